@@ -5,24 +5,54 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/qudata/agent/internal/agent"
 	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/doctor"
+	"github.com/qudata/agent/internal/imagebuild"
+	"github.com/qudata/agent/internal/ssh"
 )
 
 func main() {
-	cfg, err := config.Load()
+	// --version is also how a self-update checks that a new binary runs.
+	for _, arg := range os.Args[1:] {
+		if arg == "--version" {
+			fmt.Println(config.Version)
+			return
+		}
+	}
+
+	configPath := config.DefaultFile
+	if v := os.Getenv("QUDATA_CONFIG"); v != "" {
+		configPath = v
+	}
+	for _, arg := range os.Args[1:] {
+		if p, ok := strings.CutPrefix(arg, "--config="); ok {
+			configPath = p
+		}
+	}
+
+	cfg, err := config.Load(configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// TODO: --test mode — agent and VM ports listen on 0.0.0.0, no FRPC proxy.
-	for _, arg := range os.Args[1:] {
-		if arg == "--test" {
-			cfg.TestMode = true
+	config.ApplyFlags(cfg, os.Args[1:])
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		res := doctor.Run(context.Background(), cfg)
+		doctor.Print(os.Stdout, res)
+		if doctor.Failed(res) {
+			os.Exit(1)
 		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "build-image" {
+		os.Exit(buildImage(cfg, os.Args[2:]))
 	}
 
 	logger, err := config.NewLogger(cfg, "agent")
@@ -36,6 +66,7 @@ func main() {
 		"build_time", config.BuildTime,
 		"debug", cfg.Debug,
 		"test_mode", cfg.TestMode,
+		"backend", cfg.Backend,
 	)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -54,3 +85,35 @@ func main() {
 
 	logger.Info("agent stopped cleanly")
 }
+
+// buildImage builds the base image at the configured path, authorizing the
+// management key the agent logs in to instances with.
+func buildImage(cfg *config.Config, args []string) int {
+	opts := imagebuild.DefaultOptions()
+	opts.Output = cfg.BaseImagePath
+	opts.CacheDir = filepath.Join(cfg.ImageDir, "build")
+	if cfg.ManagementKeyPath != "" {
+		opts.PublicKey = cfg.ManagementKeyPath + ".pub"
+	} else {
+		keys, err := ssh.EnsureManagementKey(filepath.Join(cfg.DataDir, ".ssh"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "management key: %v\n", err)
+			return 1
+		}
+		opts.PublicKey = keys.PublicKeyPath
+	}
+	if err := opts.ApplyArgs(args); err != nil {
+		fmt.Fprintf(os.Stderr, "build-image: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	digest, err := imagebuild.Build(ctx, opts, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "build-image: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s  %s\n", digest, opts.Output)
+	return 0
+}
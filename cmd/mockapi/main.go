@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/qudata/agent/internal/mockapi"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8900", "listen address")
+	configPath := flag.String("config", "", "JSON file with responses and faults")
+	hostExists := flag.Bool("host-exists", false, "report the host as already registered")
+	flag.Parse()
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	cfg := mockapi.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = mockapi.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *hostExists {
+		cfg.Init.HostExists = true
+	}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mockapi.New(cfg, logger).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("mock Qudata API listening", "addr", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("mock API exited with error", "err", err)
+		os.Exit(1)
+	}
+}
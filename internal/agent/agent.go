@@ -2,16 +2,30 @@ package agent
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/qudata/agent/internal/apitls"
+	"github.com/qudata/agent/internal/baseimage"
 	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/crash"
 	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/events"
 	"github.com/qudata/agent/internal/frpc"
-	"github.com/qudata/agent/internal/gpu"
+	"github.com/qudata/agent/internal/logship"
+	"github.com/qudata/agent/internal/metering"
+	"github.com/qudata/agent/internal/metrics"
 	"github.com/qudata/agent/internal/network"
 	"github.com/qudata/agent/internal/qemu"
 	"github.com/qudata/agent/internal/qudata"
@@ -19,23 +33,71 @@ import (
 	"github.com/qudata/agent/internal/ssh"
 	"github.com/qudata/agent/internal/storage"
 	"github.com/qudata/agent/internal/system"
+	"github.com/qudata/agent/internal/tlsterm"
+	"github.com/qudata/agent/internal/tracing"
+	"github.com/qudata/agent/internal/tunnel"
+	"github.com/qudata/agent/internal/uptime"
+	"github.com/qudata/agent/internal/volume"
 )
 
 type Agent struct {
 	cfg    *config.Config
 	logger *slog.Logger
 
-	store    *storage.Store
-	api      *qudata.Client
-	mgr      *qemu.Manager
-	frpcProc *frpc.Process
-	ports    *network.PortAllocator
-
-	httpServer *server.Server
-	meta       *domain.AgentMetadata
+	store  *storage.Store
+	api    *qudata.Client
+	mgr    vmBackend
+	images *baseimage.Manager
+	tunnel tunnel.Provider
+	ports  *network.PortAllocator
+	tls    *tlsterm.Terminator
+	events *events.Publisher
+	// shipper sends warnings and errors to the API; nil when disabled.
+	shipper *logship.Shipper
+	// stopTracing flushes the spans not yet exported.
+	stopTracing func(context.Context) error
+
+	httpServer    *server.Server
+	metricsServer *server.Server
+	meta          *domain.AgentMetadata
+
+	// apiTLS serves the API under mutual TLS; nil when it is disabled.
+	apiTLS *tls.Config
+
+	// activated holds listeners inherited via systemd socket activation or
+	// from the process that re-exec'd into this one.
+	activated []net.Listener
+
+	// updateKey verifies binaries pushed through POST /update; nil disables it.
+	updateKey ed25519.PublicKey
+	// sealKey is the control plane key root passwords are sealed to; nil
+	// returns them in clear.
+	sealKey *[32]byte
+	// handingOff is set once the HTTP server is drained for a re-exec.
+	handingOff atomic.Bool
+
+	// current is the configuration the reloadable settings were last taken
+	// from; cfg keeps the one the agent started with.
+	reloadMu      sync.Mutex
+	current       *config.Config
+	statsInterval chan time.Duration
 }
 
 func New(cfg *config.Config, logger *slog.Logger) (*Agent, error) {
+	// The API client logs through the plain logger so that a failure to
+	// ship logs is not itself shipped.
+	api := qudata.NewClient(cfg.APIKey, cfg.ServiceURL, logger)
+	var shipper *logship.Shipper
+	if cfg.LogShipping {
+		shipper = logship.New(api.SendLogs, cfg.LogShippingLevel, logger)
+		logger = slog.New(shipper.Handler(logger.Handler()))
+	}
+	crash.Setup(filepath.Join(cfg.LogDir, "crash"), config.Version, logger)
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TracingEndpoint, config.Version)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
 	store, err := storage.NewStore(cfg.DataDir)
 	if err != nil {
 		return nil, fmt.Errorf("init storage: %w", err)
@@ -51,96 +113,234 @@ func New(cfg *config.Config, logger *slog.Logger) (*Agent, error) {
 		logger.Info("using management key", "path", sshKeyPath)
 	}
 
-	mgr := qemu.NewManager(qemu.Config{
-		QEMUBinary:    cfg.QEMUBinary,
-		OVMFCodePath:  cfg.OVMFCodePath,
-		OVMFVarsPath:  cfg.OVMFVarsPath,
-		BaseImagePath: cfg.BaseImagePath,
-		ImageDir:      cfg.ImageDir,
-		RunDir:        cfg.VMRunDir,
-		DataDir:       cfg.DataDir,
-		DefaultGPUs:   cfg.GPUPCIAddrs,
-		SSHKeyPath:    sshKeyPath,
-		DefaultCPUs:   cfg.VMDefaultCPUs,
-		DefaultMemory: cfg.VMDefaultMemory,
-		DiskSizeGB:    cfg.VMDiskSizeGB,
-		TestMode:      cfg.TestMode,
+	// A cap set by the control plane outlives the configured one.
+	powerCap := cfg.GPUPowerCapW
+	if pc, err := store.LoadPowerCap(); err != nil {
+		logger.Warn("failed to load GPU power cap", "err", err)
+	} else if pc != nil {
+		powerCap = pc.Watts
+	}
+
+	mgr := newBackend(cfg, qemu.Config{
+		QEMUBinary:         cfg.QEMUBinary,
+		SwtpmBinary:        cfg.SwtpmBinary,
+		Confidential:       system.Capabilities().ConfidentialMode(),
+		CVMFirmware:        cfg.ConfidentialFirmware,
+		OVMFCodePath:       cfg.OVMFCodePath,
+		OVMFVarsPath:       cfg.OVMFVarsPath,
+		OVMFSecbootCode:    cfg.OVMFSecbootCode,
+		OVMFSecbootVars:    cfg.OVMFSecbootVars,
+		BaseImagePath:      cfg.BaseImagePath,
+		ImageDir:           cfg.ImageDir,
+		RunDir:             cfg.VMRunDir,
+		DataDir:            cfg.DataDir,
+		DefaultGPUs:        cfg.GPUPCIAddrs,
+		SSHKeyPath:         sshKeyPath,
+		DefaultCPUs:        cfg.VMDefaultCPUs,
+		DefaultMemory:      cfg.VMDefaultMemory,
+		DiskSizeGB:         cfg.VMDiskSizeGB,
+		TestMode:           cfg.TestMode,
+		SecureWipe:         cfg.SecureWipe,
+		DiskEncryption:     cfg.DiskEncryption,
+		SRIOVNumVFs:        cfg.GPUSRIOVNumVFs,
+		NetworkIsolation:   cfg.NetworkIsolation,
+		NetAccounting:      cfg.NetAccounting,
+		MaxBandwidthMbps:   cfg.MaxBandwidthMbps,
+		DCGMExporterPort:   cfg.DCGMExporterPort,
+		RegistryMirrorPort: cfg.RegistryCachePort,
+		PowerCapW:          powerCap,
+		PCIDevices:         cfg.PCIDevices,
+		Disk: qemu.DiskOptions{
+			Preallocation: cfg.DiskPreallocation,
+			ClusterSize:   cfg.DiskClusterSize,
+			Cache:         cfg.DiskCache,
+			AIO:           cfg.DiskAIO,
+		},
 	}, logger)
 
-	api := qudata.NewClient(cfg.APIKey, cfg.ServiceURL, logger)
-	frpcProc := frpc.NewProcess(cfg.FRPCBinary, cfg.FRPCConfigPath, logger)
+	var imageKey ed25519.PublicKey
+	if cfg.ImagePublicKey != "" {
+		imageKey, err = baseimage.ParsePublicKey(cfg.ImagePublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_IMAGE_PUBKEY: %w", err)
+		}
+	}
+	images := baseimage.New(cfg.ImageDir, imageKey, logger)
+	images.SetConversion(cfg.BaseImageConversion, cfg.DiskClusterSize)
+	if cur := images.Current(); cur != "" {
+		mgr.SetBaseImage(cur)
+		logger.Info("using managed base image", "path", cur)
+	}
+
+	var updateKey ed25519.PublicKey
+	if cfg.UpdatePublicKey != "" {
+		updateKey, err = baseimage.ParsePublicKey(cfg.UpdatePublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_UPDATE_PUBKEY: %w", err)
+		}
+	}
+
+	var sealKey *[32]byte
+	if cfg.CredentialsPublicKey != "" {
+		sealKey, err = server.ParseSealKey(cfg.CredentialsPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_CREDENTIALS_PUBKEY: %w", err)
+		}
+	}
+
+	var tun tunnel.Provider = frpc.NewProcess(cfg.FRPCBinary, cfg.FRPCConfigPath, filepath.Join(cfg.LogDir, "frpc.log"), logger)
+	if cfg.TunnelProvider == tunnel.ProviderWireGuard {
+		wg, err := tunnel.NewWireGuard(cfg.WireGuard, logger)
+		if err != nil {
+			return nil, err
+		}
+		tun = wg
+	}
 	portAlloc := network.NewPortAllocator()
+	portAlloc.SetRanges(cfg.SSHPorts, cfg.AppPorts)
+	if err := portAlloc.Restore(store, logger); err != nil {
+		logger.Warn("unreadable port leases, starting without them", "err", err)
+	}
+	issuer := tlsterm.NewIssuer(cfg.ACMEDirectoryURL, cfg.ACMEEmail, cfg.DataDir+"/tls", api, logger)
 
 	return &Agent{
-		cfg:      cfg,
-		logger:   logger,
-		store:    store,
-		api:      api,
-		mgr:      mgr,
-		frpcProc: frpcProc,
-		ports:    portAlloc,
+		cfg:       cfg,
+		logger:    logger,
+		store:     store,
+		api:       api,
+		mgr:       mgr,
+		images:    images,
+		tunnel:    tun,
+		ports:     portAlloc,
+		tls:       tlsterm.NewTerminator(issuer, logger),
+		events:    events.NewPublisher(store, api.SendEvent, logger),
+		shipper:   shipper,
+		updateKey: updateKey,
+		sealKey:   sealKey,
+
+		stopTracing: stopTracing,
+
+		current:       cfg,
+		statsInterval: make(chan time.Duration, 1),
 	}, nil
 }
 
 func (a *Agent) Run(ctx context.Context) error {
-	a.mgr.KillOrphans()
+	if a.cfg.CrashReports {
+		crash.SetReporter(a.reportCrash)
+	}
+	hup := notifyReload()
+	go crash.Loop(ctx, "reload", func(ctx context.Context) { a.watchReload(ctx, hup) })
+	go crash.Loop(ctx, "watchdog", a.runWatchdog)
+
+	handoff := a.resumeHandoff()
+	if !a.adoptHandoff(handoff) && !a.adoptInstance() {
+		a.mgr.KillOrphans()
+	}
+	if err := a.mgr.PrepareSRIOV(); err != nil {
+		return fmt.Errorf("sr-iov: %w", err)
+	}
+
+	activated, err := server.ActivationListeners()
+	if err != nil {
+		return fmt.Errorf("socket activation: %w", err)
+	}
+	a.activated = activated
+	if len(activated) > 0 {
+		a.logger.Info("using socket-activated listeners", "count", len(activated))
+	}
+	inherited, err := server.HandoffListeners()
+	if err != nil {
+		return fmt.Errorf("handoff listeners: %w", err)
+	}
+	if len(inherited) > 0 {
+		a.logger.Info("using listeners handed over by previous process", "count", len(inherited))
+		a.activated = append(a.activated, inherited...)
+	}
 
 	meta, err := a.bootstrap(ctx)
 	if err != nil {
 		return fmt.Errorf("bootstrap: %w", err)
 	}
 	a.meta = meta
+	go crash.Loop(ctx, "events", a.events.Run)
+	if a.shipper != nil {
+		go crash.Loop(ctx, "log shipping", a.shipper.Run)
+	}
 
 	// TODO: --test mode — skip FRPC, agent accessible directly by IP.
 	if a.cfg.TestMode {
-		a.logger.Info("test mode — FRPC disabled, listening on 0.0.0.0")
+		a.logger.Info("test mode — tunnel disabled", "listen", a.cfg.ListenHost())
 	} else {
 		if meta.TunnelToken == "" {
-			return fmt.Errorf("tunnel_token not received from API — cannot start FRPC tunnel")
+			return fmt.Errorf("tunnel_token not received from API — cannot start the tunnel")
 		}
-		if err := a.frpcProc.Start(meta.ID, meta.TunnelToken, meta.Port); err != nil {
-			return fmt.Errorf("start frpc: %w", err)
+		if p, ok := a.tunnel.(*frpc.Process); ok && meta.FRP != nil {
+			if err := p.SetServers(meta.FRP); err != nil {
+				a.logger.Warn("ignoring frp servers from API, using the built-in one", "err", err)
+			}
+		}
+		if err := a.tunnel.Start(meta.ID, meta.TunnelToken, a.tunnelTargetIP(), meta.Port, a.apiTLS != nil); err != nil {
+			return fmt.Errorf("start %s tunnel: %w", a.cfg.TunnelProvider, err)
 		}
-		a.logger.Info("frpc tunnel established",
+		a.logger.Info("tunnel established",
+			"provider", a.cfg.TunnelProvider,
 			"tunnel_token", meta.TunnelToken,
 			"domain", meta.TunnelToken+frpc.DomainSuffix,
 		)
+		go crash.Loop(ctx, "tunnel monitor", func(ctx context.Context) {
+			tunnel.Monitor(ctx, a.tunnel, a.cfg.TunnelDownThreshold, a.events.Publish, a.logger)
+		})
 	}
 
-	_ = a.store.ClearInstanceState()
+	a.reconcile()
 
-	if !meta.HostExists {
-		var gpuProvider domain.GPUInfoProvider
-		if a.cfg.Debug {
-			gpuProvider = gpu.MockInfoProvider{}
-		} else {
-			gpuInfoPath := a.cfg.DataDir + "/gpu-info.json"
-			gpuProvider = &gpu.FileInfoProvider{Path: gpuInfoPath}
-		}
-		probe := system.NewProbe(gpuProvider)
-		hostReq := probe.HostRegistration(ctx)
-		a.logger.Info("registering host",
-			"gpu", hostReq.GPUName,
-			"gpu_count", hostReq.GPUAmount,
-			"vram", hostReq.VRAM,
-			"max_cuda", hostReq.MaxCUDA,
-		)
-		if err := a.api.RegisterHost(ctx, hostReq); err != nil {
-			return fmt.Errorf("register host: %w", err)
-		}
-		a.logger.Info("host registered successfully")
+	if err := a.syncHost(ctx, meta.HostExists); err != nil {
+		return err
 	}
 
-	go a.publishStats(ctx)
+	if meta.BaseImage != nil {
+		crash.Go("base image", func() { a.syncBaseImage(ctx, *meta.BaseImage) })
+	}
+	sendEvent := a.events.Publish
+	a.mgr.SetEventSink(sendEvent)
+	go crash.Loop(ctx, "stats", a.publishStats)
+	go crash.Loop(ctx, "image gc", a.runImageGC)
+	go crash.Loop(ctx, "log rotation", a.runLogRotation)
+	if a.cfg.TrimInterval > 0 {
+		go crash.Loop(ctx, "guest trim", a.runGuestTrim)
+	}
+	go crash.Loop(ctx, "clock", a.monitorClock)
+	go crash.Loop(ctx, "tls", a.tls.Run)
+	if a.cfg.RegistryCachePort > 0 {
+		go crash.Loop(ctx, "registry cache", a.runRegistryCache)
+	}
+
+	tracker, err := uptime.NewTracker(a.store)
+	if err != nil {
+		a.logger.Warn("uptime tracking disabled", "err", err)
+	} else {
+		go crash.Loop(ctx, "heartbeat", func(ctx context.Context) { a.runHeartbeat(ctx, tracker) })
+	}
+
+	meter, err := metering.NewMeter(a.store)
+	if err != nil {
+		a.logger.Warn("usage metering disabled", "err", err)
+	} else {
+		go crash.Loop(ctx, "metering", func(ctx context.Context) { a.runMetering(ctx, meter) })
+	}
 
 	a.httpServer = server.New(
-		meta.Port,
+		a.listenConfig(meta.Port),
 		meta.SecretKey,
+		a.cfg.SignedRequests,
+		a.cfg.APIRateLimit,
 		a.cfg.TestMode,
 		a.mgr,
-		a.frpcProc,
+		a.tunnel,
 		a.ports,
 		a.store,
+		a.tls,
 		a.logger,
 	)
 
@@ -150,27 +350,104 @@ func (a *Agent) Run(ctx context.Context) error {
 		"port", meta.Port,
 	)
 
-	errCh := make(chan error, 1)
+	a.httpServer.SetDecommission(a.decommission)
+	a.httpServer.SetNetTest(a.runNetTest)
+	a.httpServer.SetReload(a.Reload)
+	a.httpServer.SetEventSink(sendEvent)
+	a.events.SetLabels(a.httpServer.Labels)
+	a.httpServer.SetCreateRetries(a.cfg.CreateRetries)
+	a.httpServer.SetFlavors(a.cfg.Flavors, a.cfg.ImageDir)
+	a.httpServer.SetCredentials(a.cfg.PasswordAuth, a.sealKey)
+	a.httpServer.SetDisplay(a.cfg.VNC)
+	a.httpServer.SetPCIDevices(a.cfg.PCIDevices)
+	a.httpServer.SetUSBDevices(a.cfg.USBDevices)
+	// Simulated instances take no memory.
+	if a.cfg.Backend != config.BackendFake {
+		a.httpServer.SetMemory(a.cfg.VMDefaultMemory, a.cfg.MemoryReserveMB)
+		if a.cfg.KSM {
+			if err := system.EnableKSM(a.cfg.KSMPagesToScan); err != nil {
+				a.logger.Warn("failed to enable KSM", "err", err)
+			} else {
+				a.logger.Info("KSM enabled", "pages_to_scan", a.cfg.KSMPagesToScan)
+			}
+		}
+	}
+	a.httpServer.SetVolumes(volume.NewStore(a.cfg.ImageDir))
+	a.mgr.SetStageSink(a.httpServer.ReportStage)
+	a.httpServer.ResumeCreate()
+	// Ports the previous run held are claimed again by now; the rest
+	// belonged to an instance or create that did not survive.
+	if dropped := a.ports.DropRestored(); len(dropped) > 0 {
+		a.logger.Info("released port leases of the previous run", "leases", dropped)
+	}
+	go crash.Loop(ctx, "create worker", a.httpServer.RunCreateWorker)
+	go crash.Loop(ctx, "reaper", func(ctx context.Context) { a.httpServer.RunReaper(ctx, sendEvent) })
+	go crash.Loop(ctx, "reconciler", func(ctx context.Context) { a.httpServer.RunReconciler(ctx, sendEvent) })
+	go crash.Loop(ctx, "resource reconciler", a.runResourceReconcile)
+	if a.updateKey != nil {
+		a.httpServer.SetUpdate(a.applyUpdate)
+	}
+	if handoff != nil {
+		crash.Go("update confirm", func() { a.confirmUpdate(ctx, handoff, sendEvent) })
+	}
+
+	errCh := make(chan error, 2)
 	go func() { errCh <- a.httpServer.Start() }()
 
+	if a.cfg.MetricsAddr != "" {
+		a.metricsServer = server.NewMetrics(a.cfg.MetricsAddr, a.logger)
+		go func() { errCh <- a.metricsServer.Start() }()
+	}
+
+	a.notifySystemd("READY=1")
+
 	select {
 	case <-ctx.Done():
 		a.logger.Info("shutting down agent")
 		return a.shutdown()
 	case err := <-errCh:
+		if a.handingOff.Load() {
+			// The servers were drained for a re-exec, which replaces the
+			// process; shutting down here would stop the VM.
+			select {}
+		}
 		return fmt.Errorf("http server: %w", err)
 	}
 }
 
+// reportCrash sends a recovered panic to the API as an agent_panic event.
+func (a *Agent) reportCrash(rep crash.Report) {
+	a.events.Publish(domain.Event{
+		Type:     domain.EventAgentPanic,
+		Severity: domain.SeverityCritical,
+		Message:  "panic in " + rep.Where + ": " + rep.Panic,
+		Data: map[string]any{
+			"where":   rep.Where,
+			"panic":   rep.Panic,
+			"stack":   rep.Stack,
+			"version": rep.Version,
+			"report":  rep.File,
+		},
+		Time: rep.Time,
+	})
+}
+
 func (a *Agent) bootstrap(ctx context.Context) (*domain.AgentMetadata, error) {
 	agentID, err := a.store.AgentID()
 	if err != nil {
 		return nil, fmt.Errorf("agent id: %w", err)
 	}
 
-	agentPort, err := a.ports.AllocateOne()
-	if err != nil {
-		return nil, fmt.Errorf("allocate agent port: %w", err)
+	var agentPort int
+	if port := server.TCPPort(a.activated); port != 0 {
+		// The socket unit owns the port; keep it out of instance allocations.
+		_ = a.ports.Reserve("agent api", port)
+		agentPort = port
+	} else {
+		agentPort, err = a.ports.AllocateOne("agent api")
+		if err != nil {
+			return nil, fmt.Errorf("allocate agent port: %w", err)
+		}
 	}
 
 	address := system.PublicIP()
@@ -189,6 +466,15 @@ func (a *Agent) bootstrap(ctx context.Context) (*domain.AgentMetadata, error) {
 		PID:         os.Getpid(),
 		Version:     config.Version,
 		TestMode:    a.cfg.TestMode,
+		Encodings:   qudata.SupportedEncodings,
+	}
+	var certs *apitls.Store
+	if a.cfg.MTLS {
+		certs = apitls.New(a.cfg.DataDir + "/api-tls")
+		initReq.TLSCSR, err = certs.CSR(agentID, address, a.tunnelTargetIP())
+		if err != nil {
+			return nil, fmt.Errorf("api tls: %w", err)
+		}
 	}
 
 	a.logger.Info("initializing agent",
@@ -221,6 +507,23 @@ func (a *Agent) bootstrap(ctx context.Context) (*domain.AgentMetadata, error) {
 		}
 	}
 
+	a.api.UseEncoding(initResp.StatsEncoding)
+
+	if certs != nil {
+		// Like the secret, a certificate from an earlier /init is reused
+		// when the response carries none.
+		if initResp.APITLS != nil {
+			if err := certs.Save(*initResp.APITLS); err != nil {
+				return nil, fmt.Errorf("api tls: %w", err)
+			}
+		}
+		a.apiTLS, err = certs.ServerConfig()
+		if err != nil {
+			return nil, fmt.Errorf("mutual tls is enabled but no usable api certificate: %w", err)
+		}
+		a.logger.Info("agent api served over mutual tls")
+	}
+
 	_ = a.store.SaveAPIKey(a.cfg.APIKey)
 
 	return &domain.AgentMetadata{
@@ -230,42 +533,143 @@ func (a *Agent) bootstrap(ctx context.Context) (*domain.AgentMetadata, error) {
 		SecretKey:   secretKey,
 		TunnelToken: initResp.TunnelToken,
 		HostExists:  initResp.HostExists,
+		BaseImage:   initResp.BaseImage,
+		FRP:         initResp.FRP,
+		SpeedTest:   initResp.SpeedTest,
+		GeoIPURL:    initResp.GeoIPURL,
 	}, nil
 }
 
+// listenConfig builds the API listener set. An inherited TCP listener
+// replaces the configured TCP address.
+func (a *Agent) listenConfig(port int) server.ListenConfig {
+	lc := server.ListenConfig{
+		UnixSocket: a.cfg.ListenSocket,
+		Listeners:  a.activated,
+		TLS:        a.apiTLS,
+		GRPCAddr:   a.cfg.GRPCAddr,
+	}
+	if server.TCPPort(a.activated) == 0 {
+		lc.Addr = net.JoinHostPort(a.cfg.ListenHost(), strconv.Itoa(port))
+	}
+	return lc
+}
+
+// tunnelTargetIP returns the IP frpc uses to reach the agent API.
+func (a *Agent) tunnelTargetIP() string {
+	ip := net.ParseIP(a.cfg.ListenHost())
+	for _, l := range a.activated {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			ip = addr.IP
+			break
+		}
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return ip.String()
+}
+
+// publishStats sends a stats report every interval. Reports the API cannot
+// take are buffered and uploaded in batches once it is reachable again.
 func (a *Agent) publishStats(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(a.cfg.StatsInterval)
 	defer ticker.Stop()
 
-	errCount := 0
+	buf := newStatsBuffer(a.cfg.StatsRetention, a.cfg.StatsInterval)
+	var retryAt time.Time
+	var thermal thermalState
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case d := <-a.statsInterval:
+			ticker.Reset(d)
 		case <-ticker.C:
 			status := a.mgr.Status(ctx)
-			if status == domain.StatusDestroyed {
-				continue
+			report := domain.StatsReport{
+				Time:         time.Now().UTC(),
+				Status:       status.Status,
+				StatusReason: status.Reason,
+				Tunnel:       a.tunnel.Health(),
 			}
-
-			report := domain.StatsReport{Status: status}
-			if snap := a.mgr.CollectStats(ctx); snap != nil {
-				report.StatsSnapshot = *snap
+			if state, _ := a.store.LoadInstanceState(); state != nil {
+				report.Labels = state.Labels
+			}
+			if status.Status != domain.StatusDestroyed {
+				if snap := a.mgr.CollectStats(ctx); snap != nil {
+					report.StatsSnapshot = *snap
+				}
+			}
+			if ksm, err := system.ReadKSM(); err == nil {
+				report.KSM = ksm
+			}
+			if ifaces, err := system.ReadNetCounters(); err == nil {
+				for _, iface := range ifaces {
+					report.InetIn += iface.RxBytes
+					report.InetOut += iface.TxBytes
+				}
+			}
+			metrics.ObserveStats(report)
+			a.checkThermal(ctx, &thermal, report)
+
+			switch {
+			case status.Status == domain.StatusDestroyed:
+			case buf.len() == 0:
+				err := a.api.SendStats(ctx, report)
+				if err == nil {
+					continue
+				}
+				if qudata.Rejected(err) {
+					a.logger.Warn("stats rejected by API", "err", err)
+					continue
+				}
+				a.logger.Warn("failed to send stats, buffering until the API is back", "err", err)
+				buf.push(report)
+				retryAt = time.Now().Add(statsRetryDelay)
+				continue
+			default:
+				buf.push(report)
 			}
 
-			if err := a.api.SendStats(ctx, report); err != nil {
-				if errCount%40 == 0 {
-					a.logger.Warn("failed to send stats", "err", err)
+			if buf.len() > 0 && !time.Now().Before(retryAt) {
+				if err := a.flushStats(ctx, buf); err != nil {
+					a.logger.Debug("stats upload still failing", "buffered", buf.len(), "err", err)
+					retryAt = time.Now().Add(statsRetryDelay)
 				}
-				errCount++
-			} else {
-				errCount = 0
 			}
 		}
 	}
 }
 
+// flushStats uploads the buffered reports in batches, oldest first, and
+// stops at the first batch the API cannot take. A batch it rejects is
+// dropped so it cannot hold up the rest.
+func (a *Agent) flushStats(ctx context.Context, buf *statsBuffer) error {
+	buf.expire(time.Now())
+	sent := 0
+	for buf.len() > 0 {
+		batch := buf.peek(statsBatchSize)
+		err := a.api.SendStatsBatch(ctx, domain.StatsBatch{Reports: batch})
+		switch {
+		case err == nil:
+			sent += len(batch)
+		case qudata.Rejected(err):
+			a.logger.Error("stats batch rejected by API, dropping it", "reports", len(batch), "err", err)
+			metrics.StatsDropped.Add(float64(len(batch)))
+		default:
+			return err
+		}
+		buf.drop(len(batch))
+	}
+	if sent > 0 {
+		a.logger.Info("buffered stats delivered", "reports", sent)
+	}
+	return nil
+}
+
 func (a *Agent) shutdown() error {
+	a.notifySystemd("STOPPING=1")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -274,21 +678,48 @@ func (a *Agent) shutdown() error {
 			a.logger.Error("http server shutdown error", "err", err)
 		}
 	}
+	if a.metricsServer != nil {
+		if err := a.metricsServer.Shutdown(ctx); err != nil {
+			a.logger.Error("metrics server shutdown error", "err", err)
+		}
+	}
 
-	if err := a.frpcProc.Stop(); err != nil {
-		a.logger.Error("frpc stop error", "err", err)
+	if err := a.tunnel.Stop(); err != nil {
+		a.logger.Error("tunnel stop error", "err", err)
 	}
 
-	if !a.cfg.Debug {
+	if !a.cfg.Debug && !a.leaveVMRunning() {
 		if err := a.mgr.Stop(ctx); err != nil {
 			a.logger.Error("VM stop error", "err", err)
 		}
 	}
 
+	if err := a.stopTracing(ctx); err != nil {
+		a.logger.Warn("trace export shutdown error", "err", err)
+	}
+
 	a.logger.Info("agent stopped")
 	return nil
 }
 
+// leaveVMRunning reports whether the VM is left to the next agent process
+// on shutdown. Under systemd the agent is restarted and adopts it, so the VM
+// is only shut down with the host.
+func (a *Agent) leaveVMRunning() bool {
+	if a.cfg.Backend == config.BackendFake || os.Getenv("INVOCATION_ID") == "" || a.mgr.VMID() == "" {
+		return false
+	}
+	out, _ := exec.Command("systemctl", "is-system-running").Output()
+	if strings.TrimSpace(string(out)) == "stopping" {
+		return false
+	}
+	if state, _ := a.store.LoadInstanceState(); state != nil && state.VMID == a.mgr.VMID() {
+		a.refreshHandoff(state)
+	}
+	a.logger.Info("leaving the VM running for the next agent process", "vm_id", a.mgr.VMID())
+	return true
+}
+
 func machineFingerprint() string {
 	data, err := os.ReadFile("/etc/machine-id")
 	if err != nil {
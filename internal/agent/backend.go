@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/fakevm"
+	"github.com/qudata/agent/internal/qemu"
+)
+
+// vmBackend is the VM manager together with the host-side operations the
+// agent drives directly: qemu.Manager, or fakevm.Manager for testing.
+type vmBackend interface {
+	domain.VMManager
+
+	SetEventSink(fn func(domain.Event))
+	SetStageSink(fn func(domain.ProvisionStage))
+	SetBaseImage(path string)
+	SetMaxBandwidth(mbps int)
+	KillOrphans()
+	ReapOrphans() []domain.Drift
+	EnsureContainers(ctx context.Context) []domain.Drift
+	PrepareSRIOV() error
+	CollectGarbage(watermark float64) (qemu.GCReport, error)
+	NetCounters() (rx, tx uint64, ok bool)
+	GPUPower() (watts float64, ok bool)
+	LimitGPUClocks(ctx context.Context, mhz int) error
+	RunCommand(ctx context.Context, cmd string) ([]byte, error)
+	TrimGuest(ctx context.Context) (uint64, error)
+	Adopt(h *domain.VMHandoff) error
+}
+
+var (
+	_ vmBackend = (*qemu.Manager)(nil)
+	_ vmBackend = (*fakevm.Manager)(nil)
+)
+
+// newBackend returns the VM backend cfg selects.
+func newBackend(cfg *config.Config, qcfg qemu.Config, logger *slog.Logger) vmBackend {
+	if cfg.Backend == config.BackendFake {
+		logger.Warn("using the fake VM backend, instances are simulated")
+		return fakevm.NewManager(fakevm.Config{
+			GPUs:       cfg.GPUPCIAddrs,
+			DiskSizeGB: cfg.VMDiskSizeGB,
+			BootTime:   cfg.FakeBootTime,
+			FailReason: domain.StatusReason(cfg.FakeFailReason),
+			DataDir:    cfg.DataDir,
+			PowerCapW:  qcfg.PowerCapW,
+		}, logger)
+	}
+	return qemu.NewManager(qcfg, logger)
+}
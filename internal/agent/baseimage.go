@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// syncBaseImage fetches the base image declared by the control plane and
+// switches new instances to it. Failures are retried with backoff since the
+// agent keeps working with the previously installed image.
+func (a *Agent) syncBaseImage(ctx context.Context, spec domain.BaseImageSpec) {
+	backoff := 30 * time.Second
+	for {
+		a.logger.Info("syncing base image", "version", spec.Version)
+		path, err := a.images.Ensure(ctx, spec)
+		if err == nil {
+			a.mgr.SetBaseImage(path)
+			a.logger.Info("base image active", "version", spec.Version, "path", path)
+			return
+		}
+		a.logger.Error("base image sync failed", "version", spec.Version, "err", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Minute {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// gpuBenchmark returns the benchmark score to register the host with. The
+// stored result is reused while the hardware and the command are unchanged;
+// otherwise the benchmark is run again. nil means no score: benchmarking is
+// off, or it failed and the host registers without one.
+func (a *Agent) gpuBenchmark(ctx context.Context, fingerprint string) *domain.GPUBenchmark {
+	command := a.cfg.GPUBenchmarkCmd
+	if command == "" {
+		return nil
+	}
+	prev, err := a.store.LoadBenchmark()
+	if err != nil {
+		a.logger.Warn("unreadable GPU benchmark result, running it again", "err", err)
+	}
+	if prev != nil && prev.Fingerprint == fingerprint && prev.Command == command {
+		return prev
+	}
+	if a.mgr.VMID() != "" {
+		a.logger.Warn("instance running, GPU benchmark skipped")
+		return nil
+	}
+
+	a.logger.Info("running GPU benchmark", "command", command, "timeout", a.cfg.GPUBenchmarkTimeout)
+	res, err := a.runBenchmark(ctx, command)
+	if err != nil {
+		a.logger.Error("GPU benchmark failed, registering without a score", "err", err)
+		return nil
+	}
+	res.Fingerprint = fingerprint
+	a.logger.Info("GPU benchmark done", "score", res.Score, "unit", res.Unit, "duration_ms", res.DurationMS)
+	if err := a.store.SaveBenchmark(res); err != nil {
+		a.logger.Warn("failed to persist GPU benchmark result", "err", err)
+	}
+	return res
+}
+
+// runBenchmark boots a throwaway VM with every GPU, runs command in it over
+// SSH and destroys the VM again.
+func (a *Agent) runBenchmark(ctx context.Context, command string) (*domain.GPUBenchmark, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.GPUBenchmarkTimeout)
+	defer cancel()
+
+	sshPort, err := a.ports.AllocateSSHPort("gpu benchmark ssh")
+	if err != nil {
+		return nil, err
+	}
+	defer a.ports.Release(sshPort)
+
+	start := time.Now()
+	spec := domain.InstanceSpec{VMID: "bench-" + uuid.New().String()[:8], SSHEnabled: true}
+	if _, err := a.mgr.Create(ctx, spec, []int{sshPort}); err != nil {
+		a.mgr.Discard(spec.VMID, false)
+		_, _ = a.mgr.Destroy(context.Background(), false)
+		return nil, fmt.Errorf("boot benchmark VM: %w", err)
+	}
+	gpus := len(a.mgr.AttachedGPUs())
+	defer func() {
+		if _, err := a.mgr.Destroy(context.Background(), false); err != nil {
+			a.logger.Warn("failed to destroy benchmark VM", "err", err)
+		}
+	}()
+
+	out, err := a.mgr.RunCommand(ctx, command)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, lastLine(string(out)))
+	}
+	score, unit, err := parseBenchmark(string(out))
+	if err != nil {
+		return nil, err
+	}
+	return &domain.GPUBenchmark{
+		Command:    command,
+		Score:      score,
+		Unit:       unit,
+		GPUs:       gpus,
+		DurationMS: time.Since(start).Milliseconds(),
+		Time:       time.Now().UTC(),
+	}, nil
+}
+
+// parseBenchmark reads the score from the last non-empty line of the
+// benchmark output: either {"score": N, "unit": "..."} or a number
+// optionally followed by its unit, e.g. "312.5 TFLOPS".
+func parseBenchmark(out string) (score float64, unit string, err error) {
+	line := lastLine(out)
+	if strings.HasPrefix(line, "{") {
+		var v struct {
+			Score *float64 `json:"score"`
+			Unit  string   `json:"unit"`
+		}
+		if err := json.Unmarshal([]byte(line), &v); err != nil || v.Score == nil {
+			return 0, "", fmt.Errorf("benchmark output has no score: %q", line)
+		}
+		return *v.Score, v.Unit, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, "", fmt.Errorf("benchmark printed nothing")
+	}
+	score, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("benchmark output has no score: %q", line)
+	}
+	return score, strings.Join(fields[1:], " "), nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
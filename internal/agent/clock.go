@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
+	"github.com/qudata/agent/internal/system"
+)
+
+const clockCheckInterval = 10 * time.Minute
+
+// monitorClock periodically measures the host clock against NTP and raises a
+// clock_drift event when the offset crosses the configured threshold. Stats
+// timestamps and billing rely on the host clock, so drift is reported once on
+// entering the drifted state and again when it recovers.
+func (a *Agent) monitorClock(ctx context.Context) {
+	if a.cfg.ManageChrony {
+		restarted, err := system.EnsureChronyConfig(a.cfg.NTPServers)
+		if err != nil {
+			a.logger.Warn("chrony config not applied", "err", err)
+		} else if restarted {
+			a.logger.Info("chrony config updated", "servers", a.cfg.NTPServers)
+		}
+	}
+
+	drifted := false
+	check := func() {
+		sample, err := a.measureClock(ctx)
+		if err != nil {
+			metrics.ClockCheckErrors.Inc()
+			a.logger.Debug("clock check failed", "err", err)
+			return
+		}
+		metrics.ClockOffset.Set(sample.Offset.Seconds())
+
+		over := sample.Offset.Abs() > a.cfg.ClockDriftThreshold
+		if over == drifted {
+			return
+		}
+		drifted = over
+
+		ev := domain.Event{
+			Type:     domain.EventClockDrift,
+			Severity: domain.SeverityInfo,
+			Message:  "host clock back in sync",
+			Data: map[string]any{
+				"offset_ms":    sample.Offset.Milliseconds(),
+				"threshold_ms": a.cfg.ClockDriftThreshold.Milliseconds(),
+				"server":       sample.Server,
+			},
+			Time: time.Now().UTC(),
+		}
+		if over {
+			ev.Severity = domain.SeverityWarning
+			ev.Message = "host clock drift exceeds threshold"
+			a.logger.Warn("host clock drift", "offset", sample.Offset, "server", sample.Server)
+		} else {
+			a.logger.Info("host clock back in sync", "offset", sample.Offset)
+		}
+		a.events.Publish(ev)
+	}
+
+	check()
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// measureClock returns the first successful sample from the configured servers.
+func (a *Agent) measureClock(ctx context.Context) (system.ClockSample, error) {
+	var lastErr error
+	for _, server := range a.cfg.NTPServers {
+		sample, err := system.QueryNTP(ctx, server)
+		if err == nil {
+			return sample, nil
+		}
+		lastErr = err
+	}
+	return system.ClockSample{}, lastErr
+}
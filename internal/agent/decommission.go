@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	agentUnit     = "qudata-agent"
+	agentUnitPath = "/etc/systemd/system/" + agentUnit + ".service"
+	// decommissionExitDelay lets the response reach the control plane
+	// through the tunnel before the agent stops.
+	decommissionExitDelay = 2 * time.Second
+)
+
+// decommission unregisters the host and removes the agent's identity,
+// credentials, state and (unless retained) images and logs, then stops the
+// agent for good. It runs after the instance has been destroyed.
+func (a *Agent) decommission(ctx context.Context, opts domain.DecommissionOptions) *domain.DecommissionReport {
+	report := &domain.DecommissionReport{}
+	fail := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		a.logger.Error("decommission: " + msg)
+		report.Errors = append(report.Errors, msg)
+	}
+
+	if err := a.api.Unregister(ctx); err != nil {
+		fail("unregister: %v", err)
+	} else {
+		report.Unregistered = true
+	}
+
+	removed, err := a.store.Purge()
+	report.Removed = append(report.Removed, removed...)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	keep := map[string]bool{}
+	if opts.KeepImages {
+		keep[filepath.Clean(a.cfg.ImageDir)] = true
+	}
+	a.removeContents(a.cfg.DataDir, keep, report, fail)
+	if !opts.KeepImages {
+		a.removeContents(a.cfg.ImageDir, nil, report, fail)
+	}
+	if !opts.KeepLogs {
+		a.removeContents(a.cfg.LogDir, nil, report, fail)
+	}
+
+	// frpc keeps the tunnel up from memory until the agent stops, so the
+	// config holding the tunnel token can go now.
+	a.removePath(a.cfg.FRPCConfigPath, report, fail)
+
+	// Disabling the unit keeps a reboot from registering the host again
+	// with the API key stored in it.
+	if out, err := exec.Command("systemctl", "disable", agentUnit).CombinedOutput(); err != nil {
+		a.logger.Warn("decommission: disable unit", "err", err, "output", string(out))
+	}
+	if opts.Uninstall {
+		a.removePath(agentUnitPath, report, fail)
+		_ = exec.Command("systemctl", "daemon-reload").Run()
+	}
+
+	a.logger.Warn("host decommissioned, stopping agent",
+		"unregistered", report.Unregistered, "removed", len(report.Removed), "errors", len(report.Errors))
+	time.AfterFunc(decommissionExitDelay, a.stopForGood)
+	return report
+}
+
+func (a *Agent) removeContents(dir string, keep map[string]bool, report *domain.DecommissionReport, fail func(string, ...any)) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fail("read %s: %v", dir, err)
+		}
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if keep[path] {
+			continue
+		}
+		a.removePath(path, report, fail)
+	}
+}
+
+func (a *Agent) removePath(path string, report *domain.DecommissionReport, fail func(string, ...any)) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return
+	}
+	if err := os.RemoveAll(path); err != nil {
+		fail("remove %s: %v", path, err)
+		return
+	}
+	report.Removed = append(report.Removed, path)
+}
+
+// stopForGood stops the agent without systemd restarting it. Outside
+// systemd a SIGTERM to ourselves triggers the normal shutdown.
+func (a *Agent) stopForGood() {
+	if os.Getenv("INVOCATION_ID") != "" {
+		if err := exec.Command("systemctl", "stop", "--no-block", agentUnit).Run(); err == nil {
+			return
+		}
+	}
+	_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
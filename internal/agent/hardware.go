@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/gpu"
+	"github.com/qudata/agent/internal/system"
+)
+
+// syncHost registers the host on first start and re-registers it when the
+// hardware differs from the snapshot stored by the previous run, so that the
+// listing never keeps stale specs.
+func (a *Agent) syncHost(ctx context.Context, hostExists bool) error {
+	var gpuProvider domain.GPUInfoProvider
+	if a.cfg.Debug {
+		gpuProvider = gpu.MockInfoProvider{}
+	} else {
+		gpuInfoPath := a.cfg.DataDir + "/gpu-info.json"
+		gpuProvider = &gpu.FileInfoProvider{Path: gpuInfoPath}
+	}
+	probe := system.NewProbe(gpuProvider)
+	hostReq := probe.HostRegistration(ctx)
+	if res, err := a.store.LoadNetTest(); err == nil && res != nil {
+		hostReq.NetTest = res
+		hostReq.Configuration.EthernetIn, hostReq.Configuration.EthernetOut =
+			system.NetworkSpeed(hostReq.Configuration.NetworkInterfaces, res)
+	}
+	snap := system.Hardware(hostReq)
+	hostReq.Hardware = &snap
+
+	prev, err := a.store.LoadHardware()
+	if err != nil {
+		a.logger.Warn("unreadable hardware snapshot, replacing", "err", err)
+	}
+	var changes []domain.HardwareChange
+	if prev != nil {
+		changes = system.DiffHardware(*prev, snap)
+	}
+
+	if hostExists && len(changes) == 0 {
+		if prev == nil || prev.Fingerprint != snap.Fingerprint {
+			_ = a.store.SaveHardware(&snap)
+		}
+		return nil
+	}
+
+	if len(changes) > 0 {
+		a.logger.Warn("hardware changed since last run, re-registering host",
+			"changes", changes, "fingerprint", snap.Fingerprint)
+	}
+	if a.cfg.NetTestOnRegister {
+		res := a.measureNetwork(ctx, registrationNetTest)
+		hostReq.NetTest = res
+		hostReq.Configuration.EthernetIn, hostReq.Configuration.EthernetOut =
+			system.NetworkSpeed(hostReq.Configuration.NetworkInterfaces, res)
+	}
+	hostReq.Location = a.hostLocation(ctx)
+	hostReq.Benchmark = a.gpuBenchmark(ctx, snap.Fingerprint)
+	a.logger.Info("registering host",
+		"gpu", hostReq.GPUName,
+		"gpu_count", hostReq.GPUAmount,
+		"vram", hostReq.VRAM,
+		"max_cuda", hostReq.MaxCUDA,
+		"country", hostReq.Location.Country,
+		"city", hostReq.Location.City,
+		"kernel", hostReq.Capabilities.KernelVersion,
+		"iommu", hostReq.Capabilities.IOMMUType,
+		"ethernet_in_mbps", hostReq.Configuration.EthernetIn,
+		"ethernet_out_mbps", hostReq.Configuration.EthernetOut,
+	)
+	if err := a.api.RegisterHost(ctx, hostReq); err != nil {
+		if !hostExists {
+			return fmt.Errorf("register host: %w", err)
+		}
+		// The stale snapshot is kept, so the next start retries.
+		a.logger.Error("failed to re-register host after hardware change", "err", err)
+		return nil
+	}
+	a.logger.Info("host registered successfully")
+
+	if err := a.store.SaveHardware(&snap); err != nil {
+		a.logger.Warn("failed to persist hardware snapshot", "err", err)
+	}
+	if len(changes) > 0 {
+		ev := domain.Event{
+			Type:     domain.EventHardwareChanged,
+			Severity: domain.SeverityWarning,
+			Message:  fmt.Sprintf("%d hardware change(s) since last run, host re-registered", len(changes)),
+			Data: map[string]any{
+				"changes":          changes,
+				"fingerprint":      snap.Fingerprint,
+				"prev_fingerprint": prev.Fingerprint,
+			},
+			Time: time.Now().UTC(),
+		}
+		a.events.Publish(ev)
+	}
+	return nil
+}
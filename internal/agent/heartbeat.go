@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/uptime"
+)
+
+const (
+	heartbeatInterval = time.Minute
+	heartbeatWindow   = 30 * 24 * time.Hour
+)
+
+// runHeartbeat samples agent and instance liveness and reports measured
+// availability. Unacknowledged downtime intervals are resent until the API
+// confirms them, so a failed heartbeat loses nothing.
+func (a *Agent) runHeartbeat(ctx context.Context, tracker *uptime.Tracker) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	errCount := 0
+	for {
+		status := a.mgr.Status(ctx)
+		active, up := instanceAvailability(status.Status)
+		if err := tracker.Observe(active, up, string(status.Reason)); err != nil {
+			a.logger.Warn("failed to persist uptime state", "err", err)
+		}
+
+		acked, err := a.api.SendHeartbeat(ctx, tracker.Heartbeat(heartbeatWindow))
+		if err != nil {
+			if errCount%30 == 0 {
+				a.logger.Warn("failed to send heartbeat", "err", err)
+			}
+			errCount++
+		} else {
+			errCount = 0
+			if err := tracker.Ack(acked); err != nil {
+				a.logger.Warn("failed to persist uptime ack", "err", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// instanceAvailability maps a lifecycle status to SLA terms: active means the
+// instance is expected to serve, up means it does. Provisioning and
+// user-initiated pauses do not count against availability.
+func instanceAvailability(s domain.InstanceStatus) (active, up bool) {
+	switch s {
+	case domain.StatusRunning:
+		return true, true
+	case domain.StatusDegraded, domain.StatusFailed:
+		return true, false
+	default:
+		return false, false
+	}
+}
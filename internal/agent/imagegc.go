@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/metrics"
+)
+
+const imageGCInterval = 15 * time.Minute
+
+// runImageGC periodically removes orphan instance disks and, above the
+// configured watermark, unused base image versions.
+func (a *Agent) runImageGC(ctx context.Context) {
+	ticker := time.NewTicker(imageGCInterval)
+	defer ticker.Stop()
+
+	for {
+		report, err := a.mgr.CollectGarbage(a.cfg.ImageGCWatermark)
+		if err != nil {
+			a.logger.Warn("image gc failed", "err", err)
+		}
+		metrics.ImageDiskUsage.Set(report.UsagePercent)
+		if len(report.Removed) > 0 {
+			metrics.ImageGCRemoved.Add(float64(len(report.Removed)))
+			metrics.ImageGCReclaimed.Add(float64(report.ReclaimedBytes))
+			a.logger.Info("image gc reclaimed space",
+				"files", report.Removed,
+				"bytes", report.ReclaimedBytes,
+				"usage_percent", report.UsagePercent,
+			)
+		}
+		if report.UsagePercent > a.cfg.ImageGCWatermark {
+			a.logger.Warn("image disk usage above watermark",
+				"usage_percent", report.UsagePercent,
+				"watermark", a.cfg.ImageGCWatermark,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
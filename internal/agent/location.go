@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/system"
+)
+
+// locationTTL is how long a GeoIP lookup is reused for an unchanged IP.
+const locationTTL = 30 * 24 * time.Hour
+
+// hostLocation returns the location to register the host with: the
+// configured one when set, otherwise a GeoIP lookup of the public IP,
+// cached in the store. A failed lookup falls back to the cached location,
+// however old, and then to an empty one.
+func (a *Agent) hostLocation(ctx context.Context) domain.HostLocation {
+	if a.cfg.Location != (domain.HostLocation{}) {
+		return a.cfg.Location
+	}
+	geoURL := a.cfg.GeoIPURL
+	ip := ""
+	if a.meta != nil {
+		ip = a.meta.Address
+		if a.meta.GeoIPURL != "" {
+			geoURL = a.meta.GeoIPURL
+		}
+	}
+
+	cached, err := a.store.LoadLocation()
+	if err != nil {
+		a.logger.Warn("unreadable cached location", "err", err)
+	}
+	if geoURL == "" || ip == "" || ip == "0.0.0.0" {
+		if cached != nil {
+			return cached.HostLocation
+		}
+		return domain.HostLocation{}
+	}
+	if cached != nil && cached.IP == ip && time.Since(cached.Time) < locationTTL {
+		return cached.HostLocation
+	}
+
+	loc, err := system.LookupLocation(ctx, geoURL, ip)
+	if err != nil {
+		a.logger.Warn("host location lookup failed", "ip", ip, "err", err)
+		if cached != nil {
+			return cached.HostLocation
+		}
+		return domain.HostLocation{}
+	}
+	a.logger.Info("host location detected", "ip", ip, "city", loc.City, "region", loc.Region, "country", loc.Country)
+	if err := a.store.SaveLocation(&domain.GeoLocation{HostLocation: loc, IP: ip, Time: time.Now().UTC()}); err != nil {
+		a.logger.Warn("failed to persist host location", "err", err)
+	}
+	return loc
+}
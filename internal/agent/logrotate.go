@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/qudata/agent/internal/logfile"
+)
+
+const logRotateInterval = time.Minute
+
+// runLogRotation rotates the logs of frpc and of the QEMU processes and
+// guest serial consoles, which are written to directly. The agent's own log rotates itself.
+func (a *Agent) runLogRotation(ctx context.Context) {
+	rotator := logfile.NewRotator(a.cfg.LogRotation)
+	ticker := time.NewTicker(logRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		paths, _ := filepath.Glob(filepath.Join(a.cfg.VMRunDir, "*.log"))
+		paths = append(paths, filepath.Join(a.cfg.LogDir, "frpc.log"))
+		if err := rotator.CheckAll(paths); err != nil {
+			a.logger.Warn("log rotation failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
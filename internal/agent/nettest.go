@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+	"github.com/qudata/agent/internal/nettest"
+	"github.com/qudata/agent/internal/system"
+)
+
+// registrationNetTest bounds the network test run before registration.
+var registrationNetTest = nettest.Options{Duration: 10 * time.Second, MaxBytes: 64 << 20}
+
+// runNetTest measures the network and reports the result as a host update.
+func (a *Agent) runNetTest(ctx context.Context, opts nettest.Options) (*domain.NetTestResult, error) {
+	res := a.measureNetwork(ctx, opts)
+	update := domain.HostUpdate{NetTest: res}
+	update.EthernetIn, update.EthernetOut = system.NetworkSpeed(system.Uplinks(), res)
+	if err := a.api.UpdateHost(ctx, update); err != nil {
+		a.logger.Warn("failed to report network test", "err", err)
+	}
+	return res, nil
+}
+
+// measureNetwork measures the path to the FRP server, the API and the
+// speedtest endpoints from the control plane, and persists the result for
+// later host registrations.
+func (a *Agent) measureNetwork(ctx context.Context, opts nettest.Options) *domain.NetTestResult {
+	var targets []nettest.Target
+	if !a.cfg.TestMode {
+		frpURL := a.cfg.NetTestFRPURL
+		if frpURL == "" {
+			frpURL = "https://" + frpc.FRPServerAddr
+		}
+		targets = append(targets, nettest.Target{
+			Name:    "frp",
+			BaseURL: frpURL,
+			Addr:    net.JoinHostPort(frpc.FRPServerAddr, strconv.Itoa(frpc.FRPServerPort)),
+		})
+	}
+	targets = append(targets, nettest.Target{
+		Name:    "api",
+		BaseURL: a.api.BaseURL(),
+		Header:  a.api.AuthHeader(),
+	})
+	if a.meta != nil {
+		for _, ep := range a.meta.SpeedTest {
+			targets = append(targets, nettest.Target{Name: ep.Name, BaseURL: strings.TrimRight(ep.URL, "/")})
+		}
+	}
+
+	res := nettest.Run(ctx, targets, opts)
+	for _, t := range res.Targets {
+		a.logger.Info("network test",
+			"target", t.Name,
+			"latency_ms", t.LatencyMS,
+			"download_mbps", t.DownloadMbps,
+			"upload_mbps", t.UploadMbps,
+			"error", t.Error,
+		)
+	}
+
+	if err := a.store.SaveNetTest(&res); err != nil {
+		a.logger.Warn("failed to persist network test", "err", err)
+	}
+	return &res
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+)
+
+// resourceReconcileInterval is how often runResourceReconcile compares the
+// instance state with the host.
+const resourceReconcileInterval = time.Minute
+
+// instancePortPurpose prefixes the purpose of every port lease held for the
+// instance.
+const instancePortPurpose = "instance"
+
+// adoptInstance takes over the VM recorded in the instance state, which
+// keeps running when the agent crashes or is restarted. It returns false if
+// there is none to adopt; simulated VMs end with the agent.
+func (a *Agent) adoptInstance() bool {
+	if a.cfg.Backend == config.BackendFake {
+		return false
+	}
+	state, err := a.store.LoadInstanceState()
+	if err != nil || state == nil || state.VM == nil {
+		return false
+	}
+	if err := a.mgr.Adopt(state.VM); err != nil {
+		a.logger.Warn("could not adopt the VM of the instance", "vm_id", state.VM.VMID, "err", err)
+		return false
+	}
+	a.logger.Info("adopted VM left running by the previous agent process", "vm_id", state.VM.VMID)
+	return true
+}
+
+// refreshHandoff records what adopting the VM takes when it changed since
+// the state was saved, as after a resize or a power change.
+func (a *Agent) refreshHandoff(state *domain.InstanceState) {
+	h := a.mgr.Handoff()
+	// Compared encoded: times and empty collections do not survive the
+	// round trip through the store unchanged.
+	was, _ := json.Marshal(state.VM)
+	now, _ := json.Marshal(h)
+	if bytes.Equal(was, now) {
+		return
+	}
+	state.VM = h
+	if err := a.store.SaveInstanceState(state); err != nil {
+		a.logger.Warn("reconcile: save VM handoff", "err", err)
+	}
+}
+
+// reconcile compares the persisted instance state with the running VM, the
+// tunnel proxy set and the port allocator, and repairs any divergence left by a
+// crash between a proxy update and the state write (or vice versa).
+func (a *Agent) reconcile() {
+	state, err := a.store.LoadInstanceState()
+	if err != nil {
+		a.logger.Warn("reconcile: unreadable instance state, discarding", "err", err)
+		_ = a.store.ClearInstanceState()
+		state = nil
+	}
+
+	configured := a.tunnel.InstanceProxies()
+	vmID := a.mgr.VMID()
+
+	if state == nil {
+		if len(configured) > 0 {
+			a.logger.Warn("reconcile: tunnel has instance proxies but no instance state, clearing",
+				"proxies", len(configured))
+			if err := a.tunnel.ClearInstanceProxies(); err != nil {
+				a.logger.Error("reconcile: clear tunnel proxies", "err", err)
+			}
+		}
+		return
+	}
+
+	if vmID == "" || state.VMID != vmID {
+		a.logger.Warn("reconcile: instance state refers to a VM that is not running, releasing",
+			"state_vm_id", state.VMID,
+			"running_vm_id", vmID,
+			"proxies", len(state.Proxies),
+			"ports", state.AllocatedPorts,
+		)
+		if len(configured) > 0 {
+			if err := a.tunnel.ClearInstanceProxies(); err != nil {
+				a.logger.Error("reconcile: clear tunnel proxies", "err", err)
+			}
+		}
+		for _, p := range state.AllocatedPorts {
+			if a.ports.Allocated(p) {
+				a.ports.Release(p)
+			}
+		}
+		if err := a.store.ClearInstanceState(); err != nil {
+			a.logger.Error("reconcile: clear instance state", "err", err)
+		}
+		return
+	}
+
+	// The ports are usually held by the leases restored from the previous
+	// run; reserving them again keeps them past DropRestored.
+	if len(state.AllocatedPorts) > 0 {
+		if err := a.ports.Reserve("instance", state.AllocatedPorts...); err != nil {
+			a.logger.Error("reconcile: restore port reservations", "err", err)
+		} else {
+			a.logger.Info("reconcile: restored port reservations", "ports", state.AllocatedPorts)
+		}
+	}
+
+	// TLS terminators live in the agent process; bring them back up for the
+	// re-adopted instance from the cached certificates.
+	for _, ep := range state.TLSEndpoints {
+		go func() {
+			if err := a.tls.Start(context.Background(), ep); err != nil {
+				a.logger.Error("reconcile: restart tls terminator", "domain", ep.Domain, "err", err)
+			}
+		}()
+	}
+
+	want := make([]frpc.Proxy, 0, len(state.Proxies))
+	for _, m := range state.Proxies {
+		want = append(want, frpc.ProxyFromMapping(m))
+	}
+	if !frpc.SameProxies(configured, want) {
+		a.logger.Warn("reconcile: tunnel proxies diverge from instance state, reapplying",
+			"configured", len(configured),
+			"persisted", len(want),
+		)
+		if err := a.tunnel.SetInstanceProxies(want); err != nil {
+			a.logger.Error("reconcile: reapply tunnel proxies", "err", err)
+		}
+	}
+}
+
+// runResourceReconcile repairs drift between the instance state and the host
+// every resourceReconcileInterval, as reconcile does once at startup. Passes
+// that find a create, delete or migration in flight are skipped.
+func (a *Agent) runResourceReconcile(ctx context.Context) {
+	ticker := time.NewTicker(resourceReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.httpServer.WhileIdle(func() { a.reconcileResources(ctx) })
+		}
+	}
+}
+
+// reconcileResources runs one pass and publishes an event for each action.
+func (a *Agent) reconcileResources(ctx context.Context) {
+	drift := a.mgr.ReapOrphans()
+	drift = append(drift, a.reconcileInstanceState()...)
+	drift = append(drift, a.mgr.EnsureContainers(ctx)...)
+
+	for _, d := range drift {
+		a.logger.Warn("reconcile: repaired drift", "kind", d.Kind, "detail", d.Detail, "action", d.Action, "err", d.Error)
+		a.events.Publish(domain.Event{
+			Type:     domain.EventResourceRepaired,
+			Severity: domain.SeverityWarning,
+			Message:  fmt.Sprintf("%s: %s (%s)", d.Kind, d.Detail, d.Action),
+			Data: map[string]any{
+				"kind":   d.Kind,
+				"detail": d.Detail,
+				"action": d.Action,
+				"error":  d.Error,
+			},
+			Time: time.Now().UTC(),
+		})
+	}
+}
+
+// reconcileInstanceState checks the instance state against the VM, the
+// port leases and the tunnel proxies.
+func (a *Agent) reconcileInstanceState() []domain.Drift {
+	state, err := a.store.LoadInstanceState()
+	if err != nil {
+		a.logger.Warn("reconcile: unreadable instance state", "err", err)
+		return nil
+	}
+
+	var drift []domain.Drift
+	add := func(kind, detail, action string, err error) {
+		d := domain.Drift{Kind: kind, Detail: detail, Action: action}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		drift = append(drift, d)
+	}
+
+	vmID := a.mgr.VMID()
+	if state != nil && state.VMID != vmID {
+		err := a.store.ClearInstanceState()
+		add("instance_state", "instance state refers to VM "+state.VMID+", which is not running", "clear_state", err)
+		if err == nil {
+			state = nil
+		}
+	}
+
+	if state != nil {
+		a.refreshHandoff(state)
+	}
+
+	var want []int
+	var proxies []frpc.Proxy
+	if state != nil {
+		want = state.AllocatedPorts
+		for _, m := range state.Proxies {
+			proxies = append(proxies, frpc.ProxyFromMapping(m))
+		}
+	}
+	var missing []int
+	for _, p := range want {
+		if !a.ports.Allocated(p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		err := a.ports.Reserve(instancePortPurpose, missing...)
+		add("ports", fmt.Sprintf("instance ports %v are not reserved", missing), "reserve", err)
+	}
+	var leaked []int
+	for _, l := range a.ports.Leases() {
+		if strings.HasPrefix(l.Purpose, instancePortPurpose) && !slices.Contains(want, l.Port) {
+			leaked = append(leaked, l.Port)
+		}
+	}
+	if len(leaked) > 0 {
+		a.ports.Release(leaked...)
+		add("ports", fmt.Sprintf("ports %v are leased for no instance", leaked), "release", nil)
+	}
+
+	if !a.cfg.TestMode && !frpc.SameProxies(a.tunnel.InstanceProxies(), proxies) {
+		var err error
+		if len(proxies) == 0 {
+			err = a.tunnel.ClearInstanceProxies()
+		} else {
+			err = a.tunnel.SetInstanceProxies(proxies)
+		}
+		add("proxies", "tunnel proxies differ from the instance state", "reapply_proxies", err)
+	}
+	return drift
+}
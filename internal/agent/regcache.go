@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	"github.com/qudata/agent/internal/regcache"
+)
+
+// runRegistryCache serves the pull-through registry cache on the loopback
+// port guests reach it through until ctx is done.
+func (a *Agent) runRegistryCache(ctx context.Context) {
+	dir := a.cfg.RegistryCacheDir
+	if dir == "" {
+		dir = filepath.Join(a.cfg.DataDir, "registry-cache")
+	}
+	cache, err := regcache.New(regcache.Config{
+		Dir:      dir,
+		Upstream: a.cfg.RegistryCacheUpstream,
+		MaxBytes: int64(a.cfg.RegistryCacheMaxGB) << 30,
+	}, a.logger)
+	if err != nil {
+		a.logger.Error("registry cache disabled", "dir", dir, "err", err)
+		return
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(a.cfg.RegistryCachePort))
+	if err := cache.ListenAndServe(ctx, addr); err != nil {
+		a.logger.Error("registry cache stopped", "addr", addr, "err", err)
+	}
+}
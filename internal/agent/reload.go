@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// reloadable are the Config fields Reload applies at runtime; changes to any
+// other field only take effect after a restart.
+var reloadable = map[string]bool{
+	"LogLevel":         true,
+	"StatsInterval":    true,
+	"MaxBandwidthMbps": true,
+	"SSHPorts":         true,
+	"AppPorts":         true,
+	"Flavors":          true,
+	"File":             true,
+}
+
+// watchReload reloads the configuration on every SIGHUP.
+func (a *Agent) watchReload(ctx context.Context, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if _, err := a.Reload(); err != nil {
+				a.logger.Error("configuration reload failed, keeping current settings", "err", err)
+			}
+		}
+	}
+}
+
+// Reload re-reads the config file and the environment and applies the
+// reloadable settings. Nothing is applied if the new configuration is
+// invalid. Restarting would tear down the tunnel, so settings that need it
+// are only reported.
+func (a *Agent) Reload() (*domain.ReloadResult, error) {
+	next, err := config.Load(a.cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("load configuration: %w", err)
+	}
+	config.ApplyFlags(next, os.Args[1:])
+
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	prev := a.current
+	res := &domain.ReloadResult{Applied: []string{}, RestartRequired: restartRequired(a.cfg, next)}
+
+	if next.Level() != prev.Level() {
+		config.SetLogLevel(next.Level())
+		res.Applied = append(res.Applied, "LogLevel")
+	}
+	if next.StatsInterval != prev.StatsInterval {
+		a.setStatsInterval(next.StatsInterval)
+		res.Applied = append(res.Applied, "StatsInterval")
+	}
+	if next.MaxBandwidthMbps != prev.MaxBandwidthMbps {
+		a.mgr.SetMaxBandwidth(next.MaxBandwidthMbps)
+		res.Applied = append(res.Applied, "MaxBandwidthMbps")
+	}
+	if next.SSHPorts != prev.SSHPorts || next.AppPorts != prev.AppPorts {
+		a.ports.SetRanges(next.SSHPorts, next.AppPorts)
+		if next.SSHPorts != prev.SSHPorts {
+			res.Applied = append(res.Applied, "SSHPorts")
+		}
+		if next.AppPorts != prev.AppPorts {
+			res.Applied = append(res.Applied, "AppPorts")
+		}
+	}
+	if !reflect.DeepEqual(next.Flavors, prev.Flavors) && a.httpServer != nil {
+		a.httpServer.SetFlavors(next.Flavors, a.cfg.ImageDir)
+		res.Applied = append(res.Applied, "Flavors")
+	}
+	a.current = next
+
+	a.logger.Info("configuration reloaded",
+		"file", next.File,
+		"applied", res.Applied,
+		"restart_required", res.RestartRequired,
+		"log_level", next.Level().String(),
+		"stats_interval", next.StatsInterval.String(),
+		"max_bandwidth_mbps", next.MaxBandwidthMbps,
+		"ssh_ports", next.SSHPorts.String(),
+		"app_ports", next.AppPorts.String(),
+	)
+	return res, nil
+}
+
+// setStatsInterval hands a new interval to publishStats, replacing one it
+// has not picked up yet.
+func (a *Agent) setStatsInterval(d time.Duration) {
+	select {
+	case <-a.statsInterval:
+	default:
+	}
+	a.statsInterval <- d
+}
+
+// restartRequired lists the fields other than the reloadable ones that differ
+// between the running and the reloaded configuration.
+func restartRequired(running, next *config.Config) []string {
+	out := []string{}
+	rv, nv := reflect.ValueOf(running).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name := rv.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// notifyReload subscribes to SIGHUP, which would otherwise terminate the
+// agent.
+func notifyReload() <-chan os.Signal {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return hup
+}
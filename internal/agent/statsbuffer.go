@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+const (
+	// maxBufferedStats bounds the buffer whatever the retention and
+	// interval, at a few megabytes.
+	maxBufferedStats = 10000
+	// statsBatchSize is the most reports one batch upload carries.
+	statsBatchSize = 500
+	// statsRetryDelay spaces out flush attempts while the API is down.
+	statsRetryDelay = 10 * time.Second
+)
+
+// statsBuffer is a ring of the stats reports that could not be sent. When
+// full, the oldest report is overwritten; reports older than retention are
+// dropped before each flush.
+type statsBuffer struct {
+	retention time.Duration
+	ring      []domain.StatsReport
+	start     int
+	n         int
+}
+
+// newStatsBuffer sizes the ring to hold retention worth of reports taken
+// every interval.
+func newStatsBuffer(retention, interval time.Duration) *statsBuffer {
+	size := int(retention / interval)
+	size = max(1, min(size, maxBufferedStats))
+	return &statsBuffer{retention: retention, ring: make([]domain.StatsReport, size)}
+}
+
+func (b *statsBuffer) len() int { return b.n }
+
+func (b *statsBuffer) push(r domain.StatsReport) {
+	if b.n == len(b.ring) {
+		b.ring[b.start] = r
+		b.start = (b.start + 1) % len(b.ring)
+		metrics.StatsDropped.Inc()
+	} else {
+		b.ring[(b.start+b.n)%len(b.ring)] = r
+		b.n++
+	}
+	metrics.StatsBuffered.Set(float64(b.n))
+}
+
+// expire drops the reports older than the retention.
+func (b *statsBuffer) expire(now time.Time) {
+	for b.n > 0 && now.Sub(b.ring[b.start].Time) > b.retention {
+		b.drop(1)
+		metrics.StatsDropped.Inc()
+	}
+}
+
+// peek returns up to max of the oldest reports without removing them.
+func (b *statsBuffer) peek(max int) []domain.StatsReport {
+	out := make([]domain.StatsReport, 0, min(max, b.n))
+	for i := 0; i < b.n && i < max; i++ {
+		out = append(out, b.ring[(b.start+i)%len(b.ring)])
+	}
+	return out
+}
+
+// drop removes the k oldest reports.
+func (b *statsBuffer) drop(k int) {
+	k = min(k, b.n)
+	for i := 0; i < k; i++ {
+		b.ring[(b.start+i)%len(b.ring)] = domain.StatsReport{}
+	}
+	b.start = (b.start + k) % len(b.ring)
+	b.n -= k
+	metrics.StatsBuffered.Set(float64(b.n))
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+const (
+	// thermalHysteresis is how far below the critical temperature the GPUs
+	// must cool before a clock limit is lifted.
+	thermalHysteresis = 5
+	// thermalPauseCooldown is how long a VM paused for its temperature stays
+	// paused. A paused guest cannot report its temperature, so it is resumed
+	// after a fixed time and paused again if it is still hot.
+	thermalPauseCooldown = 5 * time.Minute
+)
+
+// thermalState is the thermal watchdog's view of the instance, carried
+// between stats samples.
+type thermalState struct {
+	// hotSince is when the GPUs last went over the critical temperature.
+	hotSince time.Time
+	// action is the protection in force, empty when there is none.
+	action  string
+	actedAt time.Time
+}
+
+// checkThermal acts on a stats report: when the GPUs stay at or above the
+// critical temperature for the configured duration the instance is throttled
+// or paused and a thermal_event is raised, and the protection is lifted once
+// they cool down.
+func (a *Agent) checkThermal(ctx context.Context, st *thermalState, report domain.StatsReport) {
+	critical := a.cfg.GPUCriticalTemp
+	if critical == 0 {
+		return
+	}
+	now := time.Now()
+
+	if report.Status == domain.StatusDestroyed {
+		*st = thermalState{}
+		return
+	}
+
+	switch st.action {
+	case "":
+		if report.Status != domain.StatusRunning || report.GPUTemp < critical {
+			st.hotSince = time.Time{}
+			return
+		}
+		if st.hotSince.IsZero() {
+			st.hotSince = now
+		}
+		if now.Sub(st.hotSince) < a.cfg.GPUCriticalDuration {
+			return
+		}
+
+		action := a.cfg.GPUThermalAction
+		var err error
+		if action == config.ThermalPause {
+			err = a.mgr.Manage(ctx, domain.CommandStop)
+		} else {
+			err = a.mgr.LimitGPUClocks(ctx, a.cfg.GPUThrottleClockMHz)
+		}
+		if err != nil {
+			a.logger.Error("thermal protection failed", "action", action, "gpu_temp", report.GPUTemp, "err", err)
+			return
+		}
+		st.action, st.actedAt = action, now
+		metrics.GPUThermalActions.WithLabelValues(action).Inc()
+
+		data := map[string]any{
+			"action":        action,
+			"gpu_temp":      report.GPUTemp,
+			"critical_temp": critical,
+			"hot_seconds":   int(now.Sub(st.hotSince).Seconds()),
+		}
+		msg := "GPU overheating, instance paused"
+		if action == config.ThermalThrottle {
+			data["clock_mhz"] = a.cfg.GPUThrottleClockMHz
+			msg = "GPU overheating, clocks limited"
+		}
+		a.logger.Warn(msg, "gpu_temp", report.GPUTemp, "critical_temp", critical)
+		a.events.Publish(domain.Event{
+			Type:     domain.EventThermal,
+			Severity: domain.SeverityCritical,
+			Message:  msg,
+			Data:     data,
+			Time:     now.UTC(),
+		})
+
+	case config.ThermalThrottle:
+		if report.Status != domain.StatusRunning || report.GPUTemp == 0 || report.GPUTemp > critical-thermalHysteresis {
+			return
+		}
+		if err := a.mgr.LimitGPUClocks(ctx, 0); err != nil {
+			a.logger.Warn("failed to lift GPU clock limit", "err", err)
+			return
+		}
+		a.liftThermal(st, report.GPUTemp, "GPU temperature back to normal, clock limit lifted")
+
+	case config.ThermalPause:
+		if report.Status != domain.StatusPaused {
+			// Started again through the API; the watchdog rearms.
+			a.liftThermal(st, 0, "instance resumed during thermal pause")
+			return
+		}
+		if now.Sub(st.actedAt) < thermalPauseCooldown {
+			return
+		}
+		if err := a.mgr.Manage(ctx, domain.CommandStart); err != nil {
+			a.logger.Warn("failed to resume instance after thermal pause", "err", err)
+			return
+		}
+		a.liftThermal(st, 0, "thermal pause over, instance resumed")
+	}
+}
+
+// liftThermal clears the protection in force and reports it with severity
+// info. temp is the GPU temperature that allowed it, 0 when unknown.
+func (a *Agent) liftThermal(st *thermalState, temp int, msg string) {
+	data := map[string]any{
+		"action":        st.action,
+		"critical_temp": a.cfg.GPUCriticalTemp,
+		"seconds":       int(time.Since(st.actedAt).Seconds()),
+	}
+	if temp > 0 {
+		data["gpu_temp"] = temp
+	}
+	*st = thermalState{}
+
+	a.logger.Info(msg)
+	a.events.Publish(domain.Event{
+		Type:     domain.EventThermal,
+		Severity: domain.SeverityInfo,
+		Message:  msg,
+		Data:     data,
+		Time:     time.Now().UTC(),
+	})
+}
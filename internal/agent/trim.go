@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+// guestTrimTimeout bounds one fstrim run; trimming a large, fragmented
+// filesystem for the first time can take minutes.
+const guestTrimTimeout = 30 * time.Minute
+
+// runGuestTrim periodically runs fstrim in the guest, so that space the
+// guest freed is released by the disk images on the host. The first run is
+// one interval after startup.
+func (a *Agent) runGuestTrim(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.TrimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if a.mgr.Status(ctx).Status != domain.StatusRunning {
+			continue
+		}
+		trimCtx, cancel := context.WithTimeout(ctx, guestTrimTimeout)
+		trimmed, err := a.mgr.TrimGuest(trimCtx)
+		cancel()
+		var errNoInstanceRunning domain.ErrNoInstanceRunning
+		switch {
+		case errors.As(err, &errNoInstanceRunning):
+		case err != nil:
+			a.logger.Warn("guest fstrim failed", "err", err)
+		default:
+			metrics.GuestTrimmed.Add(float64(trimmed))
+			a.logger.Info("guest fstrim done", "bytes", trimmed)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/server"
+)
+
+const (
+	// updateExecDelay lets the 202 reach the control plane before the HTTP
+	// server is drained.
+	updateExecDelay = 2 * time.Second
+	// updateConfirmAfter is how long the new binary must serve before the
+	// update is confirmed and the previous binary removed.
+	updateConfirmAfter  = 10 * time.Second
+	updateDrainTimeout  = 10 * time.Second
+	versionCheckTimeout = 10 * time.Second
+	backupSuffix        = ".prev"
+)
+
+// applyUpdate downloads and verifies the binary in spec, installs it in
+// place of the running one and schedules the re-exec. The previous binary is
+// kept until the new one confirms.
+func (a *Agent) applyUpdate(ctx context.Context, spec domain.UpdateSpec) error {
+	if !strings.HasPrefix(spec.URL, "https://") && !(a.cfg.TestMode && strings.HasPrefix(spec.URL, "http://")) {
+		return fmt.Errorf("unsupported update url %q: https required", spec.URL)
+	}
+	want, err := hex.DecodeString(strings.ToLower(spec.SHA256))
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("invalid sha256 %q", spec.SHA256)
+	}
+	sig, err := base64.StdEncoding.DecodeString(spec.Signature)
+	if err != nil || spec.Signature == "" {
+		return fmt.Errorf("update %s is not signed", spec.Version)
+	}
+	if !ed25519.Verify(a.updateKey, want, sig) {
+		return fmt.Errorf("update %s: signature mismatch", spec.Version)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate agent binary: %w", err)
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return fmt.Errorf("locate agent binary: %w", err)
+	}
+
+	staged, err := a.downloadBinary(ctx, spec.URL, filepath.Dir(binary), want)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(ctx, staged, spec.Version); err != nil {
+		_ = os.Remove(staged)
+		return err
+	}
+
+	backup := binary + backupSuffix
+	if err := os.Rename(binary, backup); err != nil {
+		_ = os.Remove(staged)
+		return fmt.Errorf("back up agent binary: %w", err)
+	}
+	if err := os.Rename(staged, binary); err != nil {
+		_ = os.Rename(backup, binary)
+		_ = os.Remove(staged)
+		return fmt.Errorf("install agent binary: %w", err)
+	}
+
+	pending := &domain.PendingUpdate{
+		FromVersion: config.Version,
+		ToVersion:   spec.Version,
+		Binary:      binary,
+		Backup:      backup,
+	}
+	a.logger.Info("agent update installed, re-executing",
+		"from", pending.FromVersion, "to", pending.ToVersion, "delay", updateExecDelay)
+	time.AfterFunc(updateExecDelay, func() { a.reexec(pending) })
+	return nil
+}
+
+func (a *Agent) downloadBinary(ctx context.Context, url, dir string, want []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("download update: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download update: unexpected status %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".qudata-agent-update-*")
+	if err != nil {
+		return "", err
+	}
+	path := tmp.Name()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			err = fmt.Errorf("checksum mismatch: got %x, want %x", got, want)
+		}
+	}
+	if err == nil {
+		err = os.Chmod(path, 0o755)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", fmt.Errorf("download update: %w", err)
+	}
+	return path, nil
+}
+
+// checkVersion runs the new binary with --version, which catches binaries
+// for the wrong architecture or with missing libraries before the switch.
+func checkVersion(ctx context.Context, path, want string) error {
+	ctx, cancel := context.WithTimeout(ctx, versionCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary does not run: %w", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != want {
+		return fmt.Errorf("new binary reports version %q, want %q", got, want)
+	}
+	return nil
+}
+
+// reexec hands the VM, frpc and the API listeners over to the installed
+// binary and replaces the process with it. The pid stays the same, so QEMU
+// and frpc remain our children and systemd does not notice.
+func (a *Agent) reexec(pending *domain.PendingUpdate) {
+	files, fds := a.inheritableListeners()
+
+	h := &domain.Handoff{VM: a.mgr.Handoff(), FRPCPID: a.tunnel.PID(), Update: pending}
+	if err := a.store.SaveHandoff(h); err != nil {
+		a.logger.Error("save handoff", "err", err)
+	}
+
+	a.handingOff.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), updateDrainTimeout)
+	_ = a.httpServer.Shutdown(ctx)
+	if a.metricsServer != nil {
+		_ = a.metricsServer.Shutdown(ctx)
+	}
+	cancel()
+	a.tls.StopAll()
+
+	env := append(os.Environ(), server.HandoffEnv+"="+strings.Join(fds, ","))
+	err := syscall.Exec(pending.Binary, os.Args, env)
+
+	// Exec only returns on failure. The API is already down, so restore the
+	// previous binary and let systemd restart the agent.
+	a.logger.Error("re-exec into new binary failed, rolling back", "err", err)
+	for _, f := range files {
+		f.Close()
+	}
+	if err := os.Rename(pending.Backup, pending.Binary); err != nil {
+		a.logger.Error("restore previous binary", "err", err)
+	}
+	_ = a.store.ClearHandoff()
+	os.Exit(1)
+}
+
+// inheritableListeners duplicates the API's TCP listeners without
+// close-on-exec so that they survive the exec.
+func (a *Agent) inheritableListeners() ([]*os.File, []string) {
+	var files []*os.File
+	var fds []string
+	for _, l := range a.httpServer.Listeners() {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			a.logger.Warn("listener not handed over", "addr", l.Addr(), "err", err)
+			continue
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+			a.logger.Warn("listener not handed over", "addr", l.Addr(), "err", errno)
+			f.Close()
+			continue
+		}
+		files = append(files, f)
+		fds = append(fds, strconv.Itoa(int(f.Fd())))
+	}
+	return files, fds
+}
+
+// resumeHandoff picks up the state left by a re-exec. A pending update that
+// already started once without confirming is rolled back by exec'ing the
+// previous binary. The returned handoff is nil when there is nothing to adopt.
+func (a *Agent) resumeHandoff() *domain.Handoff {
+	h, err := a.store.LoadHandoff()
+	if err != nil {
+		a.logger.Warn("unreadable handoff, ignoring", "err", err)
+		_ = a.store.ClearHandoff()
+		return nil
+	}
+	if h == nil {
+		return nil
+	}
+
+	if u := h.Update; u != nil {
+		if u.Attempts > 0 {
+			a.rollbackUpdate(h)
+		} else {
+			u.Attempts++
+			if err := a.store.SaveHandoff(h); err != nil {
+				a.logger.Error("save handoff", "err", err)
+			}
+		}
+	}
+	return h
+}
+
+// rollbackUpdate restores the previous binary and execs it. The new binary
+// exited and systemd restarted the unit; the VM survives that, and the
+// previous binary adopts it from the instance state.
+func (a *Agent) rollbackUpdate(h *domain.Handoff) {
+	u := h.Update
+	a.logger.Error("agent update did not confirm, rolling back",
+		"from", u.ToVersion, "to", u.FromVersion)
+	h.Update, h.RolledBack = nil, u
+	if err := os.Rename(u.Backup, u.Binary); err != nil {
+		// Keep running the new binary rather than crash-looping.
+		a.logger.Error("restore previous binary", "err", err)
+		_ = a.store.SaveHandoff(h)
+		return
+	}
+	if err := a.store.SaveHandoff(h); err != nil {
+		a.logger.Error("save handoff", "err", err)
+	}
+	err := syscall.Exec(u.Binary, os.Args, os.Environ())
+	a.logger.Error("exec previous binary", "err", err)
+}
+
+// adoptHandoff takes over the VM and frpc of the previous process. It
+// returns false if there was no VM to adopt, in which case leftovers are
+// cleaned up as after a crash.
+func (a *Agent) adoptHandoff(h *domain.Handoff) bool {
+	if h == nil {
+		return false
+	}
+	if h.FRPCPID > 0 {
+		// The tunnel is re-established by our own frpc with the same config.
+		stopInherited(h.FRPCPID, "frpc")
+	}
+	if h.VM == nil {
+		return false
+	}
+	if err := a.mgr.Adopt(h.VM); err != nil {
+		a.logger.Warn("could not adopt VM from previous process", "vm_id", h.VM.VMID, "err", err)
+		return false
+	}
+	return true
+}
+
+// stopInherited kills and reaps a child inherited across exec, after
+// checking that the pid still belongs to comm.
+func stopInherited(pid int, comm string) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil || strings.TrimSpace(string(data)) != comm {
+		return
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	_ = proc.Signal(syscall.SIGTERM)
+	_, _ = proc.Wait()
+}
+
+// confirmUpdate finishes an update once the new binary has served for
+// updateConfirmAfter: the previous binary and the handoff are removed.
+func (a *Agent) confirmUpdate(ctx context.Context, h *domain.Handoff, sink func(domain.Event)) {
+	if h.Update == nil {
+		_ = a.store.ClearHandoff()
+		if u := h.RolledBack; u != nil {
+			sink(domain.Event{
+				Type:     domain.EventAgentUpdateRolledBack,
+				Severity: domain.SeverityWarning,
+				Message:  fmt.Sprintf("agent update to %s did not come up, rolled back to %s", u.ToVersion, u.FromVersion),
+				Data:     map[string]any{"from_version": u.FromVersion, "to_version": u.ToVersion},
+				Time:     time.Now().UTC(),
+			})
+		}
+		return
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(updateConfirmAfter):
+	}
+
+	u := h.Update
+	if err := os.Remove(u.Backup); err != nil && !os.IsNotExist(err) {
+		a.logger.Warn("remove previous binary", "path", u.Backup, "err", err)
+	}
+	if err := a.store.ClearHandoff(); err != nil {
+		a.logger.Error("clear handoff", "err", err)
+	}
+	a.logger.Info("agent update confirmed", "from", u.FromVersion, "to", u.ToVersion)
+	sink(domain.Event{
+		Type:     domain.EventAgentUpdated,
+		Severity: domain.SeverityInfo,
+		Message:  fmt.Sprintf("agent updated from %s to %s", u.FromVersion, u.ToVersion),
+		Data: map[string]any{
+			"from_version": u.FromVersion,
+			"to_version":   u.ToVersion,
+			"vm_adopted":   h.VM != nil && a.mgr.VMID() == h.VM.VMID,
+		},
+		Time: time.Now().UTC(),
+	})
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metering"
+)
+
+const (
+	usageSampleInterval = 15 * time.Second
+	usageReportInterval = 5 * time.Minute
+)
+
+// runMetering samples instance usage and reports cumulative totals. Totals
+// are persisted on every sample, so a failed report or a restart loses at
+// most one sample interval.
+func (a *Agent) runMetering(ctx context.Context, meter *metering.Meter) {
+	sample := time.NewTicker(usageSampleInterval)
+	defer sample.Stop()
+	report := time.NewTicker(usageReportInterval)
+	defer report.Stop()
+
+	errCount := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sample.C:
+			status := a.mgr.Status(ctx)
+			s := metering.Sample{
+				Billable: billable(status.Status),
+				GPUs:     len(a.mgr.AttachedGPUs()),
+			}
+			if status.Status != domain.StatusDestroyed {
+				s.VMID = a.mgr.VMID()
+				s.RxRaw, s.TxRaw, s.NetOK = a.mgr.NetCounters()
+				s.PowerW, _ = a.mgr.GPUPower()
+			}
+			if err := meter.Observe(s); err != nil {
+				a.logger.Warn("failed to persist usage", "err", err)
+			}
+		case <-report.C:
+			r := meter.Report()
+			if len(r.Instances) == 0 {
+				continue
+			}
+			if err := a.api.SendUsage(ctx, r); err != nil {
+				if errCount%12 == 0 {
+					a.logger.Warn("failed to send usage", "err", err)
+				}
+				errCount++
+				continue
+			}
+			errCount = 0
+			if err := meter.Ack(r); err != nil {
+				a.logger.Warn("failed to persist usage ack", "err", err)
+			}
+		}
+	}
+}
+
+// billable tells whether an instance in status s holds its GPU and memory.
+func billable(s domain.InstanceStatus) bool {
+	switch s {
+	case domain.StatusRunning, domain.StatusDegraded, domain.StatusPaused:
+		return true
+	default:
+		return false
+	}
+}
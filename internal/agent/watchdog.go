@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/qudata/agent/internal/system"
+)
+
+// watchdogStall is how long the VM manager may stay locked before the agent
+// counts as hung and stops petting the systemd watchdog. Create holds the
+// manager for the whole boot, so this is well above a slow boot.
+const watchdogStall = 15 * time.Minute
+
+// notifySystemd sends state to systemd; a failure is only logged.
+func (a *Agent) notifySystemd(state string) {
+	if _, err := system.SDNotify(state); err != nil {
+		a.logger.Warn("sd_notify failed", "state", state, "err", err)
+	}
+}
+
+// runWatchdog pets the systemd watchdog (WatchdogSec=) at half its timeout
+// for as long as the agent is responsive. Each tick probes the VM manager; a
+// probe that does not return within watchdogStall, e.g. one stuck behind a
+// VFIO bind in uninterruptible sleep, stops the petting so that systemd
+// restarts the agent instead of leaving the host wedged.
+func (a *Agent) runWatchdog(ctx context.Context) {
+	timeout := system.SDWatchdogInterval()
+	if timeout == 0 {
+		return
+	}
+	a.logger.Info("systemd watchdog enabled", "timeout", timeout)
+
+	var lastProbe atomic.Int64
+	var probing atomic.Bool
+	lastProbe.Store(time.Now().UnixNano())
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if probing.CompareAndSwap(false, true) {
+			go func() {
+				defer probing.Store(false)
+				a.mgr.VMID()
+				lastProbe.Store(time.Now().UnixNano())
+			}()
+		}
+		stalled := time.Since(time.Unix(0, lastProbe.Load()))
+		if stalled > watchdogStall {
+			a.logger.Error("VM manager unresponsive, no longer petting the systemd watchdog", "stalled", stalled.Round(time.Second))
+			continue
+		}
+		a.notifySystemd("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,163 @@
+// Package apitls keeps the certificate the agent API is served with when
+// mutual TLS is enabled. The private key never leaves the host: a CSR is
+// sent with /init and the control plane answers with the signed certificate
+// and the CA its own client certificates are issued by.
+package apitls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	keyFile  = "api.key"
+	certFile = "api.crt"
+	caFile   = "client-ca.crt"
+)
+
+// Store holds the API key pair and the client CA under dir.
+type Store struct {
+	dir string
+}
+
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// CSR returns a PEM certificate request for the agent API, generating the
+// key on first use. ips are added as subject alternative names.
+func (s *Store) CSR(agentID string, ips ...string) (string, error) {
+	key, err := s.key()
+	if err != nil {
+		return "", err
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: agentID, Organization: []string{"qudata-agent"}},
+		DNSNames: []string{"localhost"},
+	}
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return "", fmt.Errorf("create csr: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// Save stores the certificate and client CA issued by the control plane
+// after checking that the certificate belongs to our key.
+func (s *Store) Save(t domain.APITLS) error {
+	keyPEM, err := os.ReadFile(filepath.Join(s.dir, keyFile))
+	if err != nil {
+		return fmt.Errorf("read api key: %w", err)
+	}
+	if _, err := tls.X509KeyPair([]byte(t.Certificate), keyPEM); err != nil {
+		return fmt.Errorf("api certificate does not match key: %w", err)
+	}
+	if _, err := parseCAs([]byte(t.ClientCA)); err != nil {
+		return err
+	}
+	if err := writeAtomic(filepath.Join(s.dir, caFile), []byte(t.ClientCA)); err != nil {
+		return fmt.Errorf("write client ca: %w", err)
+	}
+	if err := writeAtomic(filepath.Join(s.dir, certFile), []byte(t.Certificate)); err != nil {
+		return fmt.Errorf("write api certificate: %w", err)
+	}
+	return nil
+}
+
+// ServerConfig builds the TLS config of the API listener from the stored
+// files. Client certificates are verified when presented; which routes
+// require one is decided per request.
+func (s *Store) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.dir, certFile), filepath.Join(s.dir, keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("load api certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse api certificate: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("api certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	caPEM, err := os.ReadFile(filepath.Join(s.dir, caFile))
+	if err != nil {
+		return nil, fmt.Errorf("read client ca: %w", err)
+	}
+	pool, err := parseCAs(caPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (s *Store) key() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(s.dir, keyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("api key is not PEM")
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse api key: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate api key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal api key: %w", err)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("create api tls dir: %w", err)
+	}
+	if err := writeAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("write api key: %w", err)
+	}
+	return key, nil
+}
+
+func parseCAs(data []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if len(bytes.TrimSpace(data)) == 0 || !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("client ca contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
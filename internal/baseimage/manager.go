@@ -0,0 +1,269 @@
+// Package baseimage downloads, verifies and caches the VM base image declared
+// by the control plane.
+package baseimage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	// Subdir is the directory under ImageDir holding managed versions.
+	Subdir = "base"
+	// CurrentLink is the symlink in Subdir pointing at the active version.
+	CurrentLink = "current"
+)
+
+// Conversions SetConversion accepts.
+const (
+	// ConvertCompressed rewrites base images with compressed clusters,
+	// saving disk space at the cost of decompressing on every read.
+	ConvertCompressed = "compressed"
+	// ConvertUncompressed rewrites base images without compressed clusters,
+	// so that reads of data the guest has not rewritten are not slowed down.
+	ConvertUncompressed = "uncompressed"
+)
+
+var versionRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Manager keeps verified base image versions under <dir>/base and points the
+// "current" symlink at the active one. Versions are never modified once in
+// place, so overlays created from an older version stay valid after a swap.
+type Manager struct {
+	dir    string
+	pubKey ed25519.PublicKey
+	client *http.Client
+	logger *slog.Logger
+
+	// convert and clusterSize set how verified images are rewritten with
+	// qemu-img convert; with convert empty they are kept as downloaded.
+	convert     string
+	clusterSize string
+
+	mu sync.Mutex
+}
+
+// New creates a Manager caching images under imageDir. pubKey, when set,
+// makes a valid signature mandatory for every image.
+func New(imageDir string, pubKey ed25519.PublicKey, logger *slog.Logger) *Manager {
+	return &Manager{
+		dir:    filepath.Join(imageDir, Subdir),
+		pubKey: pubKey,
+		client: &http.Client{},
+		logger: logger,
+	}
+}
+
+// SetConversion makes new versions be rewritten after verification, with
+// compressed clusters or without, and with clusterSize when it is set. The
+// checksum covers the image as downloaded; cached versions are left as they are.
+func (m *Manager) SetConversion(mode, clusterSize string) {
+	m.convert = mode
+	m.clusterSize = clusterSize
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Current returns the path of the active version, or "" if none was installed.
+func (m *Manager) Current() string {
+	target, err := os.Readlink(filepath.Join(m.dir, CurrentLink))
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(m.dir, target)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// Ensure makes spec the active version, downloading and verifying it if it
+// is not cached yet, and returns its path.
+func (m *Manager) Ensure(ctx context.Context, spec domain.BaseImageSpec) (string, error) {
+	if !versionRe.MatchString(spec.Version) {
+		return "", fmt.Errorf("invalid image version %q", spec.Version)
+	}
+	want, err := hex.DecodeString(strings.ToLower(spec.SHA256))
+	if err != nil || len(want) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 %q", spec.SHA256)
+	}
+	if err := m.checkSignature(spec, want); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return "", fmt.Errorf("create image dir: %w", err)
+	}
+
+	name := spec.Version + ".qcow2"
+	path := filepath.Join(m.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		if err := m.download(ctx, spec.URL, path, want); err != nil {
+			return "", err
+		}
+		m.logger.Info("base image downloaded", "version", spec.Version, "path", path)
+	}
+
+	if err := swapLink(m.dir, name); err != nil {
+		return "", fmt.Errorf("activate image: %w", err)
+	}
+	return path, nil
+}
+
+func (m *Manager) checkSignature(spec domain.BaseImageSpec, digest []byte) error {
+	if m.pubKey == nil {
+		if spec.Signature != "" {
+			m.logger.Warn("base image signature not verified: no public key configured", "version", spec.Version)
+		}
+		return nil
+	}
+	if spec.Signature == "" {
+		return fmt.Errorf("image %s is not signed", spec.Version)
+	}
+	sig, err := base64.StdEncoding.DecodeString(spec.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(m.pubKey, digest, sig) {
+		return fmt.Errorf("image %s: signature mismatch", spec.Version)
+	}
+	return nil
+}
+
+// download streams url into path, verifying the SHA-256 digest before the
+// file is renamed into place.
+func (m *Manager) download(ctx context.Context, url, path string, want []byte) error {
+	url, err := resolveURL(url)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download image: unexpected status %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(m.dir, ".download-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("download image: %w", err)
+	}
+
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch: got %x, want %x", got, want)
+	}
+	if m.convert != "" {
+		if err := m.convertImage(ctx, tmpPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmpPath, 0o444); err != nil {
+		return err
+	}
+	m.logger.Debug("base image verified", "bytes", n)
+	return os.Rename(tmpPath, path)
+}
+
+// convertImage rewrites the qcow2 image at path in place with qemu-img
+// convert.
+func (m *Manager) convertImage(ctx context.Context, path string) error {
+	// The prefix lets image GC sweep what an interrupted conversion leaves.
+	out, err := os.CreateTemp(m.dir, ".download-convert-*")
+	if err != nil {
+		return err
+	}
+	outPath := out.Name()
+	out.Close()
+	defer os.Remove(outPath)
+
+	args := []string{"convert", "-f", "qcow2", "-O", "qcow2"}
+	if m.convert == ConvertCompressed {
+		args = append(args, "-c")
+	}
+	if m.clusterSize != "" {
+		args = append(args, "-o", "cluster_size="+m.clusterSize)
+	}
+	cmd := exec.CommandContext(ctx, "qemu-img", append(args, path, outPath)...)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("convert image: %w: %s", err, strings.TrimSpace(string(msg)))
+	}
+	m.logger.Debug("base image converted", "mode", m.convert)
+	return os.Rename(outPath, path)
+}
+
+// resolveURL accepts https URLs and s3://bucket/key, which is mapped to the
+// bucket's public endpoint. Private buckets need a presigned https URL.
+func resolveURL(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "https://"):
+		return raw, nil
+	case strings.HasPrefix(raw, "s3://"):
+		bucket, key, ok := strings.Cut(strings.TrimPrefix(raw, "s3://"), "/")
+		if !ok || bucket == "" || key == "" {
+			return "", fmt.Errorf("invalid s3 url %q", raw)
+		}
+		return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket, key), nil
+	default:
+		return "", fmt.Errorf("unsupported image url %q: https or s3 required", raw)
+	}
+}
+
+// swapLink atomically points dir/current at name.
+func swapLink(dir, name string) error {
+	tmp := filepath.Join(dir, "."+CurrentLink+".tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, CurrentLink))
+}
@@ -3,8 +3,18 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/baseimage"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/logfile"
+	"github.com/qudata/agent/internal/network"
+	"github.com/qudata/agent/internal/regcache"
+	"github.com/qudata/agent/internal/tunnel"
 )
 
 var (
@@ -12,6 +22,19 @@ var (
 	BuildTime = "unknown"
 )
 
+// VM backends.
+const (
+	BackendQEMU = "qemu"
+	// BackendFake simulates instances without QEMU, for testing.
+	BackendFake = "fake"
+)
+
+// Thermal watchdog actions.
+const (
+	ThermalThrottle = "throttle"
+	ThermalPause    = "pause"
+)
+
 type Config struct {
 	APIKey     string
 	ServiceURL string
@@ -19,49 +42,313 @@ type Config struct {
 	TestMode   bool // --test: listen on 0.0.0.0, no FRPC, no tunnel_token required
 	DataDir    string
 	LogDir     string
+	// LogRotation limits the agent, frpc and QEMU logs.
+	LogRotation logfile.Options
+	// LogShipping sends agent log records at LogShippingLevel and above to
+	// the API.
+	LogShipping      bool
+	LogShippingLevel slog.Level
+	// CrashReports sends recovered panics to the API as agent_panic events.
+	// Crash report files are written to LogDir/crash either way.
+	CrashReports bool
+	// TracingEndpoint is the OTLP/HTTP collector spans of instance creation
+	// are exported to. Empty disables tracing.
+	TracingEndpoint string
+
+	// ListenAddr is the IP the agent API binds to. Defaults to 127.0.0.1
+	// (reachable only through FRPC), or 0.0.0.0 in test mode.
+	ListenAddr string
+	// ListenSocket, when set, additionally serves the agent API on a Unix socket.
+	ListenSocket string
+
+	// MetricsAddr, when set, starts an unauthenticated Prometheus listener
+	// (e.g. "127.0.0.1:9101") in addition to the authenticated /metrics route.
+	MetricsAddr string
+	// GRPCAddr, when set, serves the gRPC management API on this host:port
+	// next to the HTTP API.
+	GRPCAddr string
+
+	// TunnelProvider publishes the agent and instance ports: tunnel.ProviderFRP
+	// or tunnel.ProviderWireGuard.
+	TunnelProvider string
+	WireGuard      tunnel.WireGuardConfig
 
 	FRPCBinary     string
 	FRPCConfigPath string
+	// TunnelDownThreshold is how long the frpc tunnel may be down before a
+	// tunnel_down event is raised.
+	TunnelDownThreshold time.Duration
+
+	// Backend runs the instances: BackendQEMU, or BackendFake, which
+	// simulates them for testing on hosts without GPUs or KVM.
+	Backend string
+	// FakeBootTime is how long a simulated create takes.
+	FakeBootTime time.Duration
+	// FakeFailReason, a status reason such as ssh_timeout, fails every
+	// simulated create.
+	FakeFailReason string
+
+	QEMUBinary    string
+	SwtpmBinary   string
+	OVMFCodePath  string
+	OVMFVarsPath  string
+	BaseImagePath string
+	ImageDir      string
+	VMRunDir      string
+	GPUPCIAddrs   []string
+	// PCIDevices are the host PCI devices besides the GPUs, such as NVMe
+	// drives or NICs, that instances may ask to be passed through.
+	PCIDevices []string
+	// USBDevices are the host USB devices, by vendor:product ID, that
+	// instances may ask to be passed through.
+	USBDevices []domain.USBDevice
+	// OVMFSecbootCode and OVMFSecbootVars are the firmware of instances
+	// with Secure Boot; the variable store template has the keys enrolled.
+	OVMFSecbootCode string
+	OVMFSecbootVars string
 
-	QEMUBinary        string
-	OVMFCodePath      string
-	OVMFVarsPath      string
-	BaseImagePath     string
-	ImageDir          string
-	VMRunDir          string
-	GPUPCIAddrs       []string
-	ManagementKeyPath string
+	// ConfidentialFirmware is the OVMF build confidential VMs boot; empty
+	// picks the distribution's build for the host's mode.
+	ConfidentialFirmware string
+	// Flavors are the instance sizes a create may reference by name.
+	Flavors []domain.Flavor
+	// GPUSRIOVNumVFs enables SR-IOV mode: that many VFs are created per GPU
+	// and a VF, not the whole GPU, is passed to the guest.
+	GPUSRIOVNumVFs int
+	// RegistryCachePort, when set, is the loopback port of the pull-through
+	// registry cache the guest Docker daemons use as their mirror.
+	RegistryCachePort int
+	// RegistryCacheDir holds the cached images; defaults to
+	// DataDir/registry-cache.
+	RegistryCacheDir string
+	// RegistryCacheUpstream is the registry pulled through.
+	RegistryCacheUpstream string
+	// RegistryCacheMaxGB bounds the cache; 0 is unbounded.
+	RegistryCacheMaxGB int
+	// DCGMExporterPort is the guest port of dcgm-exporter, scraped with the
+	// stats for DCGM telemetry; 0 disables it.
+	DCGMExporterPort int
+	// GPUPowerCapW caps the total GPU power of an instance until the control
+	// plane sets a cap through PUT /gpus/power-cap; 0 is no cap.
+	GPUPowerCapW int
+	// GPUCriticalTemp is the GPU temperature in °C that, held for
+	// GPUCriticalDuration, makes the thermal watchdog act; 0 disables it.
+	GPUCriticalTemp     int
+	GPUCriticalDuration time.Duration
+	// GPUThermalAction is what the watchdog does: "throttle" limits the GPU
+	// clocks to GPUThrottleClockMHz, "pause" stops the VM.
+	GPUThermalAction    string
+	GPUThrottleClockMHz int
+	// GPUBenchmarkCmd, when set, is run in a throwaway VM before the host
+	// registers and its score is sent with the registration.
+	GPUBenchmarkCmd     string
+	GPUBenchmarkTimeout time.Duration
+	ManagementKeyPath   string
 
 	VMDefaultCPUs   string
 	VMDefaultMemory string
 	VMDiskSizeGB    int
+
+	// SecureWipe overwrites instance disks on destroy for every instance.
+	SecureWipe bool
+	// DiskEncryption encrypts every instance disk with a key kept in memory
+	// only; instances created with a disk_key are encrypted regardless.
+	DiskEncryption bool
+	// VNC gives every instance a VNC display; others get one only when
+	// created with vnc.
+	VNC bool
+	// CreateRetries is how often a create that failed for a transient
+	// reason, such as an SSH or QMP timeout, is attempted again.
+	CreateRetries int
+	// MemoryReserveMB is host memory a create must leave available besides
+	// the guest and QEMU's own overhead.
+	MemoryReserveMB int
+	// KSM turns on kernel same-page merging at startup, scanning
+	// KSMPagesToScan pages per wake-up, so that guests booted from the same
+	// base image share identical memory. RAM pinned by VFIO is not merged.
+	KSM            bool
+	KSMPagesToScan int
+	// TrimInterval is how often fstrim runs in the guest to free the space
+	// of deleted data in the disk images; 0 disables it.
+	TrimInterval time.Duration
+	// DiskPreallocation is the qcow2 preallocation of new instance disks:
+	// "off", "metadata" or "falloc"; empty keeps the qemu-img default.
+	DiskPreallocation string
+	// DiskClusterSize is the qcow2 cluster size of new instance disks, a
+	// power of two from 512 to 2M such as "64k".
+	DiskClusterSize string
+	// DiskCache is the cache mode of instance drives: "writeback", "none",
+	// "writethrough", "directsync" or "unsafe".
+	DiskCache string
+	// DiskAIO is the I/O engine of instance drives: "threads", "native" or
+	// "io_uring". "native" needs a cache mode bypassing the host page cache.
+	DiskAIO string
+	// BaseImageConversion rewrites downloaded base images "compressed" or
+	// "uncompressed"; empty keeps them as downloaded.
+	BaseImageConversion string
+
+	// NTPServers are queried to measure host clock drift.
+	NTPServers []string
+	// ClockDriftThreshold is the offset above which a clock_drift event is raised.
+	ClockDriftThreshold time.Duration
+	// ManageChrony makes the agent own a chrony drop-in pointing at NTPServers.
+	ManageChrony bool
+	// ImagePublicKey is the base64 ed25519 key base images must be signed with.
+	ImagePublicKey string
+	// NetworkIsolation firewalls guests off from the host and private networks.
+	NetworkIsolation bool
+	// NetAccounting counts the traffic of every instance, even when neither
+	// isolation nor a bandwidth cap calls for a network policy.
+	NetAccounting bool
+	// ImageGCWatermark is the image filesystem usage percent above which
+	// unused base image versions are deleted.
+	ImageGCWatermark float64
+	// ACMEDirectoryURL is the ACME server issuing certificates for
+	// instances created with TLS enabled.
+	ACMEDirectoryURL string
+	// ACMEEmail is the optional contact registered with the ACME account.
+	ACMEEmail string
+	// Location, when any field is set, is registered instead of the one
+	// looked up by public IP.
+	Location domain.HostLocation
+	// GeoIPURL is the GeoIP lookup, with {ip} standing for the public IP;
+	// the control plane can override it.
+	GeoIPURL string
+	// NetTestFRPURL is the nettest endpoint on the FRP server host; defaults
+	// to https on the FRP server address.
+	NetTestFRPURL string
+	// NetTestOnRegister measures the network before the host registers, so
+	// it is listed with its measured rather than its link speed.
+	NetTestOnRegister bool
+	// UpdatePublicKey is the base64 ed25519 key agent binaries pushed
+	// through POST /update must be signed with. Self-update is disabled
+	// without it.
+	UpdatePublicKey string
+	// PasswordAuth gives instances a random root password, returned when
+	// the instance is created and when it is rotated. Without it guests
+	// only accept SSH keys.
+	PasswordAuth bool
+	// CredentialsPublicKey is the base64 X25519 key of the control plane
+	// that root passwords are sealed to; without it they are returned in
+	// clear.
+	CredentialsPublicKey string
+	// MTLS serves the agent API over TLS with a certificate issued by the
+	// control plane during /init and requires a client certificate from it.
+	MTLS bool
+	// SignedRequests rejects API requests that authenticate with the bare
+	// X-Agent-Secret header instead of an HMAC signature.
+	SignedRequests bool
+	// APIRateLimit is the default requests per second allowed on each API
+	// route; instance create and delete routes are limited further. Zero
+	// disables rate limiting.
+	APIRateLimit float64
+
+	// The settings below are reloadable: SIGHUP or POST /admin/reload
+	// applies them without a restart.
+
+	// LogLevel is a slog level name; empty means info, or debug in debug mode.
+	LogLevel string
+	// StatsInterval is how often instance stats are sent to the API.
+	StatsInterval time.Duration
+	// StatsRetention is how far back stats are kept for upload while the
+	// API is unreachable.
+	StatsRetention time.Duration
+	// MaxBandwidthMbps caps the traffic of every instance in each direction,
+	// including instances created without a limit; 0 is no cap.
+	MaxBandwidthMbps int
+	// SSHPorts and AppPorts are the host port ranges forwarded to guests.
+	SSHPorts domain.PortRange
+	AppPorts domain.PortRange
+
+	// File is the config file the configuration was loaded from.
+	File string
 }
 
 func DefaultConfig() *Config {
-	code, vars := findOVMF()
+	code, vars := findOVMF(ovmfPairs)
+	secbootCode, secbootVars := findOVMF(ovmfSecbootPairs)
 	return &Config{
-		ServiceURL:      "https://internal.qudata.ai/v0",
-		DataDir:         "/var/lib/qudata",
-		LogDir:          "/var/log/qudata",
-		FRPCBinary:      "/usr/local/bin/frpc",
-		FRPCConfigPath:  "/etc/qudata/frpc.toml",
-		QEMUBinary:      "/usr/bin/qemu-system-x86_64",
-		OVMFCodePath:    code,
-		OVMFVarsPath:    vars,
-		ImageDir:        "/var/lib/qudata/images",
-		VMRunDir:        "/var/run/qudata",
-		VMDefaultCPUs:   "4",
-		VMDefaultMemory: "8G",
-		VMDiskSizeGB:    50,
+		ServiceURL: "https://internal.qudata.ai/v0",
+		DataDir:    "/var/lib/qudata",
+		LogDir:     "/var/log/qudata",
+		LogRotation: logfile.Options{
+			MaxSizeMB:  100,
+			Period:     24 * time.Hour,
+			MaxBackups: 7,
+			MaxAge:     30 * 24 * time.Hour,
+			Compress:   true,
+		},
+		LogShippingLevel: slog.LevelWarn,
+		CrashReports:     true,
+		PasswordAuth:     true,
+		TunnelProvider:   tunnel.ProviderFRP,
+		Backend:          BackendQEMU,
+		FakeBootTime:     5 * time.Second,
+		WireGuard: tunnel.WireGuardConfig{
+			Interface:      "qudata0",
+			PrivateKeyPath: "/etc/qudata/wg.key",
+		},
+		FRPCBinary:          "/usr/local/bin/frpc",
+		FRPCConfigPath:      "/etc/qudata/frpc.toml",
+		TunnelDownThreshold: 2 * time.Minute,
+		QEMUBinary:          "/usr/bin/qemu-system-x86_64",
+		SwtpmBinary:         "/usr/bin/swtpm",
+		OVMFCodePath:        code,
+		OVMFVarsPath:        vars,
+		OVMFSecbootCode:     secbootCode,
+		OVMFSecbootVars:     secbootVars,
+		ImageDir:            "/var/lib/qudata/images",
+		VMRunDir:            "/var/run/qudata",
+		VMDefaultCPUs:       "4",
+		VMDefaultMemory:     "8G",
+		VMDiskSizeGB:        50,
+		CreateRetries:       2,
+		MemoryReserveMB:     1024,
+		KSMPagesToScan:      100,
+		TrimInterval:        24 * time.Hour,
+
+		GPUCriticalDuration: 30 * time.Second,
+		GPUThermalAction:    ThermalThrottle,
+		GPUThrottleClockMHz: 1000,
+		GPUBenchmarkTimeout: 10 * time.Minute,
+
+		NTPServers:          []string{"pool.ntp.org"},
+		ClockDriftThreshold: 2 * time.Second,
+		ImageGCWatermark:    85,
+		NetworkIsolation:    true,
+		NetAccounting:       true,
+		NetTestOnRegister:   true,
+		APIRateLimit:        10,
+		ACMEDirectoryURL:    "https://acme-v02.api.letsencrypt.org/directory",
+		GeoIPURL:            "https://ipapi.co/{ip}/json/",
+
+		RegistryCacheUpstream: regcache.DefaultUpstream,
+		RegistryCacheMaxGB:    200,
+
+		StatsInterval:  5 * time.Second,
+		StatsRetention: time.Hour,
+		SSHPorts:       domain.PortRange{Min: network.SSHPortMin, Max: network.SSHPortMax},
+		AppPorts:       domain.PortRange{Min: network.AppPortMin, Max: network.AppPortMax},
 	}
 }
 
-func findOVMF() (code, vars string) {
-	pairs := [][2]string{
+var (
+	ovmfPairs = [][2]string{
 		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
 		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
 		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
 	}
+	// ovmfSecbootPairs are the Secure Boot builds, with variable stores that
+	// have the Microsoft keys enrolled.
+	ovmfSecbootPairs = [][2]string{
+		{"/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+	}
+)
+
+// findOVMF returns the first of pairs that is installed, or the first one.
+func findOVMF(pairs [][2]string) (code, vars string) {
 	for _, p := range pairs {
 		if _, e1 := os.Stat(p[0]); e1 == nil {
 			if _, e2 := os.Stat(p[1]); e2 == nil {
@@ -69,18 +356,26 @@ func findOVMF() (code, vars string) {
 			}
 		}
 	}
-	return "/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"
+	return pairs[0][0], pairs[0][1]
 }
 
-func Load() (*Config, error) {
+// Load builds the configuration from the defaults, the optional config file
+// at path and the QUDATA_* environment, each overriding the previous one.
+func Load(path string) (*Config, error) {
 	cfg := DefaultConfig()
+	cfg.File = path
+	if err := loadFile(path, cfg); err != nil {
+		return nil, err
+	}
 
-	cfg.APIKey = strings.TrimSpace(os.Getenv("QUDATA_API_KEY"))
+	if v := strings.TrimSpace(os.Getenv("QUDATA_API_KEY")); v != "" {
+		cfg.APIKey = v
+	}
 	if cfg.APIKey == "" {
-		return nil, fmt.Errorf("QUDATA_API_KEY is required")
+		return nil, fmt.Errorf("QUDATA_API_KEY (or api_key in %s) is required", path)
 	}
 	if !strings.HasPrefix(cfg.APIKey, "ak-") {
-		return nil, fmt.Errorf("QUDATA_API_KEY must start with 'ak-'")
+		return nil, fmt.Errorf("API key must start with 'ak-'")
 	}
 
 	if v := os.Getenv("QUDATA_SERVICE_URL"); v != "" {
@@ -92,6 +387,63 @@ func Load() (*Config, error) {
 	if v := os.Getenv("QUDATA_LOG_DIR"); v != "" {
 		cfg.LogDir = v
 	}
+	if v := os.Getenv("QUDATA_LOG_MAX_SIZE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_LOG_MAX_SIZE_MB must be a non-negative integer, got %q", v)
+		}
+		cfg.LogRotation.MaxSizeMB = n
+	}
+	if v := os.Getenv("QUDATA_LOG_ROTATE_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_LOG_ROTATE_PERIOD must be a non-negative duration, got %q", v)
+		}
+		cfg.LogRotation.Period = d
+	}
+	if v := os.Getenv("QUDATA_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_LOG_MAX_BACKUPS must be a non-negative integer, got %q", v)
+		}
+		cfg.LogRotation.MaxBackups = n
+	}
+	if v := os.Getenv("QUDATA_LOG_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_LOG_MAX_AGE must be a non-negative duration, got %q", v)
+		}
+		cfg.LogRotation.MaxAge = d
+	}
+	if v, ok := os.LookupEnv("QUDATA_LOG_COMPRESS"); ok {
+		cfg.LogRotation.Compress = v != "false"
+	}
+	if v, ok := os.LookupEnv("QUDATA_LOG_SHIPPING"); ok {
+		cfg.LogShipping = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_CRASH_REPORTS"); ok {
+		cfg.CrashReports = v != "false"
+	}
+	if v := os.Getenv("QUDATA_OTLP_ENDPOINT"); v != "" {
+		cfg.TracingEndpoint = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_LOG_SHIPPING_LEVEL"); v != "" {
+		if err := cfg.LogShippingLevel.UnmarshalText([]byte(strings.TrimSpace(v))); err != nil {
+			return nil, fmt.Errorf("QUDATA_LOG_SHIPPING_LEVEL must be debug, info, warn or error, got %q", v)
+		}
+	}
+	if v := os.Getenv("QUDATA_LISTEN_ADDR"); v != "" {
+		cfg.ListenAddr = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_LISTEN_SOCKET"); v != "" {
+		cfg.ListenSocket = v
+	}
+	if v := os.Getenv("QUDATA_METRICS_ADDR"); v != "" {
+		cfg.MetricsAddr = v
+	}
+	if v := os.Getenv("QUDATA_GRPC_ADDR"); v != "" {
+		cfg.GRPCAddr = v
+	}
 	if v := os.Getenv("QUDATA_FRPC_BINARY"); v != "" {
 		cfg.FRPCBinary = v
 	}
@@ -101,12 +453,24 @@ func Load() (*Config, error) {
 	if v := os.Getenv("QUDATA_QEMU_BINARY"); v != "" {
 		cfg.QEMUBinary = v
 	}
+	if v := os.Getenv("QUDATA_SWTPM_BINARY"); v != "" {
+		cfg.SwtpmBinary = v
+	}
+	if v := os.Getenv("QUDATA_CONFIDENTIAL_FIRMWARE"); v != "" {
+		cfg.ConfidentialFirmware = v
+	}
 	if v := os.Getenv("QUDATA_OVMF_CODE"); v != "" {
 		cfg.OVMFCodePath = v
 	}
 	if v := os.Getenv("QUDATA_OVMF_VARS"); v != "" {
 		cfg.OVMFVarsPath = v
 	}
+	if v := os.Getenv("QUDATA_OVMF_SECBOOT_CODE"); v != "" {
+		cfg.OVMFSecbootCode = v
+	}
+	if v := os.Getenv("QUDATA_OVMF_SECBOOT_VARS"); v != "" {
+		cfg.OVMFSecbootVars = v
+	}
 	if v := os.Getenv("QUDATA_BASE_IMAGE"); v != "" {
 		cfg.BaseImagePath = v
 	}
@@ -131,6 +495,94 @@ func Load() (*Config, error) {
 			cfg.GPUPCIAddrs = addrs
 		}
 	}
+	if v := os.Getenv("QUDATA_PCI_DEVICES"); v != "" {
+		cfg.PCIDevices = nonEmpty(strings.Split(v, ","))
+	}
+	if v := os.Getenv("QUDATA_USB_DEVICES"); v != "" {
+		devs, err := parseUSBDevices(nonEmpty(strings.Split(v, ",")))
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_USB_DEVICES: %w", err)
+		}
+		cfg.USBDevices = devs
+	}
+	if v := os.Getenv("QUDATA_GPU_SRIOV_VFS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_SRIOV_VFS must be a non-negative integer, got %q", v)
+		}
+		cfg.GPUSRIOVNumVFs = n
+	}
+	if v := os.Getenv("QUDATA_REGISTRY_CACHE_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("QUDATA_REGISTRY_CACHE_PORT must be a port number, got %q", v)
+		}
+		cfg.RegistryCachePort = n
+	}
+	if v := os.Getenv("QUDATA_REGISTRY_CACHE_DIR"); v != "" {
+		cfg.RegistryCacheDir = v
+	}
+	if v := os.Getenv("QUDATA_REGISTRY_CACHE_UPSTREAM"); v != "" {
+		cfg.RegistryCacheUpstream = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_REGISTRY_CACHE_MAX_GB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_REGISTRY_CACHE_MAX_GB must be a non-negative integer, got %q", v)
+		}
+		cfg.RegistryCacheMaxGB = n
+	}
+	if v := os.Getenv("QUDATA_DCGM_EXPORTER_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("QUDATA_DCGM_EXPORTER_PORT must be a port number, got %q", v)
+		}
+		cfg.DCGMExporterPort = n
+	}
+	if v := os.Getenv("QUDATA_GPU_POWER_CAP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_POWER_CAP must be a non-negative number of Watts, got %q", v)
+		}
+		cfg.GPUPowerCapW = n
+	}
+	if v := os.Getenv("QUDATA_GPU_CRITICAL_TEMP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_CRITICAL_TEMP must be a non-negative temperature in °C, got %q", v)
+		}
+		cfg.GPUCriticalTemp = n
+	}
+	if v := os.Getenv("QUDATA_GPU_CRITICAL_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_CRITICAL_DURATION must be a non-negative duration, got %q", v)
+		}
+		cfg.GPUCriticalDuration = d
+	}
+	if v := os.Getenv("QUDATA_GPU_THERMAL_ACTION"); v != "" {
+		if v != ThermalThrottle && v != ThermalPause {
+			return nil, fmt.Errorf("QUDATA_GPU_THERMAL_ACTION must be %q or %q, got %q", ThermalThrottle, ThermalPause, v)
+		}
+		cfg.GPUThermalAction = v
+	}
+	if v := os.Getenv("QUDATA_GPU_THROTTLE_CLOCK"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_THROTTLE_CLOCK must be a positive number of MHz, got %q", v)
+		}
+		cfg.GPUThrottleClockMHz = n
+	}
+	if v := os.Getenv("QUDATA_GPU_BENCHMARK"); v != "" {
+		cfg.GPUBenchmarkCmd = v
+	}
+	if v := os.Getenv("QUDATA_GPU_BENCHMARK_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("QUDATA_GPU_BENCHMARK_TIMEOUT must be a positive duration, got %q", v)
+		}
+		cfg.GPUBenchmarkTimeout = d
+	}
 	if v := os.Getenv("QUDATA_MANAGEMENT_KEY"); v != "" {
 		cfg.ManagementKeyPath = v
 	}
@@ -141,27 +593,401 @@ func Load() (*Config, error) {
 		cfg.VMDefaultMemory = v
 	}
 
-	cfg.Debug = os.Getenv("QUDATA_DEBUG") == "true"
+	if v := os.Getenv("QUDATA_NTP_SERVERS"); v != "" {
+		var servers []string
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				servers = append(servers, s)
+			}
+		}
+		if len(servers) > 0 {
+			cfg.NTPServers = servers
+		}
+	}
+	if v := os.Getenv("QUDATA_CLOCK_DRIFT_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("QUDATA_CLOCK_DRIFT_THRESHOLD must be a positive duration, got %q", v)
+		}
+		cfg.ClockDriftThreshold = d
+	}
+
+	if v := os.Getenv("QUDATA_IMAGE_GC_WATERMARK"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 100 {
+			return nil, fmt.Errorf("QUDATA_IMAGE_GC_WATERMARK must be a percentage in (0, 100], got %q", v)
+		}
+		cfg.ImageGCWatermark = f
+	}
+
+	if v := os.Getenv("QUDATA_CREATE_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_CREATE_RETRIES must be a non-negative integer, got %q", v)
+		}
+		cfg.CreateRetries = n
+	}
+	if v := os.Getenv("QUDATA_MEMORY_RESERVE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_MEMORY_RESERVE_MB must be a non-negative integer, got %q", v)
+		}
+		cfg.MemoryReserveMB = n
+	}
+	if v := os.Getenv("QUDATA_KSM_PAGES_TO_SCAN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("QUDATA_KSM_PAGES_TO_SCAN must be a positive integer, got %q", v)
+		}
+		cfg.KSMPagesToScan = n
+	}
+	if v := os.Getenv("QUDATA_TRIM_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_TRIM_INTERVAL must be a non-negative duration, got %q", v)
+		}
+		cfg.TrimInterval = d
+	}
+	if v := os.Getenv("QUDATA_DISK_PREALLOCATION"); v != "" {
+		cfg.DiskPreallocation = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_DISK_CLUSTER_SIZE"); v != "" {
+		cfg.DiskClusterSize = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_DISK_CACHE"); v != "" {
+		cfg.DiskCache = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_DISK_AIO"); v != "" {
+		cfg.DiskAIO = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_BASE_IMAGE_CONVERSION"); v != "" {
+		cfg.BaseImageConversion = strings.TrimSpace(v)
+	}
+	if err := cfg.validateDisk(); err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv("QUDATA_API_RATE_LIMIT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("QUDATA_API_RATE_LIMIT must be a non-negative number, got %q", v)
+		}
+		cfg.APIRateLimit = f
+	}
+
+	if cfg.ListenAddr != "" && net.ParseIP(cfg.ListenAddr) == nil {
+		return nil, fmt.Errorf("listen address must be an IP address, got %q", cfg.ListenAddr)
+	}
+
+	// Booleans only override the file when set.
+	if v, ok := os.LookupEnv("QUDATA_DEBUG"); ok {
+		cfg.Debug = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_SECURE_WIPE"); ok {
+		cfg.SecureWipe = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_DISK_ENCRYPTION"); ok {
+		cfg.DiskEncryption = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_VNC"); ok {
+		cfg.VNC = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_KSM"); ok {
+		cfg.KSM = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_MANAGE_CHRONY"); ok {
+		cfg.ManageChrony = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_NETWORK_ISOLATION"); ok {
+		cfg.NetworkIsolation = v != "false"
+	}
+	if v, ok := os.LookupEnv("QUDATA_NET_ACCOUNTING"); ok {
+		cfg.NetAccounting = v != "false"
+	}
+	if v, ok := os.LookupEnv("QUDATA_MTLS"); ok {
+		cfg.MTLS = v == "true"
+	}
+	if v, ok := os.LookupEnv("QUDATA_SIGNED_REQUESTS"); ok {
+		cfg.SignedRequests = v == "true"
+	}
+	if v := os.Getenv("QUDATA_IMAGE_PUBKEY"); v != "" {
+		cfg.ImagePublicKey = v
+	}
+	if v := os.Getenv("QUDATA_UPDATE_PUBKEY"); v != "" {
+		cfg.UpdatePublicKey = v
+	}
+	if v, ok := os.LookupEnv("QUDATA_PASSWORD_AUTH"); ok {
+		cfg.PasswordAuth = v != "false"
+	}
+	if v := os.Getenv("QUDATA_CREDENTIALS_PUBKEY"); v != "" {
+		cfg.CredentialsPublicKey = v
+	}
+	if v := os.Getenv("QUDATA_ACME_DIRECTORY"); v != "" {
+		cfg.ACMEDirectoryURL = v
+	}
+	if v := os.Getenv("QUDATA_ACME_EMAIL"); v != "" {
+		cfg.ACMEEmail = v
+	}
+	if v := os.Getenv("QUDATA_LOCATION_CITY"); v != "" {
+		cfg.Location.City = v
+	}
+	if v := os.Getenv("QUDATA_LOCATION_COUNTRY"); v != "" {
+		cfg.Location.Country = v
+	}
+	if v := os.Getenv("QUDATA_LOCATION_REGION"); v != "" {
+		cfg.Location.Region = v
+	}
+	if v := os.Getenv("QUDATA_GEOIP_URL"); v != "" {
+		cfg.GeoIPURL = v
+	}
+	if v := os.Getenv("QUDATA_TUNNEL"); v != "" {
+		cfg.TunnelProvider = v
+	}
+	if v := os.Getenv("QUDATA_WG_INTERFACE"); v != "" {
+		cfg.WireGuard.Interface = v
+	}
+	if v := os.Getenv("QUDATA_WG_ADDRESS"); v != "" {
+		cfg.WireGuard.Address = v
+	}
+	if v := os.Getenv("QUDATA_WG_ENDPOINT"); v != "" {
+		cfg.WireGuard.Endpoint = v
+	}
+	if v := os.Getenv("QUDATA_WG_PEER_PUBLIC_KEY"); v != "" {
+		cfg.WireGuard.PeerPublicKey = v
+	}
+	if v := os.Getenv("QUDATA_WG_ALLOWED_IPS"); v != "" {
+		cfg.WireGuard.AllowedIPs = nonEmpty(strings.Split(v, ","))
+	}
+	if v := os.Getenv("QUDATA_WG_PRIVATE_KEY"); v != "" {
+		cfg.WireGuard.PrivateKeyPath = v
+	}
+	switch cfg.TunnelProvider {
+	case tunnel.ProviderFRP:
+	case tunnel.ProviderWireGuard:
+		if cfg.WireGuard.Address == "" || cfg.WireGuard.Endpoint == "" || cfg.WireGuard.PeerPublicKey == "" {
+			return nil, fmt.Errorf("the wireguard tunnel needs QUDATA_WG_ADDRESS, QUDATA_WG_ENDPOINT and QUDATA_WG_PEER_PUBLIC_KEY")
+		}
+	default:
+		return nil, fmt.Errorf("QUDATA_TUNNEL must be %q or %q, got %q", tunnel.ProviderFRP, tunnel.ProviderWireGuard, cfg.TunnelProvider)
+	}
+	if v := os.Getenv("QUDATA_BACKEND"); v != "" {
+		cfg.Backend = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("QUDATA_FAKE_BOOT_TIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_FAKE_BOOT_TIME must be a non-negative duration, got %q", v)
+		}
+		cfg.FakeBootTime = d
+	}
+	if v := os.Getenv("QUDATA_FAKE_FAIL"); v != "" {
+		cfg.FakeFailReason = strings.TrimSpace(v)
+	}
+	if cfg.Backend != BackendQEMU && cfg.Backend != BackendFake {
+		return nil, fmt.Errorf("QUDATA_BACKEND must be %q or %q, got %q", BackendQEMU, BackendFake, cfg.Backend)
+	}
+	if v := os.Getenv("QUDATA_TUNNEL_DOWN_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("QUDATA_TUNNEL_DOWN_THRESHOLD must be a positive duration, got %q", v)
+		}
+		cfg.TunnelDownThreshold = d
+	}
+	if v := os.Getenv("QUDATA_NETTEST_FRP_URL"); v != "" {
+		cfg.NetTestFRPURL = strings.TrimRight(v, "/")
+	}
+	if v, ok := os.LookupEnv("QUDATA_NETTEST_ON_REGISTER"); ok {
+		cfg.NetTestOnRegister = v != "false"
+	}
+
+	if v := os.Getenv("QUDATA_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = strings.TrimSpace(v)
+	}
+	if cfg.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return nil, fmt.Errorf("log level must be debug, info, warn or error, got %q", cfg.LogLevel)
+		}
+	}
+	if v := os.Getenv("QUDATA_STATS_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_STATS_INTERVAL must be a duration, got %q", v)
+		}
+		cfg.StatsInterval = d
+	}
+	if cfg.StatsInterval < time.Second {
+		return nil, fmt.Errorf("stats interval must be at least 1s, got %s", cfg.StatsInterval)
+	}
+	if v := os.Getenv("QUDATA_STATS_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("QUDATA_STATS_RETENTION must be a non-negative duration, got %q", v)
+		}
+		cfg.StatsRetention = d
+	}
+	if v := os.Getenv("QUDATA_MAX_BANDWIDTH_MBPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("QUDATA_MAX_BANDWIDTH_MBPS must be a non-negative integer, got %q", v)
+		}
+		cfg.MaxBandwidthMbps = n
+	}
+	if v := os.Getenv("QUDATA_SSH_PORTS"); v != "" {
+		r, err := parsePortRange(v)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_SSH_PORTS: %w", err)
+		}
+		cfg.SSHPorts = r
+	}
+	if v := os.Getenv("QUDATA_APP_PORTS"); v != "" {
+		r, err := parsePortRange(v)
+		if err != nil {
+			return nil, fmt.Errorf("QUDATA_APP_PORTS: %w", err)
+		}
+		cfg.AppPorts = r
+	}
+	if cfg.SSHPorts.Overlaps(cfg.AppPorts) {
+		return nil, fmt.Errorf("SSH ports %s overlap app ports %s", cfg.SSHPorts, cfg.AppPorts)
+	}
 
 	return cfg, nil
 }
 
+// parsePortRange parses "min-max".
+func parsePortRange(s string) (domain.PortRange, error) {
+	lo, hi, ok := strings.Cut(strings.TrimSpace(s), "-")
+	minPort, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	maxPort, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if !ok || err1 != nil || err2 != nil || minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return domain.PortRange{}, fmt.Errorf("invalid port range %q, want min-max", s)
+	}
+	return domain.PortRange{Min: minPort, Max: maxPort}, nil
+}
+
+// parseUSBDevices parses vendor:product ID pairs.
+func parseUSBDevices(ids []string) ([]domain.USBDevice, error) {
+	devs := make([]domain.USBDevice, 0, len(ids))
+	for _, id := range ids {
+		d, err := domain.ParseUSBDevice(id)
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, d)
+	}
+	return devs, nil
+}
+
+// validateDisk checks the disk options, whether they came from the
+// environment or the config file.
+func (c *Config) validateDisk() error {
+	switch c.DiskPreallocation {
+	case "", "off", "metadata", "falloc":
+	default:
+		return fmt.Errorf("disk preallocation must be off, metadata or falloc, got %q", c.DiskPreallocation)
+	}
+	if c.DiskClusterSize != "" {
+		if n, err := parseClusterSize(c.DiskClusterSize); err != nil || n < 512 || n > 2<<20 || n&(n-1) != 0 {
+			return fmt.Errorf("disk cluster size must be a power of two from 512 to 2M, got %q", c.DiskClusterSize)
+		}
+	}
+	switch c.DiskCache {
+	case "", "writeback", "none", "writethrough", "directsync", "unsafe":
+	default:
+		return fmt.Errorf("disk cache must be writeback, none, writethrough, directsync or unsafe, got %q", c.DiskCache)
+	}
+	switch c.DiskAIO {
+	case "", "threads", "io_uring":
+	case "native":
+		// Linux native AIO only works with O_DIRECT.
+		if c.DiskCache != "none" && c.DiskCache != "directsync" {
+			return fmt.Errorf("disk aio native needs disk cache none or directsync, got %q", c.DiskCache)
+		}
+	default:
+		return fmt.Errorf("disk aio must be threads, native or io_uring, got %q", c.DiskAIO)
+	}
+	switch c.BaseImageConversion {
+	case "", baseimage.ConvertCompressed, baseimage.ConvertUncompressed:
+	default:
+		return fmt.Errorf("base image conversion must be %q or %q, got %q", baseimage.ConvertCompressed, baseimage.ConvertUncompressed, c.BaseImageConversion)
+	}
+	return nil
+}
+
+// parseClusterSize parses a size in bytes with an optional k or M suffix,
+// as qemu-img takes it.
+func parseClusterSize(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Level returns the log level to run at.
+func (c *Config) Level() slog.Level {
+	var l slog.Level
+	if c.LogLevel != "" && l.UnmarshalText([]byte(c.LogLevel)) == nil {
+		return l
+	}
+	if c.Debug {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// SetLogLevel changes the level of the loggers created by NewLogger.
+func SetLogLevel(l slog.Level) {
+	logLevel.Set(l)
+}
+
+var logLevel = new(slog.LevelVar)
+
+// ApplyFlags applies the command-line overrides in args on top of cfg.
+func ApplyFlags(cfg *Config, args []string) {
+	// TODO: --test mode — agent and VM ports listen on 0.0.0.0, no FRPC proxy.
+	for _, arg := range args {
+		if arg == "--test" {
+			cfg.TestMode = true
+		}
+		// --api-url points the agent at another API, e.g. a local cmd/mockapi.
+		if url, ok := strings.CutPrefix(arg, "--api-url="); ok {
+			cfg.ServiceURL = url
+		}
+	}
+}
+
+// ListenHost returns the configured API bind address or the mode default.
+func (c *Config) ListenHost() string {
+	if c.ListenAddr != "" {
+		return c.ListenAddr
+	}
+	if c.TestMode {
+		return "0.0.0.0"
+	}
+	return "127.0.0.1"
+}
+
 func NewLogger(cfg *Config, name string) (*slog.Logger, error) {
 	if err := os.MkdirAll(cfg.LogDir, 0o755); err != nil {
 		return nil, fmt.Errorf("create log dir: %w", err)
 	}
 
 	logPath := cfg.LogDir + "/" + name + ".log"
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	file, err := logfile.Open(logPath, cfg.LogRotation)
 	if err != nil {
 		return nil, fmt.Errorf("open log file %s: %w", logPath, err)
 	}
 
-	level := slog.LevelInfo
-	if cfg.Debug {
-		level = slog.LevelDebug
-	}
-
-	handler := slog.NewJSONHandler(file, &slog.HandlerOptions{Level: level})
+	logLevel.Set(cfg.Level())
+	handler := slog.NewJSONHandler(file, &slog.HandlerOptions{Level: logLevel})
 	return slog.New(handler), nil
 }
@@ -0,0 +1,595 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the optional config file read before the environment.
+const DefaultFile = "/etc/qudata/agent.yaml"
+
+// fileConfig is the layout of the config file. Pointers tell an unset value
+// from an explicit zero or false.
+type fileConfig struct {
+	APIKey     string `yaml:"api_key"`
+	ServiceURL string `yaml:"service_url"`
+	Debug      *bool  `yaml:"debug"`
+	DataDir    string `yaml:"data_dir"`
+	LogDir     string `yaml:"log_dir"`
+
+	LogRotation fileLogRotation `yaml:"log_rotation"`
+	LogShipping fileLogShipping `yaml:"log_shipping"`
+	// CrashReports sends recovered panics to the API.
+	CrashReports *bool       `yaml:"crash_reports"`
+	Tracing      fileTracing `yaml:"tracing"`
+
+	LogLevel      string `yaml:"log_level"`
+	StatsInterval string `yaml:"stats_interval"`
+	// StatsRetention is a duration such as "1h"; 0 disables buffering.
+	StatsRetention string `yaml:"stats_retention"`
+
+	Backend string      `yaml:"backend"`
+	Fake    fileFake    `yaml:"fake"`
+	QEMU    fileQEMU    `yaml:"qemu"`
+	Tunnel  fileTunnel  `yaml:"tunnel"`
+	FRPC    fileFRPC    `yaml:"frpc"`
+	Network fileNetwork `yaml:"network"`
+	GPU     fileGPU     `yaml:"gpu"`
+	Images  fileImages  `yaml:"images"`
+	// RegistryCache is the pull-through cache for guest image pulls.
+	RegistryCache fileRegistryCache `yaml:"registry_cache"`
+	// Credentials are the instance root logins.
+	Credentials fileCredentials `yaml:"credentials"`
+	Clock       fileClock       `yaml:"clock"`
+	ACME        fileACME        `yaml:"acme"`
+	Location    fileLocation    `yaml:"location"`
+	// Flavors are keyed by name.
+	Flavors map[string]fileFlavor `yaml:"flavors"`
+}
+
+type fileLogRotation struct {
+	MaxSizeMB  *int   `yaml:"max_size_mb"`
+	Period     string `yaml:"period"`
+	MaxBackups *int   `yaml:"max_backups"`
+	MaxAge     string `yaml:"max_age"`
+	Compress   *bool  `yaml:"compress"`
+}
+
+type fileLogShipping struct {
+	Enabled *bool  `yaml:"enabled"`
+	Level   string `yaml:"level"`
+}
+
+type fileTracing struct {
+	Endpoint string `yaml:"endpoint"`
+}
+
+type fileFlavor struct {
+	CPUs       int    `yaml:"cpus"`
+	MemoryGB   int    `yaml:"memory_gb"`
+	DiskGB     int    `yaml:"disk_gb"`
+	GPUs       int    `yaml:"gpus"`
+	Hugepages  bool   `yaml:"hugepages"`
+	CPUPinning string `yaml:"cpu_pinning"`
+}
+
+type fileFake struct {
+	BootTime string `yaml:"boot_time"`
+	Fail     string `yaml:"fail"`
+}
+
+type fileQEMU struct {
+	Binary         string `yaml:"binary"`
+	SwtpmBinary    string `yaml:"swtpm_binary"`
+	OVMFCode       string `yaml:"ovmf_code"`
+	OVMFVars       string `yaml:"ovmf_vars"`
+	CVMFirmware    string `yaml:"confidential_firmware"`
+	SecbootCode    string `yaml:"ovmf_secboot_code"`
+	SecbootVars    string `yaml:"ovmf_secboot_vars"`
+	RunDir         string `yaml:"run_dir"`
+	CPUs           string `yaml:"cpus"`
+	Memory         string `yaml:"memory"`
+	DiskSizeGB     *int   `yaml:"disk_size_gb"`
+	SecureWipe     *bool  `yaml:"secure_wipe"`
+	DiskEncryption *bool  `yaml:"disk_encryption"`
+	VNC            *bool  `yaml:"vnc"`
+	CreateRetries  *int   `yaml:"create_retries"`
+	ManagementKey  string `yaml:"management_key"`
+	// PCIDevices are the non-GPU devices instances may ask for.
+	PCIDevices []string `yaml:"pci_devices"`
+	// USBDevices are vendor:product IDs of USB devices they may ask for.
+	USBDevices []string `yaml:"usb_devices"`
+	// MemoryReserveMB is host memory creates must leave available.
+	MemoryReserveMB *int `yaml:"memory_reserve_mb"`
+	// KSM enables kernel same-page merging; see Config.
+	KSM            *bool `yaml:"ksm"`
+	KSMPagesToScan *int  `yaml:"ksm_pages_to_scan"`
+	// TrimInterval is how often fstrim runs in the guest; "0" disables it.
+	TrimInterval string `yaml:"trim_interval"`
+	// Disk options of instance disks; see Config.
+	DiskPreallocation string `yaml:"disk_preallocation"`
+	DiskClusterSize   string `yaml:"disk_cluster_size"`
+	DiskCache         string `yaml:"disk_cache"`
+	DiskAIO           string `yaml:"disk_aio"`
+}
+
+type fileTunnel struct {
+	Provider  string        `yaml:"provider"`
+	WireGuard fileWireGuard `yaml:"wireguard"`
+}
+
+type fileWireGuard struct {
+	Interface     string   `yaml:"interface"`
+	Address       string   `yaml:"address"`
+	Endpoint      string   `yaml:"endpoint"`
+	PeerPublicKey string   `yaml:"peer_public_key"`
+	AllowedIPs    []string `yaml:"allowed_ips"`
+	PrivateKey    string   `yaml:"private_key"`
+}
+
+type fileFRPC struct {
+	Binary     string `yaml:"binary"`
+	Config     string `yaml:"config"`
+	NetTestURL string `yaml:"nettest_url"`
+	// NetTestOnRegister runs the network test before the host registers.
+	NetTestOnRegister *bool `yaml:"nettest_on_register"`
+	// DownThreshold is a duration such as "2m".
+	DownThreshold string `yaml:"down_threshold"`
+}
+
+type fileNetwork struct {
+	ListenAddr     string   `yaml:"listen_addr"`
+	ListenSocket   string   `yaml:"listen_socket"`
+	MetricsAddr    string   `yaml:"metrics_addr"`
+	GRPCAddr       string   `yaml:"grpc_addr"`
+	Isolation      *bool    `yaml:"isolation"`
+	Accounting     *bool    `yaml:"accounting"`
+	MTLS           *bool    `yaml:"mtls"`
+	SignedRequests *bool    `yaml:"signed_requests"`
+	RateLimit      *float64 `yaml:"rate_limit"`
+
+	MaxBandwidthMbps *int   `yaml:"max_bandwidth_mbps"`
+	SSHPorts         string `yaml:"ssh_ports"`
+	AppPorts         string `yaml:"app_ports"`
+}
+
+type fileGPU struct {
+	PCIAddrs []string `yaml:"pci_addrs"`
+	SRIOVVFs *int     `yaml:"sriov_vfs"`
+	// DCGMExporterPort is the guest port of dcgm-exporter; 0 disables it.
+	DCGMExporterPort *int `yaml:"dcgm_exporter_port"`
+	// PowerCapW caps the total GPU power of an instance; 0 is no cap.
+	PowerCapW *int `yaml:"power_cap_w"`
+	// CriticalTemp enables the thermal watchdog; 0 disables it.
+	CriticalTemp     *int   `yaml:"critical_temp"`
+	CriticalDuration string `yaml:"critical_duration"`
+	ThermalAction    string `yaml:"thermal_action"`
+	ThrottleClockMHz *int   `yaml:"throttle_clock_mhz"`
+	// Benchmark is the command run in a throwaway VM before registration.
+	Benchmark        string `yaml:"benchmark"`
+	BenchmarkTimeout string `yaml:"benchmark_timeout"`
+}
+
+type fileImages struct {
+	Dir             string   `yaml:"dir"`
+	BaseImage       string   `yaml:"base_image"`
+	PublicKey       string   `yaml:"public_key"`
+	GCWatermark     *float64 `yaml:"gc_watermark"`
+	UpdatePublicKey string   `yaml:"update_public_key"`
+	// Conversion rewrites downloaded base images; see Config.
+	Conversion string `yaml:"conversion"`
+}
+
+type fileRegistryCache struct {
+	Port      *int   `yaml:"port"`
+	Dir       string `yaml:"dir"`
+	Upstream  string `yaml:"upstream"`
+	MaxSizeGB *int   `yaml:"max_size_gb"`
+}
+
+type fileCredentials struct {
+	PasswordAuth *bool  `yaml:"password_auth"`
+	PublicKey    string `yaml:"public_key"`
+}
+
+type fileClock struct {
+	NTPServers     []string `yaml:"ntp_servers"`
+	DriftThreshold string   `yaml:"drift_threshold"`
+	ManageChrony   *bool    `yaml:"manage_chrony"`
+}
+
+type fileACME struct {
+	Directory string `yaml:"directory"`
+	Email     string `yaml:"email"`
+}
+
+type fileLocation struct {
+	City     string `yaml:"city"`
+	Country  string `yaml:"country"`
+	Region   string `yaml:"region"`
+	GeoIPURL string `yaml:"geoip_url"`
+}
+
+// loadFile applies the config file at path on top of cfg. A missing file is
+// not an error; unknown keys are, so that typos do not go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	var f fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return f.apply(cfg)
+}
+
+func (f *fileConfig) apply(cfg *Config) error {
+	setString(&cfg.APIKey, strings.TrimSpace(f.APIKey))
+	setString(&cfg.ServiceURL, f.ServiceURL)
+	setBool(&cfg.Debug, f.Debug)
+	setString(&cfg.DataDir, f.DataDir)
+	setString(&cfg.LogDir, f.LogDir)
+	setString(&cfg.LogLevel, strings.TrimSpace(f.LogLevel))
+	if n := f.LogRotation.MaxSizeMB; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("log_rotation.max_size_mb must be a non-negative integer, got %d", *n)
+		}
+		cfg.LogRotation.MaxSizeMB = *n
+	}
+	if v := f.LogRotation.Period; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("log_rotation.period must be a non-negative duration, got %q", v)
+		}
+		cfg.LogRotation.Period = d
+	}
+	if n := f.LogRotation.MaxBackups; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("log_rotation.max_backups must be a non-negative integer, got %d", *n)
+		}
+		cfg.LogRotation.MaxBackups = *n
+	}
+	if v := f.LogRotation.MaxAge; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("log_rotation.max_age must be a non-negative duration, got %q", v)
+		}
+		cfg.LogRotation.MaxAge = d
+	}
+	setBool(&cfg.LogRotation.Compress, f.LogRotation.Compress)
+	setBool(&cfg.LogShipping, f.LogShipping.Enabled)
+	setBool(&cfg.CrashReports, f.CrashReports)
+	setString(&cfg.TracingEndpoint, f.Tracing.Endpoint)
+	if v := strings.TrimSpace(f.LogShipping.Level); v != "" {
+		if err := cfg.LogShippingLevel.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("log_shipping.level must be debug, info, warn or error, got %q", v)
+		}
+	}
+	if v := f.StatsInterval; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("stats_interval must be a duration, got %q", v)
+		}
+		cfg.StatsInterval = d
+	}
+	if v := f.StatsRetention; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("stats_retention must be a non-negative duration, got %q", v)
+		}
+		cfg.StatsRetention = d
+	}
+
+	setString(&cfg.QEMUBinary, f.QEMU.Binary)
+	setString(&cfg.SwtpmBinary, f.QEMU.SwtpmBinary)
+	setString(&cfg.ConfidentialFirmware, f.QEMU.CVMFirmware)
+	setString(&cfg.OVMFCodePath, f.QEMU.OVMFCode)
+	setString(&cfg.OVMFVarsPath, f.QEMU.OVMFVars)
+	setString(&cfg.OVMFSecbootCode, f.QEMU.SecbootCode)
+	setString(&cfg.OVMFSecbootVars, f.QEMU.SecbootVars)
+	setString(&cfg.VMRunDir, f.QEMU.RunDir)
+	setString(&cfg.VMDefaultCPUs, f.QEMU.CPUs)
+	setString(&cfg.VMDefaultMemory, f.QEMU.Memory)
+	if n := f.QEMU.DiskSizeGB; n != nil {
+		if *n <= 0 {
+			return fmt.Errorf("qemu.disk_size_gb must be positive, got %d", *n)
+		}
+		cfg.VMDiskSizeGB = *n
+	}
+	setBool(&cfg.SecureWipe, f.QEMU.SecureWipe)
+	setBool(&cfg.DiskEncryption, f.QEMU.DiskEncryption)
+	setBool(&cfg.VNC, f.QEMU.VNC)
+	if addrs := nonEmpty(f.QEMU.PCIDevices); len(addrs) > 0 {
+		cfg.PCIDevices = addrs
+	}
+	if ids := nonEmpty(f.QEMU.USBDevices); len(ids) > 0 {
+		devs, err := parseUSBDevices(ids)
+		if err != nil {
+			return fmt.Errorf("qemu.usb_devices: %w", err)
+		}
+		cfg.USBDevices = devs
+	}
+	if n := f.QEMU.CreateRetries; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("qemu.create_retries must not be negative, got %d", *n)
+		}
+		cfg.CreateRetries = *n
+	}
+	if n := f.QEMU.MemoryReserveMB; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("qemu.memory_reserve_mb must not be negative, got %d", *n)
+		}
+		cfg.MemoryReserveMB = *n
+	}
+	setBool(&cfg.KSM, f.QEMU.KSM)
+	if n := f.QEMU.KSMPagesToScan; n != nil {
+		if *n <= 0 {
+			return fmt.Errorf("qemu.ksm_pages_to_scan must be positive, got %d", *n)
+		}
+		cfg.KSMPagesToScan = *n
+	}
+	if v := f.QEMU.TrimInterval; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("qemu.trim_interval must be a non-negative duration, got %q", v)
+		}
+		cfg.TrimInterval = d
+	}
+	setString(&cfg.DiskPreallocation, f.QEMU.DiskPreallocation)
+	setString(&cfg.DiskClusterSize, f.QEMU.DiskClusterSize)
+	setString(&cfg.DiskCache, f.QEMU.DiskCache)
+	setString(&cfg.DiskAIO, f.QEMU.DiskAIO)
+	setString(&cfg.ManagementKeyPath, f.QEMU.ManagementKey)
+
+	setString(&cfg.TunnelProvider, f.Tunnel.Provider)
+	setString(&cfg.Backend, f.Backend)
+	if v := f.Fake.BootTime; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("fake.boot_time must be a non-negative duration, got %q", v)
+		}
+		cfg.FakeBootTime = d
+	}
+	setString(&cfg.FakeFailReason, f.Fake.Fail)
+	wg := f.Tunnel.WireGuard
+	setString(&cfg.WireGuard.Interface, wg.Interface)
+	setString(&cfg.WireGuard.Address, wg.Address)
+	setString(&cfg.WireGuard.Endpoint, wg.Endpoint)
+	setString(&cfg.WireGuard.PeerPublicKey, wg.PeerPublicKey)
+	if ips := nonEmpty(wg.AllowedIPs); len(ips) > 0 {
+		cfg.WireGuard.AllowedIPs = ips
+	}
+	setString(&cfg.WireGuard.PrivateKeyPath, wg.PrivateKey)
+
+	setString(&cfg.FRPCBinary, f.FRPC.Binary)
+	setString(&cfg.FRPCConfigPath, f.FRPC.Config)
+	setString(&cfg.NetTestFRPURL, strings.TrimRight(f.FRPC.NetTestURL, "/"))
+	setBool(&cfg.NetTestOnRegister, f.FRPC.NetTestOnRegister)
+	if v := f.FRPC.DownThreshold; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("frpc.down_threshold must be a positive duration, got %q", v)
+		}
+		cfg.TunnelDownThreshold = d
+	}
+
+	setString(&cfg.ListenAddr, strings.TrimSpace(f.Network.ListenAddr))
+	setString(&cfg.ListenSocket, f.Network.ListenSocket)
+	setString(&cfg.MetricsAddr, f.Network.MetricsAddr)
+	setString(&cfg.GRPCAddr, f.Network.GRPCAddr)
+	setBool(&cfg.NetworkIsolation, f.Network.Isolation)
+	setBool(&cfg.NetAccounting, f.Network.Accounting)
+	setBool(&cfg.MTLS, f.Network.MTLS)
+	setBool(&cfg.SignedRequests, f.Network.SignedRequests)
+	if v := f.Network.RateLimit; v != nil {
+		if *v < 0 {
+			return fmt.Errorf("network.rate_limit must be a non-negative number, got %g", *v)
+		}
+		cfg.APIRateLimit = *v
+	}
+	if n := f.Network.MaxBandwidthMbps; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("network.max_bandwidth_mbps must be a non-negative integer, got %d", *n)
+		}
+		cfg.MaxBandwidthMbps = *n
+	}
+	if v := f.Network.SSHPorts; v != "" {
+		r, err := parsePortRange(v)
+		if err != nil {
+			return fmt.Errorf("network.ssh_ports: %w", err)
+		}
+		cfg.SSHPorts = r
+	}
+	if v := f.Network.AppPorts; v != "" {
+		r, err := parsePortRange(v)
+		if err != nil {
+			return fmt.Errorf("network.app_ports: %w", err)
+		}
+		cfg.AppPorts = r
+	}
+
+	if addrs := nonEmpty(f.GPU.PCIAddrs); len(addrs) > 0 {
+		cfg.GPUPCIAddrs = addrs
+	}
+	if n := f.GPU.SRIOVVFs; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("gpu.sriov_vfs must be a non-negative integer, got %d", *n)
+		}
+		cfg.GPUSRIOVNumVFs = *n
+	}
+	if n := f.GPU.DCGMExporterPort; n != nil {
+		if *n < 0 || *n > 65535 {
+			return fmt.Errorf("gpu.dcgm_exporter_port must be a port number, got %d", *n)
+		}
+		cfg.DCGMExporterPort = *n
+	}
+	if n := f.GPU.PowerCapW; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("gpu.power_cap_w must be a non-negative number of Watts, got %d", *n)
+		}
+		cfg.GPUPowerCapW = *n
+	}
+	if n := f.GPU.CriticalTemp; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("gpu.critical_temp must be a non-negative temperature in °C, got %d", *n)
+		}
+		cfg.GPUCriticalTemp = *n
+	}
+	if v := f.GPU.CriticalDuration; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("gpu.critical_duration must be a non-negative duration, got %q", v)
+		}
+		cfg.GPUCriticalDuration = d
+	}
+	if v := f.GPU.ThermalAction; v != "" {
+		if v != ThermalThrottle && v != ThermalPause {
+			return fmt.Errorf("gpu.thermal_action must be %q or %q, got %q", ThermalThrottle, ThermalPause, v)
+		}
+		cfg.GPUThermalAction = v
+	}
+	if n := f.GPU.ThrottleClockMHz; n != nil {
+		if *n <= 0 {
+			return fmt.Errorf("gpu.throttle_clock_mhz must be a positive number of MHz, got %d", *n)
+		}
+		cfg.GPUThrottleClockMHz = *n
+	}
+	setString(&cfg.GPUBenchmarkCmd, f.GPU.Benchmark)
+	if v := f.GPU.BenchmarkTimeout; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("gpu.benchmark_timeout must be a positive duration, got %q", v)
+		}
+		cfg.GPUBenchmarkTimeout = d
+	}
+
+	setString(&cfg.ImageDir, f.Images.Dir)
+	setString(&cfg.BaseImagePath, f.Images.BaseImage)
+	setString(&cfg.ImagePublicKey, f.Images.PublicKey)
+	if w := f.Images.GCWatermark; w != nil {
+		if *w <= 0 || *w > 100 {
+			return fmt.Errorf("images.gc_watermark must be a percentage in (0, 100], got %v", *w)
+		}
+		cfg.ImageGCWatermark = *w
+	}
+	setString(&cfg.UpdatePublicKey, f.Images.UpdatePublicKey)
+	setString(&cfg.BaseImageConversion, f.Images.Conversion)
+	setBool(&cfg.PasswordAuth, f.Credentials.PasswordAuth)
+
+	if n := f.RegistryCache.Port; n != nil {
+		if *n < 0 || *n > 65535 {
+			return fmt.Errorf("registry_cache.port must be a port number, got %d", *n)
+		}
+		cfg.RegistryCachePort = *n
+	}
+	setString(&cfg.RegistryCacheDir, f.RegistryCache.Dir)
+	setString(&cfg.RegistryCacheUpstream, f.RegistryCache.Upstream)
+	if n := f.RegistryCache.MaxSizeGB; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("registry_cache.max_size_gb must be a non-negative integer, got %d", *n)
+		}
+		cfg.RegistryCacheMaxGB = *n
+	}
+	setString(&cfg.CredentialsPublicKey, f.Credentials.PublicKey)
+
+	if servers := nonEmpty(f.Clock.NTPServers); len(servers) > 0 {
+		cfg.NTPServers = servers
+	}
+	if v := f.Clock.DriftThreshold; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("clock.drift_threshold must be a positive duration, got %q", v)
+		}
+		cfg.ClockDriftThreshold = d
+	}
+	setBool(&cfg.ManageChrony, f.Clock.ManageChrony)
+
+	setString(&cfg.ACMEDirectoryURL, f.ACME.Directory)
+	setString(&cfg.ACMEEmail, f.ACME.Email)
+
+	setString(&cfg.Location.City, f.Location.City)
+	setString(&cfg.Location.Country, f.Location.Country)
+	setString(&cfg.Location.Region, f.Location.Region)
+	setString(&cfg.GeoIPURL, f.Location.GeoIPURL)
+
+	if len(f.Flavors) > 0 {
+		cfg.Flavors = nil
+		for _, name := range slices.Sorted(maps.Keys(f.Flavors)) {
+			ff := f.Flavors[name]
+			fl := domain.Flavor{
+				Name:       name,
+				CPUs:       ff.CPUs,
+				MemoryGB:   ff.MemoryGB,
+				DiskGB:     ff.DiskGB,
+				GPUs:       ff.GPUs,
+				Hugepages:  ff.Hugepages,
+				CPUPinning: ff.CPUPinning,
+			}
+			if fl.CPUPinning == "" {
+				fl.CPUPinning = domain.PinningNone
+			}
+			if err := validateFlavor(fl); err != nil {
+				return fmt.Errorf("flavors.%s: %w", name, err)
+			}
+			cfg.Flavors = append(cfg.Flavors, fl)
+		}
+	}
+	return nil
+}
+
+func validateFlavor(f domain.Flavor) error {
+	switch {
+	case f.CPUs <= 0:
+		return errors.New("cpus must be positive")
+	case f.MemoryGB <= 0:
+		return errors.New("memory_gb must be positive")
+	case f.DiskGB < 0 || f.GPUs < 0:
+		return errors.New("disk_gb and gpus must not be negative")
+	}
+	switch f.CPUPinning {
+	case domain.PinningNone, domain.PinningNUMA, domain.PinningDedicated:
+	default:
+		return fmt.Errorf("cpu_pinning must be %q, %q or %q, got %q",
+			domain.PinningNone, domain.PinningNUMA, domain.PinningDedicated, f.CPUPinning)
+	}
+	return nil
+}
+
+func setString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func setBool(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func nonEmpty(in []string) []string {
+	var out []string
+	for _, s := range in {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
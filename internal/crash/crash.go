@@ -0,0 +1,161 @@
+// Package crash recovers panics in the agent's goroutines. A recovered panic
+// is logged with its stack, written to a crash report file and handed to the
+// reporter, so that one failing goroutine does not take the agent, and the
+// GPU cleanup it owes, down with it.
+package crash
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/metrics"
+)
+
+const (
+	// maxReports is how many report files are kept.
+	maxReports = 20
+	// restartDelay is how long Loop waits before running a loop again.
+	restartDelay = 5 * time.Second
+)
+
+// Report is a recovered panic.
+type Report struct {
+	// Where names the goroutine that panicked.
+	Where   string
+	Panic   string
+	Stack   string
+	Version string
+	Time    time.Time
+	// File is the crash report written for it; empty if it could not be.
+	File string
+}
+
+var (
+	mu       sync.Mutex
+	dir      string
+	version  string
+	logger   = slog.Default()
+	reporter func(Report)
+)
+
+// Setup sets where reports are written and the agent version they carry.
+func Setup(reportDir, agentVersion string, l *slog.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	dir, version, logger = reportDir, agentVersion, l
+}
+
+// SetReporter sets the function every report is passed to, e.g. to send it
+// to the API. nil disables it.
+func SetReporter(f func(Report)) {
+	mu.Lock()
+	defer mu.Unlock()
+	reporter = f
+}
+
+// Recover recovers a panic in the calling goroutine and reports it. It must
+// be deferred directly: defer crash.Recover("stats").
+func Recover(where string) {
+	if v := recover(); v != nil {
+		Handle(where, v)
+	}
+}
+
+// Go runs fn in a new goroutine that recovers its panics.
+func Go(where string, fn func()) {
+	go func() {
+		defer Recover(where)
+		fn()
+	}()
+}
+
+// Loop runs fn until ctx is cancelled, running it again after a delay when
+// it panics. fn is a long-running loop that returns once ctx is done.
+func Loop(ctx context.Context, where string, fn func(context.Context)) {
+	for {
+		panicked := true
+		func() {
+			defer Recover(where)
+			fn(ctx)
+			panicked = false
+		}()
+		if !panicked {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+// Handle reports v, a value recovered from a panic in the goroutine named
+// where, for callers that recover themselves. The stack is the caller's.
+func Handle(where string, v any) Report {
+	rep := Report{
+		Where: where,
+		Panic: fmt.Sprint(v),
+		Stack: string(debug.Stack()),
+		Time:  time.Now().UTC(),
+	}
+
+	mu.Lock()
+	rep.Version = version
+	l, report, reportDir := logger, reporter, dir
+	mu.Unlock()
+
+	metrics.Panics.WithLabelValues(where).Inc()
+	if reportDir != "" {
+		file, err := write(reportDir, rep)
+		if err != nil {
+			l.Error("failed to write crash report", "err", err)
+		}
+		rep.File = file
+	}
+	l.Error("panic recovered", "where", where, "panic", rep.Panic, "stack", rep.Stack, "report", rep.File)
+	if report != nil {
+		report(rep)
+	}
+	return rep
+}
+
+// write saves rep as a text file in reportDir and removes the oldest
+// reports beyond maxReports.
+func write(reportDir string, rep Report) (string, error) {
+	if err := os.MkdirAll(reportDir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("crash-%s-%s.txt", rep.Time.Format("20060102-150405.000"), sanitize(rep.Where))
+	path := filepath.Join(reportDir, name)
+	body := fmt.Sprintf("time: %s\nversion: %s\nwhere: %s\npanic: %s\n\n%s",
+		rep.Time.Format(time.RFC3339Nano), rep.Version, rep.Where, rep.Panic, rep.Stack)
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		return "", err
+	}
+
+	old, _ := filepath.Glob(filepath.Join(reportDir, "crash-*.txt"))
+	sort.Strings(old)
+	for len(old) > maxReports {
+		_ = os.Remove(old[0])
+		old = old[1:]
+	}
+	return path, nil
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
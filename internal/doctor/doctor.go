@@ -0,0 +1,281 @@
+// Package doctor runs the preflight checks behind `qudata-agent doctor`: it
+// verifies that the host can run instances with the given configuration and
+// says how to fix what is missing, without changing anything on the host.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/qudata/agent/internal/config"
+	"github.com/qudata/agent/internal/qemu"
+	"github.com/qudata/agent/internal/qudata"
+	"github.com/qudata/agent/internal/system"
+	"github.com/qudata/agent/internal/tunnel"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	OK   Status = "ok"
+	Warn Status = "warn"
+	Fail Status = "fail"
+)
+
+// Result is one check. Fix says what to do about a warning or a failure.
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+	Fix    string
+}
+
+// Run checks the host against cfg.
+func Run(ctx context.Context, cfg *config.Config) []Result {
+	var res []Result
+	add := func(r ...Result) { res = append(res, r...) }
+
+	add(checkRoot())
+	// The fake backend needs none of the virtualization stack.
+	if cfg.Backend != config.BackendFake {
+		add(checkKVM())
+		add(checkIOMMU())
+		add(checkNested())
+		add(checkVFIOModule())
+		add(checkGPUs(cfg.GPUPCIAddrs)...)
+		add(checkPCIDevices(cfg.PCIDevices)...)
+		add(checkFile("QEMU", cfg.QEMUBinary, "install qemu-system-x86 or set QUDATA_QEMU_BINARY"))
+		add(checkCommand("qemu-img", "install qemu-utils"))
+		add(checkFile("OVMF code", cfg.OVMFCodePath, "install ovmf or set QUDATA_OVMF_CODE"))
+		add(checkFile("OVMF vars", cfg.OVMFVarsPath, "install ovmf or set QUDATA_OVMF_VARS"))
+		add(warnOnly(checkFile("OVMF Secure Boot code", cfg.OVMFSecbootCode,
+			"install ovmf or set QUDATA_OVMF_SECBOOT_CODE; creates with secure_boot fail until then")))
+		add(warnOnly(checkFile("OVMF Secure Boot vars", cfg.OVMFSecbootVars,
+			"install ovmf or set QUDATA_OVMF_SECBOOT_VARS; creates with secure_boot fail until then")))
+		add(checkBaseImage(cfg.BaseImagePath))
+		add(checkSwtpm(cfg.SwtpmBinary))
+		add(checkConfidential(cfg.ConfidentialFirmware))
+	}
+	add(checkTunnel(cfg)...)
+	if cfg.NetworkIsolation || cfg.NetAccounting || cfg.MaxBandwidthMbps > 0 {
+		add(checkCommand("nft", "install nftables or disable network isolation and accounting"))
+		add(checkCgroupV2())
+	}
+	add(checkAPI(ctx, cfg))
+	return res
+}
+
+// Failed reports whether any check failed; warnings do not count.
+func Failed(res []Result) bool {
+	for _, r := range res {
+		if r.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the results one per line, each warning and failure followed
+// by its fix.
+func Print(w io.Writer, res []Result) {
+	for _, r := range res {
+		tag := map[Status]string{OK: "[ OK ]", Warn: "[WARN]", Fail: "[FAIL]"}[r.Status]
+		line := tag + " " + r.Name
+		if r.Detail != "" {
+			line += ": " + r.Detail
+		}
+		fmt.Fprintln(w, line)
+		if r.Status != OK && r.Fix != "" {
+			fmt.Fprintln(w, "       fix: "+r.Fix)
+		}
+	}
+}
+
+func checkRoot() Result {
+	if os.Geteuid() != 0 {
+		return Result{Name: "root", Status: Fail, Detail: "not running as root",
+			Fix: "run the agent as root; it binds GPUs to vfio-pci and manages nftables"}
+	}
+	return Result{Name: "root", Status: OK}
+}
+
+func checkKVM() Result {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return Result{Name: "KVM", Status: Fail, Detail: err.Error(),
+			Fix: "enable VT-x/AMD-V in BIOS and load kvm_intel or kvm_amd"}
+	}
+	f.Close()
+	return Result{Name: "KVM", Status: OK, Detail: "/dev/kvm"}
+}
+
+func checkIOMMU() Result {
+	caps := system.Capabilities()
+	if caps.IOMMUGroups == 0 {
+		return Result{Name: "IOMMU", Status: Fail, Detail: "no IOMMU groups",
+			Fix: "enable VT-d/AMD-Vi in BIOS and boot with intel_iommu=on iommu=pt (or amd_iommu=on)"}
+	}
+	return Result{Name: "IOMMU", Status: OK, Detail: fmt.Sprintf("%s, %d groups", caps.IOMMUType, caps.IOMMUGroups)}
+}
+
+// checkNested only warns: instances without nested do not need it.
+func checkNested() Result {
+	if system.Capabilities().NestedVirt {
+		return Result{Name: "nested virtualization", Status: OK, Detail: "enabled"}
+	}
+	return Result{Name: "nested virtualization", Status: Warn, Detail: "disabled, creates with nested fail",
+		Fix: "set options kvm_intel nested=1 (or kvm_amd nested=1) in /etc/modprobe.d and reload the module"}
+}
+
+func checkVFIOModule() Result {
+	if _, err := os.Stat("/sys/module/vfio_pci"); err == nil {
+		return Result{Name: "vfio-pci", Status: OK, Detail: "loaded"}
+	}
+	if err := exec.Command("modinfo", "vfio-pci").Run(); err != nil {
+		return Result{Name: "vfio-pci", Status: Fail, Detail: "module not available",
+			Fix: "install the kernel's extra modules package"}
+	}
+	return Result{Name: "vfio-pci", Status: OK, Detail: "available, loaded on first bind"}
+}
+
+func checkGPUs(addrs []string) []Result {
+	if len(addrs) == 0 {
+		return []Result{{Name: "GPU", Status: Fail, Detail: "no GPU configured",
+			Fix: "set QUDATA_GPU_PCI_ADDR or gpu.pci_addrs"}}
+	}
+	var res []Result
+	for _, addr := range addrs {
+		name := "GPU " + addr
+		driver, err := qemu.NewVFIO(addr).Check()
+		switch {
+		case err != nil:
+			res = append(res, Result{Name: name, Status: Fail, Detail: err.Error(),
+				Fix: "pass through the whole IOMMU group, or move the GPU to a slot with its own group"})
+		case driver == "":
+			res = append(res, Result{Name: name, Status: OK, Detail: "no driver bound"})
+		default:
+			res = append(res, Result{Name: name, Status: OK, Detail: "driver " + driver})
+		}
+	}
+	if _, err := os.Stat("/sys/module/nvidia"); err == nil {
+		res = append(res, Result{Name: "nvidia driver", Status: Warn, Detail: "loaded on the host",
+			Fix: "the GPUs are unbound from it on create; blacklist nvidia if a host process keeps them busy"})
+	}
+	return res
+}
+
+// checkPCIDevices only warns: instances that do not ask for a device are
+// not affected.
+func checkPCIDevices(addrs []string) []Result {
+	var res []Result
+	for _, addr := range addrs {
+		name := "PCI device " + addr
+		driver, err := qemu.NewDeviceVFIO(addr).Check()
+		switch {
+		case err != nil:
+			res = append(res, Result{Name: name, Status: Warn, Detail: err.Error(),
+				Fix: "unbind the rest of its IOMMU group from host drivers, or move the device to a slot with its own group"})
+		case driver == "":
+			res = append(res, Result{Name: name, Status: OK, Detail: "no driver bound"})
+		default:
+			res = append(res, Result{Name: name, Status: OK, Detail: "driver " + driver + ", unbound on create"})
+		}
+	}
+	return res
+}
+
+func checkFile(name, path, fix string) Result {
+	if path == "" {
+		return Result{Name: name, Status: Fail, Detail: "not configured", Fix: fix}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return Result{Name: name, Status: Fail, Detail: err.Error(), Fix: fix}
+	}
+	return Result{Name: name, Status: OK, Detail: path}
+}
+
+func checkCommand(name, fix string) Result {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return Result{Name: name, Status: Fail, Detail: "not found in PATH", Fix: fix}
+	}
+	return Result{Name: name, Status: OK, Detail: path}
+}
+
+func checkBaseImage(path string) Result {
+	if path == "" {
+		return Result{Name: "base image", Status: OK, Detail: "images are pulled per instance"}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return Result{Name: "base image", Status: Warn, Detail: err.Error(),
+			Fix: "creates without an image will fail until it is in place"}
+	}
+	return Result{Name: "base image", Status: OK, Detail: path}
+}
+
+// warnOnly downgrades the failure of a check for something only some
+// instances need.
+func warnOnly(r Result) Result {
+	if r.Status == Fail {
+		r.Status = Warn
+	}
+	return r
+}
+
+func checkSwtpm(path string) Result {
+	return warnOnly(checkFile("swtpm", path, "install swtpm or set QUDATA_SWTPM_BINARY; creates with tpm fail until then"))
+}
+
+// checkConfidential reports the confidential VM mode of the host and, if
+// it has one, the firmware it needs.
+func checkConfidential(firmware string) Result {
+	mode := system.Capabilities().ConfidentialMode()
+	if mode == "" {
+		return Result{Name: "confidential VMs", Status: OK, Detail: "not supported by the host"}
+	}
+	r := checkFile("confidential VMs", qemu.ConfidentialFirmware(mode, firmware),
+		"install the OVMF build for "+string(mode)+" or set QUDATA_CONFIDENTIAL_FIRMWARE")
+	if r.Status == OK {
+		r.Detail = string(mode) + ", " + r.Detail
+	}
+	return warnOnly(r)
+}
+
+func checkTunnel(cfg *config.Config) []Result {
+	if cfg.TestMode {
+		return []Result{{Name: "tunnel", Status: OK, Detail: "skipped in test mode"}}
+	}
+	if cfg.TunnelProvider == tunnel.ProviderWireGuard {
+		return []Result{
+			checkCommand("wg", "install wireguard-tools"),
+			checkCommand("ip", "install iproute2"),
+		}
+	}
+	return []Result{checkFile("frpc", cfg.FRPCBinary, "install frpc or set QUDATA_FRPC_BINARY")}
+}
+
+func checkCgroupV2() Result {
+	if _, err := os.Stat(filepath.Join("/sys/fs/cgroup", "cgroup.controllers")); err != nil {
+		return Result{Name: "cgroup v2", Status: Fail, Detail: "not mounted",
+			Fix: "boot with systemd.unified_cgroup_hierarchy=1 or disable network isolation and accounting"}
+	}
+	return Result{Name: "cgroup v2", Status: OK}
+}
+
+func checkAPI(ctx context.Context, cfg *config.Config) Result {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	client := qudata.NewClient(cfg.APIKey, cfg.ServiceURL, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := client.Ping(ctx); err != nil {
+		return Result{Name: "API", Status: Fail, Detail: err.Error(),
+			Fix: "check outbound HTTPS to " + cfg.ServiceURL + " and the proxy settings"}
+	}
+	return Result{Name: "API", Status: OK, Detail: cfg.ServiceURL}
+}
@@ -8,6 +8,11 @@ type InitAgentRequest struct {
 	PID         int    `json:"pid"`
 	Version     string `json:"version"`
 	TestMode    bool   `json:"test_mode,omitempty"`
+	// Encodings lists the telemetry wire encodings the agent can produce.
+	Encodings []string `json:"encodings,omitempty"`
+	// TLSCSR is a PEM certificate request for the agent API, sent when
+	// mutual TLS is enabled.
+	TLSCSR string `json:"tls_csr,omitempty"`
 }
 
 type InitAgentResponse struct {
@@ -22,6 +27,67 @@ type InitAgentRespData struct {
 	SecretKey       string `json:"secret_key"`
 	TunnelToken     string `json:"tunnel_token"`
 	InstanceRunning bool   `json:"instance_running"`
+	// StatsEncoding selects the telemetry encoding, one of InitAgentRequest.Encodings.
+	StatsEncoding string `json:"stats_encoding,omitempty"`
+	// BaseImage is the VM base image the control plane wants this host to run.
+	BaseImage *BaseImageSpec `json:"base_image,omitempty"`
+	// APITLS answers InitAgentRequest.TLSCSR.
+	APITLS *APITLS `json:"api_tls,omitempty"`
+	// FRP overrides the built-in frps address and token.
+	FRP *FRPInfo `json:"frp,omitempty"`
+	// SpeedTest lists extra endpoints the network test measures against.
+	SpeedTest []SpeedTestEndpoint `json:"speedtest,omitempty"`
+	// GeoIPURL replaces the configured GeoIP lookup; {ip} stands for the
+	// public IP.
+	GeoIPURL string `json:"geoip_url,omitempty"`
+}
+
+// SpeedTestEndpoint is a server implementing the nettest protocol: GET
+// <url>/nettest/download?bytes=N and POST <url>/nettest/upload.
+type SpeedTestEndpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// FRPInfo tells the agent which frps servers to tunnel through. The first
+// server is used until it fails; the rest are tried in order after it.
+type FRPInfo struct {
+	Servers []FRPServer `json:"servers"`
+	Token   string      `json:"token,omitempty"`
+	// TLS, when set, wraps the connection to frps in TLS.
+	TLS *FRPTLS `json:"tls,omitempty"`
+}
+
+type FRPServer struct {
+	Addr string `json:"addr"`
+	Port int    `json:"port"`
+}
+
+type FRPTLS struct {
+	// ServerName is checked against the frps certificate; defaults to the
+	// server address.
+	ServerName string `json:"server_name,omitempty"`
+	// TrustedCA is the PEM CA the frps certificate must chain to. Without it
+	// frpc does not verify the certificate.
+	TrustedCA string `json:"trusted_ca,omitempty"`
+}
+
+// APITLS is the material the agent API is served with under mutual TLS.
+type APITLS struct {
+	// Certificate is the PEM chain issued for the agent's CSR.
+	Certificate string `json:"certificate"`
+	// ClientCA is the PEM CA the control plane's client certificates are
+	// issued by.
+	ClientCA string `json:"client_ca"`
+}
+
+// BaseImageSpec declares a base image version and how to verify it.
+type BaseImageSpec struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	SHA256  string `json:"sha256"`
+	// Signature is a base64 ed25519 signature over the raw SHA-256 digest.
+	Signature string `json:"signature,omitempty"`
 }
 
 type AgentMetadata struct {
@@ -31,4 +97,8 @@ type AgentMetadata struct {
 	SecretKey   string
 	TunnelToken string
 	HostExists  bool
+	BaseImage   *BaseImageSpec
+	FRP         *FRPInfo
+	SpeedTest   []SpeedTestEndpoint
+	GeoIPURL    string
 }
@@ -0,0 +1,42 @@
+package domain
+
+import "time"
+
+// ConfidentialMode is the memory-encryption technology a confidential VM
+// runs under.
+type ConfidentialMode string
+
+const (
+	ConfidentialSEVSNP ConfidentialMode = "sev-snp"
+	ConfidentialTDX    ConfidentialMode = "tdx"
+)
+
+// ConfidentialMode returns the mode confidential VMs run under on the host,
+// or "" when it supports none. SEV-SNP wins over plain SEV and SEV-ES, which
+// do not protect guest memory integrity and are not offered.
+func (c HostCapabilities) ConfidentialMode() ConfidentialMode {
+	switch {
+	case c.SEVSNP:
+		return ConfidentialSEVSNP
+	case c.TDX:
+		return ConfidentialTDX
+	}
+	return ""
+}
+
+// Attestation is evidence, signed by the CPU, that the instance runs as a
+// confidential VM. The renter verifies it against the vendor's keys; the
+// agent only relays it.
+type Attestation struct {
+	Mode ConfidentialMode `json:"mode"`
+	// Provider is the guest driver that produced the report, "sev_guest"
+	// or "tdx_guest".
+	Provider string `json:"provider"`
+	// Nonce is the report data bound into the report.
+	Nonce []byte `json:"nonce"`
+	// Report is the SNP attestation report or the TDX quote.
+	Report []byte `json:"report"`
+	// AuxBlob is the certificate chain SEV-SNP hosts may attach.
+	AuxBlob   []byte    `json:"aux_blob,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,22 @@
+package domain
+
+const (
+	// SharedVolumePath is where the containers of an instance mount their
+	// shared volume.
+	SharedVolumePath = "/shared"
+	// ComposeUnit is the guest systemd unit running the containers; its
+	// journal holds their output.
+	ComposeUnit = "qudata-compose"
+)
+
+// Container is one of the containers run in the guest. The containers of an
+// instance share the guest network, so that they reach each other on
+// localhost, and a volume mounted at SharedVolumePath.
+type Container struct {
+	Name    string            `json:"name" binding:"required,max=63"`
+	Image   string            `json:"image" binding:"required"`
+	Command []string          `json:"command,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// GPUs gives the container all GPUs of the guest.
+	GPUs bool `json:"gpus,omitempty"`
+}
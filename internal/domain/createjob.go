@@ -0,0 +1,33 @@
+package domain
+
+import "time"
+
+// CreateJob is an accepted instance create. It is persisted before any work
+// starts and removed once the instance runs or the create has failed, so a
+// create interrupted by an agent restart is found and resumed.
+type CreateJob struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	// Spec carries the VM ID chosen up front, which names the disk and run
+	// files an interrupted attempt may have left behind.
+	Spec      InstanceSpec      `json:"spec"`
+	HostPorts []int             `json:"host_ports"`
+	Allocated []int             `json:"allocated"`
+	Ports     map[string]string `json:"ports"`
+	// FRPC is set when the instance is published through frpc; SSHRemote
+	// is then the remote SSH port.
+	FRPC      bool `json:"frpc,omitempty"`
+	SSHRemote int  `json:"ssh_remote,omitempty"`
+	// Import is set for a migrated instance, whose staging bundle does not
+	// survive a restart; such a create is failed instead of resumed.
+	Import bool `json:"import,omitempty"`
+	// DiskKeySupplied is set when the caller supplied the disk key. The key
+	// is not persisted, so such a create is failed instead of resumed with a
+	// key the caller would never learn.
+	DiskKeySupplied bool `json:"disk_key_supplied,omitempty"`
+	// Resumes counts the restarts this create has been resumed after.
+	Resumes int `json:"resumes,omitempty"`
+	// Trace is the W3C trace context of the request that started the
+	// create, continued by the create worker.
+	Trace map[string]string `json:"trace,omitempty"`
+}
@@ -0,0 +1,13 @@
+package domain
+
+// RootUser is the login instance credentials are for.
+const RootUser = "root"
+
+// Credentials are the root login of an instance. The password is either in
+// Password or, when the agent has a control plane key, sealed to that key
+// (NaCl sealed box, base64) in SealedPassword.
+type Credentials struct {
+	Username       string `json:"username"`
+	Password       string `json:"password,omitempty"`
+	SealedPassword string `json:"sealed_password,omitempty"`
+}
@@ -0,0 +1,16 @@
+package domain
+
+// DecommissionOptions selects what survives POST /decommission.
+type DecommissionOptions struct {
+	KeepLogs   bool `json:"keep_logs"`
+	KeepImages bool `json:"keep_images"`
+	// Uninstall removes the systemd unit, which also holds the API key.
+	Uninstall bool `json:"uninstall"`
+}
+
+// DecommissionReport describes what a decommission removed.
+type DecommissionReport struct {
+	Unregistered bool     `json:"unregistered"`
+	Removed      []string `json:"removed"`
+	Errors       []string `json:"errors,omitempty"`
+}
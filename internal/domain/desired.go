@@ -0,0 +1,84 @@
+package domain
+
+import "time"
+
+// Power states a desired instance can be held in.
+const (
+	PowerRunning = "running"
+	PowerPaused  = "paused"
+)
+
+// DesiredState is the document the control plane pushes to PUT /state when
+// it manages the host declaratively. The agent keeps converging the instance
+// toward it until the document is removed.
+type DesiredState struct {
+	// Generation orders documents; a push older than the stored one is
+	// rejected so a delayed request cannot roll the host back.
+	Generation int64 `json:"generation" binding:"required,min=1"`
+	// Instance is the instance that should exist; nil means none.
+	Instance *DesiredInstance `json:"instance"`
+	// SSHKeys are the public keys authorized in the instance.
+	SSHKeys []string `json:"ssh_keys" binding:"dive,required"`
+}
+
+// DesiredInstance mirrors the POST /instances body. Changing a field other
+// than StorageGB, ExpiresAt or Power replaces the instance.
+type DesiredInstance struct {
+	TunnelToken   string     `json:"tunnel_token"`
+	SSHEnabled    bool       `json:"ssh_enabled"`
+	Ports         []string   `json:"ports"`
+	StorageGB     int        `json:"storage_gb" binding:"min=0"`
+	CPUs          string     `json:"cpus"`
+	Memory        string     `json:"memory"`
+	SecureWipe    bool       `json:"secure_wipe"`
+	BandwidthMbps int        `json:"bandwidth_mbps" binding:"min=0"`
+	TLS           bool       `json:"tls"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	// GPUCount and GPUAddrs select the GPUs as in POST /instances; they are
+	// omitted when empty so older documents keep their spec hash.
+	GPUCount int      `json:"gpu_count,omitempty" binding:"min=0"`
+	GPUAddrs []string `json:"gpu_addrs,omitempty"`
+	// Power is "running" (default) or "paused".
+	Power string `json:"power" binding:"omitempty,oneof=running paused"`
+}
+
+// AppliedDesired records what the reconciler last applied to the instance
+// with the given VM ID, so drift can be told apart from a changed document.
+type AppliedDesired struct {
+	VMID string `json:"vm_id"`
+	// SpecHash covers the fields whose change replaces the instance.
+	SpecHash  string   `json:"spec_hash"`
+	StorageGB int      `json:"storage_gb"`
+	SSHKeys   []string `json:"ssh_keys,omitempty"`
+}
+
+// DesiredRecord is the persisted declarative state: the document and what
+// has been applied from it.
+type DesiredRecord struct {
+	Desired DesiredState    `json:"desired"`
+	Applied *AppliedDesired `json:"applied,omitempty"`
+}
+
+// Drift is one difference between the desired and the observed state.
+type Drift struct {
+	// Kind is one of transition, instance_missing, instance_unexpected,
+	// instance_failed, instance_adopted, instance_stopped, spec_changed,
+	// disk_size, lease, power, ssh_keys or proxies. The resource reconciler
+	// reports orphan_vm, vm_artifacts, vfio_binding, instance_state, ports
+	// and containers as well.
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	// Action is what the reconciler did about it; empty while it waits.
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the outcome of the latest reconcile pass.
+type ReconcileReport struct {
+	Generation int64     `json:"generation"`
+	Time       time.Time `json:"time"`
+	Status     string    `json:"status"`
+	Drift      []Drift   `json:"drift"`
+	// Converged is set when the pass found nothing to change.
+	Converged bool `json:"converged"`
+}
@@ -0,0 +1,23 @@
+package domain
+
+// VNCPasswordLength is the length of VNC passwords; VNC authentication
+// ignores anything past 8 characters.
+const VNCPasswordLength = 8
+
+// VNCDisplay is the graphical console QEMU serves on a loopback host port.
+type VNCDisplay struct {
+	Port int `json:"port"`
+	// RemotePort is the tunnel server port the console is forwarded to.
+	RemotePort int    `json:"remote_port,omitempty"`
+	Password   string `json:"password"`
+}
+
+// Display is the graphical console of an instance as the API hands it
+// out. Like Credentials, the password is sealed when the agent has a
+// control plane key.
+type Display struct {
+	Protocol       string `json:"protocol"`
+	Port           int    `json:"port"`
+	Password       string `json:"password,omitempty"`
+	SealedPassword string `json:"sealed_password,omitempty"`
+}
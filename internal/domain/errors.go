@@ -8,6 +8,33 @@ func (e ErrInstanceAlreadyRunning) Error() string {
 	return "instance is already running"
 }
 
+// ErrCreateInProgress is returned for a create issued while another one owns the VM.
+type ErrCreateInProgress struct {
+	JobID string
+}
+
+func (e ErrCreateInProgress) Error() string {
+	return fmt.Sprintf("instance create already in progress (job %s)", e.JobID)
+}
+
+// ErrUpdateInProgress is returned for a create issued while the agent is
+// replacing its binary.
+type ErrUpdateInProgress struct{}
+
+func (e ErrUpdateInProgress) Error() string {
+	return "agent update in progress"
+}
+
+// ErrLifecycleBusy is returned for a create or delete issued while another
+// create or delete is still being carried out.
+type ErrLifecycleBusy struct {
+	Op string
+}
+
+func (e ErrLifecycleBusy) Error() string {
+	return fmt.Sprintf("instance %s already in progress", e.Op)
+}
+
 type ErrNoInstanceRunning struct{}
 
 func (e ErrNoInstanceRunning) Error() string {
@@ -48,3 +75,91 @@ func (e ErrQEMU) Error() string {
 func (e ErrQEMU) Unwrap() error {
 	return e.Err
 }
+
+// ErrNotConfidential means the instance does not run as a confidential VM.
+type ErrNotConfidential struct{}
+
+func (e ErrNotConfidential) Error() string {
+	return "instance is not a confidential VM"
+}
+
+// ErrUSBAttached means the USB device is already attached to the instance.
+type ErrUSBAttached struct {
+	Device USBDevice
+}
+
+func (e ErrUSBAttached) Error() string {
+	return fmt.Sprintf("usb device %s is already attached", e.Device)
+}
+
+// ErrUSBNotAttached means the USB device is not attached to the instance.
+type ErrUSBNotAttached struct {
+	Device USBDevice
+}
+
+func (e ErrUSBNotAttached) Error() string {
+	return fmt.Sprintf("usb device %s is not attached", e.Device)
+}
+
+// ErrUSBNotPresent means no USB device with the ID is plugged into the host.
+type ErrUSBNotPresent struct {
+	Device USBDevice
+}
+
+func (e ErrUSBNotPresent) Error() string {
+	return fmt.Sprintf("usb device %s is not plugged into the host", e.Device)
+}
+
+type ErrConsoleBusy struct{}
+
+func (e ErrConsoleBusy) Error() string {
+	return "serial console is already attached"
+}
+
+type ErrGPUReserved struct {
+	Addr string
+}
+
+func (e ErrGPUReserved) Error() string {
+	return fmt.Sprintf("gpu %s is reserved by another request", e.Addr)
+}
+
+type ErrInvalidTransition struct {
+	From InstanceStatus
+	To   InstanceStatus
+}
+
+func (e ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("invalid status transition: %s -> %s", e.From, e.To)
+}
+
+type ErrCommandNotAllowed struct {
+	Command InstanceCommand
+	Status  InstanceStatus
+}
+
+func (e ErrCommandNotAllowed) Error() string {
+	return fmt.Sprintf("command %s not allowed while instance is %s", e.Command, e.Status)
+}
+
+type ErrDiskShrink struct {
+	CurrentGB   int
+	RequestedGB int
+}
+
+func (e ErrDiskShrink) Error() string {
+	return fmt.Sprintf("disk can only grow: current size %dGB, requested %dGB", e.CurrentGB, e.RequestedGB)
+}
+
+// ErrGuestResize means the disk was grown but the guest filesystem was not.
+type ErrGuestResize struct {
+	Err error
+}
+
+func (e ErrGuestResize) Error() string {
+	return fmt.Sprintf("disk grown, guest filesystem resize failed: %v", e.Err)
+}
+
+func (e ErrGuestResize) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,67 @@
+package domain
+
+import "time"
+
+type EventType string
+
+const (
+	EventClockDrift EventType = "clock_drift"
+	EventQMPHung    EventType = "qmp_hung"
+	// EventInstanceExpired reports an instance destroyed at the end of its lease.
+	EventInstanceExpired EventType = "instance_expired"
+	// EventAgentUpdated reports a self-update that came up healthy.
+	EventAgentUpdated EventType = "agent_updated"
+	// EventAgentUpdateRolledBack reports a self-update that was reverted.
+	EventAgentUpdateRolledBack EventType = "agent_update_rolled_back"
+	// EventHardwareChanged reports hardware that differs from the last run.
+	EventHardwareChanged EventType = "hardware_changed"
+	// EventStateDrift reports drift the desired-state reconciler acted on.
+	EventStateDrift EventType = "state_drift"
+	// EventResourceRepaired reports one action of the resource reconciler,
+	// such as killing an orphan VM or releasing a leaked port.
+	EventResourceRepaired EventType = "resource_repaired"
+	// EventTunnelDown reports the frpc tunnel down for longer than the
+	// threshold, and again with severity info once it is back.
+	EventTunnelDown EventType = "tunnel_down"
+	// EventThermal reports the thermal watchdog throttling or pausing the
+	// instance over its GPU temperature, and again with severity info once
+	// it is lifted.
+	EventThermal EventType = "thermal_event"
+	// EventAgentPanic reports a panic recovered in the agent, with its stack.
+	EventAgentPanic EventType = "agent_panic"
+	// EventContainersFailed reports containers of a create that could not
+	// be started in the guest; the instance runs without them.
+	EventContainersFailed EventType = "containers_failed"
+	// EventSecureBootOff reports an instance created with Secure Boot whose
+	// firmware does not enforce it, such as one without enrolled keys.
+	EventSecureBootOff EventType = "secure_boot_off"
+
+	// Instance lifecycle events follow a create from acceptance to the
+	// instance serving, or to its failure, and report its destruction.
+	EventInstanceCreating  EventType = "instance_creating"
+	EventInstanceSSHReady  EventType = "instance_ssh_ready"
+	EventInstanceRunning   EventType = "instance_running"
+	EventInstanceFailed    EventType = "instance_failed"
+	EventInstanceDestroyed EventType = "instance_destroyed"
+)
+
+type EventSeverity string
+
+const (
+	SeverityInfo     EventSeverity = "info"
+	SeverityWarning  EventSeverity = "warning"
+	SeverityCritical EventSeverity = "critical"
+)
+
+// Event is an out-of-band notification about the host or instance sent to the API.
+type Event struct {
+	// ID is unique per event, so the API can drop a redelivered one.
+	ID       string         `json:"id,omitempty"`
+	Type     EventType      `json:"type"`
+	Severity EventSeverity  `json:"severity"`
+	Message  string         `json:"message"`
+	Data     map[string]any `json:"data,omitempty"`
+	// Labels are those of the instance at the time of the event.
+	Labels map[string]string `json:"labels,omitempty"`
+	Time   time.Time         `json:"time"`
+}
@@ -0,0 +1,30 @@
+package domain
+
+import "time"
+
+// ExecRequest is a command run in the guest.
+type ExecRequest struct {
+	// Command is the program and its arguments; it is not run through a
+	// shell unless it names one.
+	Command []string
+	// Container, when set, runs the command in that guest container with
+	// docker exec.
+	Container string
+	// Stdin is fed to the command.
+	Stdin string
+	// Timeout bounds the run; the command is killed when it is exceeded.
+	Timeout time.Duration
+}
+
+// ExecResult is the outcome of an ExecRequest. Output past the limit of
+// each stream is dropped and Truncated set.
+type ExecResult struct {
+	// ExitCode is that of the command, -1 when it was killed or its status
+	// is unknown.
+	ExitCode   int    `json:"exit_code"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
@@ -0,0 +1,24 @@
+package domain
+
+// CPU pinning policies of a flavor.
+const (
+	// PinningNone leaves vCPU placement to the host scheduler.
+	PinningNone = "none"
+	// PinningNUMA keeps all vCPUs on the NUMA node of the first GPU.
+	PinningNUMA = "numa"
+	// PinningDedicated pins every vCPU to a host CPU of its own.
+	PinningDedicated = "dedicated"
+)
+
+// Flavor is a named instance size defined by the host operator, which a
+// create may reference instead of raw CPU, memory and disk values.
+type Flavor struct {
+	Name      string `json:"name"`
+	CPUs      int    `json:"cpus"`
+	MemoryGB  int    `json:"memory_gb"`
+	DiskGB    int    `json:"disk_gb"`
+	GPUs      int    `json:"gpus"`
+	Hugepages bool   `json:"hugepages"`
+	// CPUPinning is PinningNone, PinningNUMA or PinningDedicated.
+	CPUPinning string `json:"cpu_pinning"`
+}
@@ -1,6 +1,9 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type GPUInfo struct {
 	Name    string
@@ -12,3 +15,10 @@ type GPUInfo struct {
 type GPUInfoProvider interface {
 	GPUInfo(ctx context.Context) (*GPUInfo, error)
 }
+
+// PowerCap limits the total power draw of the instance's GPUs, split evenly
+// over them. Zero Watts lifts the cap.
+type PowerCap struct {
+	Watts     int       `json:"watts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,57 @@
+package domain
+
+// UpdateSpec describes an agent binary pushed through POST /update.
+type UpdateSpec struct {
+	Version   string `json:"version" binding:"required"`
+	URL       string `json:"url" binding:"required"`
+	SHA256    string `json:"sha256" binding:"required"`
+	Signature string `json:"signature"` // base64 ed25519 signature of the raw SHA-256 digest
+}
+
+// Handoff is written by an agent before it re-execs into a new binary and
+// consumed by the new process on startup.
+type Handoff struct {
+	VM      *VMHandoff     `json:"vm,omitempty"`
+	FRPCPID int            `json:"frpc_pid,omitempty"`
+	Update  *PendingUpdate `json:"update,omitempty"`
+	// RolledBack is the update that was reverted before this start.
+	RolledBack *PendingUpdate `json:"rolled_back,omitempty"`
+}
+
+// PendingUpdate tracks an update until the new binary proves healthy.
+type PendingUpdate struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Binary      string `json:"binary"`
+	Backup      string `json:"backup"`
+	// Attempts counts startups of the new binary; a second one means the
+	// first never confirmed and the update is rolled back.
+	Attempts int `json:"attempts"`
+}
+
+// VMHandoff is what a new agent process needs to adopt a running VM.
+type VMHandoff struct {
+	VMID         string         `json:"vm_id"`
+	PID          int            `json:"pid"`
+	QMPSocket    string         `json:"qmp_socket"`
+	ConsolePath  string         `json:"console_path"`
+	DiskPath     string         `json:"disk_path"`
+	OVMFVarsPath string         `json:"ovmf_vars_path"`
+	CgroupDir    string         `json:"cgroup_dir,omitempty"`
+	Spec         InstanceSpec   `json:"spec"`
+	GPUAddrs     []string       `json:"gpu_addrs"`
+	GPUVendor    string         `json:"gpu_vendor"`
+	VFIOs        []VFIOHandoff  `json:"vfios"`
+	PortPool     map[int]int    `json:"port_pool"`
+	SecureWipe   bool           `json:"secure_wipe"`
+	Status       InstanceStatus `json:"status"`
+	Reason       StatusReason   `json:"reason,omitempty"`
+}
+
+// VFIOHandoff is the binding state of one passed-through device.
+type VFIOHandoff struct {
+	Addr       string   `json:"addr"`
+	Group      string   `json:"group"`
+	OrigDriver string   `json:"orig_driver"`
+	GroupAddrs []string `json:"group_addrs,omitempty"`
+}
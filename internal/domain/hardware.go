@@ -0,0 +1,40 @@
+package domain
+
+import "time"
+
+// HardwareSnapshot is the hardware the host is listed with. It is stored
+// between agent runs so that changes can be detected on startup.
+type HardwareSnapshot struct {
+	// Fingerprint hashes the GPU topology, CPU, RAM and disk; it changes
+	// whenever the listing would.
+	Fingerprint string      `json:"fingerprint"`
+	GPUs        []PCIDevice `json:"gpus"`
+	GPUName     string      `json:"gpu_name"`
+	GPUCount    int         `json:"gpu_count"`
+	VRAM        float64     `json:"vram"`
+	CPUName     string      `json:"cpu_name"`
+	CPUCores    int         `json:"cpu_cores"`
+	RAMGB       float64     `json:"ram_gb"`
+	DiskGB      float64     `json:"disk_gb"`
+	Time        time.Time   `json:"time"`
+}
+
+// PCIDevice is a GPU's place in the PCI topology. It does not depend on the
+// bound driver, so passing a GPU through does not look like a change.
+type PCIDevice struct {
+	Addr       string `json:"addr"`
+	Vendor     string `json:"vendor"`
+	Device     string `json:"device"`
+	Subsystem  string `json:"subsystem,omitempty"`
+	NUMANode   int    `json:"numa_node"`
+	IOMMUGroup string `json:"iommu_group,omitempty"`
+}
+
+// HardwareChange is one difference between two snapshots.
+type HardwareChange struct {
+	Component string `json:"component"` // "gpu", "cpu", "ram" or "disk"
+	Kind      string `json:"kind"`      // "added", "removed", "replaced" or "changed"
+	Addr      string `json:"addr,omitempty"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+}
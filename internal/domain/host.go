@@ -1,13 +1,76 @@
 package domain
 
+import "time"
+
 // CreateHostRequest is sent to register the host hardware with the Qudata API.
 type CreateHostRequest struct {
-	GPUName       string       `json:"gpu_name"`
-	GPUAmount     int          `json:"gpu_amount"`
-	VRAM          float64      `json:"vram"`
-	MaxCUDA       float64      `json:"max_cuda"`
-	Location      HostLocation `json:"location"`
-	Configuration HostConfig   `json:"configuration"`
+	GPUName       string           `json:"gpu_name"`
+	GPUAmount     int              `json:"gpu_amount"`
+	VRAM          float64          `json:"vram"`
+	MaxCUDA       float64          `json:"max_cuda"`
+	Location      HostLocation     `json:"location"`
+	Configuration HostConfig       `json:"configuration"`
+	Capabilities  HostCapabilities `json:"capabilities"`
+	// NetTest is the last measured tunnel and API performance, if any.
+	NetTest *NetTestResult `json:"net_test,omitempty"`
+	// Hardware is the detailed hardware inventory and its fingerprint.
+	Hardware *HardwareSnapshot `json:"hardware,omitempty"`
+	// Benchmark is the GPU benchmark score, when benchmarking is enabled.
+	Benchmark *GPUBenchmark `json:"benchmark,omitempty"`
+}
+
+// GPUBenchmark is the outcome of the benchmark command run in a throwaway
+// VM with all GPUs passed through.
+type GPUBenchmark struct {
+	Command string  `json:"command"`
+	Score   float64 `json:"score"`
+	// Unit is reported by the command, e.g. "TFLOPS"; empty if it gave a bare number.
+	Unit       string `json:"unit,omitempty"`
+	GPUs       int    `json:"gpus"`
+	DurationMS int64  `json:"duration_ms"`
+	// Fingerprint is the hardware fingerprint the score was measured on.
+	Fingerprint string    `json:"fingerprint"`
+	Time        time.Time `json:"time"`
+}
+
+// HostUpdate changes attributes of an already registered host.
+type HostUpdate struct {
+	NetTest     *NetTestResult `json:"net_test,omitempty"`
+	EthernetIn  float64        `json:"ethernet_in,omitempty"`
+	EthernetOut float64        `json:"ethernet_out,omitempty"`
+}
+
+// NetTestResult is the outcome of a POST /nettest run.
+type NetTestResult struct {
+	Time    time.Time       `json:"time"`
+	Targets []NetTestTarget `json:"targets"`
+}
+
+// NetTestTarget is the measured connectivity from the host to one endpoint.
+type NetTestTarget struct {
+	Name         string  `json:"name"` // "frp" or "api"
+	Address      string  `json:"address"`
+	LatencyMS    float64 `json:"latency_ms"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// HostCapabilities is the kernel and virtualization feature matrix of the host,
+// used by the control plane to target features per host.
+type HostCapabilities struct {
+	KernelVersion string   `json:"kernel_version"`
+	KVM           bool     `json:"kvm"`
+	NestedVirt    bool     `json:"nested_virt"`
+	IOMMUType     string   `json:"iommu_type"` // "intel-vt-d", "amd-vi" or "" when disabled
+	IOMMUGroups   int      `json:"iommu_groups"`
+	HugepageSizes []int    `json:"hugepage_sizes_kb"`
+	SEV           bool     `json:"sev"`
+	SEVES         bool     `json:"sev_es"`
+	SEVSNP        bool     `json:"sev_snp"`
+	TDX           bool     `json:"tdx"`
+	CPUVendor     string   `json:"cpu_vendor"`
+	CPUFlags      []string `json:"cpu_flags"`
 }
 
 // HostLocation describes the geographic location of the host.
@@ -17,18 +80,40 @@ type HostLocation struct {
 	Region  string `json:"region"`
 }
 
+// GeoLocation is a looked-up host location, cached with the IP it was
+// resolved for.
+type GeoLocation struct {
+	HostLocation
+	IP   string    `json:"ip"`
+	Time time.Time `json:"time"`
+}
+
 // HostConfig describes the hardware configuration of the host.
 type HostConfig struct {
-	RAM            ResourceUnit `json:"ram"`
-	Disk           ResourceUnit `json:"disk"`
-	CPUName        string       `json:"cpu_name"`
-	CPUCores       int          `json:"cpu_cores"`
-	CPUFreq        float64      `json:"cpu_freq"`
-	MemorySpeed    float64      `json:"memory_speed"`
-	EthernetIn     float64      `json:"ethernet_in"`
-	EthernetOut    float64      `json:"ethernet_out"`
-	Capacity       float64      `json:"capacity"`
-	MaxCUDAVersion float64      `json:"max_cuda_version"`
+	RAM         ResourceUnit `json:"ram"`
+	Disk        ResourceUnit `json:"disk"`
+	CPUName     string       `json:"cpu_name"`
+	CPUCores    int          `json:"cpu_cores"`
+	CPUFreq     float64      `json:"cpu_freq"`
+	MemorySpeed float64      `json:"memory_speed"`
+	// EthernetIn and EthernetOut are the estimated downlink and uplink in
+	// Mbps, 0 when unknown.
+	EthernetIn        float64        `json:"ethernet_in"`
+	EthernetOut       float64        `json:"ethernet_out"`
+	NetworkInterfaces []NetInterface `json:"network_interfaces,omitempty"`
+	Capacity          float64        `json:"capacity"`
+	MaxCUDAVersion    float64        `json:"max_cuda_version"`
+}
+
+// NetInterface is a host uplink as seen from the default route.
+type NetInterface struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"` // "physical", "bond", "bridge" or "vlan"
+	// SpeedMbps is the usable link capacity, 0 when the driver does not
+	// report it.
+	SpeedMbps float64 `json:"speed_mbps"`
+	// Members are the physical links behind a bond, bridge or VLAN.
+	Members []NetInterface `json:"members,omitempty"`
 }
 
 // ResourceUnit is a value with a unit label (e.g. 64.0 "gb").
@@ -0,0 +1,19 @@
+package domain
+
+import "time"
+
+// IdempotencyRecord is the outcome of a create sent with an idempotency key.
+// A retry with the same key gets the recorded outcome instead of being
+// turned away because the instance already exists.
+type IdempotencyRecord struct {
+	Key string `json:"key"`
+	// RequestHash fingerprints the request, so a key reused for a different
+	// request is detected.
+	RequestHash string            `json:"request_hash"`
+	Code        int               `json:"code"`
+	JobID       string            `json:"job_id,omitempty"`
+	Ports       map[string]string `json:"ports,omitempty"`
+	Credentials *Credentials      `json:"credentials,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
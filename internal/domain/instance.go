@@ -1,14 +1,20 @@
 package domain
 
+import "time"
+
 type InstanceStatus string
 
 const (
-	StatusDestroyed InstanceStatus = "destroyed"
-	StatusPending   InstanceStatus = "pending"
-	StatusRunning   InstanceStatus = "running"
-	StatusPaused    InstanceStatus = "paused"
-	StatusRebooting InstanceStatus = "rebooting"
-	StatusError     InstanceStatus = "error"
+	StatusDestroyed    InstanceStatus = "destroyed"
+	StatusProvisioning InstanceStatus = "provisioning"
+	StatusBooting      InstanceStatus = "booting"
+	StatusConfiguring  InstanceStatus = "configuring"
+	StatusRunning      InstanceStatus = "running"
+	StatusDegraded     InstanceStatus = "degraded"
+	StatusPaused       InstanceStatus = "paused"
+	StatusStopping     InstanceStatus = "stopping"
+	StatusStopped      InstanceStatus = "stopped"
+	StatusFailed       InstanceStatus = "failed"
 )
 
 type InstanceCommand string
@@ -24,26 +30,125 @@ type PortMapping struct {
 	GuestPort  int    `json:"guest_port"`
 	RemotePort int    `json:"remote_port"`
 	Proto      string `json:"proto"`
+	// TLSPort, when set, is the host port of the local TLS terminator
+	// published for this HTTP port instead of the plain forward.
+	TLSPort int `json:"tls_port,omitempty"`
 }
 
 type InstanceSpec struct {
+	// VMID names the VM; the manager picks one when it is empty.
+	VMID        string        `json:"vm_id,omitempty"`
 	Ports       []PortMapping `json:"ports"`
 	SSHEnabled  bool          `json:"ssh_enabled"`
 	TunnelToken string        `json:"tunnel_token"`
-	GPUAddr     string        `json:"gpu_addr,omitempty"`
+	GPUAddrs    []string      `json:"gpu_addrs,omitempty"`
 	DiskSizeGB  int           `json:"disk_size_gb,omitempty"`
 	CPUs        string        `json:"cpus,omitempty"`
 	Memory      string        `json:"memory,omitempty"`
+	SecureWipe  bool          `json:"secure_wipe,omitempty"`
+	// BandwidthMbps caps instance traffic in each direction; 0 is unlimited.
+	BandwidthMbps int `json:"bandwidth_mbps,omitempty"`
+	// ExpiresAt, when set, is when the instance lease ends.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Flavor names the flavor the size was taken from, if any.
+	Flavor string `json:"flavor,omitempty"`
+	// Hugepages backs guest memory with preallocated huge pages.
+	Hugepages bool `json:"hugepages,omitempty"`
+	// CPUPinning is a flavor pinning policy; empty is PinningNone.
+	CPUPinning string `json:"cpu_pinning,omitempty"`
+	// Compose is a Docker Compose document run in the guest once it is up.
+	Compose string `json:"compose,omitempty"`
+	// RootPassword is set as the guest root password; password login is
+	// disabled when it is empty. Like DiskKey it is held in memory only.
+	RootPassword string `json:"-"`
+	// DiskEncrypted encrypts the instance disk with DiskKey, or with a key
+	// the backend generates when DiskKey is empty.
+	DiskEncrypted bool `json:"disk_encrypted,omitempty"`
+	// DiskKey is held in memory only, never persisted with the spec.
+	DiskKey []byte `json:"-"`
+	// TPM gives the guest an emulated TPM 2.0.
+	TPM bool `json:"tpm,omitempty"`
+	// Confidential runs the guest with encrypted memory, under the
+	// host's ConfidentialMode.
+	Confidential bool `json:"confidential,omitempty"`
+	// SecureBoot boots the guest with UEFI Secure Boot enforced.
+	SecureBoot bool `json:"secure_boot,omitempty"`
+	// Devices are PCI addresses of host devices other than GPUs, such as
+	// an NVMe drive or a spare NIC, passed through to the guest.
+	Devices []string `json:"devices,omitempty"`
+	// USB are host USB devices passed through to the guest; devices
+	// hotplugged later are added here.
+	USB []USBDevice `json:"usb,omitempty"`
+	// Nested exposes hardware virtualization so that the guest can run
+	// VMs of its own.
+	Nested bool `json:"nested,omitempty"`
+	// VNC, when set, serves the guest display over password-protected VNC
+	// instead of running it headless.
+	VNC *VNCDisplay `json:"vnc,omitempty"`
+	// Volumes are persistent data disks attached to the instance.
+	Volumes []VolumeAttachment `json:"volumes,omitempty"`
+	// Labels are opaque key/value metadata of the control plane, such as
+	// the tenant or order ID, written to the guest under /opt/qudata.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Import, when set, boots the instance from a migrated bundle.
+	Import *ImportSource `json:"-"`
 }
 
 // InstancePorts maps guest port (e.g. "22") to allocated host port (e.g. "45001").
 type InstancePorts map[string]string
 
+// ProxyMapping records an frpc proxy published for the instance, including
+// the remote port reserved on the frps side.
+type ProxyMapping struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	LocalPort    int    `json:"local_port"`
+	RemotePort   int    `json:"remote_port,omitempty"`
+	CustomDomain string `json:"custom_domain,omitempty"`
+}
+
 type InstanceState struct {
-	VMID           string        `json:"vm_id"`
-	Ports          InstancePorts `json:"ports"`
-	SSHEnabled     bool          `json:"ssh_enabled"`
-	GPUAddr        string        `json:"gpu_addr"`
-	TunnelToken    string        `json:"tunnel_token"`
-	AllocatedPorts []int         `json:"allocated_ports,omitempty"`
+	VMID           string         `json:"vm_id"`
+	Ports          InstancePorts  `json:"ports"`
+	SSHEnabled     bool           `json:"ssh_enabled"`
+	GPUAddrs       []string       `json:"gpu_addrs,omitempty"`
+	TunnelToken    string         `json:"tunnel_token"`
+	AllocatedPorts []int          `json:"allocated_ports,omitempty"`
+	Proxies        []ProxyMapping `json:"proxies,omitempty"`
+	SecureWipe     bool           `json:"secure_wipe,omitempty"`
+	TLSEndpoints   []TLSEndpoint  `json:"tls_endpoints,omitempty"`
+	ExpiresAt      *time.Time     `json:"expires_at,omitempty"`
+	// Volumes names the volumes attached to the instance.
+	Volumes []string `json:"volumes,omitempty"`
+	// SecureBoot reports that the instance boots with Secure Boot.
+	SecureBoot bool `json:"secure_boot,omitempty"`
+	// Labels are the labels the instance was created with.
+	Labels map[string]string `json:"labels,omitempty"`
+	// VM is what the next agent process needs to take the running VM over
+	// after a crash or restart.
+	VM *VMHandoff `json:"vm,omitempty"`
+}
+
+// TLSEndpoint is a local TLS terminator serving Domain on ListenPort and
+// forwarding plaintext to the guest's forwarded TargetPort.
+type TLSEndpoint struct {
+	Domain     string `json:"domain"`
+	ListenPort int    `json:"listen_port"`
+	TargetPort int    `json:"target_port"`
+}
+
+// DNSChallenge is an ACME DNS-01 TXT record the control plane publishes
+// on the agent's behalf.
+type DNSChallenge struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// WipeReport describes the data-at-rest wipe performed when an instance was destroyed.
+type WipeReport struct {
+	Files      []string `json:"files"`
+	Bytes      int64    `json:"bytes"`
+	Method     string   `json:"method"`
+	DurationMS int64    `json:"duration_ms"`
+	Error      string   `json:"error,omitempty"`
 }
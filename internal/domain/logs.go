@@ -0,0 +1,18 @@
+package domain
+
+import "time"
+
+// LogRecord is an agent log record shipped to the API, with secrets redacted.
+type LogRecord struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// LogBatch is a batch of records sent to POST /logs. Dropped counts the
+// records lost to the rate limit or a full buffer since the previous batch.
+type LogBatch struct {
+	Records []LogRecord `json:"records"`
+	Dropped int         `json:"dropped,omitempty"`
+}
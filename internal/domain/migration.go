@@ -0,0 +1,79 @@
+package domain
+
+import "time"
+
+// Migration modes. A live migration carries the saved memory and device state
+// and resumes the guest where it stopped; a cold one carries a
+// crash-consistent disk only and reboots the guest on the target.
+const (
+	MigrationLive = "live"
+	MigrationCold = "cold"
+)
+
+// Migration phases reported by GET /instances/migration.
+const (
+	MigrationPreparing    = "preparing"
+	MigrationTransferring = "transferring"
+	MigrationCompleted    = "completed"
+	MigrationFailed       = "failed"
+)
+
+// ExportBundle lists the artifacts of a paused instance ready for transfer.
+type ExportBundle struct {
+	Mode         string
+	DiskPath     string
+	OVMFVarsPath string
+	StatePath    string
+	// BaseImageSize is the size of the disk's backing image, 0 if it has none.
+	BaseImageSize int64
+	CPUs          string
+	Memory        string
+	DiskSizeGB    int
+	BandwidthMbps int
+	// SecureBoot means OVMFVarsPath belongs to the Secure Boot firmware.
+	SecureBoot bool
+	Nested     bool
+}
+
+// ImportSource points Create at artifacts received from another host instead
+// of provisioning a fresh disk.
+type ImportSource struct {
+	Dir           string
+	DiskPath      string
+	OVMFVarsPath  string
+	StatePath     string // empty for a cold migration
+	BaseImageSize int64
+}
+
+// MigrationManifest describes an instance bundle streamed between agents.
+type MigrationManifest struct {
+	Version       int        `json:"version"`
+	Mode          string     `json:"mode"`
+	SSHEnabled    bool       `json:"ssh_enabled"`
+	TunnelToken   string     `json:"tunnel_token"`
+	Ports         []string   `json:"ports"`
+	CPUs          string     `json:"cpus"`
+	Memory        string     `json:"memory"`
+	DiskSizeGB    int        `json:"disk_size_gb"`
+	SecureWipe    bool       `json:"secure_wipe"`
+	BaseImageSize int64      `json:"base_image_size"`
+	BandwidthMbps int        `json:"bandwidth_mbps,omitempty"`
+	TLS           bool       `json:"tls,omitempty"`
+	SecureBoot    bool       `json:"secure_boot,omitempty"`
+	Nested        bool       `json:"nested,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	// Labels are the control plane's labels, kept across the move.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MigrationStatus is the progress of the last export started on this agent.
+type MigrationStatus struct {
+	ID         string     `json:"id"`
+	Phase      string     `json:"phase"`
+	Mode       string     `json:"mode,omitempty"`
+	Target     string     `json:"target"`
+	BytesSent  int64      `json:"bytes_sent"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
@@ -0,0 +1,7 @@
+package domain
+
+// PortLease is a host port held by the agent and what it is used for.
+type PortLease struct {
+	Port    int    `json:"port"`
+	Purpose string `json:"purpose"`
+}
@@ -0,0 +1,41 @@
+package domain
+
+import "time"
+
+// ProvisionStage is the step an instance create has reached. Stages advance
+// in order; a create ends in StageRunning or StageFailed, and a retried
+// attempt starts over at StageBindingGPU.
+type ProvisionStage string
+
+const (
+	StageAllocatingPorts ProvisionStage = "allocating_ports"
+	StageBindingGPU      ProvisionStage = "binding_gpu"
+	StageBooting         ProvisionStage = "booting"
+	StageWaitingSSH      ProvisionStage = "waiting_ssh"
+	StageConfiguring     ProvisionStage = "configuring"
+	StageRunning         ProvisionStage = "running"
+	StageFailed          ProvisionStage = "failed"
+)
+
+// StageEntry records when a create entered a stage.
+type StageEntry struct {
+	Stage ProvisionStage `json:"stage"`
+	At    time.Time      `json:"at"`
+}
+
+// Provisioning is the progress of the latest instance create. It outlives
+// the create, so why a create failed can be read after the fact and after
+// an agent restart, until the instance is deleted.
+type Provisioning struct {
+	JobID     string         `json:"job_id"`
+	Stage     ProvisionStage `json:"stage"`
+	Since     time.Time      `json:"since"`
+	StartedAt time.Time      `json:"started_at"`
+	// Attempt counts the create attempts, including retries.
+	Attempt int `json:"attempt"`
+	// Reason and Error explain StageFailed.
+	Reason StatusReason `json:"reason,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	// Stages lists the stages entered so far, oldest first.
+	Stages []StageEntry `json:"stages"`
+}
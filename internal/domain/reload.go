@@ -0,0 +1,27 @@
+package domain
+
+import "fmt"
+
+// PortRange is an inclusive range of host ports.
+type PortRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Overlaps reports whether r and o share a port.
+func (r PortRange) Overlaps(o PortRange) bool {
+	return r.Min <= o.Max && o.Min <= r.Max
+}
+
+// ReloadResult lists the settings a configuration reload changed.
+type ReloadResult struct {
+	// Applied settings took effect without a restart.
+	Applied []string `json:"applied"`
+	// RestartRequired settings changed in the configuration but only take
+	// effect after the agent restarts.
+	RestartRequired []string `json:"restart_required"`
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 // StatsSnapshot holds a point-in-time sample of system metrics.
 type StatsSnapshot struct {
 	GPUUtil float64 `json:"gpu_util"`
@@ -7,12 +9,94 @@ type StatsSnapshot struct {
 	CPUUtil float64 `json:"cpu_util"`
 	RAMUtil float64 `json:"ram_util"`
 	MemUtil float64 `json:"mem_util"`
-	InetIn  uint64  `json:"inet_in"`
-	InetOut uint64  `json:"inet_out"`
+	// InetIn and InetOut are the bytes received and sent by all host
+	// interfaces but loopback.
+	InetIn  uint64 `json:"inet_in"`
+	InetOut uint64 `json:"inet_out"`
+	// GPUPower is the power draw of all GPUs in Watts and GPUPowerLimit the
+	// sum of their limits.
+	GPUPower      float64 `json:"gpu_power_w"`
+	GPUPowerLimit float64 `json:"gpu_power_limit_w"`
+	// DCGM is set when dcgm-exporter runs in the guest and is scraped.
+	DCGM *DCGMStats `json:"dcgm,omitempty"`
+	// Disk is the I/O and size of the instance's qcow2 disks, from QMP.
+	Disk *DiskStats `json:"disk,omitempty"`
+	// Net is the traffic of the instance alone.
+	Net *NetStats `json:"net,omitempty"`
+}
+
+// NetStats is the traffic of the instance, counted on the host by the
+// nftables policy of its QEMU process. Bytes are the raw counters, which
+// restart when the policy is reapplied; the billed totals are in the usage
+// reports. Rates are averaged since the previous sample.
+type NetStats struct {
+	RxBytes       uint64  `json:"rx_bytes"`
+	TxBytes       uint64  `json:"tx_bytes"`
+	RxBytesPerSec float64 `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64 `json:"tx_bytes_per_sec"`
+}
+
+// DiskStats is summed over the instance's qcow2 disks. Rates are averaged
+// since the previous sample and are 0 in the first one.
+type DiskStats struct {
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+	ReadOpsPerSec    float64 `json:"read_ops_per_sec"`
+	WriteOpsPerSec   float64 `json:"write_ops_per_sec"`
+	// AllocatedBytes is the disk size the guest sees and UsedBytes the host
+	// space the images take, which grows as the guest writes.
+	AllocatedBytes int64 `json:"allocated_bytes"`
+	UsedBytes      int64 `json:"used_bytes"`
+}
+
+// DCGMStats is GPU telemetry from dcgm-exporter in the guest. Values are
+// summed over the GPUs, except SMOccupancy, which is their average.
+type DCGMStats struct {
+	GPUs int `json:"gpus"`
+	// SMOccupancy is the fraction of warps resident on the SMs, 0 to 1.
+	SMOccupancy float64 `json:"sm_occupancy"`
+	// NVLink and PCIe throughput in bytes per second.
+	NVLinkRxBytes float64 `json:"nvlink_rx_bytes"`
+	NVLinkTxBytes float64 `json:"nvlink_tx_bytes"`
+	PCIeRxBytes   float64 `json:"pcie_rx_bytes"`
+	PCIeTxBytes   float64 `json:"pcie_tx_bytes"`
+	// ECC errors since the driver was loaded.
+	ECCSingleBit uint64 `json:"ecc_sbe"`
+	ECCDoubleBit uint64 `json:"ecc_dbe"`
+	// Pages retired for single- and double-bit errors.
+	RetiredPagesSBE uint64 `json:"retired_pages_sbe"`
+	RetiredPagesDBE uint64 `json:"retired_pages_dbe"`
 }
 
 // StatsReport is the payload sent to the Qudata API.
 type StatsReport struct {
+	// Time is when the sample was taken, which for a buffered report is
+	// well before it is sent.
+	Time time.Time `json:"time"`
 	StatsSnapshot
-	Status InstanceStatus `json:"status"`
+	Status       InstanceStatus `json:"status"`
+	StatusReason StatusReason   `json:"status_reason,omitempty"`
+	// Tunnel is the frpc tunnel health; nil when the agent runs without frpc.
+	Tunnel *TunnelStatus `json:"tunnel,omitempty"`
+	// Labels are those of the instance.
+	Labels map[string]string `json:"labels,omitempty"`
+	// KSM is set while kernel same-page merging runs on the host.
+	KSM *KSMStats `json:"ksm,omitempty"`
+}
+
+// KSMStats are the kernel same-page merging counters of the host.
+// PagesSharing is how many pages point at the PagesShared merged ones, so
+// SavedBytes is PagesSharing times the page size.
+type KSMStats struct {
+	PagesShared   uint64 `json:"pages_shared"`
+	PagesSharing  uint64 `json:"pages_sharing"`
+	PagesUnshared uint64 `json:"pages_unshared"`
+	FullScans     uint64 `json:"full_scans"`
+	SavedBytes    uint64 `json:"saved_bytes"`
+}
+
+// StatsBatch carries the reports buffered while the API was unreachable,
+// oldest first.
+type StatsBatch struct {
+	Reports []StatsReport `json:"reports"`
 }
@@ -0,0 +1,90 @@
+package domain
+
+import "time"
+
+// StatusReason qualifies a degraded or failed status so the control plane can
+// tell a crashed QEMU apart from a lost monitor or a boot timeout.
+type StatusReason string
+
+const (
+	ReasonQEMUExited     StatusReason = "qemu_exited"
+	ReasonQMPUnavailable StatusReason = "qmp_unavailable"
+	ReasonQMPHung        StatusReason = "qmp_hung"
+	ReasonGuestPanicked  StatusReason = "guest_panicked"
+	ReasonGuestIOError   StatusReason = "guest_io_error"
+	ReasonVFIOBind       StatusReason = "vfio_bind_failed"
+	ReasonDisk           StatusReason = "disk_failed"
+	ReasonQEMUStart      StatusReason = "qemu_start_failed"
+	ReasonSSHTimeout     StatusReason = "ssh_timeout"
+	ReasonCreateFailed   StatusReason = "create_failed"
+)
+
+// RetryableReason reports whether a create that failed with reason may
+// succeed on another attempt. Boot and monitor timeouts, QEMU dying or not
+// starting and a GPU that would not bind are usually transient; a disk that
+// cannot be prepared or a bad spec fails the same way every time.
+func RetryableReason(r StatusReason) bool {
+	switch r {
+	case ReasonSSHTimeout, ReasonQMPUnavailable, ReasonQEMUStart, ReasonQEMUExited, ReasonVFIOBind:
+		return true
+	}
+	return false
+}
+
+// StatusInfo is the externally visible lifecycle state of the instance.
+type StatusInfo struct {
+	Status InstanceStatus `json:"status"`
+	Reason StatusReason   `json:"reason,omitempty"`
+	Since  time.Time      `json:"since"`
+}
+
+var statusTransitions = map[InstanceStatus][]InstanceStatus{
+	StatusDestroyed:    {StatusProvisioning},
+	StatusProvisioning: {StatusBooting, StatusFailed, StatusStopping},
+	StatusBooting:      {StatusConfiguring, StatusRunning, StatusFailed, StatusStopping},
+	StatusConfiguring:  {StatusRunning, StatusFailed, StatusStopping},
+	StatusRunning:      {StatusDegraded, StatusPaused, StatusStopped, StatusStopping, StatusFailed},
+	StatusDegraded:     {StatusRunning, StatusPaused, StatusStopped, StatusStopping, StatusFailed},
+	StatusPaused:       {StatusRunning, StatusDegraded, StatusStopped, StatusStopping, StatusFailed},
+	StatusStopped:      {StatusRunning, StatusStopping, StatusFailed},
+	StatusStopping:     {StatusDestroyed, StatusFailed},
+	StatusFailed:       {StatusProvisioning, StatusStopping, StatusDestroyed},
+}
+
+// CanTransition reports whether the lifecycle allows moving from one status to another.
+// Staying in the same status is always allowed.
+func CanTransition(from, to InstanceStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedCommands returns the lifecycle commands that are valid in status s.
+func AllowedCommands(s InstanceStatus) []InstanceCommand {
+	switch s {
+	case StatusRunning, StatusDegraded:
+		return []InstanceCommand{CommandStop, CommandReboot}
+	case StatusPaused:
+		return []InstanceCommand{CommandStart, CommandReboot}
+	case StatusStopped:
+		return []InstanceCommand{CommandStart}
+	default:
+		return []InstanceCommand{}
+	}
+}
+
+// CommandAllowed reports whether cmd may be issued while in status s.
+func CommandAllowed(s InstanceStatus, cmd InstanceCommand) bool {
+	for _, c := range AllowedCommands(s) {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
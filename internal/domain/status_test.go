@@ -0,0 +1,17 @@
+package domain
+
+import "testing"
+
+func TestStoppedInstanceCanStart(t *testing.T) {
+	if !CommandAllowed(StatusStopped, CommandStart) {
+		t.Fatal("start not allowed in stopped")
+	}
+	if !CanTransition(StatusStopped, StatusRunning) {
+		t.Fatal("stopped cannot move to running")
+	}
+	for _, cmd := range []InstanceCommand{CommandStop, CommandReboot} {
+		if CommandAllowed(StatusStopped, cmd) {
+			t.Errorf("%s allowed in stopped", cmd)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package domain
+
+import "time"
+
+// TunnelStatus is the health of the frpc tunnel as seen through frpc's
+// admin API.
+type TunnelStatus struct {
+	// Up is set while frpc runs and every proxy is connected.
+	Up bool `json:"up"`
+	// Since is when Up last changed.
+	Since     time.Time `json:"since"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Server is the tunnel server in use.
+	Server string `json:"server,omitempty"`
+	// Error says why frpc itself could not be queried.
+	Error   string        `json:"error,omitempty"`
+	Proxies []ProxyHealth `json:"proxies"`
+}
+
+// ProxyHealth is the state of one frpc proxy.
+type ProxyHealth struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Up   bool   `json:"up"`
+	// Status is frpc's own state, such as "running" or "start error".
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// Clone returns a deep copy of s, or nil for a nil s.
+func (s *TunnelStatus) Clone() *TunnelStatus {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Proxies = append([]ProxyHealth(nil), s.Proxies...)
+	return &c
+}
+
+// CarrySince keeps the Since of the tunnel and of each proxy from prev
+// where their Up state has not changed, so Since tells how long a state
+// has lasted rather than when it was last checked.
+func (s *TunnelStatus) CarrySince(prev *TunnelStatus) {
+	if prev == nil {
+		return
+	}
+	if prev.Up == s.Up {
+		s.Since = prev.Since
+	}
+	old := make(map[string]ProxyHealth, len(prev.Proxies))
+	for _, ph := range prev.Proxies {
+		old[ph.Name] = ph
+	}
+	for i, ph := range s.Proxies {
+		if o, ok := old[ph.Name]; ok && o.Up == ph.Up {
+			s.Proxies[i].Since = o.Since
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package domain
+
+import "time"
+
+// Downtime scopes.
+const (
+	DowntimeAgent    = "agent"
+	DowntimeInstance = "instance"
+)
+
+// DowntimeInterval is a period during which the agent or the instance was
+// unavailable. Seq increases monotonically so the API can acknowledge receipt.
+type DowntimeInterval struct {
+	Seq    uint64    `json:"seq"`
+	Scope  string    `json:"scope"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// UptimeState is the persisted state of the availability tracker.
+type UptimeState struct {
+	LastSeen       time.Time          `json:"last_seen"`
+	InstanceActive bool               `json:"instance_active"`
+	OpenInstance   *DowntimeInterval  `json:"open_instance,omitempty"`
+	Intervals      []DowntimeInterval `json:"intervals"`
+	NextSeq        uint64             `json:"next_seq"`
+	AckedSeq       uint64             `json:"acked_seq"`
+}
+
+// Heartbeat reports measured availability over a trailing window together
+// with downtime intervals not yet acknowledged by the API.
+type Heartbeat struct {
+	Time                    time.Time          `json:"time"`
+	WindowSeconds           int64              `json:"window_seconds"`
+	AgentDowntimeSeconds    float64            `json:"agent_downtime_seconds"`
+	InstanceDowntimeSeconds float64            `json:"instance_downtime_seconds"`
+	AgentAvailability       float64            `json:"agent_availability"`
+	InstanceAvailability    float64            `json:"instance_availability"`
+	Intervals               []DowntimeInterval `json:"intervals"`
+}
+
+// HeartbeatResponse acknowledges intervals up to AckedSeq.
+type HeartbeatResponse struct {
+	OK   bool `json:"ok"`
+	Data struct {
+		AckedSeq uint64 `json:"acked_seq"`
+	} `json:"data"`
+}
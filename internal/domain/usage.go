@@ -0,0 +1,35 @@
+package domain
+
+import "time"
+
+// InstanceUsage is the cumulative resource usage of one instance. Totals only
+// grow, so a resent report never double-counts.
+type InstanceUsage struct {
+	VMID  string     `json:"vm_id"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"` // set once the instance is gone
+	// RuntimeSeconds counts time the instance held its resources.
+	RuntimeSeconds float64 `json:"runtime_seconds"`
+	GPUSeconds     float64 `json:"gpu_seconds"`
+	GPUCount       int     `json:"gpu_count"`
+	// EnergyWh is the GPU energy drawn while the instance held its resources.
+	EnergyWh float64 `json:"energy_wh"`
+	RxBytes  uint64  `json:"rx_bytes"`
+	TxBytes  uint64  `json:"tx_bytes"`
+}
+
+// UsageState is the persisted state of the usage meter.
+type UsageState struct {
+	LastSample time.Time       `json:"last_sample"`
+	Instances  []InstanceUsage `json:"instances"`
+	// LastRx and LastTx are the raw counter readings of the open instance,
+	// used to turn cumulative counters into deltas across resets.
+	LastRx uint64 `json:"last_rx"`
+	LastTx uint64 `json:"last_tx"`
+}
+
+// UsageReport is the payload of POST /usage.
+type UsageReport struct {
+	Time      time.Time       `json:"time"`
+	Instances []InstanceUsage `json:"instances"`
+}
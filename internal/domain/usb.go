@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// USBDevice selects a host USB device, such as a license dongle, by its
+// vendor and product ID: four lowercase hex digits each.
+type USBDevice struct {
+	VendorID  string `json:"vendor_id"`
+	ProductID string `json:"product_id"`
+}
+
+// ParseUSBDevice parses a "vendor:product" ID pair as lsusb prints it.
+func ParseUSBDevice(s string) (USBDevice, error) {
+	vendor, product, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	if !ok || !isUSBID(vendor) || !isUSBID(product) {
+		return USBDevice{}, fmt.Errorf("usb device %q is not a vendor:product ID pair such as 0529:0001", s)
+	}
+	return USBDevice{VendorID: vendor, ProductID: product}, nil
+}
+
+func (d USBDevice) String() string {
+	return d.VendorID + ":" + d.ProductID
+}
+
+func isUSBID(s string) bool {
+	if len(s) != 4 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
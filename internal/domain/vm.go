@@ -1,18 +1,87 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"io"
+	"os"
+)
 
 type VMManager interface {
 	Create(ctx context.Context, spec InstanceSpec, hostPorts []int) (InstancePorts, error)
 	Stop(ctx context.Context) error
+	// Destroy stops the VM like Stop and returns the wipe report when the
+	// instance disks were securely wiped. secureWipe forces a wipe even if the
+	// instance was not created with one.
+	Destroy(ctx context.Context, secureWipe bool) (*WipeReport, error)
+	// SecureWipe reports whether destroying the current instance wipes its disks.
+	SecureWipe() bool
 	Manage(ctx context.Context, cmd InstanceCommand) error
-	Status(ctx context.Context) InstanceStatus
+	Status(ctx context.Context) StatusInfo
 	CollectStats(ctx context.Context) *StatsSnapshot
 	VMID() string
+	// Handoff describes the running VM so that another agent process can
+	// adopt it, or returns nil when there is none.
+	Handoff() *VMHandoff
+	// GPUAddrs returns the PCI addresses of the GPUs this manager passes through.
+	GPUAddrs() []string
+	// AttachedGPUs returns the PCI addresses passed through to the current
+	// VM, or nil when none runs.
+	AttachedGPUs() []string
+	// SetPowerCap caps the total GPU power of this and later instances;
+	// 0 lifts the cap.
+	SetPowerCap(ctx context.Context, watts int) error
+	// PowerCap returns the GPU power cap in Watts, 0 for none.
+	PowerCap() int
 	AddSSHKey(ctx context.Context, pubkey string) error
 	RemoveSSHKey(ctx context.Context, pubkey string) error
-	// MarkFailed signals that instance creation failed so that Status returns StatusError.
-	MarkFailed()
+	// SetRootPassword changes the guest root password.
+	SetRootPassword(ctx context.Context, password string) error
+	// Discard removes the disk and run files an interrupted or failed Create
+	// left for vmID, wiping the disk when secureWipe is set, and releases
+	// GPUs left bound to VFIO while no VM runs.
+	Discard(vmID string, secureWipe bool)
+	// MarkFailed signals that instance creation failed so that Status returns StatusFailed.
+	MarkFailed(reason StatusReason)
 	// Invalidate clears cached SSH client so that awaitSSH waits for a fresh one.
 	Invalidate()
+	// OpenConsole attaches to the guest serial console. Only one console
+	// session may be open at a time.
+	OpenConsole(ctx context.Context) (io.ReadWriteCloser, error)
+	// Export pauses the instance and prepares its artifacts for migration.
+	Export(ctx context.Context) (*ExportBundle, error)
+	// ResumeExport resumes an instance whose export was aborted.
+	ResumeExport() error
+	// ImportDir creates an empty staging directory for an incoming migration.
+	ImportDir() (string, error)
+	// ResizeDisk grows the instance root disk and the guest filesystem.
+	ResizeDisk(ctx context.Context, sizeGB int) error
+	// StreamLogs writes the guest journal to w.
+	StreamLogs(ctx context.Context, opts LogOptions, w io.Writer) error
+	// BootLog returns the end of the guest serial output, or that of the
+	// last instance if none runs.
+	BootLog() ([]byte, error)
+	// Exec runs a command in the guest and returns its exit code and
+	// output. A command that fails or times out is not an error.
+	Exec(ctx context.Context, req ExecRequest) (*ExecResult, error)
+	// DownloadFile passes the size and content of a guest file to fn.
+	DownloadFile(ctx context.Context, path string, fn func(size int64, r io.Reader) error) error
+	// UploadFile writes r to a guest file, replacing it once complete. A
+	// zero mode leaves the default permissions.
+	UploadFile(ctx context.Context, path string, r io.Reader, mode os.FileMode) error
+	// AttachUSB hotplugs a host USB device into the running instance and
+	// returns the devices attached after it.
+	AttachUSB(dev USBDevice) ([]USBDevice, error)
+	// DetachUSB unplugs a USB device from the instance and returns the
+	// devices still attached.
+	DetachUSB(dev USBDevice) ([]USBDevice, error)
+	// Attest returns attestation evidence of a confidential instance with
+	// nonce bound into it.
+	Attest(ctx context.Context, nonce []byte) (*Attestation, error)
+}
+
+// LogOptions selects which guest journal entries StreamLogs returns.
+type LogOptions struct {
+	Tail   int    `form:"tail"`
+	Unit   string `form:"unit"`
+	Follow bool   `form:"follow"`
 }
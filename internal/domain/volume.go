@@ -0,0 +1,73 @@
+package domain
+
+import "time"
+
+// VolumeMountDir is the guest directory volumes are mounted under, each at
+// VolumeMountDir/<name>.
+const VolumeMountDir = "/mnt"
+
+// Volume is a named data disk kept on the host apart from any instance. It
+// survives the deletion of the instance it is attached to and can be
+// attached to the next one.
+type Volume struct {
+	Name      string    `json:"name"`
+	SizeGB    int       `json:"size_gb"`
+	CreatedAt time.Time `json:"created_at"`
+	// Attached reports whether the current instance, or the create in
+	// flight, uses the volume.
+	Attached bool `json:"attached"`
+}
+
+// VolumeAttachment is a volume passed to the VM as an extra disk.
+type VolumeAttachment struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// ObjectLocation is an object in S3-compatible storage together with the
+// credentials to reach it. The credentials are used for the one transfer
+// and never stored.
+type ObjectLocation struct {
+	// Endpoint is the storage URL, e.g. https://s3.eu-central-1.amazonaws.com;
+	// buckets are addressed path-style under it.
+	Endpoint string `json:"endpoint" binding:"required,url"`
+	// Region defaults to us-east-1, which most S3-compatible stores accept.
+	Region       string `json:"region"`
+	Bucket       string `json:"bucket" binding:"required"`
+	Key          string `json:"key" binding:"required"`
+	AccessKey    string `json:"access_key" binding:"required"`
+	SecretKey    string `json:"secret_key" binding:"required"`
+	SessionToken string `json:"session_token,omitempty"`
+}
+
+type TransferDirection string
+
+const (
+	TransferExport TransferDirection = "export"
+	TransferImport TransferDirection = "import"
+)
+
+type TransferPhase string
+
+const (
+	TransferRunning   TransferPhase = "running"
+	TransferCompleted TransferPhase = "completed"
+	TransferFailed    TransferPhase = "failed"
+)
+
+// VolumeTransfer reports a volume export to, or import from, object storage.
+type VolumeTransfer struct {
+	ID        string            `json:"id"`
+	Volume    string            `json:"volume"`
+	Direction TransferDirection `json:"direction"`
+	Phase     TransferPhase     `json:"phase"`
+	// Object is bucket/key of the object.
+	Object string `json:"object"`
+	// Bytes counts the volume disk bytes read so far (export) or the object
+	// bytes received (import), out of TotalBytes when it is known.
+	Bytes      int64      `json:"bytes"`
+	TotalBytes int64      `json:"total_bytes,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
@@ -0,0 +1,159 @@
+// Package events delivers host and instance events to the Qudata API in the
+// order they were raised, retrying until each one is accepted.
+package events
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/qudata"
+	"github.com/qudata/agent/internal/storage"
+)
+
+const (
+	// maxPending bounds the queue while the API is unreachable; the oldest
+	// events are dropped beyond it.
+	maxPending = 1000
+
+	sendTimeout = 30 * time.Second
+	minBackoff  = time.Second
+	maxBackoff  = 5 * time.Minute
+)
+
+// SendFunc delivers one event.
+type SendFunc func(ctx context.Context, ev domain.Event) error
+
+// Publisher queues events and sends them one at a time. The queue is
+// persisted on every change, so events raised just before a restart are
+// delivered by the next run.
+type Publisher struct {
+	send   SendFunc
+	store  *storage.Store
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	queue  []domain.Event
+	wake   chan struct{}
+	labels func() map[string]string
+}
+
+// NewPublisher loads the events a previous run left undelivered.
+func NewPublisher(store *storage.Store, send SendFunc, logger *slog.Logger) *Publisher {
+	p := &Publisher{send: send, store: store, logger: logger, wake: make(chan struct{}, 1)}
+	pending, err := store.LoadPendingEvents()
+	if err != nil {
+		logger.Warn("dropping unreadable pending events", "err", err)
+	}
+	p.queue = pending
+	return p
+}
+
+// SetLabels sets where the labels of the instance that events carry are
+// read from.
+func (p *Publisher) SetLabels(fn func() map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.labels = fn
+}
+
+// Publish queues ev for delivery and returns without waiting for it. ID,
+// Time and Labels are filled in when unset.
+func (p *Publisher) Publish(ev domain.Event) {
+	if ev.ID == "" {
+		ev.ID = uuid.New().String()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	p.mu.Lock()
+	labels := p.labels
+	p.mu.Unlock()
+	if ev.Labels == nil && labels != nil {
+		ev.Labels = labels()
+	}
+
+	p.mu.Lock()
+	p.queue = append(p.queue, ev)
+	if over := len(p.queue) - maxPending; over > 0 {
+		p.logger.Warn("event queue full, dropping oldest events", "dropped", over)
+		p.queue = append([]domain.Event(nil), p.queue[over:]...)
+	}
+	p.saveLocked()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued events until ctx is cancelled. A failed delivery is
+// retried with exponential backoff; an event the API rejects as invalid is
+// dropped so it cannot block the ones behind it.
+func (p *Publisher) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		ev, ok := p.head()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+				continue
+			}
+		}
+
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := p.send(sendCtx, ev)
+		cancel()
+
+		if err == nil || qudata.Rejected(err) {
+			if err != nil {
+				p.logger.Error("event rejected by API, dropping it", "type", ev.Type, "id", ev.ID, "err", err)
+			}
+			p.pop(ev.ID)
+			backoff = minBackoff
+			continue
+		}
+
+		if backoff == minBackoff {
+			p.logger.Warn("failed to send event, retrying", "type", ev.Type, "id", ev.ID, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (p *Publisher) head() (domain.Event, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return domain.Event{}, false
+	}
+	return p.queue[0], true
+}
+
+// pop removes the delivered event unless it was already dropped for space.
+func (p *Publisher) pop(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) > 0 && p.queue[0].ID == id {
+		p.queue = p.queue[1:]
+		p.saveLocked()
+	}
+}
+
+func (p *Publisher) saveLocked() {
+	if err := p.store.SavePendingEvents(p.queue); err != nil {
+		p.logger.Warn("failed to persist pending events", "err", err)
+	}
+}
@@ -0,0 +1,640 @@
+// Package fakevm is a simulated VM backend. It walks instances through the
+// same provisioning stages and status transitions as the QEMU manager, with
+// configurable timing, but starts no process, binds no GPU and touches no
+// disk. It lets the HTTP API, storage, tunnel configuration and restore
+// logic run in CI on machines without GPUs or KVM.
+package fakevm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/qemu"
+)
+
+// defaultGPU is the address reported when no GPU is configured.
+const defaultGPU = "0000:01:00.0"
+
+var (
+	// errUnsupported is returned for what a simulated guest cannot do.
+	errUnsupported = errors.New("not supported by the fake backend")
+	// errSimulated is the cause of a create failed by Config.FailReason.
+	errSimulated = errors.New("simulated failure")
+)
+
+type Config struct {
+	// GPUs are the simulated GPU addresses; one is made up if empty.
+	GPUs       []string
+	DiskSizeGB int
+	// BootTime is how long a create takes, spread over its stages.
+	BootTime time.Duration
+	// FailReason, when set, fails every create with this reason once the
+	// stage it belongs to is reached.
+	FailReason domain.StatusReason
+	// DataDir holds the staging directories of imports.
+	DataDir   string
+	PowerCapW int
+}
+
+// Manager implements domain.VMManager and the host-side operations of the
+// QEMU manager the agent uses.
+type Manager struct {
+	cfg    Config
+	logger *slog.Logger
+
+	mu           sync.Mutex
+	vmID         string
+	spec         domain.InstanceSpec
+	gpuAddrs     []string
+	portPool     map[int]int
+	diskGB       int
+	secureWipe   bool
+	sshKeys      []string
+	status       domain.InstanceStatus
+	statusReason domain.StatusReason
+	statusSince  time.Time
+	powerCap     int
+	clockLimit   int
+
+	events func(domain.Event)
+	stages func(domain.ProvisionStage)
+}
+
+var _ domain.VMManager = (*Manager)(nil)
+
+func NewManager(cfg Config, logger *slog.Logger) *Manager {
+	if len(cfg.GPUs) == 0 {
+		cfg.GPUs = []string{defaultGPU}
+	}
+	if cfg.DiskSizeGB == 0 {
+		cfg.DiskSizeGB = 50
+	}
+	return &Manager{
+		cfg:         cfg,
+		logger:      logger.With("backend", "fake"),
+		status:      domain.StatusDestroyed,
+		statusSince: time.Now(),
+		powerCap:    cfg.PowerCapW,
+	}
+}
+
+// SetEventSink sets where instance events are published.
+func (m *Manager) SetEventSink(fn func(domain.Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = fn
+}
+
+// SetStageSink sets where provisioning stages are reported.
+func (m *Manager) SetStageSink(fn func(domain.ProvisionStage)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stages = fn
+}
+
+func (m *Manager) stageLocked(stage domain.ProvisionStage) {
+	if m.stages != nil {
+		m.stages(stage)
+	}
+}
+
+// Create simulates a boot. The manager is unlocked while a stage "runs", so
+// a Destroy in the meantime is noticed as it would be during the SSH wait of
+// a real VM.
+func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPorts []int) (domain.InstancePorts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID != "" {
+		return nil, domain.ErrInstanceAlreadyRunning{}
+	}
+	if !m.setStatusLocked(domain.StatusProvisioning, "") {
+		return nil, domain.ErrInvalidTransition{From: m.status, To: domain.StatusProvisioning}
+	}
+
+	gpuAddrs := m.cfg.GPUs
+	if len(spec.GPUAddrs) > 0 {
+		gpuAddrs = spec.GPUAddrs
+	}
+	for _, addr := range gpuAddrs {
+		if !slices.Contains(m.cfg.GPUs, addr) {
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "create", Err: fmt.Errorf("gpu %s is not configured for passthrough", addr)}
+		}
+	}
+
+	guestPorts := make([]int, 0, len(spec.Ports)+1)
+	if spec.SSHEnabled {
+		guestPorts = append(guestPorts, 22)
+	}
+	for _, pm := range spec.Ports {
+		guestPorts = append(guestPorts, pm.GuestPort)
+	}
+	if len(hostPorts) < len(guestPorts) {
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+		return nil, domain.ErrQEMU{Op: "ports", Err: fmt.Errorf("not enough host ports: need %d, got %d", len(guestPorts), len(hostPorts))}
+	}
+	pool := make(map[int]int, len(guestPorts))
+	for i, gp := range guestPorts {
+		pool[gp] = hostPorts[i]
+	}
+
+	vmID := spec.VMID
+	if vmID == "" {
+		vmID = "vm-fake"
+	}
+	diskGB := spec.DiskSizeGB
+	if diskGB == 0 {
+		diskGB = m.cfg.DiskSizeGB
+	}
+
+	m.vmID = vmID
+	m.spec = spec
+	m.gpuAddrs = append([]string(nil), gpuAddrs...)
+	m.portPool = pool
+	m.diskGB = diskGB
+	m.secureWipe = spec.SecureWipe
+
+	step := m.cfg.BootTime / 4
+	if !m.stepLocked(ctx, domain.StageBindingGPU, step) {
+		return nil, m.abortLocked(ctx, vmID)
+	}
+	if m.cfg.FailReason == domain.ReasonVFIOBind {
+		m.failLocked(domain.ReasonVFIOBind)
+		return nil, domain.ErrVFIO{Op: "bind", Addr: gpuAddrs[0], Err: errSimulated}
+	}
+
+	if !m.stepLocked(ctx, domain.StageBooting, step) {
+		return nil, m.abortLocked(ctx, vmID)
+	}
+	switch m.cfg.FailReason {
+	case domain.ReasonDisk, domain.ReasonQEMUStart, domain.ReasonQMPUnavailable, domain.ReasonCreateFailed:
+		return nil, m.failLocked(m.cfg.FailReason)
+	}
+	m.logger.Info("VM started", "vm_id", vmID)
+	m.setStatusLocked(domain.StatusBooting, "")
+
+	if spec.SSHEnabled {
+		if !m.stepLocked(ctx, domain.StageWaitingSSH, step) {
+			return nil, m.abortLocked(ctx, vmID)
+		}
+		if m.cfg.FailReason == domain.ReasonSSHTimeout {
+			return nil, m.failLocked(domain.ReasonSSHTimeout)
+		}
+		m.logger.Info("VM SSH ready", "vm_id", vmID)
+		m.setStatusLocked(domain.StatusConfiguring, "")
+		if m.events != nil {
+			m.events(domain.Event{
+				Type:     domain.EventInstanceSSHReady,
+				Severity: domain.SeverityInfo,
+				Message:  "instance accepts SSH connections",
+				Data:     map[string]any{"vm_id": vmID},
+				Time:     time.Now().UTC(),
+			})
+		}
+		if !m.stepLocked(ctx, domain.StageConfiguring, step) {
+			return nil, m.abortLocked(ctx, vmID)
+		}
+	}
+
+	m.setStatusLocked(domain.StatusRunning, "")
+
+	portMap := make(domain.InstancePorts, len(pool))
+	for gp, hp := range pool {
+		portMap[strconv.Itoa(gp)] = strconv.Itoa(hp)
+	}
+	return portMap, nil
+}
+
+// stepLocked reports stage and waits d with the manager unlocked. It
+// returns false if ctx was cancelled or the VM destroyed meanwhile.
+func (m *Manager) stepLocked(ctx context.Context, stage domain.ProvisionStage, d time.Duration) bool {
+	m.stageLocked(stage)
+	vmID := m.vmID
+	m.mu.Unlock()
+	defer m.mu.Lock()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+	}
+	m.mu.Lock()
+	gone := m.vmID != vmID
+	m.mu.Unlock()
+	return !gone
+}
+
+// abortLocked ends a create interrupted by ctx or a Destroy.
+func (m *Manager) abortLocked(ctx context.Context, vmID string) error {
+	if m.vmID != vmID {
+		return fmt.Errorf("VM destroyed while booting")
+	}
+	m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+	m.clearLocked()
+	return ctx.Err()
+}
+
+// failLocked fails the create with reason and removes the VM, as the QEMU
+// manager does when a boot step fails.
+func (m *Manager) failLocked(reason domain.StatusReason) error {
+	m.setStatusLocked(domain.StatusFailed, reason)
+	m.clearLocked()
+	return domain.ErrQEMU{Op: string(reason), Err: errSimulated}
+}
+
+func (m *Manager) clearLocked() {
+	m.vmID = ""
+	m.spec = domain.InstanceSpec{}
+	m.gpuAddrs = nil
+	m.portPool = nil
+	m.diskGB = 0
+	m.sshKeys = nil
+	m.clockLimit = 0
+}
+
+// Stop destroys the VM; a failed instance is cleared back to destroyed.
+func (m *Manager) Stop(ctx context.Context) error {
+	_, err := m.Destroy(ctx, false)
+	return err
+}
+
+func (m *Manager) Destroy(ctx context.Context, secureWipe bool) (*domain.WipeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" {
+		if m.status == domain.StatusFailed {
+			m.setStatusLocked(domain.StatusDestroyed, "")
+		}
+		return nil, nil
+	}
+
+	m.setStatusLocked(domain.StatusStopping, "")
+	var report *domain.WipeReport
+	if secureWipe || m.secureWipe {
+		report = &domain.WipeReport{
+			Files:  []string{m.vmID + ".qcow2"},
+			Bytes:  int64(m.diskGB) << 30,
+			Method: "fake",
+		}
+	}
+	m.logger.Info("VM destroyed", "vm_id", m.vmID)
+	m.clearLocked()
+	m.setStatusLocked(domain.StatusDestroyed, "")
+	return report, nil
+}
+
+func (m *Manager) SecureWipe() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.secureWipe
+}
+
+func (m *Manager) Manage(ctx context.Context, cmd domain.InstanceCommand) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	switch cmd {
+	case domain.CommandStart, domain.CommandStop, domain.CommandReboot:
+	default:
+		return domain.ErrUnknownCommand{Command: string(cmd)}
+	}
+	if !domain.CommandAllowed(m.status, cmd) {
+		return domain.ErrCommandNotAllowed{Command: cmd, Status: m.status}
+	}
+
+	switch cmd {
+	case domain.CommandStart:
+		m.setStatusLocked(domain.StatusRunning, "")
+	case domain.CommandStop:
+		m.setStatusLocked(domain.StatusPaused, "")
+	}
+	return nil
+}
+
+func (m *Manager) MarkFailed(reason domain.StatusReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status == domain.StatusFailed {
+		return
+	}
+	m.setStatusLocked(domain.StatusFailed, reason)
+}
+
+func (m *Manager) Invalidate() {}
+
+func (m *Manager) Status(ctx context.Context) domain.StatusInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return domain.StatusInfo{Status: m.status, Reason: m.statusReason, Since: m.statusSince}
+}
+
+func (m *Manager) setStatusLocked(to domain.InstanceStatus, reason domain.StatusReason) bool {
+	if m.status == to && m.statusReason == reason {
+		return true
+	}
+	if !domain.CanTransition(m.status, to) {
+		m.logger.Warn("rejected status transition", "from", m.status, "to", to, "reason", reason)
+		return false
+	}
+	m.logger.Info("instance status changed", "from", m.status, "to", to, "reason", reason)
+	m.status = to
+	m.statusReason = reason
+	m.statusSince = time.Now()
+	return true
+}
+
+// CollectStats returns made-up but plausible utilisation of the running VM.
+func (m *Manager) CollectStats(ctx context.Context) *domain.StatsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" || m.status != domain.StatusRunning {
+		return nil
+	}
+	t := float64(time.Now().Unix()%60) / 60
+	return &domain.StatsSnapshot{
+		GPUUtil: 50 + 40*t,
+		GPUTemp: 55 + int(20*t),
+		CPUUtil: 20 + 30*t,
+		RAMUtil: 40,
+		MemUtil: 30 + 20*t,
+	}
+}
+
+func (m *Manager) VMID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.vmID
+}
+
+func (m *Manager) GPUAddrs() []string {
+	return append([]string(nil), m.cfg.GPUs...)
+}
+
+func (m *Manager) AttachedGPUs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.gpuAddrs...)
+}
+
+func (m *Manager) SetPowerCap(ctx context.Context, watts int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.powerCap = watts
+	return nil
+}
+
+func (m *Manager) PowerCap() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.powerCap
+}
+
+func (m *Manager) AddSSHKey(ctx context.Context, pubkey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	if !slices.Contains(m.sshKeys, pubkey) {
+		m.sshKeys = append(m.sshKeys, pubkey)
+	}
+	return nil
+}
+
+func (m *Manager) RemoveSSHKey(ctx context.Context, pubkey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	m.sshKeys = slices.DeleteFunc(m.sshKeys, func(k string) bool { return k == pubkey })
+	return nil
+}
+
+func (m *Manager) SetRootPassword(ctx context.Context, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	m.spec.RootPassword = password
+	return nil
+}
+
+// Discard has nothing to remove: a simulated create leaves no files.
+func (m *Manager) Discard(vmID string, secureWipe bool) {}
+
+func (m *Manager) OpenConsole(ctx context.Context) (io.ReadWriteCloser, error) {
+	return nil, errUnsupported
+}
+
+func (m *Manager) Export(ctx context.Context) (*domain.ExportBundle, error) {
+	return nil, errUnsupported
+}
+
+func (m *Manager) ResumeExport() error { return nil }
+
+func (m *Manager) ImportDir() (string, error) {
+	dir := filepath.Join(m.cfg.DataDir, "import")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "fake-")
+}
+
+func (m *Manager) ResizeDisk(ctx context.Context, sizeGB int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	if sizeGB < m.diskGB {
+		return domain.ErrDiskShrink{CurrentGB: m.diskGB, RequestedGB: sizeGB}
+	}
+	m.diskGB = sizeGB
+	return nil
+}
+
+// StreamLogs writes a short made-up journal.
+func (m *Manager) StreamLogs(ctx context.Context, opts domain.LogOptions, w io.Writer) error {
+	m.mu.Lock()
+	vmID, since := m.vmID, m.statusSince
+	m.mu.Unlock()
+	if vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	lines := []string{"systemd[1]: Started OpenSSH server.", "systemd[1]: Reached target Multi-User System."}
+	if opts.Tail > 0 && opts.Tail < len(lines) {
+		lines = lines[len(lines)-opts.Tail:]
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", since.Format(time.Stamp), vmID, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BootLog returns a short made-up kernel log.
+func (m *Manager) BootLog() ([]byte, error) {
+	m.mu.Lock()
+	vmID := m.vmID
+	m.mu.Unlock()
+	if vmID == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	return []byte("[    0.000000] Linux version 6.8.0 (fakevm)\n[    1.234567] Run /sbin/init as init process\n" +
+		vmID + " login:\n"), nil
+}
+
+func (m *Manager) DownloadFile(ctx context.Context, path string, fn func(size int64, r io.Reader) error) error {
+	return errUnsupported
+}
+
+func (m *Manager) UploadFile(ctx context.Context, path string, r io.Reader, mode os.FileMode) error {
+	if m.VMID() == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	return errUnsupported
+}
+
+func (m *Manager) Exec(ctx context.Context, req domain.ExecRequest) (*domain.ExecResult, error) {
+	if m.VMID() == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	return nil, errUnsupported
+}
+
+// TrimGuest has nothing to discard.
+func (m *Manager) TrimGuest(ctx context.Context) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return 0, domain.ErrNoInstanceRunning{}
+	}
+	return 0, nil
+}
+
+// AttachUSB records the device; nothing is plugged in.
+func (m *Manager) AttachUSB(dev domain.USBDevice) ([]domain.USBDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	if slices.Contains(m.spec.USB, dev) {
+		return nil, domain.ErrUSBAttached{Device: dev}
+	}
+	m.spec.USB = append(m.spec.USB, dev)
+	return slices.Clone(m.spec.USB), nil
+}
+
+func (m *Manager) DetachUSB(dev domain.USBDevice) ([]domain.USBDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	i := slices.Index(m.spec.USB, dev)
+	if i < 0 {
+		return nil, domain.ErrUSBNotAttached{Device: dev}
+	}
+	m.spec.USB = slices.Delete(m.spec.USB, i, i+1)
+	return slices.Clone(m.spec.USB), nil
+}
+
+func (m *Manager) Attest(ctx context.Context, nonce []byte) (*domain.Attestation, error) {
+	return nil, errUnsupported
+}
+
+// KillOrphans has nothing to kill: simulated VMs end with the agent.
+func (m *Manager) KillOrphans() {}
+
+// ReapOrphans has nothing to reap either.
+func (m *Manager) ReapOrphans() []domain.Drift { return nil }
+
+// EnsureContainers leaves the simulated containers alone.
+func (m *Manager) EnsureContainers(ctx context.Context) []domain.Drift { return nil }
+
+func (m *Manager) PrepareSRIOV() error { return nil }
+
+func (m *Manager) SetBaseImage(path string) {}
+
+func (m *Manager) SetMaxBandwidth(mbps int) {}
+
+func (m *Manager) CollectGarbage(watermark float64) (qemu.GCReport, error) {
+	return qemu.GCReport{}, nil
+}
+
+func (m *Manager) NetCounters() (rx, tx uint64, ok bool) { return 0, 0, false }
+
+func (m *Manager) GPUPower() (watts float64, ok bool) { return 0, false }
+
+func (m *Manager) LimitGPUClocks(ctx context.Context, mhz int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clockLimit = mhz
+	return nil
+}
+
+func (m *Manager) RunCommand(ctx context.Context, cmd string) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+// Handoff describes the simulated VM so that the process the agent re-execs
+// into can adopt it, which exercises the same restore path as with QEMU.
+func (m *Manager) Handoff() *domain.VMHandoff {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return nil
+	}
+	h := &domain.VMHandoff{
+		VMID:       m.vmID,
+		Spec:       m.spec,
+		GPUAddrs:   append([]string(nil), m.gpuAddrs...),
+		PortPool:   make(map[int]int, len(m.portPool)),
+		SecureWipe: m.secureWipe,
+		Status:     m.status,
+		Reason:     m.statusReason,
+	}
+	for gp, hp := range m.portPool {
+		h.PortPool[gp] = hp
+	}
+	return h
+}
+
+func (m *Manager) Adopt(h *domain.VMHandoff) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID != "" {
+		return domain.ErrInstanceAlreadyRunning{}
+	}
+	m.vmID = h.VMID
+	m.spec = h.Spec
+	m.gpuAddrs = h.GPUAddrs
+	m.portPool = h.PortPool
+	m.secureWipe = h.SecureWipe
+	m.diskGB = h.Spec.DiskSizeGB
+	if m.diskGB == 0 {
+		m.diskGB = m.cfg.DiskSizeGB
+	}
+	m.status, m.statusReason, m.statusSince = h.Status, h.Reason, time.Now()
+	m.logger.Info("adopted VM from previous process", "vm_id", h.VMID)
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"text/template"
+
+	"github.com/qudata/agent/internal/domain"
 )
 
 const (
@@ -17,11 +19,30 @@ type Config struct {
 	ServerAddr string
 	ServerPort int
 	AuthToken  string
+	// TLS wraps the connection to frps; it is left out of the config when nil.
+	TLS *TLSConfig
+
+	// Admin is frpc's local admin API, used to reload proxies without a
+	// restart; it is left out of the config when nil.
+	Admin *AdminAPI
 
 	AgentProxy      *Proxy
 	InstanceProxies []Proxy
 }
 
+// TLSConfig is frpc's transport.tls section.
+type TLSConfig struct {
+	ServerName    string
+	TrustedCAFile string
+}
+
+// AdminAPI is where frpc serves its admin API and the credentials it takes.
+type AdminAPI struct {
+	Port     int
+	User     string
+	Password string
+}
+
 type Proxy struct {
 	Name         string
 	Type         string
@@ -33,6 +54,8 @@ type Proxy struct {
 
 var configTemplate = template.Must(template.New("frpc").Parse(`serverAddr = "{{ .ServerAddr }}"
 serverPort = {{ .ServerPort }}
+# Exit when the first login fails, so the agent can fail over to the next server.
+loginFailExit = true
 
 [auth]
 method = "token"
@@ -41,11 +64,31 @@ token = "{{ .AuthToken }}"
 [transport]
 tcpMuxKeepaliveInterval = 30
 dialServerKeepalive = 30
+{{- if .TLS }}
+
+[transport.tls]
+enable = true
+{{- if .TLS.ServerName }}
+serverName = "{{ .TLS.ServerName }}"
+{{- end }}
+{{- if .TLS.TrustedCAFile }}
+trustedCaFile = "{{ .TLS.TrustedCAFile }}"
+{{- end }}
+{{- end }}
 
 [log]
 to = "console"
 level = "debug"
 
+{{- if .Admin }}
+
+[webServer]
+addr = "127.0.0.1"
+port = {{ .Admin.Port }}
+user = "{{ .Admin.User }}"
+password = "{{ .Admin.Password }}"
+{{- end }}
+
 {{- if .AgentProxy }}
 
 [[proxies]]
@@ -74,15 +117,21 @@ remotePort = {{ .RemotePort }}
 {{- end }}
 `))
 
-func NewConfig(agentID, tunnelToken string, agentPort int) *Config {
+// NewConfig builds the config proxying the agent API. With agentTLS the API
+// speaks TLS itself and frps routes it by SNI without terminating it.
+func NewConfig(agentID, tunnelToken, agentIP string, agentPort int, agentTLS bool) *Config {
+	proxyType := "http"
+	if agentTLS {
+		proxyType = "https"
+	}
 	return &Config{
 		ServerAddr: FRPServerAddr,
 		ServerPort: FRPServerPort,
 		AuthToken:  FRPToken,
 		AgentProxy: &Proxy{
 			Name:         fmt.Sprintf("agent-%s", agentID),
-			Type:         "http",
-			LocalIP:      "127.0.0.1",
+			Type:         proxyType,
+			LocalIP:      agentIP,
 			LocalPort:    agentPort,
 			CustomDomain: fmt.Sprintf("%s-%d", tunnelToken, agentPort),
 		},
@@ -97,6 +146,47 @@ func (c *Config) ClearInstanceProxies() {
 	c.InstanceProxies = nil
 }
 
+// Mapping converts the proxy into its persisted form.
+func (p Proxy) Mapping() domain.ProxyMapping {
+	return domain.ProxyMapping{
+		Name:         p.Name,
+		Type:         p.Type,
+		LocalPort:    p.LocalPort,
+		RemotePort:   p.RemotePort,
+		CustomDomain: p.CustomDomain,
+	}
+}
+
+// ProxyFromMapping rebuilds a proxy from its persisted form.
+func ProxyFromMapping(m domain.ProxyMapping) Proxy {
+	return Proxy{
+		Name:         m.Name,
+		Type:         m.Type,
+		LocalIP:      "127.0.0.1",
+		LocalPort:    m.LocalPort,
+		RemotePort:   m.RemotePort,
+		CustomDomain: m.CustomDomain,
+	}
+}
+
+// SameProxies reports whether a and b hold the same proxies in any order.
+func SameProxies(a, b []Proxy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[Proxy]int, len(a))
+	for _, p := range a {
+		seen[p]++
+	}
+	for _, p := range b {
+		if seen[p] == 0 {
+			return false
+		}
+		seen[p]--
+	}
+	return true
+}
+
 func (c *Config) Render() ([]byte, error) {
 	var buf bytes.Buffer
 	if err := configTemplate.Execute(&buf, c); err != nil {
@@ -134,10 +224,12 @@ func BuildInstanceProxies(tunnelToken string, hostPorts []int, sshRemotePort int
 		case "tcp":
 			proxy.RemotePort = ps.RemotePort
 		case "http":
-			if ps.RemotePort > 0 {
-				proxy.CustomDomain = fmt.Sprintf("%s-%d", tunnelToken, ps.RemotePort)
-			} else {
-				proxy.CustomDomain = tunnelToken
+			proxy.CustomDomain = HTTPDomain(tunnelToken, ps.RemotePort)
+			if ps.TLSPort > 0 {
+				// frps routes https by SNI and passes the stream through
+				// untouched to the local TLS terminator.
+				proxy.Type = "https"
+				proxy.LocalPort = ps.TLSPort
 			}
 		}
 		proxies = append(proxies, proxy)
@@ -151,4 +243,13 @@ type PortSpec struct {
 	GuestPort  int
 	RemotePort int
 	Proto      string
+	TLSPort    int
+}
+
+// HTTPDomain returns the frps custom domain of an instance HTTP port.
+func HTTPDomain(tunnelToken string, remotePort int) string {
+	if remotePort > 0 {
+		return fmt.Sprintf("%s-%d", tunnelToken, remotePort)
+	}
+	return tunnelToken
 }
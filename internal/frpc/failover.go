@@ -0,0 +1,116 @@
+package frpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+// failoverAfter is how long the tunnel may stay down on a server frpc is
+// still connected to, or reconnecting to, before the next one is tried.
+const failoverAfter = 90 * time.Second
+
+// SetServers replaces the built-in frps address and token with the ones
+// from /init. Call it before Start; it takes effect on the next start.
+func (p *Process) SetServers(info *domain.FRPInfo) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.servers = nil
+	for _, s := range info.Servers {
+		if s.Addr != "" && s.Port > 0 {
+			p.servers = append(p.servers, s)
+		}
+	}
+	if len(p.servers) == 0 {
+		return fmt.Errorf("no usable frps server in %d given", len(info.Servers))
+	}
+	p.current = 0
+	p.token = info.Token
+
+	p.tls = nil
+	if info.TLS != nil {
+		p.tls = &TLSConfig{ServerName: info.TLS.ServerName}
+		if info.TLS.TrustedCA != "" {
+			path := filepath.Join(filepath.Dir(p.configPath), "frps-ca.pem")
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return fmt.Errorf("frps ca: %w", err)
+			}
+			if err := os.WriteFile(path, []byte(info.TLS.TrustedCA), 0o644); err != nil {
+				return fmt.Errorf("frps ca: %w", err)
+			}
+			p.tls.TrustedCAFile = path
+		}
+	}
+	return nil
+}
+
+// applyServerLocked points the config at the current server. Must be
+// called with p.mu held.
+func (p *Process) applyServerLocked() {
+	if p.config == nil || len(p.servers) == 0 {
+		return
+	}
+	s := p.servers[p.current]
+	p.config.ServerAddr, p.config.ServerPort = s.Addr, s.Port
+	if p.token != "" {
+		p.config.AuthToken = p.token
+	}
+	p.config.TLS = p.tls
+}
+
+// nextServerLocked moves the config to the next server and reports whether
+// there was one to move to. The caller (re)starts frpc. Must be called with
+// p.mu held.
+func (p *Process) nextServerLocked(reason string) bool {
+	if len(p.servers) < 2 || p.config == nil {
+		return false
+	}
+	from := p.serverLocked()
+	p.current = (p.current + 1) % len(p.servers)
+	p.applyServerLocked()
+	p.failedOver = time.Now()
+	metrics.FRPCFailovers.Inc()
+	p.logger.Warn("frpc failing over to the next server", "from", from, "to", p.serverLocked(), "reason", reason)
+	return true
+}
+
+// serverLocked is the address frpc is configured to connect to. Must be
+// called with p.mu held.
+func (p *Process) serverLocked() string {
+	if p.config == nil {
+		return ""
+	}
+	return net.JoinHostPort(p.config.ServerAddr, strconv.Itoa(p.config.ServerPort))
+}
+
+// failoverIfStuck restarts frpc on the next server when the tunnel has been
+// down for failoverAfter while frpc kept running: frpc only exits when the
+// first login fails and otherwise reconnects to the same server forever.
+func (p *Process) failoverIfStuck(st domain.TunnelStatus) {
+	if st.Up {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	down := st.Since
+	if p.failedOver.After(down) {
+		down = p.failedOver
+	}
+	if time.Since(down) < failoverAfter || !p.running() {
+		return
+	}
+	if !p.nextServerLocked(fmt.Sprintf("tunnel down since %s", st.Since.Format(time.RFC3339))) {
+		return
+	}
+	if err := p.restart(); err != nil {
+		p.logger.Error("frpc restart on failover failed", "err", err)
+	}
+}
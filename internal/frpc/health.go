@@ -0,0 +1,101 @@
+package frpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// proxyStatus is one proxy in the response of frpc's /api/status.
+type proxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// Health returns the tunnel status of the last check, or nil before the
+// first one.
+func (p *Process) Health() *domain.TunnelStatus {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+	return p.health.Clone()
+}
+
+// CheckHealth queries frpc's admin API and records the result. A tunnel
+// stuck down on one server fails over to the next.
+func (p *Process) CheckHealth(ctx context.Context) domain.TunnelStatus {
+	now := time.Now().UTC()
+	statuses, err := p.proxyStatuses(ctx)
+
+	p.mu.Lock()
+	server := p.serverLocked()
+	p.mu.Unlock()
+
+	st := domain.TunnelStatus{Up: err == nil, Since: now, CheckedAt: now, Server: server}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	for _, ps := range statuses {
+		ph := domain.ProxyHealth{
+			Name:       ps.Name,
+			Type:       ps.Type,
+			Up:         ps.Status == "running",
+			Status:     ps.Status,
+			Error:      ps.Err,
+			RemoteAddr: ps.RemoteAddr,
+			Since:      now,
+		}
+		if !ph.Up {
+			st.Up = false
+		}
+		st.Proxies = append(st.Proxies, ph)
+	}
+
+	p.healthMu.Lock()
+	st.CarrySince(p.health)
+	p.health = &st
+	p.healthMu.Unlock()
+
+	p.failoverIfStuck(st)
+	return st
+}
+
+// proxyStatuses asks frpc's admin API for the state of every proxy.
+func (p *Process) proxyStatuses(ctx context.Context) ([]proxyStatus, error) {
+	p.mu.Lock()
+	var admin *AdminAPI
+	if p.config != nil {
+		admin = p.config.Admin
+	}
+	running := p.running()
+	p.mu.Unlock()
+
+	switch {
+	case !running:
+		return nil, fmt.Errorf("frpc is not running")
+	case admin == nil:
+		return nil, fmt.Errorf("frpc admin API disabled")
+	}
+
+	body, err := admin.request(ctx, http.MethodGet, "/api/status")
+	if err != nil {
+		return nil, err
+	}
+	var byType map[string][]proxyStatus
+	if err := json.Unmarshal(body, &byType); err != nil {
+		return nil, fmt.Errorf("decode frpc status: %w", err)
+	}
+	var out []proxyStatus
+	for _, list := range byType {
+		out = append(out, list...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
@@ -4,12 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/qudata/agent/internal/crash"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/logfile"
+	"github.com/qudata/agent/internal/metrics"
 )
 
 // Process manages the FRPC subprocess lifecycle and its configuration.
@@ -17,6 +25,7 @@ type Process struct {
 	logger     *slog.Logger
 	binaryPath string
 	configPath string
+	logPath    string
 
 	mu     sync.Mutex
 	cmd    *exec.Cmd
@@ -28,17 +37,33 @@ type Process struct {
 	// intentional restart() and full Stop().
 	runCtx    context.Context
 	runCancel context.CancelFunc
+
+	// servers are the frps to fail over between, from SetServers; current
+	// is the one the config points at.
+	servers    []domain.FRPServer
+	current    int
+	token      string
+	tls        *TLSConfig
+	failedOver time.Time
+
+	healthMu sync.Mutex
+	health   *domain.TunnelStatus
 }
 
-func NewProcess(binaryPath, configPath string, logger *slog.Logger) *Process {
+// NewProcess returns an frpc runner. frpc's output goes to logPath, or to
+// the agent's stdout when logPath is empty.
+func NewProcess(binaryPath, configPath, logPath string, logger *slog.Logger) *Process {
 	return &Process{
 		logger:     logger,
 		binaryPath: binaryPath,
 		configPath: configPath,
+		logPath:    logPath,
 	}
 }
 
-func (p *Process) Start(agentID, tunnelToken string, agentPort int) error {
+// Start writes the frpc config and launches frpc, proxying the agent API
+// at agentIP:agentPort, served over TLS if agentTLS is set.
+func (p *Process) Start(agentID, tunnelToken, agentIP string, agentPort int, agentTLS bool) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -46,16 +71,47 @@ func (p *Process) Start(agentID, tunnelToken string, agentPort int) error {
 		return fmt.Errorf("frpc binary not found at %s: %w", p.binaryPath, err)
 	}
 
-	p.config = NewConfig(agentID, tunnelToken, agentPort)
+	if p.cmd == nil {
+		p.stopStale()
+	}
+	p.config = NewConfig(agentID, tunnelToken, agentIP, agentPort, agentTLS)
+	p.applyServerLocked()
+
+	// A server refusing the login makes frpc exit at once; try the next one.
+	var err error
+	for range max(1, len(p.servers)) {
+		if err = p.startProcess(); err == nil {
+			return nil
+		}
+		if !p.nextServerLocked(err.Error()) {
+			break
+		}
+	}
+	return err
+}
+
+func (p *Process) UpdateInstanceProxies(proxies []Proxy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config == nil {
+		return fmt.Errorf("frpc not initialized")
+	}
+
+	for _, proxy := range proxies {
+		p.config.AddInstanceProxy(proxy)
+	}
 
 	if err := p.writeConfig(); err != nil {
 		return err
 	}
 
-	return p.startProcess()
+	return p.reload()
 }
 
-func (p *Process) UpdateInstanceProxies(proxies []Proxy) error {
+// SetInstanceProxies replaces the instance proxies with the given set and
+// reloads frpc.
+func (p *Process) SetInstanceProxies(proxies []Proxy) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -63,6 +119,7 @@ func (p *Process) UpdateInstanceProxies(proxies []Proxy) error {
 		return fmt.Errorf("frpc not initialized")
 	}
 
+	p.config.ClearInstanceProxies()
 	for _, proxy := range proxies {
 		p.config.AddInstanceProxy(proxy)
 	}
@@ -71,7 +128,17 @@ func (p *Process) UpdateInstanceProxies(proxies []Proxy) error {
 		return err
 	}
 
-	return p.restart()
+	return p.reload()
+}
+
+// InstanceProxies returns a copy of the instance proxies currently configured.
+func (p *Process) InstanceProxies() []Proxy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config == nil {
+		return nil
+	}
+	return append([]Proxy(nil), p.config.InstanceProxies...)
 }
 
 func (p *Process) ClearInstanceProxies() error {
@@ -88,7 +155,41 @@ func (p *Process) ClearInstanceProxies() error {
 		return err
 	}
 
-	return p.restart()
+	return p.reload()
+}
+
+// stopStale terminates an frpc running with our config that a crashed agent
+// process left behind: systemd only kills the agent itself, so that the VM
+// survives. Two frpcs would fight over the proxies.
+func (p *Process) stopStale() {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) != 3 || args[0] != p.binaryPath || args[1] != "-c" || args[2] != p.configPath {
+			continue
+		}
+		p.logger.Warn("stopping frpc left by a previous agent process", "pid", pid)
+		if syscall.Kill(pid, syscall.SIGTERM) != nil {
+			continue
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if syscall.Kill(pid, 0) != nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
 }
 
 func (p *Process) Stop() error {
@@ -97,6 +198,16 @@ func (p *Process) Stop() error {
 	return p.stopProcess()
 }
 
+// PID returns the pid of the running frpc, or 0.
+func (p *Process) PID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
 func (p *Process) GetConfig() *Config {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -113,7 +224,8 @@ func (p *Process) writeConfig() error {
 		return fmt.Errorf("frpc write-config: render: %w", err)
 	}
 
-	if err := os.WriteFile(p.configPath, data, 0o644); err != nil {
+	// The config holds the server token and the admin API password.
+	if err := os.WriteFile(p.configPath, data, 0o600); err != nil {
 		return fmt.Errorf("frpc write-config: write file: %w", err)
 	}
 
@@ -121,9 +233,20 @@ func (p *Process) writeConfig() error {
 	return nil
 }
 
-// startProcess launches the frpc binary and starts a monitor goroutine.
-// Must be called with p.mu held.
+// startProcess writes the config, launches the frpc binary and starts a
+// monitor goroutine. Must be called with p.mu held.
 func (p *Process) startProcess() error {
+	// The admin API gets a fresh port on every start, so a port taken in
+	// the meantime cannot keep frpc from coming up.
+	admin, err := newAdminAPI()
+	if err != nil {
+		p.logger.Warn("frpc admin API disabled, proxy changes will restart frpc", "err", err)
+	}
+	p.config.Admin = admin
+	if err := p.writeConfig(); err != nil {
+		return err
+	}
+
 	// Cancel any lingering monitor goroutine from a previous run.
 	if p.runCancel != nil {
 		p.runCancel()
@@ -133,12 +256,26 @@ func (p *Process) startProcess() error {
 	p.cmd = exec.Command(p.binaryPath, "-c", p.configPath)
 	p.cmd.Stdout = os.Stdout
 	p.cmd.Stderr = os.Stderr
+	var logFile *os.File
+	if p.logPath != "" {
+		// Appended to so that the agent can rotate it while frpc runs.
+		if logFile, err = logfile.OpenAppend(p.logPath); err != nil {
+			return fmt.Errorf("open frpc log: %w", err)
+		}
+		p.cmd.Stdout, p.cmd.Stderr = logFile, logFile
+	}
 
-	if err := p.cmd.Start(); err != nil {
+	err = p.cmd.Start()
+	if logFile != nil {
+		logFile.Close()
+	}
+	if err != nil {
 		return fmt.Errorf("frpc start: %w", err)
 	}
 
 	p.logger.Info("frpc started", "pid", p.cmd.Process.Pid, "config", p.configPath)
+	metrics.FRPCUp.Set(1)
+	metrics.FRPCRestarts.Inc()
 
 	p.done = make(chan struct{})
 	go p.monitor(p.runCtx)
@@ -156,10 +293,12 @@ func (p *Process) startProcess() error {
 // monitor waits for the frpc process to exit. If the exit was unexpected
 // (ctx not cancelled), it auto-restarts after a delay.
 func (p *Process) monitor(ctx context.Context) {
+	defer crash.Recover("frpc monitor")
 	cmd := p.cmd
 	done := p.done
 
 	err := cmd.Wait()
+	metrics.FRPCUp.Set(0)
 	close(done)
 
 	// If ctx is cancelled, stop or restart was intentional — do not auto-restart.
@@ -193,6 +332,7 @@ func (p *Process) monitor(ctx context.Context) {
 	default:
 	}
 
+	p.nextServerLocked("frpc exited")
 	if restartErr := p.startProcess(); restartErr != nil {
 		p.logger.Error("frpc auto-restart failed", "err", restartErr)
 	}
@@ -243,6 +383,37 @@ func (p *Process) stopProcess() error {
 	return nil
 }
 
+// reload applies the written config. frpc re-reads its proxies through the
+// admin API, which keeps the agent tunnel up; the process is restarted only
+// when the admin API is disabled or unreachable. Must be called with p.mu
+// held.
+func (p *Process) reload() error {
+	if p.config.Admin != nil && p.running() {
+		_, err := p.config.Admin.request(context.Background(), http.MethodGet, "/api/reload")
+		if err == nil {
+			p.logger.Info("frpc proxies reloaded", "proxies", len(p.config.InstanceProxies))
+			metrics.FRPCReloads.Inc()
+			return nil
+		}
+		p.logger.Warn("frpc hot reload failed, restarting", "err", err)
+	}
+	return p.restart()
+}
+
+// running reports whether the frpc process is up. Must be called with p.mu
+// held.
+func (p *Process) running() bool {
+	if p.cmd == nil || p.done == nil {
+		return false
+	}
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
 func (p *Process) restart() error {
 	if err := p.stopProcess(); err != nil {
 		p.logger.Warn("error stopping frpc for restart", "err", err)
@@ -55,9 +55,11 @@ func (p *FileInfoProvider) GPUInfo(_ context.Context) (*domain.GPUInfo, error) {
 	}, nil
 }
 
-// formatGPUName removes "NVIDIA " prefix and collapses spaces: "NVIDIA Tesla T4" -> "TeslaT4".
+// formatGPUName removes the vendor prefix and collapses spaces: "NVIDIA Tesla T4" -> "TeslaT4",
+// "AMD Instinct MI210" -> "InstinctMI210".
 func formatGPUName(name string) string {
 	name = strings.TrimPrefix(name, "NVIDIA ")
+	name = strings.TrimPrefix(name, "AMD ")
 	name = strings.ReplaceAll(name, " ", "")
 	return name
 }
@@ -0,0 +1,140 @@
+package gpu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	DefaultReservationTTL = 30 * time.Second
+	MaxReservationTTL     = 10 * time.Minute
+)
+
+// Reservation holds a GPU for a pending instance create so that the control
+// plane can route two-phase allocations without racing other creates.
+type Reservation struct {
+	ID        string    `json:"reservation_id"`
+	Addr      string    `json:"gpu_addr"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Reservations tracks short-lived, in-memory GPU reservations keyed by PCI address.
+// Reservations are not persisted: they are only meaningful for the few seconds
+// between the scheduler decision and the create request.
+type Reservations struct {
+	mu     sync.Mutex
+	byAddr map[string]Reservation
+}
+
+func NewReservations() *Reservations {
+	return &Reservations{
+		byAddr: make(map[string]Reservation),
+	}
+}
+
+// Reserve places a reservation on addr for ttl. It fails if another
+// unexpired reservation already holds the device.
+func (r *Reservations) Reserve(addr string, ttl time.Duration) (Reservation, error) {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	if ttl > MaxReservationTTL {
+		ttl = MaxReservationTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if cur, ok := r.byAddr[addr]; ok && now.Before(cur.ExpiresAt) {
+		return Reservation{}, domain.ErrGPUReserved{Addr: addr}
+	}
+
+	res := Reservation{
+		ID:        uuid.New().String(),
+		Addr:      addr,
+		ExpiresAt: now.Add(ttl),
+	}
+	r.byAddr[addr] = res
+	return res, nil
+}
+
+// Release drops the reservation on addr if id matches the holder.
+func (r *Reservations) Release(addr, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, ok := r.byAddr[addr]
+	if !ok || cur.ID != id {
+		return false
+	}
+	delete(r.byAddr, addr)
+	return true
+}
+
+// Claim verifies that every address in addrs is either unreserved or reserved
+// by id, and consumes the matching reservations, which it returns. Nothing
+// is consumed on error.
+func (r *Reservations) Claim(addrs []string, id string) ([]Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, addr := range addrs {
+		cur, ok := r.byAddr[addr]
+		if !ok {
+			continue
+		}
+		if !now.Before(cur.ExpiresAt) {
+			delete(r.byAddr, addr)
+			continue
+		}
+		if cur.ID != id {
+			return nil, domain.ErrGPUReserved{Addr: addr}
+		}
+	}
+	var claimed []Reservation
+	for _, addr := range addrs {
+		if cur, ok := r.byAddr[addr]; ok && cur.ID == id {
+			claimed = append(claimed, cur)
+			delete(r.byAddr, addr)
+		}
+	}
+	return claimed, nil
+}
+
+// Restore puts back reservations consumed by Claim for a create that then
+// failed, so the scheduler can retry under the same ID until they expire.
+// A device reserved again in the meantime keeps its new reservation.
+func (r *Reservations) Restore(claimed []Reservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, res := range claimed {
+		if !now.Before(res.ExpiresAt) {
+			continue
+		}
+		if cur, ok := r.byAddr[res.Addr]; ok && now.Before(cur.ExpiresAt) {
+			continue
+		}
+		r.byAddr[res.Addr] = res
+	}
+}
+
+// Active returns the unexpired reservation on addr, if any.
+func (r *Reservations) Active(addr string) (Reservation, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, ok := r.byAddr[addr]
+	if !ok {
+		return Reservation{}, false
+	}
+	if !time.Now().Before(cur.ExpiresAt) {
+		delete(r.byAddr, addr)
+		return Reservation{}, false
+	}
+	return cur, true
+}
@@ -0,0 +1,53 @@
+package gpu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreClaimedReservation(t *testing.T) {
+	const addr = "0000:01:00.0"
+	r := NewReservations()
+	res, err := r.Reserve(addr, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := r.Claim([]string{addr}, res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Active(addr); ok {
+		t.Fatal("claimed reservation still active")
+	}
+
+	r.Restore(claimed)
+	got, ok := r.Active(addr)
+	if !ok || got != res {
+		t.Fatalf("restored reservation = %+v, %v; want %+v", got, ok, res)
+	}
+	if _, err := r.Claim([]string{addr}, "other"); err == nil {
+		t.Fatal("restored reservation claimed under another ID")
+	}
+}
+
+func TestRestoreKeepsNewerReservation(t *testing.T) {
+	const addr = "0000:01:00.0"
+	r := NewReservations()
+	res, _ := r.Reserve(addr, time.Minute)
+	claimed, _ := r.Claim([]string{addr}, res.ID)
+	newer, err := r.Reserve(addr, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Restore(claimed)
+	if got, _ := r.Active(addr); got.ID != newer.ID {
+		t.Fatalf("reservation %s replaced by the restored %s", newer.ID, got.ID)
+	}
+
+	expired := []Reservation{{ID: "old", Addr: "0000:02:00.0", ExpiresAt: time.Now().Add(-time.Second)}}
+	r.Restore(expired)
+	if _, ok := r.Active("0000:02:00.0"); ok {
+		t.Fatal("expired reservation restored")
+	}
+}
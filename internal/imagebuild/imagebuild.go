@@ -0,0 +1,295 @@
+// Package imagebuild builds the instance base image behind
+// `qudata-agent build-image`: an Ubuntu cloud image, verified against the
+// release checksums, provisioned with virt-customize with the NVIDIA driver,
+// Docker with the NVIDIA container toolkit and sshd accepting the management
+// key.
+package imagebuild
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//go:embed provision.sh
+var provisionScript []byte
+
+const cloudImageURL = "https://cloud-images.ubuntu.com/releases"
+
+var (
+	releaseRe = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+	serialRe  = regexp.MustCompile(`^[0-9.]*$`)
+)
+
+// Options describe the image to build. The cloud image serial, the driver
+// branch and the toolkit version pin everything the image is built from,
+// except for the Ubuntu packages, which come from the archive at build time.
+type Options struct {
+	// Output is where the image is written; it must not exist yet, since
+	// overlays of the image it would replace would be corrupted.
+	Output string
+	// Release is the Ubuntu release, such as "24.04".
+	Release string
+	// Serial is the cloud image build, such as "20241004"; empty takes the
+	// latest.
+	Serial string
+	// Driver is the NVIDIA driver branch, such as "550".
+	Driver string
+	// Toolkit is the NVIDIA container toolkit version; empty takes the latest.
+	Toolkit string
+	// SizeGB is the virtual size of the image. Instance disks grow past it.
+	SizeGB int
+	// Script is an optional shell script run in the image after provisioning.
+	Script string
+	// PublicKey is the management public key file authorized for root.
+	PublicKey string
+	// CacheDir keeps downloaded cloud images between builds.
+	CacheDir string
+}
+
+// DefaultOptions returns the options of a build with the latest 24.04
+// cloud image and the 550 driver branch.
+func DefaultOptions() Options {
+	return Options{Release: "24.04", Driver: "550", SizeGB: 20}
+}
+
+// ApplyArgs sets the options given as --name=value in args. The agent's own
+// flags are skipped.
+func (o *Options) ApplyArgs(args []string) error {
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "--output":
+			o.Output = value
+		case "--release":
+			o.Release = value
+		case "--serial":
+			o.Serial = value
+		case "--driver":
+			o.Driver = value
+		case "--toolkit":
+			o.Toolkit = value
+		case "--size-gb":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("--size-gb must be a positive integer, got %q", value)
+			}
+			o.SizeGB = n
+		case "--script":
+			o.Script = value
+		case "--config", "--test", "--api-url":
+		default:
+			return fmt.Errorf("unknown option %q", arg)
+		}
+	}
+	return nil
+}
+
+// Build builds the image, writing progress to w, and returns its SHA-256
+// digest, which the control plane declares the image with.
+func Build(ctx context.Context, o Options, w io.Writer) (string, error) {
+	if o.Output == "" {
+		return "", fmt.Errorf("no output path")
+	}
+	if !releaseRe.MatchString(o.Release) {
+		return "", fmt.Errorf("invalid release %q", o.Release)
+	}
+	if !serialRe.MatchString(o.Serial) {
+		return "", fmt.Errorf("invalid serial %q", o.Serial)
+	}
+	if _, err := os.Stat(o.Output); err == nil {
+		return "", fmt.Errorf("%s already exists; remove it or choose another --output", o.Output)
+	}
+	for _, tool := range []string{"qemu-img", "virt-customize"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", fmt.Errorf("%s not found: install qemu-utils and guestfs-tools", tool)
+		}
+	}
+	if _, err := os.Stat(o.PublicKey); err != nil {
+		return "", fmt.Errorf("management public key: %w", err)
+	}
+	if err := os.MkdirAll(o.CacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("create cache dir: %w", err)
+	}
+
+	src, url, sum, err := fetchCloudImage(ctx, o, w)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.Output), 0o755); err != nil {
+		return "", fmt.Errorf("create output dir: %w", err)
+	}
+	tmp := o.Output + ".build"
+	defer os.Remove(tmp)
+	if err := run(ctx, w, "qemu-img", "convert", "-O", "qcow2", src, tmp); err != nil {
+		return "", err
+	}
+	if err := run(ctx, w, "qemu-img", "resize", tmp, fmt.Sprintf("%dG", o.SizeGB)); err != nil {
+		return "", err
+	}
+
+	script, err := os.CreateTemp("", "qudata-provision-*.sh")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(script.Name())
+	_, err = script.Write(provisionScript)
+	if cerr := script.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("write provisioning script: %w", err)
+	}
+
+	env := fmt.Sprintf("NVIDIA_DRIVER=%s NVIDIA_TOOLKIT=%s CLOUD_IMAGE=%s CLOUD_SHA256=%s",
+		shellQuote(o.Driver), shellQuote(o.Toolkit), shellQuote(url), sum)
+	args := []string{"-a", tmp, "--memsize", "2048",
+		"--upload", script.Name() + ":/root/provision.sh",
+		"--run-command", env + " sh /root/provision.sh",
+		"--delete", "/root/provision.sh",
+		"--ssh-inject", "root:file:" + o.PublicKey,
+	}
+	if o.Script != "" {
+		args = append(args, "--run", o.Script)
+	}
+	fmt.Fprintln(w, "provisioning")
+	if err := run(ctx, w, "virt-customize", args...); err != nil {
+		return "", err
+	}
+
+	digest, err := fileSHA256(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, o.Output); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// fetchCloudImage downloads the cloud image into the cache unless a copy
+// matching the release checksums is there already, and returns its path,
+// URL and digest.
+func fetchCloudImage(ctx context.Context, o Options, w io.Writer) (path, url, digest string, err error) {
+	dir := "release"
+	if o.Serial != "" {
+		dir += "-" + o.Serial
+	}
+	base := fmt.Sprintf("%s/%s/%s", cloudImageURL, o.Release, dir)
+	name := fmt.Sprintf("ubuntu-%s-server-cloudimg-amd64.img", o.Release)
+	url = base + "/" + name
+
+	sums, err := fetch(ctx, base+"/SHA256SUMS")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer sums.Close()
+	var want string
+	scanner := bufio.NewScanner(sums)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			want = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", "", fmt.Errorf("read checksums: %w", err)
+	}
+	if want == "" {
+		return "", "", "", fmt.Errorf("%s is not listed in %s/SHA256SUMS", name, base)
+	}
+
+	// Cached under the digest, since the latest release keeps its file name.
+	path = filepath.Join(o.CacheDir, want+".img")
+	if got, err := fileSHA256(path); err == nil && got == want {
+		fmt.Fprintf(w, "using cached %s (%s)\n", url, want)
+		return path, url, want, nil
+	}
+
+	fmt.Fprintf(w, "downloading %s\n", url)
+	body, err := fetch(ctx, url)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp(o.CacheDir, ".download-*")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", "", "", fmt.Errorf("download cloud image: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return "", "", "", fmt.Errorf("cloud image checksum mismatch: got %s, want %s", got, want)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", "", "", err
+	}
+	return path, url, want, nil
+}
+
+func fetch(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// run runs a command with its output going to w. libguestfs launches its
+// appliance directly rather than through libvirt, which hosts usually lack.
+func run(ctx context.Context, w io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if os.Getenv("LIBGUESTFS_BACKEND") == "" {
+		cmd.Env = append(os.Environ(), "LIBGUESTFS_BACKEND=direct")
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,83 @@
+#!/bin/sh
+# Provisions the qudata base image. `qudata-agent build-image` runs it with
+# virt-customize inside the Ubuntu cloud image, with NVIDIA_DRIVER set to the
+# driver branch, NVIDIA_TOOLKIT to the container toolkit version (empty for
+# the latest) and CLOUD_IMAGE/CLOUD_SHA256 describing the source image.
+set -eu
+export DEBIAN_FRONTEND=noninteractive
+
+apt-get update
+# Precompiled kernel modules instead of DKMS: the build never boots the
+# image, so there is no running kernel to build against.
+apt-get install -y --no-install-recommends \
+	linux-generic \
+	"linux-modules-nvidia-${NVIDIA_DRIVER}-server-generic" \
+	"nvidia-headless-no-dkms-${NVIDIA_DRIVER}-server" \
+	"nvidia-utils-${NVIDIA_DRIVER}-server" \
+	docker.io docker-compose-v2 \
+	openssh-server jq util-linux curl ca-certificates gnupg
+
+curl -fsSL https://nvidia.github.io/libnvidia-container/gpgkey |
+	gpg --dearmor -o /usr/share/keyrings/nvidia-container-toolkit.gpg
+curl -fsSL https://nvidia.github.io/libnvidia-container/stable/deb/nvidia-container-toolkit.list |
+	sed 's#deb https://#deb [signed-by=/usr/share/keyrings/nvidia-container-toolkit.gpg] https://#' \
+		>/etc/apt/sources.list.d/nvidia-container-toolkit.list
+apt-get update
+if [ -n "$NVIDIA_TOOLKIT" ]; then
+	apt-get install -y --no-install-recommends "nvidia-container-toolkit=${NVIDIA_TOOLKIT}*"
+else
+	apt-get install -y --no-install-recommends nvidia-container-toolkit
+fi
+nvidia-ctk runtime configure --runtime=docker
+systemctl enable docker
+
+# The agent logs in as root with the management key and switches password
+# logins on and off in sshd_config; a drop-in would override it.
+rm -f /etc/ssh/sshd_config.d/60-cloudimg-settings.conf
+sed -i 's/^#*PermitRootLogin.*/PermitRootLogin yes/' /etc/ssh/sshd_config
+systemctl enable ssh
+
+# The image is never booted during the build, so each instance generates
+# its own host keys on first boot.
+cat >/etc/systemd/system/qudata-ssh-hostkeys.service <<'EOF'
+[Unit]
+Description=Generate SSH host keys
+Before=ssh.service ssh.socket
+ConditionPathExists=!/etc/ssh/ssh_host_ed25519_key
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/ssh-keygen -A
+
+[Install]
+WantedBy=multi-user.target
+EOF
+systemctl enable qudata-ssh-hostkeys.service
+
+# There is no metadata service: DHCP on whatever the NIC is named instead of
+# cloud-init. The agent grows the root partition itself.
+rm -f /etc/netplan/*.yaml /etc/systemd/network/[0-8]*.network
+mkdir -p /etc/systemd/network /etc/systemd/system/systemd-networkd-wait-online.service.d
+printf '[Match]\nName=en*\n\n[Network]\nDHCP=yes\n' >/etc/systemd/network/99-dhcp-all.network
+printf '[Service]\nExecStart=\nExecStart=/lib/systemd/systemd-networkd-wait-online --any --timeout=10\n' \
+	>/etc/systemd/system/systemd-networkd-wait-online.service.d/any.conf
+systemctl enable systemd-networkd
+touch /etc/cloud/cloud-init.disabled
+
+# Faster boots, and no apt runs holding the dpkg lock behind the user's back.
+systemctl disable apt-daily.timer apt-daily-upgrade.timer man-db.timer unattended-upgrades.service || true
+systemctl mask snapd.service snapd.socket || true
+
+mkdir -p /usr/share/qudata
+{
+	echo "cloud_image=${CLOUD_IMAGE}"
+	echo "cloud_sha256=${CLOUD_SHA256}"
+	echo "nvidia_driver=${NVIDIA_DRIVER}"
+} >/usr/share/qudata/image-build
+dpkg-query -W >/usr/share/qudata/packages
+
+apt-get clean
+rm -rf /var/lib/apt/lists/*
+cloud-init clean --logs || true
+truncate -s 0 /etc/machine-id
+rm -f /var/lib/dbus/machine-id
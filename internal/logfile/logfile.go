@@ -0,0 +1,296 @@
+// Package logfile rotates log files by size and age, compresses the rotated
+// copies and prunes them by count and age.
+//
+// The agent's own log is written through a Writer. Logs written by child
+// processes (frpc, QEMU) stay open in those processes, which survive an agent
+// re-exec, so they are rotated in place by a Rotator: the file is copied to
+// the backup and truncated, which requires the child to have it open with
+// O_APPEND.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the timestamp suffix of a rotated file: agent.log becomes
+// agent.log.20060102-150405.000, then agent.log.20060102-150405.000.gz.
+const backupLayout = "20060102-150405.000"
+
+// Options are the rotation and retention limits. Zero disables a limit.
+type Options struct {
+	// MaxSizeMB rotates a file once it grows past this size.
+	MaxSizeMB int
+	// Period rotates a file once it has been written to for this long.
+	Period time.Duration
+	// MaxBackups is how many rotated files are kept.
+	MaxBackups int
+	// MaxAge removes rotated files older than this.
+	MaxAge time.Duration
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+func (o Options) due(size int64, since time.Time) bool {
+	if o.MaxSizeMB > 0 && size >= int64(o.MaxSizeMB)<<20 {
+		return true
+	}
+	return o.Period > 0 && size > 0 && time.Since(since) >= o.Period
+}
+
+// OpenAppend opens path for a child process to log to, creating it if needed.
+// O_APPEND keeps the child writing at the end after a Rotator truncates it.
+func OpenAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// Writer is an io.Writer to a log file that rotates itself.
+type Writer struct {
+	path string
+	opts Options
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	since time.Time
+}
+
+// Open opens the log at path for appending.
+func Open(path string, opts Options) (*Writer, error) {
+	w := &Writer{path: path, opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	prune(path, opts)
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := OpenAppend(w.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size, w.since = f, info.Size(), time.Now()
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opts.due(w.size+int64(len(p)), w.since) && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "rotate %s: %v\n", w.path, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) rotate() error {
+	backup := backupName(w.path)
+	if err := os.Rename(w.path, backup); err != nil {
+		// Try again after another full period or size rather than on
+		// every write.
+		w.size, w.since = 0, time.Now()
+		return err
+	}
+	old := w.file
+	if err := w.open(); err != nil {
+		// Renamed but not reopened: the old descriptor still works.
+		return err
+	}
+	old.Close()
+	go finish(w.path, backup, w.opts)
+	return nil
+}
+
+// Close closes the current file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Rotator rotates logs that other processes write to. It remembers when it
+// first saw each file, the base for Options.Period.
+type Rotator struct {
+	opts  Options
+	since map[string]time.Time
+}
+
+func NewRotator(opts Options) *Rotator {
+	return &Rotator{opts: opts, since: make(map[string]time.Time)}
+}
+
+// Check rotates path if it is due. A missing file is not an error.
+func (r *Rotator) Check(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(r.since, path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	since, ok := r.since[path]
+	if !ok {
+		since = time.Now()
+		r.since[path] = since
+	}
+	if !r.opts.due(info.Size(), since) {
+		return nil
+	}
+	r.since[path] = time.Now()
+
+	backup := backupName(path)
+	if err := copyTruncate(path, backup); err != nil {
+		return fmt.Errorf("rotate %s: %w", path, err)
+	}
+	finish(path, backup, r.opts)
+	return nil
+}
+
+// CheckAll checks every path and forgets the files it is no longer given,
+// e.g. the log of a VM that is gone.
+func (r *Rotator) CheckAll(paths []string) error {
+	seen := make(map[string]bool, len(paths))
+	var errs []error
+	for _, path := range paths {
+		seen[path] = true
+		if err := r.Check(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for path := range r.since {
+		if !seen[path] {
+			delete(r.since, path)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// copyTruncate copies path to backup and truncates path. Lines written
+// between the copy and the truncate are lost; that is the price of rotating
+// a file another process keeps open.
+func copyTruncate(path, backup string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(backup, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(backup)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(backup)
+		return err
+	}
+	return os.Truncate(path, 0)
+}
+
+// RemoveAll removes path and its rotated copies.
+func RemoveAll(path string) {
+	_ = os.Remove(path)
+	for _, b := range backups(path) {
+		_ = os.Remove(b)
+	}
+}
+
+func backupName(path string) string {
+	return path + "." + time.Now().Format(backupLayout)
+}
+
+// finish compresses a fresh backup and prunes the old ones.
+func finish(path, backup string, opts Options) {
+	if opts.Compress {
+		if err := compress(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "compress %s: %v\n", backup, err)
+		}
+	}
+	prune(path, opts)
+}
+
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// backups lists the rotated copies of path, oldest first.
+func backups(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var out []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if len(suffix) >= len(backupLayout) {
+			if _, err := time.ParseInLocation(backupLayout, suffix[:len(backupLayout)], time.Local); err == nil {
+				out = append(out, m)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// prune removes the backups of path beyond MaxBackups or older than MaxAge.
+func prune(path string, opts Options) {
+	list := backups(path)
+	if opts.MaxBackups > 0 && len(list) > opts.MaxBackups {
+		for _, b := range list[:len(list)-opts.MaxBackups] {
+			_ = os.Remove(b)
+		}
+		list = list[len(list)-opts.MaxBackups:]
+	}
+	if opts.MaxAge <= 0 {
+		return
+	}
+	for _, b := range list {
+		if info, err := os.Stat(b); err == nil && time.Since(info.ModTime()) > opts.MaxAge {
+			_ = os.Remove(b)
+		}
+	}
+}
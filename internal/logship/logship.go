@@ -0,0 +1,266 @@
+// Package logship ships the agent's warnings and errors to the Qudata API,
+// so that a host can be debugged without logging in to it. Records are
+// redacted, rate limited and sent in batches; what cannot be sent in time is
+// dropped and counted rather than held back.
+package logship
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/qudata"
+)
+
+const (
+	// maxBuffered bounds the records waiting for the API.
+	maxBuffered = 1000
+	// maxBatch is the most records sent at once.
+	maxBatch = 100
+	// ratePerMinute is how many records are shipped per minute at most;
+	// a burst of that size is allowed.
+	ratePerMinute = 120
+
+	flushInterval = 10 * time.Second
+	sendTimeout   = 30 * time.Second
+)
+
+// SendFunc delivers one batch.
+type SendFunc func(ctx context.Context, batch domain.LogBatch) error
+
+// Shipper collects records from a Handler and sends them.
+type Shipper struct {
+	send   SendFunc
+	level  slog.Level
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	buf     []domain.LogRecord
+	dropped int
+	tokens  float64
+	refill  time.Time
+	wake    chan struct{}
+}
+
+// New returns a shipper for records at level and above. logger reports the
+// shipper's own failures and must not ship to it.
+func New(send SendFunc, level slog.Level, logger *slog.Logger) *Shipper {
+	return &Shipper{
+		send:   send,
+		level:  level,
+		logger: logger,
+		tokens: ratePerMinute,
+		refill: time.Now(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Handler returns next with every record at the shipper's level or above
+// also queued for shipping.
+func (s *Shipper) Handler(next slog.Handler) slog.Handler {
+	return &handler{next: next, s: s}
+}
+
+// add queues rec if the rate limit allows it.
+func (s *Shipper) add(rec domain.LogRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens = min(ratePerMinute, s.tokens+now.Sub(s.refill).Minutes()*ratePerMinute)
+	s.refill = now
+	if s.tokens < 1 || len(s.buf) >= maxBuffered {
+		s.dropped++
+		return
+	}
+	s.tokens--
+	s.buf = append(s.buf, rec)
+	if len(s.buf) >= maxBatch {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run sends the queued records until ctx is cancelled, then makes a last
+// attempt to send what is left.
+func (s *Shipper) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		s.flush(ctx)
+	}
+}
+
+// flush sends the queued records batch by batch. A batch that fails stays
+// queued for the next flush, unless the API refused it.
+func (s *Shipper) flush(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		n := min(len(s.buf), maxBatch)
+		if n == 0 && s.dropped == 0 {
+			s.mu.Unlock()
+			return
+		}
+		batch := domain.LogBatch{Records: append([]domain.LogRecord(nil), s.buf[:n]...), Dropped: s.dropped}
+		s.mu.Unlock()
+
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := s.send(sendCtx, batch)
+		cancel()
+		if err != nil && !qudata.Rejected(err) {
+			s.logger.Debug("log shipping failed, will retry", "records", n, "err", err)
+			return
+		}
+		if err != nil {
+			s.logger.Warn("API rejected shipped logs, dropping them", "records", n, "err", err)
+		}
+
+		s.mu.Lock()
+		s.buf = s.buf[n:]
+		s.dropped -= batch.Dropped
+		s.mu.Unlock()
+	}
+}
+
+type handler struct {
+	next   slog.Handler
+	s      *Shipper
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *handler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.s.level || h.next.Enabled(ctx, l)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.s.level {
+		rec := domain.LogRecord{
+			Time:    r.Time.UTC(),
+			Level:   r.Level.String(),
+			Message: Redact(r.Message),
+		}
+		attrs := make(map[string]any)
+		for _, a := range h.attrs {
+			addAttr(attrs, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addAttr(attrs, h.prefix, a)
+			return true
+		})
+		if len(attrs) > 0 {
+			rec.Attrs = attrs
+		}
+		h.s.add(rec)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	c.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// addAttr flattens a into m, groups as dotted keys, redacting secrets.
+func addAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	key := prefix + a.Key
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			addAttr(m, key+".", g)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	if secretKey(a.Key) {
+		m[key] = redacted
+		return
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		m[key] = Redact(v.String())
+	case slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+		m[key] = v.Any()
+	case slog.KindDuration:
+		m[key] = v.Duration().String()
+	case slog.KindTime:
+		m[key] = v.Time().UTC()
+	default:
+		m[key] = Redact(fmt.Sprint(v.Any()))
+	}
+}
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute key fragments whose values are never shipped.
+var secretKeys = []string{"secret", "token", "password", "passwd", "private", "authorization", "cookie", "api_key", "apikey", "credential"}
+
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretPatterns match secrets inside free text: Qudata API keys and agent
+// secrets, bearer tokens, URL credentials, signature or token query
+// parameters and JSON fields named like secretKeys.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)("[\w.-]*(?:` + strings.Join(secretKeys, "|") + `|disk_key)[\w.-]*"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + redacted + `"`},
+	{regexp.MustCompile(`\b(ak|sk)-[A-Za-z0-9_-]{6,}`), "$1-" + redacted},
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`), "$1 " + redacted},
+	{regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`), "://" + redacted + "@"},
+	{regexp.MustCompile(`(?i)([?&](?:sig|signature|token|access_token|x-amz-signature|x-amz-credential)=)[^&\s"]+`), "${1}" + redacted},
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), redacted},
+}
+
+// Redact masks the secrets secretPatterns find in s.
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
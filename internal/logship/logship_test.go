@@ -0,0 +1,47 @@
+package logship
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactJSONFields(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{
+			`body={"image":"app","password":"hunter2","login":"acme"}`,
+			`body={"image":"app","password":"[REDACTED]","login":"acme"}`,
+		},
+		{
+			`{"tunnel_token" : "t0k\"en", "disk_key":"c2VjcmV0"}`,
+			`{"tunnel_token" : "[REDACTED]", "disk_key":"[REDACTED]"}`,
+		},
+		{
+			`{"env_variables":{"HF_TOKEN":"hf_abc","MODEL":"llama"}}`,
+			`{"env_variables":{"HF_TOKEN":"[REDACTED]","MODEL":"llama"}}`,
+		},
+		{
+			`{"Password": "x", "token_count": 3}`,
+			`{"Password": "[REDACTED]", "token_count": 3}`,
+		},
+	} {
+		if got := Redact(tc.in); got != tc.want {
+			t.Errorf("Redact(%s)\n got %s\nwant %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRedactKeepsPlainText(t *testing.T) {
+	in := `password login disabled; token bucket refilled`
+	if got := Redact(in); got != in {
+		t.Errorf("Redact(%q) = %q", in, got)
+	}
+}
+
+func TestRedactAPIKey(t *testing.T) {
+	got := Redact("register failed for ak-0123456789abcdef")
+	if strings.Contains(got, "0123456789abcdef") {
+		t.Errorf("API key not redacted: %s", got)
+	}
+}
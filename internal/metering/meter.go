@@ -0,0 +1,154 @@
+// Package metering accumulates per-instance runtime, GPU-seconds, GPU energy
+// and network bytes for billing.
+package metering
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/storage"
+)
+
+// maxGap is the longest interval between samples that is still billed.
+// Time the agent was not watching, e.g. across a restart, is not.
+const maxGap = 2 * time.Minute
+
+// Sample is one observation of the host's instance.
+type Sample struct {
+	VMID string
+	// Billable tells whether the instance currently holds its resources.
+	Billable bool
+	GPUs     int
+	// NetOK is false when no network counters are available.
+	NetOK bool
+	RxRaw uint64
+	TxRaw uint64
+	// PowerW is the GPU power draw, taken to hold until the next sample.
+	PowerW float64
+}
+
+// Meter turns samples into cumulative usage and persists it so that totals
+// survive agent restarts.
+type Meter struct {
+	store *storage.Store
+
+	mu    sync.Mutex
+	state domain.UsageState
+}
+
+// NewMeter loads persisted usage.
+func NewMeter(store *storage.Store) (*Meter, error) {
+	st, err := store.LoadUsage()
+	if err != nil {
+		return nil, fmt.Errorf("load usage state: %w", err)
+	}
+	m := &Meter{store: store}
+	if st != nil {
+		m.state = *st
+	}
+	return m, nil
+}
+
+// Observe accounts for the time and traffic since the previous sample.
+func (m *Meter) Observe(s Sample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	var dt time.Duration
+	if last := m.state.LastSample; !last.IsZero() {
+		if d := now.Sub(last); d > 0 && d <= maxGap {
+			dt = d
+		}
+	}
+
+	open := m.openLocked()
+	if open != nil && open.VMID != s.VMID {
+		end := now
+		if !m.state.LastSample.IsZero() {
+			end = m.state.LastSample
+		}
+		open.End = &end
+		open = nil
+	}
+	if open == nil && s.VMID != "" {
+		m.state.Instances = append(m.state.Instances, domain.InstanceUsage{VMID: s.VMID, Start: now})
+		open = &m.state.Instances[len(m.state.Instances)-1]
+		// Counters start from zero with the instance's network policy.
+		m.state.LastRx, m.state.LastTx = 0, 0
+	}
+
+	if open != nil {
+		if s.Billable {
+			open.RuntimeSeconds += dt.Seconds()
+			open.GPUSeconds += dt.Seconds() * float64(s.GPUs)
+			open.EnergyWh += dt.Hours() * s.PowerW
+		}
+		open.GPUCount = max(open.GPUCount, s.GPUs)
+		if s.NetOK {
+			open.RxBytes += counterDelta(s.RxRaw, m.state.LastRx)
+			open.TxBytes += counterDelta(s.TxRaw, m.state.LastTx)
+			m.state.LastRx, m.state.LastTx = s.RxRaw, s.TxRaw
+		}
+	}
+
+	m.state.LastSample = now
+	return m.saveLocked()
+}
+
+// Report returns the usage of the current instance and of ended instances
+// not yet acknowledged.
+func (m *Meter) Report() domain.UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return domain.UsageReport{
+		Time:      time.Now().UTC(),
+		Instances: append([]domain.InstanceUsage(nil), m.state.Instances...),
+	}
+}
+
+// Ack drops ended instances whose final totals were delivered in r.
+func (m *Meter) Ack(r domain.UsageReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := make(map[string]domain.InstanceUsage, len(r.Instances))
+	for _, u := range r.Instances {
+		sent[u.VMID] = u
+	}
+	kept := m.state.Instances[:0]
+	for _, u := range m.state.Instances {
+		// An instance is final once ended, so a report that already carried
+		// its end delivered the final totals.
+		if s, ok := sent[u.VMID]; ok && s.End != nil {
+			continue
+		}
+		kept = append(kept, u)
+	}
+	m.state.Instances = kept
+	return m.saveLocked()
+}
+
+func (m *Meter) openLocked() *domain.InstanceUsage {
+	for i := range m.state.Instances {
+		if m.state.Instances[i].End == nil {
+			return &m.state.Instances[i]
+		}
+	}
+	return nil
+}
+
+func (m *Meter) saveLocked() error {
+	return m.store.SaveUsage(&m.state)
+}
+
+// counterDelta returns the growth of a cumulative counter, treating a
+// decrease as a reset to zero.
+func counterDelta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qudata/agent/internal/system"
+)
+
+// hostCollector samples host CPU, memory, KSM and network counters on each
+// scrape.
+type hostCollector struct {
+	cpuUtil         *prometheus.Desc
+	memUtil         *prometheus.Desc
+	memTotal        *prometheus.Desc
+	ksmPagesShared  *prometheus.Desc
+	ksmPagesSharing *prometheus.Desc
+	netRx           *prometheus.Desc
+	netTx           *prometheus.Desc
+
+	mu      sync.Mutex
+	lastCPU system.CPUTimes
+}
+
+func newHostCollector() *hostCollector {
+	return &hostCollector{
+		cpuUtil: prometheus.NewDesc(namespace+"_host_cpu_utilization_percent",
+			"Host CPU utilization since the previous scrape.", nil, nil),
+		memUtil: prometheus.NewDesc(namespace+"_host_memory_utilization_percent",
+			"Host memory utilization (total minus available).", nil, nil),
+		memTotal: prometheus.NewDesc(namespace+"_host_memory_total_bytes",
+			"Host physical memory.", nil, nil),
+		ksmPagesShared: prometheus.NewDesc(namespace+"_host_ksm_pages_shared",
+			"Merged pages KSM keeps, while it runs.", nil, nil),
+		ksmPagesSharing: prometheus.NewDesc(namespace+"_host_ksm_pages_sharing",
+			"Pages KSM has merged into the shared ones, that is the pages saved.", nil, nil),
+		netRx: prometheus.NewDesc(namespace+"_host_network_receive_bytes_total",
+			"Bytes received per host interface.", []string{"interface"}, nil),
+		netTx: prometheus.NewDesc(namespace+"_host_network_transmit_bytes_total",
+			"Bytes transmitted per host interface.", []string{"interface"}, nil),
+	}
+}
+
+func (c *hostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuUtil
+	ch <- c.memUtil
+	ch <- c.memTotal
+	ch <- c.ksmPagesShared
+	ch <- c.ksmPagesSharing
+	ch <- c.netRx
+	ch <- c.netTx
+}
+
+func (c *hostCollector) Collect(ch chan<- prometheus.Metric) {
+	if cur, err := system.ReadCPUTimes(); err == nil {
+		c.mu.Lock()
+		util := cur.UtilizationSince(c.lastCPU)
+		c.lastCPU = cur
+		c.mu.Unlock()
+		ch <- prometheus.MustNewConstMetric(c.cpuUtil, prometheus.GaugeValue, util)
+	}
+
+	if mem, err := system.ReadMemory(); err == nil && mem.TotalBytes > 0 {
+		used := float64(mem.TotalBytes-mem.AvailableBytes) / float64(mem.TotalBytes) * 100
+		ch <- prometheus.MustNewConstMetric(c.memUtil, prometheus.GaugeValue, used)
+		ch <- prometheus.MustNewConstMetric(c.memTotal, prometheus.GaugeValue, float64(mem.TotalBytes))
+	}
+
+	if ksm, err := system.ReadKSM(); err == nil && ksm != nil {
+		ch <- prometheus.MustNewConstMetric(c.ksmPagesShared, prometheus.GaugeValue, float64(ksm.PagesShared))
+		ch <- prometheus.MustNewConstMetric(c.ksmPagesSharing, prometheus.GaugeValue, float64(ksm.PagesSharing))
+	}
+
+	if ifaces, err := system.ReadNetCounters(); err == nil {
+		for _, iface := range ifaces {
+			ch <- prometheus.MustNewConstMetric(c.netRx, prometheus.CounterValue, float64(iface.RxBytes), iface.Name)
+			ch <- prometheus.MustNewConstMetric(c.netTx, prometheus.CounterValue, float64(iface.TxBytes), iface.Name)
+		}
+	}
+}
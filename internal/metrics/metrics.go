@@ -0,0 +1,301 @@
+// Package metrics exposes agent and instance metrics in Prometheus format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const namespace = "qudata"
+
+// Registry holds every agent collector. A private registry keeps the output
+// free of collectors registered by third-party packages.
+var Registry = prometheus.NewRegistry()
+
+var (
+	GPUUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_utilization_percent",
+		Help: "GPU utilization reported by the guest.",
+	})
+	GPUTemperature = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_temperature_celsius",
+		Help: "GPU temperature reported by the guest.",
+	})
+	GPUMemoryUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_memory_utilization_percent",
+		Help: "GPU VRAM utilization reported by the guest.",
+	})
+	CPUUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "cpu_utilization_percent",
+		Help: "Guest CPU utilization.",
+	})
+	RAMUtilization = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "ram_utilization_percent",
+		Help: "Guest RAM utilization.",
+	})
+	GPUPower = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_power_watts",
+		Help: "Power draw of the guest GPUs.",
+	})
+	GPUPowerLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_power_limit_watts",
+		Help: "Sum of the power limits of the guest GPUs.",
+	})
+	GPUSMOccupancy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_sm_occupancy_ratio",
+		Help: "Average SM occupancy of the guest GPUs, from DCGM.",
+	})
+	GPUNVLinkThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_nvlink_bytes_per_second",
+		Help: "NVLink throughput of the guest GPUs, from DCGM.",
+	}, []string{"direction"})
+	GPUPCIeThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_pcie_bytes_per_second",
+		Help: "PCIe throughput of the guest GPUs, from DCGM.",
+	}, []string{"direction"})
+	GPUECCErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_ecc_errors",
+		Help: "ECC errors of the guest GPUs since the driver loaded, from DCGM.",
+	}, []string{"type"})
+	GPURetiredPages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_retired_pages",
+		Help: "GPU memory pages retired for ECC errors, from DCGM.",
+	}, []string{"cause"})
+	DiskThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "disk_bytes_per_second",
+		Help: "Read and write throughput of the instance disks, from QMP.",
+	}, []string{"direction"})
+	DiskOps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "disk_ops_per_second",
+		Help: "Read and write operations of the instance disks, from QMP.",
+	}, []string{"direction"})
+	DiskAllocated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "disk_allocated_bytes",
+		Help: "Size of the instance disks as the guest sees them.",
+	})
+	DiskUsed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "disk_used_bytes",
+		Help: "Host space taken by the qcow2 images of the instance disks.",
+	})
+	NetThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "network_bytes_per_second",
+		Help: "Traffic of the instance, counted by its network policy.",
+	}, []string{"direction"})
+	GPUThermalActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "gpu_thermal_actions_total",
+		Help: "Times the thermal watchdog throttled or paused the instance.",
+	}, []string{"action"})
+	InstanceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "instance", Name: "status",
+		Help: "Current instance status; the series for the active status is 1.",
+	}, []string{"status", "reason"})
+
+	ClockOffset = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "host", Name: "clock_offset_seconds",
+		Help: "Offset of the NTP reference clock relative to the host clock.",
+	})
+	ClockCheckErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "host", Name: "clock_check_errors_total",
+		Help: "Failed NTP offset measurements.",
+	})
+
+	ImageDiskUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "images", Name: "disk_usage_percent",
+		Help: "Usage of the filesystem holding the image directory.",
+	})
+	ImageGCReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "images", Name: "gc_reclaimed_bytes_total",
+		Help: "Bytes freed by image garbage collection.",
+	})
+	ImageGCRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "images", Name: "gc_removed_total",
+		Help: "Image files removed by garbage collection.",
+	})
+	GuestTrimmed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "images", Name: "guest_trimmed_bytes_total",
+		Help: "Bytes the guest discarded in periodic fstrim runs.",
+	})
+
+	StatsBuffered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "stats", Name: "buffered",
+		Help: "Stats reports held back while the API is unreachable.",
+	})
+	StatsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "stats", Name: "dropped_total",
+		Help: "Buffered stats reports dropped for age, space or rejection.",
+	})
+
+	FRPCUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "frpc", Name: "up",
+		Help: "Whether the frpc tunnel process is running.",
+	})
+	FRPCRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "frpc", Name: "restarts_total",
+		Help: "Number of frpc process (re)starts.",
+	})
+	TunnelUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "tunnel", Name: "up",
+		Help: "Whether the tunnel and every proxy over it are up.",
+	})
+	FRPCFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "frpc", Name: "failovers_total",
+		Help: "Number of switches to the next frps server.",
+	})
+	FRPCReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "frpc", Name: "reloads_total",
+		Help: "Number of frpc proxy reloads through its admin API.",
+	})
+
+	RegistryCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "registry_cache", Name: "requests_total",
+		Help: "Pulls served by the registry cache, by kind (manifest, blob) and result (hit, miss, stale).",
+	}, []string{"kind", "result"})
+	RegistryCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "registry_cache", Name: "bytes",
+		Help: "Size of the content held by the registry cache.",
+	})
+
+	Panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "agent", Name: "panics_total",
+		Help: "Panics recovered in the agent, by goroutine.",
+	}, []string{"where"})
+
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "api", Name: "requests_total",
+		Help: "Requests made to the Qudata API by path and status code.",
+	}, []string{"path", "code"})
+	APIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "api", Name: "errors_total",
+		Help: "Failed requests to the Qudata API (transport errors and non-2xx responses).",
+	}, []string{"path"})
+)
+
+func init() {
+	Registry.MustRegister(
+		GPUUtilization,
+		GPUTemperature,
+		GPUMemoryUtilization,
+		CPUUtilization,
+		RAMUtilization,
+		GPUPower,
+		GPUPowerLimit,
+		GPUSMOccupancy,
+		GPUNVLinkThroughput,
+		GPUPCIeThroughput,
+		GPUECCErrors,
+		GPURetiredPages,
+		DiskThroughput,
+		DiskOps,
+		DiskAllocated,
+		DiskUsed,
+		NetThroughput,
+		GPUThermalActions,
+		InstanceStatus,
+		ClockOffset,
+		ClockCheckErrors,
+		ImageDiskUsage,
+		ImageGCReclaimed,
+		ImageGCRemoved,
+		GuestTrimmed,
+		StatsBuffered,
+		StatsDropped,
+		FRPCUp,
+		FRPCRestarts,
+		FRPCReloads,
+		FRPCFailovers,
+		TunnelUp,
+		RegistryCacheRequests,
+		RegistryCacheBytes,
+		Panics,
+		APIRequests,
+		APIErrors,
+		newHostCollector(),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveStats updates the instance gauges from a stats report.
+func ObserveStats(report domain.StatsReport) {
+	InstanceStatus.Reset()
+	InstanceStatus.WithLabelValues(string(report.Status), string(report.StatusReason)).Set(1)
+
+	GPUUtilization.Set(report.GPUUtil)
+	GPUTemperature.Set(float64(report.GPUTemp))
+	GPUMemoryUtilization.Set(report.MemUtil)
+	CPUUtilization.Set(report.CPUUtil)
+	RAMUtilization.Set(report.RAMUtil)
+	GPUPower.Set(report.GPUPower)
+	GPUPowerLimit.Set(report.GPUPowerLimit)
+	observeDCGM(report.DCGM)
+	observeDisk(report.Disk)
+	if report.Net != nil {
+		NetThroughput.WithLabelValues("rx").Set(report.Net.RxBytesPerSec)
+		NetThroughput.WithLabelValues("tx").Set(report.Net.TxBytesPerSec)
+	} else {
+		NetThroughput.Reset()
+	}
+}
+
+// observeDisk publishes the disk I/O and size, or removes them when QMP did
+// not report any.
+func observeDisk(d *domain.DiskStats) {
+	if d == nil {
+		DiskThroughput.Reset()
+		DiskOps.Reset()
+		DiskAllocated.Set(0)
+		DiskUsed.Set(0)
+		return
+	}
+	DiskThroughput.WithLabelValues("read").Set(d.ReadBytesPerSec)
+	DiskThroughput.WithLabelValues("write").Set(d.WriteBytesPerSec)
+	DiskOps.WithLabelValues("read").Set(d.ReadOpsPerSec)
+	DiskOps.WithLabelValues("write").Set(d.WriteOpsPerSec)
+	DiskAllocated.Set(float64(d.AllocatedBytes))
+	DiskUsed.Set(float64(d.UsedBytes))
+}
+
+// observeDCGM publishes the DCGM telemetry, or removes it when the guest
+// does not report any.
+func observeDCGM(d *domain.DCGMStats) {
+	if d == nil {
+		GPUSMOccupancy.Set(0)
+		GPUNVLinkThroughput.Reset()
+		GPUPCIeThroughput.Reset()
+		GPUECCErrors.Reset()
+		GPURetiredPages.Reset()
+		return
+	}
+	GPUSMOccupancy.Set(d.SMOccupancy)
+	GPUNVLinkThroughput.WithLabelValues("rx").Set(d.NVLinkRxBytes)
+	GPUNVLinkThroughput.WithLabelValues("tx").Set(d.NVLinkTxBytes)
+	GPUPCIeThroughput.WithLabelValues("rx").Set(d.PCIeRxBytes)
+	GPUPCIeThroughput.WithLabelValues("tx").Set(d.PCIeTxBytes)
+	GPUECCErrors.WithLabelValues("sbe").Set(float64(d.ECCSingleBit))
+	GPUECCErrors.WithLabelValues("dbe").Set(float64(d.ECCDoubleBit))
+	GPURetiredPages.WithLabelValues("sbe").Set(float64(d.RetiredPagesSBE))
+	GPURetiredPages.WithLabelValues("dbe").Set(float64(d.RetiredPagesDBE))
+}
+
+// ObserveAPIRequest records the outcome of a Qudata API call. A zero code
+// means the request failed before a response was received.
+func ObserveAPIRequest(path string, code int) {
+	label := "error"
+	if code > 0 {
+		label = strconv.Itoa(code)
+	}
+	APIRequests.WithLabelValues(path, label).Inc()
+	if code < 200 || code >= 300 {
+		APIErrors.WithLabelValues(path).Inc()
+	}
+}
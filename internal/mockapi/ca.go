@@ -0,0 +1,130 @@
+package mockapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// mockCA signs agent API certificates and the client certificate used to
+// call an agent running with mutual TLS. It is generated per process.
+type mockCA struct {
+	once    sync.Once
+	err     error
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	clientCert []byte
+	clientKey  []byte
+}
+
+func (ca *mockCA) init() error {
+	ca.once.Do(func() {
+		ca.key, ca.err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if ca.err != nil {
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "qudata mock CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+		if err != nil {
+			ca.err = err
+			return
+		}
+		ca.cert, _ = x509.ParseCertificate(der)
+		ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+		clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			ca.err = err
+			return
+		}
+		ca.clientCert, ca.err = ca.sign(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "qudata mock control plane"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &clientKey.PublicKey)
+		if ca.err != nil {
+			return
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(clientKey)
+		ca.clientKey = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	})
+	return ca.err
+}
+
+func (ca *mockCA) sign(tmpl *x509.Certificate, pub any) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// issue answers an agent CSR with a server certificate and the client CA.
+func (ca *mockCA) issue(csrPEM string) (*domain.APITLS, error) {
+	if err := ca.init(); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return nil, fmt.Errorf("tls_csr is not PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse tls_csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("tls_csr signature: %w", err)
+	}
+	cert, err := ca.sign(&x509.Certificate{
+		Subject:     csr.Subject,
+		DNSNames:    csr.DNSNames,
+		IPAddresses: csr.IPAddresses,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.APITLS{Certificate: string(cert), ClientCA: string(ca.certPEM)}, nil
+}
+
+// getClientCert returns the PEM client certificate, key and CA for calling
+// an agent that runs with mutual TLS.
+func (s *Server) getClientCert(c *gin.Context) {
+	if err := s.ca.init(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"certificate": string(s.ca.clientCert),
+		"key":         string(s.ca.clientKey),
+		"ca":          string(s.ca.certPEM),
+	})
+}
@@ -0,0 +1,332 @@
+// Package mockapi is a local stand-in for the Qudata API used in development
+// and CI. It implements the endpoints the agent calls, with configurable
+// responses and fault injection.
+package mockapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/ugorji/go/codec"
+)
+
+// Fault describes how requests to one path misbehave.
+type Fault struct {
+	// Rate is the probability (0..1) that a request fails with Status.
+	Rate   float64 `json:"rate"`
+	Status int     `json:"status"`
+	// Latency is added to every request on the path, e.g. "500ms".
+	Latency string `json:"latency"`
+}
+
+// Config controls mock API responses. It can be loaded from a JSON file and
+// replaced at runtime via PUT /_mock/config.
+type Config struct {
+	Init   domain.InitAgentRespData `json:"init"`
+	Faults map[string]Fault         `json:"faults"` // keyed by path, e.g. "/stats"
+	// RequireAuth rejects requests without X-API-Key or X-Agent-Secret.
+	RequireAuth bool `json:"require_auth"`
+}
+
+// DefaultConfig returns a config that accepts a fresh agent.
+func DefaultConfig() Config {
+	return Config{
+		Init: domain.InitAgentRespData{
+			AgentCreated: true,
+			SecretKey:    "sk-mock-secret",
+			TunnelToken:  "mock-tunnel",
+		},
+		RequireAuth: true,
+	}
+}
+
+// LoadConfig reads a JSON config file on top of DefaultConfig.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read mock config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse mock config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Request is a recorded call, exposed via GET /_mock/requests for assertions.
+type Request struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+const maxRecorded = 1000
+
+type Server struct {
+	mu       sync.Mutex
+	cfg      Config
+	requests []Request
+	host     *domain.CreateHostRequest
+	ca       mockCA
+
+	logger *slog.Logger
+}
+
+func New(cfg Config, logger *slog.Logger) *Server {
+	return &Server{cfg: cfg, logger: logger}
+}
+
+// Handler returns the HTTP handler serving the mock API.
+func (s *Server) Handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	api := r.Group("/", s.record, s.faults, s.auth)
+	api.GET("/ping", s.ping)
+	api.POST("/init", s.initAgent)
+	api.POST("/init/host", s.initHost)
+	api.DELETE("/init", s.unregister)
+	api.PATCH("/init/host", s.accept)
+	api.GET("/nettest/download", s.nettestDownload)
+	api.POST("/nettest/upload", s.accept)
+	api.POST("/stats", s.accept)
+	api.POST("/stats/batch", s.accept)
+	api.POST("/events", s.accept)
+	api.POST("/logs", s.accept)
+	api.POST("/usage", s.accept)
+	api.POST("/heartbeat", s.heartbeat)
+	api.POST("/dns/challenge", s.accept)
+	api.DELETE("/dns/challenge", s.accept)
+
+	mock := r.Group("/_mock")
+	mock.GET("/config", s.getConfig)
+	mock.PUT("/config", s.putConfig)
+	mock.GET("/requests", s.getRequests)
+	mock.DELETE("/requests", s.resetRequests)
+	mock.GET("/client-cert", s.getClientCert)
+
+	return r
+}
+
+func (s *Server) config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// record stores every API call with its final status code.
+func (s *Server) record(c *gin.Context) {
+	body, _ := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(strings.NewReader(string(body)))
+
+	c.Next()
+
+	req := Request{
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Status: c.Writer.Status(),
+		Time:   time.Now().UTC(),
+	}
+	if c.ContentType() == "application/msgpack" {
+		req.Body = msgpackToJSON(body)
+	} else if json.Valid(body) {
+		req.Body = body
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	if len(s.requests) > maxRecorded {
+		s.requests = s.requests[len(s.requests)-maxRecorded:]
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("mock request", "method", req.Method, "path", req.Path, "status", req.Status)
+}
+
+func (s *Server) faults(c *gin.Context) {
+	f, ok := s.config().Faults[c.Request.URL.Path]
+	if !ok {
+		return
+	}
+	if f.Latency != "" {
+		if d, err := time.ParseDuration(f.Latency); err == nil {
+			time.Sleep(d)
+		}
+	}
+	if f.Rate > 0 && rand.Float64() < f.Rate {
+		status := f.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		c.AbortWithStatusJSON(status, gin.H{"ok": false, "error": "injected fault"})
+	}
+}
+
+func (s *Server) auth(c *gin.Context) {
+	if c.Request.URL.Path == "/ping" || !s.config().RequireAuth {
+		return
+	}
+	if c.GetHeader("X-API-Key") == "" && c.GetHeader("X-Agent-Secret") == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"ok": false, "error": "unauthorized"})
+	}
+}
+
+func (s *Server) ping(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (s *Server) initAgent(c *gin.Context) {
+	var req domain.InitAgentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	data := s.cfg.Init
+	if s.host != nil {
+		data.HostExists = true
+	}
+	s.mu.Unlock()
+
+	if req.TLSCSR != "" {
+		t, err := s.ca.issue(req.TLSCSR)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+			return
+		}
+		data.APITLS = t
+	}
+
+	c.JSON(http.StatusOK, domain.InitAgentResponse{OK: true, Data: data})
+}
+
+func (s *Server) initHost(c *gin.Context) {
+	var req domain.CreateHostRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	s.host = &req
+	s.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// msgpackToJSON converts a msgpack payload so it can be inspected through
+// /_mock/requests like JSON ones.
+func msgpackToJSON(body []byte) json.RawMessage {
+	var v map[string]interface{}
+	h := &codec.MsgpackHandle{}
+	h.RawToString = true
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	if err := codec.NewDecoderBytes(body, h).Decode(&v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (s *Server) accept(c *gin.Context) {
+	if _, err := io.ReadAll(c.Request.Body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// nettestDownload streams the requested number of zero bytes (at most 1 GiB).
+func (s *Server) nettestDownload(c *gin.Context) {
+	n, err := strconv.ParseInt(c.Query("bytes"), 10, 64)
+	if err != nil || n < 0 || n > 1<<30 {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "bytes must be in [0, 1GiB]"})
+		return
+	}
+	c.DataFromReader(http.StatusOK, n, "application/octet-stream", io.LimitReader(zeros{}, n), nil)
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// unregister forgets the registered host.
+func (s *Server) unregister(c *gin.Context) {
+	s.mu.Lock()
+	s.host = nil
+	s.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// heartbeat acknowledges every downtime interval it receives.
+func (s *Server) heartbeat(c *gin.Context) {
+	var hb domain.Heartbeat
+	if err := c.ShouldBindJSON(&hb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	var acked uint64
+	for _, iv := range hb.Intervals {
+		acked = max(acked, iv.Seq)
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": gin.H{"acked_seq": acked}})
+}
+
+func (s *Server) getConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": s.config()})
+}
+
+func (s *Server) putConfig(c *gin.Context) {
+	cfg := DefaultConfig()
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": cfg})
+}
+
+func (s *Server) getRequests(c *gin.Context) {
+	path := c.Query("path")
+	s.mu.Lock()
+	out := make([]Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		if path == "" || r.Path == path {
+			out = append(out, r)
+		}
+	}
+	s.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": out})
+}
+
+func (s *Server) resetRequests(c *gin.Context) {
+	s.mu.Lock()
+	s.requests = nil
+	s.host = nil
+	s.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
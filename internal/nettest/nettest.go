@@ -0,0 +1,207 @@
+// Package nettest measures latency and throughput from the host to the FRP
+// server and the Qudata API.
+package nettest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	latencySamples = 5
+	dialTimeout    = 5 * time.Second
+)
+
+// Target is an endpoint implementing the nettest protocol:
+// GET <BaseURL>/nettest/download?bytes=N streams N bytes and
+// POST <BaseURL>/nettest/upload discards the request body.
+type Target struct {
+	Name    string
+	BaseURL string
+	// Addr is the host:port probed for latency. Defaults to the BaseURL host.
+	Addr   string
+	Header http.Header
+}
+
+// Options bound a run.
+type Options struct {
+	// Duration is the total time budget, split evenly across the transfers.
+	Duration time.Duration
+	// MaxBytes caps each transfer.
+	MaxBytes int64
+}
+
+// Run measures every target in turn. Failures are recorded per target.
+func Run(ctx context.Context, targets []Target, opts Options) domain.NetTestResult {
+	phase := opts.Duration / time.Duration(2*max(len(targets), 1))
+	client := &http.Client{}
+
+	res := domain.NetTestResult{Time: time.Now().UTC()}
+	for _, t := range targets {
+		res.Targets = append(res.Targets, measure(ctx, client, t, phase, opts.MaxBytes))
+	}
+	return res
+}
+
+func measure(ctx context.Context, client *http.Client, t Target, phase time.Duration, maxBytes int64) domain.NetTestTarget {
+	out := domain.NetTestTarget{Name: t.Name, Address: t.Addr}
+	if out.Address == "" {
+		addr, err := hostPort(t.BaseURL)
+		if err != nil {
+			out.Error = err.Error()
+			return out
+		}
+		out.Address = addr
+	}
+
+	latency, err := probeLatency(ctx, out.Address)
+	if err != nil {
+		out.Error = fmt.Sprintf("latency: %v", err)
+		return out
+	}
+	out.LatencyMS = float64(latency.Microseconds()) / 1000
+
+	if out.DownloadMbps, err = download(ctx, client, t, phase, maxBytes); err != nil {
+		out.Error = fmt.Sprintf("download: %v", err)
+		return out
+	}
+	if out.UploadMbps, err = upload(ctx, client, t, phase, maxBytes); err != nil {
+		out.Error = fmt.Sprintf("upload: %v", err)
+	}
+	return out
+}
+
+// probeLatency returns the median TCP connect time to addr.
+func probeLatency(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	samples := make([]time.Duration, 0, latencySamples)
+	for range latencySamples {
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		start := time.Now()
+		conn, err := d.DialContext(dctx, "tcp", addr)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		samples = append(samples, time.Since(start))
+		conn.Close()
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[len(samples)/2], nil
+}
+
+func download(ctx context.Context, client *http.Client, t Target, phase time.Duration, maxBytes int64) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, phase)
+	defer cancel()
+
+	u := t.BaseURL + "/nettest/download?bytes=" + strconv.FormatInt(maxBytes, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	copyHeader(req.Header, t.Header)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return 0, err
+	}
+	return mbps(n, time.Since(start)), nil
+}
+
+func upload(ctx context.Context, client *http.Client, t Target, phase time.Duration, maxBytes int64) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, phase)
+	defer cancel()
+
+	body := &countingReader{r: io.LimitReader(zeroReader{}, maxBytes)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.BaseURL+"/nettest/upload", body)
+	if err != nil {
+		return 0, err
+	}
+	copyHeader(req.Header, t.Header)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		// Running out of budget mid-transfer still yields a measurement.
+		if sent := body.n.Load(); errors.Is(err, context.DeadlineExceeded) && sent > 0 {
+			return mbps(sent, elapsed), nil
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return mbps(body.n.Load(), elapsed), nil
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+func hostPort(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("parse %q: %w", raw, err)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// countingReader counts bytes handed to the transport, which may still be
+// reading when Do returns on a timeout.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
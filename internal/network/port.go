@@ -2,9 +2,13 @@ package network
 
 import (
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
+
+	"github.com/qudata/agent/internal/domain"
 )
 
 const (
@@ -14,32 +18,111 @@ const (
 	AppPortMax = 15300
 )
 
+// LeaseStore persists the ports held by the allocator.
+type LeaseStore interface {
+	SavePortLeases(leases []domain.PortLease) error
+	LoadPortLeases() ([]domain.PortLease, error)
+}
+
 type PortAllocator struct {
 	mu        sync.Mutex
-	allocated map[int]struct{}
+	allocated map[int]lease
+	ssh       domain.PortRange
+	app       domain.PortRange
+	store     LeaseStore
+	logger    *slog.Logger
+}
+
+type lease struct {
+	purpose string
+	// restored leases were loaded from the store and are released by
+	// DropRestored unless reserved again by then.
+	restored bool
 }
 
 func NewPortAllocator() *PortAllocator {
-	return &PortAllocator{allocated: make(map[int]struct{})}
+	return &PortAllocator{
+		allocated: make(map[int]lease),
+		ssh:       domain.PortRange{Min: SSHPortMin, Max: SSHPortMax},
+		app:       domain.PortRange{Min: AppPortMin, Max: AppPortMax},
+	}
 }
 
-func (a *PortAllocator) AllocateSSHPort() (int, error) {
+// Restore loads the leases a previous run persisted and persists every
+// change from then on. Restored ports are held, so none can be handed to a
+// new allocation, until the owner reserves them again or DropRestored
+// releases the ones nobody claimed.
+func (a *PortAllocator) Restore(store LeaseStore, logger *slog.Logger) error {
+	leases, err := store.LoadPortLeases()
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	return a.allocateFromRange(SSHPortMin, SSHPortMax)
+	a.store, a.logger = store, logger
+	for _, l := range leases {
+		if _, taken := a.allocated[l.Port]; !taken {
+			a.allocated[l.Port] = lease{purpose: l.Purpose, restored: true}
+		}
+	}
+	return err
 }
 
-func (a *PortAllocator) AllocateAppPorts(n int) ([]int, error) {
+// DropRestored releases the restored leases that were not reserved again
+// and returns them.
+func (a *PortAllocator) DropRestored() []domain.PortLease {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var dropped []domain.PortLease
+	for p, l := range a.allocated {
+		if l.restored {
+			dropped = append(dropped, domain.PortLease{Port: p, Purpose: l.purpose})
+			delete(a.allocated, p)
+		}
+	}
+	if len(dropped) > 0 {
+		a.saveLocked()
+	}
+	return dropped
+}
+
+// Leases returns the ports currently held and what they are for.
+func (a *PortAllocator) Leases() []domain.PortLease {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.leasesLocked()
+}
+
+// SetRanges changes the ranges new ports are allocated from. Ports already
+// allocated outside the new ranges stay valid until released.
+func (a *PortAllocator) SetRanges(ssh, app domain.PortRange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ssh, a.app = ssh, app
+}
+
+// Ranges returns the SSH and application port ranges.
+func (a *PortAllocator) Ranges() (ssh, app domain.PortRange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ssh, a.app
+}
+
+func (a *PortAllocator) AllocateSSHPort(purpose string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocateFromRange(a.ssh.Min, a.ssh.Max, purpose)
+}
+
+func (a *PortAllocator) AllocateAppPorts(n int, purpose string) ([]int, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	ports := make([]int, 0, n)
 	for i := 0; i < n; i++ {
-		p, err := a.allocateFromRange(AppPortMin, AppPortMax)
+		p, err := a.allocateFromRange(a.app.Min, a.app.Max, purpose)
 		if err != nil {
 			for _, allocated := range ports {
 				delete(a.allocated, allocated)
 			}
+			a.saveLocked()
 			return nil, fmt.Errorf("allocate app port %d/%d: %w", i+1, n, err)
 		}
 		ports = append(ports, p)
@@ -47,10 +130,41 @@ func (a *PortAllocator) AllocateAppPorts(n int) ([]int, error) {
 	return ports, nil
 }
 
-func (a *PortAllocator) AllocateOne() (int, error) {
+func (a *PortAllocator) AllocateOne(purpose string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocateFromRange(a.app.Min, a.app.Max, purpose)
+}
+
+// Reserve marks ports as allocated without probing them, e.g. when restoring
+// ports owned by a persisted instance. It fails if any port is already taken,
+// unless only by a restored lease, which the reservation takes over.
+func (a *PortAllocator) Reserve(purpose string, ports ...int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range ports {
+		if l, taken := a.allocated[p]; taken && !l.restored {
+			return fmt.Errorf("port %d already allocated for %s", p, l.purpose)
+		}
+	}
+	for _, p := range ports {
+		if l, ok := a.allocated[p]; ok && l.purpose != "" {
+			// A restored lease knows what the port was for.
+			a.allocated[p] = lease{purpose: l.purpose}
+			continue
+		}
+		a.allocated[p] = lease{purpose: purpose}
+	}
+	a.saveLocked()
+	return nil
+}
+
+// Allocated reports whether port is currently held by the allocator.
+func (a *PortAllocator) Allocated(port int) bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	return a.allocateFromRange(AppPortMin, AppPortMax)
+	_, ok := a.allocated[port]
+	return ok
 }
 
 func (a *PortAllocator) Release(ports ...int) {
@@ -59,9 +173,10 @@ func (a *PortAllocator) Release(ports ...int) {
 	for _, p := range ports {
 		delete(a.allocated, p)
 	}
+	a.saveLocked()
 }
 
-func (a *PortAllocator) allocateFromRange(min, max int) (int, error) {
+func (a *PortAllocator) allocateFromRange(min, max int, purpose string) (int, error) {
 	start := min + rand.Intn(max-min+1)
 	for i := 0; i <= max-min; i++ {
 		port := min + (start-min+i)%(max-min+1)
@@ -71,12 +186,32 @@ func (a *PortAllocator) allocateFromRange(min, max int) (int, error) {
 		if !isPortFree(port) {
 			continue
 		}
-		a.allocated[port] = struct{}{}
+		a.allocated[port] = lease{purpose: purpose}
+		a.saveLocked()
 		return port, nil
 	}
 	return 0, fmt.Errorf("no free port in range %d-%d", min, max)
 }
 
+func (a *PortAllocator) leasesLocked() []domain.PortLease {
+	leases := make([]domain.PortLease, 0, len(a.allocated))
+	for p, l := range a.allocated {
+		leases = append(leases, domain.PortLease{Port: p, Purpose: l.purpose})
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Port < leases[j].Port })
+	return leases
+}
+
+// saveLocked persists the leases once Restore has set a store.
+func (a *PortAllocator) saveLocked() {
+	if a.store == nil {
+		return
+	}
+	if err := a.store.SavePortLeases(a.leasesLocked()); err != nil {
+		a.logger.Warn("failed to persist port leases", "err", err)
+	}
+}
+
 func isPortFree(port int) bool {
 	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
@@ -0,0 +1,77 @@
+package qemu
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	// serialLogSuffix names the file QEMU copies the guest serial output
+	// to. It ends in .log so the agent's log rotation picks it up.
+	serialLogSuffix = ".serial.log"
+	// maxBootLog caps how much of the serial log BootLog returns and
+	// keeps after the VM is gone.
+	maxBootLog = 256 << 10
+	// sshErrorTail is how many serial log lines a failed SSH wait reports.
+	sshErrorTail = 5
+)
+
+func serialLogPath(runDir, vmID string) string {
+	return filepath.Join(runDir, vmID+serialLogSuffix)
+}
+
+// BootLog returns the end of the guest serial output: kernel messages, the
+// boot loader and anything else the guest prints to its console. Once the
+// VM is gone it returns what the last one printed, so that a guest that
+// failed to boot can still be diagnosed.
+func (m *Manager) BootLog() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		if m.lastBootLog == nil {
+			return nil, domain.ErrNoInstanceRunning{}
+		}
+		return m.lastBootLog, nil
+	}
+	return readTail(serialLogPath(m.runDir, m.vmID), maxBootLog), nil
+}
+
+// readTail returns at most limit bytes from the end of path, starting at a
+// line boundary when it had to cut.
+func readTail(path string, limit int64) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	cut := false
+	if info, err := f.Stat(); err == nil && info.Size() > limit {
+		_, _ = f.Seek(-limit, io.SeekEnd)
+		cut = true
+	}
+	data, _ := io.ReadAll(f)
+	if cut {
+		if i := strings.IndexByte(string(data), '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data
+}
+
+// lastLines returns the last n non-empty lines of data, joined by " | ".
+func lastLines(data []byte, n int) string {
+	var lines []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
@@ -0,0 +1,113 @@
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	// cgsID is the QEMU object of the confidential guest support.
+	cgsID = "cgs0"
+	// snpCbitPos and snpReducedPhysBits describe the memory encryption bit
+	// of the guest page tables; every SEV-SNP capable EPYC uses these.
+	snpCbitPos         = 51
+	snpReducedPhysBits = 1
+	// tsmReportDir is the configfs-tsm interface through which the guest
+	// kernel (6.7 and later) obtains SNP reports and TDX quotes alike.
+	tsmReportDir = "/sys/kernel/config/tsm/report"
+	// attestTimeout bounds a report request, which for TDX includes the
+	// host's quoting enclave.
+	attestTimeout = 30 * time.Second
+)
+
+// defaultConfidentialFirmware is the stateless OVMF build each mode boots
+// when no firmware is configured; confidential guests cannot use pflash
+// variables.
+var defaultConfidentialFirmware = map[domain.ConfidentialMode]string{
+	domain.ConfidentialSEVSNP: "/usr/share/ovmf/OVMF.amdsev.fd",
+	domain.ConfidentialTDX:    "/usr/share/ovmf/OVMF.fd",
+}
+
+var errNoConfidential = errors.New("host does not support confidential VMs (SEV-SNP or TDX)")
+
+// confidentialArgs returns the machine options and arguments that run the
+// guest under the host's confidential mode.
+func (m *Manager) confidentialArgs() (machine string, args []string) {
+	switch m.confidential {
+	case domain.ConfidentialSEVSNP:
+		machine = ",confidential-guest-support=" + cgsID
+		args = []string{"-object", fmt.Sprintf("sev-snp-guest,id=%s,cbitpos=%d,reduced-phys-bits=%d", cgsID, snpCbitPos, snpReducedPhysBits)}
+	case domain.ConfidentialTDX:
+		// TDX guests cannot use the in-kernel IOAPIC.
+		machine = ",kernel-irqchip=split,confidential-guest-support=" + cgsID
+		args = []string{"-object", "tdx-guest,id=" + cgsID}
+	}
+	return machine, append(args, "-bios", ConfidentialFirmware(m.confidential, m.cvmFirmware))
+}
+
+// ConfidentialFirmware returns the firmware confidential VMs boot under
+// mode: configured, or the default for the mode when it is empty.
+func ConfidentialFirmware(mode domain.ConfidentialMode, configured string) string {
+	if configured != "" {
+		return configured
+	}
+	return defaultConfidentialFirmware[mode]
+}
+
+// Attest asks the guest kernel for a report binding nonce, signed by the
+// CPU. The host cannot forge it, so the renter can verify that the guest
+// memory is encrypted without trusting the host operator.
+func (m *Manager) Attest(ctx context.Context, nonce []byte) (*domain.Attestation, error) {
+	m.mu.Lock()
+	confidential := m.vmID != "" && m.spec.Confidential
+	m.mu.Unlock()
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return nil, err
+	}
+	if !confidential {
+		return nil, domain.ErrNotConfidential{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, attestTimeout)
+	defer cancel()
+	script := fmt.Sprintf(`set -e
+mountpoint -q /sys/kernel/config || mount -t configfs configfs /sys/kernel/config
+[ -d %[1]s ] || { echo "configfs-tsm is not available in the guest kernel" >&2; exit 1; }
+d=$(mktemp -u %[1]s/qudata.XXXXXX)
+mkdir "$d"
+trap 'rmdir "$d"' EXIT
+echo %[2]s | base64 -d > "$d/inblob"
+cat "$d/provider"
+base64 -w0 "$d/outblob"; echo
+base64 -w0 "$d/auxblob" 2>/dev/null || true; echo`, tsmReportDir, base64.StdEncoding.EncodeToString(nonce))
+	var stdout, stderr bytes.Buffer
+	if err := ssh.Stream(ctx, script, &stdout, &stderr); err != nil {
+		return nil, fmt.Errorf("attestation report: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	lines := strings.Split(stdout.String(), "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("attestation report: unexpected output %q", stdout.String())
+	}
+	report, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(report) == 0 {
+		return nil, fmt.Errorf("attestation report: empty or malformed report")
+	}
+	aux, _ := base64.StdEncoding.DecodeString(lines[2])
+	return &domain.Attestation{
+		Mode:      m.confidential,
+		Provider:  strings.TrimSpace(lines[0]),
+		Nonce:     nonce,
+		Report:    report,
+		AuxBlob:   aux,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,29 @@
+package qemu
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// guestComposePath is where the Compose document is written in the guest.
+const guestComposePath = "/opt/qudata/compose.yaml"
+
+// startContainers writes compose to the guest and brings its containers up
+// in the transient unit domain.ComposeUnit. The unit runs in the background,
+// so that pulling large images does not hold up the create; its journal
+// shows the pull and the container output.
+func startContainers(ctx context.Context, ssh *SSHClient, compose string) error {
+	encoded := base64.StdEncoding.EncodeToString([]byte(compose))
+	cmd := `command -v docker >/dev/null 2>&1 || { echo "docker is not installed in the guest" >&2; exit 1; }; ` +
+		fmt.Sprintf(`mkdir -p /opt/qudata && echo '%s' | base64 -d > %s && `, encoded, guestComposePath) +
+		fmt.Sprintf(`systemd-run --unit=%s --description="qudata containers" `, domain.ComposeUnit) +
+		fmt.Sprintf(`docker compose -p qudata -f %s up --remove-orphans`, guestComposePath)
+	if out, err := ssh.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package qemu
+
+import (
+	"fmt"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// dcgmStatsCmd prints the metrics of the guest's dcgm-exporter, or nothing
+// when it is not running.
+func dcgmStatsCmd(port int) string {
+	return fmt.Sprintf(`curl -sf --max-time 1 http://127.0.0.1:%d/metrics 2>/dev/null`, port)
+}
+
+// parseDCGM reads the DCGM fields the agent reports from dcgm-exporter
+// output. It returns nil when the output holds none of them.
+func parseDCGM(text string) *domain.DCGMStats {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil && len(families) == 0 {
+		return nil
+	}
+
+	d := &domain.DCGMStats{}
+	gpus := map[string]bool{}
+	sum := func(name string) (total float64, found bool) {
+		mf, ok := families[name]
+		if !ok {
+			return 0, false
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "gpu" {
+					gpus[l.GetValue()] = true
+				}
+			}
+			total += metricValue(m)
+		}
+		return total, true
+	}
+
+	var found bool
+	collect := func(name string) float64 {
+		v, ok := sum(name)
+		found = found || ok
+		return v
+	}
+	occupancy := collect("DCGM_FI_PROF_SM_OCCUPANCY")
+	occupied := len(families["DCGM_FI_PROF_SM_OCCUPANCY"].GetMetric())
+	d.NVLinkRxBytes = collect("DCGM_FI_PROF_NVLINK_RX_BYTES")
+	d.NVLinkTxBytes = collect("DCGM_FI_PROF_NVLINK_TX_BYTES")
+	d.PCIeRxBytes = collect("DCGM_FI_PROF_PCIE_RX_BYTES")
+	d.PCIeTxBytes = collect("DCGM_FI_PROF_PCIE_TX_BYTES")
+	d.ECCSingleBit = uint64(collect("DCGM_FI_DEV_ECC_SBE_VOL_TOTAL"))
+	d.ECCDoubleBit = uint64(collect("DCGM_FI_DEV_ECC_DBE_VOL_TOTAL"))
+	d.RetiredPagesSBE = uint64(collect("DCGM_FI_DEV_RETIRED_SBE"))
+	d.RetiredPagesDBE = uint64(collect("DCGM_FI_DEV_RETIRED_DBE"))
+	if !found {
+		return nil
+	}
+	if occupied > 0 {
+		d.SMOccupancy = occupancy / float64(occupied)
+	}
+	d.GPUs = len(gpus)
+	return d
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue()
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package qemu
+
+import "strings"
+
+// DiskOptions tune how instance disks are laid out and opened. Empty fields
+// keep the qemu-img and QEMU defaults.
+type DiskOptions struct {
+	// Preallocation is the qcow2 preallocation of new disks: "off",
+	// "metadata" or "falloc".
+	Preallocation string
+	// ClusterSize is the qcow2 cluster size of new disks, such as "64k" or
+	// "2M".
+	ClusterSize string
+	// Cache is the cache mode of the drives, such as "writeback" or "none".
+	Cache string
+	// AIO is the I/O engine of the drives: "threads", "native" or
+	// "io_uring".
+	AIO string
+}
+
+// createOpts returns the options qemu-img create takes with -o, or "".
+func (o DiskOptions) createOpts() string {
+	var opts []string
+	if o.Preallocation != "" {
+		opts = append(opts, "preallocation="+o.Preallocation)
+	}
+	if o.ClusterSize != "" {
+		opts = append(opts, "cluster_size="+o.ClusterSize)
+	}
+	return strings.Join(opts, ",")
+}
+
+// createArgs returns createOpts as qemu-img arguments.
+func (o DiskOptions) createArgs() []string {
+	if opts := o.createOpts(); opts != "" {
+		return []string{"-o", opts}
+	}
+	return nil
+}
+
+// driveOpts returns the options appended to the -drive of instance disks
+// and volumes.
+func (o DiskOptions) driveOpts() string {
+	opts := diskDiscardOpts
+	if o.Cache != "" {
+		opts += ",cache=" + o.Cache
+	}
+	if o.AIO != "" {
+		opts += ",aio=" + o.AIO
+	}
+	return opts
+}
@@ -0,0 +1,76 @@
+package qemu
+
+import (
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// diskSample is the summed I/O counters of the instance's disks.
+type diskSample struct {
+	rdBytes, wrBytes uint64
+	rdOps, wrOps     uint64
+	at               time.Time
+}
+
+// collectDisk reads the I/O counters and image sizes of the qcow2 disks
+// over QMP. It returns nil while QMP is unavailable, so a hung monitor
+// cannot hold up the stats.
+func (m *Manager) collectDisk() *domain.DiskStats {
+	m.mu.Lock()
+	qmp, degraded := m.qmp, m.qmpDegraded
+	m.mu.Unlock()
+	if qmp == nil || !qmp.Connected() || degraded {
+		return nil
+	}
+
+	images, err := qmp.QueryBlock()
+	if err != nil {
+		m.logger.Debug("query-block failed", "err", err)
+		return nil
+	}
+	stats, err := qmp.QueryBlockStats()
+	if err != nil {
+		m.logger.Debug("query-blockstats failed", "err", err)
+		return nil
+	}
+
+	// The firmware drives are raw; only the instance disks are qcow2.
+	disks := map[string]bool{}
+	out := &domain.DiskStats{}
+	for _, img := range images {
+		if img.Format != "qcow2" {
+			continue
+		}
+		disks[img.Device] = true
+		out.AllocatedBytes += img.VirtualSize
+		out.UsedBytes += img.ActualSize
+	}
+	cur := diskSample{at: time.Now()}
+	for _, s := range stats {
+		if !disks[s.Device] {
+			continue
+		}
+		cur.rdBytes += s.RdBytes
+		cur.wrBytes += s.WrBytes
+		cur.rdOps += s.RdOps
+		cur.wrOps += s.WrOps
+	}
+
+	m.sampleMu.Lock()
+	prev := m.diskPrev
+	m.diskPrev = cur
+	m.sampleMu.Unlock()
+
+	// Counters restart with the VM; skip the rates rather than report a
+	// negative delta.
+	if dt := cur.at.Sub(prev.at).Seconds(); !prev.at.IsZero() && dt > 0 &&
+		cur.rdBytes >= prev.rdBytes && cur.wrBytes >= prev.wrBytes &&
+		cur.rdOps >= prev.rdOps && cur.wrOps >= prev.wrOps {
+		out.ReadBytesPerSec = float64(cur.rdBytes-prev.rdBytes) / dt
+		out.WriteBytesPerSec = float64(cur.wrBytes-prev.wrBytes) / dt
+		out.ReadOpsPerSec = float64(cur.rdOps-prev.rdOps) / dt
+		out.WriteOpsPerSec = float64(cur.wrOps-prev.wrOps) / dt
+	}
+	return out
+}
@@ -0,0 +1,26 @@
+package qemu
+
+import (
+	"fmt"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// vncBasePort is the port of VNC display 0; QEMU takes display numbers.
+const vncBasePort = 5900
+
+// displayArgs returns the display arguments: headless, or a VNC server on
+// the loopback port of vnc whose password is set over QMP once QEMU runs.
+// The monitor is disabled, since QEMU would otherwise offer it as a VNC
+// console.
+func displayArgs(vnc *domain.VNCDisplay) []string {
+	if vnc == nil {
+		return []string{"-nographic"}
+	}
+	return []string{
+		"-vga", "std",
+		"-display", "none",
+		"-monitor", "none",
+		"-vnc", fmt.Sprintf("127.0.0.1:%d,password=on", vnc.Port-vncBasePort),
+	}
+}
@@ -0,0 +1,99 @@
+package qemu
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// diskKeySize is the size of the keys the agent generates.
+	diskKeySize = 32
+	// diskSecretID is the QEMU secret object holding the disk key.
+	diskSecretID = "disksec0"
+	// diskSecretObject reads the key from the first of the command's
+	// ExtraFiles, so that it appears neither on the command line nor on disk.
+	diskSecretObject = "secret,id=" + diskSecretID + ",format=base64,file=/dev/fd/3"
+)
+
+// newDiskKey returns a random disk key.
+func newDiskKey() ([]byte, error) {
+	key := make([]byte, diskKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate disk key: %w", err)
+	}
+	return key, nil
+}
+
+// instanceDiskKey returns a copy of the supplied key, or a new key when none
+// is. The caller clears it when done; the supplied key stays intact, since
+// the caller retries a failed create with the same spec.
+func instanceDiskKey(supplied []byte) ([]byte, error) {
+	if len(supplied) == 0 {
+		return newDiskKey()
+	}
+	return bytes.Clone(supplied), nil
+}
+
+// secretPipe returns the read end of a pipe holding key for a child's
+// diskSecretObject. The key fits in the pipe buffer, so it is written and
+// the write end closed before the child starts.
+func secretPipe(key []byte) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write([]byte(base64.StdEncoding.EncodeToString(key)))
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("write disk key: %w", err)
+	}
+	return r, nil
+}
+
+// CreateEncryptedDisk creates a LUKS-encrypted qcow2 disk of sizeGB,
+// overlaying basePath when it is set. Only what the guest writes is
+// encrypted; the base image stays shared. The overlay is created at its
+// final size, since growing it later with qemu-img would need the key again.
+func (m *ImageManager) CreateEncryptedDisk(name, basePath string, sizeGB int, key []byte) (string, error) {
+	if err := os.MkdirAll(m.imageDir, 0o755); err != nil {
+		return "", fmt.Errorf("create image dir: %w", err)
+	}
+	size := int64(sizeGB) << 30
+	opts := "encrypt.format=luks,encrypt.key-secret=" + diskSecretID
+	if extra := m.opts.createOpts(); extra != "" {
+		opts += "," + extra
+	}
+	args := []string{"create", "-f", "qcow2", "--object", diskSecretObject, "-o", opts}
+	if basePath != "" {
+		baseSize, err := m.virtualSize(basePath)
+		if err != nil {
+			return "", err
+		}
+		size = max(size, baseSize)
+		args = append(args, "-b", basePath, "-F", "qcow2")
+	}
+	path := filepath.Join(m.imageDir, name+".qcow2")
+	args = append(args, path, fmt.Sprintf("%d", size))
+
+	secret, err := secretPipe(key)
+	if err != nil {
+		return "", err
+	}
+	defer secret.Close()
+	cmd := exec.Command("qemu-img", args...)
+	cmd.ExtraFiles = []*os.File{secret}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(path)
+		return "", fmt.Errorf("qemu-img create encrypted: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return path, nil
+}
@@ -0,0 +1,41 @@
+package qemu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInstanceDiskKeySurvivesRetry(t *testing.T) {
+	supplied := bytes.Repeat([]byte{0xab}, 32)
+	want := bytes.Clone(supplied)
+
+	// Create clears its key when done; a retried create must still see the
+	// key the control plane supplied.
+	for attempt := range 2 {
+		key, err := instanceDiskKey(supplied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, want) {
+			t.Fatalf("attempt %d: key = %x, want %x", attempt, key, want)
+		}
+		clear(key)
+	}
+	if !bytes.Equal(supplied, want) {
+		t.Fatalf("supplied key changed to %x", supplied)
+	}
+}
+
+func TestInstanceDiskKeyGenerated(t *testing.T) {
+	a, err := instanceDiskKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := instanceDiskKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != diskKeySize || bytes.Equal(a, b) {
+		t.Fatalf("generated keys %x and %x", a, b)
+	}
+}
@@ -0,0 +1,155 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/baseimage"
+	"github.com/qudata/agent/internal/system"
+)
+
+// staleDownloadAge is how old an unfinished base image download must be
+// before GC treats it as abandoned.
+const staleDownloadAge = 24 * time.Hour
+
+// GCReport summarizes one garbage collection pass over the image directory.
+type GCReport struct {
+	Removed        []string
+	ReclaimedBytes int64
+	// UsagePercent is the filesystem usage after the pass.
+	UsagePercent float64
+}
+
+// CollectGarbage removes instance disks that no VM uses and, while the image
+// filesystem is above watermark percent full, base image versions that are
+// neither active nor backing a remaining disk, oldest first.
+func (m *Manager) CollectGarbage(watermark float64) (GCReport, error) {
+	// Create holds the lock while it prepares a disk, so an overlay seen
+	// here without a VM cannot be one that is being created.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var report GCReport
+	dir := m.images.imageDir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return report, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".qcow2") {
+			continue
+		}
+		if _, err := uuid.Parse(strings.TrimSuffix(name, ".qcow2")); err != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if path == m.diskPath {
+			continue
+		}
+		m.removeImage(path, m.wipeDefault, &report)
+	}
+
+	baseDir := filepath.Join(dir, baseimage.Subdir)
+	m.removeStaleDownloads(baseDir, &report)
+
+	usage, err := system.ReadDiskUsage(dir)
+	if err != nil {
+		return report, err
+	}
+	report.UsagePercent = usage.UsedPercent()
+	if report.UsagePercent <= watermark {
+		return report, nil
+	}
+
+	for _, path := range m.unusedBaseImages(baseDir) {
+		m.removeImage(path, false, &report)
+		if usage, err = system.ReadDiskUsage(dir); err != nil {
+			return report, err
+		}
+		report.UsagePercent = usage.UsedPercent()
+		if report.UsagePercent <= watermark {
+			break
+		}
+	}
+	return report, nil
+}
+
+func (m *Manager) removeImage(path string, wipe bool, report *GCReport) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if wipe {
+		if _, _, err := m.images.WipeDisk(path); err != nil {
+			m.logger.Warn("gc: wipe failed, removing anyway", "path", path, "err", err)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		m.logger.Warn("gc: remove image", "path", path, "err", err)
+		return
+	}
+	report.Removed = append(report.Removed, path)
+	report.ReclaimedBytes += info.Size()
+}
+
+func (m *Manager) removeStaleDownloads(baseDir string, report *GCReport) {
+	matches, _ := filepath.Glob(filepath.Join(baseDir, ".download-*"))
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < staleDownloadAge {
+			continue
+		}
+		m.removeImage(path, false, report)
+	}
+}
+
+// unusedBaseImages lists versions under baseDir that are safe to delete,
+// oldest first. Must be called with m.mu held.
+func (m *Manager) unusedBaseImages(baseDir string) []string {
+	inUse := make(map[string]bool)
+	if p, err := filepath.EvalSymlinks(filepath.Join(baseDir, baseimage.CurrentLink)); err == nil {
+		inUse[p] = true
+	}
+	if m.baseImage != "" {
+		inUse[m.baseImage] = true
+	}
+	if m.diskPath != "" {
+		if backing, err := m.images.backingFile(m.diskPath); err == nil && backing != "" {
+			inUse[backing] = true
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(baseDir, "*.qcow2"))
+	type candidate struct {
+		path  string
+		mtime time.Time
+	}
+	var candidates []candidate
+	for _, path := range matches {
+		if inUse[path] {
+			continue
+		}
+		// A version just downloaded may be about to become current.
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+		candidates = append(candidates, candidate{path, info.ModTime()})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].mtime.Before(candidates[j].mtime) })
+
+	paths := make([]string, len(candidates))
+	for i, c := range candidates {
+		paths[i] = c.path
+	}
+	return paths
+}
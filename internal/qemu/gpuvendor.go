@@ -0,0 +1,100 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PCI vendor IDs of supported GPU vendors.
+const (
+	VendorNVIDIA = "0x10de"
+	VendorAMD    = "0x1002"
+)
+
+// Guest commands printing one GPU metrics record for the stats collector.
+const (
+	nvidiaStatsCmd = `nvidia-smi --query-gpu=utilization.gpu,temperature.gpu,memory.used,memory.total,power.draw,power.limit --format=csv,noheader,nounits 2>/dev/null`
+	rocmStatsCmd   = `rocm-smi --showuse --showtemp --showmeminfo vram --json 2>/dev/null | tr -d '\n'; echo`
+)
+
+// GPUVendor returns the PCI vendor ID of the device at addr, e.g. "0x10de".
+func GPUVendor(addr string) string {
+	v, _ := readSysfsAttr(filepath.Join(devicesDir, addr), "vendor")
+	return v
+}
+
+// isCompanionAudio reports whether dev is the HDMI audio function of a GPU
+// that has to follow the GPU into vfio-pci.
+func isCompanionAudio(dev IOMMUGroupDevice) bool {
+	return dev.IsAudio && (strings.HasPrefix(dev.Vendor, VendorNVIDIA) || strings.HasPrefix(dev.Vendor, VendorAMD))
+}
+
+func gpuStatsCmd(vendor string) string {
+	if vendor == VendorAMD {
+		return rocmStatsCmd
+	}
+	return nvidiaStatsCmd
+}
+
+// CheckROCm verifies that the AMD driver stack is usable inside the VM.
+func (c *SSHClient) CheckROCm(ctx context.Context) error {
+	out, err := c.Run(ctx, "rocm-smi >/dev/null 2>&1 && echo ok")
+	if err != nil || strings.TrimSpace(string(out)) != "ok" {
+		return fmt.Errorf("amdgpu/ROCm driver not available in VM")
+	}
+	return nil
+}
+
+// CheckGPUDriver runs the guest driver check matching the GPU vendor.
+func (c *SSHClient) CheckGPUDriver(ctx context.Context, vendor string) error {
+	if vendor == VendorAMD {
+		return c.CheckROCm(ctx)
+	}
+	return c.CheckNVIDIA(ctx)
+}
+
+// parseROCmMetrics parses `rocm-smi --showuse --showtemp --showmeminfo vram --json`
+// across all cards, like the NVIDIA stats: utilization is averaged,
+// temperature is the hottest card and VRAM is pooled.
+func parseROCmMetrics(output string) (*GPUMetrics, error) {
+	var cards map[string]map[string]string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(output)), &cards); err != nil {
+		return nil, fmt.Errorf("parse rocm-smi output: %w", err)
+	}
+
+	metrics := &GPUMetrics{}
+	var util float64
+	n := 0
+	for name, card := range cards {
+		if !strings.HasPrefix(name, "card") {
+			continue
+		}
+		for key, val := range card {
+			val = strings.TrimSpace(val)
+			switch {
+			case strings.HasPrefix(key, "GPU use"):
+				u, _ := strconv.ParseFloat(val, 64)
+				util += u
+			case strings.HasPrefix(key, "Temperature") && strings.Contains(key, "edge"):
+				t, _ := strconv.ParseFloat(val, 64)
+				metrics.Temperature = max(metrics.Temperature, int(t))
+			case key == "VRAM Total Memory (B)":
+				b, _ := strconv.ParseUint(val, 10, 64)
+				metrics.MemoryTotal += b / (1024 * 1024)
+			case key == "VRAM Total Used Memory (B)":
+				b, _ := strconv.ParseUint(val, 10, 64)
+				metrics.MemoryUsed += b / (1024 * 1024)
+			}
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("no cards in rocm-smi output")
+	}
+	metrics.Utilization = util / float64(n)
+	return metrics, nil
+}
@@ -0,0 +1,30 @@
+package qemu
+
+import "testing"
+
+func TestParseROCmMetricsAggregatesCards(t *testing.T) {
+	out := `{"card0": {"GPU use (%)": "80", "Temperature (Sensor edge) (C)": "60.0",
+		"VRAM Total Memory (B)": "68702699520", "VRAM Total Used Memory (B)": "34351349760"},
+	"card1": {"GPU use (%)": "20", "Temperature (Sensor edge) (C)": "71.0",
+		"VRAM Total Memory (B)": "68702699520", "VRAM Total Used Memory (B)": "0"},
+	"system": {"Driver version": "6.7.0"}}`
+	m, err := parseROCmMetrics(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Utilization != 50 {
+		t.Errorf("Utilization = %v, want 50", m.Utilization)
+	}
+	if m.Temperature != 71 {
+		t.Errorf("Temperature = %d, want the hottest card, 71", m.Temperature)
+	}
+	if m.MemoryTotal != 2*65520 || m.MemoryUsed != 32760 {
+		t.Errorf("memory = %d/%d MiB, want 32760/%d", m.MemoryUsed, m.MemoryTotal, 2*65520)
+	}
+}
+
+func TestParseROCmMetricsNoCards(t *testing.T) {
+	if _, err := parseROCmMetrics(`{"system": {}}`); err == nil {
+		t.Fatal("no error without cards")
+	}
+}
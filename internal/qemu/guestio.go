@@ -0,0 +1,169 @@
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"golang.org/x/crypto/ssh"
+)
+
+// StreamLogs writes the guest system journal to w. With opts.Follow it keeps
+// streaming until ctx is cancelled.
+func (m *Manager) StreamLogs(ctx context.Context, opts domain.LogOptions, w io.Writer) error {
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return err
+	}
+
+	tail := opts.Tail
+	if tail <= 0 {
+		tail = 200
+	}
+	cmd := "journalctl --no-pager -o short-iso -n " + strconv.Itoa(tail)
+	if opts.Unit != "" {
+		cmd += " -u " + shellQuote(opts.Unit)
+	}
+	if opts.Follow {
+		cmd += " -f"
+	}
+	lw := &lockedWriter{w: w}
+	return ssh.Stream(ctx, cmd, lw, lw)
+}
+
+// RunCommand runs a shell command in the guest and returns its combined
+// output.
+func (m *Manager) RunCommand(ctx context.Context, cmd string) ([]byte, error) {
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Run(ctx, cmd)
+}
+
+// maxExecOutput bounds what Exec keeps of each output stream.
+const maxExecOutput = 1 << 20
+
+// Exec runs req in the guest over SSH, or in a guest container through
+// docker exec.
+func (m *Manager) Exec(ctx context.Context, req domain.ExecRequest) (*domain.ExecResult, error) {
+	client, err := m.guestSSH()
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, len(req.Command)+3)
+	if req.Container != "" {
+		args = append(args, "docker", "exec", "-i", shellQuote(req.Container))
+	}
+	for _, a := range req.Command {
+		args = append(args, shellQuote(a))
+	}
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	stdout := &cappedBuffer{max: maxExecOutput}
+	stderr := &cappedBuffer{max: maxExecOutput}
+	start := time.Now()
+	err = client.run(ctx, strings.Join(args, " "), strings.NewReader(req.Stdin), stdout, stderr)
+	out, outDropped := stdout.snapshot()
+	errOut, errDropped := stderr.snapshot()
+	res := &domain.ExecResult{
+		Stdout:     out,
+		Stderr:     errOut,
+		Truncated:  outDropped || errDropped,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitStatus()
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil:
+		res.ExitCode, res.TimedOut = -1, true
+	default:
+		var missing *ssh.ExitMissingError
+		if !errors.As(err, &missing) {
+			return nil, domain.ErrQEMU{Op: "exec", Err: err}
+		}
+		res.ExitCode = -1
+	}
+	return res, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest,
+// so that a chatty command cannot exhaust memory. It is safe for concurrent
+// use.
+type cappedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	max     int
+	dropped bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.dropped = true
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// snapshot returns what was kept so far and whether anything was dropped.
+func (b *cappedBuffer) snapshot() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String(), b.dropped
+}
+
+// DownloadFile reads an absolute guest path and hands its size and content to fn.
+func (m *Manager) DownloadFile(ctx context.Context, guestPath string, fn func(size int64, r io.Reader) error) error {
+	if !path.IsAbs(guestPath) {
+		return fmt.Errorf("guest path must be absolute: %q", guestPath)
+	}
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return err
+	}
+	return ssh.ReadFile(ctx, path.Clean(guestPath), fn)
+}
+
+// UploadFile writes r to an absolute guest path. A zero mode leaves the
+// default permissions.
+func (m *Manager) UploadFile(ctx context.Context, guestPath string, r io.Reader, mode os.FileMode) error {
+	if !path.IsAbs(guestPath) || path.Clean(guestPath) == "/" {
+		return fmt.Errorf("guest path must be an absolute file path: %q", guestPath)
+	}
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return err
+	}
+	return ssh.UploadFile(ctx, path.Clean(guestPath), r, mode)
+}
+
+func (m *Manager) guestSSH() (*SSHClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vmID == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	if m.sshClient == nil {
+		return nil, domain.ErrQEMU{Op: "ssh", Err: fmt.Errorf("guest SSH not ready")}
+	}
+	return m.sshClient, nil
+}
@@ -0,0 +1,43 @@
+package qemu
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCappedBufferCaps(t *testing.T) {
+	b := &cappedBuffer{max: 8}
+	for _, s := range []string{"hello", " world", "!"} {
+		if n, err := b.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got, dropped := b.snapshot(); got != "hello wo" || !dropped {
+		t.Fatalf("snapshot = %q, %v; want %q, true", got, dropped, "hello wo")
+	}
+}
+
+// TestCappedBufferConcurrent reads the buffer while writers still use it;
+// run with -race.
+func TestCappedBufferConcurrent(t *testing.T) {
+	b := &cappedBuffer{max: 1 << 10}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_, _ = b.Write([]byte("0123456789"))
+			}
+		}()
+	}
+	for range 100 {
+		_, _ = b.snapshot()
+	}
+	wg.Wait()
+	got, dropped := b.snapshot()
+	if len(got) != 1<<10 || !dropped || strings.Trim(got, "0123456789") != "" {
+		t.Fatalf("snapshot has %d bytes, dropped %v", len(got), dropped)
+	}
+}
@@ -0,0 +1,145 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/qudata/agent/internal/crash"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const adoptPollInterval = time.Second
+
+// Handoff describes the running VM so that a new agent process can adopt it
+// after a re-exec. It returns nil when there is no VM.
+func (m *Manager) Handoff() *domain.VMHandoff {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" || m.proc == nil {
+		return nil
+	}
+	h := &domain.VMHandoff{
+		VMID:         m.vmID,
+		PID:          m.proc.Pid,
+		QMPSocket:    m.qmpSocket,
+		ConsolePath:  m.consolePath,
+		DiskPath:     m.diskPath,
+		OVMFVarsPath: m.ovmfVarsPath,
+		Spec:         m.spec,
+		GPUAddrs:     append([]string(nil), m.gpuAddrs...),
+		GPUVendor:    m.gpuVendor,
+		PortPool:     make(map[int]int, len(m.portPool)),
+		SecureWipe:   m.secureWipe,
+		Status:       m.status,
+		Reason:       m.statusReason,
+	}
+	if m.cgroup != nil {
+		h.CgroupDir = m.cgroup.dir
+	}
+	for gp, hp := range m.portPool {
+		h.PortPool[gp] = hp
+	}
+	for _, v := range m.vfios {
+		h.VFIOs = append(h.VFIOs, domain.VFIOHandoff{
+			Addr:       v.addr,
+			Group:      v.group,
+			OrigDriver: v.origDriver,
+			GroupAddrs: append([]string(nil), v.boundGroupAddrs...),
+		})
+	}
+	return h
+}
+
+// Adopt takes over a VM started by the previous agent process, either across
+// a re-exec, where QEMU stays our child, or after the agent crashed or was
+// restarted, where it was reparented. The VM itself is not touched.
+func (m *Manager) Adopt(h *domain.VMHandoff) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID != "" {
+		return domain.ErrInstanceAlreadyRunning{}
+	}
+	// The pid may have been reused if QEMU died in the meantime.
+	if pid, err := FindQEMUProcessBySocket(h.QMPSocket); err != nil || pid != h.PID {
+		return fmt.Errorf("qemu pid %d no longer serves %s", h.PID, h.QMPSocket)
+	}
+	proc, err := os.FindProcess(h.PID)
+	if err != nil {
+		return fmt.Errorf("find qemu pid %d: %w", h.PID, err)
+	}
+
+	vfios := make([]*VFIO, 0, len(h.VFIOs))
+	for _, vh := range h.VFIOs {
+		v := &VFIO{
+			addr:            vh.Addr,
+			group:           vh.Group,
+			origDriver:      vh.OrigDriver,
+			bound:           true,
+			boundGroupAddrs: vh.GroupAddrs,
+		}
+		if !vfioLocks.claim(v.addr, v) {
+			for _, c := range vfios {
+				vfioLocks.release(c.addr, c)
+			}
+			return fmt.Errorf("pci device %s is already passed through by another instance", v.addr)
+		}
+		vfios = append(vfios, v)
+	}
+
+	m.vmID = h.VMID
+	m.proc = proc
+	m.vfios = vfios
+	m.portPool = h.PortPool
+	m.diskPath = h.DiskPath
+	m.qmpSocket = h.QMPSocket
+	m.consolePath = h.ConsolePath
+	m.spec = h.Spec
+	m.gpuAddrs = h.GPUAddrs
+	m.gpuVendor = h.GPUVendor
+	m.ovmfVarsPath = h.OVMFVarsPath
+	m.secureWipe = h.SecureWipe
+	if h.CgroupDir != "" {
+		m.cgroup = &vmCgroup{dir: h.CgroupDir}
+	}
+
+	m.done = make(chan struct{})
+	go waitAdopted(proc, m.done)
+
+	qmpClient := NewQMPClient(h.QMPSocket)
+	if err := qmpClient.Connect(); err != nil {
+		m.logger.Warn("QMP connect failed after adoption", "err", err)
+		m.qmpDegraded = true
+	} else {
+		m.qmp = qmpClient
+		done := m.done
+		crash.Go("qmp watchdog", func() { m.watchQMP(qmpClient, done) })
+	}
+
+	if sshPort, ok := h.PortPool[22]; ok {
+		m.sshClient = NewSSHClient("127.0.0.1", sshPort, m.sshKeyPath)
+	}
+
+	m.status = h.Status
+	m.statusReason = h.Reason
+	m.statusSince = time.Now()
+
+	m.logger.Info("adopted running VM", "vm_id", h.VMID, "pid", h.PID, "status", h.Status)
+	return nil
+}
+
+// waitAdopted closes done when the adopted QEMU exits. Wait only works while
+// QEMU is still our child; otherwise its pid is polled.
+func waitAdopted(proc *os.Process, done chan struct{}) {
+	defer close(done)
+	if _, err := proc.Wait(); err == nil || !errors.Is(err, syscall.ECHILD) {
+		return
+	}
+	for syscall.Kill(proc.Pid, 0) == nil {
+		time.Sleep(adoptPollInterval)
+	}
+}
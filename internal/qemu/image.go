@@ -3,6 +3,7 @@ package qemu
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,10 +12,11 @@ import (
 
 type ImageManager struct {
 	imageDir string
+	opts     DiskOptions
 }
 
-func NewImageManager(imageDir string) *ImageManager {
-	return &ImageManager{imageDir: imageDir}
+func NewImageManager(imageDir string, opts DiskOptions) *ImageManager {
+	return &ImageManager{imageDir: imageDir, opts: opts}
 }
 
 func (m *ImageManager) CreateDisk(name string, sizeGB int) (string, error) {
@@ -22,7 +24,8 @@ func (m *ImageManager) CreateDisk(name string, sizeGB int) (string, error) {
 		return "", fmt.Errorf("create image dir: %w", err)
 	}
 	path := filepath.Join(m.imageDir, name+".qcow2")
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", path, fmt.Sprintf("%dG", sizeGB))
+	args := append([]string{"create", "-f", "qcow2"}, m.opts.createArgs()...)
+	cmd := exec.Command("qemu-img", append(args, path, fmt.Sprintf("%dG", sizeGB))...)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return "", fmt.Errorf("qemu-img create: %w: %s", err, strings.TrimSpace(string(out)))
 	}
@@ -37,7 +40,8 @@ func (m *ImageManager) CreateOverlay(name, basePath string) (string, error) {
 		return "", fmt.Errorf("base image not found: %w", err)
 	}
 	path := filepath.Join(m.imageDir, name+".qcow2")
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", basePath, "-F", "qcow2", path)
+	args := append([]string{"create", "-f", "qcow2"}, m.opts.createArgs()...)
+	cmd := exec.Command("qemu-img", append(args, "-b", basePath, "-F", "qcow2", path)...)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return "", fmt.Errorf("qemu-img create overlay: %w: %s", err, strings.TrimSpace(string(out)))
 	}
@@ -65,8 +69,9 @@ func (m *ImageManager) ResizeDisk(path string, sizeGB int) error {
 }
 
 // virtualSize returns the virtual disk size in bytes via qemu-img info.
+// The image may be held open by a running QEMU, so the lock is shared.
 func (m *ImageManager) virtualSize(path string) (int64, error) {
-	cmd := exec.Command("qemu-img", "info", "--output=json", path)
+	cmd := exec.Command("qemu-img", "info", "-U", "--output=json", path)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return 0, fmt.Errorf("qemu-img info: %w: %s", err, strings.TrimSpace(string(out)))
@@ -81,6 +86,98 @@ func (m *ImageManager) virtualSize(path string) (int64, error) {
 	return info.VirtualSize, nil
 }
 
+// backingFile returns the absolute path of the image backing path, or "" if
+// it has none.
+func (m *ImageManager) backingFile(path string) (string, error) {
+	out, err := exec.Command("qemu-img", "info", "-U", "--output=json", path).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("qemu-img info: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var info struct {
+		FullBackingFilename string `json:"full-backing-filename"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", fmt.Errorf("parse qemu-img info: %w", err)
+	}
+	return info.FullBackingFilename, nil
+}
+
+// WipeDisk destroys the contents of a disk before removing it. Block devices
+// are discarded with blkdiscard; regular files are overwritten with zeros and
+// synced. It returns the number of bytes wiped and the method used.
+func (m *ImageManager) WipeDisk(path string) (int64, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, "", nil
+		}
+		return 0, "", fmt.Errorf("stat %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		out, err := exec.Command("blkdiscard", "-f", path).CombinedOutput()
+		if err == nil {
+			size, _ := blockDeviceSize(path)
+			return size, "blkdiscard", nil
+		}
+		n, werr := overwriteFile(path)
+		if werr != nil {
+			return n, "overwrite", fmt.Errorf("blkdiscard: %v: %s; overwrite: %w", err, strings.TrimSpace(string(out)), werr)
+		}
+		return n, "overwrite", nil
+	}
+
+	n, err := overwriteFile(path)
+	if err != nil {
+		return n, "overwrite", err
+	}
+	return n, "overwrite", m.RemoveDisk(path)
+}
+
+func overwriteFile(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("size %s: %w", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek %s: %w", path, err)
+	}
+
+	buf := make([]byte, 4<<20)
+	var written int64
+	for written < size {
+		chunk := int64(len(buf))
+		if size-written < chunk {
+			chunk = size - written
+		}
+		n, err := f.Write(buf[:chunk])
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("overwrite %s: %w", path, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return written, fmt.Errorf("sync %s: %w", path, err)
+	}
+	return written, nil
+}
+
+func blockDeviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
 func (m *ImageManager) RemoveDisk(path string) error {
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("remove disk %s: %w", path, err)
@@ -0,0 +1,51 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// guestLabelsJSON holds the labels of the instance as a JSON object.
+	guestLabelsJSON = "/opt/qudata/labels.json"
+	// guestLabelsEnv holds them as QUDATA_LABEL_<KEY> variables, for
+	// sourcing from a shell or as a systemd EnvironmentFile.
+	guestLabelsEnv = "/opt/qudata/labels.env"
+)
+
+// writeLabels writes the labels of the instance to the guest.
+func writeLabels(ctx context.Context, ssh *SSHClient, labels map[string]string) error {
+	data, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ssh.WriteFile(ctx, guestLabelsJSON, string(data)+"\n", 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", guestLabelsJSON, err)
+	}
+	if err := ssh.WriteFile(ctx, guestLabelsEnv, labelsEnv(labels), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", guestLabelsEnv, err)
+	}
+	return nil
+}
+
+// labelsEnv renders labels as an environment file. Keys are upper-cased
+// with dots and dashes turned into underscores; values are double-quoted,
+// which both the shell and systemd unescape.
+func labelsEnv(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	name := strings.NewReplacer(".", "_", "-", "_")
+	value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "QUDATA_LABEL_%s=\"%s\"\n", strings.ToUpper(name.Replace(k)), value.Replace(labels[k]))
+	}
+	return b.String()
+}
@@ -2,20 +2,27 @@ package qemu
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
+	"io"
 	"log/slog"
-	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/crash"
 	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/logfile"
+	"github.com/qudata/agent/internal/system"
+	"github.com/qudata/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Config struct {
@@ -32,6 +39,45 @@ type Config struct {
 	DefaultMemory string
 	DiskSizeGB    int
 	TestMode      bool
+	// SecureWipe wipes instance disks on destroy even if the spec did not ask for it.
+	SecureWipe bool
+	// SRIOVNumVFs, when positive, passes a virtual function of each DefaultGPUs
+	// entry to the guest instead of the whole physical GPU.
+	SRIOVNumVFs int
+	// NetworkIsolation firewalls the guest off from the host and private networks.
+	NetworkIsolation bool
+	// NetAccounting installs a network policy for the traffic counters alone
+	// when neither isolation nor a bandwidth cap needs one.
+	NetAccounting bool
+	// MaxBandwidthMbps caps every instance's traffic in each direction; 0 is no cap.
+	MaxBandwidthMbps int
+	// PowerCapW caps the total GPU power of an instance, split over its GPUs.
+	PowerCapW int
+	// DCGMExporterPort, when set, is the guest port of dcgm-exporter, whose
+	// metrics are collected with the stats of NVIDIA guests.
+	DCGMExporterPort int
+	// RegistryMirrorPort, when set, is the loopback port of the host's
+	// registry cache, which guest Docker daemons are pointed at.
+	RegistryMirrorPort int
+	// DiskEncryption encrypts instance disks even if the spec did not ask
+	// for it.
+	DiskEncryption bool
+	// SwtpmBinary is the TPM emulator started for instances with a TPM.
+	SwtpmBinary string
+	// Confidential is the mode confidential instances run under, "" when
+	// the host supports none.
+	Confidential domain.ConfidentialMode
+	// CVMFirmware overrides the OVMF build confidential instances boot.
+	CVMFirmware string
+	// OVMFSecbootCode and OVMFSecbootVars are the firmware of instances
+	// with Secure Boot.
+	OVMFSecbootCode string
+	OVMFSecbootVars string
+	// PCIDevices are the host PCI devices besides the GPUs that an
+	// instance may ask to be passed through.
+	PCIDevices []string
+	// Disk tunes how instance disks are created and attached.
+	Disk DiskOptions
 }
 
 type Manager struct {
@@ -39,8 +85,11 @@ type Manager struct {
 	qemuBin      string
 	ovmfCode     string
 	ovmfVarsTmpl string
+	secbootCode  string
+	secbootVars  string
 	baseImage    string
 	defaultGPUs  []string
+	pciDevices   []string
 	runDir       string
 	dataDir      string
 	sshKeyPath   string
@@ -48,22 +97,62 @@ type Manager struct {
 	defaultMem   string
 	diskSizeGB   int
 	testMode     bool
+	wipeDefault  bool
+	encryptDisks bool
+	swtpmBin     string
+	confidential domain.ConfidentialMode
+	cvmFirmware  string
+	sriovVFs     int
+	isolate      bool
+	account      bool
+	maxBandwidth int
+	dcgmPort     int
+	mirrorPort   int
 	images       *ImageManager
 
+	// powerCap is the host GPU power cap in Watts, 0 for none; power is the
+	// last reading of the instance's draw.
+	powerMu  sync.Mutex
+	powerCap int
+	power    powerReading
+
+	// diskPrev and netPrev are the previous counter samples, the base for
+	// the rates in the stats.
+	sampleMu sync.Mutex
+	diskPrev diskSample
+	netPrev  netSample
+
 	mu           sync.Mutex
 	vmID         string
-	cmd          *exec.Cmd
+	proc         *os.Process
+	swtpm        *os.Process
 	logFile      *os.File
+	cgroup       *vmCgroup
 	vfios        []*VFIO
 	qmp          *QMPClient
+	qmpDegraded  bool
+	events       func(domain.Event)
+	stages       func(domain.ProvisionStage)
 	sshClient    *SSHClient
 	diskPath     string
 	qmpSocket    string
+	consolePath  string
+	consoleOpen  bool
+	spec         domain.InstanceSpec
 	gpuAddrs     []string
+	gpuVendor    string
 	ovmfVarsPath string
 	done         chan struct{}
 	portPool     map[int]int
-	failed       bool
+	secureWipe   bool
+	lastWipe     *domain.WipeReport
+	// lastBootLog is the end of the serial output of the VM that was
+	// last torn down.
+	lastBootLog []byte
+
+	status       domain.InstanceStatus
+	statusReason domain.StatusReason
+	statusSince  time.Time
 }
 
 func NewManager(cfg Config, logger *slog.Logger) *Manager {
@@ -85,8 +174,11 @@ func NewManager(cfg Config, logger *slog.Logger) *Manager {
 		qemuBin:      cfg.QEMUBinary,
 		ovmfCode:     cfg.OVMFCodePath,
 		ovmfVarsTmpl: cfg.OVMFVarsPath,
+		secbootCode:  cfg.OVMFSecbootCode,
+		secbootVars:  cfg.OVMFSecbootVars,
 		baseImage:    cfg.BaseImagePath,
 		defaultGPUs:  cfg.DefaultGPUs,
+		pciDevices:   cfg.PCIDevices,
 		runDir:       cfg.RunDir,
 		dataDir:      cfg.DataDir,
 		sshKeyPath:   cfg.SSHKeyPath,
@@ -94,8 +186,87 @@ func NewManager(cfg Config, logger *slog.Logger) *Manager {
 		defaultMem:   mem,
 		diskSizeGB:   diskGB,
 		testMode:     cfg.TestMode,
-		images:       NewImageManager(cfg.ImageDir),
+		wipeDefault:  cfg.SecureWipe,
+		encryptDisks: cfg.DiskEncryption,
+		swtpmBin:     cfg.SwtpmBinary,
+		confidential: cfg.Confidential,
+		cvmFirmware:  cfg.CVMFirmware,
+		sriovVFs:     cfg.SRIOVNumVFs,
+		isolate:      cfg.NetworkIsolation,
+		account:      cfg.NetAccounting,
+		dcgmPort:     cfg.DCGMExporterPort,
+		mirrorPort:   cfg.RegistryMirrorPort,
+		powerCap:     cfg.PowerCapW,
+		maxBandwidth: cfg.MaxBandwidthMbps,
+		images:       NewImageManager(cfg.ImageDir, cfg.Disk),
+		status:       domain.StatusDestroyed,
+		statusSince:  time.Now(),
+	}
+}
+
+// SetBaseImage switches the backing image used for new instances. The running
+// instance keeps the image it was created from.
+func (m *Manager) SetBaseImage(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.baseImage = path
+}
+
+// SetStageSink registers a callback for the provisioning stages Create goes
+// through. fn is called with the manager locked and must not call back into it.
+func (m *Manager) SetStageSink(fn func(domain.ProvisionStage)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stages = fn
+}
+
+func (m *Manager) stageLocked(stage domain.ProvisionStage) {
+	if m.stages != nil {
+		m.stages(stage)
+	}
+}
+
+// SetMaxBandwidth changes the host-wide bandwidth cap. It is applied to the
+// running instance at once if that instance has a network policy; otherwise
+// it takes effect with the next instance.
+func (m *Manager) SetMaxBandwidth(mbps int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maxBandwidth == mbps {
+		return
 	}
+	m.maxBandwidth = mbps
+	if m.vmID == "" {
+		return
+	}
+	if m.cgroup == nil {
+		m.logger.Info("bandwidth cap applies to the next instance", "max_bandwidth_mbps", mbps)
+		return
+	}
+	policy := m.policyLocked()
+	if err := policy.apply(m.cgroup); err != nil {
+		m.logger.Error("reapply network policy", "vm_id", m.vmID, "err", err)
+		return
+	}
+	m.logger.Info("network policy updated", "vm_id", m.vmID, "bandwidth_mbps", policy.BandwidthMbps)
+}
+
+// policyLocked builds the network policy of the current instance.
+func (m *Manager) policyLocked() netPolicy {
+	policy := netPolicy{Isolate: m.isolate, Account: m.account, BandwidthMbps: capBandwidth(m.spec.BandwidthMbps, m.maxBandwidth), MirrorPort: m.mirrorPort}
+	for _, hp := range m.portPool {
+		policy.HostPorts = append(policy.HostPorts, hp)
+	}
+	return policy
+}
+
+// capBandwidth applies the host-wide cap to a requested limit; 0 is
+// unlimited for both.
+func capBandwidth(requested, limit int) int {
+	if limit > 0 && (requested == 0 || requested > limit) {
+		return limit
+	}
+	return requested
 }
 
 // KillOrphans finds and kills leftover VMs from previous agent runs,
@@ -114,15 +285,63 @@ func (m *Manager) KillOrphans() {
 	}
 
 	CleanOrphanArtifacts(m.runDir)
+	cleanOrphanNetPolicy()
+	m.unbindIdleGPUs()
+}
 
-	for _, addr := range m.defaultGPUs {
+// unbindIdleGPUs returns every configured GPU, or its VFs, and every
+// configured PCI device that is still bound to vfio-pci to the host, and
+// reports each one. It must only run while no VM is running.
+func (m *Manager) unbindIdleGPUs() []domain.Drift {
+	addrs := m.defaultGPUs
+	if m.sriovVFs > 0 {
+		addrs = nil
+		for _, pf := range m.defaultGPUs {
+			vfs, _ := ListVFs(pf)
+			addrs = append(addrs, vfs...)
+		}
+	}
+	var drift []domain.Drift
+	unbind := func(vfio *VFIO, addr string) {
+		d := domain.Drift{Kind: "vfio_binding", Detail: addr + " is bound to vfio-pci without a VM", Action: "unbind"}
+		if err := vfio.Unbind(); err != nil {
+			d.Error = err.Error()
+		}
+		drift = append(drift, d)
+	}
+	for _, addr := range addrs {
 		vfio := NewVFIO(addr)
 		vfio.RestoreBinding()
 		if vfio.Bound() {
-			m.logger.Info("unbinding orphan GPU from VFIO", "addr", addr)
-			_ = vfio.Unbind()
+			m.logger.Info("unbinding idle GPU from VFIO", "addr", addr)
+			unbind(vfio, addr)
 		}
 	}
+	for _, addr := range m.pciDevices {
+		vfio := NewDeviceVFIO(addr)
+		vfio.RestoreBinding()
+		if vfio.Bound() {
+			m.logger.Info("unbinding idle PCI device from VFIO", "addr", addr)
+			unbind(vfio, addr)
+		}
+	}
+	return drift
+}
+
+// PrepareSRIOV enables the configured number of VFs on every GPU. It is a
+// no-op unless SR-IOV mode is configured.
+func (m *Manager) PrepareSRIOV() error {
+	if m.sriovVFs <= 0 {
+		return nil
+	}
+	for _, pf := range m.defaultGPUs {
+		if err := EnableVFs(pf, m.sriovVFs); err != nil {
+			return err
+		}
+		vfs, _ := ListVFs(pf)
+		m.logger.Info("SR-IOV enabled", "pf", pf, "vfs", vfs)
+	}
+	return nil
 }
 
 // Create boots a new VM with GPU passthrough. hostPorts maps guest ports to
@@ -131,16 +350,64 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.failed = false
-
 	if m.vmID != "" {
 		return nil, domain.ErrInstanceAlreadyRunning{}
 	}
+	if !m.setStatusLocked(domain.StatusProvisioning, "") {
+		return nil, domain.ErrInvalidTransition{From: m.status, To: domain.StatusProvisioning}
+	}
 
 	gpuAddrs := m.defaultGPUs
+	if len(spec.GPUAddrs) > 0 {
+		gpuAddrs = spec.GPUAddrs
+	}
 	if len(gpuAddrs) == 0 {
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
 		return nil, domain.ErrQEMU{Op: "create", Err: fmt.Errorf("no GPU PCI addresses")}
 	}
+	for _, addr := range gpuAddrs {
+		if !slices.Contains(m.defaultGPUs, addr) {
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "create", Err: fmt.Errorf("gpu %s is not configured for passthrough", addr)}
+		}
+	}
+	for _, addr := range spec.Devices {
+		if !slices.Contains(m.pciDevices, addr) {
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "create", Err: fmt.Errorf("pci device %s is not configured for passthrough", addr)}
+		}
+	}
+	if spec.Confidential && m.confidential == "" {
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+		return nil, domain.ErrQEMU{Op: "create", Err: errNoConfidential}
+	}
+	if spec.SecureBoot && (m.secbootCode == "" || m.secbootVars == "") {
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+		return nil, domain.ErrQEMU{Op: "create", Err: errNoSecureBoot}
+	}
+	if spec.VNC != nil && spec.VNC.Port <= vncBasePort {
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+		return nil, domain.ErrQEMU{Op: "create", Err: fmt.Errorf("vnc port %d is not above %d", spec.VNC.Port, vncBasePort)}
+	}
+	// The module parameter is read now: it can be changed by reloading
+	// the module while the agent runs.
+	cpuModel := "host"
+	if spec.Nested {
+		flag, err := nestedCPUFlag(system.Capabilities())
+		if err != nil {
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "create", Err: err}
+		}
+		cpuModel += "," + flag
+	}
+	if m.sriovVFs > 0 {
+		vfs, err := selectVFs(gpuAddrs)
+		if err != nil {
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonVFIOBind)
+			return nil, domain.ErrVFIO{Op: "select VF", Addr: strings.Join(gpuAddrs, ","), Err: err}
+		}
+		gpuAddrs = vfs
+	}
 
 	cpus := spec.CPUs
 	if cpus == "" {
@@ -155,6 +422,11 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		diskGB = m.diskSizeGB
 	}
 
+	phases := tracing.NewPhases(ctx)
+	defer phases.End()
+
+	m.stageLocked(domain.StageBindingGPU)
+	phases.Next("vfio.bind", attribute.StringSlice("gpus", gpuAddrs))
 	var vfios []*VFIO
 	for _, addr := range gpuAddrs {
 		v := NewVFIO(addr)
@@ -162,18 +434,57 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 			for _, bound := range vfios {
 				_ = bound.Unbind()
 			}
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonVFIOBind)
 			return nil, domain.ErrVFIO{Op: "bind", Addr: addr, Err: err}
 		}
 		vfios = append(vfios, v)
 	}
+	// Other devices follow the GPUs and are torn down with them.
+	for _, addr := range spec.Devices {
+		v := NewDeviceVFIO(addr)
+		if err := v.Bind(); err != nil {
+			for _, bound := range vfios {
+				_ = bound.Unbind()
+			}
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonVFIOBind)
+			return nil, domain.ErrVFIO{Op: "bind", Addr: addr, Err: err}
+		}
+		vfios = append(vfios, v)
+	}
+	m.stageLocked(domain.StageBooting)
 
-	vmID := "vm-" + uuid.New().String()[:8]
+	vmID := spec.VMID
+	if vmID == "" {
+		vmID = "vm-" + uuid.New().String()[:8]
+	}
 
-	diskPath, err := m.prepareDisk(vmID, diskGB)
+	phases.Next("disk.prepare", attribute.String("vm_id", vmID), attribute.Int("disk_gb", diskGB))
+	var (
+		diskPath, ovmfVarsPath, statePath string
+		err                               error
+	)
+	// The agent keeps the key only for this call; QEMU reads it at startup.
+	// A generated key is lost with the VM, which makes the disk unreadable
+	// after it. An imported disk keeps the encryption it arrived with, none.
+	var diskKey []byte
+	spec.DiskEncrypted = spec.Import == nil && (spec.DiskEncrypted || m.encryptDisks)
+	if spec.DiskEncrypted {
+		diskKey, err = instanceDiskKey(spec.DiskKey)
+	}
+	spec.DiskKey = nil
+	defer clear(diskKey)
+	switch {
+	case err != nil:
+	case spec.Import != nil:
+		diskPath, ovmfVarsPath, statePath, err = m.adoptImport(vmID, spec.Import)
+	default:
+		diskPath, err = m.prepareDisk(vmID, diskGB, diskKey)
+	}
 	if err != nil {
 		for _, v := range vfios {
 			_ = v.Unbind()
 		}
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonDisk)
 		return nil, domain.ErrQEMU{Op: "disk", Err: err}
 	}
 
@@ -190,6 +501,7 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		for _, v := range vfios {
 			_ = v.Unbind()
 		}
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
 		return nil, domain.ErrQEMU{Op: "ports", Err: fmt.Errorf("not enough host ports: need %d, got %d", len(guestPorts), len(hostPorts))}
 	}
 
@@ -208,22 +520,62 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		for _, v := range vfios {
 			_ = v.Unbind()
 		}
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
 		return nil, domain.ErrQEMU{Op: "rundir", Err: err}
 	}
 
-	ovmfVarsPath, err := m.copyOVMFVars(vmID)
+	if ovmfVarsPath == "" && !spec.Confidential {
+		ovmfVarsPath, err = m.copyOVMFVars(vmID, spec.SecureBoot)
+	}
 	if err != nil {
 		_ = m.images.RemoveDisk(diskPath)
 		for _, v := range vfios {
 			_ = v.Unbind()
 		}
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
 		return nil, domain.ErrQEMU{Op: "ovmf", Err: err}
 	}
 
+	var (
+		swtpm     *os.Process
+		tpmSocket string
+	)
+	if spec.TPM {
+		swtpm, tpmSocket, err = m.startSwtpm(vmID)
+		if err != nil {
+			_ = m.images.RemoveDisk(diskPath)
+			removeTPMState(m.runDir, vmID)
+			for _, v := range vfios {
+				_ = v.Unbind()
+			}
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "swtpm", Err: err}
+		}
+	}
+
 	qmpSocket := filepath.Join(m.runDir, vmID+".qmp")
-	args := m.buildVMArgs(diskPath, gpuAddrs, qmpSocket, netCfg, cpus, mem, ovmfVarsPath)
+	consolePath := filepath.Join(m.runDir, vmID+".console")
+	serialLog := serialLogPath(m.runDir, vmID)
+	// QEMU appends to the log so that rotation can truncate it in place;
+	// drop whatever an earlier attempt with this ID left.
+	logfile.RemoveAll(serialLog)
+	args := m.buildVMArgs(diskPath, vfios, qmpSocket, consolePath, serialLog, netCfg, cpuModel, cpus, mem, ovmfVarsPath, spec)
+	args = append(args, volumeDriveArgs(spec.Volumes, m.images.opts)...)
+	args = append(args, usbArgs(spec.USB)...)
+	if tpmSocket != "" {
+		args = append(args, tpmArgs(tpmSocket)...)
+	}
+	if spec.Hugepages {
+		// Back guest RAM with the host's preallocated huge pages.
+		args = append(args, "-mem-path", hugepagesMount, "-mem-prealloc")
+	}
+	if statePath != "" {
+		// Resume a live-migrated guest from its saved state.
+		args = append(args, "-incoming", "exec:cat "+shellQuote(statePath))
+	}
 
-	logFile, _ := os.Create(filepath.Join(m.runDir, vmID+".log"))
+	// Opened for appending so that the agent can rotate it under QEMU.
+	logFile, _ := logfile.OpenAppend(filepath.Join(m.runDir, vmID+".log"))
 
 	m.logger.Info("starting VM", "vm_id", vmID, "gpus", gpuAddrs, "cpus", cpus, "mem", mem)
 
@@ -232,27 +584,85 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		cmd.Stdout = logFile
 		cmd.Stderr = logFile
 	}
+	var diskSecret *os.File
+	if spec.DiskEncrypted {
+		diskSecret, err = secretPipe(diskKey)
+		if err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			_ = m.images.RemoveDisk(diskPath)
+			stopSwtpm(swtpm)
+			removeTPMState(m.runDir, vmID)
+			for _, v := range vfios {
+				_ = v.Unbind()
+			}
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "disk key", Err: err}
+		}
+		defer diskSecret.Close()
+		cmd.ExtraFiles = []*os.File{diskSecret}
+	}
+
+	policy := netPolicy{Isolate: m.isolate, Account: m.account, BandwidthMbps: capBandwidth(spec.BandwidthMbps, m.maxBandwidth), MirrorPort: m.mirrorPort}
+	for _, hp := range pool {
+		policy.HostPorts = append(policy.HostPorts, hp)
+	}
+	var cg *vmCgroup
+	if policy.enabled() {
+		cg, err = newVMCgroup(vmID)
+		if err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			_ = m.images.RemoveDisk(diskPath)
+			stopSwtpm(swtpm)
+			removeTPMState(m.runDir, vmID)
+			for _, v := range vfios {
+				_ = v.Unbind()
+			}
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			return nil, domain.ErrQEMU{Op: "cgroup", Err: err}
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cg.fd.Fd())}
+	}
 
+	phases.Next("qemu.start")
 	if err := cmd.Start(); err != nil {
 		if logFile != nil {
 			logFile.Close()
 		}
+		if cg != nil {
+			cg.remove()
+		}
 		_ = m.images.RemoveDisk(diskPath)
+		stopSwtpm(swtpm)
+		removeTPMState(m.runDir, vmID)
 		for _, v := range vfios {
 			_ = v.Unbind()
 		}
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonQEMUStart)
 		return nil, domain.ErrQEMU{Op: "start", Err: err}
 	}
 
 	m.vmID = vmID
-	m.cmd = cmd
+	m.lastBootLog = nil
+	m.proc = cmd.Process
+	m.swtpm = swtpm
 	m.logFile = logFile
+	m.cgroup = cg
 	m.vfios = vfios
 	m.portPool = pool
 	m.diskPath = diskPath
 	m.qmpSocket = qmpSocket
+	m.consolePath = consolePath
+	m.spec = spec
+	m.spec.CPUs, m.spec.Memory, m.spec.DiskSizeGB = cpus, mem, diskGB
+	m.spec.Import = nil
 	m.gpuAddrs = gpuAddrs
+	m.gpuVendor = GPUVendor(gpuAddrs[0])
 	m.ovmfVarsPath = ovmfVarsPath
+	m.secureWipe = spec.SecureWipe || m.wipeDefault
 
 	m.done = make(chan struct{})
 	go func() {
@@ -263,36 +673,96 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		close(m.done)
 	}()
 
+	// Without its monitor the VM could not be paused, resized or shut down
+	// cleanly, so a QMP timeout fails the create.
+	phases.Next("qmp.connect")
 	qmpClient := NewQMPClient(qmpSocket)
 	if err := m.waitForQMP(qmpClient, 30*time.Second); err != nil {
-		m.logger.Warn("QMP connect failed", "err", err)
-	} else {
-		m.qmp = qmpClient
+		// The log is removed with the VM; keep its end for diagnosis.
+		m.logger.Error("QMP connect failed", "vm_id", vmID, "err", err, "qemu_log", qemuLogTail(filepath.Join(m.runDir, vmID+".log")))
+		m.setStatusLocked(domain.StatusFailed, domain.ReasonQMPUnavailable)
+		m.forceKill()
+		m.stopLocked(context.Background())
+		return nil, domain.ErrQEMU{Op: "qmp", Err: err}
+	}
+	m.qmp = qmpClient
+	done := m.done
+	crash.Go("qmp watchdog", func() { m.watchQMP(qmpClient, done) })
+
+	if spec.VNC != nil {
+		if err := qmpClient.SetVNCPassword(spec.VNC.Password); err != nil {
+			m.logger.Warn("VNC password not set, display locked", "vm_id", vmID, "err", err)
+		}
+	}
+
+	if spec.CPUPinning != "" && spec.CPUPinning != domain.PinningNone {
+		if err := m.pinVCPUs(qmpClient, spec.CPUPinning, gpuAddrs); err != nil {
+			m.logger.Warn("vCPUs not pinned", "vm_id", vmID, "policy", spec.CPUPinning, "err", err)
+		}
 	}
 
 	m.logger.Info("VM started", "vm_id", vmID, "pid", cmd.Process.Pid)
 
+	if cg != nil {
+		phases.Next("network.policy")
+		cg.closeFD()
+		if err := policy.apply(cg); err != nil {
+			m.logger.Error("network policy not applied", "err", err)
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonCreateFailed)
+			m.stopLocked(context.Background())
+			return nil, domain.ErrQEMU{Op: "network policy", Err: err}
+		}
+		m.logger.Info("network policy applied", "vm_id", vmID,
+			"isolated", policy.Isolate, "bandwidth_mbps", policy.BandwidthMbps)
+	}
+	m.setStatusLocked(domain.StatusBooting, "")
+
 	sshPort, hasSSH := pool[22]
 	if hasSSH {
 		sshClient := NewSSHClient("127.0.0.1", sshPort, m.sshKeyPath)
 
+		m.stageLocked(domain.StageWaitingSSH)
+		phases.Next("ssh.wait")
 		m.mu.Unlock()
 		sshErr := sshClient.WaitForBoot(ctx, 180*time.Second)
 		m.mu.Lock()
 
 		// VM could have been destroyed by Stop() while we waited.
 		if m.vmID == "" {
+			_ = sshClient.Close()
 			return nil, fmt.Errorf("VM destroyed while waiting for SSH")
 		}
 
 		if sshErr != nil {
-			m.logger.Error("VM SSH timeout", "err", sshErr)
+			_ = sshClient.Close()
+			// A guest that never reached SSH usually says why on its
+			// serial console.
+			console := lastLines(readTail(serialLogPath(m.runDir, vmID), maxBootLog), sshErrorTail)
+			m.logger.Error("VM SSH timeout", "err", sshErr, "console", console)
+			if m.status != domain.StatusFailed {
+				m.setStatusLocked(domain.StatusFailed, domain.ReasonSSHTimeout)
+			}
 			m.stopLocked(context.Background())
+			if console != "" {
+				return nil, fmt.Errorf("VM SSH not ready: %w; console: %s", sshErr, console)
+			}
 			return nil, fmt.Errorf("VM SSH not ready: %w", sshErr)
 		}
 
 		m.sshClient = sshClient
 		m.logger.Info("VM SSH ready", "vm_id", vmID)
+		m.setStatusLocked(domain.StatusConfiguring, "")
+		m.stageLocked(domain.StageConfiguring)
+		phases.Next("guest.configure")
+		if m.events != nil {
+			m.events(domain.Event{
+				Type:     domain.EventInstanceSSHReady,
+				Severity: domain.SeverityInfo,
+				Message:  "instance accepts SSH connections",
+				Data:     map[string]any{"vm_id": vmID},
+				Time:     time.Now().UTC(),
+			})
+		}
 
 		// Persist management key in a location that survives cloud-init.
 		// Cloud-init may overwrite /root/.ssh/authorized_keys on boot,
@@ -316,18 +786,20 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 			}
 		}
 
-		// Set root password and log it.
-		rootPass := generatePassword(16)
-		if out, err := sshClient.Run(ctx, fmt.Sprintf("echo 'root:%s' | chpasswd", rootPass)); err != nil {
-			m.logger.Warn("failed to set root password", "err", err, "output", string(out))
-		} else {
-			m.logger.Info("VM root credentials", "username", "root", "password", rootPass)
+		// The password is returned to the caller by the API, never logged.
+		passwordAuth := "no"
+		if spec.RootPassword != "" {
+			if err := setRootPassword(ctx, sshClient, spec.RootPassword); err != nil {
+				m.logger.Warn("failed to set root password", "err", err)
+			} else {
+				passwordAuth = "yes"
+			}
 		}
 
-		// Allow PasswordAuthentication, enable SSH keepalive (prevents idle
-		// tunnel disconnects through FRP/SLIRP chain), and reload sshd
-		// (also picks up management_keys).
-		hardenSSH := `sed -i 's/^#*PasswordAuthentication.*/PasswordAuthentication yes/' /etc/ssh/sshd_config && ` +
+		// Allow PasswordAuthentication only with a password set, enable SSH
+		// keepalive (prevents idle tunnel disconnects through FRP/SLIRP
+		// chain), and reload sshd (also picks up management_keys).
+		hardenSSH := `sed -i 's/^#*PasswordAuthentication.*/PasswordAuthentication ` + passwordAuth + `/' /etc/ssh/sshd_config && ` +
 			`sed -i 's/^#*ClientAliveInterval.*/ClientAliveInterval 30/' /etc/ssh/sshd_config && ` +
 			`grep -q '^ClientAliveInterval' /etc/ssh/sshd_config || echo 'ClientAliveInterval 30' >> /etc/ssh/sshd_config && ` +
 			`sed -i 's/^#*ClientAliveCountMax.*/ClientAliveCountMax 3/' /etc/ssh/sshd_config && ` +
@@ -336,8 +808,72 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 		if out, err := sshClient.Run(ctx, hardenSSH); err != nil {
 			m.logger.Warn("failed to harden sshd config", "err", err, "output", string(out))
 		}
+
+		if spec.SecureBoot {
+			if on, err := guestSecureBoot(ctx, sshClient); err != nil || !on {
+				m.logger.Warn("guest does not enforce Secure Boot", "vm_id", vmID, "err", err)
+				if m.events != nil {
+					m.events(domain.Event{
+						Type:     domain.EventSecureBootOff,
+						Severity: domain.SeverityWarning,
+						Message:  "Secure Boot is not enforced in the guest",
+						Data:     map[string]any{"vm_id": vmID},
+						Time:     time.Now().UTC(),
+					})
+				}
+			}
+		}
+
+		// Written before the containers start, so that they can take the
+		// env file; an imported guest keeps its own.
+		if len(spec.Labels) > 0 && spec.Import == nil {
+			if err := writeLabels(ctx, sshClient, spec.Labels); err != nil {
+				m.logger.Warn("failed to write labels to the guest", "err", err)
+			}
+		}
+
+		// Volumes are mounted before the containers, which may use them.
+		if len(spec.Volumes) > 0 {
+			if err := mountVolumes(ctx, sshClient, spec.Volumes); err != nil {
+				m.logger.Warn("failed to mount volumes", "err", err)
+			} else {
+				m.logger.Info("volumes mounted", "vm_id", vmID, "volumes", len(spec.Volumes))
+			}
+		}
+
+		// An imported guest may be running containers a daemon restart
+		// would stop; it keeps the mirror it was configured with.
+		if m.mirrorPort > 0 && spec.Import == nil {
+			if err := configureRegistryMirror(ctx, sshClient, m.mirrorPort); err != nil {
+				m.logger.Warn("failed to configure registry mirror", "err", err)
+			}
+		}
+		if spec.Compose != "" && spec.Import == nil {
+			if err := startContainers(ctx, sshClient, spec.Compose); err != nil {
+				m.logger.Warn("failed to start containers", "err", err)
+				if m.events != nil {
+					m.events(domain.Event{
+						Type:     domain.EventContainersFailed,
+						Severity: domain.SeverityWarning,
+						Message:  "containers not started: " + err.Error(),
+						Data:     map[string]any{"vm_id": vmID},
+						Time:     time.Now().UTC(),
+					})
+				}
+			} else {
+				m.logger.Info("containers starting", "vm_id", vmID, "unit", domain.ComposeUnit)
+			}
+		}
+
+		if watts := m.PowerCap(); watts > 0 {
+			if err := applyPowerCap(ctx, sshClient, m.gpuVendor, watts, len(gpuAddrs)); err != nil {
+				m.logger.Warn("failed to apply GPU power cap", "watts", watts, "err", err)
+			}
+		}
 	}
 
+	m.setStatusLocked(domain.StatusRunning, "")
+
 	portMap := make(domain.InstancePorts, len(pool))
 	for gp, hp := range pool {
 		portMap[strconv.Itoa(gp)] = strconv.Itoa(hp)
@@ -347,10 +883,43 @@ func (m *Manager) Create(ctx context.Context, spec domain.InstanceSpec, hostPort
 }
 
 // Stop gracefully shuts down the VM and releases GPU back to the host.
+// A failed instance is cleared back to destroyed.
 func (m *Manager) Stop(ctx context.Context) error {
+	_, err := m.Destroy(ctx, false)
+	return err
+}
+
+// Destroy stops the VM and releases its resources. The disks are securely
+// wiped if the instance requested it, the agent is configured to, or
+// secureWipe is set; the report is nil when no wipe took place.
+func (m *Manager) Destroy(ctx context.Context, secureWipe bool) (*domain.WipeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" {
+		if m.status == domain.StatusFailed {
+			m.setStatusLocked(domain.StatusDestroyed, "")
+		}
+		return nil, nil
+	}
+
+	if secureWipe {
+		m.secureWipe = true
+	}
+
+	m.setStatusLocked(domain.StatusStopping, "")
+	err := m.stopLocked(ctx)
+	report := m.lastWipe
+	m.lastWipe = nil
+	m.setStatusLocked(domain.StatusDestroyed, "")
+	return report, err
+}
+
+// SecureWipe reports whether destroying the current instance wipes its disks.
+func (m *Manager) SecureWipe() bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.stopLocked(ctx)
+	return m.secureWipe
 }
 
 func (m *Manager) stopLocked(ctx context.Context) error {
@@ -365,12 +934,28 @@ func (m *Manager) stopLocked(ctx context.Context) error {
 	}
 
 	if m.done != nil {
-		select {
-		case <-m.done:
-			m.logger.Info("VM exited gracefully")
-		case <-time.After(30 * time.Second):
-			m.logger.Warn("VM did not exit in time, killing")
-			m.forceKill()
+		// With -no-shutdown QEMU outlives the guest, so it is told to quit
+		// once the guest has powered off.
+		poll := time.NewTicker(500 * time.Millisecond)
+		defer poll.Stop()
+		deadline := time.After(30 * time.Second)
+	wait:
+		for {
+			select {
+			case <-m.done:
+				m.logger.Info("VM exited gracefully")
+				break wait
+			case <-poll.C:
+				if m.qmp != nil && !m.qmpDegraded {
+					if s, _, err := m.qmp.QueryStatus(); err == nil && s == "shutdown" {
+						_ = m.qmp.Quit()
+					}
+				}
+			case <-deadline:
+				m.logger.Warn("VM did not exit in time, killing")
+				m.forceKill()
+				break wait
+			}
 		}
 	}
 
@@ -378,7 +963,8 @@ func (m *Manager) stopLocked(ctx context.Context) error {
 	return nil
 }
 
-// Manage executes a lifecycle command (pause/resume/reboot) on the running VM.
+// Manage executes a lifecycle command (pause/resume/reboot) on the running
+// VM. Start also boots a guest that powered itself off.
 func (m *Manager) Manage(ctx context.Context, cmd domain.InstanceCommand) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -386,28 +972,57 @@ func (m *Manager) Manage(ctx context.Context, cmd domain.InstanceCommand) error
 	if m.vmID == "" {
 		return domain.ErrNoInstanceRunning{}
 	}
+
+	switch cmd {
+	case domain.CommandStart, domain.CommandStop, domain.CommandReboot:
+	default:
+		return domain.ErrUnknownCommand{Command: string(cmd)}
+	}
+
+	m.observeLocked()
+	if !domain.CommandAllowed(m.status, cmd) {
+		return domain.ErrCommandNotAllowed{Command: cmd, Status: m.status}
+	}
 	if m.qmp == nil || !m.qmp.Connected() {
 		return domain.ErrQEMU{Op: "manage", Err: fmt.Errorf("QMP not connected")}
 	}
+	if m.qmpDegraded {
+		return domain.ErrQEMU{Op: "manage", Err: fmt.Errorf("QMP monitor not responding")}
+	}
 
 	switch cmd {
 	case domain.CommandStart:
-		return m.qmp.Resume()
+		if m.status == domain.StatusStopped {
+			// The guest powered off; a reset boots it again from the same
+			// disk, and QEMU waits in the shutdown state until resumed.
+			if err := m.qmp.Reset(); err != nil {
+				return err
+			}
+		}
+		if err := m.qmp.Resume(); err != nil {
+			return err
+		}
+		m.setStatusLocked(domain.StatusRunning, "")
 	case domain.CommandStop:
-		return m.qmp.Pause()
+		if err := m.qmp.Pause(); err != nil {
+			return err
+		}
+		m.setStatusLocked(domain.StatusPaused, "")
 	case domain.CommandReboot:
 		return m.qmp.Reset()
-	default:
-		return domain.ErrUnknownCommand{Command: string(cmd)}
 	}
+	return nil
 }
 
-// MarkFailed sets the manager into a failed state so that Status returns StatusError.
-// This is used when instance creation fails before the VM process starts.
-func (m *Manager) MarkFailed() {
+// MarkFailed moves the manager into the failed state with the given reason.
+// This is used when instance creation fails outside of the manager itself.
+func (m *Manager) MarkFailed(reason domain.StatusReason) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.failed = true
+	if m.status == domain.StatusFailed {
+		return
+	}
+	m.setStatusLocked(domain.StatusFailed, reason)
 }
 
 // Invalidate clears the cached SSH client immediately so that subsequent
@@ -415,37 +1030,77 @@ func (m *Manager) MarkFailed() {
 func (m *Manager) Invalidate() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.sshClient = nil
+	if m.sshClient != nil {
+		_ = m.sshClient.Close()
+		m.sshClient = nil
+	}
 }
 
-// Status returns the current lifecycle status of the VM.
-func (m *Manager) Status(ctx context.Context) domain.InstanceStatus {
+// Status returns the current lifecycle status of the VM, refreshed against
+// the QEMU process and QMP run state.
+func (m *Manager) Status(ctx context.Context) domain.StatusInfo {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.observeLocked()
+	return domain.StatusInfo{Status: m.status, Reason: m.statusReason, Since: m.statusSince}
+}
 
+// observeLocked reconciles the recorded status with what the QEMU process and
+// QMP report. Transitional states owned by Create/Stop are left untouched.
+// Must be called with m.mu held.
+func (m *Manager) observeLocked() {
 	if m.vmID == "" {
-		if m.failed {
-			return domain.StatusError
-		}
-		return domain.StatusDestroyed
+		return
 	}
 
 	if m.done != nil {
 		select {
 		case <-m.done:
-			return domain.StatusError
+			m.setStatusLocked(domain.StatusFailed, domain.ReasonQEMUExited)
+			return
 		default:
 		}
 	}
 
-	if m.qmp != nil && m.qmp.Connected() {
-		status, _, err := m.qmp.QueryStatus()
-		if err == nil {
-			return mapQMPStatus(status)
-		}
+	switch m.status {
+	case domain.StatusRunning, domain.StatusDegraded, domain.StatusPaused, domain.StatusStopped:
+	default:
+		return
 	}
 
-	return domain.StatusRunning
+	if m.qmp == nil {
+		m.setStatusLocked(domain.StatusDegraded, domain.ReasonQMPUnavailable)
+		return
+	}
+	if m.qmpDegraded {
+		// Querying a hung monitor would block for the full read deadline.
+		m.setStatusLocked(domain.StatusDegraded, domain.ReasonQMPHung)
+		return
+	}
+	qmpStatus, _, err := m.qmp.QueryStatus()
+	if err != nil {
+		m.setStatusLocked(domain.StatusDegraded, domain.ReasonQMPUnavailable)
+		return
+	}
+	status, reason := mapQMPStatus(qmpStatus)
+	m.setStatusLocked(status, reason)
+}
+
+// setStatusLocked moves to status `to` if the lifecycle allows it and reports
+// whether the transition happened. Must be called with m.mu held.
+func (m *Manager) setStatusLocked(to domain.InstanceStatus, reason domain.StatusReason) bool {
+	if m.status == to && m.statusReason == reason {
+		return true
+	}
+	if !domain.CanTransition(m.status, to) {
+		m.logger.Warn("rejected status transition", "from", m.status, "to", to, "reason", reason)
+		return false
+	}
+	m.logger.Info("instance status changed", "from", m.status, "to", to, "reason", reason)
+	m.status = to
+	m.statusReason = reason
+	m.statusSince = time.Now()
+	return true
 }
 
 func (m *Manager) VMID() string {
@@ -454,6 +1109,33 @@ func (m *Manager) VMID() string {
 	return m.vmID
 }
 
+// NetCounters returns the instance's cumulative received and sent bytes.
+// ok is false when no network policy, and so no counter, is installed.
+func (m *Manager) NetCounters() (rx, tx uint64, ok bool) {
+	m.mu.Lock()
+	active := m.cgroup != nil
+	m.mu.Unlock()
+	if !active {
+		return 0, 0, false
+	}
+	rx, tx, err := readNetCounters()
+	if err != nil {
+		m.logger.Debug("read instance net counters", "err", err)
+		return 0, 0, false
+	}
+	return rx, tx, true
+}
+
+func (m *Manager) GPUAddrs() []string {
+	return append([]string(nil), m.defaultGPUs...)
+}
+
+func (m *Manager) AttachedGPUs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.gpuAddrs...)
+}
+
 func (m *Manager) HostPortForGuest(guestPort int) (int, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -465,47 +1147,88 @@ func (m *Manager) HostPortForGuest(guestPort int) (int, bool) {
 func (m *Manager) CollectStats(ctx context.Context) *domain.StatsSnapshot {
 	m.mu.Lock()
 	ssh := m.sshClient
+	vendor := m.gpuVendor
 	m.mu.Unlock()
 
 	if ssh == nil {
 		return nil
 	}
+	disk := m.collectDisk()
+	network := m.collectNet()
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	// Single SSH call: GPU (nvidia-smi) + CPU/RAM (from /proc).
-	cmd := `nvidia-smi --query-gpu=utilization.gpu,temperature.gpu,memory.used,memory.total --format=csv,noheader,nounits 2>/dev/null; ` +
+	// Single SSH call: GPU (nvidia-smi or rocm-smi) + CPU/RAM (from /proc).
+	cmd := gpuStatsCmd(vendor) + `; ` +
 		`echo "---"; ` +
 		`awk '{u=$2+$4; t=$2+$4+$5; if(NR>1) printf "%.1f\n", (u-pu)/(t-pt)*100; pu=u; pt=t}' <(head -1 /proc/stat; sleep 0.3; head -1 /proc/stat); ` +
 		`awk '/MemTotal/{t=$2} /MemAvailable/{a=$2} END{printf "%.1f\n", (t-a)/t*100}' /proc/meminfo`
+	if m.dcgmPort > 0 && vendor != VendorAMD {
+		cmd += `; echo "---"; ` + dcgmStatsCmd(m.dcgmPort)
+	}
 
 	out, err := ssh.Run(ctx, cmd)
 	if err != nil {
+		if disk != nil || network != nil {
+			return &domain.StatsSnapshot{Disk: disk, Net: network}
+		}
 		return nil
 	}
 
-	return parseVMStats(string(out))
+	snap := parseVMStats(string(out))
+	snap.Disk = disk
+	snap.Net = network
+	m.observePower(ctx, ssh, snap)
+	return snap
 }
 
 func parseVMStats(output string) *domain.StatsSnapshot {
-	parts := strings.SplitN(output, "---\n", 2)
+	parts := strings.SplitN(output, "---\n", 3)
 	snap := &domain.StatsSnapshot{}
 
-	// GPU part (before "---")
+	// GPU part (before "---"): JSON from rocm-smi or CSV from nvidia-smi.
 	if len(parts) >= 1 {
 		gpuLine := strings.TrimSpace(parts[0])
-		if gpuLine != "" {
-			fields := strings.Split(gpuLine, ",")
-			if len(fields) >= 4 {
-				snap.GPUUtil, _ = strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
-				snap.GPUTemp, _ = strconv.Atoi(strings.TrimSpace(fields[1]))
-				memUsed, _ := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
-				memTotal, _ := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
-				if memTotal > 0 {
-					snap.MemUtil = memUsed / memTotal * 100
+		if strings.HasPrefix(gpuLine, "{") {
+			if gm, err := parseROCmMetrics(gpuLine); err == nil {
+				snap.GPUUtil = gm.Utilization
+				snap.GPUTemp = gm.Temperature
+				if gm.MemoryTotal > 0 {
+					snap.MemUtil = float64(gm.MemoryUsed) / float64(gm.MemoryTotal) * 100
 				}
 			}
+		} else if gpuLine != "" {
+			// One line per GPU: utilization is averaged, temperature is the
+			// hottest GPU, memory is pooled and power is summed.
+			var util, memUsed, memTotal float64
+			gpus := 0
+			for _, line := range strings.Split(gpuLine, "\n") {
+				fields := strings.Split(line, ",")
+				if len(fields) < 4 {
+					continue
+				}
+				u, _ := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+				temp, _ := strconv.Atoi(strings.TrimSpace(fields[1]))
+				used, _ := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+				total, _ := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+				util, memUsed, memTotal = util+u, memUsed+used, memTotal+total
+				snap.GPUTemp = max(snap.GPUTemp, temp)
+				if len(fields) >= 6 {
+					// "[N/A]" on GPUs without power readings parses as 0.
+					draw, _ := strconv.ParseFloat(strings.TrimSpace(fields[4]), 64)
+					limit, _ := strconv.ParseFloat(strings.TrimSpace(fields[5]), 64)
+					snap.GPUPower += draw
+					snap.GPUPowerLimit += limit
+				}
+				gpus++
+			}
+			if gpus > 0 {
+				snap.GPUUtil = util / float64(gpus)
+			}
+			if memTotal > 0 {
+				snap.MemUtil = memUsed / memTotal * 100
+			}
 		}
 	}
 
@@ -520,6 +1243,11 @@ func parseVMStats(output string) *domain.StatsSnapshot {
 		}
 	}
 
+	// DCGM part, when dcgm-exporter is scraped: Prometheus text format.
+	if len(parts) >= 3 {
+		snap.DCGM = parseDCGM(parts[2])
+	}
+
 	return snap
 }
 
@@ -574,6 +1302,41 @@ func (m *Manager) AddSSHKey(_ context.Context, pubkey string) error {
 	return nil
 }
 
+// SetRootPassword changes the guest root password.
+func (m *Manager) SetRootPassword(_ context.Context, password string) error {
+	if m.VMID() == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	ssh, err := m.awaitSSH(ctx)
+	if err != nil {
+		return err
+	}
+	if err := setRootPassword(ctx, ssh, password); err != nil {
+		return err
+	}
+	// Instances created without a password had password login turned off.
+	enable := `sed -i 's/^#*PasswordAuthentication.*/PasswordAuthentication yes/' /etc/ssh/sshd_config && ` +
+		`(systemctl reload sshd 2>/dev/null || systemctl reload ssh 2>/dev/null; true)`
+	if out, err := ssh.Run(ctx, enable); err != nil {
+		m.logger.Warn("failed to enable password login", "err", err, "output", strings.TrimSpace(string(out)))
+	}
+	m.logger.Info("root password changed")
+	return nil
+}
+
+// setRootPassword runs chpasswd in the guest. password must not contain
+// quotes.
+func setRootPassword(ctx context.Context, ssh *SSHClient, password string) error {
+	out, err := ssh.Run(ctx, fmt.Sprintf("echo '%s:%s' | chpasswd", domain.RootUser, password))
+	if err != nil {
+		return fmt.Errorf("set root password: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func (m *Manager) RemoveSSHKey(_ context.Context, pubkey string) error {
 	pubkey = strings.TrimSpace(pubkey)
 	if pubkey == "" {
@@ -596,7 +1359,54 @@ func (m *Manager) RemoveSSHKey(_ context.Context, pubkey string) error {
 	return nil
 }
 
-func (m *Manager) prepareDisk(vmID string, sizeGB int) (string, error) {
+// OpenConsole connects to the guest's first serial port. QEMU serves the
+// chardev to a single client, so concurrent sessions are rejected.
+func (m *Manager) OpenConsole(ctx context.Context) (io.ReadWriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" || m.consolePath == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	if m.consoleOpen {
+		return nil, domain.ErrConsoleBusy{}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", m.consolePath)
+	if err != nil {
+		return nil, domain.ErrQEMU{Op: "console", Err: err}
+	}
+	m.consoleOpen = true
+	return &consoleConn{Conn: conn, release: m.releaseConsole}, nil
+}
+
+func (m *Manager) releaseConsole() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consoleOpen = false
+}
+
+// consoleConn frees the console slot when the session is closed.
+type consoleConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *consoleConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (m *Manager) prepareDisk(vmID string, sizeGB int, key []byte) (string, error) {
+	if key != nil {
+		if sizeGB == 0 && m.baseImage == "" {
+			sizeGB = m.diskSizeGB
+		}
+		return m.images.CreateEncryptedDisk(vmID, m.baseImage, sizeGB, key)
+	}
 	if m.baseImage != "" {
 		path, err := m.images.CreateOverlay(vmID, m.baseImage)
 		if err != nil {
@@ -616,47 +1426,88 @@ func (m *Manager) prepareDisk(vmID string, sizeGB int) (string, error) {
 	return m.images.CreateDisk(vmID, sizeGB)
 }
 
-func (m *Manager) buildVMArgs(diskPath string, gpuAddrs []string, qmpSocket string, net *NetworkConfig, cpus, mem, ovmfVarsPath string) []string {
+func (m *Manager) buildVMArgs(diskPath string, gpus []*VFIO, qmpSocket, consolePath, serialLog string, net *NetworkConfig, cpuModel, cpus, mem, ovmfVarsPath string, spec domain.InstanceSpec) []string {
+	machine := "q35,accel=kvm"
+	var fwArgs []string
+	if spec.Confidential {
+		var opts string
+		opts, fwArgs = m.confidentialArgs()
+		machine += opts
+		ovmfVarsPath = ""
+	}
+	ovmfCode := m.ovmfCode
+	if spec.SecureBoot {
+		// The Secure Boot firmware keeps its variables in SMM, out of the
+		// guest kernel's reach, so that it cannot change the keys.
+		machine += ",smm=on"
+		fwArgs = append(fwArgs, "-global", "driver=cfi.pflash01,property=secure,value=on")
+		ovmfCode = m.secbootCode
+	}
 	args := []string{
-		"-machine", "q35,accel=kvm",
+		"-machine", machine,
 		"-global", "q35-pcihost.pci-hole64-size=64G",
-		"-cpu", "host",
+		"-cpu", cpuModel,
 		"-smp", cpus,
 		"-m", strings.ToUpper(strings.TrimSpace(mem)),
 	}
-	if m.ovmfCode != "" && ovmfVarsPath != "" {
+	args = append(args, fwArgs...)
+	if ovmfCode != "" && ovmfVarsPath != "" {
 		args = append(args,
-			"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", m.ovmfCode),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", ovmfCode),
 			"-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", ovmfVarsPath),
 		)
 	}
-	args = append(args,
-		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", diskPath),
-	)
-	for i, addr := range gpuAddrs {
+	drive := fmt.Sprintf("file=%s,format=qcow2,if=virtio,id=%s", diskPath, diskDriveID) + m.images.opts.driveOpts()
+	if spec.DiskEncrypted {
+		args = append(args, "-object", diskSecretObject)
+		drive += ",encrypt.key-secret=" + diskSecretID
+	}
+	args = append(args, "-drive", drive)
+	// Each GPU gets its own root port; its audio functions share the slot
+	// as further functions, as on the host. Other devices come after the
+	// GPUs, one per port as well.
+	for i, v := range gpus {
 		portID := fmt.Sprintf("pci.%d", i+1)
 		args = append(args,
 			"-device", fmt.Sprintf("pcie-root-port,id=%s,bus=pcie.0", portID),
 		)
-		vfioDev := fmt.Sprintf("vfio-pci,host=%s,bus=%s,rombar=0", addr, portID)
+		companions := v.Companions()
+		vfioDev := fmt.Sprintf("vfio-pci,host=%s,bus=%s,rombar=0", v.addr, portID)
+		if len(companions) > 0 {
+			vfioDev += ",addr=0x0.0,multifunction=on"
+		}
 		args = append(args, "-device", vfioDev)
+		for fn, addr := range companions {
+			args = append(args, "-device", fmt.Sprintf("vfio-pci,host=%s,bus=%s,addr=0x0.%d", addr, portID, fn+1))
+		}
 	}
 	args = append(args,
 		"-qmp", fmt.Sprintf("unix:%s,server,nowait", qmpSocket),
-		"-nographic",
+		// A guest that powers itself off leaves QEMU running and stopped,
+		// with its GPUs and ports held, so that it can be started again.
+		"-no-shutdown",
+		"-chardev", fmt.Sprintf("socket,id=serial0,path=%s,server=on,wait=off,logfile=%s,logappend=on", consolePath, serialLog),
+		"-serial", "chardev:serial0",
 	)
+	args = append(args, displayArgs(spec.VNC)...)
 	args = append(args, net.Args()...)
 	return args
 }
 
-func (m *Manager) copyOVMFVars(vmID string) (string, error) {
-	if m.ovmfVarsTmpl == "" {
+// copyOVMFVars gives vmID its own variable store, from the template with
+// the Secure Boot keys enrolled when secureBoot is set.
+func (m *Manager) copyOVMFVars(vmID string, secureBoot bool) (string, error) {
+	tmpl := m.ovmfVarsTmpl
+	if secureBoot {
+		tmpl = m.secbootVars
+	}
+	if tmpl == "" {
 		return "", nil
 	}
 	dst := filepath.Join(m.runDir, vmID+"-OVMF_VARS.fd")
-	src, err := os.ReadFile(m.ovmfVarsTmpl)
+	src, err := os.ReadFile(tmpl)
 	if err != nil {
-		return "", fmt.Errorf("read OVMF_VARS template %s: %w", m.ovmfVarsTmpl, err)
+		return "", fmt.Errorf("read OVMF_VARS template %s: %w", tmpl, err)
 	}
 	if err := os.WriteFile(dst, src, 0o644); err != nil {
 		return "", fmt.Errorf("write OVMF_VARS %s: %w", dst, err)
@@ -664,6 +1515,21 @@ func (m *Manager) copyOVMFVars(vmID string) (string, error) {
 	return dst, nil
 }
 
+// qemuLogTail returns the last lines of a QEMU log, at most 2 KiB.
+func qemuLogTail(path string) string {
+	const maxTail = 2048
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > maxTail {
+		_, _ = f.Seek(-maxTail, io.SeekEnd)
+	}
+	data, _ := io.ReadAll(f)
+	return strings.TrimSpace(string(data))
+}
+
 func (m *Manager) waitForQMP(qmp *QMPClient, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
@@ -683,8 +1549,8 @@ func (m *Manager) waitForQMP(qmp *QMPClient, timeout time.Duration) error {
 }
 
 func (m *Manager) forceKill() {
-	if m.cmd != nil && m.cmd.Process != nil {
-		_ = m.cmd.Process.Kill()
+	if m.proc != nil {
+		_ = m.proc.Kill()
 		if m.done != nil {
 			<-m.done
 		}
@@ -696,6 +1562,10 @@ func (m *Manager) cleanup() {
 		_ = m.qmp.Close()
 		m.qmp = nil
 	}
+	m.qmpDegraded = false
+	if m.sshClient != nil {
+		_ = m.sshClient.Close()
+	}
 
 	for _, v := range m.vfios {
 		if err := v.Unbind(); err != nil {
@@ -704,53 +1574,146 @@ func (m *Manager) cleanup() {
 	}
 	m.vfios = nil
 
-	if m.diskPath != "" {
-		_ = m.images.RemoveDisk(m.diskPath)
+	if m.cgroup != nil {
+		m.cgroup.remove()
+		m.cgroup = nil
+	}
+
+	stopSwtpm(m.swtpm)
+	m.swtpm = nil
+
+	if m.secureWipe {
+		paths := []string{m.diskPath, m.ovmfVarsPath}
+		if m.spec.TPM {
+			state := filepath.Join(tpmDir(m.runDir, m.vmID), tpmStateFile)
+			if _, err := os.Stat(state); err == nil {
+				paths = append(paths, state)
+			}
+		}
+		m.lastWipe = m.wipeDisks(paths...)
+	} else {
+		if m.diskPath != "" {
+			_ = m.images.RemoveDisk(m.diskPath)
+		}
+		if m.ovmfVarsPath != "" {
+			_ = os.Remove(m.ovmfVarsPath)
+		}
 	}
 	if m.qmpSocket != "" {
 		_ = os.Remove(m.qmpSocket)
 	}
-	if m.ovmfVarsPath != "" {
-		_ = os.Remove(m.ovmfVarsPath)
+	if m.consolePath != "" {
+		_ = os.Remove(m.consolePath)
 	}
 	if m.vmID != "" {
-		_ = os.Remove(filepath.Join(m.runDir, m.vmID+".log"))
+		serialLog := serialLogPath(m.runDir, m.vmID)
+		m.lastBootLog = readTail(serialLog, maxBootLog)
+		logfile.RemoveAll(serialLog)
+		logfile.RemoveAll(filepath.Join(m.runDir, m.vmID+".log"))
+		_ = os.Remove(filepath.Join(m.runDir, m.vmID+".state"))
+		removeTPMState(m.runDir, m.vmID)
 	}
 
 	m.vmID = ""
-	m.cmd = nil
+	m.proc = nil
 	m.logFile = nil
 	m.sshClient = nil
 	m.portPool = nil
 	m.diskPath = ""
 	m.qmpSocket = ""
+	m.consolePath = ""
+	m.spec = domain.InstanceSpec{}
 	m.gpuAddrs = nil
+	m.gpuVendor = ""
 	m.ovmfVarsPath = ""
 	m.done = nil
-	m.failed = false
+	m.secureWipe = false
 }
 
-func mapQMPStatus(s string) domain.InstanceStatus {
-	switch s {
-	case "running":
-		return domain.StatusRunning
-	case "paused":
-		return domain.StatusPaused
-	case "prelaunch", "inmigrate":
-		return domain.StatusPending
-	case "shutdown", "postmigrate":
-		return domain.StatusDestroyed
-	default:
-		return domain.StatusError
+// Discard removes the disk and run files an interrupted or failed Create
+// left for vmID. The current VM is never touched. Orphan processes and
+// network policy are already gone after KillOrphans or the failed Create's
+// own cleanup; GPUs still bound to VFIO are released if no VM runs.
+func (m *Manager) Discard(vmID string, secureWipe bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if vmID == "" || vmID == m.vmID {
+		return
+	}
+	if m.vmID == "" {
+		defer m.unbindIdleGPUs()
 	}
+
+	disk := m.images.DiskPath(vmID)
+	ovmfVars := filepath.Join(m.runDir, vmID+"-OVMF_VARS.fd")
+	if secureWipe || m.wipeDefault {
+		var existing []string
+		for _, p := range []string{disk, ovmfVars} {
+			if _, err := os.Stat(p); err == nil {
+				existing = append(existing, p)
+			}
+		}
+		if len(existing) > 0 {
+			if r := m.wipeDisks(existing...); r.Error != "" {
+				m.logger.Error("wipe of interrupted create incomplete", "vm_id", vmID, "err", r.Error)
+			}
+		}
+	} else {
+		if err := m.images.RemoveDisk(disk); err != nil {
+			m.logger.Warn("remove disk of interrupted create", "vm_id", vmID, "err", err)
+		}
+	}
+	_ = os.Remove(filepath.Join(m.runDir, vmID+".qmp"))
+	removeVMArtifacts(m.runDir, vmID)
+}
+
+// wipeDisks overwrites and removes the instance disk and its UEFI variable
+// store, which may hold guest secrets such as boot entries and keys.
+func (m *Manager) wipeDisks(paths ...string) *domain.WipeReport {
+	start := time.Now()
+	report := &domain.WipeReport{Files: []string{}}
+	var errs []string
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		n, method, err := m.images.WipeDisk(path)
+		report.Bytes += n
+		if method != "" {
+			report.Files = append(report.Files, path)
+			report.Method = method
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	report.DurationMS = time.Since(start).Milliseconds()
+	report.Error = strings.Join(errs, "; ")
+	if report.Error != "" {
+		m.logger.Error("secure wipe incomplete", "files", report.Files, "err", report.Error)
+	} else {
+		m.logger.Info("secure wipe completed", "files", report.Files, "bytes", report.Bytes, "duration_ms", report.DurationMS)
+	}
+	return report
 }
 
-func generatePassword(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		b[i] = charset[n.Int64()]
+// mapQMPStatus translates a QMP RunState into the instance status it implies
+// for an instance that has finished booting.
+func mapQMPStatus(s string) (domain.InstanceStatus, domain.StatusReason) {
+	switch s {
+	case "running":
+		return domain.StatusRunning, ""
+	case "paused", "suspended", "prelaunch", "inmigrate", "postmigrate", "finish-migrate", "save-vm", "restore-vm", "debug":
+		return domain.StatusPaused, ""
+	case "shutdown":
+		return domain.StatusStopped, ""
+	case "guest-panicked", "internal-error":
+		return domain.StatusFailed, domain.ReasonGuestPanicked
+	case "io-error":
+		return domain.StatusDegraded, domain.ReasonGuestIOError
+	default:
+		return domain.StatusDegraded, domain.ReasonQMPUnavailable
 	}
-	return string(b)
 }
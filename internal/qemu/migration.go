@@ -0,0 +1,210 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const migrateStateTimeout = 10 * time.Minute
+
+// Export pauses the VM and returns the artifacts to stream to the target host.
+// The guest memory and device state are saved when QEMU allows it; VFIO
+// devices without migration support block that, in which case the bundle is
+// a crash-consistent cold export. The VM stays paused until it is destroyed
+// or ResumeExport is called.
+func (m *Manager) Export(ctx context.Context) (*domain.ExportBundle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" {
+		return nil, domain.ErrNoInstanceRunning{}
+	}
+	m.observeLocked()
+	switch m.status {
+	case domain.StatusRunning, domain.StatusDegraded, domain.StatusPaused:
+	default:
+		return nil, domain.ErrCommandNotAllowed{Command: "export", Status: m.status}
+	}
+	if m.qmp == nil || !m.qmp.Connected() {
+		return nil, domain.ErrQEMU{Op: "export", Err: fmt.Errorf("QMP not connected")}
+	}
+	if m.spec.DiskEncrypted {
+		// The target would need the key, which the agent no longer has.
+		return nil, domain.ErrQEMU{Op: "export", Err: fmt.Errorf("encrypted disks cannot be migrated")}
+	}
+	if m.spec.TPM {
+		// Secrets sealed to the TPM would not unseal on the target.
+		return nil, domain.ErrQEMU{Op: "export", Err: fmt.Errorf("instances with a TPM cannot be migrated")}
+	}
+	if m.spec.Confidential {
+		// The encrypted memory is bound to this CPU.
+		return nil, domain.ErrQEMU{Op: "export", Err: fmt.Errorf("confidential instances cannot be migrated")}
+	}
+
+	// Flush guest page cache so that a cold export carries recent writes.
+	if m.sshClient != nil && m.status != domain.StatusPaused {
+		syncCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if out, err := m.sshClient.Run(syncCtx, "sync"); err != nil {
+			m.logger.Warn("guest sync before export failed", "err", err, "output", string(out))
+		}
+		cancel()
+	}
+
+	if m.status != domain.StatusPaused {
+		if err := m.qmp.Pause(); err != nil {
+			return nil, domain.ErrQEMU{Op: "export pause", Err: err}
+		}
+		m.setStatusLocked(domain.StatusPaused, "")
+	}
+
+	bundle := &domain.ExportBundle{
+		Mode:          domain.MigrationCold,
+		DiskPath:      m.diskPath,
+		OVMFVarsPath:  m.ovmfVarsPath,
+		CPUs:          m.spec.CPUs,
+		Memory:        m.spec.Memory,
+		DiskSizeGB:    m.spec.DiskSizeGB,
+		BandwidthMbps: m.spec.BandwidthMbps,
+		SecureBoot:    m.spec.SecureBoot,
+		Nested:        m.spec.Nested,
+	}
+	if m.baseImage != "" {
+		if info, err := os.Stat(m.baseImage); err == nil {
+			bundle.BaseImageSize = info.Size()
+		}
+	}
+
+	statePath := filepath.Join(m.runDir, m.vmID+".state")
+	if err := m.saveStateLocked(ctx, statePath); err != nil {
+		_ = os.Remove(statePath)
+		m.logger.Warn("guest state not saved, exporting cold", "err", err)
+	} else {
+		bundle.Mode = domain.MigrationLive
+		bundle.StatePath = statePath
+	}
+
+	m.logger.Info("instance exported", "vm_id", m.vmID, "mode", bundle.Mode)
+	return bundle, nil
+}
+
+func (m *Manager) saveStateLocked(ctx context.Context, path string) error {
+	if err := m.qmp.Migrate("exec:cat > " + shellQuote(path)); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrateStateTimeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		status, desc, err := m.qmp.QueryMigrate()
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("migration %s: %s", status, desc)
+		}
+		select {
+		case <-ctx.Done():
+			_ = m.qmp.MigrateCancel()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ResumeExport continues a VM paused by Export after the transfer failed.
+func (m *Manager) ResumeExport() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	_ = os.Remove(filepath.Join(m.runDir, m.vmID+".state"))
+	if m.qmp == nil || !m.qmp.Connected() {
+		return domain.ErrQEMU{Op: "resume", Err: fmt.Errorf("QMP not connected")}
+	}
+	if err := m.qmp.Resume(); err != nil {
+		return domain.ErrQEMU{Op: "resume", Err: err}
+	}
+	m.setStatusLocked(domain.StatusRunning, "")
+	return nil
+}
+
+// ImportDir creates an empty staging directory for an incoming bundle.
+func (m *Manager) ImportDir() (string, error) {
+	dir := filepath.Join(m.dataDir, "import", uuid.New().String())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("create import dir: %w", err)
+	}
+	return dir, nil
+}
+
+// adoptImport moves a received bundle into the image and run directories
+// under vmID and re-points the disk at the local base image.
+func (m *Manager) adoptImport(vmID string, src *domain.ImportSource) (diskPath, ovmfVarsPath, statePath string, err error) {
+	defer os.RemoveAll(src.Dir)
+
+	if src.BaseImageSize > 0 {
+		if m.baseImage == "" {
+			return "", "", "", fmt.Errorf("bundle needs a base image but none is configured")
+		}
+		info, err := os.Stat(m.baseImage)
+		if err != nil {
+			return "", "", "", fmt.Errorf("base image: %w", err)
+		}
+		if info.Size() != src.BaseImageSize {
+			return "", "", "", fmt.Errorf("base image size mismatch: local %d, source %d", info.Size(), src.BaseImageSize)
+		}
+	}
+
+	if err := os.MkdirAll(m.images.imageDir, 0o755); err != nil {
+		return "", "", "", fmt.Errorf("create image dir: %w", err)
+	}
+	if err := os.MkdirAll(m.runDir, 0o755); err != nil {
+		return "", "", "", fmt.Errorf("create run dir: %w", err)
+	}
+
+	diskPath = filepath.Join(m.images.imageDir, vmID+".qcow2")
+	if err := os.Rename(src.DiskPath, diskPath); err != nil {
+		return "", "", "", fmt.Errorf("move imported disk: %w", err)
+	}
+	if src.BaseImageSize > 0 {
+		out, err := exec.Command("qemu-img", "rebase", "-u", "-b", m.baseImage, "-F", "qcow2", diskPath).CombinedOutput()
+		if err != nil {
+			_ = os.Remove(diskPath)
+			return "", "", "", fmt.Errorf("qemu-img rebase: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if src.OVMFVarsPath != "" {
+		ovmfVarsPath = filepath.Join(m.runDir, vmID+"-OVMF_VARS.fd")
+		if err := os.Rename(src.OVMFVarsPath, ovmfVarsPath); err != nil {
+			_ = os.Remove(diskPath)
+			return "", "", "", fmt.Errorf("move imported OVMF vars: %w", err)
+		}
+	}
+
+	if src.StatePath != "" {
+		statePath = filepath.Join(m.runDir, vmID+".state")
+		if err := os.Rename(src.StatePath, statePath); err != nil {
+			_ = os.Remove(diskPath)
+			_ = os.Remove(ovmfVarsPath)
+			return "", "", "", fmt.Errorf("move imported state: %w", err)
+		}
+	}
+	return diskPath, ovmfVarsPath, statePath, nil
+}
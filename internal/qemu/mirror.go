@@ -0,0 +1,29 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// slirpHost is the address under which a guest on user-mode networking
+// reaches the host's loopback.
+const slirpHost = "10.0.2.2"
+
+// configureRegistryMirror points the guest Docker daemon, if it has one, at
+// the host registry cache and restarts it. Other daemon.json settings are
+// kept when jq is available to merge them.
+func configureRegistryMirror(ctx context.Context, ssh *SSHClient, port int) error {
+	mirror := fmt.Sprintf("http://%s:%d", slirpHost, port)
+	cmd := `command -v dockerd >/dev/null 2>&1 || exit 0; ` +
+		`mkdir -p /etc/docker && f=/etc/docker/daemon.json && ` +
+		`if [ -s $f ]; then ` +
+		`command -v jq >/dev/null 2>&1 || { echo "jq is needed to merge $f" >&2; exit 1; }; ` +
+		`jq --arg m '` + mirror + `' '."registry-mirrors" = [$m]' $f > $f.tmp && mv $f.tmp $f; ` +
+		`else printf '{"registry-mirrors": ["%s"]}\n' '` + mirror + `' > $f; fi && ` +
+		`(systemctl restart docker 2>/dev/null; true)`
+	if out, err := ssh.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +20,9 @@ type QMPClient struct {
 	conn       net.Conn
 	dec        *json.Decoder
 	autoReconn bool // Enable automatic reconnection on failure
+
+	// live mirrors conn so Abort can close it while a command holds mu.
+	live atomic.Pointer[net.Conn]
 }
 
 // qmpMessage is a union type that can represent any QMP response or event.
@@ -83,6 +87,7 @@ func (c *QMPClient) connectLocked() error {
 	}
 	c.conn = conn
 	c.dec = json.NewDecoder(conn)
+	c.live.Store(&conn)
 
 	// Read the server greeting.
 	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -138,6 +143,14 @@ func (c *QMPClient) Close() error {
 	return nil
 }
 
+// Abort closes the connection without waiting for an in-flight command,
+// which then fails with a read error and releases the client.
+func (c *QMPClient) Abort() {
+	if conn := c.live.Swap(nil); conn != nil {
+		_ = (*conn).Close()
+	}
+}
+
 // Connected reports whether the QMP socket is currently open.
 func (c *QMPClient) Connected() bool {
 	c.mu.Lock()
@@ -185,6 +198,170 @@ func (c *QMPClient) Quit() error {
 	return err
 }
 
+// Migrate starts an outgoing migration to uri, e.g. "exec:cat > /path".
+// Progress is reported by QueryMigrate.
+func (c *QMPClient) Migrate(uri string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("migrate", map[string]string{"uri": uri})
+	return err
+}
+
+// MigrateCancel aborts a running outgoing migration.
+func (c *QMPClient) MigrateCancel() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("migrate_cancel", nil)
+	return err
+}
+
+// QueryMigrate returns the migration status ("active", "completed", "failed", ...)
+// and the error description QEMU reports for a failed migration.
+func (c *QMPClient) QueryMigrate() (status, errDesc string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := c.exec("query-migrate", nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	var result struct {
+		Status    string `json:"status"`
+		ErrorDesc string `json:"error-desc"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", "", fmt.Errorf("unmarshal migrate status: %w", err)
+	}
+	return result.Status, result.ErrorDesc, nil
+}
+
+// BlockResize grows the block device with the given drive id to size bytes.
+func (c *QMPClient) BlockResize(device string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("block_resize", map[string]interface{}{"device": device, "size": size})
+	return err
+}
+
+// SetVNCPassword sets the password of the VNC server, which refuses all
+// clients until it is set.
+func (c *QMPClient) SetVNCPassword(password string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("set_password", map[string]interface{}{"protocol": "vnc", "password": password})
+	return err
+}
+
+// DeviceAdd hotplugs a device; args are its driver, id and properties.
+func (c *QMPClient) DeviceAdd(args map[string]interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("device_add", args)
+	return err
+}
+
+// DeviceDel unplugs the device with the given id.
+func (c *QMPClient) DeviceDel(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.exec("device_del", map[string]interface{}{"id": id})
+	return err
+}
+
+// BlockImage is a block device backed by an image file, from query-block.
+type BlockImage struct {
+	Device string
+	Format string
+	// VirtualSize is the disk size the guest sees and ActualSize the space
+	// the image file takes on the host.
+	VirtualSize int64
+	ActualSize  int64
+}
+
+// QueryBlock returns the block devices that have an image inserted.
+func (c *QMPClient) QueryBlock() ([]BlockImage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := c.exec("query-block", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []struct {
+		Device   string `json:"device"`
+		Inserted *struct {
+			Image struct {
+				Format      string `json:"format"`
+				VirtualSize int64  `json:"virtual-size"`
+				ActualSize  int64  `json:"actual-size"`
+			} `json:"image"`
+		} `json:"inserted"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal block info: %w", err)
+	}
+	var images []BlockImage
+	for _, b := range result {
+		if b.Inserted == nil {
+			continue
+		}
+		images = append(images, BlockImage{
+			Device:      b.Device,
+			Format:      b.Inserted.Image.Format,
+			VirtualSize: b.Inserted.Image.VirtualSize,
+			ActualSize:  b.Inserted.Image.ActualSize,
+		})
+	}
+	return images, nil
+}
+
+// BlockStats are the I/O counters of a block device since the VM started,
+// from query-blockstats.
+type BlockStats struct {
+	Device  string
+	RdBytes uint64
+	WrBytes uint64
+	RdOps   uint64
+	WrOps   uint64
+}
+
+// QueryBlockStats returns the I/O counters of every block device.
+func (c *QMPClient) QueryBlockStats() ([]BlockStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := c.exec("query-blockstats", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []struct {
+		Device string `json:"device"`
+		Stats  struct {
+			RdBytes uint64 `json:"rd_bytes"`
+			WrBytes uint64 `json:"wr_bytes"`
+			RdOps   uint64 `json:"rd_operations"`
+			WrOps   uint64 `json:"wr_operations"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal blockstats: %w", err)
+	}
+	stats := make([]BlockStats, 0, len(result))
+	for _, b := range result {
+		stats = append(stats, BlockStats{
+			Device:  b.Device,
+			RdBytes: b.Stats.RdBytes,
+			WrBytes: b.Stats.WrBytes,
+			RdOps:   b.Stats.RdOps,
+			WrOps:   b.Stats.WrOps,
+		})
+	}
+	return stats, nil
+}
+
 // QueryStatus returns the current VM run state (e.g. "running", "paused").
 func (c *QMPClient) QueryStatus() (status string, running bool, err error) {
 	c.mu.Lock()
@@ -0,0 +1,25 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+var errNoNested = errors.New("nested virtualization is disabled in the host kvm module (kvm_intel.nested or kvm_amd.nested)")
+
+// nestedCPUFlag returns the -cpu feature that exposes the host's hardware
+// virtualization to the guest, so that it can run VMs of its own.
+func nestedCPUFlag(caps domain.HostCapabilities) (string, error) {
+	if !caps.NestedVirt {
+		return "", errNoNested
+	}
+	switch caps.CPUVendor {
+	case "GenuineIntel":
+		return "+vmx", nil
+	case "AuthenticAMD":
+		return "+svm", nil
+	}
+	return "", fmt.Errorf("nested virtualization is not supported on %s CPUs", caps.CPUVendor)
+}
@@ -0,0 +1,251 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	cgroupMount  = "/sys/fs/cgroup"
+	cgroupParent = "qudata"
+	vmTable      = "qudata_vm"
+	counterRx    = "vm_rx"
+	counterTx    = "vm_tx"
+)
+
+// blockedIPv4 and blockedIPv6 are destinations a guest may not open
+// connections to: loopback (slirp maps 10.0.2.2 to the host's 127.0.0.1),
+// link-local and cloud metadata, private LANs, CGNAT and multicast.
+var (
+	blockedIPv4 = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	}
+	blockedIPv6 = []string{"::1/128", "fc00::/7", "fe80::/10", "ff00::/8"}
+)
+
+// netPolicy is the host-side network policy for one instance. User-mode
+// networking has no tap device, so guest traffic leaves through QEMU's own
+// sockets: QEMU is started in a dedicated cgroup and nftables matches the
+// sockets of that cgroup.
+type netPolicy struct {
+	// Isolate restricts inbound connections to the forwarded host ports and
+	// blocks outbound connections to host-local and private addresses.
+	Isolate bool
+	// BandwidthMbps polices traffic in each direction; 0 is unlimited.
+	BandwidthMbps int
+	// Account installs the policy for its traffic counters even when it
+	// neither isolates nor polices.
+	Account bool
+	// HostPorts are the hostfwd listeners QEMU owns.
+	HostPorts []int
+	// MirrorPort is the loopback port of the registry cache, which an
+	// isolated guest may still reach; 0 for none.
+	MirrorPort int
+}
+
+func (p netPolicy) enabled() bool {
+	return p.Isolate || p.BandwidthMbps > 0 || p.Account
+}
+
+// ruleset renders the nftables table for the cgroup at rel (relative to the
+// cgroup mount).
+func (p netPolicy) ruleset(rel string) string {
+	level := strings.Count(rel, "/") + 1
+
+	var police string
+	if p.BandwidthMbps > 0 {
+		// nft counts kbytes as 1024 bytes.
+		kbytes := max(p.BandwidthMbps*1_000_000/8/1024, 1)
+		burst := max(kbytes/10, 64)
+		police = fmt.Sprintf("limit rate over %d kbytes/second burst %d kbytes drop", kbytes, burst)
+	}
+
+	var out, in []string
+	if police != "" {
+		out = append(out, police)
+		in = append(in, police)
+	}
+	// Named counters feed usage metering with the bytes that got past the
+	// policer.
+	out = append(out, "counter name "+counterTx)
+	in = append(in, "counter name "+counterRx)
+	if p.Isolate {
+		out = append(out,
+			"ct state established,related accept",
+			// slirp forwards guest DNS to the host resolver, which is often on loopback.
+			"meta l4proto { tcp, udp } th dport 53 accept",
+		)
+		if p.MirrorPort > 0 {
+			out = append(out, fmt.Sprintf("ip daddr 127.0.0.1 tcp dport %d accept", p.MirrorPort))
+		}
+		out = append(out,
+			"ip daddr @blocked4 reject",
+			"ip6 daddr @blocked6 reject",
+		)
+		in = append(in, "ct state established,related accept")
+		if len(p.HostPorts) > 0 {
+			ports := append([]int(nil), p.HostPorts...)
+			sort.Ints(ports)
+			strs := make([]string, len(ports))
+			for i, port := range ports {
+				strs[i] = strconv.Itoa(port)
+			}
+			in = append(in, "tcp dport { "+strings.Join(strs, ", ")+" } accept")
+		}
+		in = append(in, "drop")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %[1]s\ndelete table inet %[1]s\ntable inet %[1]s {\n", vmTable)
+	fmt.Fprintf(&b, "\tset blocked4 {\n\t\ttype ipv4_addr; flags interval;\n\t\telements = { %s }\n\t}\n", strings.Join(blockedIPv4, ", "))
+	fmt.Fprintf(&b, "\tset blocked6 {\n\t\ttype ipv6_addr; flags interval;\n\t\telements = { %s }\n\t}\n", strings.Join(blockedIPv6, ", "))
+	fmt.Fprintf(&b, "\tcounter %s {\n\t}\n\tcounter %s {\n\t}\n", counterRx, counterTx)
+	writeChain(&b, "vm_out", out)
+	writeChain(&b, "vm_in", in)
+	fmt.Fprintf(&b, "\tchain output {\n\t\ttype filter hook output priority 0; policy accept;\n\t\tsocket cgroupv2 level %d %q jump vm_out\n\t}\n", level, rel)
+	fmt.Fprintf(&b, "\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n\t\tsocket cgroupv2 level %d %q jump vm_in\n\t}\n", level, rel)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeChain(b *strings.Builder, name string, rules []string) {
+	fmt.Fprintf(b, "\tchain %s {\n", name)
+	for _, r := range rules {
+		fmt.Fprintf(b, "\t\t%s\n", r)
+	}
+	b.WriteString("\t}\n")
+}
+
+// apply installs the policy for cg, replacing any previous one.
+func (p netPolicy) apply(cg *vmCgroup) error {
+	rel := strings.TrimPrefix(cg.dir, cgroupMount+"/")
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(p.ruleset(rel))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// vmCgroup is the cgroup v2 QEMU is started in.
+type vmCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+func newVMCgroup(vmID string) (*vmCgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is required for instance network policy: %w", err)
+	}
+	dir := filepath.Join(cgroupMount, cgroupParent, vmID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cgroup: %w", err)
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		_ = os.Remove(dir)
+		return nil, fmt.Errorf("open cgroup: %w", err)
+	}
+	return &vmCgroup{dir: dir, fd: fd}, nil
+}
+
+// closeFD releases the cgroup descriptor once QEMU has been started in it.
+func (cg *vmCgroup) closeFD() {
+	if cg.fd != nil {
+		_ = cg.fd.Close()
+		cg.fd = nil
+	}
+}
+
+// remove drops the nftables rules and the cgroup. The cgroup can only be
+// removed after QEMU has exited.
+func (cg *vmCgroup) remove() {
+	cg.closeFD()
+	_ = exec.Command("nft", "delete", "table", "inet", vmTable).Run()
+	_ = os.Remove(cg.dir)
+}
+
+// readNetCounters returns the bytes received and sent by the instance
+// sockets since the policy was installed.
+func readNetCounters() (rx, tx uint64, err error) {
+	out, err := exec.Command("nft", "-j", "list", "counters", "table", "inet", vmTable).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("nft list counters: %w", err)
+	}
+	var doc struct {
+		Nftables []struct {
+			Counter *struct {
+				Name  string `json:"name"`
+				Bytes uint64 `json:"bytes"`
+			} `json:"counter"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return 0, 0, fmt.Errorf("parse nft counters: %w", err)
+	}
+	for _, obj := range doc.Nftables {
+		if obj.Counter == nil {
+			continue
+		}
+		switch obj.Counter.Name {
+		case counterRx:
+			rx = obj.Counter.Bytes
+		case counterTx:
+			tx = obj.Counter.Bytes
+		}
+	}
+	return rx, tx, nil
+}
+
+// netSample is a reading of the instance's traffic counters.
+type netSample struct {
+	rx, tx uint64
+	at     time.Time
+}
+
+// collectNet reads the instance's traffic counters; nil when no network
+// policy, and so no counter, is installed.
+func (m *Manager) collectNet() *domain.NetStats {
+	rx, tx, ok := m.NetCounters()
+	if !ok {
+		return nil
+	}
+	cur := netSample{rx: rx, tx: tx, at: time.Now()}
+	out := &domain.NetStats{RxBytes: rx, TxBytes: tx}
+
+	m.sampleMu.Lock()
+	prev := m.netPrev
+	m.netPrev = cur
+	m.sampleMu.Unlock()
+
+	// The counters start over with every instance.
+	if dt := cur.at.Sub(prev.at).Seconds(); !prev.at.IsZero() && dt > 0 && rx >= prev.rx && tx >= prev.tx {
+		out.RxBytesPerSec = float64(rx-prev.rx) / dt
+		out.TxBytesPerSec = float64(tx-prev.tx) / dt
+	}
+	return out
+}
+
+// cleanOrphanNetPolicy removes policies left behind by a previous agent run.
+func cleanOrphanNetPolicy() {
+	_ = exec.Command("nft", "delete", "table", "inet", vmTable).Run()
+	entries, err := os.ReadDir(filepath.Join(cgroupMount, cgroupParent))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			_ = os.Remove(filepath.Join(cgroupMount, cgroupParent, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+	"golang.org/x/sys/unix"
+)
+
+// hugepagesMount is where hugetlbfs is mounted for guests backed by huge
+// pages.
+const hugepagesMount = "/dev/hugepages"
+
+type qmpCPUInfo struct {
+	CPUIndex int `json:"cpu-index"`
+	ThreadID int `json:"thread-id"`
+}
+
+// QueryVCPUThreads returns the host thread IDs of the vCPUs, in vCPU order.
+func (c *QMPClient) QueryVCPUThreads() ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := c.exec("query-cpus-fast", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var cpus []qmpCPUInfo
+	if err := json.Unmarshal(raw, &cpus); err != nil {
+		return nil, fmt.Errorf("unmarshal cpus: %w", err)
+	}
+	threads := make([]int, len(cpus))
+	for _, cpu := range cpus {
+		if cpu.CPUIndex < 0 || cpu.CPUIndex >= len(cpus) {
+			return nil, fmt.Errorf("unexpected vCPU index %d", cpu.CPUIndex)
+		}
+		threads[cpu.CPUIndex] = cpu.ThreadID
+	}
+	return threads, nil
+}
+
+// pinVCPUs sets the CPU affinity of the vCPU threads by policy: numa keeps
+// them on the NUMA node of the first GPU, dedicated gives each vCPU a host
+// CPU of its own, taken from that node first.
+func (m *Manager) pinVCPUs(qmp *QMPClient, policy string, gpuAddrs []string) error {
+	threads, err := qmp.QueryVCPUThreads()
+	if err != nil {
+		return err
+	}
+	online, err := readCPUList("/sys/devices/system/cpu/online")
+	if err != nil {
+		return err
+	}
+	local := online
+	if len(gpuAddrs) > 0 {
+		if node, ok := pciNUMANode(gpuAddrs[0]); ok {
+			if cpus, err := readCPUList(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node)); err == nil && len(cpus) > 0 {
+				local = cpus
+			}
+		}
+	}
+
+	switch policy {
+	case domain.PinningNUMA:
+		var set unix.CPUSet
+		for _, cpu := range local {
+			set.Set(cpu)
+		}
+		for _, tid := range threads {
+			if err := unix.SchedSetaffinity(tid, &set); err != nil {
+				return fmt.Errorf("pin thread %d: %w", tid, err)
+			}
+		}
+	case domain.PinningDedicated:
+		cpus := dedicatedCPUs(local, online)
+		if len(cpus) < len(threads) {
+			return fmt.Errorf("%d vCPUs, %d host CPUs to dedicate", len(threads), len(cpus))
+		}
+		for i, tid := range threads {
+			var set unix.CPUSet
+			set.Set(cpus[i])
+			if err := unix.SchedSetaffinity(tid, &set); err != nil {
+				return fmt.Errorf("pin thread %d: %w", tid, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown pinning policy %q", policy)
+	}
+	m.logger.Info("vCPUs pinned", "policy", policy, "vcpus", len(threads))
+	return nil
+}
+
+// dedicatedCPUs orders the CPUs to hand out one per vCPU: those of the local
+// node, then the rest, with CPU 0, which takes the host's interrupts, last.
+func dedicatedCPUs(local, online []int) []int {
+	seen := make(map[int]bool, len(online))
+	var out []int
+	add := func(cpus []int) {
+		for _, cpu := range cpus {
+			if cpu != 0 && !seen[cpu] {
+				seen[cpu] = true
+				out = append(out, cpu)
+			}
+		}
+	}
+	add(local)
+	add(online)
+	if slices.Contains(online, 0) {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// pciNUMANode returns the NUMA node of a PCI device, if the host reports one.
+func pciNUMANode(addr string) (int, bool) {
+	data, err := os.ReadFile(filepath.Join("/sys/bus/pci/devices", addr, "numa_node"))
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// readCPUList parses a kernel CPU list file such as "0-3,8-11".
+func readCPUList(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,117 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// maxPowerAge is how long a power reading stands in for the draw between
+// stats samples.
+const maxPowerAge = 30 * time.Second
+
+type powerReading struct {
+	watts float64
+	at    time.Time
+}
+
+// powerLimitCmd sets the power limit of every NVIDIA GPU in the guest to
+// watts, or back to its default when watts is 0.
+func powerLimitCmd(watts int) string {
+	if watts > 0 {
+		return fmt.Sprintf("nvidia-smi -pm 1 >/dev/null; nvidia-smi -pl %d", watts)
+	}
+	return `for i in $(nvidia-smi --query-gpu=index --format=csv,noheader); do ` +
+		`nvidia-smi -i "$i" -pl "$(nvidia-smi -i "$i" --query-gpu=power.default_limit --format=csv,noheader,nounits)" || exit 1; done`
+}
+
+// applyPowerCap splits watts evenly over the guest's gpus and sets each
+// GPU's limit; 0 restores the default limits.
+func applyPowerCap(ctx context.Context, ssh *SSHClient, vendor string, watts, gpus int) error {
+	if vendor == VendorAMD {
+		if watts == 0 {
+			return nil
+		}
+		return errors.New("GPU power cap is only supported on NVIDIA GPUs")
+	}
+	perGPU := 0
+	if watts > 0 {
+		perGPU = max(1, watts/max(1, gpus))
+	}
+	out, err := ssh.Run(ctx, powerLimitCmd(perGPU))
+	if err != nil {
+		return fmt.Errorf("nvidia-smi -pl: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PowerCap returns the host GPU power cap in Watts, 0 for none.
+func (m *Manager) PowerCap() int {
+	m.powerMu.Lock()
+	defer m.powerMu.Unlock()
+	return m.powerCap
+}
+
+// SetPowerCap caps the total GPU power of the running instance at watts,
+// split evenly over its GPUs, and keeps the cap for later instances. 0
+// restores the default limits. The cap is left unchanged if the running
+// instance refuses it.
+func (m *Manager) SetPowerCap(ctx context.Context, watts int) error {
+	m.mu.Lock()
+	ssh, vendor, gpus := m.sshClient, m.gpuVendor, len(m.gpuAddrs)
+	m.mu.Unlock()
+
+	if ssh != nil {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := applyPowerCap(ctx, ssh, vendor, watts, gpus); err != nil {
+			return err
+		}
+	}
+
+	m.powerMu.Lock()
+	m.powerCap = watts
+	m.powerMu.Unlock()
+	m.logger.Info("GPU power cap set", "watts", watts, "gpus", gpus)
+	return nil
+}
+
+// GPUPower returns the last power draw of the instance's GPUs in Watts. ok
+// is false when there is no recent reading.
+func (m *Manager) GPUPower() (watts float64, ok bool) {
+	m.powerMu.Lock()
+	defer m.powerMu.Unlock()
+	if time.Since(m.power.at) > maxPowerAge {
+		return 0, false
+	}
+	return m.power.watts, true
+}
+
+// observePower records the draw in snap and puts the cap back if the guest
+// has raised its GPU limits above it.
+func (m *Manager) observePower(ctx context.Context, ssh *SSHClient, snap *domain.StatsSnapshot) {
+	m.powerMu.Lock()
+	m.power = powerReading{watts: snap.GPUPower, at: time.Now()}
+	watts := m.powerCap
+	m.powerMu.Unlock()
+
+	if watts == 0 || snap.GPUPowerLimit == 0 {
+		return
+	}
+	m.mu.Lock()
+	vendor, gpus := m.gpuVendor, len(m.gpuAddrs)
+	m.mu.Unlock()
+	// Limits are whole Watts per GPU, so allow a Watt of rounding each.
+	if snap.GPUPowerLimit <= float64(watts+gpus) {
+		return
+	}
+	m.logger.Warn("guest raised GPU power limit above the cap, reapplying",
+		"limit_w", snap.GPUPowerLimit, "cap_w", watts)
+	if err := applyPowerCap(ctx, ssh, vendor, watts, gpus); err != nil {
+		m.logger.Warn("failed to reapply GPU power cap", "err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// composeStateCmd prints "missing" when the containers of the instance are
+// neither starting nor created, as after a guest reboot before the unit ran
+// or once someone removed them. A guest without Docker has nothing to repair.
+var composeStateCmd = fmt.Sprintf(
+	`command -v docker >/dev/null 2>&1 || { echo ok; exit 0; }; `+
+		`if systemctl is-active --quiet %[1]s || [ -n "$(docker compose -p qudata ps -a -q 2>/dev/null)" ]; `+
+		`then echo ok; else systemctl reset-failed %[1]s 2>/dev/null; echo missing; fi`,
+	domain.ComposeUnit)
+
+// ReapOrphans kills QEMU processes of VMs other than the current one,
+// removes what stopped ones left in the run directory and returns idle GPUs
+// and PCI devices to the host. It is KillOrphans for a running agent and
+// does nothing while another operation holds the manager.
+func (m *Manager) ReapOrphans() []domain.Drift {
+	if !m.mu.TryLock() {
+		return nil
+	}
+	defer m.mu.Unlock()
+
+	var drift []domain.Drift
+	entries, err := os.ReadDir(m.runDir)
+	if err != nil && !os.IsNotExist(err) {
+		m.logger.Warn("reconcile: read run dir", "err", err)
+	}
+	for _, e := range entries {
+		vmID, ok := strings.CutSuffix(e.Name(), ".qmp")
+		if !ok || vmID == m.vmID {
+			continue
+		}
+		socket := filepath.Join(m.runDir, e.Name())
+		pid, err := FindQEMUProcessBySocket(socket)
+		if err != nil {
+			continue
+		}
+		if pid == 0 {
+			_ = os.Remove(socket)
+			removeVMArtifacts(m.runDir, vmID)
+			drift = append(drift, domain.Drift{Kind: "vm_artifacts",
+				Detail: "files of stopped VM " + vmID + " left in the run directory", Action: "remove"})
+			continue
+		}
+		m.logger.Warn("reconcile: killing orphan VM", "vm_id", vmID, "pid", pid)
+		d := domain.Drift{Kind: "orphan_vm",
+			Detail: fmt.Sprintf("QEMU process %d of VM %s is not managed", pid, vmID), Action: "kill"}
+		if err := KillProcess(pid); err != nil {
+			d.Error = err.Error()
+		} else {
+			_ = os.Remove(socket)
+			removeVMArtifacts(m.runDir, vmID)
+		}
+		drift = append(drift, d)
+	}
+
+	if m.vmID == "" {
+		drift = append(drift, m.unbindIdleGPUs()...)
+	}
+	return drift
+}
+
+// EnsureContainers starts the containers of the running instance again when
+// they are gone from the guest.
+func (m *Manager) EnsureContainers(ctx context.Context) []domain.Drift {
+	if !m.mu.TryLock() {
+		return nil
+	}
+	compose := m.spec.Compose
+	if m.spec.Import != nil || m.status != domain.StatusRunning {
+		compose = ""
+	}
+	ssh := m.sshClient
+	m.mu.Unlock()
+	if compose == "" || ssh == nil {
+		return nil
+	}
+
+	out, err := ssh.Run(ctx, composeStateCmd)
+	if err != nil || strings.TrimSpace(string(out)) != "missing" {
+		return nil
+	}
+	m.logger.Warn("reconcile: containers missing from the guest, starting them")
+	d := domain.Drift{Kind: "containers", Detail: "the containers of the instance are not running", Action: "start"}
+	if err := startContainers(ctx, ssh, compose); err != nil {
+		d.Error = err.Error()
+	}
+	return []domain.Drift{d}
+}
@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/qudata/agent/internal/logfile"
 )
 
 // ProcessInfo contains information about a running QEMU process.
@@ -101,7 +103,7 @@ func FindOrphanVMs(runDir string) ([]ProcessInfo, error) {
 	return orphans, nil
 }
 
-// CleanOrphanArtifacts removes leftover .log and OVMF_VARS files in runDir
+// CleanOrphanArtifacts removes leftover .log, serial log, console and OVMF_VARS files in runDir
 // that no longer have a corresponding running QEMU process.
 func CleanOrphanArtifacts(runDir string) {
 	entries, err := os.ReadDir(runDir)
@@ -112,10 +114,23 @@ func CleanOrphanArtifacts(runDir string) {
 		name := entry.Name()
 		var vmID string
 		switch {
+		case strings.HasSuffix(name, serialLogSuffix):
+			vmID = strings.TrimSuffix(name, serialLogSuffix)
+		case strings.Contains(name, serialLogSuffix+"."):
+			vmID, _, _ = strings.Cut(name, serialLogSuffix+".")
 		case strings.HasSuffix(name, ".log"):
 			vmID = strings.TrimSuffix(name, ".log")
+		case strings.Contains(name, ".log."):
+			// A rotated log.
+			vmID, _, _ = strings.Cut(name, ".log.")
+		case strings.HasSuffix(name, ".console"):
+			vmID = strings.TrimSuffix(name, ".console")
 		case strings.HasSuffix(name, "-OVMF_VARS.fd"):
 			vmID = strings.TrimSuffix(name, "-OVMF_VARS.fd")
+		case strings.HasSuffix(name, ".state"):
+			vmID = strings.TrimSuffix(name, ".state")
+		case strings.HasSuffix(name, ".tpm"):
+			vmID = strings.TrimSuffix(name, ".tpm")
 		default:
 			continue
 		}
@@ -123,14 +138,18 @@ func CleanOrphanArtifacts(runDir string) {
 		if _, err := os.Stat(qmpSocket); err == nil {
 			continue
 		}
-		_ = os.Remove(filepath.Join(runDir, name))
+		_ = os.RemoveAll(filepath.Join(runDir, name))
 	}
 }
 
-// removeVMArtifacts removes leftover .log and OVMF_VARS files for a given VM ID.
+// removeVMArtifacts removes leftover logs, console socket, migration state and OVMF_VARS files for a given VM ID.
 func removeVMArtifacts(runDir, vmID string) {
-	_ = os.Remove(filepath.Join(runDir, vmID+".log"))
+	logfile.RemoveAll(filepath.Join(runDir, vmID+".log"))
+	logfile.RemoveAll(serialLogPath(runDir, vmID))
+	_ = os.Remove(filepath.Join(runDir, vmID+".state"))
+	_ = os.Remove(filepath.Join(runDir, vmID+".console"))
 	_ = os.Remove(filepath.Join(runDir, vmID+"-OVMF_VARS.fd"))
+	removeTPMState(runDir, vmID)
 }
 
 // ProcessExists checks if a process with the given PID exists.
@@ -0,0 +1,87 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// diskDriveID is the QEMU drive id of the instance root disk.
+const diskDriveID = "disk0"
+
+// growRootScript grows the partition holding / and its filesystem to fill
+// the disk. growpart exits 1 when the partition already spans the disk.
+const growRootScript = `set -e
+src=$(findmnt -no SOURCE /)
+disk=/dev/$(lsblk -no PKNAME "$src" | head -n1)
+part=$(cat /sys/class/block/$(basename "$src")/partition)
+growpart "$disk" "$part" || [ $? -eq 1 ]
+case $(findmnt -no FSTYPE /) in
+xfs) xfs_growfs / ;;
+btrfs) btrfs filesystem resize max / ;;
+*) resize2fs "$src" ;;
+esac`
+
+// ResizeDisk grows the root disk of the running instance to sizeGB. The
+// image is grown by QEMU with block_resize, since qemu-img cannot modify an
+// image QEMU holds open; the guest partition and filesystem are then grown
+// over SSH.
+func (m *Manager) ResizeDisk(ctx context.Context, sizeGB int) error {
+	if err := m.resizeBlock(sizeGB); err != nil {
+		return err
+	}
+
+	ssh, err := m.awaitSSH(ctx)
+	if err != nil {
+		return domain.ErrGuestResize{Err: err}
+	}
+	out, err := ssh.Run(ctx, growRootScript)
+	if err != nil {
+		return domain.ErrGuestResize{Err: fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))}
+	}
+	m.logger.Info("guest filesystem grown", "size_gb", sizeGB)
+	return nil
+}
+
+func (m *Manager) resizeBlock(sizeGB int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.vmID == "" || m.diskPath == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	m.observeLocked()
+	switch m.status {
+	case domain.StatusRunning, domain.StatusDegraded:
+	default:
+		return domain.ErrCommandNotAllowed{Command: "resize", Status: m.status}
+	}
+	if m.qmp == nil || !m.qmp.Connected() {
+		return domain.ErrQEMU{Op: "resize", Err: fmt.Errorf("QMP not connected")}
+	}
+
+	current, err := m.images.virtualSize(m.diskPath)
+	if err != nil {
+		return domain.ErrQEMU{Op: "resize", Err: err}
+	}
+	target := int64(sizeGB) * 1024 * 1024 * 1024
+	if target <= current {
+		return domain.ErrDiskShrink{CurrentGB: int(current >> 30), RequestedGB: sizeGB}
+	}
+
+	start := time.Now()
+	if err := m.qmp.BlockResize(diskDriveID, target); err != nil {
+		return domain.ErrQEMU{Op: "block_resize", Err: err}
+	}
+	m.spec.DiskSizeGB = sizeGB
+	m.logger.Info("instance disk resized",
+		"vm_id", m.vmID,
+		"from_bytes", current,
+		"to_gb", sizeGB,
+		"duration", time.Since(start),
+	)
+	return nil
+}
@@ -0,0 +1,25 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// secureBootVar is the UEFI variable through which the firmware tells the
+// guest whether it enforces Secure Boot; its last byte is 1 when it does.
+const secureBootVar = "/sys/firmware/efi/efivars/SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+var errNoSecureBoot = errors.New("no Secure Boot firmware configured (ovmf_secboot_code, ovmf_secboot_vars)")
+
+// guestSecureBoot reports whether the guest booted with Secure Boot
+// enforced. The firmware leaves it off if the variable store has no keys
+// enrolled.
+func guestSecureBoot(ctx context.Context, ssh *SSHClient) (bool, error) {
+	out, err := ssh.Run(ctx, "tail -c1 "+secureBootVar+" | od -An -tu1")
+	if err != nil {
+		return false, fmt.Errorf("read SecureBoot variable: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)) == "1", nil
+}
@@ -0,0 +1,114 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sriovManage is NVIDIA's helper for enabling VFs on vGPU-capable boards.
+const sriovManage = "/usr/lib/nvidia/sriov-manage"
+
+// IsVF reports whether addr is an SR-IOV virtual function.
+func IsVF(addr string) bool {
+	_, err := os.Lstat(filepath.Join(devicesDir, addr, "physfn"))
+	return err == nil
+}
+
+// SRIOVTotalVFs returns how many VFs the physical function supports, or 0.
+func SRIOVTotalVFs(pf string) int {
+	s, err := readSysfsAttr(filepath.Join(devicesDir, pf), "sriov_totalvfs")
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// EnableVFs makes sure at least n VFs exist under the physical function.
+func EnableVFs(pf string, n int) error {
+	total := SRIOVTotalVFs(pf)
+	if total == 0 {
+		return fmt.Errorf("GPU %s does not support SR-IOV", pf)
+	}
+	if n > total {
+		return fmt.Errorf("GPU %s supports at most %d VFs, %d requested", pf, total, n)
+	}
+
+	unlock := vfioLocks.lock(pf)
+	defer unlock()
+
+	if vfs, _ := ListVFs(pf); len(vfs) >= n {
+		return nil
+	}
+
+	// NVIDIA vGPU boards only expose VFs through sriov-manage.
+	if _, err := os.Stat(sriovManage); err == nil {
+		out, err := exec.Command(sriovManage, "-e", pf).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("sriov-manage -e %s: %s", pf, strings.TrimSpace(string(out)))
+		}
+		if vfs, _ := ListVFs(pf); len(vfs) >= n {
+			return nil
+		}
+	}
+
+	numVFs := filepath.Join(devicesDir, pf, "sriov_numvfs")
+	// The kernel rejects changing a non-zero VF count directly.
+	_ = os.WriteFile(numVFs, []byte("0"), 0o200)
+	if err := os.WriteFile(numVFs, []byte(strconv.Itoa(n)), 0o200); err != nil {
+		return fmt.Errorf("enable %d VFs on %s: %w", n, pf, err)
+	}
+	return nil
+}
+
+// ListVFs returns the PCI addresses of the VFs under pf, ordered by index.
+func ListVFs(pf string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(devicesDir, pf, "virtfn*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(matches[i]), "virtfn"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(matches[j]), "virtfn"))
+		return a < b
+	})
+
+	vfs := make([]string, 0, len(matches))
+	for _, m := range matches {
+		link, err := os.Readlink(m)
+		if err != nil {
+			continue
+		}
+		vfs = append(vfs, filepath.Base(link))
+	}
+	return vfs, nil
+}
+
+// selectVFs picks one free VF per physical function. A VF already bound to
+// vfio-pci is assumed to be passed through to another guest.
+func selectVFs(pfs []string) ([]string, error) {
+	selected := make([]string, 0, len(pfs))
+	for _, pf := range pfs {
+		vfs, err := ListVFs(pf)
+		if err != nil {
+			return nil, fmt.Errorf("list VFs of %s: %w", pf, err)
+		}
+		found := ""
+		for _, vf := range vfs {
+			if readPCIDriver(vf) != "vfio-pci" {
+				found = vf
+				break
+			}
+		}
+		if found == "" {
+			return nil, fmt.Errorf("no free VF on %s (%d VFs enabled)", pf, len(vfs))
+		}
+		selected = append(selected, found)
+	}
+	return selected, nil
+}
@@ -1,32 +1,46 @@
 package qemu
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net"
 	"os"
-	"os/exec"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
+const sshKeepaliveInterval = 15 * time.Second
+
+// SSHClient runs commands in the guest over a single reusable SSH connection.
+// The connection is dialed lazily and re-established transparently when the
+// guest reboots or sshd drops it.
 type SSHClient struct {
-	host       string
-	port       int
-	user       string
-	keyPath    string
-	timeout    time.Duration
-	knownHosts string
+	host    string
+	port    int
+	user    string
+	keyPath string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	signer ssh.Signer
+	client *ssh.Client
 }
 
 func NewSSHClient(host string, port int, keyPath string) *SSHClient {
 	return &SSHClient{
-		host:       host,
-		port:       port,
-		user:       "root",
-		keyPath:    keyPath,
-		timeout:    10 * time.Second,
-		knownHosts: "/dev/null",
+		host:    host,
+		port:    port,
+		user:    "root",
+		keyPath: keyPath,
+		timeout: 10 * time.Second,
 	}
 }
 
@@ -60,32 +74,203 @@ func (c *SSHClient) checkConnection(ctx context.Context) error {
 	return err
 }
 
+// Run executes command in the guest and returns its combined stdout and stderr.
 func (c *SSHClient) Run(ctx context.Context, command string) ([]byte, error) {
-	args := c.buildArgs(command)
-	return exec.CommandContext(ctx, "ssh", args...).CombinedOutput()
+	var buf bytes.Buffer
+	w := &lockedWriter{w: &buf}
+	err := c.run(ctx, command, nil, w, w)
+	return buf.Bytes(), err
 }
 
+// RunWithStdin executes command with stdin fed from the given string.
 func (c *SSHClient) RunWithStdin(ctx context.Context, command, stdin string) ([]byte, error) {
-	args := c.buildArgs(command)
-	cmd := exec.CommandContext(ctx, "ssh", args...)
-	cmd.Stdin = strings.NewReader(stdin)
-	return cmd.CombinedOutput()
+	var buf bytes.Buffer
+	w := &lockedWriter{w: &buf}
+	err := c.run(ctx, command, strings.NewReader(stdin), w, w)
+	return buf.Bytes(), err
+}
+
+// Stream executes command and copies its stdout and stderr to the given
+// writers as the output is produced.
+func (c *SSHClient) Stream(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	return c.run(ctx, command, nil, stdout, stderr)
+}
+
+// Close tears down the cached connection, if any.
+func (c *SSHClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
 }
 
-func (c *SSHClient) buildArgs(command string) []string {
-	args := []string{
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=" + c.knownHosts,
-		"-o", "ConnectTimeout=10",
-		"-o", "BatchMode=yes",
-		"-o", "LogLevel=ERROR",
-		"-p", strconv.Itoa(c.port),
+func (c *SSHClient) run(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	sess, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	if err := sess.Start(command); err != nil {
+		return fmt.Errorf("ssh start: %w", err)
 	}
-	if c.keyPath != "" {
-		args = append(args, "-i", c.keyPath)
+
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = sess.Signal(ssh.SIGKILL)
+		_ = sess.Close()
+		// Wait returns once the output copiers are done, so the caller's
+		// writers are no longer in use when run returns.
+		<-done
+		return ctx.Err()
 	}
-	args = append(args, fmt.Sprintf("%s@%s", c.user, c.host), command)
-	return args
+}
+
+// session opens a new channel on the cached connection, redialing once if the
+// cached connection turns out to be dead.
+func (c *SSHClient) session(ctx context.Context) (*ssh.Session, error) {
+	client, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := client.NewSession()
+	if err == nil {
+		return sess, nil
+	}
+
+	c.drop(client)
+	client, err = c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err = client.NewSession()
+	if err != nil {
+		c.drop(client)
+		return nil, fmt.Errorf("ssh session: %w", err)
+	}
+	return sess, nil
+}
+
+func (c *SSHClient) connect(ctx context.Context) (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	cfg, err := c.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial %s: %w", addr, err)
+	}
+
+	// The handshake itself does not honour ctx; bound it with a deadline.
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake %s: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	c.client = client
+	go c.keepalive(client)
+	return client, nil
+}
+
+func (c *SSHClient) clientConfig() (*ssh.ClientConfig, error) {
+	if c.signer == nil {
+		if c.keyPath == "" {
+			return nil, fmt.Errorf("ssh: no private key configured")
+		}
+		data, err := os.ReadFile(c.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read ssh key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse ssh key: %w", err)
+		}
+		c.signer = signer
+	}
+	return &ssh.ClientConfig{
+		User: c.user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(c.signer)},
+		// Guest host keys are regenerated on every fresh overlay.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         c.timeout,
+	}, nil
+}
+
+// keepalive probes the connection periodically and drops it when the peer
+// stops answering, so that a black-holed connection is not reused forever.
+func (c *SSHClient) keepalive(client *ssh.Client) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errCh <- err
+		}()
+
+		select {
+		case err := <-errCh:
+			if err == nil {
+				continue
+			}
+		case <-time.After(c.timeout):
+		}
+		c.drop(client)
+		return
+	}
+}
+
+// drop closes client and forgets it if it is still the cached connection.
+func (c *SSHClient) drop(client *ssh.Client) {
+	c.mu.Lock()
+	if c.client == client {
+		c.client = nil
+	}
+	c.mu.Unlock()
+	_ = client.Close()
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
 
 func (c *SSHClient) CheckNVIDIA(ctx context.Context) error {
@@ -214,40 +399,116 @@ func parseGPUMetrics(output string) (*GPUMetrics, error) {
 	return metrics, nil
 }
 
+// CopyFile uploads a local file to remotePath over SFTP, preserving its mode.
 func (c *SSHClient) CopyFile(ctx context.Context, localPath, remotePath string) error {
-	args := []string{
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=" + c.knownHosts,
-		"-o", "ConnectTimeout=10",
-		"-o", "BatchMode=yes",
-		"-P", strconv.Itoa(c.port),
-	}
-	if c.keyPath != "" {
-		args = append(args, "-i", c.keyPath)
-	}
-	args = append(args, localPath, fmt.Sprintf("%s@%s:%s", c.user, c.host, remotePath))
-	out, err := exec.CommandContext(ctx, "scp", args...).CombinedOutput()
+	src, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("scp: %w: %s", err, strings.TrimSpace(string(out)))
+		return fmt.Errorf("open %s: %w", localPath, err)
 	}
-	return nil
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", localPath, err)
+	}
+
+	return c.withSFTP(ctx, func(fs *sftp.Client) error {
+		return writeRemote(fs, remotePath, src, info.Mode().Perm())
+	})
 }
 
+// WriteFile creates or truncates remotePath with the given content, creating
+// parent directories as needed. A zero mode leaves the default permissions.
 func (c *SSHClient) WriteFile(ctx context.Context, remotePath, content string, mode os.FileMode) error {
-	dir := remotePath[:strings.LastIndex(remotePath, "/")]
-	if dir != "" {
-		if _, err := c.Run(ctx, fmt.Sprintf("mkdir -p %s", shellQuote(dir))); err != nil {
-			return fmt.Errorf("create directory: %w", err)
+	return c.withSFTP(ctx, func(fs *sftp.Client) error {
+		return writeRemote(fs, remotePath, strings.NewReader(content), mode)
+	})
+}
+
+// UploadFile streams r to remotePath, creating parent directories as needed.
+// The content goes to a temporary file renamed into place once complete, so
+// an interrupted upload never leaves a partial file behind.
+func (c *SSHClient) UploadFile(ctx context.Context, remotePath string, r io.Reader, mode os.FileMode) error {
+	return c.withSFTP(ctx, func(fs *sftp.Client) error {
+		tmp := path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".upload")
+		if err := writeRemote(fs, tmp, r, mode); err != nil {
+			_ = fs.Remove(tmp)
+			return err
+		}
+		if err := fs.PosixRename(tmp, remotePath); err != nil {
+			_ = fs.Remove(tmp)
+			return fmt.Errorf("rename %s: %w", tmp, err)
 		}
+		return nil
+	})
+}
+
+// ReadFile opens remotePath over SFTP and passes its size and content to fn.
+func (c *SSHClient) ReadFile(ctx context.Context, remotePath string, fn func(size int64, r io.Reader) error) error {
+	return c.withSFTP(ctx, func(fs *sftp.Client) error {
+		f, err := fs.Open(remotePath)
+		if err != nil {
+			return fmt.Errorf("open remote %s: %w", remotePath, err)
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("stat remote %s: %w", remotePath, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", remotePath)
+		}
+		return fn(info.Size(), f)
+	})
+}
+
+func (c *SSHClient) withSFTP(ctx context.Context, fn func(*sftp.Client) error) error {
+	client, err := c.connect(ctx)
+	if err != nil {
+		return err
 	}
-	cmd := fmt.Sprintf("cat > %s << 'QUDATA_EOF'\n%s\nQUDATA_EOF", shellQuote(remotePath), content)
-	if out, err := c.Run(ctx, cmd); err != nil {
-		return fmt.Errorf("write file: %w: %s", err, strings.TrimSpace(string(out)))
+	fs, err := sftp.NewClient(client)
+	if err != nil {
+		c.drop(client)
+		return fmt.Errorf("sftp: %w", err)
 	}
+	defer fs.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- fn(fs) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = fs.Close()
+		return ctx.Err()
+	}
+}
+
+func writeRemote(fs *sftp.Client, remotePath string, r io.Reader, mode os.FileMode) error {
+	if dir := path.Dir(remotePath); dir != "." && dir != "/" {
+		if err := fs.MkdirAll(dir); err != nil {
+			return fmt.Errorf("create directory %s: %w", dir, err)
+		}
+	}
+
+	dst, err := fs.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("open remote %s: %w", remotePath, err)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		return fmt.Errorf("write remote %s: %w", remotePath, err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("close remote %s: %w", remotePath, err)
+	}
+
 	if mode != 0 {
-		cmd = fmt.Sprintf("chmod %o %s", mode, shellQuote(remotePath))
-		if out, err := c.Run(ctx, cmd); err != nil {
-			return fmt.Errorf("chmod: %w: %s", err, strings.TrimSpace(string(out)))
+		if err := fs.Chmod(remotePath, mode); err != nil {
+			return fmt.Errorf("chmod %s: %w", remotePath, err)
 		}
 	}
 	return nil
@@ -0,0 +1,40 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockLimitCmd locks the graphics clock of every NVIDIA GPU in the guest to
+// at most mhz, or removes the lock when mhz is 0.
+func clockLimitCmd(mhz int) string {
+	if mhz > 0 {
+		return fmt.Sprintf("nvidia-smi -lgc 0,%d", mhz)
+	}
+	return "nvidia-smi -rgc"
+}
+
+// LimitGPUClocks caps the graphics clock of the instance's GPUs at mhz to
+// bring their temperature down; 0 lifts the cap.
+func (m *Manager) LimitGPUClocks(ctx context.Context, mhz int) error {
+	m.mu.Lock()
+	ssh, vendor := m.sshClient, m.gpuVendor
+	m.mu.Unlock()
+
+	if ssh == nil {
+		return errors.New("instance SSH not ready")
+	}
+	if vendor == VendorAMD {
+		return errors.New("GPU clock limits are only supported on NVIDIA GPUs")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := ssh.Run(ctx, clockLimitCmd(mhz))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", clockLimitCmd(mhz), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
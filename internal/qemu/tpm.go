@@ -0,0 +1,86 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// tpmStateFile is where swtpm keeps the TPM 2.0 state, guest secrets
+	// sealed to the TPM included.
+	tpmStateFile = "tpm2-00.permall"
+	// swtpmStartTimeout bounds the wait for the swtpm control socket.
+	swtpmStartTimeout = 5 * time.Second
+)
+
+// tpmDir holds the swtpm state, control socket and log of vmID.
+func tpmDir(runDir, vmID string) string {
+	return filepath.Join(runDir, vmID+".tpm")
+}
+
+// startSwtpm starts the TPM 2.0 emulator of vmID and waits for its control
+// socket. It exits by itself once QEMU closes the connection.
+func (m *Manager) startSwtpm(vmID string) (*os.Process, string, error) {
+	dir := tpmDir(m.runDir, vmID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, "", fmt.Errorf("create tpm dir: %w", err)
+	}
+	socket := filepath.Join(dir, "swtpm.sock")
+	_ = os.Remove(socket)
+
+	cmd := exec.Command(m.swtpmBin, "socket", "--tpm2",
+		"--tpmstate", "dir="+dir,
+		"--ctrl", "type=unixio,path="+socket,
+		"--log", "file="+filepath.Join(dir, "swtpm.log"),
+		"--terminate",
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("start swtpm: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(swtpmStartTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			return cmd.Process, socket, nil
+		}
+		select {
+		case <-exited:
+			return nil, "", fmt.Errorf("swtpm exited: %s", qemuLogTail(filepath.Join(dir, "swtpm.log")))
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			_ = cmd.Process.Kill()
+			return nil, "", fmt.Errorf("swtpm socket did not appear within %s", swtpmStartTimeout)
+		}
+	}
+}
+
+// stopSwtpm kills an emulator that QEMU did not take over.
+func stopSwtpm(proc *os.Process) {
+	if proc != nil {
+		_ = proc.Kill()
+	}
+}
+
+// tpmArgs attaches the emulator listening on socket as a CRB TPM, the
+// interface UEFI guests expect on q35.
+func tpmArgs(socket string) []string {
+	return []string{
+		"-chardev", "socket,id=chrtpm,path=" + socket,
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", "tpm-crb,tpmdev=tpm0",
+	}
+}
+
+// removeTPMState removes the TPM directory of vmID.
+func removeTPMState(runDir, vmID string) {
+	_ = os.RemoveAll(tpmDir(runDir, vmID))
+}
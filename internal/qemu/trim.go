@@ -0,0 +1,42 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// diskDiscardOpts pass guest discards down to the qcow2 image and turn
+// zeroed writes into discards, so that space freed in the guest is freed in
+// the image file too.
+const diskDiscardOpts = ",discard=unmap,detect-zeroes=unmap"
+
+// fstrimCmd discards the free space of every mounted filesystem that
+// supports it. fstrim exits 32 when some filesystems could not be trimmed.
+const fstrimCmd = "fstrim -av || [ $? -eq 32 ]"
+
+// fstrimTrimmed matches the byte count of a line of fstrim -v output, such
+// as "/: 1.2 GiB (1288490188 bytes) trimmed on /dev/vda1".
+var fstrimTrimmed = regexp.MustCompile(`\((\d+) bytes\) trimmed`)
+
+// TrimGuest runs fstrim in the guest and returns the bytes it discarded.
+func (m *Manager) TrimGuest(ctx context.Context) (uint64, error) {
+	ssh, err := m.guestSSH()
+	if err != nil {
+		return 0, err
+	}
+	out, err := ssh.Run(ctx, fstrimCmd)
+	if err != nil {
+		return 0, domain.ErrQEMU{Op: "fstrim", Err: fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))}
+	}
+	var total uint64
+	for _, match := range fstrimTrimmed.FindAllSubmatch(out, -1) {
+		n, _ := strconv.ParseUint(string(match[1]), 10, 64)
+		total += n
+	}
+	return total, nil
+}
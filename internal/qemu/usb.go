@@ -0,0 +1,110 @@
+package qemu
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	// usbControllerID names the xHCI controller. Every VM gets one so that
+	// USB devices can be hotplugged; its bus is usbControllerID + ".0".
+	usbControllerID = "usb"
+	sysBusUSB       = "/sys/bus/usb/devices"
+)
+
+// usbArgs returns the USB controller and a usb-host device for each of devs.
+func usbArgs(devs []domain.USBDevice) []string {
+	args := []string{"-device", "qemu-xhci,id=" + usbControllerID}
+	for _, d := range devs {
+		args = append(args, "-device", fmt.Sprintf("usb-host,bus=%s.0,vendorid=0x%s,productid=0x%s,id=%s",
+			usbControllerID, d.VendorID, d.ProductID, usbDeviceID(d)))
+	}
+	return args
+}
+
+func usbDeviceID(d domain.USBDevice) string {
+	return "usb-" + d.VendorID + "-" + d.ProductID
+}
+
+// usbPresent reports whether a device with d's IDs is plugged into the host.
+func usbPresent(d domain.USBDevice) bool {
+	dirs, _ := filepath.Glob(filepath.Join(sysBusUSB, "*"))
+	for _, dir := range dirs {
+		vendor, err := readSysfsAttr(dir, "idVendor")
+		if err != nil || vendor != d.VendorID {
+			continue
+		}
+		if product, _ := readSysfsAttr(dir, "idProduct"); product == d.ProductID {
+			return true
+		}
+	}
+	return false
+}
+
+// AttachUSB hotplugs a host USB device into the running instance with
+// device_add. QEMU opens the device itself, detaching it from host drivers.
+func (m *Manager) AttachUSB(dev domain.USBDevice) ([]domain.USBDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.usbReadyLocked("usb attach"); err != nil {
+		return nil, err
+	}
+	if slices.Contains(m.spec.USB, dev) {
+		return nil, domain.ErrUSBAttached{Device: dev}
+	}
+	if !usbPresent(dev) {
+		return nil, domain.ErrUSBNotPresent{Device: dev}
+	}
+	if err := m.qmp.DeviceAdd(map[string]interface{}{
+		"driver":    "usb-host",
+		"bus":       usbControllerID + ".0",
+		"vendorid":  "0x" + dev.VendorID,
+		"productid": "0x" + dev.ProductID,
+		"id":        usbDeviceID(dev),
+	}); err != nil {
+		return nil, domain.ErrQEMU{Op: "device_add", Err: err}
+	}
+	m.spec.USB = append(m.spec.USB, dev)
+	m.logger.Info("usb device attached", "vm_id", m.vmID, "device", dev.String())
+	return slices.Clone(m.spec.USB), nil
+}
+
+// DetachUSB unplugs a USB device from the instance with device_del.
+func (m *Manager) DetachUSB(dev domain.USBDevice) ([]domain.USBDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.usbReadyLocked("usb detach"); err != nil {
+		return nil, err
+	}
+	i := slices.Index(m.spec.USB, dev)
+	if i < 0 {
+		return nil, domain.ErrUSBNotAttached{Device: dev}
+	}
+	if err := m.qmp.DeviceDel(usbDeviceID(dev)); err != nil {
+		return nil, domain.ErrQEMU{Op: "device_del", Err: err}
+	}
+	m.spec.USB = slices.Delete(m.spec.USB, i, i+1)
+	m.logger.Info("usb device detached", "vm_id", m.vmID, "device", dev.String())
+	return slices.Clone(m.spec.USB), nil
+}
+
+func (m *Manager) usbReadyLocked(op string) error {
+	if m.vmID == "" {
+		return domain.ErrNoInstanceRunning{}
+	}
+	m.observeLocked()
+	switch m.status {
+	case domain.StatusRunning, domain.StatusDegraded, domain.StatusPaused:
+	default:
+		return domain.ErrCommandNotAllowed{Command: domain.InstanceCommand(op), Status: m.status}
+	}
+	if m.qmp == nil || !m.qmp.Connected() {
+		return domain.ErrQEMU{Op: op, Err: fmt.Errorf("QMP not connected")}
+	}
+	return nil
+}
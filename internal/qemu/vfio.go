@@ -44,7 +44,8 @@ type IOMMUGroupDevice struct {
 	IsBridge bool
 }
 
-// VFIO manages PCI device binding to the vfio-pci driver for GPU passthrough.
+// VFIO manages PCI device binding to the vfio-pci driver for GPU passthrough
+// and, with NewDeviceVFIO, for other PCI devices.
 type VFIO struct {
 	addr            string
 	vendorID        string
@@ -54,6 +55,10 @@ type VFIO struct {
 	bound           bool
 	groupDevices    []IOMMUGroupDevice
 	boundGroupAddrs []string
+	// device marks a PCI device other than a GPU, such as an NVMe drive
+	// or a NIC. Only the device itself is bound; nothing else in its
+	// IOMMU group may be in use by the host.
+	device bool
 }
 
 // NewVFIO creates a VFIO manager for the given PCI address (e.g. "0000:01:00.0").
@@ -61,11 +66,54 @@ func NewVFIO(addr string) *VFIO {
 	return &VFIO{addr: addr}
 }
 
+// NewDeviceVFIO creates a VFIO manager for a PCI device that is not a GPU.
+func NewDeviceVFIO(addr string) *VFIO {
+	return &VFIO{addr: addr, device: true}
+}
+
 // Bind detaches the GPU from its host driver and attaches it to vfio-pci.
 //
 // Safety: refuses to hot-unbind nouveau (kernel crash risk).
 // The install script ensures nouveau is blacklisted before the agent runs.
+// The device and its IOMMU group are locked for the duration of the bind.
 func (v *VFIO) Bind() error {
+	unlock := vfioLocks.lock(iommuGroupAddrs(v.addr)...)
+	defer unlock()
+
+	if !vfioLocks.claim(v.addr, v) {
+		return fmt.Errorf("pci device %s is already passed through by another instance", v.addr)
+	}
+	if err := v.bind(); err != nil {
+		vfioLocks.release(v.addr, v)
+		return err
+	}
+	return nil
+}
+
+// Check reports why the device could not be passed through, without
+// touching it: it must exist, sit in an IOMMU group free of host devices and
+// not be driven by nouveau. It returns the driver the device is bound to.
+func (v *VFIO) Check() (driver string, err error) {
+	deviceDir := filepath.Join(devicesDir, v.addr)
+	if _, err := os.Stat(deviceDir); err != nil {
+		return "", fmt.Errorf("pci device %s not found: %w", v.addr, err)
+	}
+	if _, err := os.Readlink(filepath.Join(deviceDir, "iommu_group")); err != nil {
+		return "", fmt.Errorf("read iommu_group: %w (is IOMMU enabled in BIOS and kernel?)", err)
+	}
+	if err := v.validateIOMMUGroup(); err != nil {
+		return "", err
+	}
+	if link, err := os.Readlink(filepath.Join(deviceDir, "driver")); err == nil {
+		driver = filepath.Base(link)
+	}
+	if driver == "nouveau" {
+		return driver, fmt.Errorf("GPU %s is bound to nouveau; blacklist nouveau and reboot", v.addr)
+	}
+	return driver, nil
+}
+
+func (v *VFIO) bind() error {
 	deviceDir := filepath.Join(devicesDir, v.addr)
 
 	if _, err := os.Stat(deviceDir); err != nil {
@@ -103,8 +151,11 @@ func (v *VFIO) Bind() error {
 				"Blacklist nouveau and reboot first", v.addr)
 	}
 
-	if err := v.unloadGPUModules(); err != nil {
-		return err
+	// The PF driver manages its VFs and must stay loaded.
+	if !v.device && !IsVF(v.addr) {
+		if err := v.unloadGPUModules(); err != nil {
+			return err
+		}
 	}
 
 	if err := v.bindAllGroupDevices(); err != nil {
@@ -158,7 +209,15 @@ func (v *VFIO) validateIOMMUGroup() error {
 		if dev.IsBridge {
 			continue
 		}
-		if dev.IsAudio && strings.HasPrefix(dev.Vendor, "0x10de") {
+		if v.device {
+			// The group shares one DMA context, so whatever else is in
+			// it would be reachable from the guest.
+			if addr != v.addr && dev.Driver != "" && dev.Driver != "vfio-pci" {
+				problemDevices = append(problemDevices, fmt.Sprintf("%s (class %s, driver %s)", addr, dev.Class, dev.Driver))
+			}
+			continue
+		}
+		if isCompanionAudio(dev) {
 			continue
 		}
 		if dev.IsGPU && addr == v.addr {
@@ -170,17 +229,60 @@ func (v *VFIO) validateIOMMUGroup() error {
 	}
 
 	if len(problemDevices) > 0 {
-		return fmt.Errorf("IOMMU group %s contains devices that may prevent passthrough:\n  %s\n\nEither:\n1. Bind all devices to vfio-pci manually\n2. Use ACS override patch to isolate the GPU\n3. Use a different PCIe slot",
+		return fmt.Errorf("IOMMU group %s contains devices that may prevent passthrough:\n  %s\n\nEither:\n1. Bind all devices to vfio-pci manually\n2. Use ACS override patch to isolate the device\n3. Use a different PCIe slot",
 			v.group, strings.Join(problemDevices, "\n  "))
 	}
 
 	return nil
 }
 
+// unloadGPUModules runs under the global module lock: modules are shared
+// by every device of the vendor, so two binds must not unload them at once.
 func (v *VFIO) unloadGPUModules() error {
-	if v.origDriver != "nvidia" {
+	vfioLocks.modules.Lock()
+	defer vfioLocks.modules.Unlock()
+
+	switch v.origDriver {
+	case "nvidia":
+		return v.unloadNVIDIAModules()
+	case "amdgpu":
+		return v.unloadAMDGPUModule()
+	}
+	return nil
+}
+
+// unloadAMDGPUModule releases the GPU from amdgpu. The module is only
+// removed when no other device depends on it; otherwise the per-device
+// unbind in bindSingleDevice is enough.
+func (v *VFIO) unloadAMDGPUModule() error {
+	unbindVTConsoles()
+
+	if !isModuleLoaded("amdgpu") || driverDeviceCount("amdgpu") > 1 {
 		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), rmmodTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "rmmod", "amdgpu").CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("rmmod amdgpu timed out after %v — GPU may be in use by another process", rmmodTimeout)
+		}
+		if strings.Contains(msg, "in use") {
+			return fmt.Errorf("GPU is in use, cannot bind to VFIO: failed to unload amdgpu: %s", msg)
+		}
+		return fmt.Errorf("failed to unload module amdgpu: %w: %s", err, msg)
+	}
+	return nil
+}
+
+// driverDeviceCount returns the number of PCI devices bound to driver.
+func driverDeviceCount(driver string) int {
+	matches, _ := filepath.Glob(filepath.Join(sysBusPCI, "drivers", driver, "0000:*"))
+	return len(matches)
+}
+
+func (v *VFIO) unloadNVIDIAModules() error {
 
 	for _, svc := range nvidiaServices {
 		_ = exec.Command("systemctl", "stop", svc).Run()
@@ -229,12 +331,36 @@ func unbindVTConsoles() {
 	}
 }
 
+// Companions returns the audio functions in the GPU's IOMMU group, which are
+// bound with it and passed through alongside it.
+func (v *VFIO) Companions() []string {
+	if v.device {
+		return nil
+	}
+	var addrs []string
+	for _, dev := range v.groupDevices {
+		if dev.Addr != v.addr && isCompanionAudio(dev) {
+			addrs = append(addrs, dev.Addr)
+		}
+	}
+	return addrs
+}
+
 func (v *VFIO) bindAllGroupDevices() error {
+	if v.device {
+		if readPCIDriver(v.addr) == "vfio-pci" {
+			return nil
+		}
+		if err := v.bindSingleDevice(v.addr); err != nil {
+			return fmt.Errorf("bind device %s: %w", v.addr, err)
+		}
+		return nil
+	}
 	for _, dev := range v.groupDevices {
 		if dev.IsBridge {
 			continue
 		}
-		if !dev.IsGPU && !(dev.IsAudio && strings.HasPrefix(dev.Vendor, "0x10de")) {
+		if !dev.IsGPU && !isCompanionAudio(dev) {
 			continue
 		}
 
@@ -309,6 +435,10 @@ func (v *VFIO) Unbind() error {
 	}
 
 	allAddrs := append([]string{v.addr}, v.boundGroupAddrs...)
+	unlock := vfioLocks.lock(allAddrs...)
+	defer unlock()
+	defer vfioLocks.release(v.addr, v)
+
 	for i := len(allAddrs) - 1; i >= 0; i-- {
 		v.unbindSingleDevice(allAddrs[i])
 	}
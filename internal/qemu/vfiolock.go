@@ -0,0 +1,145 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// vfioLocks serializes VFIO operations across every Manager in the process.
+var vfioLocks = newVFIOCoordinator()
+
+// vfioCoordinator hands out per-device locks in FIFO order and guards kernel
+// module unloading, which affects every device using the module.
+type vfioCoordinator struct {
+	mu      sync.Mutex
+	held    map[string]bool
+	owners  map[string]*VFIO
+	waiters []*vfioWaiter
+
+	// modules is held while GPU driver modules are stopped and unloaded.
+	modules sync.Mutex
+}
+
+type vfioWaiter struct {
+	addrs []string
+	ready chan struct{}
+}
+
+func newVFIOCoordinator() *vfioCoordinator {
+	return &vfioCoordinator{
+		held:   make(map[string]bool),
+		owners: make(map[string]*VFIO),
+	}
+}
+
+// lock blocks until all addrs are free and returns the function releasing
+// them. Requests are granted in arrival order per device, so a bind cannot be
+// starved by a stream of later operations on the same device.
+func (c *vfioCoordinator) lock(addrs ...string) func() {
+	addrs = uniqueSorted(addrs)
+
+	c.mu.Lock()
+	if len(c.waiters) == 0 && c.freeLocked(addrs, nil) {
+		c.holdLocked(addrs, true)
+		c.mu.Unlock()
+		return func() { c.unlock(addrs) }
+	}
+	w := &vfioWaiter{addrs: addrs, ready: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+
+	<-w.ready
+	return func() { c.unlock(addrs) }
+}
+
+func (c *vfioCoordinator) unlock(addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holdLocked(addrs, false)
+
+	// Wake waiters in order. A device wanted by an earlier waiter is
+	// reserved for it even if a later waiter could take it now.
+	reserved := make(map[string]bool)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if c.freeLocked(w.addrs, reserved) {
+			c.holdLocked(w.addrs, true)
+			close(w.ready)
+			continue
+		}
+		for _, a := range w.addrs {
+			reserved[a] = true
+		}
+		pending = append(pending, w)
+	}
+	c.waiters = pending
+}
+
+func (c *vfioCoordinator) freeLocked(addrs []string, reserved map[string]bool) bool {
+	for _, a := range addrs {
+		if c.held[a] || reserved[a] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *vfioCoordinator) holdLocked(addrs []string, held bool) {
+	for _, a := range addrs {
+		if held {
+			c.held[a] = true
+		} else {
+			delete(c.held, a)
+		}
+	}
+}
+
+// claim records v as the owner of addr. It fails if another VFIO in this
+// process already passes the device through.
+func (c *vfioCoordinator) claim(addr string, v *VFIO) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.owners[addr]; ok && owner != v {
+		return false
+	}
+	c.owners[addr] = v
+	return true
+}
+
+func (c *vfioCoordinator) release(addr string, v *VFIO) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owners[addr] == v {
+		delete(c.owners, addr)
+	}
+}
+
+// iommuGroupAddrs returns addr together with the other devices in its IOMMU
+// group, all of which a bind may touch.
+func iommuGroupAddrs(addr string) []string {
+	addrs := []string{addr}
+	entries, err := os.ReadDir(filepath.Join(devicesDir, addr, "iommu_group", "devices"))
+	if err != nil {
+		return addrs
+	}
+	for _, e := range entries {
+		addrs = append(addrs, e.Name())
+	}
+	return addrs
+}
+
+func uniqueSorted(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
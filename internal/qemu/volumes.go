@@ -0,0 +1,41 @@
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// volumeDriveArgs attaches volumes as virtio disks. The volume name is the
+// disk serial, under which the guest lists it in /dev/disk/by-id.
+func volumeDriveArgs(volumes []domain.VolumeAttachment, opts DiskOptions) []string {
+	var args []string
+	for _, v := range volumes {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio,serial=%s", v.Path, v.Name)+opts.driveOpts())
+	}
+	return args
+}
+
+// mountVolumes mounts the volumes under domain.VolumeMountDir, formatting
+// those that hold no filesystem yet, and adds them to fstab so that they
+// come back after a guest reboot.
+func mountVolumes(ctx context.Context, ssh *SSHClient, volumes []domain.VolumeAttachment) error {
+	for _, v := range volumes {
+		dev := "/dev/disk/by-id/virtio-" + v.Name
+		dir := path.Join(domain.VolumeMountDir, v.Name)
+		cmd := fmt.Sprintf(`d=%s; m=%s; `, dev, dir) +
+			`for i in $(seq 30); do [ -b $d ] && break; sleep 1; done; ` +
+			`[ -b $d ] || { echo "$d not found" >&2; exit 1; }; ` +
+			`blkid $d >/dev/null 2>&1 || mkfs.ext4 -q $d && ` +
+			`mkdir -p $m && ` +
+			`{ grep -q " $m " /etc/fstab || echo "$d $m ext4 defaults,nofail 0 2" >> /etc/fstab; } && ` +
+			`{ mountpoint -q $m || mount $m; }`
+		if out, err := ssh.Run(ctx, cmd); err != nil {
+			return fmt.Errorf("volume %s: %w: %s", v.Name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package qemu
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	qmpProbeInterval = 10 * time.Second
+	qmpProbeTimeout  = 5 * time.Second
+	// qmpHungAfter is the number of consecutive failed probes after which
+	// the monitor is considered hung.
+	qmpHungAfter = 3
+)
+
+// SetEventSink registers a callback for instance alerts raised by the manager.
+// fn may be called with the manager locked and must not call back into it.
+func (m *Manager) SetEventSink(fn func(domain.Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = fn
+}
+
+// watchQMP probes the monitor until the VM exits. A hung QEMU main loop
+// leaves the socket open but stops answering, so every QMP call would wait
+// for the full read deadline. After repeated probe failures the instance is
+// marked degraded, observeLocked stops querying QMP, and the connection is
+// torn down and redialed until QEMU answers again.
+func (m *Manager) watchQMP(client *QMPClient, done <-chan struct{}) {
+	ticker := time.NewTicker(qmpProbeInterval)
+	defer ticker.Stop()
+
+	var inflight chan error
+	failures := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		current := m.qmp == client
+		m.mu.Unlock()
+		if !current {
+			return
+		}
+
+		// A probe still waiting on the previous tick counts as another failure.
+		if inflight == nil {
+			inflight = make(chan error, 1)
+			go func(ch chan<- error) {
+				_, _, err := client.QueryStatus()
+				ch <- err
+			}(inflight)
+		}
+
+		var err error
+		select {
+		case err = <-inflight:
+			inflight = nil
+		case <-time.After(qmpProbeTimeout):
+			err = fmt.Errorf("no response within %v", qmpProbeTimeout)
+		}
+
+		if err == nil {
+			if failures >= qmpHungAfter {
+				m.qmpRecovered()
+			}
+			failures = 0
+			continue
+		}
+
+		failures++
+		m.logger.Warn("QMP probe failed", "err", err, "consecutive", failures)
+		if failures == qmpHungAfter {
+			m.qmpHung(err)
+		}
+		if failures >= qmpHungAfter {
+			// Closing the socket unblocks a command stuck on the hung monitor.
+			client.Abort()
+			inflight = nil
+			if rerr := client.Reconnect(); rerr != nil {
+				m.logger.Warn("QMP reconnect failed", "err", rerr)
+			}
+		}
+	}
+}
+
+func (m *Manager) qmpHung(cause error) {
+	m.mu.Lock()
+	m.qmpDegraded = true
+	m.setStatusLocked(domain.StatusDegraded, domain.ReasonQMPHung)
+	vmID, sink := m.vmID, m.events
+	m.mu.Unlock()
+
+	m.logger.Error("QMP monitor hung", "vm_id", vmID, "err", cause)
+	if sink != nil {
+		sink(domain.Event{
+			Type:     domain.EventQMPHung,
+			Severity: domain.SeverityCritical,
+			Message:  fmt.Sprintf("QEMU monitor stopped responding: %v", cause),
+			Data:     map[string]any{"vm_id": vmID},
+			Time:     time.Now().UTC(),
+		})
+	}
+}
+
+func (m *Manager) qmpRecovered() {
+	m.mu.Lock()
+	m.qmpDegraded = false
+	m.observeLocked()
+	vmID, sink := m.vmID, m.events
+	m.mu.Unlock()
+
+	m.logger.Info("QMP monitor recovered", "vm_id", vmID)
+	if sink != nil {
+		sink(domain.Event{
+			Type:     domain.EventQMPHung,
+			Severity: domain.SeverityInfo,
+			Message:  "QEMU monitor is responding again",
+			Data:     map[string]any{"vm_id": vmID, "recovered": true},
+			Time:     time.Now().UTC(),
+		})
+	}
+}
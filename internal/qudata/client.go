@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/metrics"
 )
 
 // Client communicates with the Qudata API for agent lifecycle and telemetry.
@@ -20,8 +22,9 @@ type Client struct {
 	baseURL string
 	apiKey  string
 
-	mu     sync.RWMutex
-	secret string
+	mu       sync.RWMutex
+	secret   string
+	encoding string
 
 	http   *http.Client
 	logger *slog.Logger
@@ -50,6 +53,25 @@ func (c *Client) UseSecret(secret string) {
 	c.secret = secret
 }
 
+// AuthHeader returns the headers authenticating a request to the API, for
+// callers that stream bodies outside doRequest.
+func (c *Client) AuthHeader() http.Header {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := http.Header{}
+	if c.secret != "" {
+		h.Set("X-Agent-Secret", c.secret)
+	} else {
+		h.Set("X-API-Key", c.apiKey)
+	}
+	return h
+}
+
+// BaseURL returns the API base URL.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
 // Ping verifies connectivity to the Qudata API.
 func (c *Client) Ping(ctx context.Context) error {
 	_, err := c.doRequest(ctx, http.MethodGet, "/ping", nil)
@@ -78,6 +100,22 @@ func (c *Client) InitAgent(ctx context.Context, req domain.InitAgentRequest) (*d
 	return &resp.Data, nil
 }
 
+// UpdateHost changes attributes of the registered host.
+func (c *Client) UpdateHost(ctx context.Context, upd domain.HostUpdate) error {
+	body, err := json.Marshal(upd)
+	if err != nil {
+		return fmt.Errorf("marshal host update: %w", err)
+	}
+	_, err = c.doRequest(ctx, http.MethodPatch, "/init/host", body)
+	return err
+}
+
+// Unregister removes the agent and its host from the platform.
+func (c *Client) Unregister(ctx context.Context) error {
+	_, err := c.doRequest(ctx, http.MethodDelete, "/init", nil)
+	return err
+}
+
 // RegisterHost sends the host hardware configuration to the API.
 func (c *Client) RegisterHost(ctx context.Context, req domain.CreateHostRequest) error {
 	body, err := json.Marshal(req)
@@ -94,18 +132,101 @@ func (c *Client) RegisterHost(ctx context.Context, req domain.CreateHostRequest)
 
 // SendStats publishes a telemetry snapshot to the API.
 func (c *Client) SendStats(ctx context.Context, report domain.StatsReport) error {
-	body, err := json.Marshal(report)
+	return c.sendTelemetry(ctx, "/stats", report)
+}
+
+// SendStatsBatch publishes snapshots held back during an outage.
+func (c *Client) SendStatsBatch(ctx context.Context, batch domain.StatsBatch) error {
+	return c.sendTelemetry(ctx, "/stats/batch", batch)
+}
+
+// SendHeartbeat reports measured availability and returns the highest
+// downtime interval sequence acknowledged by the API.
+func (c *Client) SendHeartbeat(ctx context.Context, hb domain.Heartbeat) (uint64, error) {
+	body, err := json.Marshal(hb)
 	if err != nil {
-		return fmt.Errorf("marshal stats: %w", err)
+		return 0, fmt.Errorf("marshal heartbeat: %w", err)
 	}
 
-	_, err = c.doRequest(ctx, http.MethodPost, "/stats", body)
+	data, err := c.doRequest(ctx, http.MethodPost, "/heartbeat", body)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp domain.HeartbeatResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, fmt.Errorf("unmarshal heartbeat response: %w", err)
+	}
+	return resp.Data.AckedSeq, nil
+}
+
+// SendUsage reports cumulative per-instance usage for billing.
+func (c *Client) SendUsage(ctx context.Context, report domain.UsageReport) error {
+	return c.sendTelemetry(ctx, "/usage", report)
+}
+
+// SendEvent reports a host or instance event to the API.
+func (c *Client) SendEvent(ctx context.Context, ev domain.Event) error {
+	return c.sendTelemetry(ctx, "/events", ev)
+}
+
+// SendLogs ships a batch of agent log records.
+func (c *Client) SendLogs(ctx context.Context, batch domain.LogBatch) error {
+	return c.sendTelemetry(ctx, "/logs", batch)
+}
+
+// SetDNSChallenge asks the API to publish an ACME DNS-01 TXT record. The
+// call returns once the record is served by the authoritative nameservers.
+func (c *Client) SetDNSChallenge(ctx context.Context, ch domain.DNSChallenge) error {
+	body, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("marshal dns challenge: %w", err)
+	}
+	_, err = c.doRequest(ctx, http.MethodPost, "/dns/challenge", body)
+	return err
+}
+
+// ClearDNSChallenge removes a record published by SetDNSChallenge.
+func (c *Client) ClearDNSChallenge(ctx context.Context, ch domain.DNSChallenge) error {
+	body, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("marshal dns challenge: %w", err)
+	}
+	_, err = c.doRequest(ctx, http.MethodDelete, "/dns/challenge", body)
 	return err
 }
 
 // --- internal ---
 
+// StatusError is returned for non-2xx API responses.
+type StatusError struct {
+	Method string
+	Path   string
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API %s %s returned %d: %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+// Rejected reports whether the API refused the request itself, as opposed
+// to being unavailable or rate limiting, so that resending it cannot help.
+func Rejected(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.Status >= 400 && se.Status < 500 &&
+		se.Status != http.StatusRequestTimeout && se.Status != http.StatusTooManyRequests &&
+		se.Status != http.StatusUnauthorized
+}
+
 func (c *Client) doRequest(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	return c.doRequestAs(ctx, method, path, body, contentTypeJSON)
+}
+
+func (c *Client) doRequestAs(ctx context.Context, method, path string, body []byte, contentType string) ([]byte, error) {
 	url := c.baseURL + path
 
 	var bodyReader io.Reader
@@ -118,7 +239,7 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body []byte
 		return nil, fmt.Errorf("create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 
 	c.mu.RLock()
 	secret := c.secret
@@ -136,14 +257,16 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body []byte
 		"method", method,
 		"url", url,
 		"auth", authKind,
-		"body", truncate(string(body), 2048),
+		"body", logBody(body, contentType),
 	)
 
 	resp, err := c.http.Do(req)
 	if err != nil {
+		metrics.ObserveAPIRequest(path, 0)
 		return nil, fmt.Errorf("http %s %s: %w", method, path, err)
 	}
 	defer resp.Body.Close()
+	metrics.ObserveAPIRequest(path, resp.StatusCode)
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -164,12 +287,19 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body []byte
 			"status", resp.StatusCode,
 			"body", string(respBody),
 		)
-		return nil, fmt.Errorf("API %s %s returned %d: %s", method, path, resp.StatusCode, string(respBody))
+		return nil, &StatusError{Method: method, Path: path, Status: resp.StatusCode, Body: string(respBody)}
 	}
 
 	return respBody, nil
 }
 
+func logBody(body []byte, contentType string) string {
+	if contentType != contentTypeJSON {
+		return fmt.Sprintf("<%d bytes %s>", len(body), contentType)
+	}
+	return truncate(string(body), 2048)
+}
+
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -0,0 +1,86 @@
+package qudata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Wire encodings for telemetry payloads. JSON is always accepted by the API;
+// msgpack is used only when the API selects it during init.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// SupportedEncodings is announced to the API in the init request.
+var SupportedEncodings = []string{EncodingMsgpack, EncodingJSON}
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// msgpackHandle reuses the json struct tags so both encodings share field names.
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true
+	h.TypeInfos = codec.NewTypeInfos([]string{"json"})
+	return h
+}()
+
+// UseEncoding selects the telemetry encoding negotiated with the API.
+// Unknown or empty values keep JSON.
+func (c *Client) UseEncoding(enc string) {
+	switch enc {
+	case EncodingMsgpack:
+	case "", EncodingJSON:
+		enc = EncodingJSON
+	default:
+		c.logger.Warn("unsupported stats encoding requested, using json", "encoding", enc)
+		enc = EncodingJSON
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encoding = enc
+}
+
+func (c *Client) currentEncoding() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.encoding == "" {
+		return EncodingJSON
+	}
+	return c.encoding
+}
+
+// sendTelemetry posts v in the negotiated encoding. If the API rejects the
+// binary encoding, the client falls back to JSON for the rest of its life.
+func (c *Client) sendTelemetry(ctx context.Context, path string, v any) error {
+	enc := c.currentEncoding()
+	if enc == EncodingMsgpack {
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf, msgpackHandle).Encode(v); err != nil {
+			return fmt.Errorf("encode %s: %w", path, err)
+		}
+		_, err := c.doRequestAs(ctx, http.MethodPost, path, buf.Bytes(), contentTypeMsgpack)
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.Status != http.StatusUnsupportedMediaType {
+			return err
+		}
+		c.logger.Warn("API rejected msgpack, falling back to json", "path", path)
+		c.UseEncoding(EncodingJSON)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", path, err)
+	}
+	_, err = c.doRequest(ctx, http.MethodPost, path, body)
+	return err
+}
@@ -0,0 +1,613 @@
+// Package regcache is a pull-through cache of a Docker registry for the
+// Docker daemons in the guests. Blobs and manifests fetched by digest are
+// kept on the host under their digest, so that creating instances from the
+// same large CUDA images again does not download them again. Tags are always
+// resolved upstream; the last digest seen for a tag is served when the
+// upstream cannot be reached.
+package regcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/metrics"
+)
+
+// DefaultUpstream is Docker Hub, the only registry Docker uses mirrors for.
+const DefaultUpstream = "https://registry-1.docker.io"
+
+// maxManifestSize bounds the manifests read into memory.
+const maxManifestSize = 4 << 20
+
+var (
+	digestRe = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	nameRe   = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	tagRe    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// Config configures a Cache.
+type Config struct {
+	// Dir holds the cached content.
+	Dir string
+	// Upstream is the registry pulled through; DefaultUpstream if empty.
+	Upstream string
+	// MaxBytes bounds the cache; the least recently used content is removed
+	// beyond it. 0 is unbounded.
+	MaxBytes int64
+}
+
+// Cache serves the registry API v2 for pulls, fetching what it does not
+// hold from the upstream registry.
+type Cache struct {
+	cfg    Config
+	client *http.Client
+	logger *slog.Logger
+
+	tokenMu sync.Mutex
+	tokens  map[string]token
+
+	// inflight holds the blobs being downloaded; requests for one wait for
+	// the download instead of starting another.
+	fetchMu  sync.Mutex
+	inflight map[string]chan struct{}
+
+	evictMu sync.Mutex
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// New returns a cache storing its content in cfg.Dir.
+func New(cfg Config, logger *slog.Logger) (*Cache, error) {
+	if cfg.Upstream == "" {
+		cfg.Upstream = DefaultUpstream
+	}
+	cfg.Upstream = strings.TrimRight(cfg.Upstream, "/")
+	for _, sub := range []string{"blobs", "manifests", "tags", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	// Downloads left over by a crash are never completed.
+	tmp, _ := filepath.Glob(filepath.Join(cfg.Dir, "tmp", "*"))
+	for _, f := range tmp {
+		_ = os.Remove(f)
+	}
+	return &Cache{
+		cfg:      cfg,
+		client:   &http.Client{},
+		logger:   logger,
+		tokens:   make(map[string]token),
+		inflight: make(map[string]chan struct{}),
+	}, nil
+}
+
+// ListenAndServe serves the cache on addr until ctx is done.
+func (c *Cache) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: c, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	c.logger.Info("registry cache listening", "addr", ln.Addr().String(), "upstream", c.cfg.Upstream)
+	// Measures the cache and trims it to a limit lowered since the last run.
+	go c.evict()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the cache only serves pulls")
+		return
+	}
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "not a registry path")
+		return
+	}
+	if i := strings.LastIndex(rest, "/manifests/"); i > 0 {
+		name, ref := rest[:i], rest[i+len("/manifests/"):]
+		if !nameRe.MatchString(name) || !digestRe.MatchString(ref) && !tagRe.MatchString(ref) {
+			registryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "invalid repository or reference")
+			return
+		}
+		c.serveManifest(w, r, name, ref)
+		return
+	}
+	if i := strings.LastIndex(rest, "/blobs/"); i > 0 {
+		name, digest := rest[:i], rest[i+len("/blobs/"):]
+		if !nameRe.MatchString(name) || !digestRe.MatchString(digest) {
+			registryError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid repository or digest")
+			return
+		}
+		c.serveBlob(w, r, name, digest)
+		return
+	}
+	registryError(w, http.StatusNotFound, "UNSUPPORTED", "unknown registry path")
+}
+
+func (c *Cache) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	isDigest := digestRe.MatchString(ref)
+	if isDigest && c.serveManifestFile(w, r, ref) {
+		metrics.RegistryCacheRequests.WithLabelValues("manifest", "hit").Inc()
+		return
+	}
+
+	// A HEAD by tag, which clients send to check for updates, stays a HEAD
+	// upstream: Docker Hub only counts manifest GETs against its pull limit.
+	method := http.MethodGet
+	if r.Method == http.MethodHead && !isDigest {
+		method = http.MethodHead
+	}
+	resp, err := c.upstream(r.Context(), method, name, "/manifests/"+ref, r.Header)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if !isDigest {
+			if digest := c.tagDigest(name, ref); digest != "" && c.serveManifestFile(w, r, digest) {
+				c.logger.Warn("registry upstream unavailable, serving cached tag", "repo", name, "tag", ref, "err", err)
+				metrics.RegistryCacheRequests.WithLabelValues("manifest", "stale").Inc()
+				return
+			}
+		}
+		registryError(w, http.StatusBadGateway, "UNAVAILABLE", "upstream registry unavailable")
+		return
+	}
+	defer resp.Body.Close()
+	metrics.RegistryCacheRequests.WithLabelValues("manifest", "miss").Inc()
+
+	if resp.StatusCode != http.StatusOK || method == http.MethodHead {
+		if digest := resp.Header.Get("Docker-Content-Digest"); resp.StatusCode == http.StatusOK && digestRe.MatchString(digest) {
+			c.saveTag(name, ref, digest)
+		}
+		copyResponse(w, resp, r.Method == http.MethodHead)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil || len(body) > maxManifestSize {
+		registryError(w, http.StatusBadGateway, "MANIFEST_INVALID", "manifest unreadable or too large")
+		return
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if isDigest && digest != ref {
+		registryError(w, http.StatusBadGateway, "DIGEST_INVALID", "upstream manifest does not match its digest")
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if err := c.saveManifest(digest, contentType, body); err != nil {
+		c.logger.Warn("failed to cache manifest", "digest", digest, "err", err)
+	}
+	if !isDigest {
+		c.saveTag(name, ref, digest)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+func (c *Cache) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	path := c.blobPath(digest)
+	for {
+		if c.serveFile(w, r, path, "application/octet-stream", digest) {
+			metrics.RegistryCacheRequests.WithLabelValues("blob", "hit").Inc()
+			return
+		}
+		wait, leader := c.claim(digest)
+		if leader {
+			break
+		}
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	defer c.release(digest)
+	metrics.RegistryCacheRequests.WithLabelValues("blob", "miss").Inc()
+
+	// Ranged and HEAD requests are passed through; a later full GET fills
+	// the cache.
+	if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		resp, err := c.upstream(r.Context(), r.Method, name, "/blobs/"+digest, r.Header)
+		if err != nil {
+			registryError(w, http.StatusBadGateway, "UNAVAILABLE", "upstream registry unavailable")
+			return
+		}
+		defer resp.Body.Close()
+		copyResponse(w, resp, r.Method == http.MethodHead)
+		return
+	}
+
+	// The download outlives the client, so that a pull retried after a
+	// dropped connection finds the blob cached.
+	ctx := context.WithoutCancel(r.Context())
+	resp, err := c.upstream(ctx, http.MethodGet, name, "/blobs/"+digest, r.Header)
+	if err != nil {
+		registryError(w, http.StatusBadGateway, "UNAVAILABLE", "upstream registry unavailable")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		copyResponse(w, resp, false)
+		return
+	}
+
+	n, err := c.download(w, resp, digest, path)
+	if err != nil {
+		c.logger.Warn("blob not cached", "repo", name, "digest", digest, "err", err)
+		return
+	}
+	c.logger.Info("blob cached", "repo", name, "digest", digest, "bytes", n)
+	go c.evict()
+}
+
+// download streams resp to w while storing it at path once its digest is
+// verified. It returns the size of the blob.
+func (c *Cache) download(w http.ResponseWriter, resp *http.Response, digest, path string) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.cfg.Dir, "tmp"), "blob-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(resp.ContentLength))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	h := sha256.New()
+	client := &clientWriter{w: w}
+	n, err := io.Copy(io.MultiWriter(tmp, h, client), resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return n, fmt.Errorf("digest mismatch: got %s", got)
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// clientWriter writes to the client until the first failure and then drops
+// the rest, so that the download continues into the cache.
+type clientWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if !cw.failed {
+		if _, err := cw.w.Write(p); err != nil {
+			cw.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// claim makes the caller the downloader of digest, or returns a channel
+// closed when the current download ends.
+func (c *Cache) claim(digest string) (<-chan struct{}, bool) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	if ch, ok := c.inflight[digest]; ok {
+		return ch, false
+	}
+	c.inflight[digest] = make(chan struct{})
+	return nil, true
+}
+
+func (c *Cache) release(digest string) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	close(c.inflight[digest])
+	delete(c.inflight, digest)
+}
+
+// upstream sends a request for name to the upstream registry, getting a
+// pull token when it asks for one.
+func (c *Cache) upstream(ctx context.Context, method, name, path string, header http.Header) (*http.Response, error) {
+	url := c.cfg.Upstream + "/v2/" + name + path
+	do := func(tok string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range []string{"Accept", "Range"} {
+			if v := header.Values(k); len(v) > 0 {
+				req.Header[k] = v
+			}
+		}
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		return c.client.Do(req)
+	}
+
+	scope := "repository:" + name + ":pull"
+	resp, err := do(c.cachedToken(scope))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	resp.Body.Close()
+	tok, err := c.fetchToken(ctx, challenge, scope)
+	if err != nil {
+		return nil, fmt.Errorf("registry token: %w", err)
+	}
+	return do(tok)
+}
+
+func (c *Cache) cachedToken(scope string) string {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if t, ok := c.tokens[scope]; ok && time.Now().Before(t.expires) {
+		return t.value
+	}
+	return ""
+}
+
+// fetchToken gets an anonymous pull token as the Bearer challenge of the
+// upstream describes.
+func (c *Cache) fetchToken(ctx context.Context, challenge, scope string) (string, error) {
+	params, ok := parseChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"], nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	q.Set("scope", scope)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	tok := body.Token
+	if tok == "" {
+		tok = body.AccessToken
+	}
+	ttl := time.Duration(max(body.ExpiresIn, 60)) * time.Second
+	c.tokenMu.Lock()
+	c.tokens[scope] = token{value: tok, expires: time.Now().Add(ttl - 30*time.Second)}
+	c.tokenMu.Unlock()
+	return tok, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header of the Bearer scheme.
+func parseChallenge(h string) (map[string]string, bool) {
+	rest, ok := strings.CutPrefix(h, "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for rest != "" {
+		key, after, ok := strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if !ok {
+			break
+		}
+		var val string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			val, rest = after[1:end+1], after[end+2:]
+		} else {
+			val, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = val
+	}
+	return params, true
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.cfg.Dir, "blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+func (c *Cache) manifestPath(digest string) string {
+	return filepath.Join(c.cfg.Dir, "manifests", strings.Replace(digest, ":", "/", 1))
+}
+
+func (c *Cache) tagPath(name, tag string) string {
+	// "_tags" cannot be a repository path component, so that the tags of
+	// library/ubuntu do not clash with a repository library/ubuntu/x.
+	return filepath.Join(c.cfg.Dir, "tags", filepath.FromSlash(name), "_tags", tag)
+}
+
+func (c *Cache) saveManifest(digest, contentType string, body []byte) error {
+	path := c.manifestPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+".type", []byte(contentType)); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, body)
+}
+
+func (c *Cache) saveTag(name, tag, digest string) {
+	path := c.tagPath(name, tag)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		_ = writeFileAtomic(path, []byte(digest))
+	}
+}
+
+func (c *Cache) tagDigest(name, tag string) string {
+	data, err := os.ReadFile(c.tagPath(name, tag))
+	if err != nil || !digestRe.Match(data) {
+		return ""
+	}
+	return string(data)
+}
+
+func (c *Cache) serveManifestFile(w http.ResponseWriter, r *http.Request, digest string) bool {
+	path := c.manifestPath(digest)
+	contentType, err := os.ReadFile(path + ".type")
+	if err != nil {
+		return false
+	}
+	return c.serveFile(w, r, path, string(contentType), digest)
+}
+
+// serveFile serves a cached file, marking it recently used; it reports
+// false if the file is not cached.
+func (c *Cache) serveFile(w http.ResponseWriter, r *http.Request, path, contentType, digest string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	return true
+}
+
+// evict removes the least recently used blobs and manifests until the cache
+// fits MaxBytes.
+func (c *Cache) evict() {
+	if c.cfg.MaxBytes <= 0 || !c.evictMu.TryLock() {
+		return
+	}
+	defer c.evictMu.Unlock()
+
+	type entry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	for _, sub := range []string{"blobs", "manifests"} {
+		_ = filepath.WalkDir(filepath.Join(c.cfg.Dir, sub), func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasSuffix(path, ".type") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+			return nil
+		})
+	}
+	metrics.RegistryCacheBytes.Set(float64(total))
+	if total <= c.cfg.MaxBytes {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	var removed int
+	for _, e := range entries {
+		if total <= c.cfg.MaxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			continue
+		}
+		_ = os.Remove(e.path + ".type")
+		total -= e.size
+		removed++
+	}
+	metrics.RegistryCacheBytes.Set(float64(total))
+	c.logger.Info("registry cache evicted", "removed", removed, "bytes", total)
+}
+
+// writeFileAtomic replaces path with data, so that a reader never sees a
+// partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response, headOnly bool) {
+	for _, k := range []string{"Content-Type", "Content-Length", "Content-Range", "Docker-Content-Digest", "Www-Authenticate"} {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if !headOnly {
+		_, _ = io.Copy(w, resp.Body)
+	}
+}
+
+func registryError(w http.ResponseWriter, code int, errCode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, errCode, msg)
+}
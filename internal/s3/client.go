@@ -0,0 +1,311 @@
+// Package s3 is a minimal client for S3-compatible object storage: signed
+// (SigV4) streaming downloads and multipart uploads with path-style
+// addressing, which AWS, MinIO, R2 and Ceph RGW all accept.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	// MinPartSize is the smallest part S3 accepts but for the last one.
+	MinPartSize = 5 << 20
+	// MaxParts is the most parts a multipart upload may have.
+	MaxParts = 10000
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	errBodyMaxSize  = 4096
+)
+
+// Client talks to one S3-compatible endpoint with one set of credentials.
+type Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	now          func() time.Time
+}
+
+// New creates a client for the endpoint and credentials of o.
+func New(o domain.ObjectLocation) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(o.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q must be an http(s) URL", o.Endpoint)
+	}
+	region := o.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	return &Client{
+		endpoint:     u,
+		region:       region,
+		accessKey:    o.AccessKey,
+		secretKey:    o.SecretKey,
+		sessionToken: o.SessionToken,
+		http:         &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: time.Minute}},
+		now:          time.Now,
+	}, nil
+}
+
+// Download opens an object. The size is -1 when the server does not
+// report it.
+func (c *Client) Download(ctx context.Context, bucket, key string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, nil, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Upload stores r as an object in parts of partSize, which bounds the
+// memory used; the object may not exceed MaxParts parts. A failed upload is
+// aborted so that the parts do not linger in the bucket.
+func (c *Client) Upload(ctx context.Context, bucket, key string, r io.Reader, partSize int64) error {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	uploadID, err := c.createUpload(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := c.uploadParts(ctx, bucket, key, uploadID, r, partSize); err != nil {
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if resp, aerr := c.do(abortCtx, http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil, ""); aerr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (c *Client) createUpload(ctx context.Context, bucket, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, []byte{}, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res initiateResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("parse create multipart upload: %w", err)
+	}
+	if res.UploadID == "" {
+		return "", errors.New("create multipart upload: no upload id")
+	}
+	return res.UploadID, nil
+}
+
+func (c *Client) uploadParts(ctx context.Context, bucket, key, uploadID string, r io.Reader, partSize int64) error {
+	buf := make([]byte, partSize)
+	var parts []completedPart
+	for n := 1; ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err == io.EOF && n > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("read part %d: %w", n, err)
+		}
+		if n > MaxParts {
+			return fmt.Errorf("object exceeds %d parts of %d bytes", MaxParts, partSize)
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		resp, perr := c.do(ctx, http.MethodPut, bucket, key, q, buf[:size], "")
+		if perr != nil {
+			return fmt.Errorf("upload part %d: %w", n, perr)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+		if err != nil {
+			// A short read was the last part.
+			break
+		}
+	}
+
+	body, err := xml.Marshal(completeUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, body, "application/xml")
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+	// S3 reports some failures of the completion with a 200 and an error
+	// document.
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, errBodyMaxSize))
+	if bytes.Contains(data, []byte("<Error>")) {
+		return fmt.Errorf("complete multipart upload: %s", strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// do sends a signed request and fails on a non-2xx status. A nil body is
+// sent unsigned; a GET sends none.
+func (c *Client) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = strings.TrimRight(c.endpoint.EscapedPath(), "/") + "/" + escapePath(bucket) + "/" + escapePath(key)
+	u.RawQuery = canonicalQuery(query)
+
+	var reader io.Reader
+	payloadHash := unsignedPayload
+	if body != nil {
+		reader = bytes.NewReader(body)
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, u.RawPath, payloadHash)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, errBodyMaxSize))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %d: %s", method, bucket+"/"+key, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (c *Client) sign(req *http.Request, escapedPath, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		escapedPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as SigV4 signs it.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapePath percent-encodes an object key, keeping its slashes.
+func escapePath(s string) string {
+	segments := strings.Split(s, "/")
+	for i, seg := range segments {
+		segments[i] = escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape percent-encodes all but the unreserved characters of RFC 3986.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/gpu"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+// apiPrefix is the current API version. The same routes are still served
+// without it for control planes that predate versioning.
+const apiPrefix = "/v1"
+
+// routePath strips the version prefix so that checks keyed by route apply
+// to both the versioned and the legacy path.
+func routePath(p string) string {
+	if p == apiPrefix || strings.HasPrefix(p, apiPrefix+"/") {
+		return p[len(apiPrefix):]
+	}
+	return p
+}
+
+// publicPaths are served without authentication.
+var publicPaths = map[string]bool{
+	"/ping":         true,
+	"/openapi.json": true,
+}
+
+// apiRoute is one endpoint of the agent API. The route table drives both
+// the router and the OpenAPI document, so neither can drift from the other.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler gin.HandlerFunc
+	// Guarded routes are refused while the host is managed through PUT /state.
+	Guarded bool
+	// Request is the JSON body type; nil when the route takes no body.
+	Request any
+	// Response is the type of the "data" field of a successful response.
+	Response any
+	// Query lists the query parameters the route reads.
+	Query []apiParam
+	// Headers lists the optional request headers the route reads.
+	Headers []apiParam
+	// Content is the media type of a non-JSON request or response body.
+	Content string
+}
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+func (h *Handler) routes() []apiRoute {
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/ping", Summary: "Liveness check", Handler: h.Ping},
+		{Method: http.MethodGet, Path: "/openapi.json", Summary: "This OpenAPI document", Handler: h.OpenAPI},
+		{Method: http.MethodGet, Path: "/metrics", Summary: "Prometheus metrics", Handler: gin.WrapH(metrics.Handler()), Content: "text/plain"},
+
+		{Method: http.MethodGet, Path: "/instances", Summary: "Instance status", Handler: h.GetInstance, Response: instanceResponse{}},
+		{Method: http.MethodPost, Path: "/instances", Summary: "Create the instance; it boots in the background", Handler: h.CreateInstance, Guarded: true,
+			Request: createInstanceRequest{}, Response: createInstanceResponse{},
+			Headers: []apiParam{{Name: idempotencyHeader, Type: "string", Description: "Repeating a create with the same key returns its original outcome"}}},
+		{Method: http.MethodPut, Path: "/instances", Summary: "Start, stop or restart the instance", Handler: h.ManageInstance, Request: manageInstanceRequest{}},
+		{Method: http.MethodPatch, Path: "/instances", Summary: "Grow the instance disk", Handler: h.UpdateInstance, Guarded: true,
+			Request: updateInstanceRequest{}, Response: resizeResponse{}},
+		{Method: http.MethodDelete, Path: "/instances", Summary: "Destroy the instance", Handler: h.DeleteInstance, Guarded: true,
+			Response: deleteInstanceResponse{},
+			Query:    []apiParam{{Name: "secure_wipe", Type: "boolean", Description: "Overwrite the disks before deleting them"}}},
+		{Method: http.MethodGet, Path: "/instances/console", Summary: "Serial console over WebSocket", Handler: h.Console},
+		{Method: http.MethodPost, Path: "/instances/urls", Summary: "Issue a signed URL for guest logs or a guest file", Handler: h.CreateSignedURL,
+			Request: signedURLRequest{}, Response: signedURLResponse{}},
+		{Method: http.MethodGet, Path: "/instances/logs", Summary: "Guest logs", Handler: h.InstanceLogs, Content: "text/plain",
+			Query: append(signedURLParams, queryParams(domain.LogOptions{})...)},
+		{Method: http.MethodGet, Path: "/instances/boot-log", Summary: "Guest serial output", Handler: h.BootLog, Content: "text/plain",
+			Query: []apiParam{{Name: "tail", Type: "integer", Description: "Return only the last lines"}}},
+		{Method: http.MethodGet, Path: "/instances/files", Summary: "Download a guest file", Handler: h.DownloadFile, Content: "application/octet-stream",
+			Query: append(signedURLParams, apiParam{Name: "path", Type: "string", Description: "Absolute guest path"})},
+		{Method: http.MethodPost, Path: "/instances/files", Summary: "Upload a file to the guest", Handler: h.UploadFile, Content: multipartContentType,
+			Response: uploadFileResponse{}, Query: []apiParam{
+				{Name: "path", Type: "string", Description: "Absolute guest path, or a directory ending in a slash"},
+				{Name: "mode", Type: "string", Description: "Octal permissions of the file"},
+			}},
+		{Method: http.MethodPost, Path: "/instances/exec", Summary: "Run a command in the guest", Handler: h.ExecInstance,
+			Request: execRequest{}, Response: domain.ExecResult{}},
+		{Method: http.MethodPost, Path: "/instances/usb", Summary: "Hotplug a host USB device into the instance", Handler: h.AttachUSB,
+			Request: usbRequest{}, Response: usbResponse{}},
+		{Method: http.MethodDelete, Path: "/instances/usb/:device", Summary: "Unplug a USB device from the instance", Handler: h.DetachUSB,
+			Response: usbResponse{}},
+		{Method: http.MethodPost, Path: "/instances/attestation", Summary: "Attestation report of a confidential instance", Handler: h.AttestInstance,
+			Request: attestationRequest{}, Response: domain.Attestation{}},
+		{Method: http.MethodPost, Path: "/instances/export", Summary: "Stream the instance to another agent", Handler: h.ExportInstance, Request: exportRequest{}},
+		{Method: http.MethodGet, Path: "/instances/migration", Summary: "Status of the last export", Handler: h.GetMigration, Response: domain.MigrationStatus{}},
+		{Method: http.MethodPost, Path: "/instances/ingest", Summary: "Receive an instance bundle from another agent", Handler: h.IngestInstance, Guarded: true,
+			Response: createInstanceResponse{}, Content: migrationContentType},
+		{Method: http.MethodPost, Path: "/instances/batch", Summary: "Run create, delete and manage operations in order", Handler: h.Batch, Guarded: true,
+			Request: batchRequest{}, Response: batchResponse{}},
+
+		{Method: http.MethodPost, Path: "/instances/credentials/rotate", Summary: "Set a new root password in the instance", Handler: h.RotateCredentials,
+			Response: domain.Credentials{}},
+		{Method: http.MethodPost, Path: "/ssh", Summary: "Authorize an SSH key in the instance", Handler: h.AddSSH, Guarded: true, Request: sshRequest{}},
+		{Method: http.MethodDelete, Path: "/ssh", Summary: "Remove an SSH key from the instance", Handler: h.RemoveSSH, Guarded: true, Request: sshRequest{}},
+
+		{Method: http.MethodGet, Path: "/state", Summary: "Desired state, applied state and drift", Handler: h.GetState, Response: stateResponse{}},
+		{Method: http.MethodPut, Path: "/state", Summary: "Manage the host declaratively", Handler: h.PutState, Request: domain.DesiredState{}, Response: putStateResponse{}},
+		{Method: http.MethodDelete, Path: "/state", Summary: "Leave declarative mode", Handler: h.DeleteState},
+
+		{Method: http.MethodGet, Path: "/gpus", Summary: "GPUs and their reservations", Handler: h.ListGPUs, Response: gpuListResponse{}},
+		{Method: http.MethodGet, Path: "/flavors", Summary: "Instance flavors and whether the host can run them", Handler: h.ListFlavors, Response: flavorListResponse{}},
+		{Method: http.MethodGet, Path: "/volumes", Summary: "Persistent volumes and whether they are attached", Handler: h.ListVolumes, Response: volumeListResponse{}},
+		{Method: http.MethodPost, Path: "/volumes", Summary: "Create a persistent volume", Handler: h.CreateVolume,
+			Request: createVolumeRequest{}, Response: domain.Volume{}},
+		{Method: http.MethodDelete, Path: "/volumes/:name", Summary: "Delete a detached volume and its data", Handler: h.DeleteVolume},
+		{Method: http.MethodPost, Path: "/volumes/:name/export", Summary: "Upload a detached volume to S3-compatible storage", Handler: h.ExportVolume,
+			Request: volumeExportRequest{}, Response: domain.VolumeTransfer{}},
+		{Method: http.MethodPost, Path: "/volumes/:name/import", Summary: "Create a volume from an exported object", Handler: h.ImportVolume,
+			Request: volumeImportRequest{}, Response: domain.VolumeTransfer{}},
+		{Method: http.MethodGet, Path: "/volumes/:name/transfer", Summary: "Progress of the last volume export or import", Handler: h.GetVolumeTransfer,
+			Response: domain.VolumeTransfer{}},
+		{Method: http.MethodPost, Path: "/gpus/:addr/reserve", Summary: "Reserve a GPU for a later create", Handler: h.ReserveGPU,
+			Request: reserveGPURequest{}, Response: gpu.Reservation{}},
+		{Method: http.MethodDelete, Path: "/gpus/:addr/reserve", Summary: "Release a GPU reservation", Handler: h.ReleaseGPU, Request: releaseGPURequest{}},
+		{Method: http.MethodPut, Path: "/gpus/power-cap", Summary: "Cap the total GPU power of the instance", Handler: h.SetPowerCap,
+			Request: powerCapRequest{}, Response: domain.PowerCap{}},
+
+		{Method: http.MethodPost, Path: "/decommission", Summary: "Wipe the host; the first call returns a confirm token", Handler: h.Decommission,
+			Request: decommissionRequest{}, Response: domain.DecommissionReport{}},
+		{Method: http.MethodPost, Path: "/nettest", Summary: "Measure bandwidth to the FRP server", Handler: h.NetTest, Request: netTestRequest{}, Response: domain.NetTestResult{}},
+		{Method: http.MethodPost, Path: "/diagnostics/speedtest", Summary: "Measure bandwidth to the FRP server, the API and the control plane's speedtest endpoints",
+			Handler: h.NetTest, Request: netTestRequest{}, Response: domain.NetTestResult{}},
+		{Method: http.MethodPost, Path: "/update", Summary: "Replace the agent binary", Handler: h.Update, Request: domain.UpdateSpec{}},
+		{Method: http.MethodPost, Path: "/admin/reload", Summary: "Reload the configuration", Handler: h.Reload, Response: domain.ReloadResult{}},
+	}
+}
+
+var signedURLParams = []apiParam{
+	{Name: "vm", Type: "string", Description: "Instance the signed URL was issued for"},
+	{Name: "expires", Type: "integer", Description: "Expiry of the signed URL, Unix seconds"},
+	{Name: "sig", Type: "string", Description: "Signature from POST /instances/urls"},
+}
+
+// register mounts the route table under apiPrefix and, marked deprecated,
+// at the root.
+func (h *Handler) register(router *gin.Engine) {
+	v1 := router.Group(apiPrefix)
+	for _, r := range h.routes() {
+		handlers := []gin.HandlerFunc{r.Handler}
+		if r.Guarded {
+			handlers = []gin.HandlerFunc{h.ImperativeGuard, r.Handler}
+		}
+		v1.Handle(r.Method, r.Path, handlers...)
+		router.Handle(r.Method, r.Path, append([]gin.HandlerFunc{deprecatedRoute}, handlers...)...)
+	}
+}
+
+// deprecatedRoute points callers of an unversioned path at its successor.
+func deprecatedRoute(c *gin.Context) {
+	c.Header("Deprecation", "true")
+	c.Header("Link", "<"+apiPrefix+c.Request.URL.Path+">; rel=\"successor-version\"")
+	c.Next()
+}
+
+type instanceResponse struct {
+	Status          domain.InstanceStatus    `json:"status"`
+	Reason          domain.StatusReason      `json:"reason"`
+	Since           time.Time                `json:"since"`
+	AllowedCommands []domain.InstanceCommand `json:"allowed_commands"`
+	Job             *createJob               `json:"job"`
+	// Provisioning is the progress of the latest create, kept until the
+	// instance is deleted.
+	Provisioning *domain.Provisioning `json:"provisioning"`
+	// Tunnel is the frpc health of the instance's proxies; nil in test mode
+	// and until the first check.
+	Tunnel    *domain.TunnelStatus `json:"tunnel"`
+	ExpiresAt *time.Time           `json:"expires_at"`
+	// GPUs are the PCI addresses passed through to the VM.
+	GPUs []string `json:"gpus"`
+	// SecureBoot reports that the instance boots with Secure Boot.
+	SecureBoot bool `json:"secure_boot"`
+	// Labels are those the instance was created with.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type createInstanceResponse struct {
+	JobID string `json:"job_id"`
+	// Ports maps guest ports to the ports clients connect to.
+	Ports map[string]string `json:"ports"`
+	// Credentials are the root login the instance gets once it is up; nil
+	// when password authentication is disabled.
+	Credentials *domain.Credentials `json:"credentials,omitempty"`
+	// Display is the VNC console; nil when the instance has none.
+	Display *domain.Display `json:"display,omitempty"`
+}
+
+type resizeResponse struct {
+	StorageGB int `json:"storage_gb"`
+}
+
+type deleteInstanceResponse struct {
+	// Wipe is reported when the disks were securely wiped.
+	Wipe *domain.WipeReport `json:"wipe"`
+}
+
+type signedURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type batchResponse struct {
+	Results   []batchResult `json:"results"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+}
+
+type gpuInfo struct {
+	GPUAddr       string     `json:"gpu_addr"`
+	InUse         bool       `json:"in_use"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+}
+
+type gpuListResponse struct {
+	GPUs []gpuInfo `json:"gpus"`
+	// PowerCapW is the cap on the total GPU power of the instance; 0 is none.
+	PowerCapW int `json:"power_cap_w"`
+}
+
+type decommissionTokenResponse struct {
+	ConfirmToken string    `json:"confirm_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type putStateResponse struct {
+	Generation int64 `json:"generation"`
+	// Changed is false when the stored generation was resent.
+	Changed bool `json:"changed"`
+}
+
+type observedState struct {
+	Status domain.InstanceStatus `json:"status"`
+	Reason domain.StatusReason   `json:"reason"`
+	VMID   string                `json:"vm_id"`
+}
+
+type stateResponse struct {
+	Enabled       bool                    `json:"enabled"`
+	Desired       *domain.DesiredState    `json:"desired,omitempty"`
+	Applied       *domain.AppliedDesired  `json:"applied,omitempty"`
+	Observed      *observedState          `json:"observed,omitempty"`
+	LastReconcile *domain.ReconcileReport `json:"last_reconcile,omitempty"`
+}
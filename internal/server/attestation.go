@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// maxNonceSize is the report data an SNP report or a TDX quote can hold.
+const maxNonceSize = 64
+
+type attestationRequest struct {
+	// Nonce, base64, is chosen by the verifier and bound into the report,
+	// so that an old report cannot be replayed.
+	Nonce string `json:"nonce" binding:"required"`
+}
+
+// AttestInstance returns an attestation report of the confidential
+// instance, produced by the guest and signed by the CPU.
+func (h *Handler) AttestInstance(c *gin.Context) {
+	var req attestationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	nonce, err := base64.StdEncoding.DecodeString(req.Nonce)
+	if err != nil || len(nonce) == 0 || len(nonce) > maxNonceSize {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "nonce must be 1-64 bytes, base64"})
+		return
+	}
+
+	report, err := h.vm.Attest(c.Request.Context(), nonce)
+	if err != nil {
+		code := http.StatusInternalServerError
+		var errNoInstanceRunning domain.ErrNoInstanceRunning
+		if errors.As(err, &errNoInstanceRunning) {
+			code = http.StatusNotFound
+		}
+		var errNotConfidential domain.ErrNotConfidential
+		if errors.As(err, &errNotConfidential) {
+			code = http.StatusConflict
+		}
+		c.JSON(code, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": report})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/tracing"
+)
+
+// maxBatchOps bounds the operations in one POST /instances/batch.
+const maxBatchOps = 32
+
+type batchRequest struct {
+	Ops []batchOp `json:"ops" binding:"required,min=1,dive"`
+	// StopOnError skips the remaining operations after the first failure.
+	StopOnError bool `json:"stop_on_error"`
+}
+
+type batchOp struct {
+	// ID is an optional caller reference echoed in the result.
+	ID string `json:"id"`
+	Op string `json:"op" binding:"required,oneof=create delete manage"`
+	// Params is the body of the matching single-operation endpoint; for
+	// delete it is {"secure_wipe": bool}.
+	Params json.RawMessage `json:"params"`
+}
+
+type deleteParams struct {
+	SecureWipe bool `json:"secure_wipe"`
+}
+
+type batchResult struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id,omitempty"`
+	Op      string `json:"op"`
+	OK      bool   `json:"ok"`
+	Status  int    `json:"status"`
+	Data    any    `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+
+// Batch runs a list of create, delete and manage operations in order and
+// reports each outcome, so the control plane can reconcile the host in one
+// round trip. A failed operation does not undo the ones before it. Deletes
+// complete before the next operation runs; creates are accepted and boot in
+// the background as with POST /instances.
+func (h *Handler) Batch(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if len(req.Ops) > maxBatchOps {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": fmt.Sprintf("at most %d operations per batch", maxBatchOps)})
+		return
+	}
+
+	// Deletes are synchronous and may wipe disks.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(secureWipeTimeout))
+
+	results := make([]batchResult, len(req.Ops))
+	failed := 0
+	for i, op := range req.Ops {
+		res := batchResult{Index: i, ID: op.ID, Op: op.Op}
+		if req.StopOnError && failed > 0 {
+			res.Skipped = true
+			results[i] = res
+			continue
+		}
+
+		r := h.runBatchOp(c, op)
+		res.OK, res.Status, res.Data = r.err == nil, r.code, r.data
+		if r.err != nil {
+			res.Error = r.err.Error()
+			failed++
+		}
+		h.logger.Info("batch operation", "index", i, "id", op.ID, "op", op.Op, "status", r.code, "err", r.err)
+		results[i] = res
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok": failed == 0,
+		"data": batchResponse{
+			Results:   results,
+			Succeeded: countOK(results),
+			Failed:    failed,
+		},
+	})
+}
+
+func (h *Handler) runBatchOp(c *gin.Context, op batchOp) opResult {
+	switch op.Op {
+	case "create":
+		var req createInstanceRequest
+		if err := decodeParams(op.Params, &req); err != nil {
+			return opResult{code: http.StatusBadRequest, err: err}
+		}
+		req.trace = tracing.Inject(c.Request.Context())
+		return h.createInstance(req)
+	case "manage":
+		var req manageInstanceRequest
+		if err := decodeParams(op.Params, &req); err != nil {
+			return opResult{code: http.StatusBadRequest, err: err}
+		}
+		return h.manageInstance(c.Request.Context(), domain.InstanceCommand(req.Command))
+	case "delete":
+		var req deleteParams
+		if err := decodeParams(op.Params, &req); err != nil {
+			return opResult{code: http.StatusBadRequest, err: err}
+		}
+		return h.deleteInstance(req.SecureWipe, true)
+	}
+	return opResult{code: http.StatusBadRequest, err: fmt.Errorf("unknown op %q", op.Op)}
+}
+
+// decodeParams decodes and validates op parameters like ShouldBindJSON does
+// for a request body. Missing parameters decode as an empty object.
+func decodeParams(raw json.RawMessage, v any) error {
+	if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		raw = json.RawMessage("{}")
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errors.New("invalid params: " + err.Error())
+	}
+	return binding.Validator.ValidateStruct(v)
+}
+
+func countOK(results []batchResult) int {
+	n := 0
+	for _, r := range results {
+		if r.OK {
+			n++
+		}
+	}
+	return n
+}
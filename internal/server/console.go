@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	consoleBufSize      = 4096
+	consolePingInterval = 30 * time.Second
+)
+
+var consoleUpgrader = websocket.Upgrader{
+	ReadBufferSize:  consoleBufSize,
+	WriteBufferSize: consoleBufSize,
+	// Requests are authenticated by AuthMiddleware, not by origin.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// Console upgrades the request to a WebSocket and bridges it to the guest
+// serial console. Guest output is sent as binary messages; any message
+// received from the client is written to the console verbatim.
+func (h *Handler) Console(c *gin.Context) {
+	console, err := h.vm.OpenConsole(c.Request.Context())
+	if err != nil {
+		code := http.StatusInternalServerError
+		var errNoInstanceRunning domain.ErrNoInstanceRunning
+		if errors.As(err, &errNoInstanceRunning) {
+			code = http.StatusNotFound
+		}
+		var errConsoleBusy domain.ErrConsoleBusy
+		if errors.As(err, &errConsoleBusy) {
+			code = http.StatusConflict
+		}
+		c.JSON(code, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	defer console.Close()
+
+	ws, err := consoleUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.logger.Warn("console websocket upgrade failed", "err", err)
+		return
+	}
+	defer ws.Close()
+
+	// Clear the server's read/write timeouts inherited by the hijacked conn.
+	_ = ws.NetConn().SetDeadline(time.Time{})
+
+	h.logger.Info("console attached", "ip", c.ClientIP())
+	defer h.logger.Info("console detached", "ip", c.ClientIP())
+
+	done := make(chan struct{})
+
+	// guest -> client
+	go func() {
+		defer close(done)
+		buf := make([]byte, consoleBufSize)
+		for {
+			n, err := console.Read(buf)
+			if n > 0 {
+				_ = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"),
+					time.Now().Add(time.Second))
+				return
+			}
+		}
+	}()
+
+	// keepalive through the tunnel
+	go func() {
+		ticker := time.NewTicker(consolePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// client -> guest
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := console.Write(data); err != nil {
+			return
+		}
+	}
+}
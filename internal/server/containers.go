@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/qudata/agent/internal/domain"
+	"gopkg.in/yaml.v3"
+)
+
+var containerNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// composeService is the part of a Compose service the containers of a
+// create are expressed in.
+type composeService struct {
+	Image       string            `yaml:"image"`
+	Command     []string          `yaml:"command,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	NetworkMode string            `yaml:"network_mode"`
+	Restart     string            `yaml:"restart"`
+	Volumes     []string          `yaml:"volumes"`
+	Deploy      *composeDeploy    `yaml:"deploy,omitempty"`
+}
+
+type composeDeploy struct {
+	Resources struct {
+		Reservations struct {
+			Devices []composeDevice `yaml:"devices"`
+		} `yaml:"reservations"`
+	} `yaml:"resources"`
+}
+
+type composeDevice struct {
+	Driver       string   `yaml:"driver"`
+	Count        string   `yaml:"count"`
+	Capabilities []string `yaml:"capabilities"`
+}
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+	Volumes  map[string]struct{}       `yaml:"volumes"`
+}
+
+// composeDocument returns the Compose document running the containers of
+// req in the guest, or "" when it has none. The containers share the guest
+// network and a volume, like the containers of a pod. The agent reaches the
+// guest over SSH to start them, so SSH must be enabled.
+func (h *Handler) composeDocument(req createInstanceRequest) (string, error) {
+	if len(req.Containers) == 0 && req.Compose == "" {
+		return "", nil
+	}
+	if len(req.Containers) > 0 && req.Compose != "" {
+		return "", errors.New("containers and compose cannot both be given")
+	}
+	if !req.SSHEnabled && !h.testMode {
+		return "", errors.New("containers need ssh_enabled")
+	}
+
+	if req.Compose != "" {
+		var doc struct {
+			Services map[string]yaml.Node `yaml:"services"`
+		}
+		if err := yaml.Unmarshal([]byte(req.Compose), &doc); err != nil {
+			return "", fmt.Errorf("invalid compose document: %w", err)
+		}
+		if len(doc.Services) == 0 {
+			return "", errors.New("compose document has no services")
+		}
+		return req.Compose, nil
+	}
+
+	const sharedVolume = "shared"
+	doc := composeFile{
+		Services: make(map[string]composeService, len(req.Containers)),
+		Volumes:  map[string]struct{}{sharedVolume: {}},
+	}
+	for _, c := range req.Containers {
+		if !containerNameRe.MatchString(c.Name) {
+			return "", fmt.Errorf("invalid container name %q", c.Name)
+		}
+		if _, dup := doc.Services[c.Name]; dup {
+			return "", fmt.Errorf("duplicate container name %q", c.Name)
+		}
+		svc := composeService{
+			Image:       c.Image,
+			Command:     c.Command,
+			Environment: c.Env,
+			NetworkMode: "host",
+			Restart:     "unless-stopped",
+			Volumes:     []string{sharedVolume + ":" + domain.SharedVolumePath},
+		}
+		if c.GPUs {
+			svc.Deploy = &composeDeploy{}
+			svc.Deploy.Resources.Reservations.Devices = []composeDevice{
+				{Driver: "nvidia", Count: "all", Capabilities: []string{"gpu"}},
+			}
+		}
+		doc.Services[c.Name] = svc
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/crash"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/gpu"
+	"github.com/qudata/agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// createJob is the create request that currently owns the VM slot. It lives
+// from the moment a create is accepted until the instance is destroyed or the
+// create fails, so repeated creates can be answered without allocating ports.
+type createJob struct {
+	ID        string            `json:"job_id"`
+	StartedAt time.Time         `json:"started_at"`
+	Ports     map[string]string `json:"ports,omitempty"`
+	Volumes   []string          `json:"volumes,omitempty"`
+	// claimed are the GPU reservations the create consumed; they are
+	// restored if it fails.
+	claimed []gpu.Reservation
+}
+
+// beginCreate claims the VM slot for a new create. A create that is already
+// in flight, or an instance that already exists, is reported as an error
+// together with the job that owns the slot (nil if the agent has restarted
+// since that job was accepted).
+func (h *Handler) beginCreate() (*createJob, error) {
+	h.jobMu.Lock()
+	defer h.jobMu.Unlock()
+
+	if h.job != nil {
+		existing := *h.job
+		return &existing, domain.ErrCreateInProgress{JobID: existing.ID}
+	}
+	if h.updating {
+		return nil, domain.ErrUpdateInProgress{}
+	}
+	if h.vm.VMID() != "" {
+		return nil, domain.ErrInstanceAlreadyRunning{}
+	}
+
+	h.job = &createJob{ID: uuid.New().String(), StartedAt: time.Now().UTC()}
+	return h.job, nil
+}
+
+// acceptCreate records the ports handed out to the caller of job.
+func (h *Handler) acceptCreate(job *createJob, ports map[string]string) {
+	h.jobMu.Lock()
+	defer h.jobMu.Unlock()
+	job.Ports = ports
+}
+
+// endCreate releases the VM slot if it is still owned by job. A nil job
+// releases the slot unconditionally.
+func (h *Handler) endCreate(job *createJob) {
+	h.jobMu.Lock()
+	defer h.jobMu.Unlock()
+	if job == nil || h.job == job {
+		h.job = nil
+	}
+}
+
+// currentJob returns a copy of the job owning the VM slot, or nil.
+func (h *Handler) currentJob() *createJob {
+	h.jobMu.Lock()
+	defer h.jobMu.Unlock()
+	if h.job == nil {
+		return nil
+	}
+	job := *h.job
+	return &job
+}
+
+// maxCreateResumes bounds how often a create is resumed after a restart, so
+// a create that takes the agent down every time does not loop forever.
+const maxCreateResumes = 3
+
+// queuedCreate is a persisted create waiting for the create worker.
+type queuedCreate struct {
+	job *createJob
+	rec domain.CreateJob
+}
+
+// newVMID picks the ID of the VM a create will boot.
+func newVMID() string {
+	return "vm-" + uuid.New().String()[:8]
+}
+
+// enqueueCreate persists rec, announces the create and hands it to the
+// worker. job must own the VM slot.
+func (h *Handler) enqueueCreate(job *createJob, rec domain.CreateJob) error {
+	if err := h.store.SaveCreateJob(&rec); err != nil {
+		return fmt.Errorf("persist create job: %w", err)
+	}
+	h.emitCreating(job, rec.Ports)
+	h.createQueue <- queuedCreate{job: job, rec: rec}
+	return nil
+}
+
+// RunCreateWorker boots queued instances one at a time until ctx is
+// cancelled.
+func (s *Server) RunCreateWorker(ctx context.Context) {
+	h := s.handler
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-h.createQueue:
+			h.runCreate(q)
+		}
+	}
+}
+
+func (h *Handler) runCreate(q queuedCreate) {
+	defer func() {
+		// A panic fails the create like any other error: the ports are
+		// released and the instance is marked failed, so that a delete
+		// unbinds its GPUs instead of the worker dying with them claimed.
+		if r := recover(); r != nil {
+			rep := crash.Handle("create", r)
+			h.createFailed(q.job, fmt.Errorf("panic: %s", rep.Panic), q.rec.Allocated)
+		}
+	}()
+	if !h.ownsSlot(q.job) {
+		// The instance was deleted before the worker got to it.
+		h.logger.Info("create cancelled before it started", "job_id", q.job.ID)
+		h.clearCreateJob(q.job.ID)
+		h.ports.Release(q.rec.Allocated...)
+		return
+	}
+	ctx, span := tracing.Start(tracing.Extract(context.Background(), q.rec.Trace), "instance.create",
+		attribute.String("job_id", q.job.ID),
+		attribute.String("vm_id", q.rec.Spec.VMID),
+		attribute.Int("resumes", q.rec.Resumes))
+	defer span.End()
+	if q.rec.FRPC {
+		h.startVMWithFRPC(ctx, q.job, q.rec.Spec, q.rec.HostPorts, q.rec.SSHRemote, q.rec.Allocated)
+	} else {
+		h.startVM(ctx, q.job, q.rec.Spec, q.rec.HostPorts, q.rec.Allocated)
+	}
+}
+
+// ResumeCreate queues the create a crash or restart interrupted. What the
+// interrupted attempt left on disk is removed and the create starts over
+// with the same VM ID, ports and job ID. The progress of the latest create
+// is restored as well. It must run before the API is served, while the VM
+// slot is still free.
+func (s *Server) ResumeCreate() {
+	h := s.handler
+	prov, err := h.store.LoadProvisioning()
+	if err != nil {
+		h.logger.Warn("unreadable provisioning progress, discarding", "err", err)
+	}
+	h.provMu.Lock()
+	h.provisioning = prov
+	h.provMu.Unlock()
+
+	rec, err := h.store.LoadCreateJob()
+	if err != nil {
+		h.logger.Warn("unreadable create job, discarding", "err", err)
+		h.clearCreateJob("")
+		return
+	}
+	if rec == nil {
+		return
+	}
+	if vmID := h.vm.VMID(); vmID != "" {
+		// The instance was adopted across a re-exec; it booted before the
+		// record could be removed.
+		h.logger.Info("create job already finished", "job_id", rec.ID, "vm_id", vmID)
+		h.clearCreateJob(rec.ID)
+		return
+	}
+
+	job := &createJob{ID: rec.ID, StartedAt: rec.StartedAt, Ports: rec.Ports, Volumes: volumeNames(rec.Spec.Volumes)}
+	h.jobMu.Lock()
+	h.job = job
+	h.jobMu.Unlock()
+	h.setLabels(rec.Spec.Labels)
+
+	h.vm.Discard(rec.Spec.VMID, rec.Spec.SecureWipe)
+
+	switch {
+	case rec.Import:
+		h.createFailed(job, errors.New("migration interrupted by an agent restart"), nil)
+		return
+	case rec.DiskKeySupplied:
+		h.createFailed(job, errors.New("create interrupted by an agent restart; the supplied disk key is not kept, create the instance again"), nil)
+		return
+	case rec.Resumes >= maxCreateResumes:
+		h.createFailed(job, fmt.Errorf("create interrupted by %d agent restarts, giving up", rec.Resumes+1), nil)
+		return
+	}
+	if err := h.ports.Reserve("instance", rec.Allocated...); err != nil {
+		h.createFailed(job, fmt.Errorf("reserve ports of interrupted create: %w", err), nil)
+		return
+	}
+
+	rec.Resumes++
+	h.startProvisioning(job)
+	h.logger.Info("resuming interrupted create", "job_id", rec.ID, "vm_id", rec.Spec.VMID, "resumes", rec.Resumes)
+	if err := h.enqueueCreate(job, *rec); err != nil {
+		h.createFailed(job, err, rec.Allocated)
+	}
+}
+
+// ownsSlot reports whether job still owns the VM slot.
+func (h *Handler) ownsSlot(job *createJob) bool {
+	h.jobMu.Lock()
+	defer h.jobMu.Unlock()
+	return h.job == job
+}
+
+// clearCreateJob removes the record of job id once the create has an
+// outcome; an empty id removes any record.
+func (h *Handler) clearCreateJob(id string) {
+	if err := h.store.ClearCreateJob(id); err != nil {
+		h.logger.Error("failed to clear create job", "err", err)
+	}
+}
+
+// createRetryDelay is the pause before the first retry of a failed create;
+// each further retry waits one step longer.
+const createRetryDelay = 10 * time.Second
+
+// SetCreateRetries sets how often a create that failed for a transient
+// reason is attempted again before it is reported as failed.
+func (s *Server) SetCreateRetries(n int) {
+	s.handler.createRetries = n
+}
+
+// createError is the final failure of a create after all its attempts.
+type createError struct {
+	Reason   domain.StatusReason
+	Attempts int
+	Err      error
+}
+
+func (e *createError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s after %d attempts: %v", e.Reason, e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *createError) Unwrap() error { return e.Err }
+
+// bootVM creates the VM of job, retrying failures with a transient reason up
+// to createRetries times. Whatever a failed attempt left behind is discarded
+// before the next one. When the create finally fails, or the instance is
+// deleted in the meantime, its resources are released and false is returned.
+func (h *Handler) bootVM(ctx context.Context, job *createJob, spec domain.InstanceSpec, hostPorts, allocated []int) (domain.InstancePorts, bool) {
+	for attempt := 1; ; attempt++ {
+		h.provisionAttempt(job, attempt)
+		bootCtx, span := tracing.Start(ctx, "instance.boot", attribute.Int("attempt", attempt))
+		portMap, err := h.vm.Create(bootCtx, spec, hostPorts)
+		tracing.End(span, err)
+		if err == nil {
+			return portMap, true
+		}
+		if !h.ownsSlot(job) {
+			h.cancelCreate(job, spec, allocated)
+			return nil, false
+		}
+
+		var errAlreadyRunning domain.ErrInstanceAlreadyRunning
+		if errors.As(err, &errAlreadyRunning) {
+			h.createFailed(job, err, allocated)
+			return nil, false
+		}
+		reason := h.failureReason()
+		if attempt > h.createRetries || !domain.RetryableReason(reason) {
+			h.discardCreate(spec)
+			h.createFailed(job, &createError{Reason: reason, Attempts: attempt, Err: err}, allocated)
+			return nil, false
+		}
+
+		delay := time.Duration(attempt) * createRetryDelay
+		h.logger.Warn("instance creation failed, retrying",
+			"job_id", job.ID, "attempt", attempt, "reason", reason, "retry_in", delay, "err", err)
+		h.discardCreate(spec)
+		time.Sleep(delay)
+		if !h.ownsSlot(job) {
+			h.cancelCreate(job, spec, allocated)
+			return nil, false
+		}
+	}
+}
+
+// cancelCreate cleans up after a create whose instance was deleted while it
+// booted. The slot may already belong to a new create, so only what is
+// keyed by this create is released.
+func (h *Handler) cancelCreate(job *createJob, spec domain.InstanceSpec, allocated []int) {
+	h.logger.Info("create cancelled", "job_id", job.ID)
+	h.vm.Discard(spec.VMID, spec.SecureWipe)
+	h.clearCreateJob(job.ID)
+	h.ports.Release(allocated...)
+}
+
+// discardCreate releases everything a failed create may hold outside the
+// manager's own cleanup: the disk and run files of its VM, GPUs left bound
+// to VFIO, TLS terminators and tunnel proxies. job must still own the slot.
+func (h *Handler) discardCreate(spec domain.InstanceSpec) {
+	h.vm.Discard(spec.VMID, spec.SecureWipe)
+	if h.tls != nil {
+		h.tls.StopAll()
+	}
+	if !h.testMode {
+		if err := h.tunnel.ClearInstanceProxies(); err != nil {
+			h.logger.Error("failed to clear tunnel proxies", "err", err)
+		}
+	}
+}
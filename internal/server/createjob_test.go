@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/fakevm"
+	"github.com/qudata/agent/internal/network"
+	"github.com/qudata/agent/internal/storage"
+	"github.com/qudata/agent/internal/volume"
+)
+
+// newTestHandler returns a test-mode handler on the fake backend with the
+// volumes names in its volume store.
+func newTestHandler(t *testing.T, volumes ...string) *Handler {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := storage.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(fakevm.NewManager(fakevm.Config{}, logger), nil, network.NewPortAllocator(), store, logger, true)
+
+	imageDir := t.TempDir()
+	h.volumes = volume.NewStore(imageDir)
+	dir := filepath.Join(imageDir, volume.Subdir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range volumes {
+		data, _ := json.Marshal(domain.Volume{Name: name, SizeGB: 1})
+		if err := os.WriteFile(filepath.Join(dir, name+".json"), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestConcurrentCreatesShareOneJob(t *testing.T) {
+	const n = 16
+	var names []string
+	for i := range n {
+		names = append(names, fmt.Sprintf("vol%d", i))
+	}
+	h := newTestHandler(t, names...)
+
+	results := make([]opResult, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A client retries while another create or delete is being
+			// carried out, so every request ends up in beginCreate.
+			for {
+				results[i] = h.createInstance(createInstanceRequest{Volumes: []string{names[i]}})
+				if !errors.As(results[i].err, &domain.ErrLifecycleBusy{}) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	owner := h.currentJob()
+	if owner == nil {
+		t.Fatal("no job owns the VM slot")
+	}
+	var won []int
+	for i, r := range results {
+		if r.err == nil {
+			won = append(won, i)
+			if resp := r.data.(createInstanceResponse); resp.JobID != owner.ID {
+				t.Errorf("accepted create %d has job %s, slot owned by %s", i, resp.JobID, owner.ID)
+			}
+			continue
+		}
+		if r.code != http.StatusConflict || !errors.As(r.err, &domain.ErrCreateInProgress{}) {
+			t.Errorf("create %d: %d %v, want a duplicate rejection", i, r.code, r.err)
+			continue
+		}
+		job, _ := r.data.(gin.H)["job"].(*createJob)
+		if job == nil || job.ID != owner.ID {
+			t.Errorf("create %d rejected with job %+v, want %s", i, job, owner.ID)
+		}
+	}
+	if len(won) != 1 {
+		t.Fatalf("%d creates accepted, want 1", len(won))
+	}
+
+	var want []int
+	for _, p := range owner.Ports {
+		port, _ := strconv.Atoi(p)
+		want = append(want, port)
+	}
+	var leased []int
+	for _, l := range h.ports.Leases() {
+		leased = append(leased, l.Port)
+	}
+	slices.Sort(want)
+	slices.Sort(leased)
+	if !slices.Equal(leased, want) {
+		t.Errorf("leased ports %v, want only those of the accepted create %v", leased, want)
+	}
+
+	attached := h.attachedVolumes()
+	if len(attached) != 1 || !attached[names[won[0]]] {
+		t.Errorf("attached volumes %v, want only %s", attached, names[won[0]])
+	}
+}
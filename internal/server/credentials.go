@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const rootPasswordLength = 16
+
+var errPasswordAuthDisabled = errors.New("password authentication is disabled on this host")
+
+// ParseSealKey decodes the base64 X25519 public key root passwords are
+// sealed to.
+func ParseSealKey(s string) (*[32]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	var key [32]byte
+	if len(raw) != len(key) {
+		return nil, fmt.Errorf("public key must be %d bytes, got %d", len(key), len(raw))
+	}
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// SetCredentials sets whether instances get a root password and the key
+// the password is sealed to before it is returned; nil returns it in clear.
+func (s *Server) SetCredentials(passwordAuth bool, sealKey *[32]byte) {
+	s.handler.passwordAuth = passwordAuth
+	s.handler.sealKey = sealKey
+}
+
+// newRootPassword returns a random root password for a new instance, or ""
+// when password authentication is disabled.
+func (h *Handler) newRootPassword() string {
+	if !h.passwordAuth {
+		return ""
+	}
+	return randomPassword(rootPasswordLength)
+}
+
+func randomPassword(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, length)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		b[i] = charset[n.Int64()]
+	}
+	return string(b)
+}
+
+// credentials returns the root login for password as the API hands it out,
+// or nil for no password.
+func (h *Handler) credentials(password string) *domain.Credentials {
+	if password == "" {
+		return nil
+	}
+	creds := &domain.Credentials{Username: domain.RootUser}
+	var err error
+	creds.Password, creds.SealedPassword, err = h.sealPassword(password)
+	if err != nil {
+		h.logger.Error("failed to seal root password", "err", err)
+		return nil
+	}
+	return creds
+}
+
+// sealPassword returns password in clear or, when the agent has a control
+// plane key, sealed to it.
+func (h *Handler) sealPassword(password string) (clear, sealed string, err error) {
+	if h.sealKey == nil {
+		return password, "", nil
+	}
+	// Without randomness the password cannot be delivered safely.
+	out, err := box.SealAnonymous(nil, []byte(password), h.sealKey, rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return "", base64.StdEncoding.EncodeToString(out), nil
+}
+
+// RotateCredentials sets a new root password in the instance and returns it.
+func (h *Handler) RotateCredentials(c *gin.Context) {
+	if !h.passwordAuth {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": errPasswordAuthDisabled.Error()})
+		return
+	}
+	password := h.newRootPassword()
+	if err := h.vm.SetRootPassword(c.Request.Context(), password); err != nil {
+		code := http.StatusInternalServerError
+		var errNoInstanceRunning domain.ErrNoInstanceRunning
+		if errors.As(err, &errNoInstanceRunning) {
+			code = http.StatusNotFound
+		}
+		h.logger.Error("root password rotation failed", "err", err)
+		c.JSON(code, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	h.logger.Info("root password rotated", "vm_id", h.vm.VMID())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": h.credentials(password)})
+}
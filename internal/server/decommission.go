@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// decommissionTokenTTL is how long a confirmation token stays valid.
+const decommissionTokenTTL = 5 * time.Minute
+
+// DecommissionFunc purges the host once the instance is gone. It is
+// provided by the agent, which owns the API client and the on-disk layout.
+type DecommissionFunc func(ctx context.Context, opts domain.DecommissionOptions) *domain.DecommissionReport
+
+type decommissionRequest struct {
+	ConfirmToken string `json:"confirm_token"`
+	domain.DecommissionOptions
+}
+
+// SetDecommission installs the purge step of POST /decommission.
+func (s *Server) SetDecommission(fn DecommissionFunc) {
+	s.handler.decomMu.Lock()
+	s.handler.decommission = fn
+	s.handler.decomMu.Unlock()
+}
+
+// Decommission is a two-step purge of the host. A request without
+// confirm_token returns a short-lived token; repeating the request with it
+// destroys the instance and removes all agent data.
+func (h *Handler) Decommission(c *gin.Context) {
+	var req decommissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	h.decomMu.Lock()
+	if h.decommission == nil {
+		h.decomMu.Unlock()
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": "decommission is not available"})
+		return
+	}
+
+	if req.ConfirmToken == "" {
+		buf := make([]byte, 16)
+		_, _ = rand.Read(buf)
+		h.decomToken = hex.EncodeToString(buf)
+		h.decomExpires = time.Now().Add(decommissionTokenTTL)
+		token, expires := h.decomToken, h.decomExpires
+		h.decomMu.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": decommissionTokenResponse{
+			ConfirmToken: token,
+			ExpiresAt:    expires.UTC(),
+		}})
+		return
+	}
+
+	valid := h.decomToken != "" && time.Now().Before(h.decomExpires) &&
+		subtle.ConstantTimeCompare([]byte(req.ConfirmToken), []byte(h.decomToken)) == 1
+	h.decomToken = ""
+	fn := h.decommission
+	h.decomMu.Unlock()
+
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{"ok": false, "error": "invalid or expired confirm_token"})
+		return
+	}
+
+	h.logger.Warn("decommissioning host",
+		"keep_logs", req.KeepLogs, "keep_images", req.KeepImages, "uninstall", req.Uninstall)
+
+	// The instance disk is wiped before the image directory goes away.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(secureWipeTimeout))
+	state, _ := h.store.LoadInstanceState()
+	h.vm.Invalidate()
+	wipe := h.destroyInstance(state, !req.KeepImages)
+
+	report := fn(c.Request.Context(), req.DecommissionOptions)
+	if wipe != nil && wipe.Error != "" {
+		report.Errors = append(report.Errors, "secure wipe incomplete: "+wipe.Error)
+	}
+
+	if len(report.Errors) > 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": "decommission incomplete", "data": report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": report})
+}
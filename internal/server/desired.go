@@ -0,0 +1,487 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+)
+
+// reconcileInterval is how often the desired state is re-checked without a
+// push.
+const reconcileInterval = 30 * time.Second
+
+// RunReconciler converges the host toward the document pushed to PUT /state
+// and reports the drift it repaired through sink. Without a document it
+// stays idle. It runs until ctx is cancelled.
+func (s *Server) RunReconciler(ctx context.Context, sink func(domain.Event)) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		s.handler.reconcileDesired(sink)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.handler.desiredKick:
+		}
+	}
+}
+
+// kickReconciler schedules a reconcile pass without waiting for it.
+func (h *Handler) kickReconciler() {
+	select {
+	case h.desiredKick <- struct{}{}:
+	default:
+	}
+}
+
+// PutState stores a desired-state document and switches the host to
+// declarative mode. Documents older than the stored generation are refused;
+// resending the stored one is a no-op.
+func (h *Handler) PutState(c *gin.Context) {
+	var req domain.DesiredState
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if err := h.validateDesired(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	h.desiredMu.Lock()
+	defer h.desiredMu.Unlock()
+
+	rec, err := h.store.LoadDesired()
+	if err != nil {
+		h.logger.Warn("unreadable desired state, replacing", "err", err)
+		rec = nil
+	}
+	if rec != nil {
+		cur := rec.Desired.Generation
+		switch {
+		case req.Generation < cur:
+			c.JSON(http.StatusConflict, gin.H{"ok": false, "error": fmt.Sprintf("generation %d is older than the stored generation %d", req.Generation, cur)})
+			return
+		case req.Generation == cur && !sameDocument(req, rec.Desired):
+			c.JSON(http.StatusConflict, gin.H{"ok": false, "error": fmt.Sprintf("generation %d was already stored with different content", cur)})
+			return
+		case req.Generation == cur:
+			c.JSON(http.StatusOK, gin.H{"ok": true, "data": putStateResponse{Generation: cur}})
+			return
+		}
+	} else {
+		rec = &domain.DesiredRecord{}
+	}
+
+	rec.Desired = req
+	if err := h.store.SaveDesired(rec); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	h.logger.Info("desired state stored", "generation", req.Generation, "instance", req.Instance != nil, "ssh_keys", len(req.SSHKeys))
+	h.kickReconciler()
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": putStateResponse{Generation: req.Generation, Changed: true}})
+}
+
+// GetState returns the desired state, what was applied from it and the
+// drift found by the latest reconcile pass.
+func (h *Handler) GetState(c *gin.Context) {
+	rec, err := h.store.LoadDesired()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if rec == nil {
+		c.JSON(http.StatusOK, gin.H{"ok": true, "data": stateResponse{}})
+		return
+	}
+
+	h.desiredMu.Lock()
+	report := h.lastReconcile
+	h.desiredMu.Unlock()
+
+	status := h.vm.Status(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{
+		"ok": true,
+		"data": stateResponse{
+			Enabled: true,
+			Desired: &rec.Desired,
+			Applied: rec.Applied,
+			Observed: &observedState{
+				Status: status.Status,
+				Reason: status.Reason,
+				VMID:   h.vm.VMID(),
+			},
+			LastReconcile: report,
+		},
+	})
+}
+
+// DeleteState leaves declarative mode. The instance is left as it is and
+// the imperative endpoints become available again.
+func (h *Handler) DeleteState(c *gin.Context) {
+	h.desiredMu.Lock()
+	defer h.desiredMu.Unlock()
+
+	if err := h.store.ClearDesired(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	h.lastReconcile = nil
+	h.logger.Info("desired state removed, declarative mode off")
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// ImperativeGuard rejects requests that change the instance while the host
+// is managed through PUT /state, since the reconciler would undo them.
+func (h *Handler) ImperativeGuard(c *gin.Context) {
+	if err := h.imperativeBlocked(); err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.Next()
+}
+
+// imperativeBlocked returns an error while a desired state is stored.
+func (h *Handler) imperativeBlocked() error {
+	if rec, _ := h.store.LoadDesired(); rec != nil {
+		return fmt.Errorf("host is managed declaratively (generation %d); change it through PUT /state", rec.Desired.Generation)
+	}
+	return nil
+}
+
+func (h *Handler) validateDesired(d domain.DesiredState) error {
+	if d.Instance == nil {
+		return nil
+	}
+	if !h.testMode && d.Instance.TunnelToken == "" {
+		return errors.New("instance.tunnel_token is required")
+	}
+	for _, p := range d.Instance.Ports {
+		if _, err := strconv.Atoi(p); err != nil {
+			return errors.New("instance.ports: invalid port " + p)
+		}
+	}
+	return nil
+}
+
+// specHash covers the desired instance fields that can only be applied by
+// replacing the instance.
+func specHash(d domain.DesiredInstance) string {
+	d.StorageGB, d.ExpiresAt, d.Power = 0, nil, ""
+	data, _ := json.Marshal(d)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func desiredCreateRequest(d domain.DesiredInstance) createInstanceRequest {
+	return createInstanceRequest{
+		TunnelToken:   d.TunnelToken,
+		SSHEnabled:    d.SSHEnabled,
+		Ports:         d.Ports,
+		StorageGB:     d.StorageGB,
+		CPUs:          d.CPUs,
+		Memory:        d.Memory,
+		SecureWipe:    d.SecureWipe,
+		BandwidthMbps: d.BandwidthMbps,
+		TLS:           d.TLS,
+		ExpiresAt:     d.ExpiresAt,
+		GPUCount:      d.GPUCount,
+		GPUAddrs:      d.GPUAddrs,
+	}
+}
+
+// reconcileDesired runs one pass: it compares the stored document with the
+// instance, acts on what differs and records the outcome for GET /state.
+// Transitional states are waited out rather than interrupted.
+func (h *Handler) reconcileDesired(sink func(domain.Event)) {
+	rec, err := h.store.LoadDesired()
+	if err != nil {
+		h.logger.Error("reconcile: unreadable desired state", "err", err)
+		return
+	}
+	if rec == nil {
+		return
+	}
+
+	want := rec.Desired
+	status := h.vm.Status(context.Background())
+	p := &reconcilePass{
+		h:       h,
+		applied: rec.Applied,
+		report: domain.ReconcileReport{
+			Generation: want.Generation,
+			Time:       time.Now().UTC(),
+			Status:     string(status.Status),
+		},
+	}
+
+	inst := want.Instance
+	if inst != nil && inst.ExpiresAt != nil && !inst.ExpiresAt.After(time.Now()) {
+		// A lapsed lease means the instance should be gone; recreating it
+		// would fight the reaper.
+		inst = nil
+	}
+
+	switch status.Status {
+	case domain.StatusProvisioning, domain.StatusBooting, domain.StatusConfiguring, domain.StatusStopping:
+		p.drift("transition", "waiting for the instance to leave "+string(status.Status), "", nil)
+	default:
+		if inst == nil {
+			p.ensureAbsent(status)
+		} else {
+			p.ensurePresent(*inst, want.SSHKeys, status)
+		}
+	}
+
+	p.report.Converged = len(p.report.Drift) == 0
+	acted := false
+	for _, d := range p.report.Drift {
+		if d.Action != "" {
+			acted = true
+		}
+	}
+
+	h.desiredMu.Lock()
+	if cur, _ := h.store.LoadDesired(); cur != nil {
+		// A newer document may have arrived meanwhile; only the applied
+		// record belongs to this pass.
+		cur.Applied = p.applied
+		if err := h.store.SaveDesired(cur); err != nil {
+			h.logger.Error("reconcile: save desired state", "err", err)
+		}
+		report := p.report
+		h.lastReconcile = &report
+	}
+	h.desiredMu.Unlock()
+
+	if !acted {
+		return
+	}
+	h.logger.Warn("reconcile: repaired drift", "generation", want.Generation, "drift", p.report.Drift)
+	sink(domain.Event{
+		Type:     domain.EventStateDrift,
+		Severity: domain.SeverityWarning,
+		Message:  fmt.Sprintf("%d difference(s) from desired generation %d", len(p.report.Drift), want.Generation),
+		Data: map[string]any{
+			"generation": want.Generation,
+			"drift":      p.report.Drift,
+		},
+		Time: time.Now().UTC(),
+	})
+}
+
+// reconcilePass carries the state of one reconcile pass.
+type reconcilePass struct {
+	h       *Handler
+	applied *domain.AppliedDesired
+	report  domain.ReconcileReport
+}
+
+func (p *reconcilePass) drift(kind, detail, action string, err error) {
+	d := domain.Drift{Kind: kind, Detail: detail, Action: action}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	p.report.Drift = append(p.report.Drift, d)
+}
+
+func (p *reconcilePass) ensureAbsent(status domain.StatusInfo) {
+	if p.h.vm.VMID() == "" && status.Status != domain.StatusFailed && p.h.currentJob() == nil {
+		p.applied = nil
+		return
+	}
+	p.destroy("instance_unexpected", "an instance exists but none is desired")
+	p.applied = nil
+}
+
+func (p *reconcilePass) ensurePresent(want domain.DesiredInstance, keys []string, status domain.StatusInfo) {
+	hash := specHash(want)
+	vmID := p.h.vm.VMID()
+
+	switch {
+	case status.Status == domain.StatusFailed:
+		p.destroy("instance_failed", "instance failed ("+string(status.Reason)+"), replacing")
+		p.create(want, hash)
+		return
+	case vmID == "":
+		p.create(want, hash)
+		return
+	}
+
+	switch {
+	case p.applied == nil || (p.applied.VMID != "" && p.applied.VMID != vmID):
+		// An instance created outside this document is taken over as is;
+		// the agent cannot tell how it was configured.
+		p.applied = &domain.AppliedDesired{VMID: vmID, SpecHash: hash, StorageGB: want.StorageGB}
+		p.drift("instance_adopted", "existing instance "+vmID+" taken over", "adopt", nil)
+	case p.applied.VMID == "":
+		p.applied.VMID = vmID
+	}
+
+	if p.applied.SpecHash != hash {
+		p.destroy("spec_changed", "instance spec changed, replacing")
+		p.create(want, hash)
+		return
+	}
+
+	if status.Status == domain.StatusStopped {
+		// The guest powered itself off. It is started again unless it is
+		// meant to be paused; the rest waits until it is back up.
+		p.ensurePower(want.Power, status.Status)
+		return
+	}
+
+	p.ensureDisk(want.StorageGB)
+	p.ensureLease(want.ExpiresAt)
+	p.ensurePower(want.Power, status.Status)
+	if status.Status == domain.StatusRunning || status.Status == domain.StatusDegraded {
+		p.ensureSSHKeys(keys)
+	}
+	p.ensureProxies(vmID)
+}
+
+// destroy removes the instance synchronously and records why.
+func (p *reconcilePass) destroy(kind, detail string) {
+	r := p.h.deleteInstance(false, true)
+	p.drift(kind, detail, "delete", r.err)
+	p.applied = nil
+}
+
+func (p *reconcilePass) create(want domain.DesiredInstance, hash string) {
+	r := p.h.createInstance(desiredCreateRequest(want))
+	p.drift("instance_missing", "no instance exists", "create", r.err)
+	if r.err == nil {
+		p.applied = &domain.AppliedDesired{SpecHash: hash, StorageGB: want.StorageGB}
+	}
+}
+
+func (p *reconcilePass) ensureDisk(want int) {
+	switch {
+	case want == 0 || want == p.applied.StorageGB:
+	case want < p.applied.StorageGB:
+		p.drift("disk_size", fmt.Sprintf("desired %d GB is below the applied %d GB; disks never shrink", want, p.applied.StorageGB), "", nil)
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), resizeTimeout)
+		defer cancel()
+		err := p.h.vm.ResizeDisk(ctx, want)
+		p.drift("disk_size", fmt.Sprintf("disk %d GB, desired %d GB", p.applied.StorageGB, want), "resize", err)
+		if err == nil {
+			p.applied.StorageGB = want
+		}
+	}
+}
+
+func (p *reconcilePass) ensureLease(want *time.Time) {
+	state, err := p.h.store.LoadInstanceState()
+	if err != nil || state == nil || sameTime(state.ExpiresAt, want) {
+		return
+	}
+	state.ExpiresAt = want
+	err = p.h.store.SaveInstanceState(state)
+	p.drift("lease", "instance lease differs from the document", "update_lease", err)
+}
+
+func (p *reconcilePass) ensurePower(want string, status domain.InstanceStatus) {
+	var cmd domain.InstanceCommand
+	switch {
+	case want == domain.PowerPaused && (status == domain.StatusRunning || status == domain.StatusDegraded):
+		cmd = domain.CommandStop
+	case want != domain.PowerPaused && (status == domain.StatusPaused || status == domain.StatusStopped):
+		cmd = domain.CommandStart
+	default:
+		return
+	}
+	r := p.h.manageInstance(context.Background(), cmd)
+	p.drift("power", "instance is "+string(status), string(cmd), r.err)
+}
+
+// ensureSSHKeys adds the desired keys and removes the ones an earlier
+// document added. Keys injected by other means are left alone.
+func (p *reconcilePass) ensureSSHKeys(want []string) {
+	var kept []string
+	for _, k := range p.applied.SSHKeys {
+		if slices.Contains(want, k) {
+			kept = append(kept, k)
+			continue
+		}
+		err := p.h.vm.RemoveSSHKey(context.Background(), k)
+		p.drift("ssh_keys", "key "+keyLabel(k)+" is no longer desired", "remove_key", err)
+		if err != nil {
+			kept = append(kept, k)
+		}
+	}
+	for _, k := range want {
+		if slices.Contains(kept, k) {
+			continue
+		}
+		err := p.h.vm.AddSSHKey(context.Background(), k)
+		p.drift("ssh_keys", "key "+keyLabel(k)+" is not authorized", "add_key", err)
+		if err == nil {
+			kept = append(kept, k)
+		}
+	}
+	p.applied.SSHKeys = kept
+}
+
+// ensureProxies puts back the tunnel proxies of the instance if the tunnel
+// configuration lost or changed them.
+func (p *reconcilePass) ensureProxies(vmID string) {
+	if p.h.testMode {
+		return
+	}
+	state, err := p.h.store.LoadInstanceState()
+	if err != nil || state == nil || state.VMID != vmID {
+		return
+	}
+	want := make([]frpc.Proxy, 0, len(state.Proxies))
+	for _, m := range state.Proxies {
+		want = append(want, frpc.ProxyFromMapping(m))
+	}
+	if frpc.SameProxies(p.h.tunnel.InstanceProxies(), want) {
+		return
+	}
+	err = p.h.tunnel.SetInstanceProxies(want)
+	p.drift("proxies", "tunnel proxies differ from the instance state", "reapply_proxies", err)
+}
+
+// sameDocument compares documents by their encoding; decoded times carry
+// zone pointers that reflect.DeepEqual would tell apart.
+func sameDocument(a, b domain.DesiredState) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// keyLabel shortens a public key for drift reports.
+func keyLabel(k string) string {
+	f := strings.Fields(k)
+	if len(f) >= 3 {
+		return f[2]
+	}
+	if len(k) > 24 {
+		return k[:24] + "..."
+	}
+	return k
+}
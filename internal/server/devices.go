@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// SetPCIDevices sets the host PCI devices besides the GPUs that a create may
+// ask to be passed through.
+func (s *Server) SetPCIDevices(addrs []string) {
+	s.handler.pciDevices = addrs
+}
+
+// SetUSBDevices sets the host USB devices an instance may ask for, at
+// create or later.
+func (s *Server) SetUSBDevices(devs []domain.USBDevice) {
+	s.handler.usbDevices = devs
+}
+
+// checkDevices rejects devices the host does not offer for passthrough.
+func (h *Handler) checkDevices(devices []string) error {
+	seen := make(map[string]bool, len(devices))
+	for _, addr := range devices {
+		if h.hasGPU(addr) {
+			return errors.New("pci device is a GPU, pass it in gpu_addrs: " + addr)
+		}
+		if !slices.Contains(h.pciDevices, addr) {
+			return errors.New("unknown pci device: " + addr)
+		}
+		if seen[addr] {
+			return errors.New("pci device listed twice: " + addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// resolveUSB parses vendor:product IDs and rejects those the host does not
+// offer.
+func (h *Handler) resolveUSB(ids []string) ([]domain.USBDevice, error) {
+	var devs []domain.USBDevice
+	for _, id := range ids {
+		d, err := h.usbDevice(id)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(devs, d) {
+			return nil, errors.New("usb device listed twice: " + d.String())
+		}
+		devs = append(devs, d)
+	}
+	return devs, nil
+}
+
+func (h *Handler) usbDevice(id string) (domain.USBDevice, error) {
+	d, err := domain.ParseUSBDevice(id)
+	if err != nil {
+		return d, err
+	}
+	if !slices.Contains(h.usbDevices, d) {
+		return d, errors.New("unknown usb device: " + d.String())
+	}
+	return d, nil
+}
+
+type usbRequest struct {
+	// Device is the vendor:product ID, as lsusb prints it.
+	Device string `json:"device" binding:"required"`
+}
+
+type usbResponse struct {
+	// USB are the devices attached to the instance.
+	USB []domain.USBDevice `json:"usb"`
+}
+
+// AttachUSB hotplugs a host USB device into the running instance.
+func (h *Handler) AttachUSB(c *gin.Context) {
+	var req usbRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	dev, err := h.usbDevice(req.Device)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	attached, err := h.vm.AttachUSB(dev)
+	usbResult(attached, err).respond(c)
+}
+
+// DetachUSB unplugs a USB device from the instance.
+func (h *Handler) DetachUSB(c *gin.Context) {
+	dev, err := domain.ParseUSBDevice(c.Param("device"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	attached, err := h.vm.DetachUSB(dev)
+	usbResult(attached, err).respond(c)
+}
+
+func usbResult(attached []domain.USBDevice, err error) opResult {
+	if err == nil {
+		return opResult{code: http.StatusOK, data: usbResponse{USB: attached}}
+	}
+	code := http.StatusInternalServerError
+	var (
+		errNoInstanceRunning domain.ErrNoInstanceRunning
+		errUSBNotAttached    domain.ErrUSBNotAttached
+		errUSBNotPresent     domain.ErrUSBNotPresent
+		errUSBAttached       domain.ErrUSBAttached
+		errCommandNotAllowed domain.ErrCommandNotAllowed
+	)
+	switch {
+	case errors.As(err, &errNoInstanceRunning), errors.As(err, &errUSBNotAttached), errors.As(err, &errUSBNotPresent):
+		code = http.StatusNotFound
+	case errors.As(err, &errUSBAttached), errors.As(err, &errCommandNotAllowed):
+		code = http.StatusConflict
+	}
+	return opResult{code: code, err: err}
+}
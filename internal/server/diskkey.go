@@ -0,0 +1,27 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	minDiskKeySize = 16
+	maxDiskKeySize = 64
+)
+
+// parseDiskKey decodes the base64 disk key of a create, nil for none.
+func parseDiskKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decode disk_key: %w", err)
+	}
+	if len(key) < minDiskKeySize || len(key) > maxDiskKeySize {
+		return nil, fmt.Errorf("disk_key must be %d to %d bytes, got %d", minDiskKeySize, maxDiskKeySize, len(key))
+	}
+	return key, nil
+}
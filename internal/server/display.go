@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+)
+
+// SetDisplay sets whether every instance gets a VNC display, not only
+// those created with vnc.
+func (s *Server) SetDisplay(vnc bool) {
+	s.handler.vncDefault = vnc
+}
+
+// allocateVNC allocates the loopback port of a VNC display and, with
+// remote, the tunnel port it is forwarded to. The ports are appended to
+// allocated so that they are released with the instance.
+func (h *Handler) allocateVNC(remote bool, allocated *[]int) (*domain.VNCDisplay, error) {
+	local, err := h.ports.AllocateOne("instance vnc")
+	if err != nil {
+		return nil, err
+	}
+	*allocated = append(*allocated, local)
+	vnc := &domain.VNCDisplay{Port: local, Password: randomPassword(domain.VNCPasswordLength)}
+	if remote {
+		if vnc.RemotePort, err = h.ports.AllocateSSHPort("instance vnc remote"); err != nil {
+			return nil, err
+		}
+		*allocated = append(*allocated, vnc.RemotePort)
+	}
+	return vnc, nil
+}
+
+// vncProxy forwards the VNC display over the tunnel as plain TCP; the
+// display is protected by its password.
+func vncProxy(vnc *domain.VNCDisplay) frpc.Proxy {
+	return frpc.Proxy{
+		Name:       "vm-vnc",
+		Type:       "tcp",
+		LocalIP:    "127.0.0.1",
+		LocalPort:  vnc.Port,
+		RemotePort: vnc.RemotePort,
+	}
+}
+
+// display returns the VNC display as the API hands it out: the port
+// clients connect to, the tunnel port or, without one, the host port.
+func (h *Handler) display(vnc *domain.VNCDisplay) *domain.Display {
+	if vnc == nil {
+		return nil
+	}
+	d := &domain.Display{Protocol: "vnc", Port: vnc.Port}
+	if vnc.RemotePort > 0 {
+		d.Port = vnc.RemotePort
+	}
+	var err error
+	d.Password, d.SealedPassword, err = h.sealPassword(vnc.Password)
+	if err != nil {
+		h.logger.Error("failed to seal VNC password", "err", err)
+		return nil
+	}
+	return d
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// SetEventSink registers where instance lifecycle events are published.
+func (s *Server) SetEventSink(fn func(domain.Event)) {
+	s.handler.events = fn
+}
+
+// emit publishes a lifecycle event; it is a no-op until a sink is set.
+func (h *Handler) emit(typ domain.EventType, severity domain.EventSeverity, msg string, data map[string]any) {
+	if h.events == nil {
+		return
+	}
+	h.events(domain.Event{Type: typ, Severity: severity, Message: msg, Data: data, Time: time.Now().UTC()})
+}
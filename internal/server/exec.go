@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	defaultExecTimeout = time.Minute
+	maxExecTimeout     = 30 * time.Minute
+	maxExecStdin       = 1 << 20
+)
+
+type execRequest struct {
+	// Command is the program and its arguments, such as
+	// ["sh", "-c", "nvidia-smi -L"].
+	Command []string `json:"command" binding:"required,min=1,max=256"`
+	// Container runs the command in a guest container with docker exec.
+	Container string `json:"container" binding:"max=255"`
+	// Stdin is fed to the command, at most 1 MiB.
+	Stdin string `json:"stdin"`
+	// TimeoutSeconds kills the command after this long; 60 by default, 1800
+	// at most.
+	TimeoutSeconds int `json:"timeout_seconds" binding:"min=0,max=1800"`
+}
+
+// ExecInstance runs a command in the guest and returns its exit code and
+// output once it exits. A failing or timed-out command is still a 200; the
+// outcome is in the result.
+func (h *Handler) ExecInstance(c *gin.Context) {
+	var req execRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if len(req.Stdin) > maxExecStdin {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "stdin is larger than 1 MiB"})
+		return
+	}
+	timeout := defaultExecTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = min(time.Duration(req.TimeoutSeconds)*time.Second, maxExecTimeout)
+	}
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(timeout + time.Minute))
+
+	res, err := h.vm.Exec(c.Request.Context(), domain.ExecRequest{
+		Command:   req.Command,
+		Container: req.Container,
+		Stdin:     req.Stdin,
+		Timeout:   timeout,
+	})
+	if err != nil {
+		h.guestIOError(c, err)
+		return
+	}
+	h.logger.Info("guest command run", "command", req.Command[0], "container", req.Container,
+		"exit_code", res.ExitCode, "timed_out", res.TimedOut, "duration_ms", res.DurationMS)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": res})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	reapInterval = 15 * time.Second
+	// maxTTL bounds ttl_seconds; longer leases are passed as expires_at.
+	maxTTL = 365 * 24 * time.Hour
+)
+
+// expiresAt resolves the lease of a create request. expires_at wins over
+// ttl_seconds; nil means the instance never expires.
+func (r createInstanceRequest) expiresAt(now time.Time) (*time.Time, error) {
+	switch {
+	case r.ExpiresAt != nil:
+		if !r.ExpiresAt.After(now) {
+			return nil, fmt.Errorf("expires_at %s is in the past", r.ExpiresAt.Format(time.RFC3339))
+		}
+		t := r.ExpiresAt.UTC()
+		return &t, nil
+	case r.TTLSeconds > 0:
+		ttl := time.Duration(r.TTLSeconds) * time.Second
+		if ttl > maxTTL {
+			return nil, fmt.Errorf("ttl_seconds must not exceed %d", int(maxTTL.Seconds()))
+		}
+		t := now.Add(ttl).UTC()
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// RunReaper destroys the instance once its lease expires and reports the
+// expiry through sink. It runs until ctx is cancelled.
+func (s *Server) RunReaper(ctx context.Context, sink func(domain.Event)) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.handler.reapExpired(sink)
+		}
+	}
+}
+
+func (h *Handler) reapExpired(sink func(domain.Event)) {
+	state, err := h.store.LoadInstanceState()
+	if err != nil || state == nil || state.ExpiresAt == nil {
+		return
+	}
+	if time.Now().Before(*state.ExpiresAt) {
+		return
+	}
+	// A create or delete in flight is left alone; the next tick retries.
+	if err := h.lifecycle.acquire("delete"); err != nil {
+		return
+	}
+	defer h.lifecycle.release()
+
+	h.logger.Info("instance lease expired, destroying",
+		"vm_id", state.VMID, "expires_at", state.ExpiresAt)
+	report := h.destroyInstance(state, false)
+
+	data := map[string]any{
+		"vm_id":      state.VMID,
+		"expires_at": state.ExpiresAt,
+	}
+	if report != nil {
+		data["wipe"] = report
+	}
+	sink(domain.Event{
+		Type:     domain.EventInstanceExpired,
+		Severity: domain.SeverityInfo,
+		Message:  "instance destroyed after its lease expired",
+		Data:     data,
+		Time:     time.Now().UTC(),
+	})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/system"
+)
+
+// SetFlavors sets the flavors a create may reference; it may be called
+// again on a reload. diskDir is where instance disks are created, whose free
+// space bounds the flavor disks.
+func (s *Server) SetFlavors(flavors []domain.Flavor, diskDir string) {
+	h := s.handler
+	h.flavorMu.Lock()
+	defer h.flavorMu.Unlock()
+	h.flavors = flavors
+	h.flavorDiskDir = diskDir
+}
+
+func (h *Handler) flavorList() []domain.Flavor {
+	h.flavorMu.Lock()
+	defer h.flavorMu.Unlock()
+	return h.flavors
+}
+
+type flavorInfo struct {
+	domain.Flavor
+	// Fits reports whether the host can currently run the flavor; Reason
+	// says why not.
+	Fits   bool   `json:"fits"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type flavorListResponse struct {
+	Flavors []flavorInfo `json:"flavors"`
+}
+
+func (h *Handler) ListFlavors(c *gin.Context) {
+	flavors := h.flavorList()
+	out := make([]flavorInfo, 0, len(flavors))
+	for _, f := range flavors {
+		item := flavorInfo{Flavor: f, Fits: true}
+		if err := h.flavorFits(f); err != nil {
+			item.Fits, item.Reason = false, err.Error()
+		}
+		out = append(out, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": flavorListResponse{Flavors: out}})
+}
+
+func (h *Handler) findFlavor(name string) (domain.Flavor, bool) {
+	for _, f := range h.flavorList() {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return domain.Flavor{}, false
+}
+
+// applyFlavor replaces the flavor req references by the size it stands
+// for. Raw sizes may not be given next to a flavor. A flavor the host cannot
+// run right now is refused with 409.
+func (h *Handler) applyFlavor(req *createInstanceRequest) opResult {
+	if req.Flavor == "" {
+		return opResult{}
+	}
+	if req.CPUs != "" || req.Memory != "" || req.StorageGB != 0 || req.GPUCount != 0 {
+		return opResult{code: http.StatusBadRequest, err: fmt.Errorf("flavor cannot be combined with cpus, memory, storage_gb or gpu_count")}
+	}
+	f, ok := h.findFlavor(req.Flavor)
+	if !ok {
+		return opResult{code: http.StatusBadRequest, err: fmt.Errorf("unknown flavor: %s", req.Flavor)}
+	}
+	if err := h.flavorFits(f); err != nil {
+		return opResult{code: http.StatusConflict, err: fmt.Errorf("flavor %s does not fit this host: %w", f.Name, err)}
+	}
+
+	req.CPUs = strconv.Itoa(f.CPUs)
+	req.Memory = strconv.Itoa(f.MemoryGB) + "G"
+	req.StorageGB = f.DiskGB
+	if len(req.GPUAddrs) == 0 {
+		req.GPUCount = f.GPUs
+	} else if f.GPUs != 0 && len(req.GPUAddrs) != f.GPUs {
+		return opResult{code: http.StatusBadRequest, err: fmt.Errorf("flavor %s has %d GPUs, %d gpu_addrs given", f.Name, f.GPUs, len(req.GPUAddrs))}
+	}
+	req.flavor = &f
+	return opResult{}
+}
+
+// flavorSpec records the flavor of r, if any, and how it backs and places
+// the guest in spec.
+func (r createInstanceRequest) flavorSpec(spec *domain.InstanceSpec) {
+	if r.flavor == nil {
+		return
+	}
+	spec.Flavor = r.flavor.Name
+	spec.Hugepages = r.flavor.Hugepages
+	spec.CPUPinning = r.flavor.CPUPinning
+}
+
+// flavorFits checks f against the capacity of the host: its CPUs, GPUs,
+// the memory available, or the free huge pages for a hugepages flavor, and
+// the free space for disks. It is meant to run while no instance is up.
+func (h *Handler) flavorFits(f domain.Flavor) error {
+	if cpus := runtime.NumCPU(); f.CPUs > cpus {
+		return fmt.Errorf("needs %d CPUs, host has %d", f.CPUs, cpus)
+	}
+	if gpus := len(h.vm.GPUAddrs()); f.GPUs > gpus {
+		return fmt.Errorf("needs %d GPUs, host has %d", f.GPUs, gpus)
+	}
+	need := uint64(f.MemoryGB) << 30
+	if mem, err := system.ReadMemory(); err == nil {
+		if f.Hugepages && mem.HugepagesFreeBytes < need {
+			return fmt.Errorf("needs %dGB of huge pages, %dGB free", f.MemoryGB, mem.HugepagesFreeBytes>>30)
+		}
+		if !f.Hugepages && mem.AvailableBytes < need {
+			return fmt.Errorf("needs %dGB of memory, %dGB available", f.MemoryGB, mem.AvailableBytes>>30)
+		}
+	}
+	h.flavorMu.Lock()
+	diskDir := h.flavorDiskDir
+	h.flavorMu.Unlock()
+	if diskDir != "" && f.DiskGB > 0 {
+		if du, err := system.ReadDiskUsage(diskDir); err == nil && du.AvailableBytes < uint64(f.DiskGB)<<30 {
+			return fmt.Errorf("needs %dGB of disk, %dGB free", f.DiskGB, du.AvailableBytes>>30)
+		}
+	}
+	return nil
+}
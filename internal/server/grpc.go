@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/qudata/agent/internal/agentpb"
+	"github.com/qudata/agent/internal/crash"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC API serves the services of proto/qudata/agent/v1/agent.proto on
+// a listener of its own. Calls authenticate like HTTP requests, with the
+// header names lowercased as metadata keys. A signed call is signed as
+//
+//	POST \n FULL_METHOD \n \n TIMESTAMP \n NONCE \n UNSIGNED-PAYLOAD
+//
+// since protobuf encodings are not canonical; the message itself is
+// protected by TLS.
+const (
+	// watchPollInterval is how often WatchInstance samples the status.
+	watchPollInterval = time.Second
+	// defaultStatsInterval applies when WatchStats gives no interval.
+	defaultStatsInterval = 5 * time.Second
+)
+
+// grpcRates override the default limit for individual methods.
+var grpcRates = map[string]rateSpec{
+	agentpb.InstanceService_CreateInstance_FullMethodName: lifecycleRate,
+	agentpb.InstanceService_DeleteInstance_FullMethodName: lifecycleRate,
+}
+
+// newGRPCServer registers the services of h on a gRPC server that
+// authenticates with secret, or only with signatures when signedOnly is
+// set. Callers over TLS must present a client certificate.
+func newGRPCServer(h *Handler, secret string, signedOnly bool, verifier *requestVerifier, rateLimit float64, tlsConfig *tls.Config) *grpc.Server {
+	a := &grpcAuth{secret: secret, signedOnly: signedOnly, verifier: verifier, limiter: newRateLimiter(rateLimit, grpcRates)}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(a.unary),
+		grpc.ChainStreamInterceptor(a.stream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := grpc.NewServer(opts...)
+	agentpb.RegisterInstanceServiceServer(s, &instanceService{h: h})
+	agentpb.RegisterStatsServiceServer(s, &statsService{h: h})
+	agentpb.RegisterLogServiceServer(s, &logService{h: h})
+	return s
+}
+
+type grpcAuth struct {
+	secret     string
+	signedOnly bool
+	verifier   *requestVerifier
+	limiter    *rateLimiter
+}
+
+func (a *grpcAuth) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	// Like RecoveryMiddleware: a panicking call fails instead of the agent.
+	defer func() {
+		if r := recover(); r != nil {
+			crash.Handle("grpc "+info.FullMethod, r)
+			resp, err = nil, status.Error(codes.Internal, "internal error")
+		}
+	}()
+	if err := a.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, mdCarrier(md))
+	ctx, span := tracing.Tracer().Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
+	resp, err = handler(ctx, req)
+	tracing.End(span, err)
+	return resp, err
+}
+
+// mdCarrier reads and writes the W3C trace context in gRPC metadata.
+type mdCarrier metadata.MD
+
+func (c mdCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c mdCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c mdCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (a *grpcAuth) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			crash.Handle("grpc "+info.FullMethod, r)
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	if err := a.check(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// check mirrors AuthMiddleware, ClientCertMiddleware and
+// RateLimitMiddleware for a call to method.
+func (a *grpcAuth) check(ctx context.Context, method string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if v := md.Get(strings.ToLower(key)); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if sig := get(signatureHeader); sig != "" {
+		ts, nonce, err := checkSignatureHeaders(get(timestampHeader), get(nonceHeader))
+		if err == nil {
+			err = a.verifier.check(http.MethodPost, method, "", ts, nonce, unsignedPayload, sig)
+		}
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	} else {
+		provided := get("X-Agent-Secret")
+		switch {
+		case provided == "":
+			return status.Error(codes.Unauthenticated, "missing x-agent-secret metadata")
+		case a.signedOnly:
+			return status.Error(codes.Unauthenticated, "request signature required")
+		case subtle.ConstantTimeCompare([]byte(provided), []byte(a.secret)) != 1:
+			return status.Error(codes.PermissionDenied, "invalid secret")
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) == 0 {
+			return status.Error(codes.Unauthenticated, "client certificate required")
+		}
+	}
+
+	if a.limiter != nil {
+		if wait := a.limiter.take(method); wait > 0 {
+			return status.Errorf(codes.ResourceExhausted, "rate limit exceeded for %s, retry in %s", method, wait.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// grpcError turns the outcome of an instance operation into a gRPC status.
+func grpcError(r opResult) error {
+	if r.err == nil {
+		return nil
+	}
+	return status.Error(grpcCode(r.code), r.err.Error())
+}
+
+func grpcCode(httpCode int) codes.Code {
+	switch httpCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+// ---------------------------------------------------------------------------
+// InstanceService
+// ---------------------------------------------------------------------------
+
+type instanceService struct {
+	agentpb.UnimplementedInstanceServiceServer
+	h *Handler
+}
+
+func (s *instanceService) GetInstance(ctx context.Context, _ *agentpb.GetInstanceRequest) (*agentpb.Instance, error) {
+	return instanceToPB(s.h.instanceStatus(ctx)), nil
+}
+
+func (s *instanceService) WatchInstance(_ *agentpb.WatchInstanceRequest, stream agentpb.InstanceService_WatchInstanceServer) error {
+	ctx := stream.Context()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	var last *agentpb.Instance
+	for {
+		cur := instanceToPB(s.h.instanceStatus(ctx))
+		if last == nil || !proto.Equal(cur, last) {
+			if err := stream.Send(cur); err != nil {
+				return err
+			}
+			last = cur
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *instanceService) CreateInstance(ctx context.Context, in *agentpb.CreateInstanceRequest) (*agentpb.CreateInstanceResponse, error) {
+	if err := s.h.imperativeBlocked(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	req := createRequestFromPB(in)
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	req.trace = tracing.Inject(ctx)
+	r := s.h.createInstance(req)
+	if err := grpcError(r); err != nil {
+		return nil, err
+	}
+	data, _ := r.data.(createInstanceResponse)
+	return &agentpb.CreateInstanceResponse{JobId: data.JobID, Ports: data.Ports}, nil
+}
+
+func (s *instanceService) ManageInstance(ctx context.Context, in *agentpb.ManageInstanceRequest) (*agentpb.ManageInstanceResponse, error) {
+	if in.GetCommand() == "" {
+		return nil, status.Error(codes.InvalidArgument, "command is required")
+	}
+	if err := grpcError(s.h.manageInstance(ctx, domain.InstanceCommand(in.GetCommand()))); err != nil {
+		return nil, err
+	}
+	return &agentpb.ManageInstanceResponse{}, nil
+}
+
+func (s *instanceService) ResizeInstance(ctx context.Context, in *agentpb.ResizeInstanceRequest) (*agentpb.ResizeInstanceResponse, error) {
+	if err := s.h.imperativeBlocked(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if in.GetStorageGb() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "storage_gb must be at least 1")
+	}
+	if err := grpcError(s.h.resizeInstance(ctx, int(in.GetStorageGb()))); err != nil {
+		return nil, err
+	}
+	return &agentpb.ResizeInstanceResponse{StorageGb: in.GetStorageGb()}, nil
+}
+
+func (s *instanceService) DeleteInstance(_ context.Context, in *agentpb.DeleteInstanceRequest) (*agentpb.DeleteInstanceResponse, error) {
+	if err := s.h.imperativeBlocked(); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	r := s.h.deleteInstance(in.GetSecureWipe(), false)
+	if err := grpcError(r); err != nil {
+		return nil, err
+	}
+	resp := &agentpb.DeleteInstanceResponse{}
+	if data, ok := r.data.(deleteInstanceResponse); ok && data.Wipe != nil {
+		resp.Wipe = &agentpb.WipeReport{
+			Files:      data.Wipe.Files,
+			Bytes:      data.Wipe.Bytes,
+			Method:     data.Wipe.Method,
+			DurationMs: data.Wipe.DurationMS,
+			Error:      data.Wipe.Error,
+		}
+	}
+	return resp, nil
+}
+
+func instanceToPB(r instanceResponse) *agentpb.Instance {
+	out := &agentpb.Instance{
+		Status: string(r.Status),
+		Reason: string(r.Reason),
+		Since:  optionalTimestamp(&r.Since),
+		Gpus:   r.GPUs,
+	}
+	for _, cmd := range r.AllowedCommands {
+		out.AllowedCommands = append(out.AllowedCommands, string(cmd))
+	}
+	if r.Job != nil {
+		out.Job = &agentpb.CreateJob{JobId: r.Job.ID, StartedAt: timestamppb.New(r.Job.StartedAt), Ports: r.Job.Ports}
+	}
+	if p := r.Provisioning; p != nil {
+		out.Provisioning = &agentpb.Provisioning{
+			JobId:     p.JobID,
+			Stage:     string(p.Stage),
+			Since:     timestamppb.New(p.Since),
+			StartedAt: timestamppb.New(p.StartedAt),
+			Attempt:   int32(p.Attempt),
+			Reason:    string(p.Reason),
+			Error:     p.Error,
+		}
+		for _, st := range p.Stages {
+			out.Provisioning.Stages = append(out.Provisioning.Stages, &agentpb.StageEntry{Stage: string(st.Stage), At: timestamppb.New(st.At)})
+		}
+	}
+	out.ExpiresAt = optionalTimestamp(r.ExpiresAt)
+	return out
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func createRequestFromPB(in *agentpb.CreateInstanceRequest) createInstanceRequest {
+	req := createInstanceRequest{
+		TunnelToken:   in.GetTunnelToken(),
+		SSHEnabled:    in.GetSshEnabled(),
+		Ports:         in.GetPorts(),
+		StorageGB:     int(in.GetStorageGb()),
+		Image:         in.GetImage(),
+		ImageTag:      in.GetImageTag(),
+		Registry:      in.Registry,
+		Login:         in.Login,
+		Password:      in.Password,
+		EnvVariables:  in.GetEnvVariables(),
+		Command:       in.Command,
+		CPUs:          in.GetCpus(),
+		Memory:        in.GetMemory(),
+		ReservationID: in.GetReservationId(),
+		SecureWipe:    in.GetSecureWipe(),
+		BandwidthMbps: int(in.GetBandwidthMbps()),
+		TLS:           in.GetTls(),
+		TTLSeconds:    int(in.GetTtlSeconds()),
+		InstanceID:    in.GetInstanceId(),
+		GPUCount:      int(in.GetGpuCount()),
+		GPUAddrs:      in.GetGpuAddrs(),
+	}
+	if in.ExpiresAt != nil {
+		t := in.GetExpiresAt().AsTime()
+		req.ExpiresAt = &t
+	}
+	return req
+}
+
+// ---------------------------------------------------------------------------
+// StatsService
+// ---------------------------------------------------------------------------
+
+type statsService struct {
+	agentpb.UnimplementedStatsServiceServer
+	h *Handler
+}
+
+func (s *statsService) WatchStats(in *agentpb.WatchStatsRequest, stream agentpb.StatsService_WatchStatsServer) error {
+	interval := defaultStatsInterval
+	if in.GetIntervalSeconds() > 0 {
+		interval = time.Duration(in.GetIntervalSeconds()) * time.Second
+	}
+	ctx := stream.Context()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := stream.Send(s.sample(ctx)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample takes the same readings as the stats reported to the control plane.
+func (s *statsService) sample(ctx context.Context) *agentpb.Stats {
+	st := s.h.vm.Status(ctx)
+	out := &agentpb.Stats{
+		Time:         timestamppb.Now(),
+		Status:       string(st.Status),
+		StatusReason: string(st.Reason),
+	}
+	if st.Status == domain.StatusDestroyed {
+		return out
+	}
+	if snap := s.h.vm.CollectStats(ctx); snap != nil {
+		out.GpuUtil = snap.GPUUtil
+		out.GpuTemp = int32(snap.GPUTemp)
+		out.CpuUtil = snap.CPUUtil
+		out.RamUtil = snap.RAMUtil
+		out.MemUtil = snap.MemUtil
+		out.InetIn = snap.InetIn
+		out.InetOut = snap.InetOut
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// LogService
+// ---------------------------------------------------------------------------
+
+type logService struct {
+	agentpb.UnimplementedLogServiceServer
+	h *Handler
+}
+
+func (s *logService) StreamLogs(in *agentpb.StreamLogsRequest, stream agentpb.LogService_StreamLogsServer) error {
+	opts := domain.LogOptions{Tail: int(in.GetTail()), Unit: in.GetUnit(), Follow: in.GetFollow()}
+	err := s.h.vm.StreamLogs(stream.Context(), opts, &logChunkWriter{stream: stream})
+	if err == nil || stream.Context().Err() != nil {
+		return nil
+	}
+	var errNoInstanceRunning domain.ErrNoInstanceRunning
+	if errors.As(err, &errNoInstanceRunning) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// logChunkWriter sends every write as one LogChunk.
+type logChunkWriter struct {
+	stream agentpb.LogService_StreamLogsServer
+}
+
+func (w *logChunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&agentpb.LogChunk{Data: append([]byte(nil), p...)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCInterceptorsRecoverPanics(t *testing.T) {
+	a := &grpcAuth{secret: testSecret}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-agent-secret", testSecret))
+
+	_, err := a.unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test/Unary"},
+		func(context.Context, any) (any, error) { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("unary panic: %v, want Internal", err)
+	}
+
+	err = a.stream(nil, &testServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/test/Stream"},
+		func(any, grpc.ServerStream) error { panic("boom") })
+	if status.Code(err) != codes.Internal {
+		t.Errorf("stream panic: %v, want Internal", err)
+	}
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// signedRequestKey marks requests authenticated by a signed URL.
+const signedRequestKey = "signed_url"
+
+const multipartContentType = "multipart/form-data"
+
+type signedURLRequest struct {
+	// Kind is "logs" or "file".
+	Kind       string `json:"kind" binding:"required,oneof=logs file"`
+	Path       string `json:"path"`
+	Unit       string `json:"unit"`
+	Tail       int    `json:"tail"`
+	Follow     bool   `json:"follow"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+// CreateSignedURL issues a short-lived URL for the guest logs or a guest file
+// that can be handed to an end user without exposing the agent secret. The
+// URL is bound to the current instance and stops working once it is replaced.
+// The returned URL is relative to the agent's public address.
+func (h *Handler) CreateSignedURL(c *gin.Context) {
+	var req signedURLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	vmID := h.vm.VMID()
+	if vmID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": domain.ErrNoInstanceRunning{}.Error()})
+		return
+	}
+
+	ttl := defaultURLTTL
+	if req.TTLSeconds > 0 {
+		ttl = min(time.Duration(req.TTLSeconds)*time.Second, maxURLTTL)
+	}
+	expires := time.Now().Add(ttl)
+
+	q := url.Values{"vm": {vmID}}
+	var target string
+	switch req.Kind {
+	case "logs":
+		target = apiPrefix + "/instances/logs"
+		if req.Unit != "" {
+			q.Set("unit", req.Unit)
+		}
+		if req.Tail > 0 {
+			q.Set("tail", strconv.Itoa(req.Tail))
+		}
+		if req.Follow {
+			q.Set("follow", "true")
+		}
+	case "file":
+		if !path.IsAbs(req.Path) {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "path must be an absolute guest path"})
+			return
+		}
+		target = apiPrefix + "/instances/files"
+		q.Set("path", path.Clean(req.Path))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": signedURLResponse{
+		URL:       h.signer.sign(target, q, expires),
+		ExpiresAt: expires.UTC(),
+	}})
+}
+
+// InstanceLogs streams the guest journal as plain text.
+func (h *Handler) InstanceLogs(c *gin.Context) {
+	if !h.checkSignedVM(c) {
+		return
+	}
+	var opts domain.LogOptions
+	if err := c.ShouldBindQuery(&opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if opts.Follow {
+		_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	}
+
+	w := &logWriter{c: c}
+	if err := h.vm.StreamLogs(c.Request.Context(), opts, w); err != nil && !c.Writer.Written() {
+		h.guestIOError(c, err)
+	}
+}
+
+// BootLog returns the guest serial output as plain text. It outlives the
+// instance, so a guest that failed to boot can still be looked at.
+func (h *Handler) BootLog(c *gin.Context) {
+	tail := 0
+	if v := c.Query("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "tail must be a non-negative integer"})
+			return
+		}
+		tail = n
+	}
+
+	data, err := h.vm.BootLog()
+	if err != nil {
+		h.guestIOError(c, err)
+		return
+	}
+	if tail > 0 {
+		lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) > tail {
+			data = []byte(strings.Join(lines[len(lines)-tail:], ""))
+		}
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+}
+
+// DownloadFile sends a guest file as an attachment.
+func (h *Handler) DownloadFile(c *gin.Context) {
+	if !h.checkSignedVM(c) {
+		return
+	}
+	guestPath := c.Query("path")
+	if !path.IsAbs(guestPath) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "path must be an absolute guest path"})
+		return
+	}
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	err := h.vm.DownloadFile(c.Request.Context(), guestPath, func(size int64, r io.Reader) error {
+		c.Header("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(guestPath)))
+		c.DataFromReader(http.StatusOK, size, "application/octet-stream", r, nil)
+		return nil
+	})
+	if err != nil && !c.Writer.Written() {
+		h.guestIOError(c, err)
+	}
+}
+
+type uploadFileResponse struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// UploadFile streams the "file" part of a multipart body to a guest path. A
+// path ending in a slash names a directory the file is put in under its
+// uploaded name.
+func (h *Handler) UploadFile(c *gin.Context) {
+	guestPath := c.Query("path")
+	if !path.IsAbs(guestPath) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "path must be an absolute guest path"})
+		return
+	}
+	var mode os.FileMode
+	if v := c.Query("mode"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0o7777 {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "mode must be octal permissions such as 0755"})
+			return
+		}
+		mode = os.FileMode(m)
+	}
+
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	var part *multipart.Part
+	for {
+		part, err = mr.NextPart()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "multipart body has no file part"})
+			return
+		}
+		if part.FormName() == "file" {
+			break
+		}
+	}
+	if strings.HasSuffix(guestPath, "/") {
+		name := path.Base(part.FileName())
+		if name == "." || name == "/" {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "path names a directory but the file part has no filename"})
+			return
+		}
+		guestPath += name
+	}
+	guestPath = path.Clean(guestPath)
+
+	rc := http.NewResponseController(c.Writer)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	r := &countingReader{r: part}
+	if err := h.vm.UploadFile(c.Request.Context(), guestPath, r, mode); err != nil {
+		h.guestIOError(c, err)
+		return
+	}
+	h.logger.Info("file uploaded to guest", "path", guestPath, "size", r.n)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": uploadFileResponse{Path: guestPath, Size: r.n}})
+}
+
+// checkSignedVM rejects signed URLs issued for an instance that no longer runs.
+func (h *Handler) checkSignedVM(c *gin.Context) bool {
+	if !c.GetBool(signedRequestKey) {
+		return true
+	}
+	if vmID := h.vm.VMID(); vmID == "" || vmID != c.Query("vm") {
+		c.JSON(http.StatusGone, gin.H{"ok": false, "error": "instance no longer exists"})
+		return false
+	}
+	return true
+}
+
+func (h *Handler) guestIOError(c *gin.Context, err error) {
+	code := http.StatusInternalServerError
+	var errNoInstanceRunning domain.ErrNoInstanceRunning
+	if errors.As(err, &errNoInstanceRunning) {
+		code = http.StatusNotFound
+	}
+	c.JSON(code, gin.H{"ok": false, "error": err.Error()})
+}
+
+// logWriter sends the plain-text headers on the first write, so an error
+// before any output can still be reported as JSON, and flushes after every
+// write so followed logs arrive promptly.
+type logWriter struct {
+	c *gin.Context
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	if !l.c.Writer.Written() {
+		l.c.Header("Content-Type", "text/plain; charset=utf-8")
+		l.c.Header("X-Content-Type-Options", "nosniff")
+		l.c.Status(http.StatusOK)
+	}
+	n, err := l.c.Writer.Write(p)
+	l.c.Writer.Flush()
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,52 +1,159 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/crash"
 	"github.com/qudata/agent/internal/domain"
 	"github.com/qudata/agent/internal/frpc"
+	"github.com/qudata/agent/internal/gpu"
 	"github.com/qudata/agent/internal/network"
 	"github.com/qudata/agent/internal/storage"
+	"github.com/qudata/agent/internal/tlsterm"
+	"github.com/qudata/agent/internal/tracing"
+	"github.com/qudata/agent/internal/tunnel"
+	"github.com/qudata/agent/internal/volume"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Handler struct {
-	vm       domain.VMManager
-	frpc     *frpc.Process
-	ports    *network.PortAllocator
-	store    *storage.Store
-	logger   *slog.Logger
-	testMode bool
+	vm           domain.VMManager
+	tunnel       tunnel.Provider
+	ports        *network.PortAllocator
+	store        *storage.Store
+	reservations *gpu.Reservations
+	logger       *slog.Logger
+	testMode     bool
+	signer       *urlSigner
+	tls          *tlsterm.Terminator
+
+	jobMu    sync.Mutex
+	job      *createJob
+	updating bool
+	// createQueue feeds accepted creates to RunCreateWorker.
+	createQueue chan queuedCreate
+	// createRetries is how often a create that failed for a transient
+	// reason is attempted again.
+	createRetries int
+
+	provMu       sync.Mutex
+	provisioning *domain.Provisioning
+
+	migMu     sync.Mutex
+	migration *domain.MigrationStatus
+	migBytes  atomic.Int64
+
+	decomMu      sync.Mutex
+	decommission DecommissionFunc
+	decomToken   string
+	decomExpires time.Time
+
+	netTestMu sync.Mutex
+	netTest   NetTestFunc
+
+	update UpdateFunc
+	reload ReloadFunc
+	events func(domain.Event)
+
+	lifecycle lifecycleGuard
+
+	desiredMu     sync.Mutex
+	desiredKick   chan struct{}
+	lastReconcile *domain.ReconcileReport
+
+	flavorMu      sync.Mutex
+	flavors       []domain.Flavor
+	flavorDiskDir string
+
+	passwordAuth bool
+	sealKey      *[32]byte
+	// vncDefault gives every instance a VNC display.
+	vncDefault bool
+	// pciDevices are the non-GPU devices instances may ask for.
+	pciDevices []string
+	// usbDevices are the USB devices instances may ask for.
+	usbDevices []domain.USBDevice
+	// memCheck enables memoryFits with the default guest memory and the
+	// host reserve in bytes.
+	memCheck   bool
+	memDefault string
+	memReserve uint64
+
+	// volumeMu orders volume deletes against creates attaching volumes.
+	volumeMu sync.Mutex
+	volumes  *volume.Store
+
+	transferMu sync.Mutex
+	transfers  map[string]*volumeTransfer
+
+	// labelsMu guards labels, those of the instance being created or
+	// running, which its events and status carry.
+	labelsMu sync.Mutex
+	labels   map[string]string
+
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
 }
 
 func NewHandler(
 	vm domain.VMManager,
-	frpc *frpc.Process,
+	tun tunnel.Provider,
 	ports *network.PortAllocator,
 	store *storage.Store,
 	logger *slog.Logger,
 	testMode bool,
 ) *Handler {
-	return &Handler{
-		vm:       vm,
-		frpc:     frpc,
-		ports:    ports,
-		store:    store,
-		logger:   logger,
-		testMode: testMode,
+	h := &Handler{
+		vm:           vm,
+		tunnel:       tun,
+		ports:        ports,
+		store:        store,
+		reservations: gpu.NewReservations(),
+		logger:       logger,
+		testMode:     testMode,
+		desiredKick:  make(chan struct{}, 1),
+		createQueue:  make(chan queuedCreate, 1),
+	}
+	if state, _ := store.LoadInstanceState(); state != nil {
+		h.labels = state.Labels
 	}
+	return h
 }
 
 func (h *Handler) Ping(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// opResult is the outcome of an instance operation. The single-operation
+// endpoints respond with it directly and POST /instances/batch collects one
+// per item.
+type opResult struct {
+	code int
+	data any
+	err  error
+}
+
+func (r opResult) respond(c *gin.Context) {
+	body := gin.H{"ok": r.err == nil}
+	if r.err != nil {
+		body["error"] = r.err.Error()
+	}
+	if r.data != nil {
+		body["data"] = r.data
+	}
+	c.JSON(r.code, body)
+}
+
 type createInstanceRequest struct {
 	TunnelToken  string            `json:"tunnel_token"` // required only in non-test mode
 	SSHEnabled   bool              `json:"ssh_enabled"`
@@ -61,28 +168,157 @@ type createInstanceRequest struct {
 	Command      *string           `json:"command"`
 	CPUs         string            `json:"cpus"`
 	Memory       string            `json:"memory"`
-}
+	// Flavor names an operator-defined size used instead of cpus, memory,
+	// storage_gb and gpu_count.
+	Flavor string `json:"flavor"`
+	// Containers or Compose, a Docker Compose document, are run in the
+	// guest once it is up.
+	Containers []domain.Container `json:"containers" binding:"omitempty,max=16,dive"`
+	Compose    string             `json:"compose"`
+	// Labels are opaque metadata, such as the tenant or order ID, carried
+	// by the instance's events and stats and readable in the guest.
+	Labels map[string]string `json:"labels"`
+	// DiskKey, base64, encrypts the instance disk with a key the control
+	// plane holds; it is kept in memory only.
+	DiskKey string `json:"disk_key"`
+	// TPM gives the guest an emulated TPM 2.0 for measured boot, disk
+	// encryption bound to it and attestation.
+	TPM bool `json:"tpm"`
+	// Confidential runs the guest with encrypted memory under SEV-SNP or
+	// TDX, whichever the host has; see POST /instances/attestation.
+	Confidential bool `json:"confidential"`
+	// SecureBoot boots the guest with UEFI Secure Boot enforced, for images
+	// with a signed boot chain.
+	SecureBoot bool `json:"secure_boot"`
+	// Nested lets the guest run VMs of its own, such as Kata containers;
+	// the host kvm module must have nested enabled.
+	Nested bool `json:"nested"`
+	// VNC serves the guest display over password-protected VNC, for GUI
+	// tools and watching the boot.
+	VNC bool `json:"vnc"`
+	// Volumes names persistent volumes to attach; each is mounted in the
+	// guest under /mnt and outlives the instance.
+	Volumes []string `json:"volumes" binding:"omitempty,max=8"`
+	// ReservationID redeems a prior POST /gpus/:addr/reserve.
+	ReservationID string `json:"reservation_id"`
+	// GPUCount or GPUAddrs pass a subset of the host GPUs; all of them are
+	// passed when both are empty.
+	GPUCount   int      `json:"gpu_count" binding:"min=0"`
+	GPUAddrs   []string `json:"gpu_addrs"`
+	SecureWipe bool     `json:"secure_wipe"`
+	// Devices are PCI addresses of host devices other than GPUs, among
+	// those the host offers, passed through alongside the GPUs.
+	Devices []string `json:"devices" binding:"omitempty,max=8"`
+	// USB are vendor:product IDs of host USB devices, among those the host
+	// offers, passed through to the guest.
+	USB []string `json:"usb" binding:"omitempty,max=8"`
+	// BandwidthMbps caps instance traffic in each direction; 0 is unlimited.
+	BandwidthMbps int `json:"bandwidth_mbps" binding:"min=0"`
+	// TLS serves HTTP ports over HTTPS with an ACME certificate for the
+	// port's subdomain, terminated on the host.
+	TLS bool `json:"tls"`
+	// ExpiresAt or TTLSeconds set a lease after which the instance is
+	// destroyed; expires_at wins when both are given.
+	ExpiresAt  *time.Time `json:"expires_at"`
+	TTLSeconds int        `json:"ttl_seconds" binding:"min=0"`
+	// InstanceID makes the create idempotent like the Idempotency-Key
+	// header, which takes precedence.
+	InstanceID string `json:"instance_id" binding:"max=255"`
 
-func (h *Handler) CreateInstance(c *gin.Context) {
-	// Read raw body for logging
-	bodyBytes, _ := io.ReadAll(c.Request.Body)
-	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	// headerKey is the Idempotency-Key header.
+	headerKey string
+	// importFrom is set for instances received through IngestInstance.
+	importFrom *domain.ImportSource
+	// expires is the resolved lease.
+	expires *time.Time
+	// trace is the W3C trace context of the caller.
+	trace map[string]string
+	// flavor is the resolved Flavor.
+	flavor *domain.Flavor
+	// rootPassword is the generated guest root password, "" for none.
+	rootPassword string
+	// diskKey is the decoded DiskKey, nil for none.
+	diskKey []byte
+	// volumes are the resolved Volumes.
+	volumes []domain.VolumeAttachment
+	// compose is the Compose document of the containers, "" for none.
+	compose string
+	// gpus are the resolved GPU addresses, nil for all.
+	gpus []string
+	// usb are the resolved USB devices.
+	usb []domain.USBDevice
+}
 
-	h.logger.Info("CreateInstance request",
-		"body", string(bodyBytes),
-		"content_type", c.ContentType(),
-	)
+// logAttrs describes the request for the log. The body itself is never
+// logged, since it carries the registry password, environment variables,
+// the tunnel token and the disk key.
+func (r *createInstanceRequest) logAttrs() []any {
+	return []any{
+		"image", r.Image,
+		"image_tag", r.ImageTag,
+		"flavor", r.Flavor,
+		"cpus", r.CPUs,
+		"memory", r.Memory,
+		"storage_gb", r.StorageGB,
+		"gpu_count", r.GPUCount,
+		"ports", r.Ports,
+		"ssh_enabled", r.SSHEnabled,
+		"disk_key", r.DiskKey != "",
+		"labels", len(r.Labels),
+	}
+}
 
+func (h *Handler) CreateInstance(c *gin.Context) {
 	var req createInstanceRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		h.logger.Error("CreateInstance bind error",
 			"error", err.Error(),
-			"body", string(bodyBytes),
+			"content_type", c.ContentType(),
 		)
 		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
 		return
 	}
+	h.logger.Info("CreateInstance request", req.logAttrs()...)
+	req.headerKey = c.GetHeader(idempotencyHeader)
+	req.trace = tracing.Inject(c.Request.Context())
+	if len(req.headerKey) > maxIdempotencyKeyLen {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": idempotencyHeader + " is too long"})
+		return
+	}
 
+	h.createInstance(req).respond(c)
+}
+
+// createInstance claims the VM slot for req and starts the create in the
+// background. A create repeated with the idempotency key of an earlier one
+// gets that one's outcome.
+func (h *Handler) createInstance(req createInstanceRequest) opResult {
+	var err error
+	req.expires, err = req.expiresAt(time.Now())
+	if err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+
+	if err := h.lifecycle.acquire("create"); err != nil {
+		return opResult{code: http.StatusConflict, err: err}
+	}
+	defer h.lifecycle.release()
+
+	key := req.idempotencyKey()
+	if key == "" {
+		return h.createLocked(req)
+	}
+	hash := req.fingerprint()
+	if r, ok := h.replayCreate(key, hash); ok {
+		return r
+	}
+	r := h.createLocked(req)
+	h.recordCreate(key, hash, r)
+	return r
+}
+
+// createLocked is createInstance once the create lifecycle guard is held.
+func (h *Handler) createLocked(req createInstanceRequest) opResult {
 	h.logger.Info("CreateInstance parsed",
 		"tunnel_token", req.TunnelToken,
 		"ssh_enabled", req.SSHEnabled,
@@ -90,60 +326,185 @@ func (h *Handler) CreateInstance(c *gin.Context) {
 		"test_mode", h.testMode,
 	)
 
+	if r := h.applyFlavor(&req); r.err != nil {
+		return r
+	}
+	compose, err := h.composeDocument(req)
+	if err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	req.compose = compose
+	if req.diskKey, err = parseDiskKey(req.DiskKey); err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	if req.SecureBoot && req.Confidential {
+		// Confidential guests boot stateless firmware without the keys.
+		return opResult{code: http.StatusBadRequest, err: errors.New("secure_boot cannot be combined with confidential")}
+	}
+	if req.Nested && req.Confidential {
+		return opResult{code: http.StatusBadRequest, err: errors.New("nested cannot be combined with confidential")}
+	}
+	gpus, err := h.selectGPUs(req)
+	if err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	req.gpus = gpus
+	if err := h.checkDevices(req.Devices); err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	if err := checkLabels(req.Labels); err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	if req.usb, err = h.resolveUSB(req.USB); err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+
+	// Duplicates are turned away before anything is allocated or claimed.
+	job, err := h.beginCreate()
+	if err != nil {
+		h.logger.Warn("duplicate CreateInstance rejected", "err", err)
+		return opResult{code: http.StatusConflict, data: gin.H{"job": job}, err: err}
+	}
+
+	// Checked once the slot is ours: a repeated create must get its
+	// original outcome, and a running instance makes the host look full.
+	if r := h.memoryFits(req); r.err != nil {
+		h.endCreate(job)
+		return r
+	}
+
+	volumes, r := h.attachVolumes(job, req.Volumes)
+	if r.err != nil {
+		h.endCreate(job)
+		return r
+	}
+	req.volumes = volumes
+
+	claim := gpus
+	if claim == nil {
+		claim = h.vm.GPUAddrs()
+	}
+	claimed, err := h.reservations.Claim(claim, req.ReservationID)
+	if err != nil {
+		h.endCreate(job)
+		return opResult{code: http.StatusConflict, err: err}
+	}
+	h.jobMu.Lock()
+	job.claimed = claimed
+	h.jobMu.Unlock()
+	return h.launch(job, req)
+}
+
+// launch allocates ports for the create owning job and boots the instance.
+func (h *Handler) launch(job *createJob, req createInstanceRequest) opResult {
+	h.setLabels(req.Labels)
+	h.startProvisioning(job)
+	req.rootPassword = h.newRootPassword()
+	_, span := tracing.Start(tracing.Extract(context.Background(), req.trace), "ports.allocate",
+		attribute.String("job_id", job.ID))
+	var r opResult
 	if h.testMode {
-		h.createTestInstance(c, req)
+		r = h.createTestInstance(job, req)
 	} else {
-		h.createFRPCInstance(c, req)
+		r = h.createFRPCInstance(job, req)
+	}
+	tracing.End(span, r.err)
+	if r.err != nil {
+		h.reservations.Restore(job.claimed)
+		h.finishProvisioning(job, domain.StageFailed, domain.ReasonCreateFailed, r.err)
 	}
+	return r
 }
 
 // createTestInstance — hardcoded SSH + Ollama, ports on 0.0.0.0, no FRPC.
-func (h *Handler) createTestInstance(c *gin.Context, req createInstanceRequest) {
-	sshPort, err := h.ports.AllocateSSHPort()
+func (h *Handler) createTestInstance(job *createJob, req createInstanceRequest) opResult {
+	sshPort, err := h.ports.AllocateSSHPort("instance ssh")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-		return
+		h.endCreate(job)
+		return opResult{code: http.StatusInternalServerError, err: err}
 	}
 
-	ollamaPort, err := h.ports.AllocateOne()
+	ollamaPort, err := h.ports.AllocateOne("instance port 11434")
 	if err != nil {
 		h.ports.Release(sshPort)
-		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-		return
+		h.endCreate(job)
+		return opResult{code: http.StatusInternalServerError, err: err}
+	}
+	allocated := []int{sshPort, ollamaPort}
+
+	var vnc *domain.VNCDisplay
+	if req.VNC || h.vncDefault {
+		if vnc, err = h.allocateVNC(false, &allocated); err != nil {
+			h.ports.Release(allocated...)
+			h.endCreate(job)
+			return opResult{code: http.StatusInternalServerError, err: err}
+		}
 	}
 
 	spec := domain.InstanceSpec{
-		SSHEnabled:  true,
-		TunnelToken: req.TunnelToken,
-		DiskSizeGB:  req.StorageGB,
-		CPUs:        req.CPUs,
-		Memory:      req.Memory,
+		VMID:          newVMID(),
+		SSHEnabled:    true,
+		TunnelToken:   req.TunnelToken,
+		GPUAddrs:      req.gpus,
+		DiskSizeGB:    req.StorageGB,
+		CPUs:          req.CPUs,
+		Memory:        req.Memory,
+		SecureWipe:    req.SecureWipe,
+		BandwidthMbps: req.BandwidthMbps,
+		Import:        req.importFrom,
+		ExpiresAt:     req.expires,
+		RootPassword:  req.rootPassword,
+		Compose:       req.compose,
+		Volumes:       req.volumes,
+		DiskEncrypted: req.diskKey != nil,
+		DiskKey:       req.diskKey,
+		TPM:           req.TPM,
+		Confidential:  req.Confidential,
+		SecureBoot:    req.SecureBoot,
+		Nested:        req.Nested,
+		Devices:       req.Devices,
+		USB:           req.usb,
+		VNC:           vnc,
+		Labels:        req.Labels,
 		Ports: []domain.PortMapping{
 			{Name: "ollama", GuestPort: 11434, Proto: "http"},
 		},
 	}
+	req.flavorSpec(&spec)
 	hostPorts := []int{sshPort, ollamaPort}
 
-	allocated := []int{sshPort, ollamaPort}
-	go h.startVM(context.Background(), spec, hostPorts, allocated)
-
-	h.logger.Info("instance creating (test)", "ssh", sshPort, "ollama", ollamaPort)
-	c.JSON(http.StatusOK, gin.H{
-		"ok": true,
-		"data": gin.H{
-			"ports": gin.H{
-				"22":    strconv.Itoa(sshPort),
-				"11434": strconv.Itoa(ollamaPort),
-			},
-		},
-	})
+	ports := map[string]string{
+		"22":    strconv.Itoa(sshPort),
+		"11434": strconv.Itoa(ollamaPort),
+	}
+	h.acceptCreate(job, ports)
+	rec := domain.CreateJob{
+		ID:              job.ID,
+		StartedAt:       job.StartedAt,
+		Spec:            spec,
+		HostPorts:       hostPorts,
+		Allocated:       allocated,
+		Ports:           ports,
+		Import:          spec.Import != nil,
+		Trace:           req.trace,
+		DiskKeySupplied: req.diskKey != nil,
+	}
+	if err := h.enqueueCreate(job, rec); err != nil {
+		h.ports.Release(allocated...)
+		h.endCreate(job)
+		return opResult{code: http.StatusInternalServerError, err: err}
+	}
+
+	h.logger.Info("instance creating (test)", "job_id", job.ID, "ssh", sshPort, "ollama", ollamaPort)
+	return opResult{code: http.StatusOK, data: createInstanceResponse{JobID: job.ID, Ports: ports,
+		Credentials: h.credentials(req.rootPassword), Display: h.display(vnc)}}
 }
 
 // createFRPCInstance — dynamic ports from request, tunneled via FRPC.
-func (h *Handler) createFRPCInstance(c *gin.Context, req createInstanceRequest) {
+func (h *Handler) createFRPCInstance(job *createJob, req createInstanceRequest) opResult {
 	if req.TunnelToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "tunnel_token is required"})
-		return
+		h.endCreate(job)
+		return opResult{code: http.StatusBadRequest, err: errors.New("tunnel_token is required")}
 	}
 
 	var (
@@ -153,21 +514,23 @@ func (h *Handler) createFRPCInstance(c *gin.Context, req createInstanceRequest)
 		sshRemote    int
 	)
 
-	rollback := func() { h.ports.Release(allocated...) }
+	rollback := func() {
+		h.ports.Release(allocated...)
+		h.endCreate(job)
+	}
 
 	if req.SSHEnabled {
-		remote, err := h.ports.AllocateSSHPort()
+		remote, err := h.ports.AllocateSSHPort("instance ssh remote")
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-			return
+			rollback()
+			return opResult{code: http.StatusInternalServerError, err: err}
 		}
 		allocated = append(allocated, remote)
 
-		local, err := h.ports.AllocateOne()
+		local, err := h.ports.AllocateOne("instance ssh")
 		if err != nil {
 			rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-			return
+			return opResult{code: http.StatusInternalServerError, err: err}
 		}
 		allocated = append(allocated, local)
 
@@ -183,15 +546,13 @@ func (h *Handler) createFRPCInstance(c *gin.Context, req createInstanceRequest)
 		guestPort, err := strconv.Atoi(portStr)
 		if err != nil {
 			rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": "invalid port: " + portStr})
-			return
+			return opResult{code: http.StatusBadRequest, err: errors.New("invalid port: " + portStr)}
 		}
 
-		local, err := h.ports.AllocateOne()
+		local, err := h.ports.AllocateOne("instance port " + portStr)
 		if err != nil {
 			rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-			return
+			return opResult{code: http.StatusInternalServerError, err: err}
 		}
 		allocated = append(allocated, local)
 
@@ -203,39 +564,76 @@ func (h *Handler) createFRPCInstance(c *gin.Context, req createInstanceRequest)
 
 		var remote int
 		if proto == "tcp" {
-			remote, err = h.ports.AllocateSSHPort()
+			remote, err = h.ports.AllocateSSHPort("instance port " + portStr + " remote")
 		} else {
-			remote, err = h.ports.AllocateOne()
+			remote, err = h.ports.AllocateOne("instance port " + portStr + " remote")
 		}
 		if err != nil {
 			rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
-			return
+			return opResult{code: http.StatusInternalServerError, err: err}
 		}
 		allocated = append(allocated, remote)
 
+		var tlsPort int
+		if req.TLS && proto == "http" && h.tls != nil {
+			tlsPort, err = h.ports.AllocateOne("instance port " + portStr + " tls")
+			if err != nil {
+				rollback()
+				return opResult{code: http.StatusInternalServerError, err: err}
+			}
+			allocated = append(allocated, tlsPort)
+		}
+
 		hostPorts = append(hostPorts, local)
 		portMappings = append(portMappings, domain.PortMapping{
 			Name:       "port-" + portStr,
 			GuestPort:  guestPort,
 			RemotePort: remote,
 			Proto:      proto,
+			TLSPort:    tlsPort,
 		})
 	}
 
-	spec := domain.InstanceSpec{
-		SSHEnabled:  req.SSHEnabled,
-		TunnelToken: req.TunnelToken,
-		DiskSizeGB:  req.StorageGB,
-		CPUs:        req.CPUs,
-		Memory:      req.Memory,
-		Ports:       portMappings,
+	var vnc *domain.VNCDisplay
+	if req.VNC || h.vncDefault {
+		var err error
+		if vnc, err = h.allocateVNC(true, &allocated); err != nil {
+			rollback()
+			return opResult{code: http.StatusInternalServerError, err: err}
+		}
 	}
 
-	go h.startVMWithFRPC(context.Background(), spec, hostPorts, sshRemote, allocated)
+	spec := domain.InstanceSpec{
+		VMID:          newVMID(),
+		SSHEnabled:    req.SSHEnabled,
+		TunnelToken:   req.TunnelToken,
+		GPUAddrs:      req.gpus,
+		DiskSizeGB:    req.StorageGB,
+		CPUs:          req.CPUs,
+		Memory:        req.Memory,
+		Ports:         portMappings,
+		SecureWipe:    req.SecureWipe,
+		BandwidthMbps: req.BandwidthMbps,
+		Import:        req.importFrom,
+		ExpiresAt:     req.expires,
+		RootPassword:  req.rootPassword,
+		Compose:       req.compose,
+		Volumes:       req.volumes,
+		DiskEncrypted: req.diskKey != nil,
+		DiskKey:       req.diskKey,
+		TPM:           req.TPM,
+		Confidential:  req.Confidential,
+		SecureBoot:    req.SecureBoot,
+		Nested:        req.Nested,
+		Devices:       req.Devices,
+		USB:           req.usb,
+		VNC:           vnc,
+		Labels:        req.Labels,
+	}
+	req.flavorSpec(&spec)
 
 	// Build response: guest_port → remote_port (what clients connect to via FRPC).
-	ports := make(gin.H, len(portMappings)+1)
+	ports := make(map[string]string, len(portMappings)+1)
 	if req.SSHEnabled {
 		ports["22"] = strconv.Itoa(sshRemote)
 	}
@@ -243,61 +641,172 @@ func (h *Handler) createFRPCInstance(c *gin.Context, req createInstanceRequest)
 		ports[strconv.Itoa(pm.GuestPort)] = strconv.Itoa(pm.RemotePort)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"ok": true, "data": gin.H{"ports": ports}})
+	h.acceptCreate(job, ports)
+	rec := domain.CreateJob{
+		ID:              job.ID,
+		StartedAt:       job.StartedAt,
+		Spec:            spec,
+		HostPorts:       hostPorts,
+		Allocated:       allocated,
+		Ports:           ports,
+		FRPC:            true,
+		SSHRemote:       sshRemote,
+		Import:          spec.Import != nil,
+		Trace:           req.trace,
+		DiskKeySupplied: req.diskKey != nil,
+	}
+	if err := h.enqueueCreate(job, rec); err != nil {
+		rollback()
+		return opResult{code: http.StatusInternalServerError, err: err}
+	}
+
+	return opResult{code: http.StatusOK, data: createInstanceResponse{JobID: job.ID, Ports: ports,
+		Credentials: h.credentials(req.rootPassword), Display: h.display(vnc)}}
 }
 
 // ---------------------------------------------------------------------------
 // VM lifecycle (background)
 // ---------------------------------------------------------------------------
 
-func (h *Handler) startVM(ctx context.Context, spec domain.InstanceSpec, hostPorts, allocated []int) {
-	portMap, err := h.vm.Create(ctx, spec, hostPorts)
-	if err != nil {
-		h.logger.Error("instance creation failed", "err", err)
-		h.ports.Release(allocated...)
-		h.vm.MarkFailed()
+func (h *Handler) startVM(ctx context.Context, job *createJob, spec domain.InstanceSpec, hostPorts, allocated []int) {
+	portMap, ok := h.bootVM(ctx, job, spec, hostPorts, allocated)
+	if !ok {
 		return
 	}
 
 	h.saveState(spec, portMap, allocated)
+	h.finishProvisioning(job, domain.StageRunning, "", nil)
+	h.clearCreateJob(job.ID)
 	h.logger.Info("instance running", "vm_id", h.vm.VMID(), "ports", portMap)
+	h.emitRunning(job, portMap)
 }
 
-func (h *Handler) startVMWithFRPC(ctx context.Context, spec domain.InstanceSpec, hostPorts []int, sshRemote int, allocated []int) {
-	portMap, err := h.vm.Create(ctx, spec, hostPorts)
-	if err != nil {
-		h.logger.Error("instance creation failed", "err", err)
-		h.ports.Release(allocated...)
-		h.vm.MarkFailed()
+func (h *Handler) startVMWithFRPC(ctx context.Context, job *createJob, spec domain.InstanceSpec, hostPorts []int, sshRemote int, allocated []int) {
+	portMap, ok := h.bootVM(ctx, job, spec, hostPorts, allocated)
+	if !ok {
 		return
 	}
 
+	// hostPorts holds the SSH forward first, then one entry per spec port.
+	offset := 0
+	if spec.SSHEnabled {
+		offset = 1
+	}
+
 	var portSpecs []frpc.PortSpec
-	for _, pm := range spec.Ports {
-		portSpecs = append(portSpecs, frpc.PortSpec{
+	for i, pm := range spec.Ports {
+		ps := frpc.PortSpec{
 			GuestPort:  pm.GuestPort,
 			RemotePort: pm.RemotePort,
 			Proto:      pm.Proto,
-		})
+		}
+		if pm.TLSPort > 0 && h.startTLS(ctx, spec.TunnelToken, pm, hostPorts[offset+i]) {
+			ps.TLSPort = pm.TLSPort
+		}
+		portSpecs = append(portSpecs, ps)
 	}
 
 	proxies := frpc.BuildInstanceProxies(spec.TunnelToken, hostPorts, sshRemote, spec.SSHEnabled, portSpecs)
-	if err := h.frpc.UpdateInstanceProxies(proxies); err != nil {
-		h.logger.Error("frpc proxy update failed", "err", err)
+	if spec.VNC != nil {
+		proxies = append(proxies, vncProxy(spec.VNC))
 	}
 
-	h.saveState(spec, portMap, allocated)
+	// Persist the proxy mapping before touching frpc so that a crash in
+	// between leaves a record for the startup reconciliation to act on.
+	h.saveState(spec, portMap, allocated, proxies...)
+	_, span := tracing.Start(ctx, "frpc.update", attribute.Int("proxies", len(proxies)))
+	err := h.tunnel.SetInstanceProxies(proxies)
+	tracing.End(span, err)
+	if err != nil {
+		h.logger.Error("tunnel proxy update failed", "err", err)
+	}
+	h.finishProvisioning(job, domain.StageRunning, "", nil)
+	h.clearCreateJob(job.ID)
+
 	h.logger.Info("instance running", "vm_id", h.vm.VMID(), "ports", portMap)
+	h.emitRunning(job, portMap)
 }
 
-func (h *Handler) saveState(spec domain.InstanceSpec, portMap domain.InstancePorts, allocated []int) {
+func (h *Handler) emitCreating(job *createJob, ports map[string]string) {
+	h.emit(domain.EventInstanceCreating, domain.SeverityInfo, "instance create accepted",
+		map[string]any{"job_id": job.ID, "ports": ports})
+}
+
+func (h *Handler) emitRunning(job *createJob, portMap domain.InstancePorts) {
+	h.emit(domain.EventInstanceRunning, domain.SeverityInfo, "instance is running",
+		map[string]any{"job_id": job.ID, "vm_id": h.vm.VMID(), "ports": portMap})
+}
+
+// startTLS brings up the TLS terminator for an HTTP port. On failure the
+// port is published over plain HTTP so the instance stays reachable.
+func (h *Handler) startTLS(ctx context.Context, tunnelToken string, pm domain.PortMapping, target int) bool {
+	ep := domain.TLSEndpoint{
+		Domain:     frpc.HTTPDomain(tunnelToken, pm.RemotePort) + frpc.DomainSuffix,
+		ListenPort: pm.TLSPort,
+		TargetPort: target,
+	}
+	if err := h.tls.Start(ctx, ep); err != nil {
+		h.logger.Error("tls termination unavailable, publishing plain http",
+			"guest_port", pm.GuestPort, "domain", ep.Domain, "err", err)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) createFailed(job *createJob, err error, allocated []int) {
+	h.logger.Error("instance creation failed", "job_id", job.ID, "err", err)
+	h.clearCreateJob(job.ID)
+	h.ports.Release(allocated...)
+	h.endCreate(job)
+	h.reservations.Restore(job.claimed)
+
+	var errAlreadyRunning domain.ErrInstanceAlreadyRunning
+	if !errors.As(err, &errAlreadyRunning) {
+		h.vm.MarkFailed(domain.ReasonCreateFailed)
+	}
+
+	reason := h.failureReason()
+	h.finishProvisioning(job, domain.StageFailed, reason, err)
+	data := map[string]any{"job_id": job.ID, "reason": reason, "error": err.Error()}
+	var ce *createError
+	if errors.As(err, &ce) {
+		data["attempts"] = ce.Attempts
+	}
+	h.emit(domain.EventInstanceFailed, domain.SeverityWarning, "instance creation failed: "+err.Error(), data)
+	if h.vm.VMID() == "" {
+		h.setLabels(nil)
+	}
+}
+
+// failureReason is the reason the manager recorded for a failed create, such
+// as an SSH timeout, or ReasonCreateFailed when it has none.
+func (h *Handler) failureReason() domain.StatusReason {
+	if st := h.vm.Status(context.Background()); st.Status == domain.StatusFailed && st.Reason != "" {
+		return st.Reason
+	}
+	return domain.ReasonCreateFailed
+}
+
+func (h *Handler) saveState(spec domain.InstanceSpec, portMap domain.InstancePorts, allocated []int, proxies ...frpc.Proxy) {
 	state := &domain.InstanceState{
 		VMID:           h.vm.VMID(),
 		Ports:          portMap,
 		SSHEnabled:     spec.SSHEnabled,
-		GPUAddr:        spec.GPUAddr,
+		GPUAddrs:       spec.GPUAddrs,
 		TunnelToken:    spec.TunnelToken,
 		AllocatedPorts: allocated,
+		SecureWipe:     spec.SecureWipe,
+		ExpiresAt:      spec.ExpiresAt,
+		Volumes:        volumeNames(spec.Volumes),
+		SecureBoot:     spec.SecureBoot,
+		Labels:         spec.Labels,
+		VM:             h.vm.Handoff(),
+	}
+	for _, p := range proxies {
+		state.Proxies = append(state.Proxies, p.Mapping())
+	}
+	if h.tls != nil {
+		state.TLSEndpoints = h.tls.Endpoints()
 	}
 	if err := h.store.SaveInstanceState(state); err != nil {
 		h.logger.Error("failed to save instance state", "err", err)
@@ -309,11 +818,32 @@ func (h *Handler) saveState(spec domain.InstanceSpec, portMap domain.InstancePor
 // ---------------------------------------------------------------------------
 
 func (h *Handler) GetInstance(c *gin.Context) {
-	status := h.vm.Status(c.Request.Context())
-	c.JSON(http.StatusOK, gin.H{
-		"ok":   true,
-		"data": gin.H{"status": string(status)},
-	})
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": h.instanceStatus(c.Request.Context())})
+}
+
+func (h *Handler) instanceStatus(ctx context.Context) instanceResponse {
+	status := h.vm.Status(ctx)
+	var (
+		expiresAt  *time.Time
+		secureBoot bool
+	)
+	if state, _ := h.store.LoadInstanceState(); state != nil {
+		expiresAt = state.ExpiresAt
+		secureBoot = state.SecureBoot
+	}
+	return instanceResponse{
+		Status:          status.Status,
+		Reason:          status.Reason,
+		Since:           status.Since,
+		AllowedCommands: domain.AllowedCommands(status.Status),
+		Job:             h.currentJob(),
+		Provisioning:    h.currentProvisioning(),
+		Tunnel:          tunnel.InstanceHealth(h.tunnel),
+		ExpiresAt:       expiresAt,
+		GPUs:            h.vm.AttachedGPUs(),
+		SecureBoot:      secureBoot,
+		Labels:          h.currentLabels(),
+	}
 }
 
 type manageInstanceRequest struct {
@@ -327,8 +857,11 @@ func (h *Handler) ManageInstance(c *gin.Context) {
 		return
 	}
 
-	cmd := domain.InstanceCommand(req.Command)
-	if err := h.vm.Manage(c.Request.Context(), cmd); err != nil {
+	h.manageInstance(c.Request.Context(), domain.InstanceCommand(req.Command)).respond(c)
+}
+
+func (h *Handler) manageInstance(ctx context.Context, cmd domain.InstanceCommand) opResult {
+	if err := h.vm.Manage(ctx, cmd); err != nil {
 		code := http.StatusInternalServerError
 		var errNoInstanceRunning domain.ErrNoInstanceRunning
 		if errors.As(err, &errNoInstanceRunning) {
@@ -338,30 +871,120 @@ func (h *Handler) ManageInstance(c *gin.Context) {
 		if errors.As(err, &errUnknownCommand) {
 			code = http.StatusBadRequest
 		}
-		c.JSON(code, gin.H{"ok": false, "error": err.Error()})
+		var errCommandNotAllowed domain.ErrCommandNotAllowed
+		if errors.As(err, &errCommandNotAllowed) {
+			code = http.StatusConflict
+		}
+		return opResult{code: code, err: err}
+	}
+	return opResult{code: http.StatusOK}
+}
+
+type updateInstanceRequest struct {
+	StorageGB int `json:"storage_gb" binding:"required,min=1"`
+}
+
+// resizeTimeout bounds the disk grow including the guest filesystem resize.
+const resizeTimeout = 5 * time.Minute
+
+// UpdateInstance grows the disk of the running instance. Disks never shrink.
+func (h *Handler) UpdateInstance(c *gin.Context) {
+	var req updateInstanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	h.resizeInstance(c.Request.Context(), req.StorageGB).respond(c)
 }
 
+func (h *Handler) resizeInstance(ctx context.Context, sizeGB int) opResult {
+	ctx, cancel := context.WithTimeout(ctx, resizeTimeout)
+	defer cancel()
+
+	if err := h.vm.ResizeDisk(ctx, sizeGB); err != nil {
+		code := http.StatusInternalServerError
+		var errNoInstanceRunning domain.ErrNoInstanceRunning
+		if errors.As(err, &errNoInstanceRunning) {
+			code = http.StatusNotFound
+		}
+		var errDiskShrink domain.ErrDiskShrink
+		if errors.As(err, &errDiskShrink) {
+			code = http.StatusBadRequest
+		}
+		var errCommandNotAllowed domain.ErrCommandNotAllowed
+		if errors.As(err, &errCommandNotAllowed) {
+			code = http.StatusConflict
+		}
+		return opResult{code: code, err: err}
+	}
+	return opResult{code: http.StatusOK, data: resizeResponse{StorageGB: sizeGB}}
+}
+
+// secureWipeTimeout bounds how long a synchronous delete may take while the
+// instance disks are being overwritten.
+const secureWipeTimeout = 30 * time.Minute
+
 func (h *Handler) DeleteInstance(c *gin.Context) {
+	// A secure wipe is only reported once it has finished, so the delete may
+	// be handled synchronously and needs an extended write deadline.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(secureWipeTimeout))
+	h.deleteInstance(c.Query("secure_wipe") == "true", false).respond(c)
+}
+
+// deleteInstance destroys the instance. A secure wipe is always waited for;
+// otherwise the instance is destroyed in the background unless wait is set.
+func (h *Handler) deleteInstance(forceWipe, wait bool) opResult {
+	// The guard is held until the VM is gone, including a background destroy.
+	if err := h.lifecycle.acquire("delete"); err != nil {
+		return opResult{code: http.StatusConflict, err: err}
+	}
+
 	state, _ := h.store.LoadInstanceState()
+	wipe := forceWipe || h.vm.SecureWipe() || (state != nil && state.SecureWipe)
 
 	h.vm.Invalidate()
 
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	if !wipe {
+		if wait {
+			h.destroyInstance(state, false)
+			h.lifecycle.release()
+		} else {
+			crash.Go("delete", func() {
+				defer h.lifecycle.release()
+				h.destroyInstance(state, false)
+			})
+		}
+		return opResult{code: http.StatusOK}
+	}
 
-	go h.destroyInstance(state)
+	defer h.lifecycle.release()
+	report := h.destroyInstance(state, forceWipe)
+	if report == nil {
+		return opResult{code: http.StatusOK, data: deleteInstanceResponse{}}
+	}
+	if report.Error != "" {
+		return opResult{
+			code: http.StatusInternalServerError,
+			data: deleteInstanceResponse{Wipe: report},
+			err:  errors.New("secure wipe incomplete: " + report.Error),
+		}
+	}
+	return opResult{code: http.StatusOK, data: deleteInstanceResponse{Wipe: report}}
 }
 
-func (h *Handler) destroyInstance(state *domain.InstanceState) {
-	if err := h.vm.Stop(context.Background()); err != nil {
+func (h *Handler) destroyInstance(state *domain.InstanceState, forceWipe bool) *domain.WipeReport {
+	vmID := h.vm.VMID()
+	report, err := h.vm.Destroy(context.Background(), forceWipe)
+	if err != nil {
 		h.logger.Error("failed to stop instance", "err", err)
 	}
 
-	if err := h.frpc.ClearInstanceProxies(); err != nil {
-		h.logger.Error("failed to clear frpc proxies", "err", err)
+	if err := h.tunnel.ClearInstanceProxies(); err != nil {
+		h.logger.Error("failed to clear tunnel proxies", "err", err)
+	}
+	if h.tls != nil {
+		h.tls.StopAll()
 	}
 
 	if state != nil && len(state.AllocatedPorts) > 0 {
@@ -371,8 +994,17 @@ func (h *Handler) destroyInstance(state *domain.InstanceState) {
 	if err := h.store.ClearInstanceState(); err != nil {
 		h.logger.Error("failed to clear instance state", "err", err)
 	}
+	h.clearProvisioning()
+	h.endCreate(nil)
 
 	h.logger.Info("instance destroyed")
+	data := map[string]any{"vm_id": vmID}
+	if report != nil {
+		data["wipe"] = report
+	}
+	h.emit(domain.EventInstanceDestroyed, domain.SeverityInfo, "instance destroyed", data)
+	h.setLabels(nil)
+	return report
 }
 
 // ---------------------------------------------------------------------------
@@ -409,3 +1041,139 @@ func (h *Handler) RemoveSSH(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
+
+// ---------------------------------------------------------------------------
+// GPU reservations
+// ---------------------------------------------------------------------------
+
+func (h *Handler) ListGPUs(c *gin.Context) {
+	attached := h.vm.AttachedGPUs()
+	gpus := make([]gpuInfo, 0)
+	for _, addr := range h.vm.GPUAddrs() {
+		item := gpuInfo{GPUAddr: addr, InUse: slices.Contains(attached, addr)}
+		if res, ok := h.reservations.Active(addr); ok {
+			item.ReservedUntil = &res.ExpiresAt
+		}
+		gpus = append(gpus, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": gpuListResponse{GPUs: gpus, PowerCapW: h.vm.PowerCap()}})
+}
+
+type reserveGPURequest struct {
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+func (h *Handler) ReserveGPU(c *gin.Context) {
+	var req reserveGPURequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+			return
+		}
+	}
+
+	addr := c.Param("addr")
+	if !h.hasGPU(addr) {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": "unknown gpu: " + addr})
+		return
+	}
+	if slices.Contains(h.vm.AttachedGPUs(), addr) {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "gpu is in use by a running instance"})
+		return
+	}
+
+	res, err := h.reservations.Reserve(addr, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	h.logger.Info("gpu reserved", "addr", addr, "reservation_id", res.ID, "expires_at", res.ExpiresAt)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": res})
+}
+
+type releaseGPURequest struct {
+	ReservationID string `json:"reservation_id" binding:"required"`
+}
+
+func (h *Handler) ReleaseGPU(c *gin.Context) {
+	var req releaseGPURequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if !h.reservations.Release(c.Param("addr"), req.ReservationID) {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": "reservation not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+type powerCapRequest struct {
+	// Watts is split evenly over the instance's GPUs; 0 restores their
+	// default limits.
+	Watts int `json:"watts" binding:"min=0"`
+}
+
+// SetPowerCap applies a GPU power cap to the running instance and keeps it
+// for later instances and agent restarts.
+func (h *Handler) SetPowerCap(c *gin.Context) {
+	var req powerCapRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if err := h.vm.SetPowerCap(c.Request.Context(), req.Watts); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	pc := domain.PowerCap{Watts: req.Watts, UpdatedAt: time.Now().UTC()}
+	if err := h.store.SavePowerCap(&pc); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": pc})
+}
+
+func (h *Handler) hasGPU(addr string) bool {
+	return slices.Contains(h.vm.GPUAddrs(), addr)
+}
+
+// selectGPUs resolves the GPUs a create asks for: the listed addresses, or
+// gpu_count of the host GPUs, taking those free of other reservations first.
+// It returns nil when the create takes all of them.
+func (h *Handler) selectGPUs(req createInstanceRequest) ([]string, error) {
+	all := h.vm.GPUAddrs()
+	if len(req.GPUAddrs) > 0 {
+		if req.GPUCount != 0 && req.GPUCount != len(req.GPUAddrs) {
+			return nil, fmt.Errorf("gpu_count %d does not match the %d gpu_addrs", req.GPUCount, len(req.GPUAddrs))
+		}
+		seen := make(map[string]bool, len(req.GPUAddrs))
+		for _, addr := range req.GPUAddrs {
+			if !slices.Contains(all, addr) {
+				return nil, errors.New("unknown gpu: " + addr)
+			}
+			if seen[addr] {
+				return nil, errors.New("gpu listed twice: " + addr)
+			}
+			seen[addr] = true
+		}
+		return req.GPUAddrs, nil
+	}
+	if req.GPUCount == 0 {
+		return nil, nil
+	}
+	if req.GPUCount > len(all) {
+		return nil, fmt.Errorf("gpu_count %d exceeds the %d GPUs on this host", req.GPUCount, len(all))
+	}
+
+	var free, held []string
+	for _, addr := range all {
+		if res, ok := h.reservations.Active(addr); ok && res.ID != req.ReservationID {
+			held = append(held, addr)
+		} else {
+			free = append(free, addr)
+		}
+	}
+	return append(free, held...)[:req.GPUCount], nil
+}
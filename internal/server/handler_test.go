@@ -0,0 +1,36 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCreateRequestLogOmitsSecrets(t *testing.T) {
+	body := `{
+		"tunnel_token": "tt-tunnel-secret",
+		"image": "ghcr.io/acme/app",
+		"registry": "ghcr.io",
+		"login": "acme",
+		"password": "registry-secret",
+		"env_variables": {"HF_TOKEN": "env-secret"},
+		"disk_key": "ZGlzay1rZXktc2VjcmV0LWJ5dGVz"
+	}`
+	var req createInstanceRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	slog.New(slog.NewJSONHandler(&out, nil)).Info("CreateInstance request", req.logAttrs()...)
+	for _, secret := range []string{"tunnel-secret", "registry-secret", "env-secret", req.DiskKey} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("log contains %q: %s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "ghcr.io/acme/app") {
+		t.Errorf("log lacks the image: %s", out.String())
+	}
+}
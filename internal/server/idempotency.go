@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// idempotencyHeader carries the key that makes retrying a create safe: a
+// create repeated with the same key gets the outcome of the first one.
+const idempotencyHeader = "Idempotency-Key"
+
+const (
+	// idempotencyTTL is how long the outcome of a keyed create is kept.
+	idempotencyTTL = 24 * time.Hour
+	// maxIdempotencyRecords bounds the stored outcomes; the oldest go first.
+	maxIdempotencyRecords = 100
+	maxIdempotencyKeyLen  = 255
+)
+
+var errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// idempotencyKey is the header key, or else the instance_id of the body.
+func (r createInstanceRequest) idempotencyKey() string {
+	if r.headerKey != "" {
+		return r.headerKey
+	}
+	return r.InstanceID
+}
+
+// fingerprint hashes the request so that a retry can be told apart from a
+// different request sent with the same key. The key itself is left out, as
+// it may come from either the header or the body.
+func (r createInstanceRequest) fingerprint() string {
+	r.InstanceID = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// replayCreate returns the recorded outcome of the create sent with key.
+// The caller must hold the create lifecycle guard.
+func (h *Handler) replayCreate(key, hash string) (opResult, bool) {
+	for _, rec := range h.idempotencyRecords() {
+		if rec.Key != key {
+			continue
+		}
+		if rec.RequestHash != hash {
+			return opResult{code: http.StatusUnprocessableEntity, err: errIdempotencyKeyReused}, true
+		}
+		h.logger.Info("replaying idempotent create", "key", key, "job_id", rec.JobID)
+		if rec.Error != "" {
+			return opResult{code: rec.Code, err: errors.New(rec.Error)}, true
+		}
+		return opResult{code: rec.Code, data: createInstanceResponse{JobID: rec.JobID, Ports: rec.Ports, Credentials: rec.Credentials}}, true
+	}
+	return opResult{}, false
+}
+
+// recordCreate stores the outcome r of the create sent with key. Conflicts
+// and server errors are not stored, so a retry can still succeed once the
+// cause is gone. The caller must hold the create lifecycle guard.
+func (h *Handler) recordCreate(key, hash string, r opResult) {
+	if r.code == http.StatusConflict || r.code >= http.StatusInternalServerError {
+		return
+	}
+	rec := domain.IdempotencyRecord{Key: key, RequestHash: hash, Code: r.code, CreatedAt: time.Now().UTC()}
+	if r.err != nil {
+		rec.Error = r.err.Error()
+	}
+	if data, ok := r.data.(createInstanceResponse); ok {
+		rec.JobID, rec.Ports = data.JobID, data.Ports
+		// A password in clear is handed out once and never stored; a
+		// sealed one is only readable by the control plane.
+		if data.Credentials != nil && data.Credentials.SealedPassword != "" {
+			rec.Credentials = data.Credentials
+		}
+	}
+
+	records := append(h.idempotencyRecords(), rec)
+	if over := len(records) - maxIdempotencyRecords; over > 0 {
+		records = records[over:]
+	}
+	if err := h.store.SaveIdempotencyRecords(records); err != nil {
+		h.logger.Error("failed to persist idempotency key", "key", key, "err", err)
+	}
+}
+
+// idempotencyRecords loads the stored outcomes that have not expired.
+func (h *Handler) idempotencyRecords() []domain.IdempotencyRecord {
+	records, err := h.store.LoadIdempotencyRecords()
+	if err != nil {
+		h.logger.Warn("dropping unreadable idempotency records", "err", err)
+		return nil
+	}
+	cutoff := time.Now().Add(-idempotencyTTL)
+	live := records[:0]
+	for _, rec := range records {
+		if !rec.CreatedAt.After(cutoff) {
+			continue
+		}
+		// Records written before passwords stopped being stored in clear
+		// lose them on the next save.
+		if rec.Credentials != nil && rec.Credentials.SealedPassword == "" {
+			rec.Credentials = nil
+		}
+		live = append(live, rec)
+	}
+	return live
+}
@@ -0,0 +1,36 @@
+package server
+
+import "github.com/qudata/agent/internal/domain"
+
+// WhileIdle runs fn unless a create, delete, migration or update is in
+// flight, and holds creates and deletes off until fn returns. It reports
+// whether fn ran; a caller that found the instance busy tries again later.
+func (s *Server) WhileIdle(fn func()) bool {
+	h := s.handler
+	if err := h.lifecycle.acquire("reconcile"); err != nil {
+		return false
+	}
+	defer h.lifecycle.release()
+
+	h.jobMu.Lock()
+	busy, job := h.updating, h.job != nil
+	h.jobMu.Unlock()
+	if job {
+		// The job keeps the VM slot for the life of the instance; it is
+		// only in flight until the create has an outcome.
+		p := h.currentProvisioning()
+		if p == nil || (p.Stage != domain.StageRunning && p.Stage != domain.StageFailed) {
+			busy = true
+		}
+	}
+	h.migMu.Lock()
+	if h.migration != nil && h.migration.FinishedAt == nil {
+		busy = true
+	}
+	h.migMu.Unlock()
+	if busy {
+		return false
+	}
+	fn()
+	return true
+}
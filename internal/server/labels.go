@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+const (
+	maxLabels          = 32
+	maxLabelValueBytes = 256
+)
+
+// labelKeyRe keeps label keys usable as environment variable names in the
+// guest once dots and dashes are replaced.
+var labelKeyRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,62}$`)
+
+// checkLabels validates the labels of a create.
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("labels: at most %d are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("labels: invalid key %q: letters, digits, '_', '.' and '-', starting with a letter, at most 63", k)
+		}
+		if len(v) > maxLabelValueBytes {
+			return fmt.Errorf("labels: value of %q is longer than %d bytes", k, maxLabelValueBytes)
+		}
+		for _, r := range v {
+			if unicode.IsControl(r) {
+				return fmt.Errorf("labels: value of %q contains control characters", k)
+			}
+		}
+	}
+	return nil
+}
+
+// Labels returns the labels of the instance being created or running, or
+// nil.
+func (s *Server) Labels() map[string]string {
+	return s.handler.currentLabels()
+}
+
+func (h *Handler) currentLabels() map[string]string {
+	h.labelsMu.Lock()
+	defer h.labelsMu.Unlock()
+	return h.labels
+}
+
+// setLabels replaces the labels of the instance. The map is not modified
+// afterwards, so it is handed out without copying.
+func (h *Handler) setLabels(labels map[string]string) {
+	h.labelsMu.Lock()
+	defer h.labelsMu.Unlock()
+	h.labels = labels
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// ListenConfig selects where the agent API accepts connections.
+type ListenConfig struct {
+	// Addr is the host:port of the TCP listener. Empty disables it.
+	Addr string
+	// UnixSocket is an optional Unix socket path served in addition to Addr.
+	UnixSocket string
+	// Listeners are pre-opened listeners, e.g. from systemd socket activation.
+	Listeners []net.Listener
+	// TLS, when set, serves the TCP listeners over TLS. The Unix socket is
+	// local and stays plain.
+	TLS *tls.Config
+	// GRPCAddr is the host:port of the gRPC API. Empty disables it.
+	GRPCAddr string
+}
+
+// ActivationListeners returns the listeners passed by systemd socket
+// activation (sd_listen_fds), or nil when the process was not socket-activated.
+// The LISTEN_* variables are cleared so that child processes do not inherit them.
+func ActivationListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// HandoffEnv carries the descriptors of listeners inherited from the agent
+// process that re-exec'd into this one, as a comma-separated list.
+const HandoffEnv = "QUDATA_LISTEN_FDS"
+
+// HandoffListeners returns the listeners passed down by a self-update
+// re-exec, or nil. HandoffEnv is cleared like the socket activation variables.
+func HandoffListeners() ([]net.Listener, error) {
+	raw := os.Getenv(HandoffEnv)
+	os.Unsetenv(HandoffEnv)
+	if raw == "" {
+		return nil, nil
+	}
+
+	var listeners []net.Listener
+	for _, s := range strings.Split(raw, ",") {
+		fd, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || fd < 0 {
+			continue
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "HANDOFF_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("handoff fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// TCPPort returns the port of the first TCP listener in ls, or 0.
+func TCPPort(ls []net.Listener) int {
+	for _, l := range ls {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 0
+}
+
+func (lc ListenConfig) open() ([]net.Listener, error) {
+	listeners := append([]net.Listener(nil), lc.Listeners...)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	if lc.Addr != "" {
+		l, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listen %s: %w", lc.Addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if lc.UnixSocket != "" {
+		if err := os.MkdirAll(filepath.Dir(lc.UnixSocket), 0o755); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("create socket dir: %w", err)
+		}
+		_ = os.Remove(lc.UnixSocket)
+		l, err := net.Listen("unix", lc.UnixSocket)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listen unix %s: %w", lc.UnixSocket, err)
+		}
+		if err := os.Chmod(lc.UnixSocket, 0o660); err != nil {
+			l.Close()
+			closeAll()
+			return nil, fmt.Errorf("chmod %s: %w", lc.UnixSocket, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners configured")
+	}
+	return listeners, nil
+}
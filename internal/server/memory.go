@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/system"
+)
+
+// qemuMemoryOverhead is what QEMU takes besides guest RAM: device
+// emulation, firmware and the VFIO mappings. Page tables add 1/64 of the
+// guest RAM on top.
+const qemuMemoryOverhead = 512 << 20
+
+// SetMemory enables the memory admission check. defaultMemory is the guest
+// memory of creates that give none and reserveMB the host memory every
+// create must leave available.
+//
+// The host cannot overcommit: VFIO pins all guest RAM when QEMU starts, so
+// a guest that does not fit makes the kernel OOM-kill something instead.
+func (s *Server) SetMemory(defaultMemory string, reserveMB int) {
+	s.handler.memCheck = true
+	s.handler.memDefault = defaultMemory
+	s.handler.memReserve = uint64(reserveMB) << 20
+}
+
+// memoryFits refuses a create whose guest memory, with QEMU's overhead and
+// the host reserve, exceeds the memory available. Huge pages are checked
+// against the pool when the flavor is applied.
+func (h *Handler) memoryFits(req createInstanceRequest) opResult {
+	if !h.memCheck || (req.flavor != nil && req.flavor.Hugepages) {
+		return opResult{}
+	}
+	memory := req.Memory
+	if memory == "" {
+		memory = h.memDefault
+	}
+	size, err := parseMemorySize(memory)
+	if err != nil {
+		return opResult{code: http.StatusBadRequest, err: err}
+	}
+	mem, err := system.ReadMemory()
+	if err != nil {
+		return opResult{}
+	}
+	need := size + size/64 + qemuMemoryOverhead + h.memReserve
+	if mem.AvailableBytes < need {
+		return opResult{code: http.StatusConflict, err: fmt.Errorf("memory %s needs %dMB with QEMU overhead and the host reserve, %dMB available",
+			memory, need>>20, mem.AvailableBytes>>20)}
+	}
+	return opResult{}
+}
+
+// parseMemorySize parses a QEMU -m size: a number with an optional K, M, G
+// or T suffix, in MiB without one.
+func parseMemorySize(s string) (uint64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	shift := 20
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if v[len(v)-1] > '9' {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || n == 0 || n > 1<<(64-shift)-1 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n << shift, nil
+}
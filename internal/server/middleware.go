@@ -7,18 +7,52 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/crash"
+	"github.com/qudata/agent/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// AuthMiddleware validates the X-Agent-Secret header against the expected secret.
-func AuthMiddleware(secret string) gin.HandlerFunc {
+// AuthMiddleware accepts a request signed with the agent secret or, unless
+// signedOnly is set, the X-Agent-Secret header itself. Signed URLs issued by
+// POST /instances/urls are accepted on signedPaths.
+func AuthMiddleware(secret string, signedOnly bool, signer *urlSigner, verifier *requestVerifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// /ping is public and does not require auth
-		if c.Request.URL.Path == "/ping" {
+		if publicPaths[routePath(c.Request.URL.Path)] {
+			c.Next()
+			return
+		}
+
+		if signed(c.Request) {
+			if err := verifier.verify(c.Request); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"ok":    false,
+					"error": err.Error(),
+				})
+				return
+			}
 			c.Next()
 			return
 		}
 
 		provided := c.GetHeader("X-Agent-Secret")
+		if provided == "" && c.Query("sig") != "" &&
+			c.Request.Method == http.MethodGet && signedPaths[routePath(c.Request.URL.Path)] {
+			if err := signer.verify(c.Request); err != nil {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"ok":    false,
+					"error": err.Error(),
+				})
+				return
+			}
+			c.Set(signedRequestKey, true)
+			c.Next()
+			return
+		}
+
 		if provided == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"ok":    false,
@@ -27,6 +61,14 @@ func AuthMiddleware(secret string) gin.HandlerFunc {
 			return
 		}
 
+		if signedOnly {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"ok":    false,
+				"error": "request signature required",
+			})
+			return
+		}
+
 		if subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) != 1 {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 				"ok":    false,
@@ -39,6 +81,27 @@ func AuthMiddleware(secret string) gin.HandlerFunc {
 	}
 }
 
+// ClientCertMiddleware requires a client certificate verified against the
+// control plane CA. /ping and signed URLs, which are opened by browsers,
+// stay reachable without one, as does the local Unix socket, which is not
+// served over TLS.
+func ClientCertMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if publicPaths[routePath(c.Request.URL.Path)] || c.GetBool(signedRequestKey) || c.Request.TLS == nil {
+			c.Next()
+			return
+		}
+		if len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"ok":    false,
+				"error": "client certificate required",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
 // LoggingMiddleware logs each request with duration and status.
 func LoggingMiddleware(logger *slog.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -57,15 +120,41 @@ func LoggingMiddleware(logger *slog.Logger) gin.HandlerFunc {
 	}
 }
 
-// RecoveryMiddleware catches panics and returns a 500 error.
-func RecoveryMiddleware(logger *slog.Logger) gin.HandlerFunc {
+// TracingMiddleware continues the trace in the request's traceparent
+// header, or starts one, with a server span for the request.
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracing.Tracer().Start(ctx, c.Request.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("url.path", c.Request.URL.Path),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if route := c.FullPath(); route != "" {
+			span.SetName(c.Request.Method + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// RecoveryMiddleware catches panics, reports them as crashes and returns a
+// 500 error.
+func RecoveryMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer func() {
 			if r := recover(); r != nil {
-				logger.Error("panic recovered",
-					"error", r,
-					"path", c.Request.URL.Path,
-				)
+				crash.Handle("http "+c.Request.Method+" "+c.FullPath(), r)
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
 					"ok":    false,
 					"error": "internal server error",
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	migrationTimeout        = 2 * time.Hour
+	migrationManifestVer    = 1
+	bundleManifest          = "manifest.json"
+	bundleDisk              = "disk.qcow2"
+	bundleOVMFVars          = "ovmf_vars.fd"
+	bundleState             = "state.bin"
+	migrationSecretHeader   = "X-Agent-Secret"
+	migrationContentType    = "application/x-tar"
+	migrationErrBodyMaxSize = 4096
+)
+
+type exportRequest struct {
+	// TargetURL is the base URL of the receiving agent.
+	TargetURL string `json:"target_url" binding:"required"`
+	// TargetSecret authenticates against the receiving agent.
+	TargetSecret string `json:"target_secret" binding:"required"`
+}
+
+// ExportInstance pauses the instance and streams it to another agent's
+// POST /instances/ingest. The transfer runs in the background; progress is
+// reported by GET /instances/migration. The source instance stays paused
+// until the control plane deletes it, or resumes if the transfer fails.
+func (h *Handler) ExportInstance(c *gin.Context) {
+	var req exportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	state, _ := h.store.LoadInstanceState()
+	if state == nil || h.vm.VMID() == "" {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": domain.ErrNoInstanceRunning{}.Error()})
+		return
+	}
+	if len(state.Volumes) > 0 {
+		// Volumes stay on this host; the target could not attach them.
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "instances with volumes attached cannot be migrated"})
+		return
+	}
+
+	h.migMu.Lock()
+	if cur := h.migration; cur != nil && cur.FinishedAt == nil {
+		h.migMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "migration already in progress", "data": cur})
+		return
+	}
+	mig := &domain.MigrationStatus{
+		ID:        uuid.New().String(),
+		Phase:     domain.MigrationPreparing,
+		Target:    req.TargetURL,
+		StartedAt: time.Now().UTC(),
+	}
+	h.migration = mig
+	h.migBytes.Store(0)
+	snapshot := *mig
+	h.migMu.Unlock()
+
+	go h.runExport(req, state)
+
+	c.JSON(http.StatusAccepted, gin.H{"ok": true, "data": snapshot})
+}
+
+// GetMigration returns the status of the last export.
+func (h *Handler) GetMigration(c *gin.Context) {
+	h.migMu.Lock()
+	defer h.migMu.Unlock()
+	if h.migration == nil {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": "no migration"})
+		return
+	}
+	status := *h.migration
+	status.BytesSent = h.migBytes.Load()
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": status})
+}
+
+func (h *Handler) runExport(req exportRequest, state *domain.InstanceState) {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	bundle, err := h.vm.Export(ctx)
+	if err != nil {
+		h.finishMigration(err)
+		return
+	}
+	h.updateMigration(func(m *domain.MigrationStatus) {
+		m.Phase = domain.MigrationTransferring
+		m.Mode = bundle.Mode
+	})
+
+	manifest := domain.MigrationManifest{
+		Version:       migrationManifestVer,
+		Mode:          bundle.Mode,
+		SSHEnabled:    state.SSHEnabled,
+		TunnelToken:   state.TunnelToken,
+		CPUs:          bundle.CPUs,
+		Memory:        bundle.Memory,
+		DiskSizeGB:    bundle.DiskSizeGB,
+		SecureWipe:    state.SecureWipe,
+		BaseImageSize: bundle.BaseImageSize,
+		BandwidthMbps: bundle.BandwidthMbps,
+		TLS:           len(state.TLSEndpoints) > 0,
+		SecureBoot:    bundle.SecureBoot,
+		Nested:        bundle.Nested,
+		ExpiresAt:     state.ExpiresAt,
+		Labels:        state.Labels,
+	}
+	for guest := range state.Ports {
+		manifest.Ports = append(manifest.Ports, guest)
+	}
+	sort.Strings(manifest.Ports)
+
+	err = h.sendBundle(ctx, req, manifest, bundle)
+	if bundle.StatePath != "" {
+		_ = os.Remove(bundle.StatePath)
+	}
+	if err != nil {
+		if rerr := h.vm.ResumeExport(); rerr != nil {
+			h.logger.Error("failed to resume instance after aborted export", "err", rerr)
+		}
+	}
+	h.finishMigration(err)
+}
+
+func (h *Handler) sendBundle(ctx context.Context, req exportRequest, manifest domain.MigrationManifest, bundle *domain.ExportBundle) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBundle(&countingWriter{w: pw, n: &h.migBytes}, manifest, bundle))
+	}()
+
+	url := strings.TrimRight(req.TargetURL, "/") + "/instances/ingest"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("create ingest request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", migrationContentType)
+	// The header keeps targets that predate request signing working.
+	httpReq.Header.Set(migrationSecretHeader, req.TargetSecret)
+	if err := signRequest(httpReq, req.TargetSecret, unsignedPayload); err != nil {
+		pr.Close()
+		return fmt.Errorf("sign ingest request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("ingest request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, migrationErrBodyMaxSize))
+		return fmt.Errorf("target returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (h *Handler) updateMigration(fn func(*domain.MigrationStatus)) {
+	h.migMu.Lock()
+	defer h.migMu.Unlock()
+	if h.migration != nil {
+		fn(h.migration)
+	}
+}
+
+func (h *Handler) finishMigration(err error) {
+	h.updateMigration(func(m *domain.MigrationStatus) {
+		now := time.Now().UTC()
+		m.FinishedAt = &now
+		m.BytesSent = h.migBytes.Load()
+		if err != nil {
+			m.Phase = domain.MigrationFailed
+			m.Error = err.Error()
+			h.logger.Error("instance export failed", "migration_id", m.ID, "err", err)
+			return
+		}
+		m.Phase = domain.MigrationCompleted
+		h.logger.Info("instance exported", "migration_id", m.ID, "mode", m.Mode, "bytes", m.BytesSent)
+	})
+}
+
+// IngestInstance receives a bundle streamed by ExportInstance on another host
+// and boots it here like a regular create.
+func (h *Handler) IngestInstance(c *gin.Context) {
+	if err := h.lifecycle.acquire("create"); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	job, err := h.beginCreate()
+	h.lifecycle.release()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error(), "data": gin.H{"job": job}})
+		return
+	}
+
+	// The bundle can take far longer to upload than the server read timeout.
+	_ = http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(migrationTimeout))
+
+	dir, err := h.vm.ImportDir()
+	if err != nil {
+		h.endCreate(job)
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	manifest, src, err := readBundle(c.Request.Body, dir)
+	if err == nil {
+		// The sending agent is trusted no more than a create request.
+		err = checkLabels(manifest.Labels)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		h.endCreate(job)
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	h.logger.Info("migration bundle received", "job_id", job.ID, "mode", manifest.Mode)
+
+	req := createInstanceRequest{
+		TunnelToken:   manifest.TunnelToken,
+		SSHEnabled:    manifest.SSHEnabled,
+		Ports:         manifest.Ports,
+		StorageGB:     manifest.DiskSizeGB,
+		CPUs:          manifest.CPUs,
+		Memory:        manifest.Memory,
+		SecureWipe:    manifest.SecureWipe,
+		BandwidthMbps: manifest.BandwidthMbps,
+		TLS:           manifest.TLS,
+		SecureBoot:    manifest.SecureBoot,
+		Nested:        manifest.Nested,
+		Labels:        manifest.Labels,
+		importFrom:    src,
+		expires:       manifest.ExpiresAt,
+	}
+	h.launch(job, req).respond(c)
+}
+
+func writeBundle(w io.Writer, manifest domain.MigrationManifest, bundle *domain.ExportBundle) error {
+	tw := tar.NewWriter(w)
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0o600, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	files := []struct{ name, path string }{
+		{bundleDisk, bundle.DiskPath},
+		{bundleOVMFVars, bundle.OVMFVarsPath},
+		{bundleState, bundle.StatePath},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := addBundleFile(tw, f.name, f.path); err != nil {
+			return fmt.Errorf("add %s: %w", f.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+func addBundleFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: info.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// readBundle unpacks a migration bundle into dir.
+func readBundle(r io.Reader, dir string) (*domain.MigrationManifest, *domain.ImportSource, error) {
+	var manifest *domain.MigrationManifest
+	src := &domain.ImportSource{Dir: dir}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read bundle: %w", err)
+		}
+
+		switch hdr.Name {
+		case bundleManifest:
+			manifest = &domain.MigrationManifest{}
+			if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("parse manifest: %w", err)
+			}
+			if manifest.Version != migrationManifestVer {
+				return nil, nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+			}
+			continue
+		case bundleDisk, bundleOVMFVars, bundleState:
+		default:
+			return nil, nil, fmt.Errorf("unexpected bundle entry %q", hdr.Name)
+		}
+
+		path := filepath.Join(dir, hdr.Name)
+		if err := writeBundleEntry(path, tr); err != nil {
+			return nil, nil, fmt.Errorf("write %s: %w", hdr.Name, err)
+		}
+		switch hdr.Name {
+		case bundleDisk:
+			src.DiskPath = path
+		case bundleOVMFVars:
+			src.OVMFVarsPath = path
+		case bundleState:
+			src.StatePath = path
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("bundle has no manifest")
+	}
+	if src.DiskPath == "" {
+		return nil, nil, fmt.Errorf("bundle has no disk")
+	}
+	src.BaseImageSize = manifest.BaseImageSize
+	return manifest, src, nil
+}
+
+func writeBundleEntry(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/nettest"
+)
+
+const (
+	defaultNetTestDuration = 10 * time.Second
+	maxNetTestDuration     = 40 * time.Second
+	defaultNetTestMB       = 64
+	maxNetTestMB           = 512
+)
+
+// NetTestFunc runs a bandwidth test and records its result. It is provided
+// by the agent, which knows the FRP server and API endpoints.
+type NetTestFunc func(ctx context.Context, opts nettest.Options) (*domain.NetTestResult, error)
+
+type netTestRequest struct {
+	DurationSeconds int `json:"duration_seconds" binding:"min=0"`
+	MaxMB           int `json:"max_mb" binding:"min=0"`
+}
+
+// SetNetTest installs the runner behind POST /nettest.
+func (s *Server) SetNetTest(fn NetTestFunc) {
+	s.handler.netTest = fn
+}
+
+// NetTest measures latency and throughput to the FRP server and the API.
+// Only one test runs at a time.
+func (h *Handler) NetTest(c *gin.Context) {
+	var req netTestRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if h.netTest == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": "network test is not available"})
+		return
+	}
+
+	opts := nettest.Options{
+		Duration: defaultNetTestDuration,
+		MaxBytes: defaultNetTestMB << 20,
+	}
+	if req.DurationSeconds > 0 {
+		opts.Duration = min(time.Duration(req.DurationSeconds)*time.Second, maxNetTestDuration)
+	}
+	if req.MaxMB > 0 {
+		opts.MaxBytes = int64(min(req.MaxMB, maxNetTestMB)) << 20
+	}
+
+	if !h.netTestMu.TryLock() {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "a network test is already running"})
+		return
+	}
+	defer h.netTestMu.Unlock()
+
+	// Latency probes and request setup come on top of the transfer budget.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(opts.Duration + time.Minute))
+
+	res, err := h.netTest(c.Request.Context(), opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": res})
+}
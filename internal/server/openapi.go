@@ -0,0 +1,345 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPI serves the OpenAPI 3 document generated from the route table and
+// the request and response types.
+func (h *Handler) OpenAPI(c *gin.Context) {
+	h.openAPIOnce.Do(func() {
+		h.openAPIDoc, _ = json.MarshalIndent(buildOpenAPI(h.routes()), "", "  ")
+	})
+	c.Data(http.StatusOK, "application/json", h.openAPIDoc)
+}
+
+func buildOpenAPI(routes []apiRoute) map[string]any {
+	g := &schemaGen{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	paths := map[string]map[string]any{}
+
+	for _, r := range routes {
+		path := openAPIPath(r.Path)
+		op := map[string]any{
+			"summary":     r.Summary,
+			"operationId": operationID(r.Method, r.Path),
+			"responses":   g.responses(r),
+		}
+		if publicPaths[r.Path] {
+			op["security"] = []any{}
+		}
+
+		var params []any
+		for _, seg := range strings.Split(r.Path, "/") {
+			if strings.HasPrefix(seg, ":") {
+				params = append(params, map[string]any{
+					"name": seg[1:], "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"},
+				})
+			}
+		}
+		for _, q := range r.Query {
+			p := map[string]any{"name": q.Name, "in": "query", "schema": map[string]any{"type": q.Type}}
+			if q.Description != "" {
+				p["description"] = q.Description
+			}
+			params = append(params, p)
+		}
+		for _, hd := range r.Headers {
+			params = append(params, map[string]any{
+				"name": hd.Name, "in": "header", "description": hd.Description,
+				"schema": map[string]any{"type": hd.Type},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		switch {
+		case r.Request != nil:
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(r.Request))},
+				},
+			}
+		case r.Content != "" && r.Method != http.MethodGet:
+			schema := map[string]any{"type": "string", "format": "binary"}
+			if r.Content == multipartContentType {
+				schema = map[string]any{
+					"type":       "object",
+					"required":   []string{"file"},
+					"properties": map[string]any{"file": schema},
+				}
+			}
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					r.Content: map[string]any{"schema": schema},
+				},
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(r.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "QuData Agent API",
+			"version": strings.TrimPrefix(apiPrefix, "/"),
+		},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"agentSecret": map[string]any{
+					"type": "apiKey", "in": "header", "name": "X-Agent-Secret",
+				},
+				"requestSignature": map[string]any{
+					"type": "apiKey", "in": "header", "name": signatureHeader,
+					"description": "Hex HMAC-SHA256 keyed with the agent secret over " +
+						"METHOD\\nPATH\\nQUERY\\nTIMESTAMP\\nNONCE\\nSHA256(body), sent with " +
+						timestampHeader + " and " + nonceHeader + ".",
+				},
+			},
+		},
+		"security": []any{
+			map[string]any{"agentSecret": []any{}},
+			map[string]any{"requestSignature": []any{}},
+		},
+	}
+}
+
+func (g *schemaGen) responses(r apiRoute) map[string]any {
+	envelope := func(data any) map[string]any {
+		props := map[string]any{
+			"ok":    map[string]any{"type": "boolean"},
+			"error": map[string]any{"type": "string"},
+		}
+		if data != nil {
+			props["data"] = data
+		}
+		return map[string]any{"type": "object", "required": []string{"ok"}, "properties": props}
+	}
+
+	var ok map[string]any
+	switch {
+	case r.Response != nil:
+		ok = map[string]any{"application/json": map[string]any{"schema": envelope(g.schema(reflect.TypeOf(r.Response)))}}
+	case r.Content != "" && r.Method == http.MethodGet:
+		ok = map[string]any{r.Content: map[string]any{"schema": map[string]any{"type": "string"}}}
+	default:
+		ok = map[string]any{"application/json": map[string]any{"schema": envelope(nil)}}
+	}
+	return map[string]any{
+		"200": map[string]any{"description": "OK", "content": ok},
+		"default": map[string]any{
+			"description": "Error",
+			"content":     map[string]any{"application/json": map[string]any{"schema": envelope(nil)}},
+		},
+	}
+}
+
+// openAPIPath turns gin's :param segments into {param}.
+func openAPIPath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		if strings.HasPrefix(s, ":") {
+			segs[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, s := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == ':' || r == '.' }) {
+		b.WriteString("_" + s)
+	}
+	return b.String()
+}
+
+// schemaGen derives JSON schemas from Go types: json tags name the
+// properties and binding tags give required fields and bounds. Named
+// structs become components.
+type schemaGen struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structRef(t)
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGen) structRef(t reflect.Type) map[string]any {
+	if t.Name() == "" {
+		return g.structSchema(t)
+	}
+	name, ok := g.names[t]
+	if !ok {
+		name = componentName(t)
+		if _, taken := g.schemas[name]; taken {
+			name = componentName(t) + "_" + strings.ReplaceAll(t.PkgPath(), "/", "_")
+		}
+		g.names[t] = name
+		g.schemas[name] = map[string]any{} // placeholder for recursive types
+		g.schemas[name] = g.structSchema(t)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func componentName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.addFields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		s := g.schema(f.Type)
+		if applyBinding(s, f.Type, f.Tag.Get("binding")) {
+			*required = append(*required, name)
+		}
+		props[name] = s
+	}
+}
+
+// applyBinding copies the validator rules that have a schema equivalent
+// into s and reports whether the field is required. Rules after dive apply
+// to elements and are left out.
+func applyBinding(s map[string]any, t reflect.Type, tag string) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		key, val, _ := strings.Cut(rule, "=")
+		switch key {
+		case "dive":
+			return required
+		case "required":
+			required = true
+		case "oneof":
+			s["enum"] = strings.Fields(val)
+		case "min", "max":
+			n, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				continue
+			}
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+				s[key+"Items"] = n
+			case reflect.String:
+				s[key+"Length"] = n
+			default:
+				if key == "min" {
+					s["minimum"] = n
+				} else {
+					s["maximum"] = n
+				}
+			}
+		}
+	}
+	return required
+}
+
+// queryParams lists the form-tagged fields of a query binding struct.
+func queryParams(v any) []apiParam {
+	t := reflect.TypeOf(v)
+	var params []apiParam
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("form"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		typ := "string"
+		switch f.Type.Kind() {
+		case reflect.Bool:
+			typ = "boolean"
+		case reflect.Int, reflect.Int64:
+			typ = "integer"
+		}
+		params = append(params, apiParam{Name: name, Type: typ})
+	}
+	return params
+}
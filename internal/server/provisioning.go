@@ -0,0 +1,101 @@
+package server
+
+import (
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// ReportStage records the stage the VM manager has reached in the running
+// create. It only takes the handler's own lock, so the manager may call it
+// while locked.
+func (s *Server) ReportStage(stage domain.ProvisionStage) {
+	s.handler.advanceStage(stage)
+}
+
+// startProvisioning begins tracking job at StageAllocatingPorts. A create
+// resumed after a restart keeps the stages of its earlier run.
+func (h *Handler) startProvisioning(job *createJob) {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	if h.provisioning == nil || h.provisioning.JobID != job.ID {
+		h.provisioning = &domain.Provisioning{JobID: job.ID, StartedAt: job.StartedAt}
+	}
+	h.enterStageLocked(domain.StageAllocatingPorts)
+}
+
+// advanceStage moves the create in progress to stage. It is ignored once
+// the create has an outcome.
+func (h *Handler) advanceStage(stage domain.ProvisionStage) {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	if p := h.provisioning; p == nil || p.Stage == domain.StageRunning || p.Stage == domain.StageFailed {
+		return
+	}
+	h.enterStageLocked(stage)
+}
+
+// provisionAttempt records that attempt n of job's create is starting.
+func (h *Handler) provisionAttempt(job *createJob, n int) {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	if h.provisioning == nil || h.provisioning.JobID != job.ID {
+		return
+	}
+	h.provisioning.Attempt = n
+	h.saveProvisioningLocked()
+}
+
+// finishProvisioning records the outcome of job's create: StageRunning, or
+// StageFailed with its reason and error.
+func (h *Handler) finishProvisioning(job *createJob, stage domain.ProvisionStage, reason domain.StatusReason, err error) {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	p := h.provisioning
+	if p == nil || p.JobID != job.ID {
+		return
+	}
+	p.Reason = reason
+	if err != nil {
+		p.Error = err.Error()
+	}
+	h.enterStageLocked(stage)
+}
+
+// clearProvisioning forgets the progress of the latest create once its
+// instance is deleted.
+func (h *Handler) clearProvisioning() {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	h.provisioning = nil
+	if err := h.store.ClearProvisioning(); err != nil {
+		h.logger.Error("failed to clear provisioning progress", "err", err)
+	}
+}
+
+// currentProvisioning returns a copy of the progress of the latest create,
+// or nil.
+func (h *Handler) currentProvisioning() *domain.Provisioning {
+	h.provMu.Lock()
+	defer h.provMu.Unlock()
+	if h.provisioning == nil {
+		return nil
+	}
+	p := *h.provisioning
+	p.Stages = append([]domain.StageEntry(nil), p.Stages...)
+	return &p
+}
+
+func (h *Handler) enterStageLocked(stage domain.ProvisionStage) {
+	now := time.Now().UTC()
+	p := h.provisioning
+	p.Stage, p.Since = stage, now
+	p.Stages = append(p.Stages, domain.StageEntry{Stage: stage, At: now})
+	h.saveProvisioningLocked()
+}
+
+func (h *Handler) saveProvisioningLocked() {
+	if err := h.store.SaveProvisioning(h.provisioning); err != nil {
+		h.logger.Warn("failed to persist provisioning progress", "err", err)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// rateSpec is a token bucket: Rate requests per second with bursts of Burst.
+type rateSpec struct {
+	Rate  float64
+	Burst float64
+}
+
+// lifecycleRate limits the routes that create or destroy instances, which
+// take far longer than a request to settle.
+var lifecycleRate = rateSpec{Rate: 0.5, Burst: 3}
+
+// routeRates override the default limit for individual routes.
+var routeRates = map[string]rateSpec{
+	"POST /instances":        lifecycleRate,
+	"DELETE /instances":      lifecycleRate,
+	"POST /instances/batch":  lifecycleRate,
+	"POST /instances/ingest": lifecycleRate,
+	"POST /decommission":     lifecycleRate,
+	"POST /update":           lifecycleRate,
+}
+
+type tokenBucket struct {
+	spec   rateSpec
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token and returns zero, or returns how long until one is
+// available.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens = math.Min(b.spec.Burst, b.tokens+now.Sub(b.last).Seconds()*b.spec.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.spec.Rate * float64(time.Second))
+}
+
+// RateLimitMiddleware keeps one token bucket per route. rate is the default
+// in requests per second, with bursts of twice that; zero disables limiting.
+// A route shares its bucket with its unversioned alias. Public routes stay
+// unlimited for health checks.
+func RateLimitMiddleware(rate float64) gin.HandlerFunc {
+	limiter := newRateLimiter(rate, routeRates)
+	if limiter == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		route := routePath(c.FullPath())
+		if route == "" || publicPaths[route] {
+			c.Next()
+			return
+		}
+		key := c.Request.Method + " " + route
+
+		if wait := limiter.take(key); wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"ok":    false,
+				"error": "rate limit exceeded for " + key,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimiter hands out tokens from one bucket per key.
+type rateLimiter struct {
+	def       rateSpec
+	overrides map[string]rateSpec
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns nil when rate is not positive.
+func newRateLimiter(rate float64, overrides map[string]rateSpec) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		def:       rateSpec{Rate: rate, Burst: math.Max(1, 2*rate)},
+		overrides: overrides,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// take removes a token from the bucket of key and returns zero, or returns
+// how long until one is available.
+func (l *rateLimiter) take(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		spec, ok := l.overrides[key]
+		if !ok {
+			spec = l.def
+		}
+		b = &tokenBucket{spec: spec, tokens: spec.Burst, last: time.Now()}
+		l.buckets[key] = b
+	}
+	return b.take(time.Now())
+}
+
+// lifecycleGuard lets one create or delete run at a time, so a create
+// accepted while a delete is still tearing the old VM down cannot fight it
+// over the GPU and ports.
+type lifecycleGuard struct {
+	mu sync.Mutex
+	op string
+}
+
+func (g *lifecycleGuard) acquire(op string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.op != "" {
+		return domain.ErrLifecycleBusy{Op: g.op}
+	}
+	g.op = op
+	return nil
+}
+
+func (g *lifecycleGuard) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.op = ""
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// ReloadFunc re-reads the agent configuration and applies the settings that
+// can change without a restart.
+type ReloadFunc func() (*domain.ReloadResult, error)
+
+// SetReload installs the reloader behind POST /admin/reload.
+func (s *Server) SetReload(fn ReloadFunc) {
+	s.handler.reload = fn
+}
+
+// Reload applies configuration changes, like SIGHUP does. An invalid
+// configuration is rejected and the running settings are kept.
+func (h *Handler) Reload(c *gin.Context) {
+	if h.reload == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": "configuration reload is not available"})
+		return
+	}
+	res, err := h.reload()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": res})
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request signing lets a caller prove it holds the agent secret without
+// sending it: the signature is an HMAC-SHA256, keyed with the secret, over
+//
+//	METHOD \n PATH \n RAW_QUERY \n TIMESTAMP \n NONCE \n hex(sha256(body))
+//
+// TIMESTAMP is in Unix seconds and must be within signatureWindow of the
+// agent clock; a nonce is accepted once within that window.
+const (
+	signatureHeader   = "X-Agent-Signature"
+	timestampHeader   = "X-Agent-Timestamp"
+	nonceHeader       = "X-Agent-Nonce"
+	contentHashHeader = "X-Agent-Content-SHA256"
+	// unsignedPayload in X-Agent-Content-SHA256 leaves a streamed body out
+	// of the signature on unsignedPayloadPaths.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	signatureWindow = 5 * time.Minute
+	// maxSignedBody bounds the body buffered to be hashed.
+	maxSignedBody = 16 << 20
+	minNonceLen   = 16
+	maxNonceLen   = 128
+	// noncePruneSize is the cache size above which expired nonces are dropped.
+	noncePruneSize = 4096
+)
+
+// unsignedPayloadPaths take bodies too large to buffer for hashing. Keys
+// are routePath forms, so the /v1 routes are covered too.
+var unsignedPayloadPaths = map[string]bool{
+	"/instances/ingest": true,
+	"/instances/files":  true,
+}
+
+var (
+	errSignatureInvalid = errors.New("invalid request signature")
+	errSignatureExpired = errors.New("request timestamp outside the allowed window")
+	errSignatureReplay  = errors.New("request nonce already used")
+	errBodyHash         = errors.New("body does not match X-Agent-Content-SHA256")
+)
+
+// requestVerifier checks signed requests and remembers the nonces seen
+// within the replay window.
+type requestVerifier struct {
+	secret []byte
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newRequestVerifier(secret string) *requestVerifier {
+	return &requestVerifier{secret: []byte(secret), nonces: make(map[string]time.Time)}
+}
+
+// signed reports whether r carries a request signature.
+func signed(r *http.Request) bool {
+	return r.Header.Get(signatureHeader) != ""
+}
+
+// verify checks the signature of r. The body is read to be hashed and put
+// back for the handler.
+func (v *requestVerifier) verify(r *http.Request) error {
+	ts, nonce, err := checkSignatureHeaders(r.Header.Get(timestampHeader), r.Header.Get(nonceHeader))
+	if err != nil {
+		return err
+	}
+	bodyHash, err := requestBodyHash(r)
+	if err != nil {
+		return err
+	}
+	return v.check(r.Method, r.URL.Path, r.URL.RawQuery, ts, nonce, bodyHash, r.Header.Get(signatureHeader))
+}
+
+// checkSignatureHeaders parses the timestamp and checks that it lies
+// within signatureWindow and that the nonce has an acceptable length.
+func checkSignatureHeaders(timestamp, nonce string) (int64, string, error) {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: bad %s", errSignatureInvalid, timestampHeader)
+	}
+	now := time.Now()
+	at := time.Unix(ts, 0)
+	if at.Before(now.Add(-signatureWindow)) || at.After(now.Add(signatureWindow)) {
+		return 0, "", errSignatureExpired
+	}
+	if len(nonce) < minNonceLen || len(nonce) > maxNonceLen {
+		return 0, "", fmt.Errorf("%w: %s must be %d-%d characters", errSignatureInvalid, nonceHeader, minNonceLen, maxNonceLen)
+	}
+	return ts, nonce, nil
+}
+
+// check compares sig with the signature of the given request parts and
+// consumes the nonce.
+func (v *requestVerifier) check(method, path, rawQuery string, ts int64, nonce, bodyHash, sig string) error {
+	want := signRequestString(v.secret, method, path, rawQuery, ts, nonce, bodyHash)
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
+		return errSignatureInvalid
+	}
+
+	now := time.Now()
+	at := time.Unix(ts, 0)
+
+	// Only a valid signature consumes its nonce, so forged requests cannot
+	// burn nonces of real ones.
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if exp, ok := v.nonces[nonce]; ok && now.Before(exp) {
+		return errSignatureReplay
+	}
+	if len(v.nonces) >= noncePruneSize {
+		for n, exp := range v.nonces {
+			if !now.Before(exp) {
+				delete(v.nonces, n)
+			}
+		}
+	}
+	v.nonces[nonce] = at.Add(signatureWindow)
+	return nil
+}
+
+// requestBodyHash returns the hex SHA-256 of the body, or unsignedPayload
+// where the caller opted out and that is allowed.
+func requestBodyHash(r *http.Request) (string, error) {
+	claimed := r.Header.Get(contentHashHeader)
+	if claimed == unsignedPayload {
+		if !unsignedPayloadPaths[routePath(r.URL.Path)] {
+			return "", fmt.Errorf("%w: %s is not allowed on %s", errSignatureInvalid, unsignedPayload, r.URL.Path)
+		}
+		return unsignedPayload, nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return "", fmt.Errorf("read body: %w", err)
+		}
+		if len(body) > maxSignedBody {
+			return "", fmt.Errorf("%w: body over %d bytes must be sent as %s", errSignatureInvalid, maxSignedBody, unsignedPayload)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	if claimed != "" && !strings.EqualFold(claimed, hash) {
+		return "", errBodyHash
+	}
+	return hash, nil
+}
+
+func signRequestString(secret []byte, method, path, rawQuery string, ts int64, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n%s", method, path, rawQuery, ts, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest signs an outgoing request to another agent. bodyHash is the
+// hex SHA-256 of the body or unsignedPayload.
+func signRequest(r *http.Request, secret, bodyHash string) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b[:])
+	ts := time.Now().Unix()
+	r.Header.Set(timestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(contentHashHeader, bodyHash)
+	r.Header.Set(signatureHeader, signRequestString([]byte(secret), r.Method, r.URL.Path, r.URL.RawQuery, ts, nonce, bodyHash))
+	return nil
+}
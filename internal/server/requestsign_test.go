@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "sk-test-secret"
+
+// signedRequest builds a request signed like a control plane would.
+func signedRequest(t *testing.T, method, target string, body []byte, bodyHash string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	ts := time.Now().Unix()
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 16) + "-nonce"
+	if bodyHash == "" {
+		sum := sha256.Sum256(body)
+		bodyHash = hex.EncodeToString(sum[:])
+	} else {
+		r.Header.Set(contentHashHeader, bodyHash)
+	}
+	r.Header.Set(timestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(signatureHeader, signRequestString([]byte(testSecret), method, r.URL.Path, r.URL.RawQuery, ts, nonce, bodyHash))
+	return r
+}
+
+func TestUnsignedPayloadAllowedPaths(t *testing.T) {
+	for _, tc := range []struct {
+		method, target string
+		ok             bool
+	}{
+		{http.MethodPost, "/instances/files?path=/root/", true},
+		{http.MethodPost, apiPrefix + "/instances/files?path=/root/", true},
+		{http.MethodPost, apiPrefix + "/instances/ingest", true},
+		{http.MethodPost, apiPrefix + "/instances", false},
+		{http.MethodPost, apiPrefix + "/instances/exec", false},
+	} {
+		v := newRequestVerifier(testSecret)
+		err := v.verify(signedRequest(t, tc.method, tc.target, []byte("payload"), unsignedPayload))
+		if tc.ok && err != nil {
+			t.Errorf("%s %s: %v", tc.method, tc.target, err)
+		}
+		if !tc.ok && !errors.Is(err, errSignatureInvalid) {
+			t.Errorf("%s %s: err = %v, want %v", tc.method, tc.target, err, errSignatureInvalid)
+		}
+	}
+}
+
+func TestUnsignedPayloadLeavesBodyUnread(t *testing.T) {
+	body := bytes.Repeat([]byte{'x'}, maxSignedBody+1)
+	r := signedRequest(t, http.MethodPost, apiPrefix+"/instances/files?path=/data/big", body, unsignedPayload)
+	if err := newRequestVerifier(testSecret).verify(r); err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, r.Body)
+	if err != nil || n != int64(len(body)) {
+		t.Fatalf("handler read %d bytes, err %v; want %d", n, err, len(body))
+	}
+}
+
+func TestSignedBodyLimit(t *testing.T) {
+	body := bytes.Repeat([]byte{'x'}, maxSignedBody+1)
+	r := signedRequest(t, http.MethodPost, apiPrefix+"/instances/files?path=/data/big", body, "")
+	err := newRequestVerifier(testSecret).verify(r)
+	if err == nil || !strings.Contains(err.Error(), unsignedPayload) {
+		t.Fatalf("err = %v, want a hint to use %s", err, unsignedPayload)
+	}
+}
+
+func TestSignedBodyHashed(t *testing.T) {
+	v := newRequestVerifier(testSecret)
+	r := signedRequest(t, http.MethodPost, apiPrefix+"/instances/exec", []byte(`{"command":["true"]}`), "")
+	if err := v.verify(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(r); !errors.Is(err, errSignatureReplay) {
+		t.Fatalf("replayed request: err = %v, want %v", err, errSignatureReplay)
+	}
+}
@@ -2,78 +2,172 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/qudata/agent/internal/domain"
-	"github.com/qudata/agent/internal/frpc"
+	"github.com/qudata/agent/internal/metrics"
 	"github.com/qudata/agent/internal/network"
 	"github.com/qudata/agent/internal/storage"
+	"github.com/qudata/agent/internal/tlsterm"
+	"github.com/qudata/agent/internal/tunnel"
+	"google.golang.org/grpc"
 )
 
 type Server struct {
 	httpServer *http.Server
+	grpcServer *grpc.Server
+	handler    *Handler
+	listen     ListenConfig
 	logger     *slog.Logger
+
+	mu        sync.Mutex
+	listeners []net.Listener
 }
 
 func New(
-	port int,
+	listen ListenConfig,
 	secret string,
+	signedOnly bool,
+	rateLimit float64,
 	testMode bool,
 	vm domain.VMManager,
-	frpcProc *frpc.Process,
+	tun tunnel.Provider,
 	ports *network.PortAllocator,
 	store *storage.Store,
+	tlsTerm *tlsterm.Terminator,
 	logger *slog.Logger,
 ) *Server {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
-	router.Use(RecoveryMiddleware(logger))
+	router.Use(RecoveryMiddleware())
+	router.Use(TracingMiddleware())
 	router.Use(LoggingMiddleware(logger))
-	router.Use(AuthMiddleware(secret))
-
-	h := NewHandler(vm, frpcProc, ports, store, logger, testMode)
-
-	router.GET("/ping", h.Ping)
-	router.GET("/instances", h.GetInstance)
-	router.POST("/instances", h.CreateInstance)
-	router.PUT("/instances", h.ManageInstance)
-	router.DELETE("/instances", h.DeleteInstance)
-	router.POST("/ssh", h.AddSSH)
-	router.DELETE("/ssh", h.RemoveSSH)
-
-	// TODO: --test mode — listen on 0.0.0.0 for direct IP access without FRPC.
-	bindAddr := "127.0.0.1"
-	if testMode {
-		bindAddr = "0.0.0.0"
+	signer := newURLSigner(secret)
+	verifier := newRequestVerifier(secret)
+	router.Use(AuthMiddleware(secret, signedOnly, signer, verifier))
+	if listen.TLS != nil {
+		router.Use(ClientCertMiddleware())
 	}
+	router.Use(RateLimitMiddleware(rateLimit))
 
-	return &Server{
+	h := NewHandler(vm, tun, ports, store, logger, testMode)
+	h.signer = signer
+	h.tls = tlsTerm
+
+	h.register(router)
+
+	s := &Server{
 		httpServer: &http.Server{
-			Addr:         fmt.Sprintf("%s:%d", bindAddr, port),
 			Handler:      router,
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 60 * time.Second,
 			IdleTimeout:  120 * time.Second,
 		},
+		handler: h,
+		listen:  listen,
+		logger:  logger,
+	}
+	if listen.GRPCAddr != "" {
+		s.grpcServer = newGRPCServer(h, secret, signedOnly, verifier, rateLimit, listen.TLS)
+	}
+	return s
+}
+
+// NewMetrics creates an unauthenticated server that only exposes /metrics.
+// It is meant to be bound to a host-local address for a Prometheus scraper
+// and is never published through the tunnel.
+func NewMetrics(addr string, logger *slog.Logger) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	return &Server{
+		httpServer: &http.Server{
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		},
+		listen: ListenConfig{Addr: addr},
 		logger: logger,
 	}
 }
 
+// Start opens the configured listeners and serves on all of them until
+// Shutdown is called or one of them fails.
 func (s *Server) Start() error {
-	s.logger.Info("HTTP server starting", "addr", s.httpServer.Addr)
-	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	listeners, err := s.listen.open()
+	if err != nil {
 		return fmt.Errorf("http server: %w", err)
 	}
+	s.mu.Lock()
+	s.listeners = listeners
+	s.mu.Unlock()
+
+	errCh := make(chan error, len(listeners)+1)
+	serving := len(listeners)
+	if s.grpcServer != nil {
+		l, err := net.Listen("tcp", s.listen.GRPCAddr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("grpc server: listen %s: %w", s.listen.GRPCAddr, err)
+		}
+		s.logger.Info("gRPC server starting", "addr", l.Addr().String(), "tls", s.listen.TLS != nil)
+		go func() { errCh <- s.grpcServer.Serve(l) }()
+		serving++
+	}
+	for _, l := range listeners {
+		_, isTCP := l.Addr().(*net.TCPAddr)
+		tlsOn := isTCP && s.listen.TLS != nil
+		s.logger.Info("HTTP server starting", "addr", l.Addr().String(), "network", l.Addr().Network(), "tls", tlsOn)
+		// s.listeners keeps the raw listener so it can be handed over.
+		if tlsOn {
+			l = tls.NewListener(l, s.listen.TLS)
+		}
+		go func(l net.Listener) { errCh <- s.httpServer.Serve(l) }(l)
+	}
+
+	for range serving {
+		if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			_ = s.httpServer.Close()
+			if s.grpcServer != nil {
+				s.grpcServer.Stop()
+			}
+			return fmt.Errorf("http server: %w", err)
+		}
+	}
 	return nil
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info("HTTP server shutting down")
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	if s.grpcServer != nil {
+		s.stopGRPC(ctx)
+	}
+	return err
+}
+
+// stopGRPC lets unary calls finish until ctx is done. Watch streams only
+// end when the server stops, so they are cut off then.
+func (s *Server) stopGRPC(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+	}
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultURLTTL = 15 * time.Minute
+	maxURLTTL     = 24 * time.Hour
+)
+
+// signedPaths may be fetched with a signed URL instead of X-Agent-Secret.
+var signedPaths = map[string]bool{
+	"/instances/logs":  true,
+	"/instances/files": true,
+}
+
+var (
+	errURLExpired   = errors.New("signed url expired")
+	errURLSignature = errors.New("invalid signed url")
+)
+
+// urlSigner issues short-lived URLs for read-only instance endpoints. The
+// HMAC key is derived from the agent secret, so rotating the secret revokes
+// every outstanding URL.
+type urlSigner struct {
+	key []byte
+}
+
+func newURLSigner(secret string) *urlSigner {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("qudata-signed-url"))
+	return &urlSigner{key: mac.Sum(nil)}
+}
+
+// sign returns path with q, an expiry and a signature covering all of them.
+func (s *urlSigner) sign(path string, q url.Values, expires time.Time) string {
+	q.Del("sig")
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", s.mac(path, q))
+	return path + "?" + q.Encode()
+}
+
+// verify checks the signature and expiry of a signed request.
+func (s *urlSigner) verify(r *http.Request) error {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	q.Del("sig")
+
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errURLSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.mac(r.URL.Path, q))) {
+		return errURLSignature
+	}
+	if time.Now().Unix() > expires {
+		return errURLExpired
+	}
+	return nil
+}
+
+func (s *urlSigner) mac(path string, q url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(http.MethodGet + "\n" + path + "\n" + q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+)
+
+// updateDownloadTimeout bounds fetching and verifying the new binary.
+const updateDownloadTimeout = 10 * time.Minute
+
+// UpdateFunc downloads and verifies a new agent binary, installs it and
+// schedules the re-exec into it. It is provided by the agent, which owns the
+// process and everything handed over to the new binary.
+type UpdateFunc func(ctx context.Context, spec domain.UpdateSpec) error
+
+// SetUpdate installs the updater behind POST /update.
+func (s *Server) SetUpdate(fn UpdateFunc) {
+	s.handler.update = fn
+}
+
+// Listeners returns the TCP listeners the server is serving on, so that they
+// can be handed over to a new agent process.
+func (s *Server) Listeners() []net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []net.Listener
+	for _, l := range s.listeners {
+		if _, ok := l.Addr().(*net.TCPAddr); ok {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// Update replaces the agent binary without touching the instance. The VM
+// keeps running and is adopted by the new process; creates are refused from
+// the moment the update is accepted.
+func (h *Handler) Update(c *gin.Context) {
+	var spec domain.UpdateSpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if h.update == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": "self-update is not available"})
+		return
+	}
+
+	switch h.vm.Status(c.Request.Context()).Status {
+	case domain.StatusProvisioning, domain.StatusBooting, domain.StatusConfiguring, domain.StatusStopping:
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "instance is changing state, retry later"})
+		return
+	}
+	h.migMu.Lock()
+	migrating := h.migration != nil && h.migration.FinishedAt == nil
+	h.migMu.Unlock()
+	if migrating {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": "migration in progress"})
+		return
+	}
+
+	h.jobMu.Lock()
+	switch {
+	case h.job != nil:
+		job := *h.job
+		h.jobMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": domain.ErrCreateInProgress{JobID: job.ID}.Error()})
+		return
+	case h.updating:
+		h.jobMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": domain.ErrUpdateInProgress{}.Error()})
+		return
+	}
+	h.updating = true
+	h.jobMu.Unlock()
+
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(updateDownloadTimeout + time.Minute))
+	ctx, cancel := context.WithTimeout(c.Request.Context(), updateDownloadTimeout)
+	defer cancel()
+
+	h.logger.Info("agent update requested", "version", spec.Version, "url", spec.URL)
+	if err := h.update(ctx, spec); err != nil {
+		h.jobMu.Lock()
+		h.updating = false
+		h.jobMu.Unlock()
+		h.logger.Error("agent update failed", "version", spec.Version, "err", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"ok": true, "data": gin.H{"version": spec.Version}})
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/volume"
+)
+
+var errVolumesUnavailable = errors.New("volumes are not available on this host")
+
+type createVolumeRequest struct {
+	Name   string `json:"name" binding:"required,max=20"`
+	SizeGB int    `json:"size_gb" binding:"required,min=1"`
+}
+
+type volumeListResponse struct {
+	Volumes []domain.Volume `json:"volumes"`
+}
+
+// SetVolumes sets the store of the volumes instances may attach.
+func (s *Server) SetVolumes(store *volume.Store) {
+	s.handler.volumes = store
+}
+
+// volumeCode maps a volume store error to its status code.
+func volumeCode(err error) int {
+	switch {
+	case errors.Is(err, volume.ErrInvalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, volume.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, volume.ErrExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func volumeNames(attachments []domain.VolumeAttachment) []string {
+	var names []string
+	for _, a := range attachments {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// attachedVolumes returns the volumes used by the instance or by the create
+// in flight.
+func (h *Handler) attachedVolumes() map[string]bool {
+	attached := map[string]bool{}
+	if job := h.currentJob(); job != nil {
+		for _, name := range job.Volumes {
+			attached[name] = true
+		}
+	}
+	if h.vm.VMID() != "" {
+		if state, _ := h.store.LoadInstanceState(); state != nil {
+			for _, name := range state.Volumes {
+				attached[name] = true
+			}
+		}
+	}
+	return attached
+}
+
+// attachVolumes resolves the volumes a create asks for and records them on
+// job, which owns the VM slot, so that they cannot be deleted under it.
+func (h *Handler) attachVolumes(job *createJob, names []string) ([]domain.VolumeAttachment, opResult) {
+	if len(names) == 0 {
+		return nil, opResult{}
+	}
+	if h.volumes == nil {
+		return nil, opResult{code: http.StatusBadRequest, err: errVolumesUnavailable}
+	}
+
+	h.volumeMu.Lock()
+	defer h.volumeMu.Unlock()
+	attached := h.attachedVolumes()
+	seen := map[string]bool{}
+	var out []domain.VolumeAttachment
+	for _, name := range names {
+		if seen[name] {
+			return nil, opResult{code: http.StatusBadRequest, err: fmt.Errorf("volume %s given twice", name)}
+		}
+		seen[name] = true
+		if attached[name] {
+			return nil, opResult{code: http.StatusConflict, err: fmt.Errorf("volume %s is attached to another instance", name)}
+		}
+		if h.transferring(name) {
+			return nil, opResult{code: http.StatusConflict, err: fmt.Errorf("volume %s is being transferred", name)}
+		}
+		_, path, err := h.volumes.Get(name)
+		if err != nil {
+			return nil, opResult{code: volumeCode(err), err: fmt.Errorf("volume %s: %w", name, err)}
+		}
+		out = append(out, domain.VolumeAttachment{Name: name, Path: path})
+	}
+
+	h.jobMu.Lock()
+	job.Volumes = volumeNames(out)
+	h.jobMu.Unlock()
+	return out, opResult{}
+}
+
+// ListVolumes returns the volumes and whether they are attached.
+func (h *Handler) ListVolumes(c *gin.Context) {
+	if h.volumes == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": errVolumesUnavailable.Error()})
+		return
+	}
+	volumes, err := h.volumes.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	attached := h.attachedVolumes()
+	for i := range volumes {
+		volumes[i].Attached = attached[volumes[i].Name]
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": volumeListResponse{Volumes: volumes}})
+}
+
+// CreateVolume creates an empty volume; it is formatted by the guest the
+// first time it is attached.
+func (h *Handler) CreateVolume(c *gin.Context) {
+	if h.volumes == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": errVolumesUnavailable.Error()})
+		return
+	}
+	var req createVolumeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	v, err := h.volumes.Create(req.Name, req.SizeGB)
+	if err != nil {
+		h.logger.Error("volume create failed", "name", req.Name, "err", err)
+		c.JSON(volumeCode(err), gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	h.logger.Info("volume created", "name", v.Name, "size_gb", v.SizeGB)
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": v})
+}
+
+// DeleteVolume removes a volume and its data. An attached volume is refused
+// with 409.
+func (h *Handler) DeleteVolume(c *gin.Context) {
+	if h.volumes == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": errVolumesUnavailable.Error()})
+		return
+	}
+	name := c.Param("name")
+
+	h.volumeMu.Lock()
+	defer h.volumeMu.Unlock()
+	if h.attachedVolumes()[name] {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": fmt.Sprintf("volume %s is attached to the instance", name)})
+		return
+	}
+	if h.transferring(name) {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": fmt.Sprintf("volume %s is being transferred", name)})
+		return
+	}
+	if err := h.volumes.Delete(name); err != nil {
+		c.JSON(volumeCode(err), gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	h.logger.Info("volume deleted", "name", name)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/s3"
+	"github.com/qudata/agent/internal/volume"
+)
+
+const (
+	volumeTransferTimeout = 24 * time.Hour
+	// volumePartSize is the upload part size of volumes small enough to stay
+	// within s3.MaxParts with it; larger ones use larger parts.
+	volumePartSize = 16 << 20
+)
+
+type volumeExportRequest struct {
+	Target domain.ObjectLocation `json:"target"`
+}
+
+type volumeImportRequest struct {
+	Source domain.ObjectLocation `json:"source"`
+}
+
+// volumeTransfer is a transfer in progress, or the last one, of a volume.
+type volumeTransfer struct {
+	status domain.VolumeTransfer
+	bytes  atomic.Int64
+}
+
+// snapshotTransfer returns the last transfer of name, or nil.
+func (h *Handler) snapshotTransfer(name string) *domain.VolumeTransfer {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+	t := h.transfers[name]
+	if t == nil {
+		return nil
+	}
+	status := t.status
+	status.Bytes = t.bytes.Load()
+	return &status
+}
+
+// transferring reports whether a transfer of name is running.
+func (h *Handler) transferring(name string) bool {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+	t := h.transfers[name]
+	return t != nil && t.status.Phase == domain.TransferRunning
+}
+
+// startTransfer records a new running transfer of name, failing if one is
+// running already.
+func (h *Handler) startTransfer(name string, dir domain.TransferDirection, obj domain.ObjectLocation, total int64) (*volumeTransfer, error) {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+	if t := h.transfers[name]; t != nil && t.status.Phase == domain.TransferRunning {
+		return nil, fmt.Errorf("volume %s has a %s in progress", name, t.status.Direction)
+	}
+	if h.transfers == nil {
+		h.transfers = map[string]*volumeTransfer{}
+	}
+	t := &volumeTransfer{status: domain.VolumeTransfer{
+		ID:         uuid.New().String(),
+		Volume:     name,
+		Direction:  dir,
+		Phase:      domain.TransferRunning,
+		Object:     obj.Bucket + "/" + obj.Key,
+		TotalBytes: total,
+		StartedAt:  time.Now().UTC(),
+	}}
+	h.transfers[name] = t
+	return t, nil
+}
+
+func (h *Handler) finishTransfer(t *volumeTransfer, err error) {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+	now := time.Now().UTC()
+	t.status.FinishedAt = &now
+	if err != nil {
+		t.status.Phase = domain.TransferFailed
+		t.status.Error = err.Error()
+		h.logger.Error("volume transfer failed", "transfer_id", t.status.ID, "volume", t.status.Volume,
+			"direction", t.status.Direction, "err", err)
+		return
+	}
+	t.status.Phase = domain.TransferCompleted
+	h.logger.Info("volume transfer completed", "transfer_id", t.status.ID, "volume", t.status.Volume,
+		"direction", t.status.Direction, "object", t.status.Object, "bytes", t.bytes.Load())
+}
+
+// ExportVolume uploads a detached volume, gzip-compressed, to S3-compatible
+// storage. The upload runs in the background; progress is reported by
+// GET /volumes/:name/transfer.
+func (h *Handler) ExportVolume(c *gin.Context) {
+	if h.volumes == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": errVolumesUnavailable.Error()})
+		return
+	}
+	var req volumeExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	client, err := s3.New(req.Target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	name := c.Param("name")
+
+	// The volume must not change while it is read, so it is exported only
+	// while detached and cannot be attached until the export ends.
+	h.volumeMu.Lock()
+	defer h.volumeMu.Unlock()
+	if h.attachedVolumes()[name] {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": fmt.Sprintf("volume %s is attached to the instance", name)})
+		return
+	}
+	f, size, err := h.volumes.Open(name)
+	if err != nil {
+		c.JSON(volumeCode(err), gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	t, err := h.startTransfer(name, domain.TransferExport, req.Target, size)
+	if err != nil {
+		f.Close()
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	partSize := int64(volumePartSize)
+	// gzip can grow incompressible data slightly; half the part budget
+	// leaves room for it.
+	if n := size/(s3.MaxParts/2) + 1; n > partSize {
+		partSize = n
+	}
+	go func() {
+		defer f.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), volumeTransferTimeout)
+		defer cancel()
+
+		pr, pw := io.Pipe()
+		go func() {
+			zw, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+			_, err := io.Copy(zw, io.TeeReader(f, &countingWriter{w: io.Discard, n: &t.bytes}))
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		err := client.Upload(ctx, req.Target.Bucket, req.Target.Key, pr, partSize)
+		pr.CloseWithError(errors.New("upload ended"))
+		h.finishTransfer(t, err)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"ok": true, "data": h.snapshotTransfer(name)})
+}
+
+// ImportVolume creates a volume from an object written by ExportVolume. The
+// download runs in the background; the volume appears once it is complete.
+func (h *Handler) ImportVolume(c *gin.Context) {
+	if h.volumes == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"ok": false, "error": errVolumesUnavailable.Error()})
+		return
+	}
+	var req volumeImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	client, err := s3.New(req.Source)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	name := c.Param("name")
+	if !volume.ValidName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": volume.ErrInvalidName.Error()})
+		return
+	}
+	if _, _, err := h.volumes.Get(name); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": volume.ErrExists.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), volumeTransferTimeout)
+	body, size, err := client.Download(ctx, req.Source.Bucket, req.Source.Key)
+	if err != nil {
+		cancel()
+		c.JSON(http.StatusBadGateway, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	t, err := h.startTransfer(name, domain.TransferImport, req.Source, max(size, 0))
+	if err != nil {
+		body.Close()
+		cancel()
+		c.JSON(http.StatusConflict, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+
+	go func() {
+		defer cancel()
+		defer body.Close()
+		err := func() error {
+			zr, err := gzip.NewReader(io.TeeReader(body, &countingWriter{w: io.Discard, n: &t.bytes}))
+			if err != nil {
+				return fmt.Errorf("decompress: %w", err)
+			}
+			_, err = h.volumes.Import(name, zr)
+			return err
+		}()
+		h.finishTransfer(t, err)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"ok": true, "data": h.snapshotTransfer(name)})
+}
+
+// GetVolumeTransfer returns the transfer in progress, or the last one, of a
+// volume.
+func (h *Handler) GetVolumeTransfer(c *gin.Context) {
+	t := h.snapshotTransfer(c.Param("name"))
+	if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"ok": false, "error": "no transfer"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "data": t})
+}
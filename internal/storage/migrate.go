@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaKey in the meta bucket marks a database the state files have been
+// moved into.
+const schemaKey = "schema"
+
+// migrateFiles moves the state files of earlier versions, one per record,
+// into the database in a single transaction and then deletes them. The
+// identity files stay, so an update rolled back to an older binary still
+// registers as the same agent. It runs once per database; files written
+// afterwards by an older binary are not picked up again.
+func (s *Store) migrateFiles() error {
+	var moved []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if meta.Get([]byte(schemaKey)) != nil {
+			return nil
+		}
+		for _, r := range records {
+			if r.file == "" {
+				continue
+			}
+			path := filepath.Join(s.dataDir, r.file)
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(r.bucket).Put([]byte(r.key), data); err != nil {
+				return err
+			}
+			if string(r.bucket) != string(bucketIdentity) {
+				moved = append(moved, path)
+			}
+		}
+		return meta.Put([]byte(schemaKey), []byte("1"))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range moved {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove migrated %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -2,85 +2,163 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/qudata/agent/internal/domain"
+	bolt "go.etcd.io/bbolt"
 )
 
-// Store provides persistent file-based storage for agent state.
+const (
+	dbFile = "agent.db"
+	// openTimeout bounds the wait for the database lock held by another
+	// agent process.
+	openTimeout = 10 * time.Second
+)
+
+// Buckets group the records by what they describe.
+var (
+	bucketIdentity = []byte("identity")
+	bucketInstance = []byte("instance")
+	bucketPorts    = []byte("ports")
+	bucketJobs     = []byte("jobs")
+	bucketMetering = []byte("metering")
+	bucketHost     = []byte("host")
+	bucketMeta     = []byte("meta")
+
+	buckets = [][]byte{bucketIdentity, bucketInstance, bucketPorts, bucketJobs, bucketMetering, bucketHost, bucketMeta}
+)
+
+// record is where one value lives in the database. file is the loose file
+// it was kept in before the database, migrated on first open; records added
+// since have none.
+type record struct {
+	bucket []byte
+	key    string
+	file   string
+}
+
+var (
+	recAgentID     = record{bucketIdentity, "agent_id", "agent_id"}
+	recAPIKey      = record{bucketIdentity, "api_key", "api_key"}
+	recSecret      = record{bucketIdentity, "agent_secret", "agent_secret"}
+	recInstance    = record{bucketInstance, "state", "instance_state.json"}
+	recDesired     = record{bucketInstance, "desired", "desired_state.json"}
+	recHandoff     = record{bucketInstance, "handoff", "handoff.json"}
+	recProvision   = record{bucketInstance, "provisioning", "provisioning.json"}
+	recPortLeases  = record{bucketPorts, "leases", "ports.json"}
+	recCreateJob   = record{bucketJobs, "create", "create_job.json"}
+	recIdempotency = record{bucketJobs, "idempotency", "idempotency.json"}
+	recEvents      = record{bucketJobs, "events", "events.json"}
+	recUptime      = record{bucketMetering, "uptime", "uptime.json"}
+	recUsage       = record{bucketMetering, "usage", "usage.json"}
+	recHardware    = record{bucketHost, "hardware", "hardware.json"}
+	recNetTest     = record{bucketHost, "nettest", "nettest.json"}
+	recPowerCap    = record{bucketHost, "power_cap", ""}
+	recBenchmark   = record{bucketHost, "gpu_benchmark", ""}
+	recLocation    = record{bucketHost, "location", ""}
+
+	records = []record{
+		recAgentID, recAPIKey, recSecret,
+		recInstance, recDesired, recHandoff, recProvision,
+		recPortLeases,
+		recCreateJob, recIdempotency, recEvents,
+		recUptime, recUsage,
+		recHardware, recNetTest, recPowerCap, recBenchmark, recLocation,
+	}
+)
+
+// Store provides persistent storage for agent state in an embedded bbolt
+// database. Every save is a transaction, so a crash leaves either the old
+// or the new value.
 type Store struct {
 	dataDir string
-	mu      sync.RWMutex
+	db      *bolt.DB
 }
 
-// NewStore creates a Store rooted at dataDir, ensuring the directory exists.
+// NewStore opens the database in dataDir, creating the directory and the
+// buckets, and moves in the loose files of earlier versions.
 func NewStore(dataDir string) (*Store, error) {
 	if err := os.MkdirAll(dataDir, 0o755); err != nil {
 		return nil, fmt.Errorf("create data dir %s: %w", dataDir, err)
 	}
-	return &Store{dataDir: dataDir}, nil
+	db, err := bolt.Open(filepath.Join(dataDir, dbFile), 0o600, &bolt.Options{Timeout: openTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open %s: locked by another agent process", filepath.Join(dataDir, dbFile))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", filepath.Join(dataDir, dbFile), err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create buckets: %w", err)
+	}
+
+	s := &Store{dataDir: dataDir, db: db}
+	if err := s.migrateFiles(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate state files: %w", err)
+	}
+	return s, nil
 }
 
 // AgentID returns the persisted agent ID, generating one if it doesn't exist.
 func (s *Store) AgentID() (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	path := filepath.Join(s.dataDir, "agent_id")
-	data, err := os.ReadFile(path)
-	if err == nil {
-		id := strings.TrimSpace(string(data))
-		if id != "" {
-			return id, nil
+	var id string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recAgentID.bucket)
+		if v := strings.TrimSpace(string(b.Get([]byte(recAgentID.key)))); v != "" {
+			id = v
+			return nil
 		}
-	}
-
-	id := uuid.New().String()
-	if err := os.WriteFile(path, []byte(id), 0o600); err != nil {
+		id = uuid.New().String()
+		return b.Put([]byte(recAgentID.key), []byte(id))
+	})
+	if err != nil {
 		return "", fmt.Errorf("write agent id: %w", err)
 	}
 	return id, nil
 }
 
-// SaveAPIKey persists the API key to disk.
+// SaveAPIKey persists the API key.
 func (s *Store) SaveAPIKey(key string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return os.WriteFile(filepath.Join(s.dataDir, "api_key"), []byte(key), 0o600)
+	return s.put(recAPIKey, []byte(key))
 }
 
 // APIKey reads the persisted API key.
 func (s *Store) APIKey() (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	data, err := os.ReadFile(filepath.Join(s.dataDir, "api_key"))
+	data, err := s.get(recAPIKey)
 	if err != nil {
 		return "", err
 	}
+	if data == nil {
+		return "", os.ErrNotExist
+	}
 	return strings.TrimSpace(string(data)), nil
 }
 
 // SaveSecret persists the agent secret key received from the API.
 func (s *Store) SaveSecret(secret string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return os.WriteFile(filepath.Join(s.dataDir, "agent_secret"), []byte(secret), 0o600)
+	return s.put(recSecret, []byte(secret))
 }
 
 // Secret reads the persisted agent secret key.
 func (s *Store) Secret() (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	data, err := os.ReadFile(filepath.Join(s.dataDir, "agent_secret"))
+	data, err := s.get(recSecret)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil
-		}
 		return "", err
 	}
 	return strings.TrimSpace(string(data)), nil
@@ -88,40 +166,288 @@ func (s *Store) Secret() (string, error) {
 
 // SaveInstanceState persists the running instance state.
 func (s *Store) SaveInstanceState(state *domain.InstanceState) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal instance state: %w", err)
-	}
-	return os.WriteFile(filepath.Join(s.dataDir, "instance_state.json"), data, 0o600)
+	return s.putJSON(recInstance, state)
 }
 
 // LoadInstanceState loads the persisted instance state, or nil if none exists.
 func (s *Store) LoadInstanceState() (*domain.InstanceState, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	data, err := os.ReadFile(filepath.Join(s.dataDir, "instance_state.json"))
+	return loadJSON[domain.InstanceState](s, recInstance)
+}
+
+// ClearInstanceState removes the persisted instance state.
+func (s *Store) ClearInstanceState() error {
+	return s.delete(recInstance)
+}
+
+// SaveUptime persists the availability tracker state.
+func (s *Store) SaveUptime(state *domain.UptimeState) error {
+	return s.putJSON(recUptime, state)
+}
+
+// LoadUptime loads the availability tracker state, or nil if none exists.
+func (s *Store) LoadUptime() (*domain.UptimeState, error) {
+	return loadJSON[domain.UptimeState](s, recUptime)
+}
+
+// SaveUsage persists the usage meter state.
+func (s *Store) SaveUsage(state *domain.UsageState) error {
+	return s.putJSON(recUsage, state)
+}
+
+// LoadUsage loads the usage meter state, or nil if none exists.
+func (s *Store) LoadUsage() (*domain.UsageState, error) {
+	return loadJSON[domain.UsageState](s, recUsage)
+}
+
+// SaveNetTest persists the last network test result.
+func (s *Store) SaveNetTest(res *domain.NetTestResult) error {
+	return s.putJSON(recNetTest, res)
+}
+
+// LoadNetTest loads the last network test result, or nil if none exists.
+func (s *Store) LoadNetTest() (*domain.NetTestResult, error) {
+	return loadJSON[domain.NetTestResult](s, recNetTest)
+}
+
+// SavePowerCap persists the host GPU power cap set by the control plane.
+func (s *Store) SavePowerCap(pc *domain.PowerCap) error {
+	return s.putJSON(recPowerCap, pc)
+}
+
+// LoadPowerCap loads the stored GPU power cap, or nil if none was set.
+func (s *Store) LoadPowerCap() (*domain.PowerCap, error) {
+	return loadJSON[domain.PowerCap](s, recPowerCap)
+}
+
+// SaveBenchmark persists the last GPU benchmark result.
+func (s *Store) SaveBenchmark(b *domain.GPUBenchmark) error {
+	return s.putJSON(recBenchmark, b)
+}
+
+// LoadBenchmark loads the last GPU benchmark result, or nil if none exists.
+func (s *Store) LoadBenchmark() (*domain.GPUBenchmark, error) {
+	return loadJSON[domain.GPUBenchmark](s, recBenchmark)
+}
+
+// SaveLocation persists the last GeoIP lookup.
+func (s *Store) SaveLocation(loc *domain.GeoLocation) error {
+	return s.putJSON(recLocation, loc)
+}
+
+// LoadLocation loads the last GeoIP lookup, or nil if none exists.
+func (s *Store) LoadLocation() (*domain.GeoLocation, error) {
+	return loadJSON[domain.GeoLocation](s, recLocation)
+}
+
+// SaveHardware persists the hardware snapshot the host is listed with.
+func (s *Store) SaveHardware(snap *domain.HardwareSnapshot) error {
+	return s.putJSON(recHardware, snap)
+}
+
+// LoadHardware loads the stored hardware snapshot, or nil if none exists.
+func (s *Store) LoadHardware() (*domain.HardwareSnapshot, error) {
+	return loadJSON[domain.HardwareSnapshot](s, recHardware)
+}
+
+// SaveHandoff persists the state passed to the next agent process.
+func (s *Store) SaveHandoff(h *domain.Handoff) error {
+	return s.putJSON(recHandoff, h)
+}
+
+// LoadHandoff loads the handoff left by the previous process, or nil.
+func (s *Store) LoadHandoff() (*domain.Handoff, error) {
+	return loadJSON[domain.Handoff](s, recHandoff)
+}
+
+// ClearHandoff removes the persisted handoff.
+func (s *Store) ClearHandoff() error {
+	return s.delete(recHandoff)
+}
+
+// SaveDesired persists the desired-state document and what was applied
+// from it.
+func (s *Store) SaveDesired(rec *domain.DesiredRecord) error {
+	return s.putJSON(recDesired, rec)
+}
+
+// LoadDesired loads the desired-state record, or nil when the host is not
+// managed declaratively.
+func (s *Store) LoadDesired() (*domain.DesiredRecord, error) {
+	return loadJSON[domain.DesiredRecord](s, recDesired)
+}
+
+// ClearDesired removes the desired-state record.
+func (s *Store) ClearDesired() error {
+	return s.delete(recDesired)
+}
+
+// SaveCreateJob persists the accepted create.
+func (s *Store) SaveCreateJob(job *domain.CreateJob) error {
+	return s.putJSON(recCreateJob, job)
+}
+
+// LoadCreateJob loads the create that has not finished, or nil.
+func (s *Store) LoadCreateJob() (*domain.CreateJob, error) {
+	return loadJSON[domain.CreateJob](s, recCreateJob)
+}
+
+// ClearCreateJob removes the create record if it belongs to job id, or
+// whatever record there is when id is empty. The check and the removal are
+// one transaction, so a newer job saved meanwhile is never removed.
+func (s *Store) ClearCreateJob(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recCreateJob.bucket)
+		if id != "" {
+			data := b.Get([]byte(recCreateJob.key))
+			if data == nil {
+				return nil
+			}
+			var job domain.CreateJob
+			if json.Unmarshal(data, &job) == nil && job.ID != id {
+				return nil
+			}
+		}
+		return b.Delete([]byte(recCreateJob.key))
+	})
+}
+
+// SavePendingEvents persists the events not yet accepted by the API.
+func (s *Store) SavePendingEvents(events []domain.Event) error {
+	return s.putJSON(recEvents, events)
+}
+
+// LoadPendingEvents loads the events left undelivered by a previous run.
+func (s *Store) LoadPendingEvents() ([]domain.Event, error) {
+	return loadSlice[domain.Event](s, recEvents)
+}
+
+// SaveIdempotencyRecords persists the outcomes of keyed creates.
+func (s *Store) SaveIdempotencyRecords(records []domain.IdempotencyRecord) error {
+	return s.putJSON(recIdempotency, records)
+}
+
+// LoadIdempotencyRecords loads the outcomes of keyed creates.
+func (s *Store) LoadIdempotencyRecords() ([]domain.IdempotencyRecord, error) {
+	return loadSlice[domain.IdempotencyRecord](s, recIdempotency)
+}
+
+// SaveProvisioning persists the progress of the latest create.
+func (s *Store) SaveProvisioning(p *domain.Provisioning) error {
+	return s.putJSON(recProvision, p)
+}
+
+// LoadProvisioning loads the progress of the latest create, or nil.
+func (s *Store) LoadProvisioning() (*domain.Provisioning, error) {
+	return loadJSON[domain.Provisioning](s, recProvision)
+}
+
+// ClearProvisioning removes the create progress.
+func (s *Store) ClearProvisioning() error {
+	return s.delete(recProvision)
+}
+
+// SavePortLeases persists the host ports held by the agent.
+func (s *Store) SavePortLeases(leases []domain.PortLease) error {
+	return s.putJSON(recPortLeases, leases)
+}
+
+// LoadPortLeases loads the host ports a previous run held.
+func (s *Store) LoadPortLeases() ([]domain.PortLease, error) {
+	return loadSlice[domain.PortLease](s, recPortLeases)
+}
+
+// Purge deletes the agent identity, credentials and persisted state and
+// returns what was removed: the database, when it held anything, and any
+// state file an interrupted migration left behind.
+func (s *Store) Purge() ([]string, error) {
+	var removed []string
+	had := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if tx.Bucket(name).Stats().KeyN > 0 {
+				had = true
+			}
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+		return nil, fmt.Errorf("purge %s: %w", s.db.Path(), err)
+	}
+	if had {
+		removed = append(removed, s.db.Path())
+	}
+
+	for _, r := range records {
+		if r.file == "" {
+			continue
+		}
+		path := filepath.Join(s.dataDir, r.file)
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, fmt.Errorf("remove %s: %w", path, err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+func (s *Store) put(r record, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(r.bucket).Put([]byte(r.key), data)
+	})
+}
+
+// get returns a copy of the value of r, or nil when it is unset.
+func (s *Store) get(r record) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(r.bucket).Get([]byte(r.key)); v != nil {
+			data = append([]byte(nil), v...)
 		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *Store) delete(r record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(r.bucket).Delete([]byte(r.key))
+	})
+}
+
+func (s *Store) putJSON(r record, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", r.key, err)
+	}
+	return s.put(r, data)
+}
+
+// loadJSON decodes the value of r, or returns nil when it is unset.
+func loadJSON[T any](s *Store, r record) (*T, error) {
+	data, err := s.get(r)
+	if err != nil || data == nil {
 		return nil, err
 	}
-	var state domain.InstanceState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("unmarshal instance state: %w", err)
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", r.key, err)
 	}
-	return &state, nil
+	return &v, nil
 }
 
-// ClearInstanceState removes the persisted instance state.
-func (s *Store) ClearInstanceState() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	path := filepath.Join(s.dataDir, "instance_state.json")
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return err
+func loadSlice[T any](s *Store, r record) ([]T, error) {
+	p, err := loadJSON[[]T](s, r)
+	if err != nil || p == nil {
+		return nil, err
 	}
-	return nil
+	return *p, nil
 }
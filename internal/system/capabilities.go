@@ -0,0 +1,126 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// Capabilities probes the kernel and virtualization features of the host.
+// Missing sysfs entries are reported as unsupported rather than as errors.
+func Capabilities() domain.HostCapabilities {
+	vendor, flags := cpuVendorFlags()
+	caps := domain.HostCapabilities{
+		KernelVersion: readTrimmed("/proc/sys/kernel/osrelease"),
+		KVM:           exists("/dev/kvm"),
+		IOMMUType:     iommuType(),
+		IOMMUGroups:   countEntries("/sys/kernel/iommu_groups"),
+		HugepageSizes: hugepageSizes(),
+		CPUVendor:     vendor,
+		CPUFlags:      flags,
+	}
+
+	switch vendor {
+	case "GenuineIntel":
+		caps.NestedVirt = moduleParamEnabled("kvm_intel", "nested")
+		caps.TDX = moduleParamEnabled("kvm_intel", "tdx")
+	case "AuthenticAMD":
+		caps.NestedVirt = moduleParamEnabled("kvm_amd", "nested")
+		caps.SEV = moduleParamEnabled("kvm_amd", "sev")
+		caps.SEVES = moduleParamEnabled("kvm_amd", "sev_es")
+		caps.SEVSNP = moduleParamEnabled("kvm_amd", "sev_snp")
+	}
+	return caps
+}
+
+func cpuVendorFlags() (string, []string) {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return "unknown", nil
+	}
+	vendor := "unknown"
+	var flags []string
+	for _, line := range strings.Split(string(data), "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "vendor_id":
+			vendor = strings.TrimSpace(val)
+		case "flags":
+			flags = strings.Fields(val)
+		}
+		// The first processor block is representative for the whole host.
+		if vendor != "unknown" && flags != nil {
+			break
+		}
+	}
+	sort.Strings(flags)
+	return vendor, flags
+}
+
+func iommuType() string {
+	entries, err := os.ReadDir("/sys/class/iommu")
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		switch {
+		case strings.HasPrefix(e.Name(), "dmar"):
+			return "intel-vt-d"
+		case strings.HasPrefix(e.Name(), "ivhd"):
+			return "amd-vi"
+		}
+	}
+	return ""
+}
+
+func hugepageSizes() []int {
+	entries, err := os.ReadDir("/sys/kernel/mm/hugepages")
+	if err != nil {
+		return nil
+	}
+	var sizes []int
+	for _, e := range entries {
+		s := strings.TrimSuffix(strings.TrimPrefix(e.Name(), "hugepages-"), "kB")
+		if kb, err := strconv.Atoi(s); err == nil {
+			sizes = append(sizes, kb)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+func moduleParamEnabled(module, param string) bool {
+	switch readTrimmed(filepath.Join("/sys/module", module, "parameters", param)) {
+	case "Y", "y", "1":
+		return true
+	}
+	return false
+}
+
+func readTrimmed(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func countEntries(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
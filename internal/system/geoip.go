@@ -0,0 +1,66 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// LookupLocation resolves ip to a location with the GeoIP service at
+// urlTemplate, in which {ip} stands for the address. The field names of the
+// common services are understood: ipapi.co (city, region, country_name) and
+// ip-api.com (city, regionName, country).
+func LookupLocation(ctx context.Context, urlTemplate, ip string) (domain.HostLocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	u := strings.ReplaceAll(urlTemplate, "{ip}", url.PathEscape(ip))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return domain.HostLocation{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return domain.HostLocation{}, fmt.Errorf("geoip lookup: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return domain.HostLocation{}, fmt.Errorf("geoip lookup: status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		City        string `json:"city"`
+		Region      string `json:"region"`
+		RegionName  string `json:"regionName"`
+		Country     string `json:"country"`
+		CountryName string `json:"country_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return domain.HostLocation{}, fmt.Errorf("geoip lookup: decode: %w", err)
+	}
+	loc := domain.HostLocation{
+		City:    body.City,
+		Country: firstNonEmpty(body.CountryName, body.Country),
+		Region:  firstNonEmpty(body.RegionName, body.Region),
+	}
+	if loc == (domain.HostLocation{}) {
+		return loc, fmt.Errorf("geoip lookup: no location for %s", ip)
+	}
+	return loc, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const pciDevices = "/sys/bus/pci/devices"
+
+// Tolerances below which RAM and disk sizes are considered unchanged; the
+// kernel's reserved memory moves MemTotal slightly between boots.
+const (
+	ramToleranceGB  = 2
+	diskToleranceGB = 5
+)
+
+// Hardware snapshots the hardware of a host registration together with the
+// GPU PCI topology.
+func Hardware(req domain.CreateHostRequest) domain.HardwareSnapshot {
+	snap := domain.HardwareSnapshot{
+		GPUs:     gpuTopology(),
+		GPUName:  req.GPUName,
+		GPUCount: req.GPUAmount,
+		VRAM:     req.VRAM,
+		CPUName:  req.Configuration.CPUName,
+		CPUCores: req.Configuration.CPUCores,
+		RAMGB:    req.Configuration.RAM.Amount,
+		DiskGB:   req.Configuration.Disk.Amount,
+		Time:     time.Now().UTC(),
+	}
+	snap.Fingerprint = fingerprint(snap)
+	return snap
+}
+
+// gpuTopology lists the physical display controllers on the PCI bus.
+// SR-IOV virtual functions come and go with configuration and are skipped.
+func gpuTopology() []domain.PCIDevice {
+	entries, err := os.ReadDir(pciDevices)
+	if err != nil {
+		return nil
+	}
+	var out []domain.PCIDevice
+	for _, e := range entries {
+		dir := filepath.Join(pciDevices, e.Name())
+		class := strings.TrimPrefix(readTrimmed(filepath.Join(dir, "class")), "0x")
+		if !strings.HasPrefix(class, "0300") && !strings.HasPrefix(class, "0302") {
+			continue
+		}
+		if exists(filepath.Join(dir, "physfn")) {
+			continue
+		}
+		dev := domain.PCIDevice{
+			Addr:      e.Name(),
+			Vendor:    readTrimmed(filepath.Join(dir, "vendor")),
+			Device:    readTrimmed(filepath.Join(dir, "device")),
+			Subsystem: readTrimmed(filepath.Join(dir, "subsystem_device")),
+			NUMANode:  -1,
+		}
+		if n, err := strconv.Atoi(readTrimmed(filepath.Join(dir, "numa_node"))); err == nil {
+			dev.NUMANode = n
+		}
+		if link, err := os.Readlink(filepath.Join(dir, "iommu_group")); err == nil {
+			dev.IOMMUGroup = filepath.Base(link)
+		}
+		out = append(out, dev)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// fingerprint hashes the parts of a snapshot that identify the hardware,
+// with sizes rounded so that noise does not change it.
+func fingerprint(s domain.HardwareSnapshot) string {
+	h := sha256.New()
+	for _, g := range s.GPUs {
+		fmt.Fprintf(h, "gpu %s %s:%s:%s numa=%d iommu=%s\n",
+			g.Addr, g.Vendor, g.Device, g.Subsystem, g.NUMANode, g.IOMMUGroup)
+	}
+	fmt.Fprintf(h, "gpu-model %s x%d %.0f\n", s.GPUName, s.GPUCount, s.VRAM)
+	fmt.Fprintf(h, "cpu %s x%d\n", s.CPUName, s.CPUCores)
+	fmt.Fprintf(h, "ram %.0f\n", roundTo(s.RAMGB, ramToleranceGB))
+	fmt.Fprintf(h, "disk %.0f\n", roundTo(s.DiskGB, diskToleranceGB))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func roundTo(v, step float64) float64 {
+	return math.Round(v/step) * step
+}
+
+// DiffHardware lists what changed from prev to cur.
+func DiffHardware(prev, cur domain.HardwareSnapshot) []domain.HardwareChange {
+	var changes []domain.HardwareChange
+
+	old := make(map[string]domain.PCIDevice, len(prev.GPUs))
+	for _, g := range prev.GPUs {
+		old[g.Addr] = g
+	}
+	for _, g := range cur.GPUs {
+		p, ok := old[g.Addr]
+		delete(old, g.Addr)
+		switch {
+		case !ok:
+			changes = append(changes, domain.HardwareChange{Component: "gpu", Kind: "added", Addr: g.Addr, New: pciID(g)})
+		case pciID(p) != pciID(g):
+			changes = append(changes, domain.HardwareChange{Component: "gpu", Kind: "replaced", Addr: g.Addr, Old: pciID(p), New: pciID(g)})
+		}
+	}
+	for addr, p := range old {
+		changes = append(changes, domain.HardwareChange{Component: "gpu", Kind: "removed", Addr: addr, Old: pciID(p)})
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Addr < changes[j].Addr })
+
+	if prev.GPUName != cur.GPUName || prev.GPUCount != cur.GPUCount || prev.VRAM != cur.VRAM {
+		changes = append(changes, domain.HardwareChange{
+			Component: "gpu", Kind: "changed",
+			Old: fmt.Sprintf("%dx %s %.0fGB", prev.GPUCount, prev.GPUName, prev.VRAM),
+			New: fmt.Sprintf("%dx %s %.0fGB", cur.GPUCount, cur.GPUName, cur.VRAM),
+		})
+	}
+	if prev.CPUName != cur.CPUName || prev.CPUCores != cur.CPUCores {
+		changes = append(changes, domain.HardwareChange{
+			Component: "cpu", Kind: "changed",
+			Old: fmt.Sprintf("%s x%d", prev.CPUName, prev.CPUCores),
+			New: fmt.Sprintf("%s x%d", cur.CPUName, cur.CPUCores),
+		})
+	}
+	if math.Abs(prev.RAMGB-cur.RAMGB) > ramToleranceGB {
+		changes = append(changes, domain.HardwareChange{
+			Component: "ram", Kind: "changed",
+			Old: fmt.Sprintf("%.0fGB", prev.RAMGB), New: fmt.Sprintf("%.0fGB", cur.RAMGB),
+		})
+	}
+	if math.Abs(prev.DiskGB-cur.DiskGB) > diskToleranceGB {
+		changes = append(changes, domain.HardwareChange{
+			Component: "disk", Kind: "changed",
+			Old: fmt.Sprintf("%.0fGB", prev.DiskGB), New: fmt.Sprintf("%.0fGB", cur.DiskGB),
+		})
+	}
+	return changes
+}
+
+func pciID(d domain.PCIDevice) string {
+	id := d.Vendor + ":" + d.Device
+	if d.Subsystem != "" {
+		id += ":" + d.Subsystem
+	}
+	return id
+}
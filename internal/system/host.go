@@ -0,0 +1,162 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CPUTimes is an aggregate sample of the "cpu" line in /proc/stat.
+type CPUTimes struct {
+	Busy  uint64
+	Total uint64
+}
+
+// ReadCPUTimes samples aggregate CPU jiffies from /proc/stat.
+func ReadCPUTimes() (CPUTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return CPUTimes{}, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if t, ok := parseCPULine(sc.Text()); ok {
+			return t, nil
+		}
+	}
+	return CPUTimes{}, fmt.Errorf("cpu line not found in /proc/stat")
+}
+
+// parseCPULine parses the aggregate "cpu" line of /proc/stat. Only user
+// through steal are summed: guest and guest_nice, which follow, are already
+// counted in user and nice, and adding them again would count the time spent
+// running KVM guests twice.
+func parseCPULine(line string) (CPUTimes, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return CPUTimes{}, false
+	}
+	var t CPUTimes
+	for i, v := range fields[1:min(len(fields), 9)] {
+		n, _ := strconv.ParseUint(v, 10, 64)
+		t.Total += n
+		// idle (4th) and iowait (5th) do not count as busy time.
+		if i != 3 && i != 4 {
+			t.Busy += n
+		}
+	}
+	return t, true
+}
+
+// UtilizationSince returns busy percentage between prev and t. A zero prev
+// yields the average since boot.
+func (t CPUTimes) UtilizationSince(prev CPUTimes) float64 {
+	total := t.Total - prev.Total
+	if total == 0 || t.Total < prev.Total {
+		return 0
+	}
+	return float64(t.Busy-prev.Busy) / float64(total) * 100
+}
+
+// MemoryInfo is a subset of /proc/meminfo in bytes.
+type MemoryInfo struct {
+	TotalBytes     uint64
+	AvailableBytes uint64
+	// HugepagesFreeBytes is the memory in free default-size huge pages.
+	HugepagesFreeBytes uint64
+}
+
+// ReadMemory reads MemTotal, MemAvailable and the free huge pages from
+// /proc/meminfo.
+func ReadMemory() (MemoryInfo, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return MemoryInfo{}, err
+	}
+	var mi MemoryInfo
+	var hugeFree, hugeKB uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			mi.TotalBytes = kb * 1024
+		case "MemAvailable:":
+			mi.AvailableBytes = kb * 1024
+		case "HugePages_Free:":
+			hugeFree = kb
+		case "Hugepagesize:":
+			hugeKB = kb
+		}
+	}
+	mi.HugepagesFreeBytes = hugeFree * hugeKB * 1024
+	return mi, nil
+}
+
+// NetCounters holds cumulative byte counters for one network interface.
+type NetCounters struct {
+	Name    string
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// ReadNetCounters parses /proc/net/dev, skipping the loopback interface.
+func ReadNetCounters() ([]NetCounters, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	var out []NetCounters
+	for _, line := range strings.Split(string(data), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "lo" {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		out = append(out, NetCounters{Name: name, RxBytes: rx, TxBytes: tx})
+	}
+	return out, nil
+}
+
+// DiskUsage describes the filesystem holding a path.
+type DiskUsage struct {
+	TotalBytes     uint64
+	AvailableBytes uint64
+}
+
+// UsedPercent returns the share of the filesystem that is not available.
+func (d DiskUsage) UsedPercent() float64 {
+	if d.TotalBytes == 0 {
+		return 0
+	}
+	return float64(d.TotalBytes-d.AvailableBytes) / float64(d.TotalBytes) * 100
+}
+
+// ReadDiskUsage returns usage of the filesystem containing path.
+func ReadDiskUsage(path string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskUsage{}, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	return DiskUsage{
+		TotalBytes:     st.Blocks * uint64(st.Bsize),
+		AvailableBytes: st.Bavail * uint64(st.Bsize),
+	}, nil
+}
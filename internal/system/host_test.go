@@ -0,0 +1,26 @@
+package system
+
+import "testing"
+
+func TestParseCPULineSkipsGuestTime(t *testing.T) {
+	// user nice system idle iowait irq softirq steal guest guest_nice: the
+	// 600 jiffies of guest time are part of user already.
+	got, ok := parseCPULine("cpu  1000 10 200 5000 100 20 30 0 600 5")
+	if !ok {
+		t.Fatal("cpu line not parsed")
+	}
+	want := CPUTimes{Busy: 1000 + 10 + 200 + 20 + 30, Total: 1000 + 10 + 200 + 5000 + 100 + 20 + 30}
+	if got != want {
+		t.Fatalf("parseCPULine = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseCPULineOldKernel(t *testing.T) {
+	got, ok := parseCPULine("cpu 100 0 50 800 50")
+	if !ok || got != (CPUTimes{Busy: 150, Total: 1000}) {
+		t.Fatalf("parseCPULine = %+v, %v", got, ok)
+	}
+	if _, ok := parseCPULine("cpu0 1 2 3 4 5"); ok {
+		t.Fatal("per-CPU line parsed as the aggregate")
+	}
+}
@@ -0,0 +1,65 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// ksmDir is the kernel same-page merging interface.
+const ksmDir = "/sys/kernel/mm/ksm"
+
+// EnableKSM starts kernel same-page merging, scanning pagesToScan pages
+// each time ksmd wakes up. QEMU marks guest RAM mergeable by default.
+func EnableKSM(pagesToScan int) error {
+	return enableKSM(ksmDir, pagesToScan)
+}
+
+func enableKSM(dir string, pagesToScan int) error {
+	if err := os.WriteFile(filepath.Join(dir, "pages_to_scan"), []byte(strconv.Itoa(pagesToScan)), 0o644); err != nil {
+		return fmt.Errorf("set KSM pages_to_scan: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "run"), []byte("1"), 0o644); err != nil {
+		return fmt.Errorf("start KSM: %w", err)
+	}
+	return nil
+}
+
+// ReadKSM returns the merging counters, or nil when KSM is not running.
+func ReadKSM() (*domain.KSMStats, error) {
+	return readKSM(ksmDir)
+}
+
+func readKSM(dir string) (*domain.KSMStats, error) {
+	read := func(name string) (uint64, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	run, err := read("run")
+	if err != nil {
+		return nil, err
+	}
+	if run != 1 {
+		return nil, nil
+	}
+	var s domain.KSMStats
+	for name, dst := range map[string]*uint64{
+		"pages_shared":   &s.PagesShared,
+		"pages_sharing":  &s.PagesSharing,
+		"pages_unshared": &s.PagesUnshared,
+		"full_scans":     &s.FullScans,
+	} {
+		if *dst, err = read(name); err != nil {
+			return nil, err
+		}
+	}
+	s.SavedBytes = s.PagesSharing * uint64(os.Getpagesize())
+	return &s, nil
+}
@@ -0,0 +1,55 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKSMFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, v := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(v+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestEnableKSM(t *testing.T) {
+	dir := writeKSMFiles(t, map[string]string{"run": "0", "pages_to_scan": "100"})
+	if err := enableKSM(dir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"run": "1", "pages_to_scan": "1000"} {
+		got, _ := os.ReadFile(filepath.Join(dir, name))
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadKSM(t *testing.T) {
+	dir := writeKSMFiles(t, map[string]string{
+		"run": "1", "pages_shared": "10", "pages_sharing": "250",
+		"pages_unshared": "40", "full_scans": "3",
+	})
+	s, err := readKSM(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || s.PagesShared != 10 || s.PagesSharing != 250 || s.PagesUnshared != 40 || s.FullScans != 3 {
+		t.Fatalf("stats = %+v", s)
+	}
+	if want := 250 * uint64(os.Getpagesize()); s.SavedBytes != want {
+		t.Errorf("SavedBytes = %d, want %d", s.SavedBytes, want)
+	}
+}
+
+func TestReadKSMStopped(t *testing.T) {
+	dir := writeKSMFiles(t, map[string]string{"run": "0"})
+	if s, err := readKSM(dir); err != nil || s != nil {
+		t.Fatalf("readKSM = %+v, %v; want nil, nil", s, err)
+	}
+}
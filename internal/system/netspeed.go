@@ -0,0 +1,189 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const sysClassNet = "/sys/class/net"
+
+// maxNetDepth bounds the bridge/bond/VLAN nesting that is followed.
+const maxNetDepth = 4
+
+// Uplinks returns the interfaces carrying the default route, resolved
+// through bridges, bonds and VLANs down to the physical links. Without a
+// default route every physical interface that is up is reported.
+func Uplinks() []domain.NetInterface {
+	names := defaultRouteInterfaces()
+	if len(names) == 0 {
+		entries, _ := os.ReadDir(sysClassNet)
+		for _, e := range entries {
+			if isPhysical(e.Name()) && operUp(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	var out []domain.NetInterface
+	for _, name := range names {
+		out = append(out, describeInterface(name, 0))
+	}
+	return out
+}
+
+// NetworkSpeed estimates the host's downlink and uplink in Mbps. A network
+// test, when available, measures the real path; it is capped by the link
+// capacity. Without one the link capacity is used for both directions.
+// Unknown values are 0 rather than a made-up figure.
+func NetworkSpeed(uplinks []domain.NetInterface, test *domain.NetTestResult) (in, out float64) {
+	var capacity float64
+	for _, u := range uplinks {
+		capacity += u.SpeedMbps
+	}
+	in, out = capacity, capacity
+
+	if test == nil {
+		return in, out
+	}
+	var down, up float64
+	for _, t := range test.Targets {
+		if t.Error != "" {
+			continue
+		}
+		down = max(down, t.DownloadMbps)
+		up = max(up, t.UploadMbps)
+	}
+	if down > 0 {
+		in = capTo(down, capacity)
+	}
+	if up > 0 {
+		out = capTo(up, capacity)
+	}
+	return in, out
+}
+
+func capTo(v, limit float64) float64 {
+	if limit > 0 && v > limit {
+		return limit
+	}
+	return v
+}
+
+// defaultRouteInterfaces parses /proc/net/route for IPv4 default routes.
+func defaultRouteInterfaces() []string {
+	data, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+			continue
+		}
+		if !seen[f[0]] {
+			seen[f[0]] = true
+			out = append(out, f[0])
+		}
+	}
+	return out
+}
+
+func describeInterface(name string, depth int) domain.NetInterface {
+	dir := filepath.Join(sysClassNet, name)
+	iface := domain.NetInterface{Name: name, Kind: "physical"}
+	if depth >= maxNetDepth {
+		return iface
+	}
+
+	switch {
+	case exists(filepath.Join(dir, "bonding")):
+		iface.Kind = "bond"
+		slaves, _ := os.ReadFile(filepath.Join(dir, "bonding", "slaves"))
+		mode, _ := os.ReadFile(filepath.Join(dir, "bonding", "mode"))
+		// active-backup and broadcast carry traffic over one link at a time.
+		single := strings.HasPrefix(string(mode), "active-backup") || strings.HasPrefix(string(mode), "broadcast")
+		for _, s := range strings.Fields(string(slaves)) {
+			m := describeInterface(s, depth+1)
+			iface.Members = append(iface.Members, m)
+			if !operUp(s) {
+				continue
+			}
+			if single {
+				iface.SpeedMbps = max(iface.SpeedMbps, m.SpeedMbps)
+			} else {
+				iface.SpeedMbps += m.SpeedMbps
+			}
+		}
+
+	case exists(filepath.Join(dir, "bridge")):
+		iface.Kind = "bridge"
+		ports, _ := os.ReadDir(filepath.Join(dir, "brif"))
+		for _, p := range ports {
+			// Taps and veths of local guests are not uplinks.
+			if !isPhysical(p.Name()) && !exists(filepath.Join(sysClassNet, p.Name(), "bonding")) && lowers(p.Name()) == nil {
+				continue
+			}
+			m := describeInterface(p.Name(), depth+1)
+			iface.Members = append(iface.Members, m)
+			if operUp(p.Name()) {
+				iface.SpeedMbps = max(iface.SpeedMbps, m.SpeedMbps)
+			}
+		}
+
+	case lowers(name) != nil:
+		iface.Kind = "vlan"
+		for _, l := range lowers(name) {
+			m := describeInterface(l, depth+1)
+			iface.Members = append(iface.Members, m)
+			iface.SpeedMbps = max(iface.SpeedMbps, m.SpeedMbps)
+		}
+
+	default:
+		iface.SpeedMbps = linkSpeed(name)
+	}
+	return iface
+}
+
+// linkSpeed returns the negotiated speed of a physical link, or 0 when the
+// link is down or the driver does not report it (virtio, some NICs).
+func linkSpeed(name string) float64 {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, name, "speed"))
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return float64(n)
+}
+
+// lowers returns the devices a stacked interface (VLAN, macvlan) sits on.
+func lowers(name string) []string {
+	matches, _ := filepath.Glob(filepath.Join(sysClassNet, name, "lower_*"))
+	var out []string
+	for _, m := range matches {
+		out = append(out, strings.TrimPrefix(filepath.Base(m), "lower_"))
+	}
+	return out
+}
+
+func isPhysical(name string) bool {
+	return exists(filepath.Join(sysClassNet, name, "device"))
+}
+
+func operUp(name string) bool {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, name, "operstate"))
+	if err != nil {
+		return false
+	}
+	state := strings.TrimSpace(string(data))
+	// Some virtual and older drivers never report "up".
+	return state == "up" || state == "unknown"
+}
@@ -35,20 +35,26 @@ func (p *Probe) HostRegistration(ctx context.Context) domain.CreateHostRequest {
 		}
 	}
 
+	uplinks := Uplinks()
+	ethIn, ethOut := NetworkSpeed(uplinks, nil)
+
 	return domain.CreateHostRequest{
 		GPUName:   gpuInfo.Name,
 		GPUAmount: gpuInfo.Count,
 		VRAM:      gpuInfo.VRAM,
 		MaxCUDA:   gpuInfo.MaxCUDA,
-		Location:  detectLocation(),
 		Configuration: domain.HostConfig{
-			RAM:            domain.ResourceUnit{Amount: ramGB, Unit: "gb"},
-			Disk:           domain.ResourceUnit{Amount: diskGB, Unit: "gb"},
-			CPUName:        cpuName(),
-			CPUCores:       runtime.NumCPU(),
-			CPUFreq:        cpuFreqGHz(),
-			MaxCUDAVersion: gpuInfo.MaxCUDA,
+			RAM:               domain.ResourceUnit{Amount: ramGB, Unit: "gb"},
+			Disk:              domain.ResourceUnit{Amount: diskGB, Unit: "gb"},
+			CPUName:           cpuName(),
+			CPUCores:          runtime.NumCPU(),
+			CPUFreq:           cpuFreqGHz(),
+			EthernetIn:        ethIn,
+			EthernetOut:       ethOut,
+			NetworkInterfaces: uplinks,
+			MaxCUDAVersion:    gpuInfo.MaxCUDA,
 		},
+		Capabilities: Capabilities(),
 	}
 }
 
@@ -157,11 +163,3 @@ func cpuFreqGHz() float64 {
 	}
 	return 0
 }
-
-func detectLocation() domain.HostLocation {
-	return domain.HostLocation{
-		City:    "",
-		Country: "",
-		Region:  "",
-	}
-}
@@ -0,0 +1,45 @@
+package system
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SDNotify sends state (e.g. "READY=1") to the service manager over
+// NOTIFY_SOCKET. It returns false without an error when the agent does not run
+// under systemd with Type=notify.
+func SDNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SDWatchdogInterval returns the watchdog timeout systemd expects to be
+// petted within (WatchdogSec=), or 0 when the watchdog is off or meant for
+// another process.
+func SDWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -15,7 +15,9 @@ func NewStatsCollector(vm domain.VMManager) *StatsCollector {
 }
 
 func (c *StatsCollector) Collect(ctx context.Context) domain.StatsReport {
+	status := c.vm.Status(ctx)
 	return domain.StatsReport{
-		Status: c.vm.Status(ctx),
+		Status:       status.Status,
+		StatusReason: status.Reason,
 	}
 }
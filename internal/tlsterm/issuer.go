@@ -0,0 +1,277 @@
+// Package tlsterm obtains ACME certificates for instance HTTP endpoints and
+// terminates TLS locally in front of the guest's forwarded port.
+package tlsterm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// renewBefore is how long before expiry a cached certificate is replaced.
+const renewBefore = 30 * 24 * time.Hour
+
+// DNSProvider publishes DNS-01 challenge records. The control plane owns the
+// instance zones, so the agent delegates the TXT record to it.
+type DNSProvider interface {
+	SetDNSChallenge(ctx context.Context, ch domain.DNSChallenge) error
+	ClearDNSChallenge(ctx context.Context, ch domain.DNSChallenge) error
+}
+
+// Issuer obtains certificates through ACME DNS-01 and caches them with their
+// keys under dir, one PEM pair per domain.
+type Issuer struct {
+	directoryURL string
+	email        string
+	dir          string
+	dns          DNSProvider
+	logger       *slog.Logger
+
+	mu     sync.Mutex
+	client *acme.Client
+}
+
+// NewIssuer creates an Issuer. The ACME account is registered lazily on the
+// first issuance.
+func NewIssuer(directoryURL, email, dir string, dns DNSProvider, logger *slog.Logger) *Issuer {
+	return &Issuer{
+		directoryURL: directoryURL,
+		email:        email,
+		dir:          dir,
+		dns:          dns,
+		logger:       logger,
+	}
+}
+
+// Certificate returns a certificate for fqdn, issuing a new one when none is
+// cached or the cached one is close to expiry.
+func (i *Issuer) Certificate(ctx context.Context, fqdn string) (*tls.Certificate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if cert, err := i.loadCached(fqdn); err == nil && time.Until(cert.Leaf.NotAfter) > renewBefore {
+		return cert, nil
+	}
+
+	i.logger.Info("requesting ACME certificate", "domain", fqdn)
+	cert, err := i.issue(ctx, fqdn)
+	if err != nil {
+		return nil, fmt.Errorf("issue certificate for %s: %w", fqdn, err)
+	}
+	i.logger.Info("ACME certificate issued", "domain", fqdn, "not_after", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+func (i *Issuer) issue(ctx context.Context, fqdn string) (*tls.Certificate, error) {
+	client, err := i.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(fqdn))
+	if err != nil {
+		return nil, fmt.Errorf("authorize order: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, u); err != nil {
+			return nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("wait order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{fqdn}}, key)
+	if err != nil {
+		return nil, fmt.Errorf("create csr: %w", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalize order: %w", err)
+	}
+
+	if err := i.saveCached(fqdn, der, key); err != nil {
+		return nil, err
+	}
+	return i.loadCached(fqdn)
+}
+
+func (i *Issuer) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return fmt.Errorf("compute dns-01 record: %w", err)
+	}
+	record := domain.DNSChallenge{
+		FQDN:  "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*."),
+		Value: value,
+	}
+	if err := i.dns.SetDNSChallenge(ctx, record); err != nil {
+		return fmt.Errorf("publish dns-01 record: %w", err)
+	}
+	defer func() {
+		if err := i.dns.ClearDNSChallenge(context.WithoutCancel(ctx), record); err != nil {
+			i.logger.Warn("failed to clear dns-01 record", "fqdn", record.FQDN, "err", err)
+		}
+	}()
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("wait authorization: %w", err)
+	}
+	return nil
+}
+
+// acmeClient returns the registered ACME client, creating the account key
+// and registering it on first use.
+func (i *Issuer) acmeClient(ctx context.Context) (*acme.Client, error) {
+	if i.client != nil {
+		return i.client, nil
+	}
+
+	key, err := i.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: i.directoryURL}
+
+	acct := &acme.Account{}
+	if i.email != "" {
+		acct.Contact = []string{"mailto:" + i.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register ACME account: %w", err)
+	}
+
+	i.client = client
+	return client, nil
+}
+
+func (i *Issuer) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(i.dir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		return parseKey(data)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	data, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return nil, fmt.Errorf("create tls dir: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("write account key: %w", err)
+	}
+	return key, nil
+}
+
+func (i *Issuer) loadCached(fqdn string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(i.certPath(fqdn), i.keyPath(fqdn))
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (i *Issuer) saveCached(fqdn string, der [][]byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return fmt.Errorf("create tls dir: %w", err)
+	}
+
+	var chain []byte
+	for _, b := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The key is written first so a crash never leaves a new certificate
+	// next to the previous key.
+	if err := writeAtomic(i.keyPath(fqdn), keyPEM); err != nil {
+		return fmt.Errorf("write certificate key: %w", err)
+	}
+	if err := writeAtomic(i.certPath(fqdn), chain); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+	return nil
+}
+
+func (i *Issuer) certPath(fqdn string) string { return filepath.Join(i.dir, fqdn+".crt") }
+func (i *Issuer) keyPath(fqdn string) string  { return filepath.Join(i.dir, fqdn+".key") }
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("account key is not PEM")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse account key: %w", err)
+	}
+	return key, nil
+}
+
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,183 @@
+package tlsterm
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+const (
+	renewInterval    = 12 * time.Hour
+	handshakeTimeout = 10 * time.Second
+)
+
+// Terminator runs one TLS listener per instance endpoint and forwards the
+// decrypted stream to the guest port. Connections are spliced at the TCP
+// level, so websockets and streaming responses pass through unchanged.
+type Terminator struct {
+	issuer *Issuer
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	endpoints map[int]*endpoint // keyed by listen port
+}
+
+type endpoint struct {
+	spec domain.TLSEndpoint
+	ln   net.Listener
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func NewTerminator(issuer *Issuer, logger *slog.Logger) *Terminator {
+	return &Terminator{
+		issuer:    issuer,
+		logger:    logger,
+		endpoints: make(map[int]*endpoint),
+	}
+}
+
+// Start obtains a certificate for ep.Domain and begins serving it on
+// 127.0.0.1:ep.ListenPort. Issuance may take a while on first use.
+func (t *Terminator) Start(ctx context.Context, ep domain.TLSEndpoint) error {
+	cert, err := t.issuer.Certificate(ctx, ep.Domain)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ep.ListenPort)))
+	if err != nil {
+		return fmt.Errorf("listen tls terminator: %w", err)
+	}
+
+	e := &endpoint{spec: ep, ln: ln}
+	e.cert.Store(cert)
+
+	t.mu.Lock()
+	if old := t.endpoints[ep.ListenPort]; old != nil {
+		old.ln.Close()
+	}
+	t.endpoints[ep.ListenPort] = e
+	t.mu.Unlock()
+
+	go t.serve(e)
+	t.logger.Info("tls terminator started", "domain", ep.Domain, "listen", ep.ListenPort, "target", ep.TargetPort)
+	return nil
+}
+
+// StopAll closes every listener. Established connections are left to drain.
+func (t *Terminator) StopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for port, e := range t.endpoints {
+		e.ln.Close()
+		delete(t.endpoints, port)
+	}
+}
+
+// Endpoints returns the endpoints currently being served.
+func (t *Terminator) Endpoints() []domain.TLSEndpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]domain.TLSEndpoint, 0, len(t.endpoints))
+	for _, e := range t.endpoints {
+		out = append(out, e.spec)
+	}
+	return out
+}
+
+// Run renews certificates of active endpoints until ctx is cancelled.
+func (t *Terminator) Run(ctx context.Context) {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		active := make([]*endpoint, 0, len(t.endpoints))
+		for _, e := range t.endpoints {
+			active = append(active, e)
+		}
+		t.mu.Unlock()
+
+		for _, e := range active {
+			cert, err := t.issuer.Certificate(ctx, e.spec.Domain)
+			if err != nil {
+				t.logger.Error("certificate renewal failed", "domain", e.spec.Domain, "err", err)
+				continue
+			}
+			e.cert.Store(cert)
+		}
+	}
+}
+
+func (t *Terminator) serve(e *endpoint) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return e.cert.Load(), nil
+		},
+	}
+	target := net.JoinHostPort("127.0.0.1", strconv.Itoa(e.spec.TargetPort))
+
+	for {
+		conn, err := e.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				t.logger.Warn("tls terminator accept failed", "domain", e.spec.Domain, "err", err)
+			}
+			return
+		}
+		go t.forward(tls.Server(conn, cfg), target)
+	}
+}
+
+func (t *Terminator) forward(client *tls.Conn, target string) {
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := client.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		t.logger.Debug("tls handshake failed", "remote", client.RemoteAddr(), "err", err)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", target, handshakeTimeout)
+	if err != nil {
+		t.logger.Warn("tls terminator upstream unreachable", "target", target, "err", err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		if tc, ok := upstream.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		_ = client.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
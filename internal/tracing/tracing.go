@@ -0,0 +1,126 @@
+// Package tracing exports OpenTelemetry spans of instance creation over OTLP
+// and carries the W3C trace context of the request that started a create to
+// the worker that boots it. Without an endpoint the global no-op tracer stays
+// in place and spans cost next to nothing.
+package tracing
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "qudata-agent"
+	tracerName  = "github.com/qudata/agent"
+)
+
+// Setup installs an OTLP/HTTP exporter sending to endpoint, a collector URL
+// such as http://otel-collector:4318; /v1/traces is used when it has no
+// path. The returned function flushes and stops the exporter. An empty
+// endpoint disables export.
+func Setup(ctx context.Context, endpoint, version string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the agent's tracer.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject returns the trace context of ctx as W3C headers (traceparent,
+// tracestate), or nil if ctx carries no span.
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns ctx continuing the trace in carrier, as returned by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Phases times the consecutive steps of one operation as sibling spans:
+// each Next ends the step before. The zero value is not usable; see
+// NewPhases.
+type Phases struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// NewPhases returns phases whose spans are children of the span in ctx.
+func NewPhases(ctx context.Context) *Phases {
+	return &Phases{ctx: ctx}
+}
+
+// Next ends the current step and starts the step name.
+func (p *Phases) Next(name string, attrs ...attribute.KeyValue) {
+	p.End()
+	_, p.span = Start(p.ctx, name, attrs...)
+}
+
+// End ends the current step, if any.
+func (p *Phases) End() {
+	if p.span != nil {
+		p.span.End()
+		p.span = nil
+	}
+}
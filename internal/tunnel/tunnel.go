@@ -0,0 +1,165 @@
+// Package tunnel publishes the agent API and the instance ports to the
+// control plane. FRP is the default provider; WireGuard serves deployments
+// without frp servers.
+package tunnel
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+	"github.com/qudata/agent/internal/metrics"
+)
+
+// Provider names accepted in the configuration.
+const (
+	ProviderFRP       = "frp"
+	ProviderWireGuard = "wireguard"
+)
+
+const healthInterval = 15 * time.Second
+
+// Provider is a tunnel backend. Instance ports are described as frpc
+// proxies whatever the backend, since that is also their persisted form.
+type Provider interface {
+	// Start brings the tunnel up and publishes the agent API served at
+	// agentIP:agentPort, over TLS if agentTLS is set.
+	Start(agentID, tunnelToken, agentIP string, agentPort int, agentTLS bool) error
+	Stop() error
+
+	// SetInstanceProxies replaces the published instance ports.
+	SetInstanceProxies(proxies []frpc.Proxy) error
+	ClearInstanceProxies() error
+	InstanceProxies() []frpc.Proxy
+
+	// CheckHealth probes the tunnel and records the result for Health.
+	CheckHealth(ctx context.Context) domain.TunnelStatus
+	// Health returns the last recorded status, or nil before the first check.
+	Health() *domain.TunnelStatus
+
+	// PID is the helper process to hand over on update, or 0.
+	PID() int
+}
+
+var (
+	_ Provider = (*frpc.Process)(nil)
+	_ Provider = (*WireGuard)(nil)
+)
+
+// Monitor checks the tunnel every healthInterval until ctx is cancelled. A
+// tunnel down for longer than threshold raises a tunnel_down event through
+// publish, and recovering from that raises another, so an outage is
+// reported instead of retried silently.
+func Monitor(ctx context.Context, p Provider, threshold time.Duration, publish func(domain.Event), logger *slog.Logger) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	alerted := false
+	for {
+		st := p.CheckHealth(ctx)
+		if st.Up {
+			metrics.TunnelUp.Set(1)
+		} else {
+			metrics.TunnelUp.Set(0)
+		}
+
+		switch {
+		case !st.Up && !alerted && time.Since(st.Since) >= threshold:
+			alerted = true
+			logger.Warn("tunnel down", "since", st.Since, "err", st.Error, "down", downProxies(st))
+			publish(domain.Event{
+				Type:     domain.EventTunnelDown,
+				Severity: domain.SeverityWarning,
+				Message:  "tunnel down for longer than the threshold",
+				Data: map[string]any{
+					"since":        st.Since,
+					"threshold_s":  int(threshold.Seconds()),
+					"error":        st.Error,
+					"down_proxies": downProxies(st),
+				},
+				Time: time.Now().UTC(),
+			})
+		case st.Up && alerted:
+			alerted = false
+			logger.Info("tunnel back up")
+			publish(domain.Event{
+				Type:     domain.EventTunnelDown,
+				Severity: domain.SeverityInfo,
+				Message:  "tunnel back up",
+				Data:     map[string]any{"since": st.Since},
+				Time:     time.Now().UTC(),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// InstanceHealth is the Health of p narrowed to the instance proxies: Up
+// and Since describe those alone, so an agent proxy outage does not mark
+// the instance unreachable. It is nil before the first check or without
+// instance proxies.
+func InstanceHealth(p Provider) *domain.TunnelStatus {
+	st := p.Health()
+	if st == nil {
+		return nil
+	}
+	names := map[string]bool{}
+	for _, px := range p.InstanceProxies() {
+		names[px.Name] = true
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	out := &domain.TunnelStatus{Up: st.Error == "", Since: st.Since, CheckedAt: st.CheckedAt, Error: st.Error}
+	if st.Error != "" {
+		return out
+	}
+	var upSince, downSince time.Time
+	for _, ph := range st.Proxies {
+		if !names[ph.Name] {
+			continue
+		}
+		out.Proxies = append(out.Proxies, ph)
+		if ph.Up {
+			if ph.Since.After(upSince) {
+				upSince = ph.Since
+			}
+		} else {
+			out.Up = false
+			if downSince.IsZero() || ph.Since.Before(downSince) {
+				downSince = ph.Since
+			}
+		}
+	}
+	// A proxy the tunnel does not report yet has not connected.
+	if len(out.Proxies) < len(names) {
+		out.Up = false
+		if downSince.IsZero() {
+			downSince = st.CheckedAt
+		}
+	}
+	if out.Up {
+		out.Since = upSince
+	} else {
+		out.Since = downSince
+	}
+	return out
+}
+
+func downProxies(st domain.TunnelStatus) []string {
+	var names []string
+	for _, ph := range st.Proxies {
+		if !ph.Up {
+			names = append(names, ph.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,379 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/frpc"
+)
+
+const (
+	wgKeepalive = 25
+	// wgHandshakeTimeout is how old the last handshake may be before the
+	// link counts as down. With keepalives WireGuard handshakes every two
+	// minutes.
+	wgHandshakeTimeout = 3 * time.Minute
+	wgDialTimeout      = 10 * time.Second
+)
+
+// WireGuardConfig describes the link to the control plane's gateway.
+type WireGuardConfig struct {
+	Interface string
+	// Address is this host on the tunnel, in CIDR form.
+	Address       string
+	Endpoint      string
+	PeerPublicKey string
+	// AllowedIPs are routed to the gateway; the Address network always is.
+	AllowedIPs []string
+	// PrivateKeyPath holds the host key; one is generated when it is missing.
+	PrivateKeyPath string
+}
+
+// WireGuard brings up a wg interface to the gateway and publishes each
+// proxy as a TCP listener on the tunnel address, forwarding to the proxy's
+// local port. A proxy is published on its remote port, or on its local
+// port when it has none and the gateway routes it by domain.
+type WireGuard struct {
+	cfg    WireGuardConfig
+	ip     net.IP
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	up        bool
+	agent     *wgForward
+	instances []frpc.Proxy
+	forwards  []*wgForward
+
+	healthMu sync.Mutex
+	health   *domain.TunnelStatus
+}
+
+// wgForward is one proxy published on the tunnel address.
+type wgForward struct {
+	proxy frpc.Proxy
+	ln    net.Listener
+}
+
+// NewWireGuard checks cfg; nothing is set up until Start.
+func NewWireGuard(cfg WireGuardConfig, logger *slog.Logger) (*WireGuard, error) {
+	ip, _, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard address: %w", err)
+	}
+	if cfg.Endpoint == "" || cfg.PeerPublicKey == "" {
+		return nil, errors.New("wireguard endpoint and peer public key are required")
+	}
+	return &WireGuard{cfg: cfg, ip: ip, logger: logger}, nil
+}
+
+func (w *WireGuard) Start(agentID, tunnelToken, agentIP string, agentPort int, agentTLS bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.ensureKey(); err != nil {
+		return err
+	}
+	if err := w.linkUp(); err != nil {
+		w.linkDown()
+		return err
+	}
+	w.up = true
+
+	fw, err := w.listen(frpc.Proxy{
+		Name:      fmt.Sprintf("agent-%s", agentID),
+		Type:      "tcp",
+		LocalIP:   agentIP,
+		LocalPort: agentPort,
+	})
+	if err != nil {
+		w.stopLocked()
+		return err
+	}
+	w.agent = fw
+	return nil
+}
+
+func (w *WireGuard) Stop() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stopLocked()
+}
+
+func (w *WireGuard) stopLocked() error {
+	w.closeForwards()
+	if w.agent != nil {
+		w.agent.ln.Close()
+		w.agent = nil
+	}
+	if !w.up {
+		return nil
+	}
+	w.up = false
+	return w.linkDown()
+}
+
+// SetInstanceProxies replaces the instance listeners. Connections already
+// established through the old ones are left to finish.
+func (w *WireGuard) SetInstanceProxies(proxies []frpc.Proxy) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.up {
+		return errors.New("wireguard tunnel not started")
+	}
+	w.closeForwards()
+	w.instances = append([]frpc.Proxy(nil), proxies...)
+
+	var errs []error
+	for _, p := range proxies {
+		fw, err := w.listen(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		w.forwards = append(w.forwards, fw)
+	}
+	w.logger.Info("wireguard proxies updated", "proxies", len(w.forwards))
+	return errors.Join(errs...)
+}
+
+func (w *WireGuard) ClearInstanceProxies() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeForwards()
+	w.instances = nil
+	return nil
+}
+
+// InstanceProxies returns a copy of the instance proxies currently configured.
+func (w *WireGuard) InstanceProxies() []frpc.Proxy {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]frpc.Proxy(nil), w.instances...)
+}
+
+// PID is always 0: the kernel keeps the interface, so nothing is handed over.
+func (w *WireGuard) PID() int { return 0 }
+
+func (w *WireGuard) Health() *domain.TunnelStatus {
+	w.healthMu.Lock()
+	defer w.healthMu.Unlock()
+	return w.health.Clone()
+}
+
+// CheckHealth reads the time of the last handshake with the gateway. Each
+// proxy is as up as the link, except one whose listener could not be opened.
+func (w *WireGuard) CheckHealth(ctx context.Context) domain.TunnelStatus {
+	now := time.Now().UTC()
+	st := domain.TunnelStatus{Up: true, Since: now, CheckedAt: now, Server: w.cfg.Endpoint}
+	if err := w.handshakeFresh(ctx); err != nil {
+		st.Up = false
+		st.Error = err.Error()
+	}
+
+	w.mu.Lock()
+	listening := map[string]*wgForward{}
+	all := append([]*wgForward(nil), w.forwards...)
+	if w.agent != nil {
+		all = append(all, w.agent)
+	}
+	for _, fw := range all {
+		listening[fw.proxy.Name] = fw
+	}
+	proxies := append([]frpc.Proxy(nil), w.instances...)
+	if w.agent != nil {
+		proxies = append(proxies, w.agent.proxy)
+	}
+	w.mu.Unlock()
+
+	for _, p := range proxies {
+		ph := domain.ProxyHealth{Name: p.Name, Type: p.Type, Up: st.Up, Status: "running", Since: now}
+		if fw := listening[p.Name]; fw != nil {
+			ph.RemoteAddr = fw.ln.Addr().String()
+		} else {
+			ph.Up = false
+			ph.Status = "start error"
+			ph.Error = "listener not open"
+		}
+		if !st.Up {
+			ph.Status = "tunnel down"
+		}
+		if !ph.Up {
+			st.Up = false
+		}
+		st.Proxies = append(st.Proxies, ph)
+	}
+
+	w.healthMu.Lock()
+	defer w.healthMu.Unlock()
+	st.CarrySince(w.health)
+	w.health = &st
+	return st
+}
+
+func (w *WireGuard) handshakeFresh(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "wg", "show", w.cfg.Interface, "latest-handshakes").Output()
+	if err != nil {
+		return fmt.Errorf("wg show: %w", err)
+	}
+	var latest int64
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] == w.cfg.PeerPublicKey {
+			latest, _ = strconv.ParseInt(f[1], 10, 64)
+		}
+	}
+	if latest == 0 {
+		return errors.New("no handshake with the gateway yet")
+	}
+	if age := time.Since(time.Unix(latest, 0)); age > wgHandshakeTimeout {
+		return fmt.Errorf("last handshake with the gateway %s ago", age.Truncate(time.Second))
+	}
+	return nil
+}
+
+// ensureKey generates the host private key unless it already exists and
+// logs the public key the gateway has to know.
+func (w *WireGuard) ensureKey() error {
+	if _, err := os.Stat(w.cfg.PrivateKeyPath); errors.Is(err, os.ErrNotExist) {
+		key, err := exec.Command("wg", "genkey").Output()
+		if err != nil {
+			return fmt.Errorf("wg genkey: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(w.cfg.PrivateKeyPath), 0o700); err != nil {
+			return fmt.Errorf("wireguard key dir: %w", err)
+		}
+		if err := os.WriteFile(w.cfg.PrivateKeyPath, key, 0o600); err != nil {
+			return fmt.Errorf("write wireguard key: %w", err)
+		}
+	}
+	key, err := os.ReadFile(w.cfg.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("read wireguard key: %w", err)
+	}
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = bytes.NewReader(key)
+	pub, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("wg pubkey: %w", err)
+	}
+	w.logger.Info("wireguard host key", "public_key", strings.TrimSpace(string(pub)))
+	return nil
+}
+
+// linkUp recreates the interface, so a link left by a previous run with
+// other settings does not survive.
+func (w *WireGuard) linkUp() error {
+	dev := w.cfg.Interface
+	_ = exec.Command("ip", "link", "del", dev).Run()
+
+	wgArgs := []string{"set", dev, "private-key", w.cfg.PrivateKeyPath,
+		"peer", w.cfg.PeerPublicKey, "endpoint", w.cfg.Endpoint,
+		"persistent-keepalive", strconv.Itoa(wgKeepalive)}
+	if len(w.cfg.AllowedIPs) > 0 {
+		wgArgs = append(wgArgs, "allowed-ips", strings.Join(w.cfg.AllowedIPs, ","))
+	}
+
+	steps := [][]string{
+		{"ip", "link", "add", dev, "type", "wireguard"},
+		append([]string{"wg"}, wgArgs...),
+		{"ip", "address", "add", w.cfg.Address, "dev", dev},
+		{"ip", "link", "set", dev, "up"},
+	}
+	for _, cidr := range w.cfg.AllowedIPs {
+		steps = append(steps, []string{"ip", "route", "replace", cidr, "dev", dev})
+	}
+	for _, args := range steps {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", strings.Join(args[:3], " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	w.logger.Info("wireguard tunnel up", "interface", dev, "address", w.cfg.Address, "endpoint", w.cfg.Endpoint)
+	return nil
+}
+
+func (w *WireGuard) linkDown() error {
+	if out, err := exec.Command("ip", "link", "del", w.cfg.Interface).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip link del: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// listen publishes p on the tunnel address. Must be called with w.mu held.
+func (w *WireGuard) listen(p frpc.Proxy) (*wgForward, error) {
+	port := p.RemotePort
+	if port == 0 {
+		port = p.LocalPort
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(w.ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("publish %s: %w", p.Name, err)
+	}
+	fw := &wgForward{proxy: p, ln: ln}
+	go w.serve(fw)
+	return fw, nil
+}
+
+// closeForwards closes the instance listeners. Must be called with w.mu held.
+func (w *WireGuard) closeForwards() {
+	for _, fw := range w.forwards {
+		fw.ln.Close()
+	}
+	w.forwards = nil
+}
+
+func (w *WireGuard) serve(fw *wgForward) {
+	target := net.JoinHostPort(fw.proxy.LocalIP, strconv.Itoa(fw.proxy.LocalPort))
+	for {
+		conn, err := fw.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				w.logger.Warn("wireguard accept failed", "proxy", fw.proxy.Name, "err", err)
+			}
+			return
+		}
+		go w.forward(conn, target)
+	}
+}
+
+func (w *WireGuard) forward(client net.Conn, target string) {
+	defer client.Close()
+
+	upstream, err := net.DialTimeout("tcp", target, wgDialTimeout)
+	if err != nil {
+		w.logger.Warn("wireguard upstream unreachable", "target", target, "err", err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		if tc, ok := upstream.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		if tc, ok := client.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
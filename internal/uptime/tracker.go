@@ -0,0 +1,170 @@
+// Package uptime measures agent and instance availability for SLA reporting.
+package uptime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+	"github.com/qudata/agent/internal/storage"
+)
+
+const (
+	// agentGap is the silence after which the agent is considered to have been down.
+	agentGap = 3 * time.Minute
+	// retention bounds how long closed intervals are kept locally.
+	retention = 35 * 24 * time.Hour
+)
+
+// Tracker records downtime intervals and persists them so that gaps spanning
+// an agent restart are accounted for.
+type Tracker struct {
+	store *storage.Store
+
+	mu    sync.Mutex
+	state domain.UptimeState
+}
+
+// NewTracker loads persisted state and records the downtime since the agent
+// was last seen alive.
+func NewTracker(store *storage.Store) (*Tracker, error) {
+	st, err := store.LoadUptime()
+	if err != nil {
+		return nil, fmt.Errorf("load uptime state: %w", err)
+	}
+	t := &Tracker{store: store}
+	if st != nil {
+		t.state = *st
+	}
+
+	now := time.Now().UTC()
+	last := t.state.LastSeen
+	if open := t.state.OpenInstance; open != nil {
+		// The previous run ended while the instance was down.
+		t.closeLocked(*open, last)
+		t.state.OpenInstance = nil
+	}
+	if !last.IsZero() && now.Sub(last) > agentGap {
+		t.addLocked(domain.DowntimeAgent, last, now, "agent_down")
+		if t.state.InstanceActive {
+			t.addLocked(domain.DowntimeInstance, last, now, "agent_down")
+		}
+	}
+	t.state.LastSeen = now
+	return t, t.saveLocked()
+}
+
+// Observe records a liveness sample. active tells whether an instance is
+// expected to be serving; up whether it actually is.
+func (t *Tracker) Observe(active, up bool, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	t.state.LastSeen = now
+	t.state.InstanceActive = active
+
+	switch {
+	case active && !up:
+		if t.state.OpenInstance == nil {
+			t.state.OpenInstance = &domain.DowntimeInterval{Scope: domain.DowntimeInstance, Start: now, Reason: reason}
+		}
+	case t.state.OpenInstance != nil:
+		t.closeLocked(*t.state.OpenInstance, now)
+		t.state.OpenInstance = nil
+	}
+
+	t.pruneLocked(now)
+	return t.saveLocked()
+}
+
+// Heartbeat summarizes availability over the trailing window and lists
+// the intervals not yet acknowledged.
+func (t *Tracker) Heartbeat(window time.Duration) domain.Heartbeat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	from := now.Add(-window)
+
+	var agentDown, instDown time.Duration
+	hb := domain.Heartbeat{Time: now, WindowSeconds: int64(window.Seconds())}
+	for _, iv := range t.state.Intervals {
+		d := overlap(iv.Start, iv.End, from, now)
+		if iv.Scope == domain.DowntimeAgent {
+			agentDown += d
+		} else {
+			instDown += d
+		}
+		if iv.Seq > t.state.AckedSeq {
+			hb.Intervals = append(hb.Intervals, iv)
+		}
+	}
+	if open := t.state.OpenInstance; open != nil {
+		instDown += overlap(open.Start, now, from, now)
+	}
+
+	hb.AgentDowntimeSeconds = agentDown.Seconds()
+	hb.InstanceDowntimeSeconds = instDown.Seconds()
+	hb.AgentAvailability = 1 - agentDown.Seconds()/window.Seconds()
+	hb.InstanceAvailability = 1 - instDown.Seconds()/window.Seconds()
+	return hb
+}
+
+// Ack marks intervals up to seq as delivered.
+func (t *Tracker) Ack(seq uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq <= t.state.AckedSeq {
+		return nil
+	}
+	t.state.AckedSeq = seq
+	return t.saveLocked()
+}
+
+func (t *Tracker) addLocked(scope string, start, end time.Time, reason string) {
+	t.state.NextSeq++
+	t.state.Intervals = append(t.state.Intervals, domain.DowntimeInterval{
+		Seq:    t.state.NextSeq,
+		Scope:  scope,
+		Start:  start,
+		End:    end,
+		Reason: reason,
+	})
+}
+
+func (t *Tracker) closeLocked(open domain.DowntimeInterval, end time.Time) {
+	if end.After(open.Start) {
+		t.addLocked(open.Scope, open.Start, end, open.Reason)
+	}
+}
+
+func (t *Tracker) pruneLocked(now time.Time) {
+	cutoff := now.Add(-retention)
+	kept := t.state.Intervals[:0]
+	for _, iv := range t.state.Intervals {
+		if iv.End.After(cutoff) || iv.Seq > t.state.AckedSeq {
+			kept = append(kept, iv)
+		}
+	}
+	t.state.Intervals = kept
+}
+
+func (t *Tracker) saveLocked() error {
+	state := t.state
+	return t.store.SaveUptime(&state)
+}
+
+func overlap(start, end, from, to time.Time) time.Duration {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
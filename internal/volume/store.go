@@ -0,0 +1,288 @@
+// Package volume manages the persistent data volumes instances attach: qcow2
+// disks kept on the host independently of the instance disk, so that their
+// contents survive the instance being deleted and recreated.
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qudata/agent/internal/domain"
+)
+
+// Subdir is the directory under ImageDir holding the volumes.
+const Subdir = "volumes"
+
+var (
+	ErrNotFound    = errors.New("volume not found")
+	ErrExists      = errors.New("volume already exists")
+	ErrInvalidName = errors.New("volume name must be 1-20 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+)
+
+// The name is the serial of the guest disk, which virtio-blk caps at 20
+// bytes, and a directory under domain.VolumeMountDir.
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,19}$`)
+
+// Store keeps each volume as <dir>/<name>.qcow2 next to a <name>.json
+// holding its metadata.
+type Store struct {
+	dir string
+
+	mu sync.Mutex
+	// importing holds the names of volumes being imported.
+	importing map[string]bool
+}
+
+// NewStore creates a Store keeping volumes under imageDir.
+func NewStore(imageDir string) *Store {
+	return &Store{dir: filepath.Join(imageDir, Subdir), importing: map[string]bool{}}
+}
+
+// ValidName reports whether name can name a volume.
+func ValidName(name string) bool {
+	return nameRe.MatchString(name)
+}
+
+// List returns the volumes by name.
+func (s *Store) List() ([]domain.Volume, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]domain.Volume, 0, len(matches))
+	for _, path := range matches {
+		v, err := s.load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Get returns the volume called name and the path of its disk.
+func (s *Store) Get(name string) (domain.Volume, string, error) {
+	if !ValidName(name) {
+		return domain.Volume{}, "", ErrInvalidName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.load(name)
+	if err != nil {
+		return domain.Volume{}, "", err
+	}
+	return v, s.diskPath(name), nil
+}
+
+// Create creates an empty volume of sizeGB. The guest formats it the first
+// time it is attached.
+func (s *Store) Create(name string, sizeGB int) (domain.Volume, error) {
+	if !ValidName(name) {
+		return domain.Volume{}, ErrInvalidName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.claimLocked(name); err != nil {
+		return domain.Volume{}, err
+	}
+	path := s.diskPath(name)
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", path, fmt.Sprintf("%dG", sizeGB))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(path)
+		return domain.Volume{}, fmt.Errorf("qemu-img create: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return s.commit(name, sizeGB)
+}
+
+// Import creates a volume from a qcow2 image read from r, such as one
+// written by Open. The volume does not exist until the image is complete.
+func (s *Store) Import(name string, r io.Reader) (domain.Volume, error) {
+	if !ValidName(name) {
+		return domain.Volume{}, ErrInvalidName
+	}
+	s.mu.Lock()
+	err := s.claimLocked(name)
+	if err == nil {
+		s.importing[name] = true
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return domain.Volume{}, err
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.importing, name)
+		s.mu.Unlock()
+	}()
+
+	part := s.diskPath(name) + ".part"
+	sizeGB, err := receiveImage(part, r)
+	if err != nil {
+		_ = os.Remove(part)
+		return domain.Volume{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(part, s.diskPath(name)); err != nil {
+		_ = os.Remove(part)
+		return domain.Volume{}, err
+	}
+	return s.commit(name, sizeGB)
+}
+
+// Open opens the disk of a volume for reading, with its size in bytes.
+// The caller makes sure nothing writes to it meanwhile.
+func (s *Store) Open(name string) (*os.File, int64, error) {
+	if _, _, err := s.Get(name); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.diskPath(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// claimLocked checks that name is free and that the volume dir exists.
+func (s *Store) claimLocked(name string) error {
+	if _, err := os.Stat(s.metaPath(name)); err == nil || s.importing[name] {
+		return ErrExists
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("create volume dir: %w", err)
+	}
+	return nil
+}
+
+// commit writes the metadata of a volume whose disk is in place. It is
+// written last: a volume without it does not exist.
+func (s *Store) commit(name string, sizeGB int) (domain.Volume, error) {
+	path := s.diskPath(name)
+	v := domain.Volume{Name: name, SizeGB: sizeGB, CreatedAt: time.Now().UTC()}
+	data, err := json.Marshal(v)
+	if err != nil {
+		_ = os.Remove(path)
+		return domain.Volume{}, err
+	}
+	tmp := s.metaPath(name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		_ = os.Remove(path)
+		return domain.Volume{}, fmt.Errorf("write volume metadata: %w", err)
+	}
+	if err := os.Rename(tmp, s.metaPath(name)); err != nil {
+		_ = os.Remove(tmp)
+		_ = os.Remove(path)
+		return domain.Volume{}, fmt.Errorf("write volume metadata: %w", err)
+	}
+	return v, nil
+}
+
+type imageInfo struct {
+	Format          string `json:"format"`
+	VirtualSize     int64  `json:"virtual-size"`
+	BackingFilename string `json:"backing-filename"`
+	FormatSpecific  struct {
+		Data struct {
+			DataFile string `json:"data-file"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+// receiveImage writes r to path and checks that it is a self-contained
+// qcow2 image, returning its size in GB. An image referring to other files
+// would let the guest read them from the host.
+func receiveImage(path string, r io.Reader) (int, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	out, err := exec.Command("qemu-img", "info", "--output=json", path).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("qemu-img info: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	var info imageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, fmt.Errorf("parse qemu-img info: %w", err)
+	}
+	switch {
+	case info.Format != "qcow2":
+		return 0, fmt.Errorf("image is %s, not qcow2", info.Format)
+	case info.BackingFilename != "" || info.FormatSpecific.Data.DataFile != "":
+		return 0, errors.New("image refers to other files")
+	}
+	return int((info.VirtualSize + 1<<30 - 1) >> 30), nil
+}
+
+// Delete removes the volume and its data. The caller makes sure it is not
+// attached.
+func (s *Store) Delete(name string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.load(name); err != nil {
+		return err
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil {
+		return fmt.Errorf("remove volume metadata: %w", err)
+	}
+	if err := os.Remove(s.diskPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove volume disk: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) load(name string) (domain.Volume, error) {
+	data, err := os.ReadFile(s.metaPath(name))
+	if os.IsNotExist(err) {
+		return domain.Volume{}, ErrNotFound
+	}
+	if err != nil {
+		return domain.Volume{}, err
+	}
+	var v domain.Volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return domain.Volume{}, fmt.Errorf("parse volume %s: %w", name, err)
+	}
+	return v, nil
+}
+
+func (s *Store) diskPath(name string) string {
+	return filepath.Join(s.dir, name+".qcow2")
+}
+
+func (s *Store) metaPath(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
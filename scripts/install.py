@@ -5,13 +5,11 @@ import argparse
 import json
 import os
 import re
-import select
 import shutil
 import subprocess
 import sys
 import textwrap
 import time
-import urllib.request
 from pathlib import Path
 
 AGENT_NAME = "qudata-agent"
@@ -35,9 +33,6 @@ REPO_URL = os.environ.get(
 GO_VERSION = "1.23.4"
 FRP_VERSION = "0.61.1"
 
-DEBIAN_CLOUD_IMAGE = (
-    "https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-generic-amd64.qcow2"
-)
 BASE_IMAGE_PATH = IMAGE_DIR / "qudata-base.qcow2"
 
 
@@ -270,212 +265,22 @@ def generate_ssh_key():
 
 
 # ---------------------------------------------------------------------------
-# Base image (Ubuntu + NVIDIA driver, no Docker)
+# Base image (Ubuntu + NVIDIA driver + Docker)
 # ---------------------------------------------------------------------------
 
-def create_cloud_init_iso(ssh_pubkey):
-    ci_dir = IMAGE_DIR / "cloud-init"
-    ci_dir.mkdir(parents=True, exist_ok=True)
-
-    (ci_dir / "meta-data").write_text(
-        "instance-id: qudata-customize\nlocal-hostname: qudata-base\n"
-    )
-
-    user_data = textwrap.dedent(
-        f"""\
-        #cloud-config
-
-        ssh_authorized_keys:
-          - {ssh_pubkey}
-
-        write_files:
-          - path: /etc/apt/sources.list
-            content: |
-              deb http://deb.debian.org/debian bookworm main contrib non-free non-free-firmware
-              deb http://deb.debian.org/debian bookworm-updates main contrib non-free non-free-firmware
-              deb http://security.debian.org/debian-security bookworm-security main contrib non-free non-free-firmware
-
-        runcmd:
-          - echo 'debconf debconf/frontend select Noninteractive' | debconf-set-selections
-
-          - |
-            for i in $(seq 1 30); do
-              ping -c1 8.8.8.8 >/dev/null 2>&1 && break
-              sleep 2
-            done
-
-          - DEBIAN_FRONTEND=noninteractive apt-get update
-          - DEBIAN_FRONTEND=noninteractive apt-get install -y -o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold" openssh-server curl wget gnupg ca-certificates
-
-          - DEBIAN_FRONTEND=noninteractive apt-get install -y -o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold" nvidia-driver || true
-
-          - mkdir -p /root/.ssh
-          - chmod 700 /root/.ssh
-          - sed -i 's/^#*PermitRootLogin.*/PermitRootLogin prohibit-password/' /etc/ssh/sshd_config
-          - sed -i 's/^#*PubkeyAuthentication.*/PubkeyAuthentication yes/' /etc/ssh/sshd_config
-          - systemctl enable ssh
-
-          - |
-            cat > /etc/systemd/network/99-dhcp-all.network << 'NETEOF'
-            [Match]
-            Name=en*
-
-            [Network]
-            DHCP=yes
-            NETEOF
-          - systemctl enable systemd-networkd
-
-          - apt-get clean
-          - rm -rf /var/lib/apt/lists/*
-
-          - systemctl disable cloud-init cloud-init-local cloud-config cloud-final 2>/dev/null || true
-          - touch /etc/cloud/cloud-init.disabled
-          - cloud-init clean --logs
-
-          - touch /var/lib/cloud/instance/customization-complete
-          - poweroff
-    """
-    )
-    (ci_dir / "user-data").write_text(user_data)
-
-    iso_path = IMAGE_DIR / "cloud-init.iso"
-    run(
-        [
-            "genisoimage",
-            "-output",
-            str(iso_path),
-            "-volid",
-            "cidata",
-            "-joliet",
-            "-rock",
-            str(ci_dir / "user-data"),
-            str(ci_dir / "meta-data"),
-        ]
-    )
-    shutil.rmtree(ci_dir)
-    return iso_path
-
-
-def download_base_image():
-    print("\n-> Preparing base image (Debian)")
-
-    IMAGE_DIR.mkdir(parents=True, exist_ok=True)
+def build_base_image(api_key):
+    """Build the base image with `qudata-agent build-image`."""
+    print("\n-> Preparing base image")
 
     if BASE_IMAGE_PATH.exists():
         print("  + Base image already exists")
         return
 
-    ssh_pubkey = generate_ssh_key()
-
-    print("  + Downloading Debian cloud image")
-    tmp_image = IMAGE_DIR / "debian-cloud.qcow2"
-    urllib.request.urlretrieve(DEBIAN_CLOUD_IMAGE, tmp_image)
-
-    print("  + Resizing to 20 GB")
-    run(["qemu-img", "resize", str(tmp_image), "20G"])
-
-    if not shutil.which("genisoimage"):
-        apt_install(["genisoimage"])
-
-    print("  + Creating cloud-init config")
-    ci_iso = create_cloud_init_iso(ssh_pubkey)
-
-    print("  + Starting VM for customisation (may take 10-15 min with driver install)")
-
-    qemu_cmd = [
-        "qemu-system-x86_64",
-        "-machine",
-        "q35,accel=kvm",
-        "-cpu",
-        "host",
-        "-m",
-        "4096",
-        "-smp",
-        "4",
-        "-drive",
-        f"file={tmp_image},format=qcow2,if=virtio",
-        "-drive",
-        f"file={ci_iso},format=raw,if=virtio,readonly=on",
-        "-netdev",
-        "user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22",
-        "-device",
-        "virtio-net-pci,netdev=net0",
-        "-nographic",
-        "-serial",
-        "mon:stdio",
-    ]
-
-    proc = subprocess.Popen(
-        qemu_cmd,
-        stdout=subprocess.PIPE,
-        stderr=subprocess.STDOUT,
-        text=True,
-        bufsize=1,
-    )
-
-    start_time = time.time()
-    timeout = 20 * 60
-
-    try:
-        while proc.poll() is None:
-            if time.time() - start_time > timeout:
-                proc.terminate()
-                proc.wait(timeout=10)
-                raise TimeoutError("VM customisation timed out")
-
-            if select.select([proc.stdout], [], [], 1.0)[0]:
-                line = proc.stdout.readline()
-                if line:
-                    print(f"    {line.rstrip()}")
-
-        for line in proc.stdout:
-            print(f"    {line.rstrip()}")
-
-        if proc.returncode != 0:
-            raise subprocess.CalledProcessError(proc.returncode, qemu_cmd)
-    except KeyboardInterrupt:
-        proc.terminate()
-        proc.wait(timeout=10)
-        raise
-    finally:
-        ci_iso.unlink(missing_ok=True)
-
-    print("  + Verifying customisation")
-
-    if not shutil.which("virt-cat"):
-        apt_install(["libguestfs-tools"])
-
-    check = run(
-        [
-            "virt-cat",
-            "-a",
-            str(tmp_image),
-            "/var/lib/cloud/instance/customization-complete",
-        ],
-        check=False,
-    )
-    if check.returncode != 0:
-        print("  ! Warning: customisation may not have completed")
-
-    print("  + Cleaning cloud-init state")
-    run(
-        [
-            "virt-customize",
-            "-a",
-            str(tmp_image),
-            "--delete",
-            "/var/lib/cloud/instance/customization-complete",
-            "--run-command",
-            "rm -rf /var/lib/cloud/instances/*",
-            "--run-command",
-            "rm -f /etc/machine-id",
-            "--run-command",
-            "truncate -s 0 /etc/machine-id",
-        ],
-        check=False,
-    )
-
-    tmp_image.rename(BASE_IMAGE_PATH)
+    generate_ssh_key()
+    print("  + Building (may take 10-15 min with driver install)")
+    env = dict(os.environ, QUDATA_API_KEY=api_key)
+    run([str(BINARY_PATH), "build-image", f"--output={BASE_IMAGE_PATH}"],
+        capture=False, env=env)
     print("  + Base image ready")
 
 
@@ -489,86 +294,6 @@ def stop_running_agent():
         time.sleep(1)
 
 
-def prepare_base_image():
-    """Inject management SSH key, fix networking, harden SSH, disable cloud-init."""
-    if not (SSH_DIR / "management_key").exists():
-        generate_ssh_key()
-
-    pub_key_content = (SSH_DIR / "management_key.pub").read_text().strip()
-    print("  + Configuring base image")
-
-    run([
-        "virt-customize", "-a", str(BASE_IMAGE_PATH),
-
-        # SSH key
-        "--mkdir", "/root/.ssh",
-        "--chmod", "0700:/root/.ssh",
-        "--write", f"/root/.ssh/authorized_keys:{pub_key_content}",
-        "--chmod", "0600:/root/.ssh/authorized_keys",
-
-        # Network: clean old configs, force systemd-networkd with wildcard DHCP
-        "--run-command",
-        "rm -f /etc/network/interfaces.d/* /etc/netplan/*.yaml "
-        "/etc/systemd/network/[0-8]*.network 2>/dev/null; "
-        "printf 'auto lo\\niface lo inet loopback\\n' > /etc/network/interfaces; "
-        "mkdir -p /etc/systemd/network && "
-        "printf '[Match]\\nName=en*\\n\\n[Network]\\nDHCP=yes\\n' "
-        "> /etc/systemd/network/99-dhcp-all.network; "
-        "systemctl enable systemd-networkd 2>/dev/null; "
-        "systemctl disable networking 2>/dev/null; "
-        "mkdir -p /etc/systemd/system/systemd-networkd-wait-online.service.d && "
-        "printf '[Service]\\nExecStart=\\nExecStart=/lib/systemd/systemd-networkd-wait-online --any --timeout=10\\n' "
-        "> /etc/systemd/system/systemd-networkd-wait-online.service.d/any.conf; "
-        "true",
-
-        # SSH: allow root login, disable locale forwarding, enable keepalive
-        # (prevents idle tunnel disconnects through FRP/SLIRP chain)
-        "--run-command",
-        "sed -i 's/^#*PermitRootLogin.*/PermitRootLogin yes/' /etc/ssh/sshd_config; "
-        "sed -i 's/^#*PubkeyAuthentication.*/PubkeyAuthentication yes/' /etc/ssh/sshd_config; "
-        "sed -i 's/^#*PasswordAuthentication.*/PasswordAuthentication yes/' /etc/ssh/sshd_config; "
-        "sed -i 's/^AcceptEnv.*/#AcceptEnv/' /etc/ssh/sshd_config; "
-        "sed -i 's/^#*ClientAliveInterval.*/ClientAliveInterval 30/' /etc/ssh/sshd_config; "
-        "grep -q '^ClientAliveInterval' /etc/ssh/sshd_config || echo 'ClientAliveInterval 30' >> /etc/ssh/sshd_config; "
-        "sed -i 's/^#*ClientAliveCountMax.*/ClientAliveCountMax 3/' /etc/ssh/sshd_config; "
-        "grep -q '^ClientAliveCountMax' /etc/ssh/sshd_config || echo 'ClientAliveCountMax 3' >> /etc/ssh/sshd_config; "
-        "systemctl enable ssh 2>/dev/null; systemctl enable sshd 2>/dev/null; true",
-
-        # Set sane default locale
-        "--run-command",
-        "echo 'LANG=en_US.UTF-8' > /etc/default/locale; "
-        "echo 'en_US.UTF-8 UTF-8' >> /etc/locale.gen; "
-        "locale-gen en_US.UTF-8 2>/dev/null; true",
-
-        # Disable cloud-init
-        "--run-command",
-        "systemctl disable cloud-init cloud-init-local cloud-config cloud-final 2>/dev/null; "
-        "touch /etc/cloud/cloud-init.disabled; true",
-
-        # Disable noisy services for faster boot
-        "--run-command",
-        "systemctl disable apt-daily.timer apt-daily-upgrade.timer man-db.timer "
-        "fstrim.timer e2scrub_all.timer unattended-upgrades.service docker.service "
-        "docker.socket containerd.service 2>/dev/null; "
-        "systemctl mask snapd.service snapd.socket 2>/dev/null; true",
-
-        # Suppress cloud-init locale check
-        "--run-command",
-        "touch /var/lib/cloud/instance/locale-check.skip; true",
-    ])
-
-    # Verify
-    v = run(
-        ["virt-cat", "-a", str(BASE_IMAGE_PATH),
-         "/etc/systemd/network/99-dhcp-all.network"],
-        check=False,
-    )
-    if "Name=en*" in v.stdout:
-        print("  + Network: systemd-networkd wildcard DHCP")
-    else:
-        print("  ! WARNING: network config may not be correct")
-
-
 # ---------------------------------------------------------------------------
 # Test GPU passthrough
 # ---------------------------------------------------------------------------
@@ -1236,6 +961,7 @@ def create_service(api_key, gpus, debug, service_url, test_mode=False):
     if test_mode:
         exec_start += " --test"
 
+    # KillMode=process: QEMU outlives a restart of the agent, which adopts it.
     unit = textwrap.dedent(
         f"""\
         [Unit]
@@ -1243,10 +969,14 @@ def create_service(api_key, gpus, debug, service_url, test_mode=False):
         After=network.target
 
         [Service]
-        Type=simple
+        Type=notify
         ExecStart={exec_start}
+        ExecReload=/bin/kill -HUP $MAINPID
+        KillMode=process
         Restart=always
         RestartSec=10
+        TimeoutStartSec=20min
+        WatchdogSec=2min
         {chr(10).join(env)}
 
         [Install]
@@ -1312,8 +1042,7 @@ def phase1(args):
     if args.debug:
         create_service(args.api_key, [], True, args.service_url, args.test)
         stop_running_agent()
-        download_base_image()
-        prepare_base_image()
+        build_base_image(args.api_key)
         start_service()
         print_success()
         return
@@ -1398,8 +1127,7 @@ def phase2_continue(api_key, gpus, service_url, test_mode=False):
     print("\n-> IOMMU is active")
 
     stop_running_agent()
-    download_base_image()
-    prepare_base_image()
+    build_base_image(api_key)
 
     if gpus:
         working_count = run_gpu_test(gpus)